@@ -0,0 +1,166 @@
+package encryptfs
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// writeBatch is the state shared by the files written in one WriteFiles
+// call: the salt and derived key they share, if any, and the directories
+// that new files were created in, whose entries are synced once at the end
+type writeBatch struct {
+	salt []byte              // Shared salt, or nil if each file has its own
+	key  []byte              // Key derived for salt
+	dirs map[string][]string // Names of the files created, by encrypted parent directory
+}
+
+// sharesSalt reports whether salt is the batch's shared salt
+func (b *writeBatch) sharesSalt(salt []byte) bool {
+	return b.salt != nil && bytes.Equal(salt, b.salt)
+}
+
+// created defers the sync of the directory entry of name, created at
+// encryptedPath, to the end of the batch
+func (b *writeBatch) created(e *EncryptFS, name, encryptedPath string) {
+	dir := e.parentDir(encryptedPath)
+	b.dirs[dir] = append(b.dirs[dir], name)
+}
+
+// sharesKeys reports whether the files of a batch can share one salt and
+// key from provider. Providers that keep state for each salt they generate,
+// such as an ExternalKeyProvider handing out a new key for every file ID,
+// need a salt per file.
+func sharesKeys(provider KeyProvider) bool {
+	for {
+		multi, ok := provider.(*MultiKeyProvider)
+		if !ok {
+			break
+		}
+		provider = multi.primary
+	}
+	_, ok := provider.(saltDiscarder)
+	return !ok
+}
+
+// BatchError reports the outcome of a WriteFiles call in which some files
+// could not be written
+type BatchError struct {
+	Written []string         // Files written successfully, in sorted order
+	Failed  map[string]error // Files that could not be written, by name
+}
+
+func (e *BatchError) Error() string {
+	names := make([]string, 0, len(e.Failed))
+	for name := range e.Failed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if len(names) == 1 {
+		return fmt.Sprintf("batch write: %s: %v", names[0], e.Failed[names[0]])
+	}
+	return fmt.Sprintf("batch write: %d of %d files failed: %s",
+		len(names), len(names)+len(e.Written), strings.Join(names, ", "))
+}
+
+// Unwrap returns the errors of the failed files, so that errors.Is and
+// errors.As match any of them
+func (e *BatchError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Failed))
+	for _, err := range e.Failed {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// WriteFiles creates or truncates each named file and writes its contents,
+// as Create, Write and Close would. Unless Config.SharedSalt is set, which
+// already makes file keys cheap to derive, the files share one salt and a
+// single key derivation instead of paying for one per file; each file still
+// has its own random nonces. Providers that hand out a key per file, such as
+// an ExternalKeyProvider, still give each file its own. The directory entries
+// of new files are synced once per directory after all files are written,
+// rather than as each one is created; the other base filesystem operations
+// are those of a Create, Write and Close of each file.
+//
+// Files are written in sorted order, and a failure does not stop the rest of
+// the batch. If any file fails, WriteFiles returns a *BatchError listing the
+// files that were written and the error of each one that was not.
+func (e *EncryptFS) WriteFiles(files map[string][]byte) error {
+	if err := e.checkOpen("writefiles", ""); err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	shared := *e
+	shared.batch = &writeBatch{dirs: make(map[string][]string)}
+	batch := &shared
+	if !e.config.SharedSalt && len(names) > 1 && sharesKeys(e.keyProvider) {
+		salt, err := e.generateSalt()
+		if err != nil {
+			return fmt.Errorf("failed to generate salt: %w", err)
+		}
+		key, err := e.deriveKey(salt)
+		if err != nil {
+			return fmt.Errorf("failed to derive key: %w", err)
+		}
+		defer clear(key)
+
+		batch.batch.salt, batch.batch.key = salt, key
+	}
+
+	failed := make(map[string]error)
+	for _, name := range names {
+		if err := batch.writeFile(name, files[name]); err != nil {
+			failed[name] = err
+		}
+	}
+
+	// A directory that cannot be synced fails the files created in it, as
+	// their entries may not be durable
+	dirs := make([]string, 0, len(batch.batch.dirs))
+	for dir := range batch.batch.dirs {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	for _, dir := range dirs {
+		if err := e.syncDir(dir); err != nil {
+			for _, name := range batch.batch.dirs[dir] {
+				if _, ok := failed[name]; !ok {
+					failed[name] = err
+				}
+			}
+		}
+	}
+
+	var written []string
+	for _, name := range names {
+		if _, ok := failed[name]; !ok {
+			written = append(written, name)
+		}
+	}
+	if len(failed) > 0 {
+		return &BatchError{Written: written, Failed: failed}
+	}
+	return nil
+}
+
+// writeFile creates or truncates name and writes data to it
+func (e *EncryptFS) writeFile(name string, data []byte) error {
+	file, err := e.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,232 @@
+package encryptfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func TestWriteFiles(t *testing.T) {
+	for _, chunked := range []bool{false, true} {
+		t.Run(fmt.Sprintf("chunked=%v", chunked), func(t *testing.T) {
+			base, cleanup := setupTestFS(t)
+			defer cleanup()
+
+			provider := &countingKeyProvider{KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+				Memory:      64 * 1024,
+				Iterations:  1,
+				Parallelism: 2,
+			})}
+			config := &Config{Cipher: CipherAES256GCM, KeyProvider: provider}
+			if chunked {
+				config.ChunkSize = 4 * 1024
+			}
+			fs, err := New(base, config)
+			if err != nil {
+				t.Fatalf("failed to create EncryptFS: %v", err)
+			}
+			defer fs.Close()
+			if err := fs.ensureVerifyMarker(); err != nil {
+				t.Fatalf("failed to create verification marker: %v", err)
+			}
+			provider.derivations = 0
+
+			files := make(map[string][]byte)
+			for i := 0; i < 10; i++ {
+				files[fmt.Sprintf("/file-%d.txt", i)] = bytes.Repeat([]byte{byte(i)}, 100*i)
+			}
+			if err := fs.WriteFiles(files); err != nil {
+				t.Fatalf("WriteFiles failed: %v", err)
+			}
+
+			// The whole batch cost a single key derivation
+			if provider.derivations != 1 {
+				t.Errorf("%d derivations, want 1", provider.derivations)
+			}
+
+			// A new session reads every file back
+			reader, err := New(base, &Config{Cipher: CipherAES256GCM, KeyProvider: provider, ChunkSize: config.ChunkSize})
+			if err != nil {
+				t.Fatalf("failed to create EncryptFS: %v", err)
+			}
+			defer reader.Close()
+			for name, want := range files {
+				file, err := reader.Open(name)
+				if err != nil {
+					t.Fatalf("failed to open %s: %v", name, err)
+				}
+				got, err := io.ReadAll(file)
+				file.Close()
+				if err != nil {
+					t.Fatalf("failed to read %s: %v", name, err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Errorf("%s: got %d bytes, want %d", name, len(got), len(want))
+				}
+			}
+		})
+	}
+}
+
+func TestWriteFiles_PartialFailure(t *testing.T) {
+	base, cleanup := setupTestFS(t)
+	defer cleanup()
+
+	fs, err := New(base, &Config{
+		Cipher: CipherAES256GCM,
+		KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+			Memory:      64 * 1024,
+			Iterations:  1,
+			Parallelism: 2,
+		}),
+	})
+	if err != nil {
+		t.Fatalf("failed to create EncryptFS: %v", err)
+	}
+	defer fs.Close()
+
+	err = fs.WriteFiles(map[string][]byte{
+		"/a.txt":             []byte("a"),
+		"/a.txt/b.txt":       []byte("b"),
+		"/c.txt":             []byte("c"),
+		"/.encryptfs-verify": []byte("reserved"),
+	})
+
+	var batchErr *BatchError
+	if !errors.As(err, &batchErr) {
+		t.Fatalf("WriteFiles error = %v, want *BatchError", err)
+	}
+	if want := []string{"/a.txt", "/c.txt"}; fmt.Sprint(batchErr.Written) != fmt.Sprint(want) {
+		t.Errorf("Written = %v, want %v", batchErr.Written, want)
+	}
+	if len(batchErr.Failed) != 2 {
+		t.Fatalf("Failed = %v, want 2 entries", batchErr.Failed)
+	}
+	// A file cannot be created beneath another file
+	if batchErr.Failed["/a.txt/b.txt"] == nil {
+		t.Errorf("no error reported for /a.txt/b.txt")
+	}
+	if !errors.Is(err, ErrReservedPath) {
+		t.Errorf("errors.Is(err, ErrReservedPath) = false for %v", err)
+	}
+
+	// The files reported as written are complete
+	for _, name := range batchErr.Written {
+		file, err := fs.Open(name)
+		if err != nil {
+			t.Fatalf("failed to open %s: %v", name, err)
+		}
+		got, _ := io.ReadAll(file)
+		file.Close()
+		if want := name[1:2]; string(got) != want {
+			t.Errorf("%s content = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestWriteFiles_ExternalKeyProvider(t *testing.T) {
+	base, cleanup := setupTestFS(t)
+	defer cleanup()
+
+	keys := make(map[string][]byte)
+	provider := NewExternalKeyProvider(func(fileID, key []byte) error {
+		keys[string(fileID)] = key
+		return nil
+	}, func(fileID []byte) ([]byte, error) {
+		return keys[string(fileID)], nil
+	})
+	fs, err := New(base, &Config{Cipher: CipherAES256GCM, KeyProvider: provider})
+	if err != nil {
+		t.Fatalf("failed to create EncryptFS: %v", err)
+	}
+	defer fs.Close()
+
+	files := map[string][]byte{
+		"/a.txt": []byte("alpha"),
+		"/b.txt": []byte("beta"),
+		"/c.txt": []byte("gamma"),
+	}
+	if err := fs.WriteFiles(files); err != nil {
+		t.Fatalf("WriteFiles failed: %v", err)
+	}
+
+	// Every file has its own ID and key, each handed out once
+	if len(keys) != len(files) {
+		t.Fatalf("onKey called for %d file IDs, want %d", len(keys), len(files))
+	}
+	ids := make(map[string]bool)
+	for name, want := range files {
+		id, err := fs.FileID(name)
+		if err != nil {
+			t.Fatalf("FileID(%s) failed: %v", name, err)
+		}
+		if ids[string(id)] {
+			t.Errorf("%s shares its file ID with another file", name)
+		}
+		ids[string(id)] = true
+
+		file, err := fs.Open(name)
+		if err != nil {
+			t.Fatalf("failed to open %s: %v", name, err)
+		}
+		got, _ := io.ReadAll(file)
+		file.Close()
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s content = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestWriteFiles_SyncsDirectoriesOnce(t *testing.T) {
+	osBase, cleanup := setupTestFS(t)
+	defer cleanup()
+
+	base := &dirSyncerFS{FileSystem: osBase}
+	fs, err := New(base, &Config{
+		Cipher: CipherAES256GCM,
+		KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+			Memory:      64 * 1024,
+			Iterations:  1,
+			Parallelism: 2,
+		}),
+	})
+	if err != nil {
+		t.Fatalf("failed to create EncryptFS: %v", err)
+	}
+	defer fs.Close()
+	if err := fs.Mkdir("/sub", 0755); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+	if err := fs.ensureVerifyMarker(); err != nil {
+		t.Fatalf("failed to create verification marker: %v", err)
+	}
+	base.synced = nil
+
+	files := make(map[string][]byte)
+	for i := 0; i < 5; i++ {
+		files[fmt.Sprintf("/file-%d.txt", i)] = []byte("top")
+		files[fmt.Sprintf("/sub/file-%d.txt", i)] = []byte("nested")
+	}
+	if err := fs.WriteFiles(files); err != nil {
+		t.Fatalf("WriteFiles failed: %v", err)
+	}
+
+	subDir, err := fs.translatePath("/sub")
+	if err != nil {
+		t.Fatalf("failed to translate /sub: %v", err)
+	}
+	if want := []string{"/", subDir}; fmt.Sprint(base.synced) != fmt.Sprint(want) {
+		t.Errorf("synced %v, want %v", base.synced, want)
+	}
+
+	// Rewriting existing files creates no directory entries
+	base.synced = nil
+	if err := fs.WriteFiles(files); err != nil {
+		t.Fatalf("WriteFiles failed: %v", err)
+	}
+	if len(base.synced) != 0 {
+		t.Errorf("synced %v when rewriting existing files, want none", base.synced)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"runtime"
 	"testing"
 	"time"
 
@@ -500,6 +501,62 @@ func BenchmarkWriteChunked(b *testing.B) {
 	}
 }
 
+// BenchmarkOverwriteChunked benchmarks overwriting 1MB in the middle of a
+// chunked file, aligned to chunk boundaries and offset from them. Aligned
+// writes replace whole chunks without reading them first, which the
+// reads/op metric shows.
+func BenchmarkOverwriteChunked(b *testing.B) {
+	const chunkSize = 64 * 1024
+	offsets := []struct {
+		name string
+		off  int64
+	}{
+		{"Aligned", 4 * chunkSize},
+		{"Unaligned", 4*chunkSize + 100},
+	}
+
+	for _, offset := range offsets {
+		b.Run(offset.name, func(b *testing.B) {
+			base, cleanup := setupBenchFS(b)
+			defer cleanup()
+
+			metrics := &recordingMetrics{}
+			config := &Config{
+				Cipher: CipherAES256GCM,
+				KeyProvider: NewPasswordKeyProvider([]byte("benchmark"), Argon2idParams{
+					Memory:      64 * 1024,
+					Iterations:  1,
+					Parallelism: 2,
+				}),
+				ChunkSize: chunkSize,
+				Metrics:   metrics,
+			}
+			fs, _ := New(base, config)
+
+			// Create a 4MB test file
+			data := make([]byte, 4*1024*1024)
+			rand.Read(data)
+			file, _ := fs.Create("/bench.bin")
+			file.Write(data)
+			file.Close()
+
+			update := data[:1024*1024]
+			b.SetBytes(int64(len(update)))
+			metrics.misses = 0
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				file, _ := fs.OpenFile("/bench.bin", os.O_RDWR, 0)
+				file.WriteAt(update, offset.off)
+				file.Close()
+			}
+
+			b.StopTimer()
+			b.ReportMetric(float64(metrics.misses)/float64(b.N), "reads/op")
+		})
+	}
+}
+
 // BenchmarkReadTraditional benchmarks traditional (single-chunk) file reads
 func BenchmarkReadTraditional(b *testing.B) {
 	sizes := []struct {
@@ -819,6 +876,56 @@ func BenchmarkWriteParallel(b *testing.B) {
 	}
 }
 
+// BenchmarkWriteBulkSmall writes 32 KB with WriteBulk under the default
+// parallel configuration at several chunk sizes. The "parallel" metric is 1
+// if the worker pool was started; the byte threshold keeps it at 0 even
+// where the write spans many small chunks.
+func BenchmarkWriteBulkSmall(b *testing.B) {
+	const size = 32 * 1024
+
+	for _, chunkSize := range []int{4 * 1024, 16 * 1024, 64 * 1024} {
+		b.Run(fmt.Sprintf("%dKB", chunkSize/1024), func(b *testing.B) {
+			base, cleanup := setupBenchFS(b)
+			defer cleanup()
+
+			config := &Config{
+				Cipher: CipherAES256GCM,
+				KeyProvider: NewPasswordKeyProvider([]byte("benchmark"), Argon2idParams{
+					Memory:      64 * 1024,
+					Iterations:  1,
+					Parallelism: 2,
+				}),
+				ChunkSize: chunkSize,
+				Parallel:  DefaultParallelConfig(),
+			}
+			fs, _ := New(base, config)
+			defer fs.Close()
+
+			data := make([]byte, size)
+			rand.Read(data)
+
+			file, _ := fs.Create("/bench.bin")
+			defer file.Close()
+			cf := file.(*ChunkedFile)
+
+			b.SetBytes(size)
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				cf.Seek(0, io.SeekStart)
+				cf.WriteBulk(data)
+			}
+
+			b.StopTimer()
+			parallel := 0.0
+			if fs.workers.tasks != nil {
+				parallel = 1
+			}
+			b.ReportMetric(parallel, "parallel")
+		})
+	}
+}
+
 // BenchmarkReadSequential benchmarks sequential chunked reads (no parallel)
 func BenchmarkReadSequential(b *testing.B) {
 	sizes := []struct {
@@ -967,3 +1074,309 @@ func BenchmarkParallelWorkers(b *testing.B) {
 		})
 	}
 }
+
+// BenchmarkWorkerPool compares starting workers for every bulk call with
+// reusing the filesystem's shared pool
+func BenchmarkWorkerPool(b *testing.B) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	engine, _ := NewCipherEngine(CipherAES256GCM, key)
+
+	jobs := make([]chunkJob, 8)
+	for i := range jobs {
+		jobs[i] = chunkJob{
+			plaintext: make([]byte, 4*1024),
+			nonce:     make([]byte, engine.NonceSize()),
+		}
+	}
+	encrypt := func(i int) error {
+		ciphertext, err := engine.Encrypt(jobs[i].nonce, jobs[i].plaintext)
+		jobs[i].ciphertext = ciphertext
+		return err
+	}
+
+	b.Run("PerCall", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			pool := newWorkerPool(4)
+			pool.run(len(jobs), "encryption", encrypt)
+			pool.close()
+		}
+	})
+
+	b.Run("Pooled", func(b *testing.B) {
+		pool := newWorkerPool(4)
+		defer pool.close()
+		for i := 0; i < b.N; i++ {
+			pool.run(len(jobs), "encryption", encrypt)
+		}
+	})
+}
+
+// BenchmarkSmallFiles measures workloads of many tiny files, such as a
+// Maildir, where key derivation rather than encryption dominates. Reopen
+// reads files back in the session that wrote them, so their keys are cached;
+// NewSession reads them through a fresh filesystem that must derive them.
+func BenchmarkSmallFiles(b *testing.B) {
+	const fileCount = 1000
+
+	base, cleanup := setupBenchFS(b)
+	defer cleanup()
+
+	config := &Config{
+		Cipher: CipherAES256GCM,
+		KeyProvider: NewPasswordKeyProvider([]byte("bench-password"), Argon2idParams{
+			Memory:      8 * 1024, // Minimum allowed cost
+			Iterations:  1,
+			Parallelism: 1,
+		}),
+	}
+
+	fs, err := New(base, config)
+	if err != nil {
+		b.Fatalf("failed to create EncryptFS: %v", err)
+	}
+	defer fs.Close()
+
+	data := make([]byte, 512)
+	rand.Read(data)
+
+	writeFile := func(name string) {
+		file, err := fs.Create(name)
+		if err != nil {
+			b.Fatalf("failed to create: %v", err)
+		}
+		file.Write(data)
+		file.Close()
+	}
+	readFile := func(fs *EncryptFS, name string) {
+		file, err := fs.Open(name)
+		if err != nil {
+			b.Fatalf("failed to open: %v", err)
+		}
+		io.Copy(io.Discard, file)
+		file.Close()
+	}
+
+	names := make([]string, fileCount)
+	for i := range names {
+		names[i] = fmt.Sprintf("/msg-%04d", i)
+		writeFile(names[i])
+	}
+
+	b.Run("Create", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			writeFile(fmt.Sprintf("/new-%d", i))
+		}
+	})
+
+	b.Run("Reopen", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			readFile(fs, names[i%fileCount])
+		}
+	})
+
+	b.Run("NewSession", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			session, err := New(base, config)
+			if err != nil {
+				b.Fatalf("failed to create EncryptFS: %v", err)
+			}
+			readFile(session, names[i%fileCount])
+			session.Close()
+		}
+	})
+}
+
+// BenchmarkWriteFiles writes a batch of small files, once with WriteFiles
+// and once with Create, Write and Close per file. The batch pays for one
+// Argon2id derivation; individual creates pay for one per file.
+func BenchmarkWriteFiles(b *testing.B) {
+	const fileCount = 50
+
+	data := make([]byte, 512)
+	rand.Read(data)
+	files := make(map[string][]byte, fileCount)
+	for i := 0; i < fileCount; i++ {
+		files[fmt.Sprintf("/msg-%04d", i)] = data
+	}
+
+	for _, tc := range []struct {
+		name  string
+		write func(fs *EncryptFS) error
+	}{
+		{"WriteFiles", func(fs *EncryptFS) error {
+			return fs.WriteFiles(files)
+		}},
+		{"Individual", func(fs *EncryptFS) error {
+			for name, data := range files {
+				file, err := fs.Create(name)
+				if err != nil {
+					return err
+				}
+				file.Write(data)
+				if err := file.Close(); err != nil {
+					return err
+				}
+			}
+			return nil
+		}},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			base, cleanup := setupBenchFS(b)
+			defer cleanup()
+
+			fs, err := New(base, &Config{
+				Cipher: CipherAES256GCM,
+				KeyProvider: NewPasswordKeyProvider([]byte("bench-password"), Argon2idParams{
+					Memory:      8 * 1024, // Minimum allowed cost
+					Iterations:  1,
+					Parallelism: 1,
+				}),
+			})
+			if err != nil {
+				b.Fatalf("failed to create EncryptFS: %v", err)
+			}
+			defer fs.Close()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := tc.write(fs); err != nil {
+					b.Fatalf("failed to write files: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkRepeatedOpen reopens one small file. With the key cache the
+// file's Argon2id derivation is paid once; without it, on every open. With
+// a shared salt the file key is expanded with HKDF and Argon2id only runs
+// when the filesystem is created, even without the cache.
+func BenchmarkRepeatedOpen(b *testing.B) {
+	for _, tc := range []struct {
+		name       string
+		cacheSize  int
+		sharedSalt bool
+	}{
+		{"Cached", 0, false},
+		{"Uncached", -1, false},
+		{"SharedSalt", -1, true},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			base, cleanup := setupBenchFS(b)
+			defer cleanup()
+
+			fs, err := New(base, &Config{
+				Cipher: CipherAES256GCM,
+				KeyProvider: NewPasswordKeyProvider([]byte("bench-password"), Argon2idParams{
+					Memory:      64 * 1024,
+					Iterations:  1,
+					Parallelism: 2,
+				}),
+				KeyCacheSize: tc.cacheSize,
+				SharedSalt:   tc.sharedSalt,
+			})
+			if err != nil {
+				b.Fatalf("failed to create EncryptFS: %v", err)
+			}
+			defer fs.Close()
+
+			file, err := fs.Create("/small.txt")
+			if err != nil {
+				b.Fatalf("failed to create: %v", err)
+			}
+			file.Write([]byte("small file"))
+			file.Close()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				file, err := fs.Open("/small.txt")
+				if err != nil {
+					b.Fatalf("failed to open: %v", err)
+				}
+				io.Copy(io.Discard, file)
+				file.Close()
+			}
+		})
+	}
+}
+
+// BenchmarkReadOnce reads a large file once through a small buffer and
+// reports the peak heap growth. A traditional file is decrypted whole; with
+// ReadOnce the file is chunked and read one uncached chunk at a time.
+func BenchmarkReadOnce(b *testing.B) {
+	const size = 16 * 1024 * 1024
+
+	for _, tc := range []struct {
+		name     string
+		readOnce bool
+	}{
+		{"Cached", false},
+		{"ReadOnce", true},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			base, cleanup := setupBenchFS(b)
+			defer cleanup()
+
+			fs, err := New(base, &Config{
+				Cipher: CipherAES256GCM,
+				KeyProvider: NewPasswordKeyProvider([]byte("bench-password"), Argon2idParams{
+					Memory:      64 * 1024,
+					Iterations:  1,
+					Parallelism: 2,
+				}),
+				ReadOnce: tc.readOnce,
+			})
+			if err != nil {
+				b.Fatalf("failed to create EncryptFS: %v", err)
+			}
+			defer fs.Close()
+
+			data := make([]byte, size)
+			rand.Read(data)
+			file, err := fs.Create("/large.bin")
+			if err != nil {
+				b.Fatalf("failed to create: %v", err)
+			}
+			file.Write(data)
+			file.Close()
+			data = nil
+
+			var stats runtime.MemStats
+			var peak uint64
+			buf := make([]byte, 32*1024)
+			b.SetBytes(size)
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				runtime.GC()
+				runtime.ReadMemStats(&stats)
+				start := stats.HeapAlloc
+				b.StartTimer()
+
+				file, err := fs.Open("/large.bin")
+				if err != nil {
+					b.Fatalf("failed to open: %v", err)
+				}
+				for reads := 0; ; reads++ {
+					_, err := file.Read(buf)
+					if reads%64 == 0 || err != nil {
+						b.StopTimer()
+						runtime.ReadMemStats(&stats)
+						if stats.HeapAlloc > start && stats.HeapAlloc-start > peak {
+							peak = stats.HeapAlloc - start
+						}
+						b.StartTimer()
+					}
+					if err != nil {
+						break
+					}
+				}
+				file.Close()
+			}
+
+			b.ReportMetric(float64(peak)/(1024*1024), "peak-MB")
+		})
+	}
+}
@@ -42,6 +42,16 @@ const (
 	// This prevents the index from overwriting chunk data as it grows
 	// Size calculation: 8 (header) + 1700 * 12 (offset + size per chunk) = 20,408 bytes
 	ChunkIndexReservedSize = 20 * 1024 // 20 KB
+
+	// MaxIndexedChunks is the number of chunks that fit in the reserved index
+	MaxIndexedChunks = (ChunkIndexReservedSize - chunkIndexPreambleSize) / chunkIndexEntrySize
+
+	// chunkIndexPreambleSize is the size of the chunk size and chunk count fields
+	chunkIndexPreambleSize = 8
+
+	// chunkIndexEntrySize is the size of one interleaved index entry
+	// (offset + plaintext size)
+	chunkIndexEntrySize = 12
 )
 
 // ChunkIndexHeader contains metadata about all chunks in the file
@@ -50,6 +60,11 @@ type ChunkIndexHeader struct {
 	ChunkCount     uint32   // Total number of chunks
 	ChunkOffsets   []uint64 // Byte offset of each chunk from start of file
 	PlaintextSizes []uint32 // Plaintext size of each chunk (may be < ChunkSize for last chunk)
+
+	// Interleaved selects the entry layout. Legacy indexes store all offsets
+	// followed by all sizes; interleaved indexes store (offset, size) pairs so
+	// a single entry can be rewritten in place without touching the others.
+	Interleaved bool
 }
 
 // NewChunkIndexHeader creates a new chunk index header
@@ -88,17 +103,24 @@ func (h *ChunkIndexHeader) WriteTo(w io.Writer) (int64, error) {
 		return 0, fmt.Errorf("failed to write chunk count: %w", err)
 	}
 
-	// Write all chunk offsets
-	for _, offset := range h.ChunkOffsets {
-		if err := binary.Write(buf, binary.LittleEndian, offset); err != nil {
-			return 0, fmt.Errorf("failed to write chunk offset: %w", err)
+	if h.Interleaved {
+		// Write (offset, size) pairs
+		for i := range h.ChunkOffsets {
+			buf.Write(h.encodeEntry(uint32(i)))
+		}
+	} else {
+		// Write all chunk offsets
+		for _, offset := range h.ChunkOffsets {
+			if err := binary.Write(buf, binary.LittleEndian, offset); err != nil {
+				return 0, fmt.Errorf("failed to write chunk offset: %w", err)
+			}
 		}
-	}
 
-	// Write all plaintext sizes
-	for _, size := range h.PlaintextSizes {
-		if err := binary.Write(buf, binary.LittleEndian, size); err != nil {
-			return 0, fmt.Errorf("failed to write plaintext size: %w", err)
+		// Write all plaintext sizes
+		for _, size := range h.PlaintextSizes {
+			if err := binary.Write(buf, binary.LittleEndian, size); err != nil {
+				return 0, fmt.Errorf("failed to write plaintext size: %w", err)
+			}
 		}
 	}
 
@@ -130,22 +152,41 @@ func (h *ChunkIndexHeader) ReadFrom(r io.Reader) (int64, error) {
 	}
 	totalRead += 4
 
-	// Read chunk offsets
-	h.ChunkOffsets = make([]uint64, h.ChunkCount)
-	for i := uint32(0); i < h.ChunkCount; i++ {
-		if err := binary.Read(r, binary.LittleEndian, &h.ChunkOffsets[i]); err != nil {
-			return totalRead, fmt.Errorf("failed to read chunk offset %d: %w", i, err)
-		}
-		totalRead += 8
+	// Reject counts that cannot fit in the reserved space
+	if h.ChunkCount > MaxIndexedChunks {
+		return totalRead, fmt.Errorf("chunk count %d exceeds index capacity %d", h.ChunkCount, MaxIndexedChunks)
 	}
 
-	// Read plaintext sizes
+	h.ChunkOffsets = make([]uint64, h.ChunkCount)
 	h.PlaintextSizes = make([]uint32, h.ChunkCount)
-	for i := uint32(0); i < h.ChunkCount; i++ {
-		if err := binary.Read(r, binary.LittleEndian, &h.PlaintextSizes[i]); err != nil {
-			return totalRead, fmt.Errorf("failed to read plaintext size %d: %w", i, err)
+
+	if h.Interleaved {
+		// Read (offset, size) pairs
+		for i := uint32(0); i < h.ChunkCount; i++ {
+			if err := binary.Read(r, binary.LittleEndian, &h.ChunkOffsets[i]); err != nil {
+				return totalRead, fmt.Errorf("failed to read chunk offset %d: %w", i, err)
+			}
+			if err := binary.Read(r, binary.LittleEndian, &h.PlaintextSizes[i]); err != nil {
+				return totalRead, fmt.Errorf("failed to read plaintext size %d: %w", i, err)
+			}
+			totalRead += chunkIndexEntrySize
+		}
+	} else {
+		// Read chunk offsets
+		for i := uint32(0); i < h.ChunkCount; i++ {
+			if err := binary.Read(r, binary.LittleEndian, &h.ChunkOffsets[i]); err != nil {
+				return totalRead, fmt.Errorf("failed to read chunk offset %d: %w", i, err)
+			}
+			totalRead += 8
+		}
+
+		// Read plaintext sizes
+		for i := uint32(0); i < h.ChunkCount; i++ {
+			if err := binary.Read(r, binary.LittleEndian, &h.PlaintextSizes[i]); err != nil {
+				return totalRead, fmt.Errorf("failed to read plaintext size %d: %w", i, err)
+			}
+			totalRead += 4
 		}
-		totalRead += 4
 	}
 
 	// Skip padding to reach the end of reserved space
@@ -162,6 +203,45 @@ func (h *ChunkIndexHeader) ReadFrom(r io.Reader) (int64, error) {
 	return totalRead, nil
 }
 
+// EntryOffset returns the position of an interleaved index entry relative to
+// the start of the index
+func (h *ChunkIndexHeader) EntryOffset(chunkIdx uint32) int64 {
+	return chunkIndexPreambleSize + int64(chunkIdx)*chunkIndexEntrySize
+}
+
+// CountOffset returns the position of the chunk count relative to the start
+// of the index
+func (h *ChunkIndexHeader) CountOffset() int64 {
+	return 4
+}
+
+// encodeEntry returns the interleaved encoding of a single index entry
+func (h *ChunkIndexHeader) encodeEntry(chunkIdx uint32) []byte {
+	entry := make([]byte, chunkIndexEntrySize)
+	binary.LittleEndian.PutUint64(entry[0:8], h.ChunkOffsets[chunkIdx])
+	binary.LittleEndian.PutUint32(entry[8:12], h.PlaintextSizes[chunkIdx])
+	return entry
+}
+
+// WriteEntry writes a single interleaved index entry. The writer must be
+// positioned at EntryOffset(chunkIdx).
+func (h *ChunkIndexHeader) WriteEntry(w io.Writer, chunkIdx uint32) (int64, error) {
+	if chunkIdx >= h.ChunkCount {
+		return 0, fmt.Errorf("chunk index %d out of range (count: %d)", chunkIdx, h.ChunkCount)
+	}
+	n, err := w.Write(h.encodeEntry(chunkIdx))
+	return int64(n), err
+}
+
+// WriteCount writes the chunk count. The writer must be positioned at
+// CountOffset().
+func (h *ChunkIndexHeader) WriteCount(w io.Writer) (int64, error) {
+	count := make([]byte, 4)
+	binary.LittleEndian.PutUint32(count, h.ChunkCount)
+	n, err := w.Write(count)
+	return int64(n), err
+}
+
 // AddChunk adds a new chunk to the index
 func (h *ChunkIndexHeader) AddChunk(offset uint64, plaintextSize uint32) {
 	h.ChunkOffsets = append(h.ChunkOffsets, offset)
@@ -249,8 +329,9 @@ func (h *EncryptedChunkHeader) WriteTo(w io.Writer) (int64, error) {
 	return int64(n), err
 }
 
-// ReadFrom reads the chunk header from a reader
-func (h *EncryptedChunkHeader) ReadFrom(r io.Reader, nonceSize int) (int64, error) {
+// readWithNonceSize reads the chunk header from a reader, expecting a nonce of
+// nonceSize bytes
+func (h *EncryptedChunkHeader) readWithNonceSize(r io.Reader, nonceSize int) (int64, error) {
 	var totalRead int64
 
 	// Read plaintext size
@@ -270,6 +351,11 @@ func (h *EncryptedChunkHeader) ReadFrom(r io.Reader, nonceSize int) (int64, erro
 	return totalRead, nil
 }
 
+// ReadFrom reads the chunk header from a reader
+func (h *EncryptedChunkHeader) ReadFrom(r io.Reader, nonceSize int) (int64, error) {
+	return h.readWithNonceSize(r, nonceSize)
+}
+
 // ValidateChunkSize validates that a chunk size is within acceptable bounds
 func ValidateChunkSize(size uint32) error {
 	if size < MinChunkSize {
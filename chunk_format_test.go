@@ -0,0 +1,57 @@
+package encryptfs
+
+import (
+	"bytes"
+	"testing"
+)
+
+// FuzzParseChunkIndex feeds arbitrary bytes to the chunk index parser in
+// both layouts, and looks chunks up in any index it accepts
+func FuzzParseChunkIndex(f *testing.F) {
+	for _, interleaved := range []bool{false, true} {
+		index := NewChunkIndexHeader(4096)
+		index.Interleaved = interleaved
+		index.AddChunk(20480+80, 4096)
+		index.AddChunk(20480+80+4096+32, 100)
+		seed := new(bytes.Buffer)
+		index.WriteTo(seed)
+		f.Add(seed.Bytes(), interleaved)
+	}
+	f.Add([]byte{0, 16, 0, 0, 0xff, 0xff, 0xff, 0xff}, true)
+
+	f.Fuzz(func(t *testing.T, data []byte, interleaved bool) {
+		index := &ChunkIndexHeader{Interleaved: interleaved}
+		n, err := index.ReadFrom(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		if n != ChunkIndexReservedSize {
+			t.Fatalf("read %d bytes, want %d", n, ChunkIndexReservedSize)
+		}
+		if int(index.ChunkCount) != len(index.ChunkOffsets) || int(index.ChunkCount) != len(index.PlaintextSizes) {
+			t.Fatalf("count %d does not match %d offsets and %d sizes", index.ChunkCount, len(index.ChunkOffsets), len(index.PlaintextSizes))
+		}
+		for i := uint32(0); i <= index.ChunkCount; i++ {
+			index.GetChunkInfo(i)
+		}
+		index.TotalPlaintextSize()
+		index.FindChunkForOffset(int64(index.ChunkSize) * 3)
+	})
+}
+
+func TestEncryptedChunkHeader_ReadFrom(t *testing.T) {
+	nonce := bytes.Repeat([]byte{7}, 12)
+	buf := new(bytes.Buffer)
+	if _, err := NewEncryptedChunkHeader(4096, nonce).WriteTo(buf); err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+
+	var header EncryptedChunkHeader
+	n, err := header.ReadFrom(bytes.NewReader(buf.Bytes()), len(nonce))
+	if err != nil {
+		t.Fatalf("ReadFrom failed: %v", err)
+	}
+	if n != int64(buf.Len()) || header.PlaintextSize != 4096 || !bytes.Equal(header.Nonce, nonce) {
+		t.Errorf("ReadFrom = %d bytes, size %d, nonce %x", n, header.PlaintextSize, header.Nonce)
+	}
+}
@@ -0,0 +1,284 @@
+package encryptfs
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// ChunkInfo describes where one chunk of a chunked file lies on the base
+// filesystem
+type ChunkInfo struct {
+	Index          uint32 // Position of the chunk in the file
+	Offset         int64  // Offset of the chunk header in the base file
+	PlaintextSize  uint32 // Size of the chunk's plaintext
+	CiphertextSize int64  // Size on the base file, including chunk header and tag
+	Nonce          []byte // Nonce the chunk was encrypted with
+}
+
+// ChunkLayout returns the layout of a chunked file as recorded in its chunk
+// index and chunk headers, for debugging and repair tools. Nothing is
+// decrypted, so no key is needed. A chunk header that disagrees with the
+// index is reported as a CorruptionError; files in the traditional format
+// return ErrNotChunked.
+func (e *EncryptFS) ChunkLayout(name string) ([]ChunkInfo, error) {
+	return e.chunkLayout("chunklayout", name)
+}
+
+// CheckNonces verifies that no two chunks of a chunked file share a nonce.
+// Chunk nonces are random, so a repeated one means a broken random source or
+// a tampered file, and is reported as a CorruptionError wrapping
+// ErrNonceReuse. Only chunk headers are read and no key is needed. Set
+// Config.CheckNonces to run the check whenever a chunked file is opened.
+func (e *EncryptFS) CheckNonces(name string) error {
+	layout, err := e.chunkLayout("checknonces", name)
+	if err != nil {
+		return err
+	}
+	return checkNonces(name, layout)
+}
+
+// chunkLayout implements ChunkLayout, reporting errors under op
+func (e *EncryptFS) chunkLayout(op, name string) ([]ChunkInfo, error) {
+	if err := e.checkOp(op, name); err != nil {
+		return nil, err
+	}
+
+	encryptedPath, err := e.translatePath(name)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := e.base.Open(encryptedPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	chunked, err := detectChunkedFormat(file, info.Size())
+	if err != nil {
+		return nil, NewCorruptionError(name, err.Error())
+	}
+	if !chunked {
+		return nil, &os.PathError{Op: op, Path: name, Err: ErrNotChunked}
+	}
+
+	r := io.NewSectionReader(file, 0, info.Size())
+	header := &FileHeader{}
+	if _, err := header.ReadFrom(r); err != nil {
+		return nil, NewCorruptionError(name, err.Error())
+	}
+	if err := header.Validate(); err != nil {
+		return nil, NewCorruptionError(name, err.Error())
+	}
+	index := header.newChunkIndex(0)
+	if _, err := index.ReadFrom(r); err != nil {
+		return nil, NewCorruptionError(name, fmt.Sprintf("failed to read chunk index: %v", err))
+	}
+
+	nonceSize, err := nonceSizeFor(header.Cipher)
+	if err != nil {
+		return nil, err
+	}
+	if header.Flags&FlagStream != 0 {
+		nonceSize = streamNonceSize
+	}
+	return readChunkLayout(name, file, info.Size(), index, nonceSize)
+}
+
+// readChunkLayout reads the header of every chunk in index from a chunked
+// file of the given size
+func readChunkLayout(name string, file io.ReaderAt, size int64, index *ChunkIndexHeader, nonceSize int) ([]ChunkInfo, error) {
+	layout := make([]ChunkInfo, index.ChunkCount)
+	for i := range layout {
+		idx := uint32(i)
+		offset, plaintextSize, _ := index.GetChunkInfo(idx)
+
+		chunkHeader := &EncryptedChunkHeader{}
+		if _, err := chunkHeader.readWithNonceSize(io.NewSectionReader(file, int64(offset), size-int64(offset)), nonceSize); err != nil {
+			return nil, readChunkError(name, idx, err)
+		}
+		if chunkHeader.PlaintextSize != plaintextSize {
+			return nil, &CorruptionError{
+				Path:     name,
+				ChunkIdx: idx,
+				Message:  fmt.Sprintf("chunk header size %d does not match index size %d", chunkHeader.PlaintextSize, plaintextSize),
+			}
+		}
+
+		layout[i] = ChunkInfo{
+			Index:          idx,
+			Offset:         int64(offset),
+			PlaintextSize:  plaintextSize,
+			CiphertextSize: int64(CalculateCiphertextSize(plaintextSize, nonceSize, aeadTagSize)),
+			Nonce:          chunkHeader.Nonce,
+		}
+	}
+
+	return layout, nil
+}
+
+// checkNonces returns a CorruptionError if two chunks in layout share a nonce
+func checkNonces(name string, layout []ChunkInfo) error {
+	seen := make(map[string]uint32, len(layout))
+	for _, chunk := range layout {
+		if first, ok := seen[string(chunk.Nonce)]; ok {
+			return &CorruptionError{
+				Path:     name,
+				ChunkIdx: chunk.Index,
+				Message:  fmt.Sprintf("chunk reuses the nonce of chunk %d", first),
+				Err:      ErrNonceReuse,
+			}
+		}
+		seen[string(chunk.Nonce)] = chunk.Index
+	}
+	return nil
+}
+
+// RebuildChunkIndex reconstructs the chunk index of a chunked file from its
+// chunk headers, for files whose index region was damaged while the chunks
+// after it survived. Chunks are scanned in order from the end of the
+// reserved index, and each is decrypted so that only authentic chunks are
+// indexed. Every chunk but the last must be full; the chunk size is taken
+// from the first chunk, or from the configuration for a single-chunk file.
+// The file's contents are not changed, only its index is rewritten.
+func (e *EncryptFS) RebuildChunkIndex(name string) error {
+	if err := e.checkTarget("rebuildindex", name); err != nil {
+		return err
+	}
+
+	encryptedPath, err := e.translatePath(name)
+	if err != nil {
+		return err
+	}
+
+	file, err := e.base.OpenFile(encryptedPath, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	header := &FileHeader{}
+	if _, err := header.ReadFrom(io.NewSectionReader(file, 0, info.Size())); err != nil {
+		return NewCorruptionError(name, err.Error())
+	}
+	if err := header.Validate(); err != nil {
+		return NewCorruptionError(name, err.Error())
+	}
+	if header.Version >= headerFlagsVersion && header.Flags&FlagChunked == 0 {
+		return &os.PathError{Op: "rebuildindex", Path: name, Err: ErrNotChunked}
+	}
+
+	keyProvider, err := e.fileKeyProvider(header)
+	if err != nil {
+		return err
+	}
+	key, err := e.keys.derive(keyProvider, header)
+	if err != nil {
+		return fmt.Errorf("failed to derive key: %w", err)
+	}
+	if err := header.openFormat(key); err != nil {
+		return decryptError(name, "failed to authenticate header", err)
+	}
+	engine, err := NewCipherEngine(header.Cipher, key)
+	if err != nil {
+		return fmt.Errorf("failed to create cipher engine: %w", err)
+	}
+	nonceSize, err := chunkNonceSize(header, engine)
+	if err != nil {
+		return err
+	}
+	sealer := newChunkSealer(header, key, NewCipherEngine)
+	defer sealer.destroy()
+
+	// Scan the chunks that follow the reserved index
+	var offsets []uint64
+	var sizes []uint32
+	pos := int64(header.Size()) + ChunkIndexReservedSize
+	for pos < info.Size() {
+		idx := uint32(len(offsets))
+		if idx >= MaxIndexedChunks {
+			return NewCorruptionError(name, fmt.Sprintf("more than %d chunks", MaxIndexedChunks))
+		}
+
+		r := io.NewSectionReader(file, pos, info.Size()-pos)
+		chunkHeader := &EncryptedChunkHeader{}
+		if _, err := chunkHeader.readWithNonceSize(r, nonceSize); err != nil {
+			return readChunkError(name, idx, err)
+		}
+		if chunkHeader.PlaintextSize == 0 || chunkHeader.PlaintextSize > MaxChunkSize {
+			return &CorruptionError{
+				Path:     name,
+				ChunkIdx: idx,
+				Message:  fmt.Sprintf("chunk header at offset %d has invalid size %d", pos, chunkHeader.PlaintextSize),
+			}
+		}
+
+		ciphertext := make([]byte, int(chunkHeader.PlaintextSize)+engine.Overhead())
+		if _, err := io.ReadFull(r, ciphertext); err != nil {
+			return readChunkError(name, idx, err)
+		}
+		last := pos+int64(CalculateCiphertextSize(chunkHeader.PlaintextSize, nonceSize, engine.Overhead())) >= info.Size()
+		if _, err := sealer.open(engine, chunkHeader.Nonce, idx, last, ciphertext); err != nil {
+			return &CorruptionError{
+				Path:     name,
+				ChunkIdx: idx,
+				Message:  fmt.Sprintf("failed to decrypt chunk at offset %d: %v", pos, err),
+				Err:      decryptError(name, "failed to decrypt chunk", err),
+			}
+		}
+
+		offsets = append(offsets, uint64(pos))
+		sizes = append(sizes, chunkHeader.PlaintextSize)
+		pos += int64(CalculateCiphertextSize(chunkHeader.PlaintextSize, nonceSize, engine.Overhead()))
+	}
+
+	chunkSize := uint32(e.config.ChunkSize)
+	if chunkSize == 0 {
+		chunkSize = DefaultChunkSize
+	}
+	switch {
+	case len(sizes) > 1:
+		chunkSize = sizes[0]
+	case len(sizes) == 1 && sizes[0] > chunkSize:
+		chunkSize = sizes[0]
+	}
+	if err := ValidateChunkSize(chunkSize); err != nil {
+		return NewCorruptionError(name, err.Error())
+	}
+
+	index := header.newChunkIndex(chunkSize)
+	for i := range offsets {
+		if i < len(offsets)-1 && sizes[i] != chunkSize {
+			return &CorruptionError{
+				Path:     name,
+				ChunkIdx: uint32(i),
+				Message:  fmt.Sprintf("chunk size %d does not match chunk size %d of the file", sizes[i], chunkSize),
+			}
+		}
+		index.AddChunk(offsets[i], sizes[i])
+	}
+
+	err = e.retry(func() error {
+		if _, err := file.Seek(int64(header.Size()), io.SeekStart); err != nil {
+			return fmt.Errorf("failed to seek to chunk index: %w", err)
+		}
+		if _, err := index.WriteTo(file); err != nil {
+			return fmt.Errorf("failed to write chunk index: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return file.Sync()
+}
@@ -0,0 +1,311 @@
+package encryptfs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestChunkLayout(t *testing.T) {
+	const chunkSize = 4 * 1024
+
+	base, cleanup := setupTestFS(t)
+	defer cleanup()
+
+	keyProvider := NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+		Memory:      64 * 1024,
+		Iterations:  1,
+		Parallelism: 2,
+	})
+	fs, err := New(base, &Config{Cipher: CipherChaCha20Poly1305, KeyProvider: keyProvider, ChunkSize: chunkSize})
+	if err != nil {
+		t.Fatalf("failed to create EncryptFS: %v", err)
+	}
+
+	data := make([]byte, 2*chunkSize+1808)
+	rand.Read(data)
+	file, err := fs.Create("/layout.bin")
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	file.Write(data)
+	if err := file.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	// Any key can read the layout
+	other, err := New(base, &Config{
+		Cipher: CipherAES256GCM,
+		KeyProvider: NewPasswordKeyProvider([]byte("other-password"), Argon2idParams{
+			Memory:      64 * 1024,
+			Iterations:  1,
+			Parallelism: 2,
+		}),
+	})
+	if err != nil {
+		t.Fatalf("failed to create EncryptFS: %v", err)
+	}
+	layout, err := other.ChunkLayout("/layout.bin")
+	if err != nil {
+		t.Fatalf("ChunkLayout failed: %v", err)
+	}
+
+	wantSizes := []uint32{chunkSize, chunkSize, 1808}
+	if len(layout) != len(wantSizes) {
+		t.Fatalf("got %d chunks, want %d", len(layout), len(wantSizes))
+	}
+	info, err := base.Stat("/layout.bin")
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+
+	for i, chunk := range layout {
+		if chunk.Index != uint32(i) {
+			t.Errorf("chunk %d: Index = %d", i, chunk.Index)
+		}
+		if chunk.PlaintextSize != wantSizes[i] {
+			t.Errorf("chunk %d: PlaintextSize = %d, want %d", i, chunk.PlaintextSize, wantSizes[i])
+		}
+		// Size, nonce and tag
+		if want := int64(4 + 12 + wantSizes[i] + 16); chunk.CiphertextSize != want {
+			t.Errorf("chunk %d: CiphertextSize = %d, want %d", i, chunk.CiphertextSize, want)
+		}
+		if len(chunk.Nonce) != 12 {
+			t.Errorf("chunk %d: nonce is %d bytes, want 12", i, len(chunk.Nonce))
+		}
+
+		// Chunks are laid out back to back up to the end of the file
+		end := info.Size()
+		if i+1 < len(layout) {
+			end = layout[i+1].Offset
+			if bytes.Equal(chunk.Nonce, layout[i+1].Nonce) {
+				t.Errorf("chunks %d and %d share a nonce", i, i+1)
+			}
+		}
+		if chunk.Offset+chunk.CiphertextSize != end {
+			t.Errorf("chunk %d: ends at %d, want %d", i, chunk.Offset+chunk.CiphertextSize, end)
+		}
+	}
+
+	// The nonce is read from the chunk header on disk
+	raw, err := base.Open("/layout.bin")
+	if err != nil {
+		t.Fatalf("failed to open base file: %v", err)
+	}
+	nonce := make([]byte, 12)
+	raw.ReadAt(nonce, layout[1].Offset+4)
+	raw.Close()
+	if !bytes.Equal(nonce, layout[1].Nonce) {
+		t.Error("chunk 1 nonce does not match the chunk header")
+	}
+
+	// Traditional files have no chunk layout
+	traditional, err := New(base, &Config{Cipher: CipherAES256GCM, KeyProvider: keyProvider})
+	if err != nil {
+		t.Fatalf("failed to create EncryptFS: %v", err)
+	}
+	file, err = traditional.Create("/single.txt")
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	file.Write([]byte("single chunk"))
+	file.Close()
+	if _, err := fs.ChunkLayout("/single.txt"); !errors.Is(err, ErrNotChunked) {
+		t.Errorf("ChunkLayout of a traditional file error = %v, want ErrNotChunked", err)
+	}
+}
+
+func TestRebuildChunkIndex(t *testing.T) {
+	const chunkSize = 4 * 1024
+
+	base, cleanup := setupTestFS(t)
+	defer cleanup()
+
+	fs, err := New(base, &Config{
+		Cipher: CipherAES256GCM,
+		KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+			Memory:      64 * 1024,
+			Iterations:  1,
+			Parallelism: 2,
+		}),
+		ChunkSize: chunkSize,
+	})
+	if err != nil {
+		t.Fatalf("failed to create EncryptFS: %v", err)
+	}
+
+	data := make([]byte, 3*chunkSize+100)
+	rand.Read(data)
+	file, err := fs.Create("/indexed.bin")
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	file.Write(data)
+	if err := file.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+	want, err := fs.ChunkLayout("/indexed.bin")
+	if err != nil {
+		t.Fatalf("ChunkLayout failed: %v", err)
+	}
+
+	// Zero the whole index region
+	raw, err := base.OpenFile("/indexed.bin", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("failed to open base file: %v", err)
+	}
+	header := &FileHeader{}
+	headerSize, err := header.ReadFrom(raw)
+	if err != nil {
+		t.Fatalf("failed to read header: %v", err)
+	}
+	raw.WriteAt(make([]byte, ChunkIndexReservedSize), headerSize)
+	raw.Close()
+
+	if file, err := fs.Open("/indexed.bin"); err == nil {
+		got, _ := io.ReadAll(file)
+		file.Close()
+		if bytes.Equal(got, data) {
+			t.Fatal("file still readable with a zeroed index")
+		}
+	}
+
+	if err := fs.RebuildChunkIndex("/indexed.bin"); err != nil {
+		t.Fatalf("RebuildChunkIndex failed: %v", err)
+	}
+
+	got, err := fs.ChunkLayout("/indexed.bin")
+	if err != nil {
+		t.Fatalf("ChunkLayout after rebuild failed: %v", err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("rebuilt index has %d chunks, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].Offset != want[i].Offset || got[i].PlaintextSize != want[i].PlaintextSize {
+			t.Errorf("chunk %d rebuilt as offset %d size %d, want offset %d size %d",
+				i, got[i].Offset, got[i].PlaintextSize, want[i].Offset, want[i].PlaintextSize)
+		}
+	}
+
+	file, err = fs.Open("/indexed.bin")
+	if err != nil {
+		t.Fatalf("failed to open rebuilt file: %v", err)
+	}
+	content, err := io.ReadAll(file)
+	file.Close()
+	if err != nil {
+		t.Fatalf("failed to read rebuilt file: %v", err)
+	}
+	if !bytes.Equal(content, data) {
+		t.Error("content mismatch after rebuilding the index")
+	}
+
+	// A damaged chunk is not indexed
+	raw, err = base.OpenFile("/indexed.bin", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("failed to open base file: %v", err)
+	}
+	raw.WriteAt([]byte{0xFF, 0xFF}, want[2].Offset+40)
+	raw.Close()
+
+	err = fs.RebuildChunkIndex("/indexed.bin")
+	var corruption *CorruptionError
+	if !errors.As(err, &corruption) || corruption.ChunkIdx != 2 {
+		t.Errorf("RebuildChunkIndex with a damaged chunk error = %v, want corruption of chunk 2", err)
+	}
+}
+
+func TestCheckNonces(t *testing.T) {
+	const chunkSize = 4 * 1024
+
+	base, cleanup := setupTestFS(t)
+	defer cleanup()
+
+	config := &Config{
+		Cipher: CipherAES256GCM,
+		KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+			Memory:      64 * 1024,
+			Iterations:  1,
+			Parallelism: 2,
+		}),
+		ChunkSize: chunkSize,
+	}
+	fs, err := New(base, config)
+	if err != nil {
+		t.Fatalf("failed to create EncryptFS: %v", err)
+	}
+
+	data := make([]byte, 3*chunkSize)
+	rand.Read(data)
+	file, err := fs.Create("/nonces.bin")
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	file.Write(data)
+	if err := file.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	if err := fs.CheckNonces("/nonces.bin"); err != nil {
+		t.Fatalf("CheckNonces on a healthy file: %v", err)
+	}
+
+	// Give the last chunk the nonce of the first
+	layout, err := fs.ChunkLayout("/nonces.bin")
+	if err != nil {
+		t.Fatalf("ChunkLayout failed: %v", err)
+	}
+	raw, err := base.OpenFile("/nonces.bin", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("failed to open base file: %v", err)
+	}
+	if _, err := raw.WriteAt(layout[0].Nonce, layout[2].Offset+4); err != nil {
+		t.Fatalf("failed to overwrite nonce: %v", err)
+	}
+	raw.Close()
+
+	err = fs.CheckNonces("/nonces.bin")
+	var ce *CorruptionError
+	if !errors.As(err, &ce) || !errors.Is(err, ErrNonceReuse) {
+		t.Fatalf("CheckNonces: got %v, want a CorruptionError wrapping ErrNonceReuse", err)
+	}
+	if ce.ChunkIdx != 2 {
+		t.Errorf("CorruptionError.ChunkIdx = %d, want 2", ce.ChunkIdx)
+	}
+
+	// The check is off by default, so the file still opens
+	file, err = fs.Open("/nonces.bin")
+	if err != nil {
+		t.Fatalf("Open without CheckNonces failed: %v", err)
+	}
+	file.Close()
+
+	config.CheckNonces = true
+	checked, err := New(base, config)
+	if err != nil {
+		t.Fatalf("failed to create EncryptFS: %v", err)
+	}
+	if _, err := checked.Open("/nonces.bin"); !errors.Is(err, ErrNonceReuse) {
+		t.Errorf("Open with CheckNonces: got %v, want ErrNonceReuse", err)
+	}
+
+	// Traditional files have a single nonce
+	config.ChunkSize = 0
+	traditional, err := New(base, config)
+	if err != nil {
+		t.Fatalf("failed to create EncryptFS: %v", err)
+	}
+	file, err = traditional.Create("/single.txt")
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	file.Write([]byte("one chunk"))
+	file.Close()
+	if err := traditional.CheckNonces("/single.txt"); !errors.Is(err, ErrNotChunked) {
+		t.Errorf("CheckNonces on a traditional file: got %v, want ErrNotChunked", err)
+	}
+}
@@ -1,15 +1,20 @@
 package encryptfs
 
 import (
-	"crypto/rand"
+	"crypto/sha256"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"os"
+	"sort"
 	"sync"
 
 	"github.com/absfs/absfs"
 )
 
+var _ absfs.File = (*ChunkedFile)(nil)
+
 // ChunkedFile implements a chunked encrypted file with efficient seeking
 type ChunkedFile struct {
 	base       absfs.File
@@ -17,12 +22,24 @@ type ChunkedFile struct {
 	fileHeader *FileHeader
 	chunkIndex *ChunkIndexHeader
 	engine     CipherEngine
+	sealer     *chunkSealer // Seals and opens chunks, as STREAM records for FlagStream files
+	nonceSize  int          // Chunk nonce size recorded by the header
 	chunkSize  uint32
 	flags      int
 
 	// Current state
 	position int64 // Current read/write position in plaintext
 	dirty    bool  // Whether we have uncommitted changes
+	baseSize int64 // Size of the base file, read on load and kept up to date by writes
+
+	// Index persistence
+	dirtyEntries   map[uint32]struct{} // Index entries changed since the last Sync
+	persistedCount uint32              // Chunk count last written to disk
+
+	// Plaintext digest (FlagDigest only)
+	digest        hash.Hash // Running hash of sequential writes; nil once a write lands elsewhere
+	digestLen     int64     // Number of bytes hashed so far
+	digestChanged bool      // Whether the contents changed since the digest was recorded
 
 	// Chunk cache
 	cache      *chunkCache
@@ -30,6 +47,8 @@ type ChunkedFile struct {
 	currentBuf []byte      // Currently loaded chunk plaintext
 	chunkDirty bool        // Whether current chunk has been modified
 	mu         sync.RWMutex // Protects concurrent access
+
+	unlock func() // Releases the Config.FileLocking lock, if set
 }
 
 // newChunkedFile creates a new chunked encrypted file
@@ -48,13 +67,18 @@ func newChunkedFile(base absfs.File, fs *EncryptFS, chunkSize uint32, flags int)
 		position:   0,
 	}
 
+	// Read-once files are never revisited, so decrypted chunks are not kept
+	if fs.config.ReadOnce {
+		cf.cache = newChunkCache(0)
+	}
+
 	// Check if file exists and has content
 	info, err := base.Stat()
 	if err != nil {
 		return nil, err
 	}
 
-	if info.Size() > 0 {
+	if baseFileSize(info, flags) > 0 {
 		// Load existing chunked file
 		if err := cf.loadChunkedFile(); err != nil {
 			return nil, fmt.Errorf("failed to load chunked file: %w", err)
@@ -72,34 +96,62 @@ func newChunkedFile(base absfs.File, fs *EncryptFS, chunkSize uint32, flags int)
 // initChunkedFile initializes a new chunked encrypted file
 func (cf *ChunkedFile) initChunkedFile() error {
 	// Generate salt
-	salt, err := cf.fs.keyProvider.GenerateSalt()
+	salt, err := cf.fs.generateSalt()
 	if err != nil {
 		return fmt.Errorf("failed to generate salt: %w", err)
 	}
 
 	// Derive key
-	key, err := cf.fs.keyProvider.DeriveKey(salt)
+	key, err := cf.fs.deriveKey(salt)
 	if err != nil {
 		return fmt.Errorf("failed to derive key: %w", err)
 	}
 
 	// Create cipher engine
-	cf.engine, err = NewCipherEngine(cf.fs.cipher, key)
+	cf.engine, err = cf.fs.newCipherEngine(cf.fs.cipher, key)
 	if err != nil {
 		return fmt.Errorf("failed to create cipher engine: %w", err)
 	}
 
 	// Generate nonce for file header (not used for chunk encryption)
-	nonce, err := GenerateNonce(cf.fs.cipher)
+	nonce, err := cf.fs.generateNonce(cf.fs.cipher)
 	if err != nil {
 		return fmt.Errorf("failed to generate nonce: %w", err)
 	}
 
 	// Create file header
 	cf.fileHeader = NewFileHeader(cf.fs.cipher, salt, nonce)
+	cf.fileHeader.KDF = kdfParamsFor(cf.fs.keyProvider)
+	cf.fileHeader.Flags = FlagChunked | cf.fs.newFileFlags()
+	if cf.fs.config.StreamFormat == StreamFormatSTREAM {
+		cf.fileHeader.Flags |= FlagStream
+	}
+	cf.fileHeader.setKeyID(keyIDFor(cf.fs.keyProvider))
+	if err := cf.fs.wrapRecoveryKey(cf.fileHeader, key); err != nil {
+		return err
+	}
+	if err := cf.fs.describeFormat(cf.fileHeader, key); err != nil {
+		return err
+	}
+	if cf.nonceSize, err = chunkNonceSize(cf.fileHeader, cf.engine); err != nil {
+		return err
+	}
+	cf.sealer = newChunkSealer(cf.fileHeader, key, cf.fs.newCipherEngine)
+	cf.fs.keys.put(cf.fs.keyProvider, salt, cf.fileHeader.KDF, key)
+
+	// Start hashing the plaintext as it is written
+	if cf.fs.config.ComputeDigest {
+		cf.digest = sha256.New()
+		if err := cf.fileHeader.setDigestKey(key); err != nil {
+			return err
+		}
+		if err := cf.fileHeader.sealDigest(cf.digest.Sum(nil), cf.fs.random); err != nil {
+			return err
+		}
+	}
 
 	// Create empty chunk index
-	cf.chunkIndex = NewChunkIndexHeader(cf.chunkSize)
+	cf.chunkIndex = cf.fileHeader.newChunkIndex(cf.chunkSize)
 
 	// Write headers to file
 	if err := cf.writeHeaders(); err != nil {
@@ -111,113 +163,275 @@ func (cf *ChunkedFile) initChunkedFile() error {
 
 // loadChunkedFile loads an existing chunked encrypted file
 func (cf *ChunkedFile) loadChunkedFile() error {
-	// Seek to start
-	if _, err := cf.base.Seek(0, io.SeekStart); err != nil {
-		return fmt.Errorf("failed to seek to start: %w", err)
-	}
+	// Read the file header and the chunk index that follows it
+	err := cf.fs.retry(func() error {
+		if _, err := cf.base.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to seek to start: %w", err)
+		}
+
+		cf.fileHeader = &FileHeader{}
+		if _, err := cf.fileHeader.ReadFrom(cf.base); err != nil {
+			return fmt.Errorf("failed to read file header: %w", err)
+		}
+		if err := cf.fileHeader.Validate(); err != nil {
+			return fmt.Errorf("invalid file header: %w", err)
+		}
+
+		cf.chunkIndex = cf.fileHeader.newChunkIndex(0)
+		if _, err := cf.chunkIndex.ReadFrom(cf.base); err != nil {
+			return fmt.Errorf("failed to read chunk index: %w", err)
+		}
 
-	// Read file header
-	cf.fileHeader = &FileHeader{}
-	if _, err := cf.fileHeader.ReadFrom(cf.base); err != nil {
-		return fmt.Errorf("failed to read file header: %w", err)
+		// Chunks are checked against the end of the file before they are
+		// read, and appended there
+		size, err := cf.base.Seek(0, io.SeekEnd)
+		if err != nil {
+			return fmt.Errorf("failed to seek to end: %w", err)
+		}
+		cf.baseSize = size
+		return nil
+	})
+	if err != nil {
+		return err
 	}
+	cf.persistedCount = cf.chunkIndex.ChunkCount
 
-	// Validate header
-	if err := cf.fileHeader.Validate(); err != nil {
-		return fmt.Errorf("invalid file header: %w", err)
+	// Chunk boundaries are fixed by the file, not the current configuration
+	if err := ValidateChunkSize(cf.chunkIndex.ChunkSize); err != nil {
+		return NewCorruptionError(cf.base.Name(), fmt.Sprintf("invalid chunk index: %v", err))
 	}
+	cf.chunkSize = cf.chunkIndex.ChunkSize
 
-	// Derive key
-	key, err := cf.fs.keyProvider.DeriveKey(cf.fileHeader.Salt)
+	keyProvider, err := cf.fs.fileKeyProvider(cf.fileHeader)
 	if err != nil {
-		return fmt.Errorf("failed to derive key: %w", err)
+		return err
 	}
 
+	// Check if we have a MultiKeyProvider for fallback support
+	if multiProvider, ok := keyProvider.(*MultiKeyProvider); ok {
+		// Try each provider that may have written the file in order,
+		// moving on while the key fails to authenticate
+		var lastErr error
+		opened := false
+		for _, provider := range multiProvider.providersFor(cf.fileHeader.KeyID) {
+			key, err := cf.fs.keys.derive(provider, cf.fileHeader)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			if err := cf.openKey(key, true); err != nil {
+				if !errors.Is(err, ErrAuthFailed) {
+					return err
+				}
+				lastErr = err
+				continue
+			}
+			opened = true
+			break
+		}
+
+		if !opened {
+			if lastErr != nil {
+				return decryptError(cf.base.Name(), "all key providers failed to decrypt", lastErr)
+			}
+			return fmt.Errorf("no key providers could decrypt the file")
+		}
+	} else {
+		key, err := cf.fs.keys.derive(keyProvider, cf.fileHeader)
+		if err != nil {
+			return fmt.Errorf("failed to derive key: %w", err)
+		}
+		if err := cf.openKey(key, false); err != nil {
+			return err
+		}
+	}
+
+	if cf.fs.config.CheckNonces {
+		info, err := cf.base.Stat()
+		if err != nil {
+			return err
+		}
+		layout, err := readChunkLayout(cf.base.Name(), cf.base, info.Size(), cf.chunkIndex, cf.nonceSize)
+		if err != nil {
+			return err
+		}
+		if err := checkNonces(cf.base.Name(), layout); err != nil {
+			return err
+		}
+	}
+
+	// An empty file can be hashed as it is written; anything else is
+	// rehashed on Close if it changes
+	if cf.fileHeader.Flags&FlagDigest != 0 && cf.chunkIndex.ChunkCount == 0 {
+		cf.digest = sha256.New()
+	}
+
+	return nil
+}
+
+// openKey sets the file up to decrypt its chunks with key, after checking
+// the key against the header's format tag and digest. With verify set, the
+// first chunk of a file without a digest is decrypted too, so that a wrong
+// key is caught here rather than on the first read.
+func (cf *ChunkedFile) openKey(key []byte, verify bool) error {
+	if err := cf.fileHeader.openFormat(key); err != nil {
+		return decryptError(cf.base.Name(), "failed to authenticate header", err)
+	}
 	// Create cipher engine
-	cf.engine, err = NewCipherEngine(cf.fileHeader.Cipher, key)
+	engine, err := cf.fs.newCipherEngine(cf.fileHeader.Cipher, key)
 	if err != nil {
 		return fmt.Errorf("failed to create cipher engine: %w", err)
 	}
-
-	// Read chunk index
-	cf.chunkIndex = &ChunkIndexHeader{}
-	if _, err := cf.chunkIndex.ReadFrom(cf.base); err != nil {
-		return fmt.Errorf("failed to read chunk index: %w", err)
+	if cf.nonceSize, err = chunkNonceSize(cf.fileHeader, engine); err != nil {
+		return err
 	}
+	cf.engine = engine
+	cf.sealer = newChunkSealer(cf.fileHeader, key, cf.fs.newCipherEngine)
 
+	// A digest that does not open means a wrong key, unless the first
+	// chunk decrypts under it
+	if err := cf.fileHeader.openDigest(key); err != nil {
+		if cf.chunkIndex.ChunkCount == 0 {
+			return decryptError(cf.base.Name(), "failed to authenticate header", err)
+		}
+		if _, chunkErr := cf.readChunk(0); chunkErr != nil {
+			return chunkErr
+		}
+		return NewCorruptionError(cf.base.Name(), err.Error())
+	}
+	if verify && cf.fileHeader.Flags&FlagDigest == 0 && cf.chunkIndex.ChunkCount > 0 {
+		if _, err := cf.readChunk(0); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// chunkNonceSize returns the size of the chunk nonces of a file, which is
+// fixed by the cipher recorded in its header rather than by the configured
+// cipher, and checks that the file's engine uses the cipher's nonce size.
+// The chunks of a FlagStream file hold the 16-byte nonce of a STREAM record.
+func chunkNonceSize(header *FileHeader, engine CipherEngine) (int, error) {
+	nonceSize, err := nonceSizeFor(header.Cipher)
+	if err != nil {
+		return 0, err
+	}
+	if engine.NonceSize() != nonceSize {
+		return 0, fmt.Errorf("cipher engine nonce size %d does not match %s nonce size %d", engine.NonceSize(), header.Cipher, nonceSize)
+	}
+	if header.Flags&FlagStream != 0 {
+		return streamNonceSize, nil
+	}
+	return nonceSize, nil
+}
+
 // writeHeaders writes file header and chunk index to the beginning of the file
 func (cf *ChunkedFile) writeHeaders() error {
-	// Seek to start
-	if _, err := cf.base.Seek(0, io.SeekStart); err != nil {
+	err := cf.fs.retry(func() error {
+		// Seek to start
+		if _, err := cf.base.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+
+		// Write file header
+		if _, err := cf.fileHeader.WriteTo(cf.base); err != nil {
+			return fmt.Errorf("failed to write file header: %w", err)
+		}
+
+		// Write chunk index
+		if _, err := cf.chunkIndex.WriteTo(cf.base); err != nil {
+			return fmt.Errorf("failed to write chunk index: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
 		return err
 	}
 
-	// Write file header
-	if _, err := cf.fileHeader.WriteTo(cf.base); err != nil {
-		return fmt.Errorf("failed to write file header: %w", err)
+	cf.dirtyEntries = nil
+	cf.persistedCount = cf.chunkIndex.ChunkCount
+	cf.baseSize = max(cf.baseSize, int64(cf.fileHeader.Size())+ChunkIndexReservedSize)
+	if cf.fs.config.VerifyAfterWrite {
+		return cf.verifyHeaders()
 	}
+	return nil
+}
 
-	// Write chunk index
-	if _, err := cf.chunkIndex.WriteTo(cf.base); err != nil {
-		return fmt.Errorf("failed to write chunk index: %w", err)
+// markEntryDirty records that a chunk index entry must be written on the next Sync
+func (cf *ChunkedFile) markEntryDirty(chunkIdx uint32) {
+	if cf.dirtyEntries == nil {
+		cf.dirtyEntries = make(map[uint32]struct{})
 	}
-
-	return nil
+	cf.dirtyEntries[chunkIdx] = struct{}{}
+	cf.dirty = true
 }
 
-// Read reads up to len(p) bytes from the chunked file
-func (cf *ChunkedFile) Read(p []byte) (int, error) {
-	// Input validation
-	if p == nil {
-		return 0, ErrNilBuffer
+// persistIndex writes the chunk index changes made since the last Sync.
+//
+// Interleaved indexes are updated in place: only the changed entries are
+// written, followed by the chunk count. Entries for appended chunks lie past
+// the persisted count and are ignored by readers until the count is
+// rewritten, so when durable is set the base file is synced before the count
+// is updated. A crash at any point then leaves an index that only references
+// chunks that are fully on disk. Legacy indexes are rewritten in full.
+func (cf *ChunkedFile) persistIndex(durable bool) error {
+	if !cf.chunkIndex.Interleaved {
+		return cf.writeHeaders()
 	}
 
-	cf.mu.Lock()
-	defer cf.mu.Unlock()
+	indexStart := int64(cf.fileHeader.Size())
 
-	if len(p) == 0 {
-		return 0, nil
+	entries := make([]uint32, 0, len(cf.dirtyEntries))
+	for idx := range cf.dirtyEntries {
+		entries = append(entries, idx)
 	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i] < entries[j] })
 
-	totalRead := 0
-	fileSize := cf.chunkIndex.TotalPlaintextSize()
+	for _, idx := range entries {
+		if _, err := cf.base.Seek(indexStart+cf.chunkIndex.EntryOffset(idx), io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := cf.chunkIndex.WriteEntry(cf.base, idx); err != nil {
+			return fmt.Errorf("failed to write chunk index entry %d: %w", idx, err)
+		}
+	}
+	cf.dirtyEntries = nil
 
-	for totalRead < len(p) {
-		// Check if we're at EOF
-		if cf.position >= fileSize {
-			if totalRead == 0 {
-				return 0, io.EOF
+	if cf.chunkIndex.ChunkCount != cf.persistedCount {
+		// New chunks and their entries must be durable before the count
+		// makes them visible
+		if durable {
+			if err := cf.base.Sync(); err != nil {
+				return err
 			}
-			return totalRead, nil
 		}
 
-		// Find which chunk we're in
-		chunkIdx, offsetInChunk, err := cf.chunkIndex.FindChunkForOffset(cf.position)
-		if err != nil {
-			return totalRead, err
+		if _, err := cf.base.Seek(indexStart+cf.chunkIndex.CountOffset(), io.SeekStart); err != nil {
+			return err
 		}
-
-		// Load the chunk if not already loaded
-		if err := cf.ensureChunkLoaded(chunkIdx); err != nil {
-			return totalRead, err
+		if _, err := cf.chunkIndex.WriteCount(cf.base); err != nil {
+			return fmt.Errorf("failed to write chunk count: %w", err)
 		}
+		cf.persistedCount = cf.chunkIndex.ChunkCount
+	}
 
-		// Read from current chunk
-		available := len(cf.currentBuf) - int(offsetInChunk)
-		toRead := len(p) - totalRead
-		if toRead > available {
-			toRead = available
-		}
+	if cf.fs.config.VerifyAfterWrite {
+		return cf.verifyHeaders()
+	}
+	return nil
+}
 
-		copy(p[totalRead:], cf.currentBuf[offsetInChunk:offsetInChunk+int64(toRead)])
-		totalRead += toRead
-		cf.position += int64(toRead)
+// Read reads up to len(p) bytes from the chunked file
+func (cf *ChunkedFile) Read(p []byte) (int, error) {
+	// Input validation
+	if p == nil {
+		return 0, ErrNilBuffer
 	}
 
-	return totalRead, nil
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+
+	return cf.readInternal(p)
 }
 
 // Write writes len(p) bytes to the chunked file
@@ -226,6 +440,9 @@ func (cf *ChunkedFile) Write(p []byte) (int, error) {
 	if p == nil {
 		return 0, ErrNilBuffer
 	}
+	if err := checkWritable("write", cf.Name(), cf.flags); err != nil {
+		return 0, err
+	}
 
 	cf.mu.Lock()
 	defer cf.mu.Unlock()
@@ -234,46 +451,89 @@ func (cf *ChunkedFile) Write(p []byte) (int, error) {
 		return 0, nil
 	}
 
-	totalWritten := 0
+	// Appends always land at the end of the plaintext
+	if cf.flags&os.O_APPEND != 0 {
+		cf.position = cf.plaintextSize()
+	}
 
-	for totalWritten < len(p) {
-		// Find which chunk we're in (or need to create)
-		chunkIdx, offsetInChunk, err := cf.findOrCreateChunkForWrite(cf.position)
-		if err != nil {
-			return totalWritten, err
-		}
+	return cf.writeInternal(p)
+}
 
-		// Load the chunk
-		if err := cf.ensureChunkLoaded(chunkIdx); err != nil {
-			return totalWritten, err
-		}
+// trackDigest feeds plaintext written at pos into the running digest. Only
+// writes that continue where the previous one ended can be hashed
+// incrementally; any other write abandons the running hash, and the digest
+// is recomputed from the chunks on Close.
+func (cf *ChunkedFile) trackDigest(pos int64, p []byte) {
+	if cf.fileHeader.Flags&FlagDigest == 0 || len(p) == 0 {
+		return
+	}
+	cf.digestChanged = true
 
-		// Expand buffer if needed
-		neededSize := int(offsetInChunk) + (len(p) - totalWritten)
-		if neededSize > len(cf.currentBuf) {
-			if neededSize > int(cf.chunkSize) {
-				neededSize = int(cf.chunkSize)
+	if cf.digest != nil && pos == cf.digestLen {
+		cf.digest.Write(p)
+		cf.digestLen += int64(len(p))
+		return
+	}
+	cf.digest = nil
+}
+
+// recordDigest writes the plaintext digest to the file header if the
+// contents changed since it was last recorded
+func (cf *ChunkedFile) recordDigest() error {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+
+	if cf.fileHeader.Flags&FlagDigest == 0 || !cf.digestChanged {
+		return nil
+	}
+
+	var sum []byte
+	if cf.digest != nil {
+		sum = cf.digest.Sum(nil)
+	} else {
+		h := sha256.New()
+		for idx := uint32(0); idx < cf.chunkIndex.ChunkCount; idx++ {
+			data, err := cf.readChunk(idx)
+			if err != nil {
+				return err
 			}
-			newBuf := make([]byte, neededSize)
-			copy(newBuf, cf.currentBuf)
-			cf.currentBuf = newBuf
+			h.Write(data)
 		}
+		sum = h.Sum(nil)
+	}
+	if err := cf.fileHeader.sealDigest(sum, cf.fs.random); err != nil {
+		return err
+	}
 
-		// Write to current chunk
-		available := int(cf.chunkSize) - int(offsetInChunk)
-		toWrite := len(p) - totalWritten
-		if toWrite > available {
-			toWrite = available
+	// The header size is fixed when the file is created, so the digest is
+	// overwritten in place
+	if _, err := cf.base.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := cf.fileHeader.WriteTo(cf.base); err != nil {
+		return fmt.Errorf("failed to write file header: %w", err)
+	}
+	cf.digestChanged = false
+	if cf.fs.config.VerifyAfterWrite {
+		if err := cf.verifyHeaders(); err != nil {
+			return err
 		}
-
-		copy(cf.currentBuf[offsetInChunk:], p[totalWritten:totalWritten+toWrite])
-		totalWritten += toWrite
-		cf.position += int64(toWrite)
-		cf.chunkDirty = true
-		cf.dirty = true
 	}
 
-	return totalWritten, nil
+	return cf.base.Sync()
+}
+
+// Digest returns the SHA-256 digest of the plaintext recorded in the file
+// header, or nil if the file has none. It reflects the contents as of the
+// last Close.
+func (cf *ChunkedFile) Digest() []byte {
+	cf.mu.RLock()
+	defer cf.mu.RUnlock()
+
+	if cf.fileHeader.Flags&FlagDigest == 0 {
+		return nil
+	}
+	return append([]byte(nil), cf.fileHeader.plaintextDigest...)
 }
 
 // ensureChunkLoaded loads a chunk into memory if not already loaded
@@ -299,12 +559,19 @@ func (cf *ChunkedFile) ensureChunkLoaded(chunkIdx uint32) error {
 	}
 
 	// Check cache
+	metrics := cf.fs.config.Metrics
 	if data, ok := cf.cache.Get(chunkIdx); ok {
+		if metrics != nil {
+			metrics.OnChunkCacheHit()
+		}
 		cf.currentBuf = data
 		cf.currentIdx = chunkIdx
 		cf.chunkDirty = false
 		return nil
 	}
+	if metrics != nil {
+		metrics.OnChunkCacheMiss()
+	}
 
 	// Load chunk from disk
 	data, err := cf.readChunk(chunkIdx)
@@ -320,62 +587,139 @@ func (cf *ChunkedFile) ensureChunkLoaded(chunkIdx uint32) error {
 	return nil
 }
 
+// replaceChunk makes a chunk current with a zeroed buffer of a full chunk
+// instead of loading it, for a write that is about to overwrite all of it
+func (cf *ChunkedFile) replaceChunk(chunkIdx uint32) error {
+	if chunkIdx == cf.currentIdx && cf.currentBuf != nil {
+		return nil
+	}
+
+	if err := cf.flushCurrentChunk(); err != nil {
+		return err
+	}
+
+	cf.currentBuf = make([]byte, cf.chunkSize)
+	cf.currentIdx = chunkIdx
+	cf.chunkDirty = false
+	return nil
+}
+
 // readChunk reads and decrypts a single chunk
 func (cf *ChunkedFile) readChunk(chunkIdx uint32) ([]byte, error) {
-	// Get chunk info
-	offset, plaintextSize, err := cf.chunkIndex.GetChunkInfo(chunkIdx)
+	nonce, ciphertext, err := cf.readChunkCiphertext(chunkIdx)
 	if err != nil {
 		return nil, err
 	}
 
-	// Seek to chunk
-	if _, err := cf.base.Seek(int64(offset), io.SeekStart); err != nil {
-		return nil, fmt.Errorf("failed to seek to chunk: %w", err)
+	// Decrypt
+	plaintext, err := cf.sealer.open(cf.engine, nonce, chunkIdx, cf.lastChunk(chunkIdx), ciphertext)
+	if err != nil {
+		return nil, cf.chunkCorruption(chunkIdx, "failed to decrypt chunk", err)
 	}
 
-	// Read chunk header
-	chunkHeader := &EncryptedChunkHeader{}
-	if _, err := chunkHeader.ReadFrom(cf.base, cf.engine.NonceSize()); err != nil {
-		return nil, fmt.Errorf("failed to read chunk header: %w", err)
+	return plaintext, nil
+}
+
+// lastChunk reports whether chunkIdx is the last chunk of the file, or is
+// about to become it by being appended
+func (cf *ChunkedFile) lastChunk(chunkIdx uint32) bool {
+	return chunkIdx+1 >= cf.chunkIndex.ChunkCount
+}
+
+// readChunkCiphertext reads the nonce and ciphertext of a chunk. The size
+// in the chunk header must match the index; a mismatch means the chunk was
+// read at the wrong offset or with the wrong nonce size.
+func (cf *ChunkedFile) readChunkCiphertext(chunkIdx uint32) (nonce, ciphertext []byte, err error) {
+	// Get chunk info
+	offset, plaintextSize, err := cf.chunkIndex.GetChunkInfo(chunkIdx)
+	if err != nil {
+		return nil, nil, err
+	}
+	if plaintextSize > cf.chunkSize {
+		return nil, nil, &CorruptionError{
+			Path:     cf.base.Name(),
+			ChunkIdx: chunkIdx,
+			Message:  fmt.Sprintf("chunk size %d exceeds the file's chunk size %d", plaintextSize, cf.chunkSize),
+		}
 	}
 
-	// Read ciphertext
-	ciphertextSize := int(plaintextSize) + cf.engine.Overhead()
-	ciphertext := make([]byte, ciphertextSize)
-	if _, err := io.ReadFull(cf.base, ciphertext); err != nil {
-		return nil, fmt.Errorf("failed to read ciphertext: %w", err)
+	// Check the chunk lies within the file before allocating for it
+	end := offset + uint64(CalculateCiphertextSize(plaintextSize, cf.nonceSize, cf.engine.Overhead()))
+	if end > uint64(cf.baseSize) {
+		return nil, nil, &CorruptionError{
+			Path:     cf.base.Name(),
+			ChunkIdx: chunkIdx,
+			Message:  fmt.Sprintf("chunk at offset %d ends at %d, past the end of the file at %d", offset, end, cf.baseSize),
+		}
 	}
+	ciphertext = make([]byte, int(plaintextSize)+cf.engine.Overhead())
 
-	// Decrypt
-	plaintext, err := cf.engine.Decrypt(chunkHeader.Nonce, ciphertext)
+	chunkHeader := &EncryptedChunkHeader{}
+	err = cf.fs.retry(func() error {
+		// Seek to chunk
+		if _, err := cf.base.Seek(int64(offset), io.SeekStart); err != nil {
+			return NewIOError("seek", cf.base.Name(), err)
+		}
+
+		// Read chunk header
+		if _, err := chunkHeader.readWithNonceSize(cf.base, cf.nonceSize); err != nil {
+			return readChunkError(cf.base.Name(), chunkIdx, err)
+		}
+		if chunkHeader.PlaintextSize != plaintextSize {
+			return &CorruptionError{
+				Path:     cf.base.Name(),
+				ChunkIdx: chunkIdx,
+				Message:  fmt.Sprintf("chunk header size %d does not match index size %d", chunkHeader.PlaintextSize, plaintextSize),
+			}
+		}
+
+		// Read ciphertext
+		if _, err := io.ReadFull(cf.base, ciphertext); err != nil {
+			return readChunkError(cf.base.Name(), chunkIdx, err)
+		}
+		return nil
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to decrypt chunk: %w", err)
+		return nil, nil, err
 	}
 
-	return plaintext, nil
+	return chunkHeader.Nonce, ciphertext, nil
 }
 
-// flushCurrentChunk writes the current chunk to disk
-func (cf *ChunkedFile) flushCurrentChunk() error {
-	if !cf.chunkDirty || cf.currentBuf == nil {
-		return nil
+// chunkCorruption wraps a failure to decrypt a chunk in a CorruptionError
+// that names the chunk, so callers can tell which part of the file is
+// damaged. The cause is classified with decryptError, so authentication
+// failures also match AuthenticationError and ErrAuthFailed.
+func (cf *ChunkedFile) chunkCorruption(chunkIdx uint32, message string, err error) error {
+	return &CorruptionError{
+		Path:     cf.base.Name(),
+		ChunkIdx: chunkIdx,
+		Message:  fmt.Sprintf("%s: %v", message, err),
+		Err:      decryptError(cf.base.Name(), message, err),
 	}
+}
 
-	// Generate nonce
-	nonce := make([]byte, cf.engine.NonceSize())
-	if _, err := rand.Read(nonce); err != nil {
-		return fmt.Errorf("failed to generate nonce: %w", err)
+// readChunkError classifies a failure to read a chunk from the base file. A
+// chunk that ends early means the file was truncated and is reported as a
+// CorruptionError; other failures are reported as an IOError.
+func readChunkError(path string, chunkIdx uint32, err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return &CorruptionError{
+			Path:     path,
+			ChunkIdx: chunkIdx,
+			Message:  fmt.Sprintf("chunk is truncated: %v", err),
+			Err:      err,
+		}
 	}
+	return NewIOError("read", path, err)
+}
 
-	// Encrypt chunk
-	ciphertext, err := cf.engine.Encrypt(nonce, cf.currentBuf)
-	if err != nil {
-		return fmt.Errorf("failed to encrypt chunk: %w", err)
+// flushCurrentChunk writes the current chunk to disk
+func (cf *ChunkedFile) flushCurrentChunk() error {
+	if !cf.chunkDirty || cf.currentBuf == nil {
+		return nil
 	}
 
-	// Create chunk header
-	chunkHeader := NewEncryptedChunkHeader(uint32(len(cf.currentBuf)), nonce)
-
 	// Calculate where to write
 	var offset int64
 	if cf.currentIdx < cf.chunkIndex.ChunkCount {
@@ -383,25 +727,22 @@ func (cf *ChunkedFile) flushCurrentChunk() error {
 		offset = int64(cf.chunkIndex.ChunkOffsets[cf.currentIdx])
 	} else {
 		// Appending new chunk
-		offset, err = cf.base.Seek(0, io.SeekEnd)
-		if err != nil {
-			return fmt.Errorf("failed to seek to end: %w", err)
+		if cf.chunkIndex.ChunkCount >= MaxIndexedChunks {
+			return fmt.Errorf("chunk index full: cannot store more than %d chunks", MaxIndexedChunks)
 		}
-	}
+		offset = cf.baseSize
 
-	// Seek to position
-	if _, err := cf.base.Seek(offset, io.SeekStart); err != nil {
-		return fmt.Errorf("failed to seek: %w", err)
-	}
-
-	// Write chunk header
-	if _, err := chunkHeader.WriteTo(cf.base); err != nil {
-		return fmt.Errorf("failed to write chunk header: %w", err)
+		// The last chunk of a FlagStream file hands the final-record flag
+		// on to the chunk appended after it
+		if cf.sealer.streamKey != nil && cf.chunkIndex.ChunkCount > 0 {
+			if err := cf.resealChunk(cf.chunkIndex.ChunkCount-1, false); err != nil {
+				return err
+			}
+		}
 	}
 
-	// Write ciphertext
-	if _, err := cf.base.Write(ciphertext); err != nil {
-		return fmt.Errorf("failed to write ciphertext: %w", err)
+	if err := cf.writeChunk(cf.currentIdx, cf.lastChunk(cf.currentIdx), offset, cf.currentBuf); err != nil {
+		return err
 	}
 
 	// Update chunk index
@@ -410,11 +751,80 @@ func (cf *ChunkedFile) flushCurrentChunk() error {
 	} else {
 		cf.chunkIndex.AddChunk(uint64(offset), uint32(len(cf.currentBuf)))
 	}
+	cf.markEntryDirty(cf.currentIdx)
+
+	// The cache holds copies, so it must see the new contents before the
+	// chunk is unloaded
+	cf.cache.Put(cf.currentIdx, cf.currentBuf)
 
 	cf.chunkDirty = false
 	return nil
 }
 
+// writeChunk seals the plaintext of chunk chunkIdx under a fresh nonce and
+// writes it at offset
+func (cf *ChunkedFile) writeChunk(chunkIdx uint32, last bool, offset int64, plaintext []byte) error {
+	nonce := make([]byte, cf.nonceSize)
+	if _, err := io.ReadFull(cf.fs.random, nonce); err != nil {
+		return fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	ciphertext, err := cf.sealer.seal(cf.engine, nonce, chunkIdx, last, plaintext)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt chunk: %w", err)
+	}
+	return cf.writeSealedChunk(chunkIdx, last, offset, plaintext, nonce, ciphertext)
+}
+
+// writeSealedChunk writes chunk chunkIdx, sealed under nonce, at offset,
+// reading it back if Config.VerifyAfterWrite is set
+func (cf *ChunkedFile) writeSealedChunk(chunkIdx uint32, last bool, offset int64, plaintext, nonce, ciphertext []byte) error {
+	chunkHeader := NewEncryptedChunkHeader(uint32(len(plaintext)), nonce)
+
+	err := cf.fs.retry(func() error {
+		// Seek to position
+		if _, err := cf.base.Seek(offset, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to seek: %w", err)
+		}
+
+		// Write chunk header
+		if _, err := chunkHeader.WriteTo(cf.base); err != nil {
+			return fmt.Errorf("failed to write chunk header: %w", err)
+		}
+
+		// Write ciphertext
+		if _, err := cf.base.Write(ciphertext); err != nil {
+			return fmt.Errorf("failed to write ciphertext: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	cf.baseSize = max(cf.baseSize, offset+int64(chunkHeader.Size()+len(ciphertext)))
+	if cf.fs.config.VerifyAfterWrite {
+		return cf.verifyChunk(chunkIdx, last, offset, plaintext)
+	}
+	return nil
+}
+
+// resealChunk seals chunk chunkIdx of a FlagStream file again in place, as
+// the last chunk if last is set and as an inner chunk otherwise, once the
+// chunks after it are appended or dropped
+func (cf *ChunkedFile) resealChunk(chunkIdx uint32, last bool) error {
+	plaintext, ok := cf.cache.Get(chunkIdx)
+	if !ok {
+		nonce, ciphertext, err := cf.readChunkCiphertext(chunkIdx)
+		if err != nil {
+			return err
+		}
+		plaintext, err = cf.sealer.open(cf.engine, nonce, chunkIdx, !last, ciphertext)
+		if err != nil {
+			return cf.chunkCorruption(chunkIdx, "failed to decrypt chunk", err)
+		}
+	}
+	return cf.writeChunk(chunkIdx, last, int64(cf.chunkIndex.ChunkOffsets[chunkIdx]), plaintext)
+}
+
 // findOrCreateChunkForWrite finds or creates a chunk for the given write position
 func (cf *ChunkedFile) findOrCreateChunkForWrite(pos int64) (uint32, int64, error) {
 	// Calculate which chunk this position falls into
@@ -430,7 +840,7 @@ func (cf *ChunkedFile) Seek(offset int64, whence int) (int64, error) {
 	defer cf.mu.Unlock()
 
 	var newPos int64
-	fileSize := cf.chunkIndex.TotalPlaintextSize()
+	fileSize := cf.plaintextSize()
 
 	switch whence {
 	case io.SeekStart:
@@ -456,6 +866,35 @@ func (cf *ChunkedFile) Sync() error {
 	cf.mu.Lock()
 	defer cf.mu.Unlock()
 
+	return cf.commit()
+}
+
+// Flush writes the current chunk and the index to the base file, making the
+// contents visible to other handles, without syncing the base file to
+// stable storage. Unlike Sync it does not order the chunk data before the
+// chunk count on disk, so a crash before the next Sync may leave appended
+// chunks that fail to decrypt.
+func (cf *ChunkedFile) Flush() error {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+
+	return cf.flush(false)
+}
+
+// commit flushes the current chunk and the index and syncs the base file.
+// Assumes the lock is held.
+func (cf *ChunkedFile) commit() error {
+	if err := cf.flush(true); err != nil {
+		return err
+	}
+
+	// Sync base file
+	return cf.base.Sync()
+}
+
+// flush writes the current chunk and the index to the base file, syncing
+// between them if durable is set. Assumes the lock is held.
+func (cf *ChunkedFile) flush(durable bool) error {
 	// Flush current chunk if dirty
 	if cf.chunkDirty {
 		if err := cf.flushCurrentChunk(); err != nil {
@@ -463,31 +902,61 @@ func (cf *ChunkedFile) Sync() error {
 		}
 	}
 
-	// Write updated headers
+	// Write updated index
 	if cf.dirty {
-		if err := cf.writeHeaders(); err != nil {
+		if err := cf.persistIndex(durable); err != nil {
 			return err
 		}
 		cf.dirty = false
 	}
 
-	// Sync base file
-	return cf.base.Sync()
+	return nil
 }
 
 // Close closes the chunked file
 func (cf *ChunkedFile) Close() error {
+	if cf.unlock != nil {
+		defer cf.unlock()
+	}
+	defer cf.fileHeader.clearKeys()
+	defer cf.sealer.destroy()
+
 	// Sync before closing
 	if err := cf.Sync(); err != nil {
 		return err
 	}
 
+	if err := cf.recordDigest(); err != nil {
+		return err
+	}
+
 	return cf.base.Close()
 }
 
-// Stat returns file info
+// Stat returns file info reporting the plaintext size
 func (cf *ChunkedFile) Stat() (os.FileInfo, error) {
-	return cf.base.Stat()
+	info, err := cf.base.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	cf.mu.RLock()
+	defer cf.mu.RUnlock()
+
+	encInfo := newEncryptedFileInfo(info, cf.fileHeader.Cipher)
+	encInfo.size = cf.plaintextSize()
+	return encInfo, nil
+}
+
+// plaintextSize returns the size of the file including writes still
+// buffered in the current chunk. The caller must hold cf.mu.
+func (cf *ChunkedFile) plaintextSize() int64 {
+	size := cf.chunkIndex.TotalPlaintextSize()
+	if cf.chunkDirty {
+		end := int64(cf.currentIdx)*int64(cf.chunkSize) + int64(len(cf.currentBuf))
+		size = max(size, end)
+	}
+	return size
 }
 
 // Name returns the name of the file
@@ -521,6 +990,11 @@ func (cf *ChunkedFile) readInternal(p []byte) (int, error) {
 		return 0, nil
 	}
 
+	// Writes buffered in the current chunk are not in the index yet
+	if err := cf.flushCurrentChunk(); err != nil {
+		return 0, err
+	}
+
 	totalRead := 0
 	fileSize := cf.chunkIndex.TotalPlaintextSize()
 
@@ -557,6 +1031,10 @@ func (cf *ChunkedFile) readInternal(p []byte) (int, error) {
 
 // WriteAt writes len(b) bytes to the File starting at byte offset off
 func (cf *ChunkedFile) WriteAt(b []byte, off int64) (int, error) {
+	if err := checkWritable("write", cf.Name(), cf.flags); err != nil {
+		return 0, err
+	}
+
 	cf.mu.Lock()
 	defer cf.mu.Unlock()
 
@@ -581,6 +1059,14 @@ func (cf *ChunkedFile) writeInternal(p []byte) (int, error) {
 		return 0, nil
 	}
 
+	// Every chunk before the one written must be full, so a write past the
+	// end zero-fills the gap first
+	if size := cf.plaintextSize(); cf.position > size {
+		if err := cf.extend(size, cf.position); err != nil {
+			return 0, err
+		}
+	}
+
 	totalWritten := 0
 
 	for totalWritten < len(p) {
@@ -589,7 +1075,14 @@ func (cf *ChunkedFile) writeInternal(p []byte) (int, error) {
 			return totalWritten, err
 		}
 
-		if err := cf.ensureChunkLoaded(chunkIdx); err != nil {
+		// A write covering a whole chunk replaces it, so its old contents
+		// need not be read
+		if offsetInChunk == 0 && len(p)-totalWritten >= int(cf.chunkSize) {
+			err = cf.replaceChunk(chunkIdx)
+		} else {
+			err = cf.ensureChunkLoaded(chunkIdx)
+		}
+		if err != nil {
 			return totalWritten, err
 		}
 
@@ -609,11 +1102,19 @@ func (cf *ChunkedFile) writeInternal(p []byte) (int, error) {
 			toWrite = available
 		}
 
+		cf.trackDigest(cf.position, p[totalWritten:totalWritten+toWrite])
 		copy(cf.currentBuf[offsetInChunk:], p[totalWritten:totalWritten+toWrite])
 		totalWritten += toWrite
 		cf.position += int64(toWrite)
 		cf.chunkDirty = true
 		cf.dirty = true
+
+		// In write-through mode every completed chunk is made durable
+		if cf.fs.config.WriteThrough && offsetInChunk+int64(toWrite) == int64(cf.chunkSize) {
+			if err := cf.commit(); err != nil {
+				return totalWritten, err
+			}
+		}
 	}
 
 	return totalWritten, nil
@@ -624,24 +1125,139 @@ func (cf *ChunkedFile) WriteString(s string) (int, error) {
 	return cf.Write([]byte(s))
 }
 
-// Truncate changes the size of the file
+// Truncate changes the size of the file. Growing the file appends zeros;
+// shrinking it re-encrypts the new last chunk, drops the chunks after it and
+// truncates the base file. The read/write position is not changed.
 func (cf *ChunkedFile) Truncate(size int64) error {
+	if err := checkWritable("truncate", cf.Name(), cf.flags); err != nil {
+		return err
+	}
+	if size < 0 {
+		return fmt.Errorf("negative size: %d", size)
+	}
+
 	cf.mu.Lock()
 	defer cf.mu.Unlock()
 
-	// For now, simple implementation
-	// A complete implementation would handle shrinking/growing chunks properly
-	return fmt.Errorf("Truncate not yet fully implemented for chunked files")
+	// The index must describe every chunk before it can be cut
+	if err := cf.flushCurrentChunk(); err != nil {
+		return err
+	}
+
+	current := cf.chunkIndex.TotalPlaintextSize()
+	switch {
+	case size > current:
+		return cf.extend(current, size)
+	case size < current:
+		return cf.shrink(size)
+	}
+	return nil
+}
+
+// extend appends zeros from the current end of the file up to size
+func (cf *ChunkedFile) extend(current, size int64) error {
+	oldPos := cf.position
+	defer func() { cf.position = oldPos }()
+
+	fill := size - current
+	if fill > int64(cf.chunkSize) {
+		fill = int64(cf.chunkSize)
+	}
+	zeros := make([]byte, fill)
+
+	cf.position = current
+	for cf.position < size {
+		n := int64(len(zeros))
+		if remaining := size - cf.position; n > remaining {
+			n = remaining
+		}
+		if _, err := cf.writeInternal(zeros[:n]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// shrink discards the plaintext after size, which must be smaller than the
+// current file size
+func (cf *ChunkedFile) shrink(size int64) error {
+	keep, offsetInChunk, err := cf.chunkIndex.FindChunkForOffset(size)
+	if err != nil {
+		return err
+	}
+	count := cf.chunkIndex.ChunkCount
+
+	// Re-encrypt the part of the chunk that straddles the new end
+	if offsetInChunk > 0 {
+		data, err := cf.readChunk(keep)
+		if err != nil {
+			return err
+		}
+		cf.currentBuf = data[:offsetInChunk]
+		cf.currentIdx = keep
+		cf.chunkDirty = true
+		if err := cf.flushCurrentChunk(); err != nil {
+			return err
+		}
+		keep++
+	}
+
+	// Drop the chunks past the new end
+	cf.chunkIndex.ChunkCount = keep
+	cf.chunkIndex.ChunkOffsets = cf.chunkIndex.ChunkOffsets[:keep]
+	cf.chunkIndex.PlaintextSizes = cf.chunkIndex.PlaintextSizes[:keep]
+	for idx := range cf.dirtyEntries {
+		if idx >= keep {
+			delete(cf.dirtyEntries, idx)
+		}
+	}
+
+	// The new last chunk of a FlagStream file takes the final-record flag
+	if cf.sealer.streamKey != nil && keep > 0 && keep < count {
+		if err := cf.resealChunk(keep-1, true); err != nil {
+			return err
+		}
+	}
+	cf.currentBuf = nil
+	cf.chunkDirty = false
+	cf.cache = newChunkCache(cf.cache.capacity)
+
+	if cf.fileHeader.Flags&FlagDigest != 0 {
+		cf.digest = nil
+		cf.digestChanged = true
+	}
+
+	// The index must stop referencing the dropped chunks before their
+	// ciphertext is removed
+	cf.dirty = true
+	if err := cf.persistIndex(true); err != nil {
+		return err
+	}
+	if err := cf.base.Sync(); err != nil {
+		return err
+	}
+
+	end := int64(cf.fileHeader.Size()) + ChunkIndexReservedSize
+	if keep > 0 {
+		offset, plaintextSize, _ := cf.chunkIndex.GetChunkInfo(keep - 1)
+		end = int64(offset) + int64(CalculateCiphertextSize(plaintextSize, cf.nonceSize, cf.engine.Overhead()))
+	}
+	if err := cf.base.Truncate(end); err != nil {
+		return NewIOError("truncate", cf.base.Name(), err)
+	}
+	cf.baseSize = end
+
+	return nil
 }
 
-// Readdirnames reads directory names (not applicable for files)
+// Readdirnames fails, as a regular file is not a directory
 func (cf *ChunkedFile) Readdirnames(n int) ([]string, error) {
-	return nil, fmt.Errorf("not a directory")
+	return nil, &os.PathError{Op: "readdirnames", Path: cf.Name(), Err: errNotDir}
 }
 
-// Readdir reads directory entries (not applicable for files)
+// Readdir fails, as a regular file is not a directory
 func (cf *ChunkedFile) Readdir(n int) ([]os.FileInfo, error) {
-	return nil, fmt.Errorf("not a directory")
+	return nil, &os.PathError{Op: "readdir", Path: cf.Name(), Err: errNotDir}
 }
 
 // WriteBulk writes data using parallel chunk encryption (experimental)
@@ -651,6 +1267,9 @@ func (cf *ChunkedFile) WriteBulk(p []byte) (int, error) {
 	if p == nil {
 		return 0, ErrNilBuffer
 	}
+	if err := checkWritable("write", cf.Name(), cf.flags); err != nil {
+		return 0, err
+	}
 
 	cf.mu.Lock()
 	defer cf.mu.Unlock()
@@ -659,8 +1278,12 @@ func (cf *ChunkedFile) WriteBulk(p []byte) (int, error) {
 		return 0, nil
 	}
 
+	if cf.flags&os.O_APPEND != 0 {
+		cf.position = cf.plaintextSize()
+	}
+
 	// Check if parallel processing is enabled and worthwhile
-	if !cf.fs.config.Parallel.Enabled || len(p) < int(cf.chunkSize)*4 {
+	if !cf.useParallel(len(p)) {
 		// Fall back to sequential write
 		return cf.writeInternal(p)
 	}
@@ -672,17 +1295,15 @@ func (cf *ChunkedFile) WriteBulk(p []byte) (int, error) {
 	numChunks := endChunkIdx - startChunkIdx
 
 	// If not enough chunks for parallel, use sequential
-	minChunks := uint32(cf.fs.config.Parallel.MinChunksForParallel)
-	if minChunks == 0 {
-		minChunks = 4
-	}
-	if numChunks < minChunks {
+	if numChunks < uint32(cf.fs.parallel.MinChunksForParallel) {
 		return cf.writeInternal(p)
 	}
 
 	// Prepare chunks for parallel encryption
+	count := max(cf.chunkIndex.ChunkCount, endChunkIdx)
 	jobs := make([]chunkJob, 0, numChunks)
 	offset := 0
+	start := cf.position
 
 	for chunkIdx := startChunkIdx; chunkIdx < endChunkIdx && offset < len(p); chunkIdx++ {
 		offsetInChunk := cf.position % int64(cf.chunkSize)
@@ -702,11 +1323,14 @@ func (cf *ChunkedFile) WriteBulk(p []byte) (int, error) {
 		copy(chunkData[offsetInChunk:], p[offset:offset+int(toWrite)])
 
 		// Generate nonce
-		nonce := make([]byte, cf.engine.NonceSize())
-		rand.Read(nonce)
+		nonce := make([]byte, cf.nonceSize)
+		if _, err := io.ReadFull(cf.fs.random, nonce); err != nil {
+			return 0, fmt.Errorf("failed to generate nonce: %w", err)
+		}
 
 		jobs = append(jobs, chunkJob{
 			index:     chunkIdx,
+			last:      chunkIdx+1 >= count,
 			plaintext: chunkData[:offsetInChunk+toWrite],
 			nonce:     nonce,
 		})
@@ -719,23 +1343,33 @@ func (cf *ChunkedFile) WriteBulk(p []byte) (int, error) {
 	if err := cf.parallelEncryptChunks(jobs); err != nil {
 		return 0, err
 	}
+	cf.trackDigest(start, p)
+
+	// The last chunk of a FlagStream file hands the final-record flag on to
+	// the chunks appended after it
+	if cf.sealer.streamKey != nil && cf.chunkIndex.ChunkCount > 0 && startChunkIdx >= cf.chunkIndex.ChunkCount {
+		if err := cf.resealChunk(cf.chunkIndex.ChunkCount-1, false); err != nil {
+			return 0, err
+		}
+	}
 
 	// Write encrypted chunks to disk
 	for _, job := range jobs {
-		chunkHeader := NewEncryptedChunkHeader(uint32(len(job.plaintext)), job.nonce)
-
 		// Calculate write offset
 		var writeOffset int64
 		if job.index < cf.chunkIndex.ChunkCount {
 			writeOffset = int64(cf.chunkIndex.ChunkOffsets[job.index])
 		} else {
-			writeOffset, _ = cf.base.Seek(0, io.SeekEnd)
+			if cf.chunkIndex.ChunkCount >= MaxIndexedChunks {
+				return 0, fmt.Errorf("chunk index full: cannot store more than %d chunks", MaxIndexedChunks)
+			}
+			writeOffset = cf.baseSize
 		}
 
 		// Write chunk
-		cf.base.Seek(writeOffset, io.SeekStart)
-		chunkHeader.WriteTo(cf.base)
-		cf.base.Write(job.ciphertext)
+		if err := cf.writeSealedChunk(job.index, job.last, writeOffset, job.plaintext, job.nonce, job.ciphertext); err != nil {
+			return 0, err
+		}
 
 		// Update index
 		if job.index < cf.chunkIndex.ChunkCount {
@@ -743,9 +1377,16 @@ func (cf *ChunkedFile) WriteBulk(p []byte) (int, error) {
 		} else {
 			cf.chunkIndex.AddChunk(uint64(writeOffset), uint32(len(job.plaintext)))
 		}
+		cf.markEntryDirty(job.index)
 	}
 
 	cf.dirty = true
+
+	if cf.fs.config.WriteThrough {
+		if err := cf.commit(); err != nil {
+			return len(p), err
+		}
+	}
 	return len(p), nil
 }
 
@@ -770,7 +1411,7 @@ func (cf *ChunkedFile) ReadBulk(p []byte) (int, error) {
 	}
 
 	// Check if parallel processing is enabled and worthwhile
-	if !cf.fs.config.Parallel.Enabled || len(p) < int(cf.chunkSize)*4 {
+	if !cf.useParallel(len(p)) {
 		// Fall back to sequential read
 		return cf.readInternal(p)
 	}
@@ -793,11 +1434,7 @@ func (cf *ChunkedFile) ReadBulk(p []byte) (int, error) {
 	numChunks := endChunkIdx - startChunkIdx
 
 	// If not enough chunks for parallel, use sequential
-	minChunks := uint32(cf.fs.config.Parallel.MinChunksForParallel)
-	if minChunks == 0 {
-		minChunks = 4
-	}
-	if numChunks < minChunks {
+	if numChunks < uint32(cf.fs.parallel.MinChunksForParallel) {
 		return cf.readInternal(p)
 	}
 
@@ -806,22 +1443,15 @@ func (cf *ChunkedFile) ReadBulk(p []byte) (int, error) {
 	for i := uint32(0); i < numChunks; i++ {
 		chunkIdx := startChunkIdx + i
 
-		// Get chunk info
-		offset, plaintextSize, _ := cf.chunkIndex.GetChunkInfo(chunkIdx)
-
-		// Seek and read chunk header
-		cf.base.Seek(int64(offset), io.SeekStart)
-		header := &EncryptedChunkHeader{}
-		header.ReadFrom(cf.base, cf.engine.NonceSize())
-
-		// Read ciphertext
-		ciphertextSize := int(plaintextSize) + cf.engine.Overhead()
-		ciphertext := make([]byte, ciphertextSize)
-		io.ReadFull(cf.base, ciphertext)
+		nonce, ciphertext, err := cf.readChunkCiphertext(chunkIdx)
+		if err != nil {
+			return 0, err
+		}
 
 		jobs[i] = chunkJob{
 			index:      chunkIdx,
-			nonce:      header.Nonce,
+			last:       cf.lastChunk(chunkIdx),
+			nonce:      nonce,
 			ciphertext: ciphertext,
 		}
 	}
@@ -889,6 +1519,10 @@ func (c *chunkCache) Get(key uint32) ([]byte, bool) {
 }
 
 func (c *chunkCache) Put(key uint32, data []byte) {
+	if c.capacity <= 0 {
+		return
+	}
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
@@ -3,10 +3,15 @@ package encryptfs
 import (
 	"bytes"
 	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
 	"os"
+	"strings"
 	"testing"
 
+	"github.com/absfs/absfs"
 	"github.com/absfs/memfs"
 )
 
@@ -364,6 +369,528 @@ func TestChunkedFile_PartialChunkWrite(t *testing.T) {
 	}
 }
 
+func TestChunkedFile_CorruptMiddleChunk(t *testing.T) {
+	base, err := memfs.NewFS()
+	if err != nil {
+		t.Fatalf("Failed to create memfs: %v", err)
+	}
+
+	chunkSize := 4 * 1024
+	config := &Config{
+		Cipher: CipherAES256GCM,
+		KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+			Memory:      64 * 1024,
+			Iterations:  1,
+			Parallelism: 2,
+		}),
+		ChunkSize: chunkSize,
+	}
+
+	fs, err := New(base, config)
+	if err != nil {
+		t.Fatalf("Failed to create EncryptFS: %v", err)
+	}
+
+	// Write 10 chunks of data
+	testData := make([]byte, 10*chunkSize)
+	rand.Read(testData)
+
+	file, err := fs.Create("/corrupt.bin")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	file.Write(testData)
+	if err := file.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// Locate chunk 3 on the base filesystem and flip a ciphertext byte
+	raw, err := base.OpenFile("/corrupt.bin", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile on base failed: %v", err)
+	}
+	header := &FileHeader{}
+	if _, err := header.ReadFrom(raw); err != nil {
+		t.Fatalf("ReadFrom header failed: %v", err)
+	}
+	index := header.newChunkIndex(0)
+	if _, err := index.ReadFrom(raw); err != nil {
+		t.Fatalf("ReadFrom index failed: %v", err)
+	}
+	corruptAt := int64(index.ChunkOffsets[3]) + 4 + int64(len(header.Nonce)) + 10
+	b := make([]byte, 1)
+	raw.ReadAt(b, corruptAt)
+	b[0] ^= 0xFF
+	if _, err := raw.WriteAt(b, corruptAt); err != nil {
+		t.Fatalf("WriteAt on base failed: %v", err)
+	}
+	raw.Close()
+
+	// Reading the whole file returns the intact prefix along with the error
+	file, err = fs.Open("/corrupt.bin")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer file.Close()
+
+	buf := make([]byte, len(testData))
+	n, err := file.Read(buf)
+	if err == nil {
+		t.Fatal("Expected error reading corrupt chunk")
+	}
+
+	var corruption *CorruptionError
+	if !errors.As(err, &corruption) {
+		t.Fatalf("Expected CorruptionError, got %T: %v", err, err)
+	}
+	if corruption.ChunkIdx != 3 {
+		t.Errorf("CorruptionError chunk: got %d, want 3", corruption.ChunkIdx)
+	}
+	if !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("Expected error to wrap ErrAuthFailed, got %v", err)
+	}
+
+	if n != 3*chunkSize {
+		t.Fatalf("Read returned %d bytes, want %d", n, 3*chunkSize)
+	}
+	if !bytes.Equal(buf[:n], testData[:n]) {
+		t.Error("Bytes preceding the corrupt chunk do not match")
+	}
+}
+
+func TestChunkedFile_CorruptChunkSize(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    uint32 // Plaintext size written into the first index entry
+		message string
+	}{
+		{"huge", 0xFFFFFFF0, "exceeds the file's chunk size"},
+		{"past end of file", 4 * 1024, "past the end of the file"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base, err := memfs.NewFS()
+			if err != nil {
+				t.Fatalf("Failed to create memfs: %v", err)
+			}
+			fs, err := New(base, &Config{
+				Cipher: CipherAES256GCM,
+				KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+					Memory:      64 * 1024,
+					Iterations:  1,
+					Parallelism: 2,
+				}),
+				ChunkSize: 4 * 1024,
+			})
+			if err != nil {
+				t.Fatalf("Failed to create EncryptFS: %v", err)
+			}
+
+			// A single short chunk, whose index entry is then overwritten
+			file, err := fs.Create("/corrupt.bin")
+			if err != nil {
+				t.Fatalf("Create failed: %v", err)
+			}
+			file.Write([]byte("short chunk"))
+			if err := file.Close(); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+
+			raw, err := base.OpenFile("/corrupt.bin", os.O_RDWR, 0)
+			if err != nil {
+				t.Fatalf("OpenFile on base failed: %v", err)
+			}
+			header := &FileHeader{}
+			if _, err := header.ReadFrom(raw); err != nil {
+				t.Fatalf("ReadFrom header failed: %v", err)
+			}
+			index := header.newChunkIndex(0)
+			size := binary.LittleEndian.AppendUint32(nil, tt.size)
+			if _, err := raw.WriteAt(size, int64(header.Size())+index.EntryOffset(0)+8); err != nil {
+				t.Fatalf("WriteAt on base failed: %v", err)
+			}
+			raw.Close()
+
+			file, err = fs.Open("/corrupt.bin")
+			if err != nil {
+				t.Fatalf("Open failed: %v", err)
+			}
+			defer file.Close()
+			_, err = io.ReadAll(file)
+
+			var corruption *CorruptionError
+			if !errors.As(err, &corruption) {
+				t.Fatalf("Expected CorruptionError, got %T: %v", err, err)
+			}
+			if !strings.Contains(corruption.Message, tt.message) {
+				t.Errorf("CorruptionError message %q does not mention %q", corruption.Message, tt.message)
+			}
+		})
+	}
+}
+
+func TestChunkedFile_OverwriteFullChunks(t *testing.T) {
+	base, err := memfs.NewFS()
+	if err != nil {
+		t.Fatalf("Failed to create memfs: %v", err)
+	}
+	metrics := &recordingMetrics{}
+	const chunkSize = 4 * 1024
+	fs, err := New(base, &Config{
+		Cipher: CipherAES256GCM,
+		KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+			Memory:      64 * 1024,
+			Iterations:  1,
+			Parallelism: 2,
+		}),
+		ChunkSize: chunkSize,
+		Metrics:   metrics,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create EncryptFS: %v", err)
+	}
+
+	want := make([]byte, 8*chunkSize+100)
+	rand.Read(want)
+	file, err := fs.Create("/overwrite.bin")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	file.Write(want)
+	if err := file.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		off   int
+		size  int
+		reads int // Chunks read before being written
+	}{
+		{"aligned", 2 * chunkSize, 3 * chunkSize, 0},
+		{"last full chunk", 7 * chunkSize, chunkSize, 0},
+		{"past end", 8 * chunkSize, chunkSize, 0},
+		{"unaligned", chunkSize + 10, 2 * chunkSize, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file, err := fs.OpenFile("/overwrite.bin", os.O_RDWR, 0)
+			if err != nil {
+				t.Fatalf("OpenFile failed: %v", err)
+			}
+			update := make([]byte, tt.size)
+			rand.Read(update)
+
+			metrics.mu.Lock()
+			metrics.misses = 0
+			metrics.mu.Unlock()
+			if _, err := file.WriteAt(update, int64(tt.off)); err != nil {
+				t.Fatalf("WriteAt failed: %v", err)
+			}
+			if err := file.Close(); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+			metrics.mu.Lock()
+			reads := metrics.misses
+			metrics.mu.Unlock()
+			if reads != tt.reads {
+				t.Errorf("WriteAt read %d chunks, want %d", reads, tt.reads)
+			}
+
+			if end := tt.off + tt.size; end > len(want) {
+				want = append(want, make([]byte, end-len(want))...)
+			}
+			copy(want[tt.off:], update)
+			compareTree(t, fs, "/", map[string][]byte{"/overwrite.bin": want})
+		})
+	}
+}
+
+// errSimulatedCrash is returned by faultyFile in place of the write it drops
+var errSimulatedCrash = errors.New("simulated crash")
+
+// faultyFS wraps a filesystem so that writes starting at failAt fail, as if
+// the process crashed before they reached the disk. written counts the bytes
+// written through it.
+type faultyFS struct {
+	absfs.FileSystem
+	failAt  int64
+	written int64
+}
+
+func (f *faultyFS) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	file, err := f.FileSystem.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &faultyFile{File: file, fs: f}, nil
+}
+
+type faultyFile struct {
+	absfs.File
+	fs  *faultyFS
+	pos int64
+}
+
+func (f *faultyFile) Seek(offset int64, whence int) (int64, error) {
+	pos, err := f.File.Seek(offset, whence)
+	if err == nil {
+		f.pos = pos
+	}
+	return pos, err
+}
+
+func (f *faultyFile) Write(p []byte) (int, error) {
+	if f.pos == f.fs.failAt {
+		return 0, errSimulatedCrash
+	}
+	n, err := f.File.Write(p)
+	f.pos += int64(n)
+	f.fs.written += int64(n)
+	return n, err
+}
+
+// useLegacyIndex rewrites a new chunked file's headers in the version 2
+// layout, whose index is rewritten in full on every Sync
+func useLegacyIndex(tb testing.TB, file absfs.File) {
+	tb.Helper()
+	cf := file.(*ChunkedFile)
+	cf.fileHeader.Version = 2
+	cf.fileHeader.Flags = 0
+	cf.chunkIndex.Interleaved = false
+	if err := cf.base.Truncate(0); err != nil {
+		tb.Fatalf("Truncate failed: %v", err)
+	}
+	cf.baseSize = 0
+	if err := cf.writeHeaders(); err != nil {
+		tb.Fatalf("writeHeaders failed: %v", err)
+	}
+}
+
+func TestChunkedFile_IndexCrashConsistency(t *testing.T) {
+	chunkSize := 4 * 1024
+	original := make([]byte, 2*chunkSize)
+	rand.Read(original)
+	appended := make([]byte, chunkSize)
+	rand.Read(appended)
+
+	tests := []struct {
+		name   string
+		failAt func(cf *ChunkedFile) int64
+	}{
+		{
+			name: "crash before entry",
+			failAt: func(cf *ChunkedFile) int64 {
+				return int64(cf.fileHeader.Size()) + cf.chunkIndex.EntryOffset(2)
+			},
+		},
+		{
+			name: "crash before count",
+			failAt: func(cf *ChunkedFile) int64 {
+				return int64(cf.fileHeader.Size()) + cf.chunkIndex.CountOffset()
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mem, err := memfs.NewFS()
+			if err != nil {
+				t.Fatalf("Failed to create memfs: %v", err)
+			}
+			base := &faultyFS{FileSystem: mem, failAt: -1}
+
+			config := &Config{
+				Cipher: CipherAES256GCM,
+				KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+					Memory:      64 * 1024,
+					Iterations:  1,
+					Parallelism: 2,
+				}),
+				ChunkSize: chunkSize,
+			}
+
+			fs, err := New(base, config)
+			if err != nil {
+				t.Fatalf("Failed to create EncryptFS: %v", err)
+			}
+
+			file, err := fs.Create("/crash.bin")
+			if err != nil {
+				t.Fatalf("Create failed: %v", err)
+			}
+			file.Write(original)
+			if err := file.Close(); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+
+			// Append a chunk and crash while persisting its index entry
+			file, err = fs.OpenFile("/crash.bin", os.O_RDWR, 0)
+			if err != nil {
+				t.Fatalf("OpenFile failed: %v", err)
+			}
+			base.failAt = tt.failAt(file.(*ChunkedFile))
+
+			file.Seek(0, io.SeekEnd)
+			file.Write(appended)
+			if err := file.Sync(); !errors.Is(err, errSimulatedCrash) {
+				t.Fatalf("Sync error = %v, want simulated crash", err)
+			}
+			base.failAt = -1
+
+			// The file still holds exactly the previously synced content
+			file, err = fs.Open("/crash.bin")
+			if err != nil {
+				t.Fatalf("Open after crash failed: %v", err)
+			}
+			data, err := io.ReadAll(file)
+			file.Close()
+			if err != nil {
+				t.Fatalf("ReadAll after crash failed: %v", err)
+			}
+			if !bytes.Equal(data, original) {
+				t.Fatalf("Content after crash: got %d bytes, want the %d original bytes", len(data), len(original))
+			}
+
+			// Appending again after recovery works
+			file, err = fs.OpenFile("/crash.bin", os.O_RDWR, 0)
+			if err != nil {
+				t.Fatalf("OpenFile failed: %v", err)
+			}
+			file.Seek(0, io.SeekEnd)
+			file.Write(appended)
+			if err := file.Close(); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+
+			file, err = fs.Open("/crash.bin")
+			if err != nil {
+				t.Fatalf("Open failed: %v", err)
+			}
+			data, _ = io.ReadAll(file)
+			file.Close()
+			if !bytes.Equal(data, append(original, appended...)) {
+				t.Error("Content mismatch after appending to a recovered file")
+			}
+		})
+	}
+}
+
+func TestChunkedFile_LegacyIndexLayout(t *testing.T) {
+	base, err := memfs.NewFS()
+	if err != nil {
+		t.Fatalf("Failed to create memfs: %v", err)
+	}
+
+	config := &Config{
+		Cipher: CipherAES256GCM,
+		KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+			Memory:      64 * 1024,
+			Iterations:  1,
+			Parallelism: 2,
+		}),
+		ChunkSize: 4 * 1024,
+	}
+
+	fs, err := New(base, config)
+	if err != nil {
+		t.Fatalf("Failed to create EncryptFS: %v", err)
+	}
+
+	testData := make([]byte, 10000)
+	rand.Read(testData)
+
+	file, err := fs.Create("/legacy.bin")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	useLegacyIndex(t, file)
+	file.Write(testData[:5000])
+	if err := file.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	file, err = fs.OpenFile("/legacy.bin", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	file.Seek(0, io.SeekEnd)
+	file.Write(testData[5000:])
+	if err := file.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	file, err = fs.Open("/legacy.bin")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer file.Close()
+
+	if file.(*ChunkedFile).chunkIndex.Interleaved {
+		t.Error("Version 2 file was loaded with an interleaved index")
+	}
+	data, _ := io.ReadAll(file)
+	if !bytes.Equal(data, testData) {
+		t.Error("Content mismatch for legacy index layout")
+	}
+}
+
+// BenchmarkChunkedFile_SmallAppends measures the bytes written per Sync when
+// appending one small chunk at a time
+func BenchmarkChunkedFile_SmallAppends(b *testing.B) {
+	for _, legacy := range []bool{true, false} {
+		name := "incremental"
+		if legacy {
+			name = "legacy"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			mem, _ := memfs.NewFS()
+			base := &faultyFS{FileSystem: mem, failAt: -1}
+
+			config := &Config{
+				Cipher: CipherAES256GCM,
+				KeyProvider: NewPasswordKeyProvider([]byte("benchmark"), Argon2idParams{
+					Memory:      64 * 1024,
+					Iterations:  1,
+					Parallelism: 2,
+				}),
+				ChunkSize: 4 * 1024,
+			}
+
+			fs, _ := New(base, config)
+
+			data := make([]byte, config.ChunkSize)
+			rand.Read(data)
+
+			const appendsPerFile = 1000
+			var file absfs.File
+
+			b.ResetTimer()
+			base.written = 0
+
+			for i := 0; i < b.N; i++ {
+				if i%appendsPerFile == 0 {
+					if file != nil {
+						file.Close()
+						fs.Remove("/bench.bin")
+					}
+					file, _ = fs.Create("/bench.bin")
+					if legacy {
+						useLegacyIndex(b, file)
+					}
+				}
+				file.Write(data)
+				file.Sync()
+			}
+
+			b.ReportMetric(float64(base.written)/float64(b.N), "written-B/op")
+			file.Close()
+		})
+	}
+}
+
 func BenchmarkChunkedFile_SequentialWrite(b *testing.B) {
 	base, _ := memfs.NewFS()
 
@@ -468,3 +995,622 @@ func BenchmarkChunkedFile_RandomSeek(b *testing.B) {
 		file.Close()
 	}
 }
+
+func TestChunkedFile_HeaderCipher(t *testing.T) {
+	base, err := memfs.NewFS()
+	if err != nil {
+		t.Fatalf("Failed to create memfs: %v", err)
+	}
+
+	newFS := func(cipher CipherSuite) *EncryptFS {
+		fs, err := New(base, &Config{
+			Cipher: cipher,
+			KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+				Memory:      64 * 1024,
+				Iterations:  1,
+				Parallelism: 2,
+			}),
+			ChunkSize: 4 * 1024,
+		})
+		if err != nil {
+			t.Fatalf("Failed to create EncryptFS: %v", err)
+		}
+		return fs
+	}
+
+	testData := make([]byte, 3*4*1024+100)
+	rand.Read(testData)
+
+	file, err := newFS(CipherChaCha20Poly1305).Create("/chacha.bin")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	file.Write(testData)
+	if err := file.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// The file is read with the cipher and nonce size its header records
+	file, err = newFS(CipherAES256GCM).Open("/chacha.bin")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	cf := file.(*ChunkedFile)
+	if cf.fileHeader.Cipher != CipherChaCha20Poly1305 {
+		t.Errorf("header cipher = %s, want %s", cf.fileHeader.Cipher, CipherChaCha20Poly1305)
+	}
+	got, err := io.ReadAll(file)
+	file.Close()
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if !bytes.Equal(got, testData) {
+		t.Error("Data mismatch reading ChaCha file with an AES config")
+	}
+
+	// A chunk whose header disagrees with the index is reported as corrupt
+	// rather than decrypted from misaligned bytes
+	raw, err := base.OpenFile("/chacha.bin", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile on base failed: %v", err)
+	}
+	header := &FileHeader{}
+	if _, err := header.ReadFrom(raw); err != nil {
+		t.Fatalf("ReadFrom header failed: %v", err)
+	}
+	index := header.newChunkIndex(0)
+	if _, err := index.ReadFrom(raw); err != nil {
+		t.Fatalf("ReadFrom index failed: %v", err)
+	}
+	if _, err := raw.WriteAt([]byte{0xFF, 0xFF, 0, 0}, int64(index.ChunkOffsets[1])); err != nil {
+		t.Fatalf("WriteAt on base failed: %v", err)
+	}
+	raw.Close()
+
+	file, err = newFS(CipherAES256GCM).Open("/chacha.bin")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer file.Close()
+
+	_, err = io.ReadAll(file)
+	var corruption *CorruptionError
+	if !errors.As(err, &corruption) || corruption.ChunkIdx != 1 {
+		t.Errorf("ReadAll error = %v, want CorruptionError for chunk 1", err)
+	}
+}
+
+func TestChunkedFile_WriteThrough(t *testing.T) {
+	const chunkSize = 4 * 1024
+
+	tests := []struct {
+		name         string
+		writeThrough bool
+		persisted    []int // Plaintext visible to a reader after each write
+	}{
+		{"write-back", false, []int{0, 0, 0, 0}},
+		{"write-through", true, []int{0, chunkSize, chunkSize, 2 * chunkSize}},
+	}
+	writes := []int{1000, chunkSize - 1000, 100, chunkSize - 100}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base, err := memfs.NewFS()
+			if err != nil {
+				t.Fatalf("Failed to create memfs: %v", err)
+			}
+
+			fs, err := New(base, &Config{
+				Cipher: CipherAES256GCM,
+				KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+					Memory:      64 * 1024,
+					Iterations:  1,
+					Parallelism: 2,
+				}),
+				ChunkSize:    chunkSize,
+				WriteThrough: tt.writeThrough,
+			})
+			if err != nil {
+				t.Fatalf("Failed to create EncryptFS: %v", err)
+			}
+
+			data := make([]byte, 2*chunkSize)
+			rand.Read(data)
+
+			file, err := fs.Create("/durable.bin")
+			if err != nil {
+				t.Fatalf("Create failed: %v", err)
+			}
+			defer file.Close()
+
+			var written int
+			for i, n := range writes {
+				if _, err := file.Write(data[written : written+n]); err != nil {
+					t.Fatalf("Write failed: %v", err)
+				}
+				written += n
+
+				// A separate handle sees only what reached the base file,
+				// which stays empty until the first chunk is flushed
+				var got []byte
+				if info, err := base.Stat("/durable.bin"); err != nil {
+					t.Fatalf("Stat failed: %v", err)
+				} else if info.Size() > 0 {
+					reader, err := fs.Open("/durable.bin")
+					if err != nil {
+						t.Fatalf("Open failed: %v", err)
+					}
+					got, err = io.ReadAll(reader)
+					reader.Close()
+					if err != nil {
+						t.Fatalf("ReadAll failed: %v", err)
+					}
+				}
+				if want := data[:tt.persisted[i]]; !bytes.Equal(got, want) {
+					t.Errorf("after writing %d bytes the base file holds %d bytes, want %d", written, len(got), len(want))
+				}
+			}
+		})
+	}
+}
+
+func TestChunkedFile_ReadOnce(t *testing.T) {
+	base, err := memfs.NewFS()
+	if err != nil {
+		t.Fatalf("Failed to create memfs: %v", err)
+	}
+
+	fs, err := New(base, &Config{
+		Cipher: CipherAES256GCM,
+		KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+			Memory:      64 * 1024,
+			Iterations:  1,
+			Parallelism: 2,
+		}),
+		ReadOnce: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create EncryptFS: %v", err)
+	}
+
+	data := make([]byte, 3*DefaultChunkSize+100)
+	rand.Read(data)
+
+	file, err := fs.Create("/download.bin")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	file.Write(data)
+	file.Close()
+
+	// New files are chunked even though ChunkSize is zero
+	file, err = fs.Open("/download.bin")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer file.Close()
+	cf, ok := file.(*ChunkedFile)
+	if !ok {
+		t.Fatalf("Open returned %T, want *ChunkedFile", file)
+	}
+
+	got, err := io.ReadAll(file)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("Data mismatch reading a read-once file")
+	}
+	if n := len(cf.cache.cache); n != 0 {
+		t.Errorf("%d chunks cached, want none", n)
+	}
+}
+
+// syncCountingFS counts the Sync calls made on its files
+type syncCountingFS struct {
+	absfs.FileSystem
+	syncs int
+}
+
+func (f *syncCountingFS) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	file, err := f.FileSystem.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &syncCountingFile{File: file, fs: f}, nil
+}
+
+type syncCountingFile struct {
+	absfs.File
+	fs *syncCountingFS
+}
+
+func (f *syncCountingFile) Sync() error {
+	f.fs.syncs++
+	return f.File.Sync()
+}
+
+func TestChunkedFile_Flush(t *testing.T) {
+	const chunkSize = 4 * 1024
+
+	// memfs publishes writes to other handles only on Sync, so the
+	// operating system's filesystem is used
+	osBase, cleanup := setupTestFS(t)
+	defer cleanup()
+	base := &syncCountingFS{FileSystem: osBase}
+
+	fs, err := New(base, &Config{
+		Cipher: CipherAES256GCM,
+		KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+			Memory:      64 * 1024,
+			Iterations:  1,
+			Parallelism: 2,
+		}),
+		ChunkSize: chunkSize,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create EncryptFS: %v", err)
+	}
+
+	data := make([]byte, chunkSize+1000)
+	rand.Read(data)
+
+	file, err := fs.Create("/flushed.bin")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	defer file.Close()
+	if _, err := file.Write(data); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	syncs := base.syncs
+	if err := file.(*ChunkedFile).Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if base.syncs != syncs {
+		t.Errorf("Flush synced the base file %d times, want 0", base.syncs-syncs)
+	}
+
+	// A second handle reads everything written before the flush
+	reader, err := fs.Open("/flushed.bin")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	got, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("second handle read %d bytes, want %d", len(got), len(data))
+	}
+
+	syncs = base.syncs
+	if err := file.Sync(); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	if base.syncs != syncs+1 {
+		t.Errorf("Sync synced the base file %d times, want 1", base.syncs-syncs)
+	}
+}
+
+// TestChunkedFile_MixedChunkSizes writes files with several chunk sizes and
+// reads, appends to and rewrites them all through a filesystem configured
+// with yet another, which must honor the chunk size stored in each file
+func TestChunkedFile_MixedChunkSizes(t *testing.T) {
+	base, err := memfs.NewFS()
+	if err != nil {
+		t.Fatalf("Failed to create memfs: %v", err)
+	}
+	keyProvider := NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+		Memory:      64 * 1024,
+		Iterations:  1,
+		Parallelism: 2,
+	})
+	newFS := func(chunkSize int, parallel bool) *EncryptFS {
+		t.Helper()
+		config := &Config{Cipher: CipherAES256GCM, KeyProvider: keyProvider, ChunkSize: chunkSize}
+		if parallel {
+			config.Parallel = DefaultParallelConfig()
+		}
+		fs, err := New(base, config)
+		if err != nil {
+			t.Fatalf("Failed to create EncryptFS: %v", err)
+		}
+		return fs
+	}
+
+	chunkSizes := []int{4 * 1024, 64 * 1024, 1024 * 1024}
+	want := make(map[string][]byte)
+	for _, chunkSize := range chunkSizes {
+		fs := newFS(chunkSize, false)
+		name := fmt.Sprintf("/chunks-%d.bin", chunkSize)
+		data := make([]byte, 2*chunkSize+chunkSize/3)
+		rand.Read(data)
+		file, err := fs.Create(name)
+		if err != nil {
+			t.Fatalf("Create %s failed: %v", name, err)
+		}
+		if _, err := file.Write(data); err != nil {
+			t.Fatalf("Write %s failed: %v", name, err)
+		}
+		if err := file.Close(); err != nil {
+			t.Fatalf("Close %s failed: %v", name, err)
+		}
+		want[name] = data
+		fs.Close()
+	}
+
+	for _, parallel := range []bool{false, true} {
+		fs := newFS(256*1024, parallel)
+		compareTree(t, fs, "/", want)
+
+		for _, chunkSize := range chunkSizes {
+			name := fmt.Sprintf("/chunks-%d.bin", chunkSize)
+			data := want[name]
+
+			// Reads that start and end inside chunks
+			file, err := fs.OpenFile(name, os.O_RDWR, 0)
+			if err != nil {
+				t.Fatalf("Open %s failed: %v", name, err)
+			}
+			buf := make([]byte, chunkSize)
+			off := int64(chunkSize / 2)
+			if n, err := file.ReadAt(buf, off); err != nil || !bytes.Equal(buf[:n], data[off:off+int64(n)]) {
+				t.Errorf("parallel %v: ReadAt(%d) of %s = %d, %v, or wrong data", parallel, off, name, n, err)
+			}
+
+			// Writes across a chunk boundary and at the end keep the file's
+			// chunk size
+			patch := bytes.Repeat([]byte{byte(chunkSize)}, 100)
+			off = int64(chunkSize - 50)
+			if _, err := file.WriteAt(patch, off); err != nil {
+				t.Fatalf("WriteAt %s failed: %v", name, err)
+			}
+			data = append(data[:off:off], append(patch, data[off+int64(len(patch)):]...)...)
+			tail := bytes.Repeat([]byte("tail"), 300)
+			if _, err := file.Seek(0, io.SeekEnd); err != nil {
+				t.Fatalf("Seek %s failed: %v", name, err)
+			}
+			if _, err := file.Write(tail); err != nil {
+				t.Fatalf("Write %s failed: %v", name, err)
+			}
+			data = append(data, tail...)
+			if err := file.Close(); err != nil {
+				t.Fatalf("Close %s failed: %v", name, err)
+			}
+			want[name] = data
+
+			raw, err := base.Open(name)
+			if err != nil {
+				t.Fatalf("Failed to open base file: %v", err)
+			}
+			header := &FileHeader{}
+			_, err = header.ReadFrom(raw)
+			index := header.newChunkIndex(0)
+			if err == nil {
+				_, err = index.ReadFrom(raw)
+			}
+			raw.Close()
+			if err != nil {
+				t.Fatalf("Failed to read chunk index of %s: %v", name, err)
+			}
+			if index.ChunkSize != uint32(chunkSize) {
+				t.Errorf("parallel %v: %s has chunk size %d after writing, want %d", parallel, name, index.ChunkSize, chunkSize)
+			}
+		}
+		compareTree(t, fs, "/", want)
+		fs.Close()
+	}
+}
+
+// ioCountingFS counts the bytes read from and written to its files
+type ioCountingFS struct {
+	absfs.FileSystem
+	read, written int
+}
+
+func (f *ioCountingFS) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	file, err := f.FileSystem.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &ioCountingFile{File: file, fs: f}, nil
+}
+
+type ioCountingFile struct {
+	absfs.File
+	fs *ioCountingFS
+}
+
+func (f *ioCountingFile) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	f.fs.read += n
+	return n, err
+}
+
+func (f *ioCountingFile) ReadAt(p []byte, off int64) (int, error) {
+	n, err := f.File.ReadAt(p, off)
+	f.fs.read += n
+	return n, err
+}
+
+func (f *ioCountingFile) Write(p []byte) (int, error) {
+	n, err := f.File.Write(p)
+	f.fs.written += n
+	return n, err
+}
+
+func (f *ioCountingFile) WriteAt(p []byte, off int64) (int, error) {
+	n, err := f.File.WriteAt(p, off)
+	f.fs.written += n
+	return n, err
+}
+
+// TestChunkedFile_AppendOpen appends to an existing chunked file through an
+// O_APPEND handle, which starts from the loaded index: only the last chunk
+// is read back, and only it, the new chunks and their index entries are
+// written
+func TestChunkedFile_AppendOpen(t *testing.T) {
+	const chunkSize = 4 * 1024
+
+	osBase, cleanup := setupTestFS(t)
+	defer cleanup()
+	base := &ioCountingFS{FileSystem: osBase}
+	fs, err := New(base, &Config{
+		Cipher: CipherAES256GCM,
+		KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+			Memory:      64 * 1024,
+			Iterations:  1,
+			Parallelism: 2,
+		}),
+		ChunkSize: chunkSize,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create EncryptFS: %v", err)
+	}
+
+	existing := make([]byte, 64*chunkSize+1000)
+	rand.Read(existing)
+	if err := fs.WriteFiles(map[string][]byte{"/log.bin": existing}); err != nil {
+		t.Fatalf("WriteFiles failed: %v", err)
+	}
+
+	appended := bytes.Repeat([]byte("new log line\n"), 700)
+	base.read, base.written = 0, 0
+	file, err := fs.OpenFile("/log.bin", os.O_RDWR|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+
+	// As with os.File, the handle starts at offset 0 and writes go to the end
+	if pos, err := file.Seek(0, io.SeekCurrent); err != nil || pos != 0 {
+		t.Errorf("offset after open = %d, %v, want 0", pos, err)
+	}
+	if _, err := file.Write(appended[:5000]); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if _, err := file.Write(appended[5000:]); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// The header and index, then one chunk, are read; the file is not
+	info, err := osBase.Stat("/log.bin")
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if limit := 32 * 1024; base.read > limit || base.written > limit {
+		t.Errorf("appending %d bytes to a %d-byte file read %d and wrote %d bytes, want at most %d each",
+			len(appended), info.Size(), base.read, base.written, limit)
+	}
+
+	compareTree(t, fs, "/", map[string][]byte{"/log.bin": append(existing, appended...)})
+}
+
+// seekCountingFS counts the seeks to the end of its files
+type seekCountingFS struct {
+	absfs.FileSystem
+	seekEnds int
+}
+
+func (s *seekCountingFS) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	file, err := s.FileSystem.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &seekCountingFile{File: file, fs: s}, nil
+}
+
+type seekCountingFile struct {
+	absfs.File
+	fs *seekCountingFS
+}
+
+func (f *seekCountingFile) Seek(offset int64, whence int) (int64, error) {
+	if whence == io.SeekEnd {
+		f.fs.seekEnds++
+	}
+	return f.File.Seek(offset, whence)
+}
+
+// TestChunkedFile_BaseSize checks that the size of the base file is read
+// once when the file is opened, rather than for every chunk read
+func TestChunkedFile_BaseSize(t *testing.T) {
+	const chunkSize = 4 * 1024
+
+	memBase, err := memfs.NewFS()
+	if err != nil {
+		t.Fatalf("Failed to create memfs: %v", err)
+	}
+	base := &seekCountingFS{FileSystem: memBase}
+	fs, err := New(base, &Config{
+		Cipher: CipherAES256GCM,
+		KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+			Memory:      64 * 1024,
+			Iterations:  1,
+			Parallelism: 2,
+		}),
+		ChunkSize: chunkSize,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create EncryptFS: %v", err)
+	}
+
+	data := make([]byte, 4*chunkSize+100)
+	rand.Read(data)
+	file, err := fs.Create("/sized.bin")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	file.Write(data)
+	if err := file.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	base.seekEnds = 0
+	file, err = fs.Open("/sized.bin")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	got, err := io.ReadAll(file)
+	file.Close()
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("Content mismatch")
+	}
+	if base.seekEnds != 1 {
+		t.Errorf("reading %d chunks sought the end %d times, want 1", CalculateChunkCount(int64(len(data)), chunkSize), base.seekEnds)
+	}
+
+	// Appends land at the recorded end of the file
+	file, err = fs.OpenFile("/sized.bin", os.O_RDWR|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	tail := make([]byte, 2*chunkSize)
+	rand.Read(tail)
+	file.Write(tail)
+	if err := file.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	data = append(data, tail...)
+
+	file, err = fs.Open("/sized.bin")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	got, err = io.ReadAll(file)
+	file.Close()
+	if err != nil {
+		t.Fatalf("ReadAll after append failed: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("Content mismatch after append")
+	}
+}
@@ -5,10 +5,14 @@ import (
 	"crypto/cipher"
 	"crypto/rand"
 	"fmt"
+	"io"
 
 	"golang.org/x/crypto/chacha20poly1305"
 )
 
+// aeadTagSize is the authentication tag size shared by all supported AEAD ciphers
+const aeadTagSize = 16
+
 // CipherEngine provides AEAD encryption/decryption
 type CipherEngine interface {
 	// Encrypt encrypts plaintext with the given nonce
@@ -24,6 +28,39 @@ type CipherEngine interface {
 	Overhead() int
 }
 
+// aadEngine is implemented by cipher engines that can authenticate
+// additional data stored outside the ciphertext, such as header fields
+type aadEngine interface {
+	EncryptWithAAD(nonce, plaintext, additionalData []byte) ([]byte, error)
+	DecryptWithAAD(nonce, ciphertext, additionalData []byte) ([]byte, error)
+}
+
+// encryptWithAAD encrypts plaintext with engine, authenticating
+// additionalData if there is any
+func encryptWithAAD(engine CipherEngine, nonce, plaintext, additionalData []byte) ([]byte, error) {
+	if len(additionalData) == 0 {
+		return engine.Encrypt(nonce, plaintext)
+	}
+	aad, ok := engine.(aadEngine)
+	if !ok {
+		return nil, fmt.Errorf("%w: cipher engine cannot authenticate additional data", ErrNotSupported)
+	}
+	return aad.EncryptWithAAD(nonce, plaintext, additionalData)
+}
+
+// decryptWithAAD decrypts ciphertext with engine, checking additionalData
+// if there is any
+func decryptWithAAD(engine CipherEngine, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(additionalData) == 0 {
+		return engine.Decrypt(nonce, ciphertext)
+	}
+	aad, ok := engine.(aadEngine)
+	if !ok {
+		return nil, fmt.Errorf("%w: cipher engine cannot authenticate additional data", ErrNotSupported)
+	}
+	return aad.DecryptWithAAD(nonce, ciphertext, additionalData)
+}
+
 // AESGCMEngine implements CipherEngine using AES-256-GCM
 type AESGCMEngine struct {
 	aead cipher.AEAD
@@ -50,21 +87,33 @@ func NewAESGCMEngine(key []byte) (*AESGCMEngine, error) {
 
 // Encrypt encrypts plaintext using AES-256-GCM
 func (e *AESGCMEngine) Encrypt(nonce, plaintext []byte) ([]byte, error) {
+	return e.EncryptWithAAD(nonce, plaintext, nil)
+}
+
+// EncryptWithAAD encrypts plaintext using AES-256-GCM, authenticating
+// additionalData without encrypting it
+func (e *AESGCMEngine) EncryptWithAAD(nonce, plaintext, additionalData []byte) ([]byte, error) {
 	if len(nonce) != e.NonceSize() {
 		return nil, fmt.Errorf("nonce must be %d bytes, got %d", e.NonceSize(), len(nonce))
 	}
 
-	ciphertext := e.aead.Seal(nil, nonce, plaintext, nil)
+	ciphertext := e.aead.Seal(nil, nonce, plaintext, additionalData)
 	return ciphertext, nil
 }
 
 // Decrypt decrypts ciphertext using AES-256-GCM
 func (e *AESGCMEngine) Decrypt(nonce, ciphertext []byte) ([]byte, error) {
+	return e.DecryptWithAAD(nonce, ciphertext, nil)
+}
+
+// DecryptWithAAD decrypts ciphertext using AES-256-GCM, failing unless
+// additionalData matches the data it was encrypted with
+func (e *AESGCMEngine) DecryptWithAAD(nonce, ciphertext, additionalData []byte) ([]byte, error) {
 	if len(nonce) != e.NonceSize() {
 		return nil, fmt.Errorf("nonce must be %d bytes, got %d", e.NonceSize(), len(nonce))
 	}
 
-	plaintext, err := e.aead.Open(nil, nonce, ciphertext, nil)
+	plaintext, err := e.aead.Open(nil, nonce, ciphertext, additionalData)
 	if err != nil {
 		return nil, ErrAuthFailed
 	}
@@ -104,21 +153,33 @@ func NewChaCha20Poly1305Engine(key []byte) (*ChaCha20Poly1305Engine, error) {
 
 // Encrypt encrypts plaintext using ChaCha20-Poly1305
 func (e *ChaCha20Poly1305Engine) Encrypt(nonce, plaintext []byte) ([]byte, error) {
+	return e.EncryptWithAAD(nonce, plaintext, nil)
+}
+
+// EncryptWithAAD encrypts plaintext using ChaCha20-Poly1305, authenticating
+// additionalData without encrypting it
+func (e *ChaCha20Poly1305Engine) EncryptWithAAD(nonce, plaintext, additionalData []byte) ([]byte, error) {
 	if len(nonce) != e.NonceSize() {
 		return nil, fmt.Errorf("nonce must be %d bytes, got %d", e.NonceSize(), len(nonce))
 	}
 
-	ciphertext := e.aead.Seal(nil, nonce, plaintext, nil)
+	ciphertext := e.aead.Seal(nil, nonce, plaintext, additionalData)
 	return ciphertext, nil
 }
 
 // Decrypt decrypts ciphertext using ChaCha20-Poly1305
 func (e *ChaCha20Poly1305Engine) Decrypt(nonce, ciphertext []byte) ([]byte, error) {
+	return e.DecryptWithAAD(nonce, ciphertext, nil)
+}
+
+// DecryptWithAAD decrypts ciphertext using ChaCha20-Poly1305, failing unless
+// additionalData matches the data it was encrypted with
+func (e *ChaCha20Poly1305Engine) DecryptWithAAD(nonce, ciphertext, additionalData []byte) ([]byte, error) {
 	if len(nonce) != e.NonceSize() {
 		return nil, fmt.Errorf("nonce must be %d bytes, got %d", e.NonceSize(), len(nonce))
 	}
 
-	plaintext, err := e.aead.Open(nil, nonce, ciphertext, nil)
+	plaintext, err := e.aead.Open(nil, nonce, ciphertext, additionalData)
 	if err != nil {
 		return nil, ErrAuthFailed
 	}
@@ -136,6 +197,16 @@ func (e *ChaCha20Poly1305Engine) Overhead() int {
 	return e.aead.Overhead()
 }
 
+// resolveCipher returns the concrete cipher selected by CipherAuto, or the
+// given cipher unchanged
+func resolveCipher(cipher CipherSuite) CipherSuite {
+	if cipher == CipherAuto {
+		// Auto-select AES-256-GCM (in future, detect AES-NI support)
+		return CipherAES256GCM
+	}
+	return cipher
+}
+
 // NewCipherEngine creates a new cipher engine based on the cipher suite
 func NewCipherEngine(cipher CipherSuite, key []byte) (CipherEngine, error) {
 	switch cipher {
@@ -153,23 +224,34 @@ func NewCipherEngine(cipher CipherSuite, key []byte) (CipherEngine, error) {
 	}
 }
 
-// GenerateNonce generates a random nonce for the given cipher
-func GenerateNonce(cipher CipherSuite) ([]byte, error) {
-	var nonceSize int
-
+// nonceSizeFor returns the nonce size used with the given cipher
+func nonceSizeFor(cipher CipherSuite) (int, error) {
 	switch cipher {
 	case CipherAES256GCM:
-		nonceSize = 12 // GCM standard nonce size
+		return 12, nil // GCM standard nonce size
 	case CipherChaCha20Poly1305:
-		nonceSize = chacha20poly1305.NonceSize
+		return chacha20poly1305.NonceSize, nil
 	case CipherAuto:
-		nonceSize = 12 // Default to GCM size
+		return 12, nil // Default to GCM size
 	default:
-		return nil, ErrUnsupportedCipher
+		return 0, ErrUnsupportedCipher
+	}
+}
+
+// GenerateNonce generates a random nonce for the given cipher
+func GenerateNonce(cipher CipherSuite) ([]byte, error) {
+	return generateNonceFrom(rand.Reader, cipher)
+}
+
+// generateNonceFrom reads a nonce for the given cipher from random
+func generateNonceFrom(random io.Reader, cipher CipherSuite) ([]byte, error) {
+	nonceSize, err := nonceSizeFor(cipher)
+	if err != nil {
+		return nil, err
 	}
 
 	nonce := make([]byte, nonceSize)
-	if _, err := rand.Read(nonce); err != nil {
+	if _, err := io.ReadFull(random, nonce); err != nil {
 		return nil, fmt.Errorf("failed to generate nonce: %w", err)
 	}
 
@@ -0,0 +1,191 @@
+package encryptfs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/memfs"
+)
+
+// TestFileConformance runs the same sequence of operations against every
+// absfs.File implementation and expects identical results
+func TestFileConformance(t *testing.T) {
+	newFS := func(t *testing.T, chunkSize int) (*EncryptFS, absfs.FileSystem) {
+		t.Helper()
+		base, err := memfs.NewFS()
+		if err != nil {
+			t.Fatalf("memfs.NewFS failed: %v", err)
+		}
+		fs, err := New(base, &Config{
+			Cipher:      CipherAES256GCM,
+			KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{Memory: 64 * 1024, Iterations: 1, Parallelism: 2}),
+			ChunkSize:   chunkSize,
+		})
+		if err != nil {
+			t.Fatalf("New failed: %v", err)
+		}
+		return fs, base
+	}
+
+	kinds := []struct {
+		name string
+		open func(t *testing.T) func(name string, flag int) (absfs.File, error)
+	}{
+		{"traditional", func(t *testing.T) func(string, int) (absfs.File, error) {
+			fs, _ := newFS(t, 0)
+			return func(name string, flag int) (absfs.File, error) {
+				return fs.OpenFile(name, flag, 0644)
+			}
+		}},
+		{"chunked", func(t *testing.T) func(string, int) (absfs.File, error) {
+			fs, _ := newFS(t, 4096)
+			return func(name string, flag int) (absfs.File, error) {
+				return fs.OpenFile(name, flag, 0644)
+			}
+		}},
+		{"streaming", func(t *testing.T) func(string, int) (absfs.File, error) {
+			fs, base := newFS(t, 0)
+			return func(name string, flag int) (absfs.File, error) {
+				baseFile, err := base.OpenFile(name, flag, 0644)
+				if err != nil {
+					return nil, err
+				}
+				return newStreamingFile(baseFile, fs, DefaultStreamingConfig(), flag)
+			}
+		}},
+	}
+
+	for _, kind := range kinds {
+		t.Run(kind.name, func(t *testing.T) {
+			open := kind.open(t)
+
+			file, err := open("/file.txt", os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+			if err != nil {
+				t.Fatalf("open failed: %v", err)
+			}
+			if file.Name() == "" {
+				t.Error("Name() is empty")
+			}
+
+			if _, err := file.WriteString("hello "); err != nil {
+				t.Fatalf("WriteString failed: %v", err)
+			}
+			if _, err := file.Write([]byte("world!")); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+
+			info, err := file.Stat()
+			if err != nil {
+				t.Fatalf("Stat failed: %v", err)
+			}
+			if info.Size() != 12 {
+				t.Errorf("Stat size = %d, want 12", info.Size())
+			}
+
+			if _, err := file.Seek(0, io.SeekStart); err != nil {
+				t.Fatalf("Seek failed: %v", err)
+			}
+			data, err := io.ReadAll(file)
+			if err != nil {
+				t.Fatalf("ReadAll failed: %v", err)
+			}
+			if string(data) != "hello world!" {
+				t.Errorf("ReadAll = %q, want %q", data, "hello world!")
+			}
+
+			buf := make([]byte, 5)
+			if n, err := file.ReadAt(buf, 6); err != nil || string(buf[:n]) != "world" {
+				t.Errorf("ReadAt = %q, %v, want %q", buf[:n], err, "world")
+			}
+			if _, err := file.ReadAt(buf, 20); err != io.EOF {
+				t.Errorf("ReadAt past end error = %v, want io.EOF", err)
+			}
+
+			pos, err := file.Seek(0, io.SeekCurrent)
+			if err != nil {
+				t.Fatalf("Seek failed: %v", err)
+			}
+			if _, err := file.WriteAt([]byte("W"), 6); err != nil {
+				t.Fatalf("WriteAt failed: %v", err)
+			}
+			if after, _ := file.Seek(0, io.SeekCurrent); after != pos {
+				t.Errorf("WriteAt moved offset from %d to %d", pos, after)
+			}
+			if end, err := file.Seek(0, io.SeekEnd); err != nil || end != 12 {
+				t.Errorf("Seek(0, SeekEnd) = %d, %v, want 12", end, err)
+			}
+
+			if err := file.Truncate(5); err != nil {
+				t.Fatalf("Truncate failed: %v", err)
+			}
+			if err := file.Truncate(8); err != nil {
+				t.Fatalf("Truncate failed: %v", err)
+			}
+			if n, err := file.ReadAt(make([]byte, 8), 0); n != 8 || (err != nil && err != io.EOF) {
+				t.Errorf("ReadAt after Truncate = %d, %v, want 8 bytes", n, err)
+			}
+
+			if _, err := file.Readdir(-1); !errors.Is(err, errNotDir) {
+				t.Errorf("Readdir error = %v, want errNotDir", err)
+			}
+			if _, err := file.Readdirnames(-1); !errors.Is(err, errNotDir) {
+				t.Errorf("Readdirnames error = %v, want errNotDir", err)
+			}
+
+			if err := file.Sync(); err != nil {
+				t.Errorf("Sync failed: %v", err)
+			}
+			if err := file.Close(); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+
+			file, err = open("/file.txt", os.O_RDONLY)
+			if err != nil {
+				t.Fatalf("reopen failed: %v", err)
+			}
+			defer file.Close()
+
+			data, err = io.ReadAll(file)
+			if err != nil {
+				t.Fatalf("ReadAll after reopen failed: %v", err)
+			}
+			want := []byte("hello\x00\x00\x00")
+			if !bytes.Equal(data, want) {
+				t.Errorf("content after reopen = %q, want %q", data, want)
+			}
+			if info, err := file.Stat(); err != nil || info.Size() != int64(len(want)) {
+				t.Errorf("Stat after reopen = %v, %v, want size %d", info, err, len(want))
+			}
+
+			// Like os.File, a read-only handle refuses writes at once and
+			// Close has nothing to flush
+			for op, write := range map[string]func() error{
+				"Write":       func() error { _, err := file.Write([]byte("x")); return err },
+				"WriteString": func() error { _, err := file.WriteString("x"); return err },
+				"WriteAt":     func() error { _, err := file.WriteAt([]byte("x"), 0); return err },
+				"Truncate":    func() error { return file.Truncate(0) },
+			} {
+				var pathErr *os.PathError
+				if err := write(); !errors.As(err, &pathErr) || !errors.Is(err, syscall.EBADF) {
+					t.Errorf("%s on a read-only handle = %v, want a PathError wrapping EBADF", op, err)
+				}
+			}
+			if err := file.Close(); err != nil {
+				t.Errorf("Close of a read-only handle failed: %v", err)
+			}
+			file, err = open("/file.txt", os.O_RDONLY)
+			if err != nil {
+				t.Fatalf("reopen failed: %v", err)
+			}
+			defer file.Close()
+			if data, err := io.ReadAll(file); err != nil || !bytes.Equal(data, want) {
+				t.Errorf("content after refused writes = %q, %v, want %q", data, err, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package encryptfs
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// errSameFile reports a copy of a file onto itself, which would truncate
+// the source before reading it
+var errSameFile = errors.New("source and destination are the same file")
+
+// Cloner is implemented by base filesystems that can copy a file by sharing
+// its storage, such as copy-on-write reflinks. Clone makes dst an exact copy
+// of src, replacing dst if it exists. It returns an error wrapping
+// errors.ErrUnsupported if the two paths cannot be cloned, in which case
+// Copy falls back to copying the contents.
+type Cloner interface {
+	Clone(src, dst string) error
+}
+
+// Copy copies the regular file src to dst, replacing dst if it exists. If
+// the base filesystem implements Cloner, the ciphertext is cloned as is:
+// the copy keeps the salt and nonce of src, so it decrypts with the same key
+// and costs no re-encryption. Otherwise the contents are decrypted and
+// written to dst, which gets its own key. Copying a path onto itself fails
+// without touching the file.
+func (e *EncryptFS) Copy(src, dst string) error {
+	for _, name := range []string{src, dst} {
+		if err := e.checkTarget("copy", name); err != nil {
+			return err
+		}
+	}
+	sep := string([]byte{e.base.Separator()})
+	if e.logicalPath(sep+src) == e.logicalPath(sep+dst) {
+		return &os.LinkError{Op: "copy", Old: src, New: dst, Err: errSameFile}
+	}
+
+	info, err := e.Stat(src)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return &os.PathError{Op: "copy", Path: src, Err: errIsDir}
+	}
+
+	if cloner, ok := e.base.(Cloner); ok {
+		err := e.cloneFile(cloner, src, dst)
+		if !errors.Is(err, errors.ErrUnsupported) {
+			return err
+		}
+	}
+
+	return e.copyContents(src, dst)
+}
+
+// cloneFile clones the ciphertext of src to dst on the base filesystem
+func (e *EncryptFS) cloneFile(cloner Cloner, src, dst string) error {
+	encryptedSrc, err := e.translatePath(src)
+	if err != nil {
+		return err
+	}
+
+	var encryptedDst string
+	var created bool
+	if e.flat != nil {
+		encryptedDst, created, err = e.flat.create(e.logicalPath(dst), e.baseExists)
+	} else {
+		encryptedDst, err = e.translatePath(dst)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := cloner.Clone(encryptedSrc, encryptedDst); err != nil {
+		if created {
+			e.flat.metadata.Remove(encryptedDst)
+		}
+		return err
+	}
+
+	// The copy starts without extended attributes, as with copyContents
+	return removeXattrs(e.base, encryptedDst)
+}
+
+// copyContents decrypts src and writes its contents to dst
+func (e *EncryptFS) copyContents(src, dst string) error {
+	in, err := e.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := e.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	encryptedDst, err := e.translatePath(dst)
+	if err != nil {
+		return err
+	}
+	return removeXattrs(e.base, encryptedDst)
+}
@@ -0,0 +1,206 @@
+package encryptfs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/absfs/absfs"
+)
+
+// cloningFS adds a Cloner to a base filesystem, counting the clones made
+type cloningFS struct {
+	absfs.FileSystem
+	clones int
+}
+
+func (c *cloningFS) Clone(src, dst string) error {
+	data, err := readBaseFile(c.FileSystem, src)
+	if err != nil {
+		return err
+	}
+	file, err := c.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	c.clones++
+	return file.Close()
+}
+
+func TestCopy(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    FilenameEncryption
+		flatten bool
+	}{
+		{"none", FilenameEncryptionNone, false},
+		{"deterministic", FilenameEncryptionDeterministic, false},
+		{"random", FilenameEncryptionRandom, false},
+		{"flat", FilenameEncryptionRandom, true},
+	}
+
+	for _, tt := range tests {
+		for _, clone := range []bool{false, true} {
+			name := tt.name + "/stream"
+			if clone {
+				name = tt.name + "/clone"
+			}
+			t.Run(name, func(t *testing.T) {
+				base, cleanup := setupTestFS(t)
+				defer cleanup()
+
+				cloner := &cloningFS{FileSystem: base}
+				config := &Config{
+					Cipher: CipherAES256GCM,
+					KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+						Memory:      64 * 1024,
+						Iterations:  1,
+						Parallelism: 2,
+					}),
+					FilenameEncryption: tt.mode,
+					FlattenDirectories: tt.flatten,
+				}
+				if tt.mode == FilenameEncryptionRandom {
+					config.MetadataPath = "/.metadata.json"
+				}
+				var fsBase absfs.FileSystem = base
+				if clone {
+					fsBase = cloner
+				}
+				fs, err := New(fsBase, config)
+				if err != nil {
+					t.Fatalf("failed to create EncryptFS: %v", err)
+				}
+
+				data := []byte("contents worth copying")
+				file, err := fs.Create("/src.txt")
+				if err != nil {
+					t.Fatalf("failed to create file: %v", err)
+				}
+				file.Write(data)
+				file.Close()
+
+				if err := fs.Copy("/src.txt", "/dst.txt"); err != nil {
+					t.Fatalf("Copy failed: %v", err)
+				}
+
+				file, err = fs.Open("/dst.txt")
+				if err != nil {
+					t.Fatalf("failed to open copy: %v", err)
+				}
+				got, err := io.ReadAll(file)
+				file.Close()
+				if err != nil || !bytes.Equal(got, data) {
+					t.Errorf("copy content = %q, %v, want %q", got, err, data)
+				}
+
+				// A clone shares the ciphertext; a stream copy re-encrypts
+				srcPath, _ := fs.translatePath("/src.txt")
+				dstPath, _ := fs.translatePath("/dst.txt")
+				srcRaw, _ := readBaseFile(base, srcPath)
+				dstRaw, _ := readBaseFile(base, dstPath)
+				if clone {
+					if cloner.clones != 1 {
+						t.Errorf("%d clones, want 1", cloner.clones)
+					}
+					if !bytes.Equal(srcRaw, dstRaw) {
+						t.Error("cloned ciphertext differs from the source")
+					}
+				} else if bytes.Equal(srcRaw, dstRaw) {
+					t.Error("stream copy reused the source ciphertext")
+				}
+
+				// Writing to the copy leaves the source untouched
+				file, err = fs.OpenFile("/dst.txt", os.O_RDWR, 0)
+				if err != nil {
+					t.Fatalf("failed to open copy for writing: %v", err)
+				}
+				file.WriteAt([]byte("CONTENTS"), 0)
+				file.Close()
+
+				file, err = fs.Open("/src.txt")
+				if err != nil {
+					t.Fatalf("failed to open source: %v", err)
+				}
+				got, _ = io.ReadAll(file)
+				file.Close()
+				if !bytes.Equal(got, data) {
+					t.Errorf("source content = %q after writing the copy, want %q", got, data)
+				}
+			})
+		}
+	}
+}
+
+// unsupportedCloner is a Cloner that can never clone
+type unsupportedCloner struct {
+	absfs.FileSystem
+}
+
+func (u unsupportedCloner) Clone(src, dst string) error {
+	return &os.LinkError{Op: "clone", Old: src, New: dst, Err: errors.ErrUnsupported}
+}
+
+func TestCopy_CloneUnsupported(t *testing.T) {
+	base, cleanup := setupTestFS(t)
+	defer cleanup()
+
+	fs, err := New(unsupportedCloner{base}, &Config{
+		Cipher:      CipherAES256GCM,
+		KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{Memory: 64 * 1024, Iterations: 1, Parallelism: 2}),
+	})
+	if err != nil {
+		t.Fatalf("failed to create EncryptFS: %v", err)
+	}
+
+	file, err := fs.Create("/src.txt")
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	file.Write([]byte("data"))
+	file.Close()
+
+	// Copy falls back to copying the contents
+	if err := fs.Copy("/src.txt", "/dst.txt"); err != nil {
+		t.Fatalf("Copy failed: %v", err)
+	}
+	file, err = fs.Open("/dst.txt")
+	if err != nil {
+		t.Fatalf("failed to open copy: %v", err)
+	}
+	defer file.Close()
+	if got, _ := io.ReadAll(file); string(got) != "data" {
+		t.Errorf("copy content = %q, want %q", got, "data")
+	}
+}
+
+func TestCopy_Errors(t *testing.T) {
+	fs, _ := newXattrTestFS(t, FilenameEncryptionNone, false)
+
+	if err := fs.Mkdir("/dir", 0755); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+	if err := fs.Copy("/dir", "/other"); !errors.Is(err, errIsDir) {
+		t.Errorf("Copy of a directory error = %v, want errIsDir", err)
+	}
+	if err := fs.Copy("/missing", "/other"); !os.IsNotExist(err) {
+		t.Errorf("Copy of a missing file error = %v, want not exist", err)
+	}
+
+	// A copy onto itself fails before the file is truncated
+	if err := fs.WriteFiles(map[string][]byte{"/dir/a.txt": []byte("content")}); err != nil {
+		t.Fatalf("WriteFiles failed: %v", err)
+	}
+	for _, dst := range []string{"/dir/a.txt", "dir/a.txt", "/dir/../dir/./a.txt"} {
+		if err := fs.Copy("/dir/a.txt", dst); !errors.Is(err, errSameFile) {
+			t.Errorf("Copy onto %s error = %v, want errSameFile", dst, err)
+		}
+	}
+	compareTree(t, fs, "/dir", map[string][]byte{"/a.txt": []byte("content")})
+}
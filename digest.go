@@ -0,0 +1,177 @@
+package encryptfs
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// digestNonceSize and digestTagSize frame the sealed digest, which is
+	// sealed with AES-256-GCM whatever the cipher of the file
+	digestNonceSize = 12
+	digestTagSize   = 16
+
+	// sealedDigestSize is the size of the digest recorded in the header
+	sealedDigestSize = digestNonceSize + DigestSize + digestTagSize
+
+	// sealedSizeSize is the size of the plaintext size recorded in the
+	// header of a FlagPadded file, sealed the same way
+	sealedSizeSize = digestNonceSize + paddedSizeSize + digestTagSize
+)
+
+// digestKeyInfo is the HKDF info string that derives the key sealing the
+// plaintext digest from the file key
+var digestKeyInfo = []byte("encryptfs plaintext digest")
+
+// sizeKeyInfo is the HKDF info string that derives the key sealing the
+// plaintext size of a padded file from the file key
+var sizeKeyInfo = []byte("encryptfs plaintext size")
+
+// setDigestKey derives the keys that seal the plaintext digest and, for a
+// padded file, the plaintext size of the file from its key. Headers keep
+// them to seal both again whenever they are recorded.
+func (h *FileHeader) setDigestKey(key []byte) error {
+	digestKey := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, h.Salt, digestKeyInfo), digestKey); err != nil {
+		return fmt.Errorf("failed to derive digest key: %w", err)
+	}
+	sizeKey, err := deriveSizeKey(key, h.Salt)
+	if err != nil {
+		return err
+	}
+	h.digestKey = digestKey
+	h.sizeKey = sizeKey
+	return nil
+}
+
+// deriveSizeKey expands the file key into the key sealing the plaintext
+// size of a padded file
+func deriveSizeKey(key, salt []byte) ([]byte, error) {
+	sizeKey := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, salt, sizeKeyInfo), sizeKey); err != nil {
+		return nil, fmt.Errorf("failed to derive size key: %w", err)
+	}
+	return sizeKey, nil
+}
+
+// openDigest derives the digest key from the file key and, for headers that
+// record a digest, opens it. A sealed digest that does not authenticate
+// fails with ErrAuthFailed: either the key is wrong or the digest is corrupt.
+func (h *FileHeader) openDigest(key []byte) error {
+	if err := h.setDigestKey(key); err != nil {
+		return err
+	}
+	if h.Flags&FlagDigest == 0 {
+		return nil
+	}
+
+	aead, err := newDigestAEAD(h.digestKey)
+	if err != nil {
+		return err
+	}
+	if len(h.Digest) != sealedDigestSize {
+		return fmt.Errorf("invalid digest size: %d", len(h.Digest))
+	}
+	sum, err := aead.Open(nil, h.Digest[:digestNonceSize], h.Digest[digestNonceSize:], nil)
+	if err != nil {
+		return fmt.Errorf("recorded digest: %w", ErrAuthFailed)
+	}
+	h.plaintextDigest = sum
+	return nil
+}
+
+// sealDigest records sum as the plaintext digest of the file, sealed under
+// the digest key with a fresh nonce read from random, so that the header
+// reveals nothing about the plaintext and identical files cannot be linked
+func (h *FileHeader) sealDigest(sum []byte, random io.Reader) error {
+	if h.digestKey == nil {
+		return fmt.Errorf("digest key not set")
+	}
+	aead, err := newDigestAEAD(h.digestKey)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, digestNonceSize, sealedDigestSize)
+	if _, err := io.ReadFull(random, nonce); err != nil {
+		return fmt.Errorf("failed to generate digest nonce: %w", err)
+	}
+	h.Flags |= FlagDigest
+	h.Digest = aead.Seal(nonce, nonce, sum, nil)
+	h.plaintextDigest = append([]byte(nil), sum...)
+	return nil
+}
+
+// sealSize records size as the plaintext size of a padded file, sealed
+// under the size key with a fresh nonce read from random, so that Stat can
+// read it without decrypting the body while the header still hides it
+func (h *FileHeader) sealSize(size int, random io.Reader) error {
+	if h.sizeKey == nil {
+		return fmt.Errorf("size key not set")
+	}
+	aead, err := newDigestAEAD(h.sizeKey)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, digestNonceSize, sealedSizeSize)
+	if _, err := io.ReadFull(random, nonce); err != nil {
+		return fmt.Errorf("failed to generate size nonce: %w", err)
+	}
+	h.SealedSize = aead.Seal(nonce, nonce, binary.LittleEndian.AppendUint64(nil, uint64(size)), nil)
+	return nil
+}
+
+// openSize opens the plaintext size recorded in the header of a padded
+// file with the file key. A sealed size that does not authenticate fails
+// with ErrAuthFailed: either the key is wrong or the header is corrupt.
+func (h *FileHeader) openSize(key []byte) (int64, error) {
+	if h.Flags&FlagPadded == 0 {
+		return 0, fmt.Errorf("file is not padded")
+	}
+	if len(h.SealedSize) != sealedSizeSize {
+		return 0, fmt.Errorf("invalid sealed size: %d bytes", len(h.SealedSize))
+	}
+	sizeKey, err := deriveSizeKey(key, h.Salt)
+	if err != nil {
+		return 0, err
+	}
+	defer clear(sizeKey)
+	aead, err := newDigestAEAD(sizeKey)
+	if err != nil {
+		return 0, err
+	}
+	size, err := aead.Open(nil, h.SealedSize[:digestNonceSize], h.SealedSize[digestNonceSize:], nil)
+	if err != nil {
+		return 0, fmt.Errorf("recorded size: %w", ErrAuthFailed)
+	}
+	if n := binary.LittleEndian.Uint64(size); n <= math.MaxInt64 {
+		return int64(n), nil
+	}
+	return 0, fmt.Errorf("%w: recorded size out of range", ErrInvalidHeader)
+}
+
+// clearKeys zeroes the keys the header keeps to seal its digest, size and
+// format descriptor again, once the file is closed
+func (h *FileHeader) clearKeys() {
+	clear(h.digestKey)
+	clear(h.sizeKey)
+	clear(h.formatKey)
+	h.digestKey = nil
+	h.sizeKey = nil
+	h.formatKey = nil
+}
+
+// newDigestAEAD creates the AEAD that seals plaintext digests
+func newDigestAEAD(digestKey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(digestKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create digest cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,74 @@
+package encryptfs
+
+import (
+	"errors"
+	"strings"
+	"syscall"
+)
+
+// DirSyncer is implemented by base filesystems that can make the entries of
+// a directory durable themselves. Other base filesystems have the directory
+// opened and its handle synced, which is how a directory is fsynced on Unix.
+type DirSyncer interface {
+	SyncDir(name string) error
+}
+
+// syncParent makes the entry of encryptedPath in its directory durable, so
+// that a file whose data was synced is not lost with its directory entry in
+// a crash. Base filesystems that cannot open or sync directories are left
+// as they are.
+func (e *EncryptFS) syncParent(encryptedPath string) error {
+	return e.syncDir(e.parentDir(encryptedPath))
+}
+
+// parentDir returns the directory holding encryptedPath on the base
+// filesystem
+func (e *EncryptFS) parentDir(encryptedPath string) string {
+	sep := string([]byte{e.base.Separator()})
+	if i := strings.LastIndex(encryptedPath, sep); i == 0 {
+		return sep
+	} else if i > 0 {
+		return encryptedPath[:i]
+	}
+	return "."
+}
+
+// syncDir syncs the directory at encryptedPath on the base filesystem,
+// returning nil if the base filesystem does not support it
+func (e *EncryptFS) syncDir(encryptedPath string) error {
+	if syncer, ok := e.base.(DirSyncer); ok {
+		return ignoreUnsupportedSync(syncer.SyncDir(encryptedPath))
+	}
+
+	dir, err := e.base.Open(encryptedPath)
+	if err != nil {
+		return ignoreUnsupportedSync(err)
+	}
+	defer dir.Close()
+	return ignoreUnsupportedSync(dir.Sync())
+}
+
+// ignoreUnsupportedSync drops the errors with which base filesystems and
+// operating systems refuse to sync a directory at all. Others, such as a
+// permission error, are returned, as the entry may not be durable.
+func ignoreUnsupportedSync(err error) error {
+	if errors.Is(err, syscall.EINVAL) || errors.Is(err, syscall.ENOTSUP) ||
+		errors.Is(err, errors.ErrUnsupported) {
+		return nil
+	}
+	return err
+}
+
+// canSyncDirs reports whether directories on the base filesystem can be
+// synced, by syncing its root
+func (e *EncryptFS) canSyncDirs() bool {
+	if _, ok := e.base.(DirSyncer); ok {
+		return true
+	}
+	dir, err := e.base.Open(string([]byte{e.base.Separator()}))
+	if err != nil {
+		return false
+	}
+	defer dir.Close()
+	return dir.Sync() == nil
+}
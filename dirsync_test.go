@@ -0,0 +1,180 @@
+package encryptfs
+
+import (
+	"os"
+	"slices"
+	"syscall"
+	"testing"
+
+	"github.com/absfs/absfs"
+)
+
+// dirSyncFS records the directories synced through handles opened on it.
+// With syncErr set, syncing a directory fails with syncErr instead.
+type dirSyncFS struct {
+	absfs.FileSystem
+	synced  []string
+	syncErr error
+}
+
+func (f *dirSyncFS) Open(name string) (absfs.File, error) {
+	return f.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (f *dirSyncFS) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	file, err := f.FileSystem.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &dirSyncFile{File: file, fs: f, name: name}, nil
+}
+
+type dirSyncFile struct {
+	absfs.File
+	fs   *dirSyncFS
+	name string
+}
+
+func (f *dirSyncFile) Sync() error {
+	if info, err := f.File.Stat(); err == nil && info.IsDir() {
+		if f.fs.syncErr != nil {
+			return f.fs.syncErr
+		}
+		f.fs.synced = append(f.fs.synced, f.name)
+	}
+	return f.File.Sync()
+}
+
+// dirSyncerFS implements DirSyncer, recording the directories it syncs
+type dirSyncerFS struct {
+	absfs.FileSystem
+	synced []string
+}
+
+func (f *dirSyncerFS) SyncDir(name string) error {
+	f.synced = append(f.synced, name)
+	return nil
+}
+
+func TestSyncParentDirectory(t *testing.T) {
+	keyProvider := NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+		Memory:      64 * 1024,
+		Iterations:  1,
+		Parallelism: 2,
+	})
+
+	for _, chunkSize := range []int{0, 4096} {
+		osBase, cleanup := setupTestFS(t)
+		defer cleanup()
+		base := &dirSyncFS{FileSystem: osBase}
+		fs, err := New(base, &Config{Cipher: CipherAES256GCM, KeyProvider: keyProvider, ChunkSize: chunkSize})
+		if err != nil {
+			t.Fatalf("failed to create EncryptFS: %v", err)
+		}
+		defer fs.Close()
+		if !fs.Capabilities().DirSync {
+			t.Errorf("chunk size %d: Capabilities() = %+v, want directory sync", chunkSize, fs.Capabilities())
+		}
+		if err := fs.Mkdir("/dir", 0755); err != nil {
+			t.Fatalf("failed to create directory: %v", err)
+		}
+
+		// Creating a file syncs its directory once, at creation
+		base.synced = nil
+		file, err := fs.Create("/dir/file.txt")
+		if err != nil {
+			t.Fatalf("failed to create file: %v", err)
+		}
+		if !slices.Equal(base.synced, []string{"/dir"}) {
+			t.Errorf("chunk size %d: synced directories %v after create, want [/dir]", chunkSize, base.synced)
+		}
+		if _, err := file.Write([]byte("durable")); err != nil {
+			t.Fatalf("failed to write: %v", err)
+		}
+		for i := 0; i < 2; i++ {
+			if err := file.Sync(); err != nil {
+				t.Fatalf("failed to sync: %v", err)
+			}
+		}
+		if err := file.Close(); err != nil {
+			t.Fatalf("failed to close: %v", err)
+		}
+		if !slices.Equal(base.synced, []string{"/dir"}) {
+			t.Errorf("chunk size %d: synced directories %v after sync and close, want [/dir] once", chunkSize, base.synced)
+		}
+
+		// Opening an existing file, even with O_CREATE, never does
+		base.synced = nil
+		for _, flag := range []int{os.O_RDWR, os.O_RDWR | os.O_CREATE} {
+			file, err = fs.OpenFile("/dir/file.txt", flag, 0644)
+			if err != nil {
+				t.Fatalf("failed to open file: %v", err)
+			}
+			if err := file.Sync(); err != nil {
+				t.Fatalf("failed to sync: %v", err)
+			}
+			file.Close()
+		}
+		if len(base.synced) != 0 {
+			t.Errorf("chunk size %d: synced directories %v for an existing file, want none", chunkSize, base.synced)
+		}
+	}
+}
+
+func TestSyncParentDirectory_Fallback(t *testing.T) {
+	keyProvider := NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+		Memory:      64 * 1024,
+		Iterations:  1,
+		Parallelism: 2,
+	})
+
+	// Base filesystems that implement DirSyncer sync directories themselves
+	osBase, cleanup := setupTestFS(t)
+	defer cleanup()
+	syncer := &dirSyncerFS{FileSystem: osBase}
+	fs, err := New(syncer, &Config{Cipher: CipherAES256GCM, KeyProvider: keyProvider})
+	if err != nil {
+		t.Fatalf("failed to create EncryptFS: %v", err)
+	}
+	defer fs.Close()
+	if !fs.Capabilities().DirSync {
+		t.Errorf("Capabilities() = %+v, want directory sync", fs.Capabilities())
+	}
+	file, err := fs.Create("/file.txt")
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+	if !slices.Equal(syncer.synced, []string{"/"}) {
+		t.Errorf("SyncDir called for %v, want [/]", syncer.synced)
+	}
+
+	// Directories that cannot be synced are skipped
+	osBase2, cleanup2 := setupTestFS(t)
+	defer cleanup2()
+	refusing := &dirSyncFS{FileSystem: osBase2, syncErr: &os.PathError{Op: "sync", Path: "/", Err: syscall.EINVAL}}
+	fs2, err := New(refusing, &Config{Cipher: CipherAES256GCM, KeyProvider: keyProvider})
+	if err != nil {
+		t.Fatalf("failed to create EncryptFS: %v", err)
+	}
+	defer fs2.Close()
+	if fs2.Capabilities().DirSync {
+		t.Errorf("Capabilities() = %+v, want no directory sync", fs2.Capabilities())
+	}
+	file, err = fs2.Create("/file.txt")
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		t.Errorf("close failed where directories cannot be synced: %v", err)
+	}
+
+	// Other errors are returned, as the new entry may not be durable
+	refusing.syncErr = &os.PathError{Op: "sync", Path: "/", Err: syscall.EACCES}
+	if file, err := fs2.Create("/other.txt"); err == nil {
+		file.Close()
+		t.Error("Create succeeded although the directory could not be synced")
+	}
+}
@@ -78,6 +78,9 @@
 // Deterministic mode uses AES-SIV to encrypt filenames consistently (same name
 // always produces same ciphertext), preserving directory structure while hiding
 // filenames. Random mode assigns UUID-based names for maximum security.
+// With Config.FlattenDirectories, random mode also stores every file in the
+// root of the base filesystem and keeps the directory tree only in the
+// metadata database, hiding directory depth and fan-out.
 //
 // # Security Considerations
 //
@@ -111,6 +114,10 @@
 //   - Winner of Password Hashing Competition
 //   - Configurable memory, time, and parallelism
 //
+// Keys that already have full entropy, such as those issued by a KMS or HSM,
+// can skip password derivation with NewRawKeyProvider, which expands the raw
+// key per file with HKDF-SHA256.
+//
 // # File Format
 //
 // Traditional (single-chunk) encrypted files:
@@ -121,7 +128,47 @@
 //   - Salt (variable): Random salt for key derivation
 //   - Nonce size (2 bytes): Length of the nonce
 //   - Nonce (variable): Random nonce for encryption
-//   - Ciphertext (variable): Encrypted data + authentication tag
+//   - KDF parameters (13 bytes, version 2+): KDF id, iterations, memory,
+//     parallelism, hash function and key size used to derive the file key
+//   - Flags (1 byte, version 4+): Optional features, such as whether the
+//     file uses the chunked format
+//   - Digest (60 bytes, if flagged): SHA-256 of the plaintext, recorded when
+//     Config.ComputeDigest is set and sealed with AES-256-GCM under a key
+//     expanded from the file key: a 12-byte nonce, then the sealed digest
+//   - Key ID (1 byte length + variable, if flagged): Identifies the key
+//     provider that wrote the file
+//   - Wrapped key (1 byte length + variable, if flagged): The file key
+//     encrypted under Config.RecoveryKey, for NewRecoveryKeyProvider
+//   - Sealed size (36 bytes, if padded): The plaintext size, sealed like
+//     the digest under its own key expanded from the file key
+//   - Ciphertext (variable): Encrypted data + authentication tag. When the
+//     padded flag is set, the encrypted data is the plaintext size (8
+//     bytes), the plaintext and zeros up to a multiple of Config.PadSize
+//
+// Because the KDF parameters are stored per file, a file remains readable
+// after the configured Argon2id or PBKDF2 settings change, as long as the
+// password is the same.
+//
+// # STREAM Body Format
+//
+// With Config.StreamFormat set to StreamFormatSTREAM, traditional files carry
+// the stream flag and are never padded, and their ciphertext is framed as
+// age's payload:
+//   - Nonce (16 bytes): Random, chosen afresh each time the file is written
+//   - Records (variable): The plaintext in 64 KiB records, the last of which
+//     may be shorter and is empty only for an empty file, each followed by
+//     its 16-byte authentication tag
+//
+// Each record is sealed under HKDF-SHA256(file key, salt = nonce, info =
+// "payload") with the nonce counter || flag, where counter is the record
+// number as 11 big-endian bytes and flag is 1 for the last record and 0
+// otherwise. The header nonce is unused. With ChaCha20-Poly1305, any STREAM
+// implementation, such as age's, decrypts the body given the file key.
+//
+// Chunked files with the stream flag keep the chunked format below, with a
+// 16-byte nonce in each chunk header. Each chunk is sealed as one STREAM
+// record under HKDF-SHA256(file key, salt = chunk nonce, info = "payload"),
+// with the chunk index as the counter and the flag set on the last chunk.
 //
 // # Chunked File Format
 //
@@ -132,13 +179,23 @@
 //   - Chunk Index (20 KB reserved):
 //     - Chunk size (4 bytes): Size of plaintext chunks
 //     - Chunk count (4 bytes): Number of chunks
-//     - Chunk offsets (8 bytes each): File offset for each chunk
-//     - Plaintext sizes (4 bytes each): Plaintext size for each chunk
+//     - Chunk entries (12 bytes each): File offset (8 bytes) and plaintext
+//       size (4 bytes) for each chunk
 //     - Padding (fills remaining reserved space)
 //   - Encrypted Chunks (variable number):
 //     - Chunk header (plaintext size + nonce)
 //     - Ciphertext (encrypted chunk data + auth tag)
 //
+// Version 2 files store all chunk offsets followed by all plaintext sizes
+// instead of interleaved entries, and rewrite the whole index on every Sync.
+// Version 3 files update only the entries that changed, then the chunk count,
+// so appending a chunk writes 16 bytes of index and an interrupted Sync
+// leaves the previously synced contents readable.
+//
+// The format of an existing file is detected when it is opened, so a store
+// can switch between traditional and chunked mode: files keep the format they
+// were written in and remain readable under either configuration.
+//
 // Benefits of chunked format:
 //   - Efficient seeking without decrypting entire file
 //   - Random access to any chunk
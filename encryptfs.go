@@ -1,8 +1,13 @@
 package encryptfs
 
 import (
+	"crypto/rand"
 	"fmt"
+	"io"
 	"os"
+	"path"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/absfs/absfs"
@@ -15,7 +20,20 @@ type EncryptFS struct {
 	keyProvider       KeyProvider
 	cipher            CipherSuite
 	filenameEncryptor FilenameEncryptor
-	masterKey         []byte
+	masterKey         *SecretKey
+	random            io.Reader      // Config.RandSource, or crypto/rand.Reader
+	flat              *flatNamespace // Non-nil when directories are flattened
+	parallel          ParallelConfig // Config.Parallel with defaults resolved
+	workers           *workerPool    // Shared by all files for parallel chunk jobs
+	closed            *atomic.Bool   // Set by Close; shared with Sub filesystems
+	marked            *atomic.Bool   // Set once the verification marker exists
+	keys              *keyCache      // File keys derived this session, by salt
+	batch             *writeBatch    // Set on the copy used by WriteFiles
+	longNames         *longNameIndex // Non-nil when long components are hashed
+
+	// Set on filesystems returned by Sub
+	root          string // Plaintext path of the root, relative to the top
+	encryptedRoot string // Encrypted form of root on the base filesystem
 }
 
 // New creates a new encrypted filesystem wrapping the base filesystem
@@ -28,47 +46,433 @@ func New(base absfs.FileSystem, config *Config) (*EncryptFS, error) {
 		return nil, fmt.Errorf("invalid config: %w", err)
 	}
 
-	// Determine the actual cipher to use
-	cipher := config.Cipher
-	if cipher == CipherAuto {
-		// Auto-select AES-256-GCM (in future, detect AES-NI support)
-		cipher = CipherAES256GCM
+	random := config.RandSource
+	if random == nil {
+		random = rand.Reader
 	}
 
-	// Derive master key for filename encryption
-	salt, err := config.KeyProvider.GenerateSalt()
+	// A stored config blob supplies the settings left unset and a master
+	// key that stays the same from one New to the next
+	config, storedKey, err := loadStoredConfig(base, config, random)
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate salt: %w", err)
+		return nil, err
+	}
+	if config.ChunkSize&(config.ChunkSize-1) != 0 {
+		config.logger().Warnf("encryptfs: chunk size %d is not a power of two", config.ChunkSize)
 	}
 
-	masterKey, err := config.KeyProvider.DeriveKey(salt)
-	if err != nil {
-		return nil, fmt.Errorf("failed to derive key: %w", err)
+	// Determine the actual cipher to use. Only concrete ciphers are
+	// recorded in file headers, so CipherAuto never leaves New.
+	cipher := resolveCipher(config.Cipher)
+
+	// Derive master key for filename encryption. File contents use keys
+	// derived from each file's own salt, so the master key, and the cost of
+	// deriving it, is only needed when filenames are encrypted, unless the
+	// filesystem shares one salt between all its files.
+	var masterKey *SecretKey
+	keyProvider := config.KeyProvider
+	if config.SharedSalt {
+		storedKey.Destroy()
+		masterKey, err = loadSharedMasterKey(base, config.KeyProvider, cipher, random)
+		if err != nil {
+			return nil, err
+		}
+		keyProvider = &sharedKeyProvider{masterKey: masterKey}
+	} else if storedKey != nil {
+		masterKey = storedKey
+	} else if config.namesEncrypted() && config.FilenameEncryptor == nil {
+		salt, err := generateSalt(config.KeyProvider, random)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate salt: %w", err)
+		}
+
+		masterKey, err = timeKeyDerive(config.Metrics, func() (*SecretKey, error) {
+			return config.KeyProvider.DeriveKey(salt)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to derive key: %w", err)
+		}
 	}
 
 	// Create filename encryptor
-	filenameEncryptor, err := NewFilenameEncryptor(config, masterKey, base)
+	filenameEncryptor, err := NewFilenameEncryptor(config, masterKey.Bytes(), base)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create filename encryptor: %w", err)
 	}
 
-	return &EncryptFS{
+	e := &EncryptFS{
 		base:              base,
 		config:            config,
-		keyProvider:       config.KeyProvider,
+		keyProvider:       keyProvider,
 		cipher:            cipher,
 		filenameEncryptor: filenameEncryptor,
 		masterKey:         masterKey,
-	}, nil
+		random:            random,
+		parallel:          config.Parallel.withDefaults(),
+		closed:            new(atomic.Bool),
+		marked:            new(atomic.Bool),
+		keys:              newKeyCache(config.KeyCacheSize),
+	}
+	e.keys.metrics = config.Metrics
+	e.flat, _ = filenameEncryptor.(*flatNamespace)
+	e.workers = newWorkerPool(e.parallel.MaxWorkers)
+	if config.HashLongComponents {
+		e.longNames = newLongNameIndex(base)
+	}
+
+	return e, nil
+}
+
+// generateSalt generates the salt of a new file
+func (e *EncryptFS) generateSalt() ([]byte, error) {
+	if e.batch != nil && e.batch.salt != nil {
+		return append([]byte(nil), e.batch.salt...), nil
+	}
+	return generateSalt(e.keyProvider, e.random)
+}
+
+// discardSalt releases the salt of a new file that will not be created,
+// after generateSalt returned it but before its key was derived
+func (e *EncryptFS) discardSalt(salt []byte) {
+	if e.batch != nil && e.batch.sharesSalt(salt) {
+		return
+	}
+	discardSalt(e.keyProvider, salt)
+}
+
+// generateNonce generates a nonce for the given cipher
+func (e *EncryptFS) generateNonce(cipher CipherSuite) ([]byte, error) {
+	return generateNonceFrom(e.random, cipher)
+}
+
+// Close releases the resources held by the filesystem. It saves the
+// filename metadata database when random filename encryption is used,
+// zeroes the master key, the cached file keys and the keys of the filename
+// encryptor it created, and stops the worker pool used for parallel chunk
+// processing, returning any error from saving the metadata. A
+// Config.FilenameEncryptor belongs to the caller and is left as it is.
+//
+// Keys held by open files, such as the STREAM key of a file and the keys
+// sealing its digest and format descriptor, are zeroed when the file is
+// closed. The key schedules inside cipher engines belong to the Go crypto
+// packages and cannot be zeroed; they are released to the garbage
+// collector.
+//
+// Operations on the filesystem after Close return an error wrapping
+// ErrClosed; files that are already open remain usable until they are
+// closed, but their bulk operations fail and open directories can no
+// longer decrypt names. Filesystems returned by Sub share these resources
+// with their parent, so closing either closes both.
+func (e *EncryptFS) Close() error {
+	if e.closed.Swap(true) {
+		return nil
+	}
+
+	var err error
+	if metadata := e.metadata(); metadata != nil && e.config.MetadataPath != "" {
+		err = metadata.Save(e.base, e.config.MetadataPath)
+	}
+
+	e.masterKey.Destroy()
+	e.keys.clear()
+	if names, ok := e.filenameEncryptor.(keyDestroyer); ok && e.config.FilenameEncryptor == nil {
+		names.destroyKeys()
+	}
+	e.workers.close()
+
+	return err
+}
+
+// checkOpen returns an error if the filesystem has been closed
+func (e *EncryptFS) checkOpen(op, name string) error {
+	if e.closed.Load() {
+		return &os.PathError{Op: op, Path: name, Err: ErrClosed}
+	}
+	return nil
+}
+
+// DefaultMaxPathDepth is the maximum number of path components when
+// Config.MaxPathDepth is zero
+const DefaultMaxPathDepth = 256
+
+// checkPath returns a ValidationError for a path that cannot be resolved
+// safely: one containing a NUL byte, one whose ".." components climb above
+// the root, or one nested deeper than Config.MaxPathDepth. It runs before
+// the base filesystem is touched.
+func (e *EncryptFS) checkPath(op, name string) error {
+	sep := string([]byte{e.base.Separator()})
+	_, depth, escapes := cleanPath(name, sep)
+
+	var message string
+	switch {
+	case strings.IndexByte(name, 0) >= 0:
+		message = "path contains a NUL byte"
+	case escapes:
+		message = "path escapes the root"
+	case depth > e.maxPathDepth():
+		message = fmt.Sprintf("path depth %d exceeds maximum %d", depth, e.maxPathDepth())
+	default:
+		return nil
+	}
+	return &os.PathError{Op: op, Path: name, Err: &ValidationError{Field: "path", Value: name, Message: message}}
+}
+
+// maxPathDepth returns the configured maximum path depth
+func (e *EncryptFS) maxPathDepth() int {
+	if e.config.MaxPathDepth == 0 {
+		return DefaultMaxPathDepth
+	}
+	return e.config.MaxPathDepth
+}
+
+// cleanPath normalizes a plaintext path: redundant and trailing separators
+// and "." components are dropped and ".." components are resolved. It
+// returns the number of components and whether ".." climbs above the root,
+// in which case the excess components are ignored. Absolute paths stay
+// absolute and an empty path stays empty.
+func cleanPath(name, sep string) (cleaned string, depth int, escapes bool) {
+	if name == "" {
+		return "", 0, false
+	}
+
+	name = normalizeSeparators(name, sep)
+	var parts []string
+	for _, part := range strings.Split(name, sep) {
+		switch part {
+		case "", ".":
+		case "..":
+			if len(parts) == 0 {
+				escapes = true
+				continue
+			}
+			parts = parts[:len(parts)-1]
+		default:
+			parts = append(parts, part)
+		}
+	}
+
+	cleaned = strings.Join(parts, sep)
+	if strings.HasPrefix(name, sep) {
+		cleaned = sep + cleaned
+	} else if cleaned == "" {
+		cleaned = "."
+	}
+	return cleaned, len(parts), escapes
+}
+
+// checkReserved returns an error if name refers to the filename metadata
+// database or an attribute sidecar. These share their namespace with user
+// files, so creating or renaming a file onto them would corrupt them.
+func (e *EncryptFS) checkReserved(op, name string) error {
+	sep := string([]byte{e.base.Separator()})
+	logical := path.Clean("/" + strings.ReplaceAll(e.logicalPath(name), sep, "/"))
+	if e.isInternalPath(strings.ReplaceAll(logical, "/", sep)) {
+		return &os.PathError{Op: op, Path: name, Err: ErrReservedPath}
+	}
+	return nil
+}
+
+// checkOp runs the checks every operation on name starts with: that the
+// filesystem is open and that name can be resolved safely
+func (e *EncryptFS) checkOp(op, name string) error {
+	if err := e.checkOpen(op, name); err != nil {
+		return err
+	}
+	return e.checkPath(op, name)
+}
+
+// checkTarget is checkOp for operations that may create, replace or open
+// name, which must also not be reserved
+func (e *EncryptFS) checkTarget(op, name string) error {
+	if err := e.checkOp(op, name); err != nil {
+		return err
+	}
+	return e.checkReserved(op, name)
+}
+
+// metadata returns the filename metadata database, or nil if filenames are
+// not randomly encrypted
+func (e *EncryptFS) metadata() *FilenameMetadata {
+	switch enc := e.filenameEncryptor.(type) {
+	case *randomFilenameEncryptor:
+		return enc.metadata
+	case *flatNamespace:
+		return enc.metadata
+	}
+	return nil
+}
+
+// Sub returns an EncryptFS rooted at dir, which must be an existing
+// directory. The returned filesystem shares the key material, cipher and
+// filename encryptor of e; paths passed to it are resolved inside dir and
+// cannot climb out of it.
+func (e *EncryptFS) Sub(dir string) (*EncryptFS, error) {
+	if err := e.checkOp("sub", dir); err != nil {
+		return nil, err
+	}
+
+	info, err := e.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, &os.PathError{Op: "sub", Path: dir, Err: errNotDir}
+	}
+
+	sub := *e
+	sub.root = e.logicalPath(dir)
+	sub.encryptedRoot = ""
+
+	// The root is encrypted once; flattened namespaces have no directories
+	// on the base filesystem and resolve full logical paths instead
+	if e.flat == nil {
+		sub.encryptedRoot, err = e.encryptPath(dir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &sub, nil
+}
+
+// logicalPath resolves name against the root of a Sub filesystem, returning
+// the plaintext path relative to the top of the filesystem. Paths are cleaned
+// so that they cannot climb out of the root.
+func (e *EncryptFS) logicalPath(name string) string {
+	sep := string([]byte{e.base.Separator()})
+	if e.root == "" {
+		cleaned, _, _ := cleanPath(name, sep)
+		return cleaned
+	}
+
+	rel := path.Clean("/" + strings.ReplaceAll(name, sep, "/"))
+	if rel == "/" {
+		return e.root
+	}
+	return e.root + strings.ReplaceAll(rel, "/", sep)
 }
 
 // translatePath translates a plaintext path to its encrypted form
 func (e *EncryptFS) translatePath(plaintext string) (string, error) {
+	encrypted, err := e.encryptPath(plaintext)
+	if err != nil || e.longNames == nil {
+		return encrypted, err
+	}
+	return e.longNames.shorten(encrypted), nil
+}
+
+// translateDirPath translates the plaintext path of a directory to its
+// encrypted form. It differs from translatePath only when directory names
+// are encrypted differently from file names, for a directory that does not
+// exist yet.
+func (e *EncryptFS) translateDirPath(plaintext string) (string, error) {
+	encrypted, err := e.encryptPathAs(plaintext, true)
+	if err != nil || e.longNames == nil {
+		return encrypted, err
+	}
+	return e.longNames.shorten(encrypted), nil
+}
+
+// encryptPath encrypts a plaintext path without shortening long components
+func (e *EncryptFS) encryptPath(plaintext string) (string, error) {
+	return e.encryptPathAs(plaintext, false)
+}
+
+// encryptPathAs encrypts a plaintext path without shortening long
+// components, as the path of a directory if dir is set
+func (e *EncryptFS) encryptPathAs(plaintext string, dir bool) (string, error) {
+	if e.root == "" || e.flat != nil {
+		return e.encryptPathIn("", e.logicalPath(plaintext), dir)
+	}
+
+	rel := strings.TrimPrefix(e.logicalPath(plaintext), e.root)
+	if rel == "" {
+		return e.encryptedRoot, nil
+	}
+
+	encrypted, err := e.encryptPathIn(e.encryptedRoot, rel, dir)
+	if err != nil {
+		return "", err
+	}
+	return e.encryptedRoot + encrypted, nil
+}
+
+// encryptPathIn encrypts a plaintext path below the encrypted directory
+// base. A MultiKeyFilenameEncryptor looks each component up on the base
+// filesystem, so that existing names are found under any of its keys.
+// Where directory names are encrypted differently from file names, the
+// last component is looked up as a directory unless dir says it is one.
+func (e *EncryptFS) encryptPathIn(base, plaintext string, dir bool) (string, error) {
+	stat := func(encrypted string) (os.FileInfo, error) {
+		encrypted = base + encrypted
+		if e.longNames != nil {
+			encrypted = e.longNames.shorten(encrypted)
+		}
+		return e.base.Stat(encrypted)
+	}
+
+	switch enc := e.filenameEncryptor.(type) {
+	case *MultiKeyFilenameEncryptor:
+		return enc.resolvePath(plaintext, func(encrypted string) bool {
+			_, err := stat(encrypted)
+			return err == nil
+		})
+	case *splitFilenameEncryptor:
+		if dir {
+			return enc.encryptDirPath(plaintext)
+		}
+		return enc.resolvePath(plaintext, func(encrypted string) bool {
+			info, err := stat(encrypted)
+			return err == nil && info.IsDir()
+		})
+	case *randomFilenameEncryptor:
+		return enc.resolvePath(plaintext, func(encrypted string) bool {
+			return e.baseExists(base + encrypted)
+		})
+	}
 	return e.filenameEncryptor.EncryptPath(plaintext)
 }
 
+// baseExists reports whether there is an entry at encryptedPath on the base
+// filesystem. A symbolic link counts as an entry even if its target is
+// missing, where the base filesystem supports them.
+func (e *EncryptFS) baseExists(encryptedPath string) bool {
+	var err error
+	if linker, ok := e.base.(absfs.SymLinker); ok {
+		_, err = linker.Lstat(encryptedPath)
+	} else {
+		_, err = e.base.Stat(encryptedPath)
+	}
+	return err == nil
+}
+
 // untranslatePath translates an encrypted path back to plaintext
 func (e *EncryptFS) untranslatePath(ciphertext string) (string, error) {
+	if e.root == "" {
+		return e.decryptPath("", ciphertext)
+	}
+
+	sep := string([]byte{e.base.Separator()})
+	if ciphertext == e.encryptedRoot {
+		return sep, nil
+	}
+	if !strings.HasPrefix(ciphertext, e.encryptedRoot+sep) {
+		return "", fmt.Errorf("path %s is outside of %s", ciphertext, e.root)
+	}
+	return e.decryptPath(e.encryptedRoot, strings.TrimPrefix(ciphertext, e.encryptedRoot))
+}
+
+// decryptPath decrypts a path found on the base filesystem, first restoring
+// any hashed components from the indexes of the directories it passes
+// through, starting at the base directory dir
+func (e *EncryptFS) decryptPath(dir, ciphertext string) (string, error) {
+	if e.longNames != nil {
+		expanded, err := e.longNames.expand(dir, ciphertext)
+		if err != nil {
+			return "", err
+		}
+		ciphertext = expanded
+	}
 	return e.filenameEncryptor.DecryptPath(ciphertext)
 }
 
@@ -115,24 +519,115 @@ func (e *EncryptFS) Create(name string) (absfs.File, error) {
 	return e.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
 }
 
-// OpenFile opens a file with the specified flags and permissions
+// OpenFile opens a file with the specified flags and permissions. Files on
+// the base filesystem must be seekable; opening one that is not returns an
+// error wrapping ErrNotSupported.
 func (e *EncryptFS) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	if err := e.checkTarget("open", name); err != nil {
+		return nil, err
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		if err := e.ensureVerifyMarker(); err != nil {
+			return nil, &os.PathError{Op: "open", Path: name, Err: err}
+		}
+	}
+
+	// Directories of a flattened filesystem exist only in the metadata
+	if e.flat != nil {
+		if _, ok := e.flat.dirInfo(e.logicalPath(name)); ok {
+			return e.openDir(name, flag)
+		}
+	}
+
 	// Translate path to encrypted form
-	encryptedPath, err := e.translatePath(name)
+	var encryptedPath string
+	var created bool
+	var err error
+	if e.flat != nil && flag&os.O_CREATE != 0 {
+		encryptedPath, created, err = e.flat.create(e.logicalPath(name), e.baseExists)
+	} else {
+		encryptedPath, err = e.translatePath(name)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	baseFile, err := e.base.OpenFile(encryptedPath, flag, perm)
+	// The lock is taken before the base file is opened, which may
+	// truncate it
+	unlock, err := e.lockFile(name, encryptedPath, flag)
 	if err != nil {
+		if created {
+			e.flat.metadata.Remove(encryptedPath)
+		}
 		return nil, err
 	}
 
-	// Check if chunking is enabled
-	useChunking := e.config.ChunkSize > 0
+	// Whether this open creates the file, whose directory entry is then
+	// synced once
+	creating := flag&os.O_CREATE != 0 && (created || !e.baseExists(encryptedPath))
+
+	baseFile, err := e.base.OpenFile(encryptedPath, baseOpenFlag(flag), perm)
+	if err != nil {
+		unlock()
+		if created {
+			e.flat.metadata.Remove(encryptedPath)
+		}
+		return nil, err
+	}
+
+	if flag&os.O_CREATE != 0 {
+		if err := e.recordLongNames(name); err != nil {
+			baseFile.Close()
+			unlock()
+			return nil, err
+		}
+	}
+
+	// Directories are listed rather than decrypted
+	info, err := baseFile.Stat()
+	if err != nil {
+		baseFile.Close()
+		unlock()
+		return nil, err
+	}
+	if info.IsDir() {
+		baseFile.Close()
+		unlock()
+		return e.openDir(name, flag)
+	}
+	if creating && e.batch != nil {
+		e.batch.created(e, name, encryptedPath)
+	} else if creating {
+		if err := e.syncParent(encryptedPath); err != nil {
+			baseFile.Close()
+			unlock()
+			return nil, err
+		}
+	}
+
+	// Both file formats seek in the base file, so base files that cannot,
+	// such as pipes, are refused here rather than failing partway through
+	err = e.retry(func() error {
+		_, err := baseFile.Seek(0, io.SeekCurrent)
+		return err
+	})
+	if err != nil {
+		baseFile.Close()
+		unlock()
+		return nil, &os.PathError{Op: "open", Path: name, Err: fmt.Errorf("%w: base file cannot seek: %v", ErrNotSupported, err)}
+	}
+
+	// Check if chunking is enabled for this file
+	useChunking, err := e.useChunkedFormat(baseFile, flag)
+	if err != nil {
+		baseFile.Close()
+		unlock()
+		return nil, err
+	}
 
 	if useChunking {
-		// Use chunked file for better performance with large files
+		// Use chunked file for better performance with large files. Existing
+		// files keep the chunk size recorded in their index.
 		chunkSize := uint32(e.config.ChunkSize)
 		if chunkSize == 0 {
 			chunkSize = DefaultChunkSize
@@ -141,8 +636,10 @@ func (e *EncryptFS) OpenFile(name string, flag int, perm os.FileMode) (absfs.Fil
 		chunkFile, err := newChunkedFile(baseFile, e, chunkSize, flag)
 		if err != nil {
 			baseFile.Close()
+			unlock()
 			return nil, err
 		}
+		chunkFile.unlock = unlock
 		return chunkFile, nil
 	}
 
@@ -150,63 +647,234 @@ func (e *EncryptFS) OpenFile(name string, flag int, perm os.FileMode) (absfs.Fil
 	encFile, err := newEncryptedFile(baseFile, e, flag)
 	if err != nil {
 		baseFile.Close()
+		unlock()
 		return nil, err
 	}
+	encFile.unlock = unlock
 
 	return encFile, nil
 }
 
+// baseOpenFlag returns the flags a file is opened with on the base
+// filesystem. Writing an existing file reads its header and contents first,
+// so write-only opens read the base file too; a truncating open finds an
+// empty base file and starts afresh without decrypting anything. O_APPEND is
+// applied to the plaintext by the file itself, as appending on the base
+// file would place rewritten ciphertext after the old.
+func baseOpenFlag(flag int) int {
+	if flag&os.O_WRONLY != 0 {
+		flag = flag&^os.O_WRONLY | os.O_RDWR
+	}
+	return flag &^ os.O_APPEND
+}
+
+// baseFileSize returns the size of a base file opened with flag. A
+// truncating open starts from an empty file whatever Stat reports, as some
+// base filesystems report the size the file had before it was truncated.
+func baseFileSize(info os.FileInfo, flag int) int64 {
+	if flag&os.O_TRUNC != 0 {
+		return 0
+	}
+	return info.Size()
+}
+
+// useChunkedFormat decides whether an opened base file is handled as a
+// chunked or a traditional file. New and truncated files follow the
+// configuration; existing files keep the format they were written in, so a
+// store can switch between modes without rewriting its files.
+func (e *EncryptFS) useChunkedFormat(baseFile absfs.File, flag int) (bool, error) {
+	info, err := baseFile.Stat()
+	if err != nil {
+		return false, err
+	}
+	if baseFileSize(info, flag) == 0 {
+		return e.config.ChunkSize > 0 || e.config.ReadOnce, nil
+	}
+
+	chunked, err := detectChunkedFormat(baseFile, info.Size())
+	if err != nil {
+		// Let the configured implementation report the damaged header
+		return e.config.ChunkSize > 0, nil
+	}
+	return chunked, nil
+}
+
 // Mkdir creates a directory
 func (e *EncryptFS) Mkdir(name string, perm os.FileMode) error {
-	encryptedPath, err := e.translatePath(name)
+	if err := e.checkTarget("mkdir", name); err != nil {
+		return err
+	}
+
+	if e.flat != nil {
+		return e.flat.mkdir(e.logicalPath(name), perm)
+	}
+
+	encryptedPath, err := e.translateDirPath(name)
 	if err != nil {
 		return err
 	}
-	return e.base.Mkdir(encryptedPath, perm)
+	if err := e.checkNoFile("mkdir", name); err != nil {
+		return err
+	}
+	if err := e.base.Mkdir(encryptedPath, perm); err != nil {
+		return err
+	}
+	return e.recordLongNames(name)
 }
 
 // MkdirAll creates a directory and all necessary parent directories
 func (e *EncryptFS) MkdirAll(name string, perm os.FileMode) error {
+	if err := e.checkOp("mkdir", name); err != nil {
+		return err
+	}
+
+	if e.flat != nil {
+		return e.flat.mkdirAll(e.logicalPath(name), perm)
+	}
+
+	encryptedPath, err := e.translateDirPath(name)
+	if err != nil {
+		return err
+	}
+	if err := e.checkNoFile("mkdir", name); err != nil {
+		return err
+	}
+	if err := e.base.MkdirAll(encryptedPath, perm); err != nil {
+		return err
+	}
+	return e.recordLongNames(name)
+}
+
+// checkNoFile returns an error if a file exists at name where directory
+// names are encrypted differently from file names. The base filesystem
+// would otherwise let a directory be created beside it under its own name.
+func (e *EncryptFS) checkNoFile(op, name string) error {
+	if _, ok := e.filenameEncryptor.(*splitFilenameEncryptor); !ok {
+		return nil
+	}
 	encryptedPath, err := e.translatePath(name)
 	if err != nil {
 		return err
 	}
-	return e.base.MkdirAll(encryptedPath, perm)
+	if info, err := e.base.Stat(encryptedPath); err == nil && !info.IsDir() {
+		return &os.PathError{Op: op, Path: name, Err: os.ErrExist}
+	}
+	return nil
 }
 
 // Remove removes a file or empty directory
 func (e *EncryptFS) Remove(name string) error {
+	if err := e.checkOp("remove", name); err != nil {
+		return err
+	}
+
+	if e.flat != nil {
+		return e.flat.remove(e.base, e.logicalPath(name))
+	}
+
 	encryptedPath, err := e.translatePath(name)
 	if err != nil {
 		return err
 	}
-	return e.base.Remove(encryptedPath)
+	if e.longNames != nil {
+		// An empty directory may still hold its long name index
+		if err := e.longNames.prepareRemove(encryptedPath); err != nil {
+			return err
+		}
+	}
+	if err := e.base.Remove(encryptedPath); err != nil {
+		return err
+	}
+	return removeXattrs(e.base, encryptedPath)
 }
 
 // RemoveAll removes a path and any children it contains
 func (e *EncryptFS) RemoveAll(path string) error {
+	if err := e.checkOp("remove", path); err != nil {
+		return err
+	}
+
+	if e.flat != nil {
+		return e.flat.removeAll(e.base, e.logicalPath(path))
+	}
+
 	encryptedPath, err := e.translatePath(path)
 	if err != nil {
 		return err
 	}
-	return e.base.RemoveAll(encryptedPath)
+	if err := e.base.RemoveAll(encryptedPath); err != nil {
+		return err
+	}
+	return removeXattrs(e.base, encryptedPath)
 }
 
 // Rename renames (moves) a file
 func (e *EncryptFS) Rename(oldpath, newpath string) error {
+	if err := e.checkTarget("rename", oldpath); err != nil {
+		return err
+	}
+	if err := e.checkTarget("rename", newpath); err != nil {
+		return err
+	}
+
+	if e.flat != nil {
+		return e.flat.rename(e.base, e.logicalPath(oldpath), e.logicalPath(newpath))
+	}
+
+	// Every path component is encrypted on its own, so a renamed directory's
+	// children keep their encrypted names and stay addressable beneath the
+	// new one. Moving a directory into its own subtree is rejected here, as
+	// not every base filesystem checks it, and one that doesn't detaches the
+	// directory from the tree.
+	if e.movesIntoItself(oldpath, newpath) {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: errRenameIntoSelf}
+	}
+
 	encryptedOld, err := e.translatePath(oldpath)
 	if err != nil {
 		return err
 	}
-	encryptedNew, err := e.translatePath(newpath)
+	translateNew := e.translatePath
+	if _, ok := e.filenameEncryptor.(*splitFilenameEncryptor); ok {
+		// A directory keeps a directory name under its new path
+		if info, err := e.base.Stat(encryptedOld); err == nil && info.IsDir() {
+			translateNew = e.translateDirPath
+		}
+	}
+	encryptedNew, err := translateNew(newpath)
 	if err != nil {
 		return err
 	}
-	return e.base.Rename(encryptedOld, encryptedNew)
+	if err := e.base.Rename(encryptedOld, encryptedNew); err != nil {
+		return err
+	}
+	if err := e.recordLongNames(newpath); err != nil {
+		return err
+	}
+	return e.renameXattrs(encryptedOld, encryptedNew)
+}
+
+// movesIntoItself reports whether renaming oldpath to newpath would move it
+// beneath itself
+func (e *EncryptFS) movesIntoItself(oldpath, newpath string) bool {
+	sep := string([]byte{e.base.Separator()})
+	o := path.Clean("/" + strings.ReplaceAll(e.logicalPath(oldpath), sep, "/"))
+	n := path.Clean("/" + strings.ReplaceAll(e.logicalPath(newpath), sep, "/"))
+	return o != n && (o == "/" || strings.HasPrefix(n, o+"/"))
 }
 
 // Stat returns file information
 func (e *EncryptFS) Stat(name string) (os.FileInfo, error) {
+	if err := e.checkOp("stat", name); err != nil {
+		return nil, err
+	}
+
+	if e.flat != nil {
+		if info, ok := e.flat.dirInfo(e.logicalPath(name)); ok {
+			return info, nil
+		}
+	}
+
 	encryptedPath, err := e.translatePath(name)
 	if err != nil {
 		return nil, err
@@ -217,17 +885,45 @@ func (e *EncryptFS) Stat(name string) (os.FileInfo, error) {
 		return nil, err
 	}
 
-	// For encrypted files, we need to adjust the size to exclude the header
-	// and overhead. This is done by the encryptedFileInfo wrapper.
-	if !info.IsDir() {
-		return newEncryptedFileInfo(info, e.cipher), nil
+	// Files report their plaintext size, read from the headers without
+	// decrypting the body; padded files open the size sealed in theirs. A
+	// file whose headers cannot be read keeps its size on disk, so that it
+	// can still be found and removed. Both files and directories report the
+	// plaintext name rather than the base name.
+	encInfo := newEncryptedFileInfo(info, e.cipher)
+	encInfo.name = e.plaintextBase(e.logicalPath(name))
+	if info.Mode().IsRegular() {
+		if size, err := e.plaintextSize(encryptedPath, info); err == nil {
+			encInfo.size = size
+		}
 	}
 
-	return info, nil
+	return encInfo, nil
 }
 
-// Chmod changes the mode of a file
+// plaintextBase returns the final component of a plaintext path, or an empty
+// string for the root so that the base filesystem's name is used instead
+func (e *EncryptFS) plaintextBase(name string) string {
+	sep := string([]byte{e.base.Separator()})
+	name = strings.TrimRight(normalizeSeparators(name, sep), sep)
+	if i := strings.LastIndex(name, sep); i >= 0 {
+		name = name[i+1:]
+	}
+	return name
+}
+
+// Chmod changes the mode of a file. Modes, times and owners are kept by
+// the base filesystem alone; file headers authenticate only the content, so
+// changing them never requires re-encrypting or re-authenticating a file.
 func (e *EncryptFS) Chmod(name string, mode os.FileMode) error {
+	if err := e.checkOp("chmod", name); err != nil {
+		return err
+	}
+
+	if e.flat != nil && e.flat.chmodDir(e.logicalPath(name), mode) {
+		return nil
+	}
+
 	encryptedPath, err := e.translatePath(name)
 	if err != nil {
 		return err
@@ -237,6 +933,17 @@ func (e *EncryptFS) Chmod(name string, mode os.FileMode) error {
 
 // Chtimes changes the access and modification times of a file
 func (e *EncryptFS) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	if err := e.checkOp("chtimes", name); err != nil {
+		return err
+	}
+
+	// Flattened directories have no times to change
+	if e.flat != nil {
+		if _, ok := e.flat.dirInfo(e.logicalPath(name)); ok {
+			return nil
+		}
+	}
+
 	encryptedPath, err := e.translatePath(name)
 	if err != nil {
 		return err
@@ -246,6 +953,17 @@ func (e *EncryptFS) Chtimes(name string, atime time.Time, mtime time.Time) error
 
 // Chown changes the owner and group of a file
 func (e *EncryptFS) Chown(name string, uid, gid int) error {
+	if err := e.checkOp("chown", name); err != nil {
+		return err
+	}
+
+	// Flattened directories have no owner to change
+	if e.flat != nil {
+		if _, ok := e.flat.dirInfo(e.logicalPath(name)); ok {
+			return nil
+		}
+	}
+
 	encryptedPath, err := e.translatePath(name)
 	if err != nil {
 		return err
@@ -253,21 +971,29 @@ func (e *EncryptFS) Chown(name string, uid, gid int) error {
 	return e.base.Chown(encryptedPath, uid, gid)
 }
 
-// Truncate truncates a file to a specified size
+// Truncate changes the plaintext size of a file. The file is opened and
+// truncated through its own Truncate method, so the ciphertext is rewritten
+// for either file format rather than cut at an arbitrary byte.
 func (e *EncryptFS) Truncate(name string, size int64) error {
-	encryptedPath, err := e.translatePath(name)
+	file, err := e.OpenFile(name, os.O_RDWR, 0)
 	if err != nil {
 		return err
 	}
-	// For encrypted files, we need to account for the header and overhead
-	// For now, we'll implement basic truncation
-	return e.base.Truncate(encryptedPath, size)
+
+	if err := file.Truncate(size); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
 }
 
 // encryptedFileInfo wraps os.FileInfo to adjust size for encrypted files
 type encryptedFileInfo struct {
 	os.FileInfo
 	cipher CipherSuite
+	name   string // Plaintext name, if known
+	size   int64  // Plaintext size, or -1 if not computed
 }
 
 // newEncryptedFileInfo creates a new encryptedFileInfo
@@ -275,11 +1001,23 @@ func newEncryptedFileInfo(info os.FileInfo, cipher CipherSuite) *encryptedFileIn
 	return &encryptedFileInfo{
 		FileInfo: info,
 		cipher:   cipher,
+		size:     -1,
 	}
 }
 
+// Name returns the plaintext name when known, otherwise the base name
+func (e *encryptedFileInfo) Name() string {
+	if e.name != "" {
+		return e.name
+	}
+	return e.FileInfo.Name()
+}
+
 // Size returns the decrypted size of the file
 func (e *encryptedFileInfo) Size() int64 {
+	if e.size >= 0 {
+		return e.size
+	}
 	// Actual size on disk includes:
 	// - Header (variable size)
 	// - Ciphertext (plaintext + overhead)
@@ -287,3 +1025,81 @@ func (e *encryptedFileInfo) Size() int64 {
 	// In a full implementation, we would calculate the actual plaintext size
 	return e.FileInfo.Size()
 }
+
+// plaintextSize computes the decrypted size of an encrypted file by reading
+// its headers, without decrypting any content
+func (e *EncryptFS) plaintextSize(encryptedPath string, info os.FileInfo) (int64, error) {
+	if info.Size() == 0 {
+		return 0, nil
+	}
+
+	file, err := e.base.Open(encryptedPath)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	chunked, err := detectChunkedFormat(file, info.Size())
+	if err != nil {
+		return 0, err
+	}
+
+	r := io.NewSectionReader(file, 0, info.Size())
+	header := &FileHeader{}
+	headerSize, err := header.ReadFrom(r)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read header: %w", err)
+	}
+
+	if chunked {
+		index := header.newChunkIndex(0)
+		if _, err := index.ReadFrom(r); err != nil {
+			return 0, fmt.Errorf("failed to read chunk index: %w", err)
+		}
+		return index.TotalPlaintextSize(), nil
+	}
+
+	// STREAM bodies imply their size through their record framing
+	if header.Flags&FlagStream != 0 {
+		size, err := streamPlaintextSize(info.Size() - headerSize)
+		if err != nil {
+			return 0, ErrInvalidCiphertext
+		}
+		return size, nil
+	}
+
+	// Padded files seal their size in the header, so only that field is
+	// opened with the file key
+	if header.Flags&FlagPadded != 0 {
+		keyProvider, err := e.fileKeyProvider(header)
+		if err != nil {
+			return 0, err
+		}
+		providers := []KeyProvider{keyProvider}
+		if multiProvider, ok := keyProvider.(*MultiKeyProvider); ok {
+			providers = multiProvider.providersFor(header.KeyID)
+		}
+		lastErr := fmt.Errorf("no key providers could open the size")
+		for _, provider := range providers {
+			key, err := e.keys.derive(provider, header)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			size, err := header.openSize(key)
+			if err == nil {
+				return size, nil
+			}
+			lastErr = err
+		}
+		return 0, lastErr
+	}
+
+	// Other traditional files hold a single ciphertext with one
+	// authentication tag
+	size := info.Size() - headerSize - aeadTagSize
+	if size < 0 {
+		return 0, ErrInvalidCiphertext
+	}
+	return size, nil
+}
@@ -2,13 +2,21 @@ package encryptfs
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/absfs/absfs"
+	"github.com/absfs/memfs"
 )
 
 // memFS is a simple in-memory filesystem for testing
@@ -429,3 +437,1798 @@ func TestEncryptFS_WrongPassword(t *testing.T) {
 		t.Logf("got error: %v", err)
 	}
 }
+
+func TestEncryptFS_MaxInMemoryFileSize(t *testing.T) {
+	base, cleanup := setupTestFS(t)
+	defer cleanup()
+
+	keyProvider := NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+		Memory:      64 * 1024,
+		Iterations:  1,
+		Parallelism: 2,
+	})
+
+	// Write a file larger than the limit without the guard in place
+	fs1, err := New(base, &Config{
+		Cipher:      CipherAES256GCM,
+		KeyProvider: keyProvider,
+	})
+	if err != nil {
+		t.Fatalf("failed to create EncryptFS: %v", err)
+	}
+
+	file, err := fs1.Create("/large.bin")
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	if _, err := file.Write(make([]byte, 4096)); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	// Reopen with a limit smaller than the file
+	fs2, err := New(base, &Config{
+		Cipher:              CipherAES256GCM,
+		KeyProvider:         keyProvider,
+		MaxInMemoryFileSize: 1024,
+	})
+	if err != nil {
+		t.Fatalf("failed to create EncryptFS: %v", err)
+	}
+
+	file, err = fs2.Open("/large.bin")
+	if err == nil {
+		file.Close()
+		t.Fatal("expected error opening file larger than MaxInMemoryFileSize")
+	}
+	if !IsValidationError(err) {
+		t.Fatalf("expected ValidationError, got %T: %v", err, err)
+	}
+
+	// Small files are still allowed
+	file, err = fs2.Create("/small.txt")
+	if err != nil {
+		t.Fatalf("failed to create small file: %v", err)
+	}
+	file.Write([]byte("small"))
+	file.Close()
+
+	file, err = fs2.Open("/small.txt")
+	if err != nil {
+		t.Fatalf("failed to open small file: %v", err)
+	}
+	file.Close()
+}
+
+func TestEncryptFS_AddressableSize(t *testing.T) {
+	base, cleanup := setupTestFS(t)
+	defer cleanup()
+
+	keyProvider := NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+		Memory:      64 * 1024,
+		Iterations:  1,
+		Parallelism: 2,
+	})
+	traditional, err := New(base, &Config{Cipher: CipherAES256GCM, KeyProvider: keyProvider})
+	if err != nil {
+		t.Fatalf("failed to create EncryptFS: %v", err)
+	}
+	chunked, err := New(base, &Config{Cipher: CipherAES256GCM, KeyProvider: keyProvider, ChunkSize: 4096})
+	if err != nil {
+		t.Fatalf("failed to create EncryptFS: %v", err)
+	}
+
+	data := bytes.Repeat([]byte("addressable"), 2000)
+	for path, fs := range map[string]*EncryptFS{"/traditional.bin": traditional, "/chunked.bin": chunked} {
+		file, err := fs.Create(path)
+		if err != nil {
+			t.Fatalf("failed to create %s: %v", path, err)
+		}
+		if _, err := file.Write(data); err != nil {
+			t.Fatalf("failed to write %s: %v", path, err)
+		}
+		if err := file.Close(); err != nil {
+			t.Fatalf("failed to close %s: %v", path, err)
+		}
+	}
+
+	// Stand in for a 32-bit platform, where a byte slice holds under 2 GiB
+	defer func(size int64) { maxInMemorySize = size }(maxInMemorySize)
+	maxInMemorySize = 8192
+
+	isSizeError := func(err error) bool {
+		var validation *ValidationError
+		return errors.As(err, &validation) && validation.Field == "size"
+	}
+
+	file, err := traditional.Open("/traditional.bin")
+	if err == nil {
+		file.Close()
+		t.Fatal("expected error opening a traditional file larger than addressable")
+	}
+	if !isSizeError(err) {
+		t.Errorf("expected a size ValidationError, got %T: %v", err, err)
+	}
+
+	// Chunked files are read a chunk at a time
+	file, err = traditional.Open("/chunked.bin")
+	if err != nil {
+		t.Fatalf("failed to open chunked file: %v", err)
+	}
+	got, err := io.ReadAll(file)
+	file.Close()
+	if err != nil {
+		t.Fatalf("failed to read chunked file: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("chunked file content mismatch")
+	}
+
+	// Growing a traditional file past the limit fails without allocating
+	file, err = traditional.Create("/grow.bin")
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	defer file.Close()
+	if _, err := file.WriteAt([]byte("x"), 1<<40); !isSizeError(err) {
+		t.Errorf("WriteAt past the limit: expected a size ValidationError, got %v", err)
+	}
+	if _, err := file.Seek(8192, io.SeekStart); err != nil {
+		t.Fatalf("failed to seek: %v", err)
+	}
+	if _, err := file.Write([]byte("x")); !isSizeError(err) {
+		t.Errorf("Write past the limit: expected a size ValidationError, got %v", err)
+	}
+	if err := file.Truncate(8193); !isSizeError(err) {
+		t.Errorf("Truncate past the limit: expected a size ValidationError, got %v", err)
+	}
+	if err := file.Truncate(8192); err != nil {
+		t.Errorf("Truncate to the limit: %v", err)
+	}
+}
+
+// unseekableFS opens files whose Seek fails, like pipes or streaming
+// network adapters
+type unseekableFS struct {
+	absfs.FileSystem
+}
+
+func (f *unseekableFS) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	file, err := f.FileSystem.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &unseekableFile{File: file}, nil
+}
+
+type unseekableFile struct {
+	absfs.File
+}
+
+func (f *unseekableFile) Seek(offset int64, whence int) (int64, error) {
+	return 0, &os.PathError{Op: "seek", Path: f.Name(), Err: syscall.ESPIPE}
+}
+
+func TestEncryptFS_UnseekableBase(t *testing.T) {
+	keyProvider := NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+		Memory:      64 * 1024,
+		Iterations:  1,
+		Parallelism: 2,
+	})
+
+	for _, chunkSize := range []int{0, 4 * 1024} {
+		osBase, cleanup := setupTestFS(t)
+		defer cleanup()
+
+		// A file written through a seekable base
+		fs, err := New(osBase, &Config{Cipher: CipherAES256GCM, KeyProvider: keyProvider, ChunkSize: chunkSize})
+		if err != nil {
+			t.Fatalf("failed to create EncryptFS: %v", err)
+		}
+		if err := fs.WriteFiles(map[string][]byte{"/file.txt": []byte("seekable")}); err != nil {
+			t.Fatalf("WriteFiles failed: %v", err)
+		}
+		if err := fs.Mkdir("/dir", 0755); err != nil {
+			t.Fatalf("Mkdir failed: %v", err)
+		}
+		fs.Close()
+
+		fs, err = New(&unseekableFS{FileSystem: osBase}, &Config{Cipher: CipherAES256GCM, KeyProvider: keyProvider, ChunkSize: chunkSize})
+		if err != nil {
+			t.Fatalf("failed to create EncryptFS: %v", err)
+		}
+		defer fs.Close()
+
+		// Opening files fails up front with ErrNotSupported
+		for _, open := range []func() (absfs.File, error){
+			func() (absfs.File, error) { return fs.Open("/file.txt") },
+			func() (absfs.File, error) { return fs.Create("/new.txt") },
+		} {
+			file, err := open()
+			if err == nil {
+				file.Close()
+			}
+			var pathErr *os.PathError
+			if !errors.Is(err, ErrNotSupported) || !errors.As(err, &pathErr) || pathErr.Op != "open" {
+				t.Errorf("chunk size %d: open on an unseekable base = %v, want an open PathError wrapping ErrNotSupported", chunkSize, err)
+			}
+		}
+
+		// Directories are still listed
+		dir, err := fs.Open("/dir")
+		if err != nil {
+			t.Fatalf("chunk size %d: opening a directory failed: %v", chunkSize, err)
+		}
+		dir.Close()
+	}
+}
+
+func TestEncryptFS_StoredKDFParams(t *testing.T) {
+	tests := []struct {
+		name      string
+		writer    KeyProvider
+		reader    KeyProvider
+		chunkSize int
+	}{
+		{
+			name: "argon2id traditional",
+			writer: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+				Memory: 64 * 1024, Iterations: 1, Parallelism: 2,
+			}),
+			reader: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+				Memory: 32 * 1024, Iterations: 2, Parallelism: 1,
+			}),
+		},
+		{
+			name: "argon2id chunked",
+			writer: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+				Memory: 64 * 1024, Iterations: 1, Parallelism: 2,
+			}),
+			reader: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+				Memory: 32 * 1024, Iterations: 2, Parallelism: 1,
+			}),
+			chunkSize: 4096,
+		},
+		{
+			name: "pbkdf2 traditional",
+			writer: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+				Memory: 64 * 1024, Iterations: 1, Parallelism: 2,
+			}),
+			reader: NewPasswordKeyProviderPBKDF2([]byte("test-password"), PBKDF2Params{
+				Iterations: 100000, HashFunc: SHA512,
+			}),
+		},
+		{
+			name: "pbkdf2 written",
+			writer: NewPasswordKeyProviderPBKDF2([]byte("test-password"), PBKDF2Params{
+				Iterations: 100000, HashFunc: SHA256,
+			}),
+			reader: NewPasswordKeyProviderPBKDF2([]byte("test-password"), PBKDF2Params{
+				Iterations: 200000, HashFunc: SHA512,
+			}),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base, cleanup := setupTestFS(t)
+			defer cleanup()
+
+			fs1, err := New(base, &Config{
+				Cipher:      CipherAES256GCM,
+				KeyProvider: tt.writer,
+				ChunkSize:   tt.chunkSize,
+			})
+			if err != nil {
+				t.Fatalf("failed to create EncryptFS: %v", err)
+			}
+
+			testData := []byte("data written with one set of kdf parameters")
+			file, err := fs1.Create("/kdf.txt")
+			if err != nil {
+				t.Fatalf("failed to create file: %v", err)
+			}
+			file.Write(testData)
+			if err := file.Close(); err != nil {
+				t.Fatalf("failed to close: %v", err)
+			}
+
+			// Read back with a provider configured differently
+			fs2, err := New(base, &Config{
+				Cipher:      CipherAES256GCM,
+				KeyProvider: tt.reader,
+				ChunkSize:   tt.chunkSize,
+			})
+			if err != nil {
+				t.Fatalf("failed to create EncryptFS: %v", err)
+			}
+
+			file, err = fs2.Open("/kdf.txt")
+			if err != nil {
+				t.Fatalf("failed to open with different kdf config: %v", err)
+			}
+			readData, err := io.ReadAll(file)
+			file.Close()
+			if err != nil {
+				t.Fatalf("failed to read: %v", err)
+			}
+
+			if !bytes.Equal(readData, testData) {
+				t.Fatalf("data mismatch:\ngot:  %q\nwant: %q", readData, testData)
+			}
+		})
+	}
+}
+
+func TestRawKeyProvider(t *testing.T) {
+	if _, err := NewRawKeyProvider(make([]byte, 16)); err == nil {
+		t.Fatal("expected error for a 16-byte raw key")
+	}
+
+	rawKey := bytes.Repeat([]byte{0x42}, 32)
+	provider, err := NewRawKeyProvider(rawKey)
+	if err != nil {
+		t.Fatalf("NewRawKeyProvider failed: %v", err)
+	}
+
+	salt1, err := provider.GenerateSalt()
+	if err != nil {
+		t.Fatalf("GenerateSalt failed: %v", err)
+	}
+	salt2, err := provider.GenerateSalt()
+	if err != nil {
+		t.Fatalf("GenerateSalt failed: %v", err)
+	}
+	if bytes.Equal(salt1, salt2) {
+		t.Fatal("GenerateSalt returned the same salt twice")
+	}
+
+	key1, err := provider.DeriveKey(salt1)
+	if err != nil {
+		t.Fatalf("DeriveKey failed: %v", err)
+	}
+	key2, err := provider.DeriveKey(salt2)
+	if err != nil {
+		t.Fatalf("DeriveKey failed: %v", err)
+	}
+	again, err := provider.DeriveKey(salt1)
+	if err != nil {
+		t.Fatalf("DeriveKey failed: %v", err)
+	}
+
+	if key1.Len() != 32 {
+		t.Errorf("derived key length: got %d, want 32", key1.Len())
+	}
+	if bytes.Equal(key1.Bytes(), key2.Bytes()) {
+		t.Error("distinct salts derived the same key")
+	}
+	if !bytes.Equal(key1.Bytes(), again.Bytes()) {
+		t.Error("the same salt derived different keys")
+	}
+	if bytes.Equal(key1.Bytes(), rawKey) {
+		t.Error("derived key equals the raw key")
+	}
+
+	// Round-trip content through a filesystem using the raw key
+	base, cleanup := setupTestFS(t)
+	defer cleanup()
+
+	fs, err := New(base, &Config{
+		Cipher:      CipherAES256GCM,
+		KeyProvider: provider,
+	})
+	if err != nil {
+		t.Fatalf("failed to create EncryptFS: %v", err)
+	}
+
+	testData := []byte("encrypted with a key from a KMS")
+	file, err := fs.Create("/raw.txt")
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	file.Write(testData)
+	if err := file.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	file, err = fs.Open("/raw.txt")
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	readData, err := io.ReadAll(file)
+	file.Close()
+	if err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if !bytes.Equal(readData, testData) {
+		t.Fatalf("data mismatch:\ngot:  %q\nwant: %q", readData, testData)
+	}
+}
+
+func TestEncryptFS_Truncate(t *testing.T) {
+	data := make([]byte, 10000)
+	for i := range data {
+		data[i] = byte(i%251) + 1
+	}
+
+	for _, tt := range []struct {
+		name      string
+		chunkSize int
+	}{
+		{"traditional", 0},
+		{"chunked", 4 * 1024},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			base, cleanup := setupTestFS(t)
+			defer cleanup()
+
+			fs, err := New(base, &Config{
+				Cipher: CipherAES256GCM,
+				KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+					Memory:      64 * 1024,
+					Iterations:  1,
+					Parallelism: 2,
+				}),
+				ChunkSize: tt.chunkSize,
+			})
+			if err != nil {
+				t.Fatalf("failed to create EncryptFS: %v", err)
+			}
+
+			file, err := fs.Create("/file.bin")
+			if err != nil {
+				t.Fatalf("failed to create file: %v", err)
+			}
+			file.Write(data)
+			if err := file.Close(); err != nil {
+				t.Fatalf("failed to close: %v", err)
+			}
+
+			readAll := func() []byte {
+				t.Helper()
+				file, err := fs.Open("/file.bin")
+				if err != nil {
+					t.Fatalf("failed to open: %v", err)
+				}
+				defer file.Close()
+				content, err := io.ReadAll(file)
+				if err != nil {
+					t.Fatalf("failed to read: %v", err)
+				}
+				return content
+			}
+
+			// Shrink to the middle of a chunk, then to a chunk boundary
+			want := data
+			for _, size := range []int64{5000, 4096} {
+				if err := fs.Truncate("/file.bin", size); err != nil {
+					t.Fatalf("Truncate(%d) failed: %v", size, err)
+				}
+				want = want[:size]
+				if got := readAll(); !bytes.Equal(got, want) {
+					t.Fatalf("after Truncate(%d): got %d bytes, want %d", size, len(got), len(want))
+				}
+			}
+
+			// Grow with zeros
+			if err := fs.Truncate("/file.bin", 12000); err != nil {
+				t.Fatalf("Truncate(12000) failed: %v", err)
+			}
+			want = append(append([]byte(nil), want...), make([]byte, 12000-len(want))...)
+			if got := readAll(); !bytes.Equal(got, want) {
+				t.Fatalf("after Truncate(12000): got %d bytes, want %d", len(got), len(want))
+			}
+
+			// Appending after a truncate continues at the new end
+			file, err = fs.OpenFile("/file.bin", os.O_RDWR, 0)
+			if err != nil {
+				t.Fatalf("failed to reopen: %v", err)
+			}
+			file.Seek(0, io.SeekEnd)
+			file.Write([]byte("tail"))
+			file.Close()
+			want = append(want, "tail"...)
+			if got := readAll(); !bytes.Equal(got, want) {
+				t.Fatalf("after append: got %d bytes, want %d", len(got), len(want))
+			}
+
+			if err := fs.Truncate("/file.bin", 0); err != nil {
+				t.Fatalf("Truncate(0) failed: %v", err)
+			}
+			if got := readAll(); len(got) != 0 {
+				t.Fatalf("after Truncate(0): got %d bytes, want 0", len(got))
+			}
+
+			if err := fs.Truncate("/missing.bin", 0); !os.IsNotExist(err) {
+				t.Errorf("Truncate of missing file: got %v, want not-exist error", err)
+			}
+		})
+	}
+}
+
+func TestEncryptFS_WriteAtBeyondEOF(t *testing.T) {
+	base, cleanup := setupTestFS(t)
+	defer cleanup()
+
+	fs, err := New(base, &Config{
+		Cipher: CipherAES256GCM,
+		KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+			Memory:      64 * 1024,
+			Iterations:  1,
+			Parallelism: 2,
+		}),
+	})
+	if err != nil {
+		t.Fatalf("failed to create EncryptFS: %v", err)
+	}
+
+	file, err := fs.Create("/sparse.bin")
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	file.Write([]byte("hello"))
+
+	// Writing past the end zero-fills the gap and leaves the offset alone
+	if n, err := file.WriteAt([]byte("world"), 10); err != nil || n != 5 {
+		t.Fatalf("WriteAt beyond EOF: n=%d, err=%v", n, err)
+	}
+	if pos, _ := file.Seek(0, io.SeekCurrent); pos != 5 {
+		t.Errorf("offset after WriteAt = %d, want 5", pos)
+	}
+	gap := make([]byte, 5)
+	if n, err := file.ReadAt(gap, 5); err != nil || n != 5 {
+		t.Fatalf("ReadAt gap: n=%d, err=%v", n, err)
+	}
+	if !bytes.Equal(gap, make([]byte, 5)) {
+		t.Errorf("gap = %q, want zeros", gap)
+	}
+	rest, _ := io.ReadAll(file)
+	if want := "\x00\x00\x00\x00\x00world"; string(rest) != want {
+		t.Errorf("Read from offset 5 = %q, want %q", rest, want)
+	}
+
+	// Empty writes do not extend the file
+	if n, err := file.WriteAt(nil, 100); err != nil || n != 0 {
+		t.Fatalf("empty WriteAt: n=%d, err=%v", n, err)
+	}
+	if end, _ := file.Seek(0, io.SeekEnd); end != 15 {
+		t.Errorf("size after empty WriteAt = %d, want 15", end)
+	}
+
+	// Overlapping writes replace only the bytes they cover
+	file.WriteAt([]byte("XYZ"), 3)
+	file.Seek(5, io.SeekStart)
+	file.Write([]byte("ab"))
+
+	// Growing after a shrink must not expose the truncated bytes
+	file.Truncate(12)
+	file.WriteAt([]byte("!"), 14)
+
+	want := "helXYab\x00\x00\x00wo\x00\x00!"
+	got := make([]byte, 20)
+	n, _ := file.ReadAt(got, 0)
+	if string(got[:n]) != want {
+		t.Errorf("content = %q, want %q", got[:n], want)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	file, err = fs.Open("/sparse.bin")
+	if err != nil {
+		t.Fatalf("failed to reopen: %v", err)
+	}
+	defer file.Close()
+	persisted, _ := io.ReadAll(file)
+	if string(persisted) != want {
+		t.Errorf("persisted content = %q, want %q", persisted, want)
+	}
+}
+
+func TestEncryptFS_SeekBeyondEOFWrite(t *testing.T) {
+	base, cleanup := setupTestFS(t)
+	defer cleanup()
+
+	fs, err := New(base, &Config{
+		Cipher: CipherAES256GCM,
+		KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+			Memory:      64 * 1024,
+			Iterations:  1,
+			Parallelism: 2,
+		}),
+		PadSize: 64,
+	})
+	if err != nil {
+		t.Fatalf("failed to create EncryptFS: %v", err)
+	}
+
+	file, err := fs.Create("/sparse.bin")
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	file.Write([]byte("head"))
+
+	// Seeking past EOF does not extend the file by itself
+	if pos, err := file.Seek(6, io.SeekEnd); err != nil || pos != 10 {
+		t.Fatalf("Seek past EOF = %d, %v; want 10", pos, err)
+	}
+	if info, _ := file.Stat(); info.Size() != 4 {
+		t.Errorf("size after Seek = %d, want 4", info.Size())
+	}
+
+	// The write lands at the offset, after a hole of zeros
+	if n, err := file.Write([]byte("tail")); err != nil || n != 4 {
+		t.Fatalf("Write past EOF: n=%d, err=%v", n, err)
+	}
+	if pos, _ := file.Seek(0, io.SeekCurrent); pos != 14 {
+		t.Errorf("offset after Write = %d, want 14", pos)
+	}
+	want := "head\x00\x00\x00\x00\x00\x00tail"
+	got := make([]byte, 20)
+	n, _ := file.ReadAt(got, 0)
+	if string(got[:n]) != want {
+		t.Errorf("content = %q, want %q", got[:n], want)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	// A reopened file holds its padding beyond the plaintext, and its
+	// truncated bytes beyond a shrink; neither shows through a hole
+	file, err = fs.OpenFile("/sparse.bin", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("failed to reopen: %v", err)
+	}
+	if err := file.Truncate(2); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	file.Seek(8, io.SeekStart)
+	file.Write([]byte("!"))
+	if err := file.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+	want = "he\x00\x00\x00\x00\x00\x00!"
+	compareTree(t, fs, "/", map[string][]byte{"/sparse.bin": []byte(want)})
+}
+
+func TestEncryptFS_WriteOnlyFlags(t *testing.T) {
+	tests := []struct {
+		name string
+		flag int
+		want string
+	}{
+		{"truncate", os.O_WRONLY | os.O_TRUNC, "new"},
+		{"append", os.O_WRONLY | os.O_APPEND, "existing contentnew"},
+		{"read-write append", os.O_RDWR | os.O_APPEND, "existing contentnew"},
+		{"overwrite", os.O_WRONLY, "newsting content"},
+	}
+
+	// Not every base filesystem reports a truncated file as empty to Stat
+	bases := map[string]func(t *testing.T) (absfs.FileSystem, func()){
+		"os": setupTestFS,
+		"memfs": func(t *testing.T) (absfs.FileSystem, func()) {
+			base, err := memfs.NewFS()
+			if err != nil {
+				t.Fatalf("failed to create base filesystem: %v", err)
+			}
+			return base, func() {}
+		},
+	}
+
+	for baseName, setup := range bases {
+		for _, chunkSize := range []int{0, 4 * 1024} {
+			for _, tt := range tests {
+				name := tt.name + "/traditional/" + baseName
+				if chunkSize > 0 {
+					name = tt.name + "/chunked/" + baseName
+				}
+				t.Run(name, func(t *testing.T) {
+					base, cleanup := setup(t)
+					defer cleanup()
+
+					fs, err := New(base, &Config{
+						Cipher: CipherAES256GCM,
+						KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+							Memory:      64 * 1024,
+							Iterations:  1,
+							Parallelism: 2,
+						}),
+						ChunkSize: chunkSize,
+					})
+					if err != nil {
+						t.Fatalf("failed to create EncryptFS: %v", err)
+					}
+
+					file, err := fs.Create("/existing.txt")
+					if err != nil {
+						t.Fatalf("failed to create file: %v", err)
+					}
+					file.Write([]byte("existing content"))
+					file.Close()
+
+					file, err = fs.OpenFile("/existing.txt", tt.flag, 0)
+					if err != nil {
+						t.Fatalf("OpenFile failed: %v", err)
+					}
+					// An append lands at the end wherever the offset is
+					file.Seek(0, io.SeekStart)
+					if _, err := file.Write([]byte("new")); err != nil {
+						t.Fatalf("Write failed: %v", err)
+					}
+					if err := file.Close(); err != nil {
+						t.Fatalf("Close failed: %v", err)
+					}
+
+					file, err = fs.Open("/existing.txt")
+					if err != nil {
+						t.Fatalf("failed to reopen: %v", err)
+					}
+					defer file.Close()
+					got, err := io.ReadAll(file)
+					if err != nil {
+						t.Fatalf("failed to read: %v", err)
+					}
+					if string(got) != tt.want {
+						t.Errorf("content = %q, want %q", got, tt.want)
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestEncryptFS_Close(t *testing.T) {
+	base, cleanup := setupTestFS(t)
+	defer cleanup()
+
+	config := &Config{
+		Cipher: CipherAES256GCM,
+		KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+			Memory:      64 * 1024,
+			Iterations:  1,
+			Parallelism: 2,
+		}),
+		FilenameEncryption: FilenameEncryptionRandom,
+		MetadataPath:       "/.metadata.json",
+	}
+
+	fs, err := New(base, config)
+	if err != nil {
+		t.Fatalf("failed to create EncryptFS: %v", err)
+	}
+
+	files := []string{"/a.txt", "/b.txt"}
+	for _, name := range files {
+		file, err := fs.Create(name)
+		if err != nil {
+			t.Fatalf("Create(%q) failed: %v", name, err)
+		}
+		file.Write([]byte("content of " + name))
+		file.Close()
+	}
+
+	masterKey := fs.masterKey.Bytes()
+	siv := fs.filenameEncryptor.(*randomFilenameEncryptor).siv
+	nameKeys := [][]byte{siv.k1, siv.k2, siv.macK1, siv.macK2, siv.zeroMAC}
+	if err := fs.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if err := fs.Close(); err != nil {
+		t.Errorf("second Close failed: %v", err)
+	}
+
+	if !bytes.Equal(masterKey, make([]byte, len(masterKey))) {
+		t.Error("master key was not zeroed")
+	}
+	for _, key := range nameKeys {
+		if !bytes.Equal(key, make([]byte, len(key))) {
+			t.Error("filename key was not zeroed")
+		}
+	}
+
+	if _, err := fs.Create("/c.txt"); !errors.Is(err, ErrClosed) {
+		t.Errorf("Create after Close: got %v, want ErrClosed", err)
+	}
+	if _, err := fs.Stat("/a.txt"); !errors.Is(err, ErrClosed) {
+		t.Errorf("Stat after Close: got %v, want ErrClosed", err)
+	}
+
+	// The metadata written by Close maps every file back to its name
+	metadata := NewFilenameMetadata()
+	if err := metadata.Load(base, config.MetadataPath); err != nil {
+		t.Fatalf("failed to load metadata: %v", err)
+	}
+	for _, name := range files {
+		if _, ok := metadata.GetReverse(filepath.Base(name)); !ok {
+			t.Errorf("metadata is missing %q", name)
+		}
+	}
+
+	reopened, err := New(base, config)
+	if err != nil {
+		t.Fatalf("failed to reopen EncryptFS: %v", err)
+	}
+	defer reopened.Close()
+
+	for _, name := range files {
+		file, err := reopened.Open(name)
+		if err != nil {
+			t.Fatalf("Open(%q) after reopen failed: %v", name, err)
+		}
+		data, _ := io.ReadAll(file)
+		file.Close()
+		if want := "content of " + name; string(data) != want {
+			t.Errorf("content of %q = %q, want %q", name, data, want)
+		}
+	}
+}
+
+func TestEncryptFS_ReservedMetadataPath(t *testing.T) {
+	tests := []struct {
+		name    string
+		flatten bool
+	}{
+		{"random", false},
+		{"flat", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base, cleanup := setupTestFS(t)
+			defer cleanup()
+
+			fs, err := New(base, &Config{
+				Cipher: CipherAES256GCM,
+				KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+					Memory:      64 * 1024,
+					Iterations:  1,
+					Parallelism: 2,
+				}),
+				FilenameEncryption: FilenameEncryptionRandom,
+				FlattenDirectories: tt.flatten,
+				MetadataPath:       "/.metadata.json",
+			})
+			if err != nil {
+				t.Fatalf("failed to create EncryptFS: %v", err)
+			}
+
+			if _, err := fs.Create("/.metadata.json"); !errors.Is(err, ErrReservedPath) {
+				t.Errorf("Create at metadata path: got %v, want ErrReservedPath", err)
+			}
+			if _, err := fs.OpenFile("/dir/../.metadata.json", os.O_RDWR|os.O_CREATE, 0644); !errors.Is(err, ErrReservedPath) {
+				t.Errorf("OpenFile at uncleaned metadata path: got %v, want ErrReservedPath", err)
+			}
+			if err := fs.Mkdir("/.metadata.json", 0755); !errors.Is(err, ErrReservedPath) {
+				t.Errorf("Mkdir at metadata path: got %v, want ErrReservedPath", err)
+			}
+
+			file, err := fs.Create("/user.txt")
+			if err != nil {
+				t.Fatalf("failed to create file: %v", err)
+			}
+			file.Close()
+			if err := fs.Rename("/user.txt", "/.metadata.json"); !errors.Is(err, ErrReservedPath) {
+				t.Errorf("Rename onto metadata path: got %v, want ErrReservedPath", err)
+			}
+
+			if err := fs.Close(); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+			reopened, err := New(base, fs.config)
+			if err != nil {
+				t.Fatalf("failed to reopen EncryptFS: %v", err)
+			}
+			defer reopened.Close()
+
+			entries, err := reopened.ReadDir("/")
+			if err != nil {
+				t.Fatalf("ReadDir failed: %v", err)
+			}
+			if len(entries) != 1 || entries[0].Name() != "user.txt" {
+				var names []string
+				for _, entry := range entries {
+					names = append(names, entry.Name())
+				}
+				t.Errorf("ReadDir = %v, want [user.txt]", names)
+			}
+		})
+	}
+}
+
+func TestCleanPath(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		depth   int
+		escapes bool
+	}{
+		{"", "", 0, false},
+		{"/", "/", 0, false},
+		{"/a//b", "/a/b", 2, false},
+		{"/a/b/", "/a/b", 2, false},
+		{"a/./b", "a/b", 2, false},
+		{"/a/../b", "/b", 1, false},
+		{"a/..", ".", 0, false},
+		{"/../a", "/a", 1, true},
+		{"/a/../../b", "/b", 1, true},
+	}
+
+	for _, tt := range tests {
+		got, depth, escapes := cleanPath(tt.in, "/")
+		if got != tt.want || depth != tt.depth || escapes != tt.escapes {
+			t.Errorf("cleanPath(%q) = %q, %d, %v; want %q, %d, %v", tt.in, got, depth, escapes, tt.want, tt.depth, tt.escapes)
+		}
+	}
+}
+
+func TestEncryptFS_PathValidation(t *testing.T) {
+	base, cleanup := setupTestFS(t)
+	defer cleanup()
+
+	fs, err := New(base, &Config{
+		Cipher: CipherAES256GCM,
+		KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+			Memory:      64 * 1024,
+			Iterations:  1,
+			Parallelism: 2,
+		}),
+		FilenameEncryption: FilenameEncryptionDeterministic,
+		MaxPathDepth:       4,
+	})
+	if err != nil {
+		t.Fatalf("failed to create EncryptFS: %v", err)
+	}
+
+	if err := fs.MkdirAll("/a/b", 0755); err != nil {
+		t.Fatalf("MkdirAll failed: %v", err)
+	}
+
+	// Doubled separators name the same file
+	file, err := fs.Create("/a//b//file.txt")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	file.Write([]byte("data"))
+	file.Close()
+
+	if _, err := fs.Stat("/a/b/file.txt"); err != nil {
+		t.Errorf("Stat of the cleaned path failed: %v", err)
+	}
+	encrypted, err := fs.translatePath("/a//b//file.txt")
+	if err != nil {
+		t.Fatalf("translatePath failed: %v", err)
+	}
+	if strings.Contains(encrypted, "//") {
+		t.Errorf("encrypted path %q has empty components", encrypted)
+	}
+
+	// Trailing separators name the directory
+	info, err := fs.Stat("/a/b/")
+	if err != nil || !info.IsDir() {
+		t.Errorf("Stat(/a/b/) = %v, %v, want a directory", info, err)
+	}
+	entries, err := fs.ReadDir("/a//b/")
+	if err != nil || len(entries) != 1 {
+		t.Errorf("ReadDir(/a//b/) = %d entries, %v, want 1", len(entries), err)
+	}
+
+	// Malformed paths fail validation before reaching the base filesystem
+	for _, name := range []string{
+		"/../escape.txt",
+		"/a/../../escape.txt",
+		"/a/b/c/d/e.txt",
+		"/a/nul\x00.txt",
+	} {
+		if _, err := fs.Create(name); !IsValidationError(err) {
+			t.Errorf("Create(%q) error = %v, want ValidationError", name, err)
+		}
+	}
+	if err := fs.Rename("/a/b/file.txt", "/../file.txt"); !IsValidationError(err) {
+		t.Errorf("Rename onto an escaping path error = %v, want ValidationError", err)
+	}
+	if _, err := base.Stat("/escape.txt"); !os.IsNotExist(err) {
+		t.Errorf("base filesystem was touched: %v", err)
+	}
+
+	// Paths up to the maximum depth are allowed
+	if err := fs.MkdirAll("/a/b/c/d", 0755); err != nil {
+		t.Errorf("MkdirAll at the maximum depth failed: %v", err)
+	}
+}
+
+func TestPasswordKeyProvider_SaltSize(t *testing.T) {
+	tests := []struct {
+		name     string
+		provider *PasswordKeyProvider
+		want     int
+	}{
+		{"argon2id default", NewPasswordKeyProvider([]byte("pw"), Argon2idParams{}), 32},
+		{"argon2id 16", NewPasswordKeyProvider([]byte("pw"), Argon2idParams{SaltSize: 16}), 16},
+		{"argon2id 64", NewPasswordKeyProvider([]byte("pw"), Argon2idParams{SaltSize: 64}), 64},
+		{"pbkdf2 default", NewPasswordKeyProviderPBKDF2([]byte("pw"), PBKDF2Params{}), 32},
+		{"pbkdf2 24", NewPasswordKeyProviderPBKDF2([]byte("pw"), PBKDF2Params{SaltSize: 24}), 24},
+		{"zero value", &PasswordKeyProvider{password: []byte("pw")}, 32},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			salt, err := tt.provider.GenerateSalt()
+			if err != nil {
+				t.Fatalf("GenerateSalt failed: %v", err)
+			}
+			if len(salt) != tt.want {
+				t.Errorf("salt size = %d, want %d", len(salt), tt.want)
+			}
+			if bytes.Equal(salt, make([]byte, len(salt))) {
+				t.Error("salt is all zeros")
+			}
+		})
+	}
+
+	// A file keeps the salt size it was written with after the configured
+	// size changes
+	base, cleanup := setupTestFS(t)
+	defer cleanup()
+
+	newFS := func(saltSize int) *EncryptFS {
+		fs, err := New(base, &Config{
+			Cipher: CipherAES256GCM,
+			KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+				Memory:      64 * 1024,
+				Iterations:  1,
+				Parallelism: 2,
+				SaltSize:    saltSize,
+			}),
+		})
+		if err != nil {
+			t.Fatalf("failed to create EncryptFS: %v", err)
+		}
+		return fs
+	}
+
+	file, err := newFS(16).Create("/short-salt.txt")
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	file.Write([]byte("salted"))
+	file.Close()
+
+	raw, err := readBaseFile(base, "/short-salt.txt")
+	if err != nil {
+		t.Fatalf("failed to read base file: %v", err)
+	}
+	header := &FileHeader{}
+	if _, err := header.ReadFrom(bytes.NewReader(raw)); err != nil {
+		t.Fatalf("failed to read header: %v", err)
+	}
+	if len(header.Salt) != 16 {
+		t.Fatalf("header salt size = %d, want 16", len(header.Salt))
+	}
+
+	file, err = newFS(64).Open("/short-salt.txt")
+	if err != nil {
+		t.Fatalf("failed to open with a different salt size: %v", err)
+	}
+	defer file.Close()
+	if got, _ := io.ReadAll(file); string(got) != "salted" {
+		t.Errorf("content = %q, want %q", got, "salted")
+	}
+}
+
+func TestPasswordKeyProvider_KDFLimit(t *testing.T) {
+	provider := NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+		Memory:      64 * 1024,
+		Iterations:  1,
+		Parallelism: 2,
+	})
+	salt := bytes.Repeat([]byte{1}, 32)
+
+	// Within the limits Argon2id's own validation allows, but far more
+	// memory than the default limit
+	oversized := KDFParams{ID: KDFArgon2id, Iterations: 1, Memory: 4 * 1024 * 1024, Parallelism: 1, KeySize: 32}
+	if _, err := provider.DeriveKeyWithParams(salt, oversized); !errors.Is(err, ErrKDFLimit) {
+		t.Fatalf("DeriveKeyWithParams(4 GiB) error = %v, want ErrKDFLimit", err)
+	}
+
+	pbkdf2 := KDFParams{ID: KDFPBKDF2, Iterations: 10000000, HashFunc: SHA256, KeySize: 32}
+	if _, err := provider.DeriveKeyWithParams(salt, pbkdf2); !errors.Is(err, ErrKDFLimit) {
+		t.Fatalf("DeriveKeyWithParams(10M PBKDF2 iterations) error = %v, want ErrKDFLimit", err)
+	}
+
+	// A header written with a crafted memory parameter fails to open
+	// before any derivation runs
+	base, cleanup := setupTestFS(t)
+	defer cleanup()
+
+	fs, err := New(base, &Config{Cipher: CipherAES256GCM, KeyProvider: provider})
+	if err != nil {
+		t.Fatalf("failed to create EncryptFS: %v", err)
+	}
+	file, err := fs.Create("/kdf.txt")
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	file.Write([]byte("guarded"))
+	if err := file.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	raw, err := base.OpenFile("/kdf.txt", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("failed to open base file: %v", err)
+	}
+	header := &FileHeader{}
+	if _, err := header.ReadFrom(raw); err != nil {
+		t.Fatalf("failed to read header: %v", err)
+	}
+	header.KDF.Memory = oversized.Memory
+	if _, err := raw.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("failed to seek: %v", err)
+	}
+	if _, err := header.WriteTo(raw); err != nil {
+		t.Fatalf("failed to rewrite header: %v", err)
+	}
+	raw.Close()
+
+	if _, err := fs.Open("/kdf.txt"); !errors.Is(err, ErrKDFLimit) {
+		t.Fatalf("Open with a 4 GiB header error = %v, want ErrKDFLimit", err)
+	}
+
+	// Raising the limit lets the provider accept stronger stored parameters
+	provider.SetKDFLimit(KDFParams{ID: KDFArgon2id, Iterations: 1, Memory: 128 * 1024, Parallelism: 2})
+	stronger := KDFParams{ID: KDFArgon2id, Iterations: 1, Memory: 128 * 1024, Parallelism: 1, KeySize: 32}
+	if _, err := provider.DeriveKeyWithParams(salt, stronger); err != nil {
+		t.Fatalf("DeriveKeyWithParams within the raised limit failed: %v", err)
+	}
+	stronger.Iterations = 2
+	if _, err := provider.DeriveKeyWithParams(salt, stronger); !errors.Is(err, ErrKDFLimit) {
+		t.Fatalf("DeriveKeyWithParams above the raised limit error = %v, want ErrKDFLimit", err)
+	}
+}
+
+// fileModel tracks the expected contents and offset of a file under a
+// sequence of reads, writes and seeks
+type fileModel struct {
+	data   []byte
+	offset int64
+}
+
+func (m *fileModel) write(p []byte) {
+	if end := m.offset + int64(len(p)); end > int64(len(m.data)) {
+		grown := make([]byte, end)
+		copy(grown, m.data)
+		m.data = grown
+	}
+	copy(m.data[m.offset:], p)
+	m.offset += int64(len(p))
+}
+
+func (m *fileModel) read(n int) []byte {
+	if m.offset >= int64(len(m.data)) {
+		return nil
+	}
+	end := m.offset + int64(n)
+	if end > int64(len(m.data)) {
+		end = int64(len(m.data))
+	}
+	got := m.data[m.offset:end]
+	m.offset = end
+	return got
+}
+
+func TestEncryptFS_InterleavedReadWrite(t *testing.T) {
+	const chunkSize = 4 * 1024
+
+	type op struct {
+		kind byte // 'w'rite, 'r'ead or 's'eek
+		n    int64
+	}
+	sequences := []struct {
+		name string
+		ops  []op
+	}{
+		{"read after write", []op{{'w', 100}, {'r', 10}, {'s', 0}, {'r', 200}}},
+		{"write after read", []op{{'w', 100}, {'s', 0}, {'r', 40}, {'w', 20}, {'s', 0}, {'r', 200}}},
+		{"read to EOF then write", []op{{'w', 50}, {'s', 0}, {'r', 100}, {'w', 30}, {'s', 0}, {'r', 100}}},
+		{"seek past end then write", []op{{'w', 10}, {'s', 100}, {'w', 5}, {'s', 0}, {'r', 200}}},
+		{"seek past a chunk boundary then write", []op{
+			{'w', 10}, {'s', 2*chunkSize + 100}, {'w', 5}, {'s', 0}, {'r', 3 * chunkSize},
+		}},
+		{"across chunks", []op{
+			{'w', chunkSize + 500}, {'s', chunkSize - 10}, {'r', 20},
+			{'w', 100}, {'s', chunkSize - 50}, {'w', chunkSize}, {'r', 10},
+			{'s', 0}, {'r', 3 * chunkSize},
+		}},
+		{"grow cached chunk", []op{
+			{'w', 100}, {'s', 0}, {'r', 50}, {'s', 90}, {'w', 200},
+			{'s', 0}, {'r', 1000},
+		}},
+		{"extend earlier chunk after reading a later one", []op{
+			{'w', 2*chunkSize + 10}, {'s', 2 * chunkSize}, {'r', 5},
+			{'s', chunkSize - 5}, {'w', 10}, {'s', 2 * chunkSize}, {'w', 100},
+			{'s', 0}, {'r', 4 * chunkSize},
+		}},
+	}
+
+	for _, chunked := range []bool{false, true} {
+		for _, seq := range sequences {
+			name := seq.name + "/traditional"
+			config := &Config{}
+			if chunked {
+				name = seq.name + "/chunked"
+				config.ChunkSize = chunkSize
+			}
+			t.Run(name, func(t *testing.T) {
+				base, cleanup := setupTestFS(t)
+				defer cleanup()
+
+				config.Cipher = CipherAES256GCM
+				config.KeyProvider = NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+					Memory:      64 * 1024,
+					Iterations:  1,
+					Parallelism: 2,
+				})
+				fs, err := New(base, config)
+				if err != nil {
+					t.Fatalf("failed to create EncryptFS: %v", err)
+				}
+
+				file, err := fs.Create("/interleaved.bin")
+				if err != nil {
+					t.Fatalf("failed to create file: %v", err)
+				}
+
+				model := &fileModel{}
+				for i, o := range seq.ops {
+					switch o.kind {
+					case 'w':
+						p := make([]byte, o.n)
+						for j := range p {
+							p[j] = byte(i*31 + j)
+						}
+						if n, err := file.Write(p); err != nil || n != len(p) {
+							t.Fatalf("op %d: Write = %d, %v, want %d", i, n, err, len(p))
+						}
+						model.write(p)
+					case 'r':
+						want := model.read(int(o.n))
+						got, err := io.ReadAll(io.LimitReader(file, o.n))
+						if err != nil {
+							t.Fatalf("op %d: Read failed: %v", i, err)
+						}
+						if !bytes.Equal(got, want) {
+							t.Fatalf("op %d: read %d bytes differing from the %d expected", i, len(got), len(want))
+						}
+					case 's':
+						if pos, err := file.Seek(o.n, io.SeekStart); err != nil || pos != o.n {
+							t.Fatalf("op %d: Seek = %d, %v, want %d", i, pos, err, o.n)
+						}
+						model.offset = o.n
+					}
+
+					if pos, _ := file.Seek(0, io.SeekCurrent); pos != model.offset {
+						t.Fatalf("op %d: offset = %d, want %d", i, pos, model.offset)
+					}
+				}
+				if err := file.Close(); err != nil {
+					t.Fatalf("failed to close: %v", err)
+				}
+
+				file, err = fs.Open("/interleaved.bin")
+				if err != nil {
+					t.Fatalf("failed to reopen: %v", err)
+				}
+				defer file.Close()
+				persisted, err := io.ReadAll(file)
+				if err != nil {
+					t.Fatalf("failed to read back: %v", err)
+				}
+				if !bytes.Equal(persisted, model.data) {
+					t.Errorf("persisted %d bytes differing from the %d expected", len(persisted), len(model.data))
+				}
+			})
+		}
+	}
+}
+
+// seededReader is a deterministic stream of bytes for tests: SHA-256 of the
+// seed and a block counter. It must never be used as a real random source.
+type seededReader struct {
+	mu      sync.Mutex
+	seed    string
+	counter uint64
+	buf     []byte
+}
+
+func (r *seededReader) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for n := 0; n < len(p); {
+		if len(r.buf) == 0 {
+			block := sha256.Sum256(binary.BigEndian.AppendUint64([]byte(r.seed), r.counter))
+			r.counter++
+			r.buf = block[:]
+		}
+		c := copy(p[n:], r.buf)
+		r.buf = r.buf[c:]
+		n += c
+	}
+	return len(p), nil
+}
+
+func TestEncryptFS_RandSource(t *testing.T) {
+	data := bytes.Repeat([]byte("reproducible ciphertext "), 200)
+
+	// write stores data with a fresh filesystem whose salts and nonces come
+	// from the seed, returning the encrypted file and verification marker
+	write := func(t *testing.T, seed string, chunkSize int) (file, marker []byte) {
+		t.Helper()
+		base, err := memfs.NewFS()
+		if err != nil {
+			t.Fatalf("failed to create base filesystem: %v", err)
+		}
+		fs, err := New(base, &Config{
+			Cipher: CipherAES256GCM,
+			KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+				Memory:      64 * 1024,
+				Iterations:  1,
+				Parallelism: 2,
+			}),
+			ChunkSize:  chunkSize,
+			RandSource: &seededReader{seed: seed},
+		})
+		if err != nil {
+			t.Fatalf("failed to create EncryptFS: %v", err)
+		}
+		defer fs.Close()
+
+		f, err := fs.Create("/kat.bin")
+		if err != nil {
+			t.Fatalf("failed to create file: %v", err)
+		}
+		if _, err := f.Write(data); err != nil {
+			t.Fatalf("failed to write: %v", err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatalf("failed to close: %v", err)
+		}
+
+		readBase := func(name string) []byte {
+			f, err := base.Open(name)
+			if err != nil {
+				t.Fatalf("failed to open %s: %v", name, err)
+			}
+			defer f.Close()
+			b, err := io.ReadAll(f)
+			if err != nil {
+				t.Fatalf("failed to read %s: %v", name, err)
+			}
+			return b
+		}
+		return readBase("/kat.bin"), readBase(VerifyMarkerPath)
+	}
+
+	for _, tc := range []struct {
+		name      string
+		chunkSize int
+	}{
+		{"traditional", 0},
+		{"chunked", 4096},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			file1, marker1 := write(t, "seed-1", tc.chunkSize)
+			file2, marker2 := write(t, "seed-1", tc.chunkSize)
+			if !bytes.Equal(file1, file2) {
+				t.Error("the same source produced different ciphertexts")
+			}
+			if !bytes.Equal(marker1, marker2) {
+				t.Error("the same source produced different markers")
+			}
+
+			other, _ := write(t, "seed-2", tc.chunkSize)
+			if bytes.Equal(file1, other) {
+				t.Error("different sources produced the same ciphertext")
+			}
+
+			// The salt and nonce in the header were read from the source
+			var header FileHeader
+			if _, err := header.ReadFrom(bytes.NewReader(file1)); err != nil {
+				t.Fatalf("failed to read header: %v", err)
+			}
+			stream := make([]byte, 1024)
+			(&seededReader{seed: "seed-1"}).Read(stream)
+			if !bytes.Contains(stream, header.Salt) || !bytes.Contains(stream, header.Nonce) {
+				t.Error("header salt and nonce were not drawn from the source")
+			}
+		})
+	}
+}
+
+func TestEncryptFS_RandSourceFilenames(t *testing.T) {
+	// name returns the random name "/a.txt" gets in a fresh filesystem
+	// whose randomness comes from the seed
+	name := func(t *testing.T, seed string, flatten bool) string {
+		t.Helper()
+		base, err := memfs.NewFS()
+		if err != nil {
+			t.Fatalf("failed to create base filesystem: %v", err)
+		}
+		fs, err := New(base, &Config{
+			Cipher: CipherAES256GCM,
+			KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+				Memory:      64 * 1024,
+				Iterations:  1,
+				Parallelism: 2,
+			}),
+			FilenameEncryption: FilenameEncryptionRandom,
+			MetadataPath:       "/.metadata",
+			FlattenDirectories: flatten,
+			RandSource:         &seededReader{seed: seed},
+		})
+		if err != nil {
+			t.Fatalf("failed to create EncryptFS: %v", err)
+		}
+		defer fs.Close()
+
+		writePlainFile(t, fs, "/a.txt", []byte("a"))
+		encrypted, err := fs.translatePath("/a.txt")
+		if err != nil {
+			t.Fatalf("translatePath failed: %v", err)
+		}
+		return encrypted
+	}
+
+	for _, flatten := range []bool{false, true} {
+		if name(t, "seed-1", flatten) != name(t, "seed-1", flatten) {
+			t.Errorf("flatten=%v: the same source produced different filenames", flatten)
+		}
+		if name(t, "seed-1", flatten) == name(t, "seed-2", flatten) {
+			t.Errorf("flatten=%v: different sources produced the same filename", flatten)
+		}
+	}
+}
+
+func TestEncryptFS_PlaintextSize(t *testing.T) {
+	base, cleanup := setupTestFS(t)
+	defer cleanup()
+
+	const padSize = 1024
+	fs, err := New(base, &Config{
+		Cipher: CipherAES256GCM,
+		KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+			Memory:      64 * 1024,
+			Iterations:  1,
+			Parallelism: 2,
+		}),
+		PadSize: padSize,
+	})
+	if err != nil {
+		t.Fatalf("failed to create EncryptFS: %v", err)
+	}
+	defer fs.Close()
+
+	sizes := []int{0, 1, 1000, padSize, 5000}
+	for _, size := range sizes {
+		name := fmt.Sprintf("/file-%d.bin", size)
+		data := bytes.Repeat([]byte{'x'}, size)
+		file, err := fs.Create(name)
+		if err != nil {
+			t.Fatalf("failed to create %s: %v", name, err)
+		}
+		file.Write(data)
+		if err := file.Close(); err != nil {
+			t.Fatalf("failed to close %s: %v", name, err)
+		}
+
+		info, err := fs.Stat(name)
+		if err != nil {
+			t.Fatalf("failed to stat %s: %v", name, err)
+		}
+		if info.Size() != int64(size) {
+			t.Errorf("Stat(%s).Size() = %d, want %d", name, info.Size(), size)
+		}
+
+		// The ciphertext on disk is padded to a multiple of padSize
+		baseInfo, err := base.Stat(name)
+		if err != nil {
+			t.Fatalf("failed to stat base file: %v", err)
+		}
+		header := readTestHeader(t, base, name)
+		if body := baseInfo.Size() - int64(header.Size()) - aeadTagSize; body%padSize != 0 || body < int64(size)+paddedSizeSize {
+			t.Errorf("%s: ciphertext body is %d bytes, want a multiple of %d holding %d", name, body, padSize, size)
+		}
+
+		file, err = fs.Open(name)
+		if err != nil {
+			t.Fatalf("failed to open %s: %v", name, err)
+		}
+		got, err := io.ReadAll(file)
+		file.Close()
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", name, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("%s: read %d bytes, want %d", name, len(got), size)
+		}
+	}
+
+	// Directory listings report the same sizes
+	entries, err := fs.ReadDir("/")
+	if err != nil {
+		t.Fatalf("ReadDir failed: %v", err)
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			t.Fatalf("failed to get info for %s: %v", entry.Name(), err)
+		}
+		var size int64
+		fmt.Sscanf(entry.Name(), "file-%d.bin", &size)
+		if info.Size() != size {
+			t.Errorf("ReadDir size of %s = %d, want %d", entry.Name(), info.Size(), size)
+		}
+	}
+
+	// The size is recorded inside the ciphertext, so files that pad to the
+	// same size cannot be told apart on disk
+	var padded []int64
+	for _, name := range []string{"/file-0.bin", "/file-1.bin", "/file-1000.bin"} {
+		header := readTestHeader(t, base, name)
+		if header.Flags&FlagPadded == 0 {
+			t.Errorf("%s: header flags %#x, want FlagPadded", name, header.Flags)
+		}
+		baseInfo, err := base.Stat(name)
+		if err != nil {
+			t.Fatalf("failed to stat base file: %v", err)
+		}
+		padded = append(padded, baseInfo.Size())
+	}
+	if padded[0] != padded[1] || padded[1] != padded[2] {
+		t.Errorf("padded files have base sizes %v, want them equal", padded)
+	}
+
+	// Stat opens the size sealed in the header without decrypting the
+	// body, so it still reports the size of a file whose body is corrupt
+	name := "/file-1000.bin"
+	raw, err := base.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile on base failed: %v", err)
+	}
+	corruptAt := int64(readTestHeader(t, base, name).Size()) + 10
+	b := make([]byte, 1)
+	raw.ReadAt(b, corruptAt)
+	b[0] ^= 0xFF
+	if _, err := raw.WriteAt(b, corruptAt); err != nil {
+		t.Fatalf("WriteAt on base failed: %v", err)
+	}
+	raw.Close()
+	if file, err := fs.Open(name); err == nil {
+		file.Close()
+		t.Errorf("Open of a padded file with a corrupt body succeeded")
+	}
+	if info, err := fs.Stat(name); err != nil || info.Size() != 1000 {
+		t.Errorf("Stat of a padded file with a corrupt body = %v, %v, want size 1000", info, err)
+	}
+}
+
+// readTestHeader reads the file header of the encrypted file name on base
+func readTestHeader(t *testing.T, base absfs.FileSystem, name string) *FileHeader {
+	t.Helper()
+	file, err := base.Open(name)
+	if err != nil {
+		t.Fatalf("failed to open base file: %v", err)
+	}
+	defer file.Close()
+
+	header := &FileHeader{}
+	if _, err := header.ReadFrom(file); err != nil {
+		t.Fatalf("failed to read header: %v", err)
+	}
+	return header
+}
+
+func TestEncryptFS_MetadataOperations(t *testing.T) {
+	password := NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+		Memory:      64 * 1024,
+		Iterations:  1,
+		Parallelism: 2,
+	})
+	configs := map[string]*Config{
+		"traditional": {Cipher: CipherAES256GCM, KeyProvider: password, ComputeDigest: true},
+		"chunked":     {Cipher: CipherAES256GCM, KeyProvider: password, ChunkSize: 4 * 1024},
+		"flat": {
+			Cipher:             CipherChaCha20Poly1305,
+			KeyProvider:        password,
+			FilenameEncryption: FilenameEncryptionRandom,
+			MetadataPath:       "/.encryptfs-metadata",
+			FlattenDirectories: true,
+		},
+	}
+
+	for name, config := range configs {
+		t.Run(name, func(t *testing.T) {
+			base, cleanup := setupTestFS(t)
+			defer cleanup()
+			fs, err := New(base, config)
+			if err != nil {
+				t.Fatalf("failed to create EncryptFS: %v", err)
+			}
+			defer fs.Close()
+
+			data := bytes.Repeat([]byte("metadata "), 2000)
+			if err := fs.Mkdir("/dir", 0755); err != nil {
+				t.Fatalf("Mkdir failed: %v", err)
+			}
+			if err := fs.WriteFiles(map[string][]byte{"/dir/file.txt": data}); err != nil {
+				t.Fatalf("WriteFiles failed: %v", err)
+			}
+
+			mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+			for _, p := range []string{"/dir/file.txt", "/dir"} {
+				if err := fs.Chtimes(p, mtime, mtime); err != nil {
+					t.Errorf("Chtimes(%s) failed: %v", p, err)
+				}
+				if err := fs.Chown(p, os.Getuid(), os.Getgid()); err != nil {
+					t.Errorf("Chown(%s) failed: %v", p, err)
+				}
+			}
+			if err := fs.Chmod("/dir/file.txt", 0400); err != nil {
+				t.Fatalf("Chmod failed: %v", err)
+			}
+
+			// Stat reports the base file's mode bits and times unchanged
+			info, err := fs.Stat("/dir/file.txt")
+			if err != nil {
+				t.Fatalf("Stat failed: %v", err)
+			}
+			if info.Mode() != 0400 || !info.ModTime().Equal(mtime) || info.Size() != int64(len(data)) {
+				t.Errorf("Stat = mode %v, mtime %v, size %d; want %v, %v, %d",
+					info.Mode(), info.ModTime(), info.Size(), os.FileMode(0400), mtime, len(data))
+			}
+
+			// The content still authenticates
+			file, err := fs.Open("/dir/file.txt")
+			if err != nil {
+				t.Fatalf("Open failed: %v", err)
+			}
+			defer file.Close()
+			got, err := io.ReadAll(file)
+			if err != nil {
+				t.Fatalf("read after Chmod failed: %v", err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Error("content changed after Chmod")
+			}
+			if info, err := file.Stat(); err != nil || info.Mode() != 0400 {
+				t.Errorf("file Stat = %v, %v, want mode %v", info, err, os.FileMode(0400))
+			}
+		})
+	}
+}
+
+// TestEncryptFS_RenameKeepsContent renames files with plaintext names in
+// every body format. Content is authenticated against its own header, not
+// its path, so a renamed file decrypts under its new name unchanged.
+func TestEncryptFS_RenameKeepsContent(t *testing.T) {
+	password := NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+		Memory:      64 * 1024,
+		Iterations:  1,
+		Parallelism: 2,
+	})
+	configs := map[string]*Config{
+		"traditional": {Cipher: CipherAES256GCM, KeyProvider: password, ComputeDigest: true},
+		"padded":      {Cipher: CipherAES256GCM, KeyProvider: password, PadSize: 256},
+		"stream":      {Cipher: CipherChaCha20Poly1305, KeyProvider: password, StreamFormat: StreamFormatSTREAM},
+		"chunked":     {Cipher: CipherAES256GCM, KeyProvider: password, ChunkSize: 4 * 1024},
+		"shared salt": {Cipher: CipherAES256GCM, KeyProvider: password, SharedSalt: true},
+	}
+
+	for name, config := range configs {
+		t.Run(name, func(t *testing.T) {
+			base, cleanup := setupTestFS(t)
+			defer cleanup()
+			config.FilenameEncryption = FilenameEncryptionNone
+			fs, err := New(base, config)
+			if err != nil {
+				t.Fatalf("failed to create EncryptFS: %v", err)
+			}
+			defer fs.Close()
+
+			data := bytes.Repeat([]byte("renamed "), 2000)
+			if err := fs.MkdirAll("/a/b", 0755); err != nil {
+				t.Fatalf("MkdirAll failed: %v", err)
+			}
+			if err := fs.WriteFiles(map[string][]byte{"/a/file.txt": data}); err != nil {
+				t.Fatalf("WriteFiles failed: %v", err)
+			}
+
+			// Rename within a directory, then into another one
+			if err := fs.Rename("/a/file.txt", "/a/moved.txt"); err != nil {
+				t.Fatalf("Rename failed: %v", err)
+			}
+			if err := fs.Rename("/a/moved.txt", "/a/b/final.txt"); err != nil {
+				t.Fatalf("Rename across directories failed: %v", err)
+			}
+			compareTree(t, fs, "/", map[string][]byte{"/a/b/final.txt": data})
+			if _, err := fs.Stat("/a/file.txt"); !os.IsNotExist(err) {
+				t.Errorf("Stat of the old name = %v, want not exist", err)
+			}
+
+			// The renamed file stays writable under its new name
+			file, err := fs.OpenFile("/a/b/final.txt", os.O_WRONLY|os.O_APPEND, 0)
+			if err != nil {
+				t.Fatalf("OpenFile after Rename failed: %v", err)
+			}
+			if _, err := file.Write([]byte("more")); err != nil {
+				t.Fatalf("Write after Rename failed: %v", err)
+			}
+			if err := file.Close(); err != nil {
+				t.Fatalf("Close after Rename failed: %v", err)
+			}
+			compareTree(t, fs, "/", map[string][]byte{"/a/b/final.txt": append(data, "more"...)})
+		})
+	}
+}
+
+// TestEncryptFS_SeekAlwaysEnabled checks that Seek works the same in both
+// file formats whatever the deprecated EnableSeek says
+func TestEncryptFS_SeekAlwaysEnabled(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+
+	for _, chunkSize := range []int{0, 4 * 1024} {
+		for _, enableSeek := range []bool{false, true} {
+			t.Run(fmt.Sprintf("chunk=%d/seek=%v", chunkSize, enableSeek), func(t *testing.T) {
+				base, cleanup := setupTestFS(t)
+				defer cleanup()
+				fs, err := New(base, &Config{
+					Cipher: CipherAES256GCM,
+					KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+						Memory:      64 * 1024,
+						Iterations:  1,
+						Parallelism: 2,
+					}),
+					ChunkSize:  chunkSize,
+					EnableSeek: enableSeek,
+				})
+				if err != nil {
+					t.Fatalf("failed to create EncryptFS: %v", err)
+				}
+				defer fs.Close()
+				if err := fs.WriteFiles(map[string][]byte{"/seek.txt": data}); err != nil {
+					t.Fatalf("WriteFiles failed: %v", err)
+				}
+
+				file, err := fs.Open("/seek.txt")
+				if err != nil {
+					t.Fatalf("Open failed: %v", err)
+				}
+				defer file.Close()
+
+				for _, tc := range []struct {
+					offset int64
+					whence int
+					want   int64
+				}{
+					{5003, io.SeekStart, 5003},
+					{-3, io.SeekCurrent, 5004},
+					{-10, io.SeekEnd, int64(len(data)) - 10},
+				} {
+					pos, err := file.Seek(tc.offset, tc.whence)
+					if err != nil || pos != tc.want {
+						t.Fatalf("Seek(%d, %d) = %d, %v; want %d", tc.offset, tc.whence, pos, err, tc.want)
+					}
+					buf := make([]byte, 4)
+					if _, err := io.ReadFull(file, buf); err != nil {
+						t.Fatalf("read after Seek failed: %v", err)
+					}
+					if !bytes.Equal(buf, data[tc.want:tc.want+4]) {
+						t.Errorf("read %q at %d, want %q", buf, tc.want, data[tc.want:tc.want+4])
+					}
+				}
+			})
+		}
+	}
+}
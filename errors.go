@@ -125,6 +125,68 @@ var (
 	ErrNegativeOffset     = errors.New("negative offset not allowed")
 )
 
+// ErrClosed is returned by operations on an EncryptFS after Close
+var ErrClosed = errors.New("filesystem is closed")
+
+// ErrReservedPath is returned when a user operation targets a path that
+// encryptfs uses for its own metadata
+var ErrReservedPath = errors.New("path is reserved for encryptfs metadata")
+
+// ErrNoXattr is returned by GetXattr when a file has no such attribute
+var ErrNoXattr = errors.New("extended attribute not found")
+
+// ErrDigestMismatch reports that a file's plaintext does not match the
+// digest recorded in its header
+var ErrDigestMismatch = errors.New("plaintext does not match recorded digest")
+
+// ErrNotChunked is returned by ChunkLayout and CheckNonces for files in the
+// traditional, single-chunk format
+var ErrNotChunked = errors.New("file is not in the chunked format")
+
+// ErrNotSupported is returned by methods that need an optional interface
+// the base filesystem does not implement. It wraps errors.ErrUnsupported.
+// Capabilities reports which such methods are available.
+var ErrNotSupported = fmt.Errorf("not supported by the base filesystem: %w", errors.ErrUnsupported)
+
+// ErrNonceReuse is wrapped by the CorruptionError reported when two chunks
+// of a file were encrypted with the same nonce
+var ErrNonceReuse = errors.New("nonce reused within file")
+
+// ErrNotEncrypted is returned when a file on the base filesystem does not
+// start with the encryptfs magic bytes, as with a plaintext file left in an
+// encrypted store. It wraps ErrInvalidHeader, and unlike ErrAuthFailed it
+// does not suggest a wrong password.
+var ErrNotEncrypted = fmt.Errorf("not an encryptfs file: %w", ErrInvalidHeader)
+
+// ErrUnsupportedFeatures is returned for a file whose format descriptor
+// lists features this version cannot read. The error names the features.
+var ErrUnsupportedFeatures = errors.New("unsupported file format features")
+
+// ErrConfigMismatch is returned by New when the config sets a value that
+// contradicts the settings stored in the filesystem's config blob
+var ErrConfigMismatch = errors.New("config contradicts the stored configuration")
+
+// ErrLocked is returned by OpenFile under LockFailFast when the file is
+// open by a handle the new one would conflict with
+var ErrLocked = errors.New("file is locked by another handle")
+
+// ErrNoFileKey is returned by an ExternalKeyProvider that has no way to
+// hand out the key of a new file, or was not given the key of an existing one
+var ErrNoFileKey = errors.New("no key supplied for file")
+
+// ErrWriteVerification is wrapped by the CorruptionError reported when data
+// read back under Config.VerifyAfterWrite does not match what was written
+var ErrWriteVerification = errors.New("written data failed read-back verification")
+
+// ErrNoRecoveryKey is returned when a RecoveryKeyProvider is asked for a
+// key it has no wrapped copy of: that of a file written without
+// Config.RecoveryKey, or of a new file
+var ErrNoRecoveryKey = errors.New("file key has no recovery copy")
+
+// ErrKDFLimit is returned when a file header asks for key derivation
+// parameters more expensive than the key provider accepts
+var ErrKDFLimit = errors.New("stored kdf parameters exceed the configured limit")
+
 // Helper functions for creating structured errors
 
 // NewValidationError creates a new validation error
@@ -174,6 +236,27 @@ func NewAuthenticationError(path string, err error) error {
 	}
 }
 
+// decryptError classifies a failure to open ciphertext. Authentication
+// failures, which mean a wrong key or tampered data, become an
+// AuthenticationError wrapping ErrAuthFailed; anything else becomes an
+// EncryptionError.
+func decryptError(path, message string, err error) error {
+	message = fmt.Sprintf("%s: %v", message, err)
+	if errors.Is(err, ErrAuthFailed) {
+		return &AuthenticationError{
+			Path:    path,
+			Message: message,
+			Err:     err,
+		}
+	}
+	return &EncryptionError{
+		Operation: "decrypt",
+		Path:      path,
+		Message:   message,
+		Err:       err,
+	}
+}
+
 // Error checking helpers
 
 // IsValidationError checks if an error is a validation error
@@ -1,8 +1,14 @@
 package encryptfs
 
 import (
+	"bytes"
 	"errors"
+	"io"
+	"os"
 	"testing"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/memfs"
 )
 
 func TestValidationError(t *testing.T) {
@@ -332,3 +338,150 @@ func TestErrorConstructors(t *testing.T) {
 		}
 	})
 }
+
+func TestErrorCategories(t *testing.T) {
+	newFS := func(t *testing.T, base absfs.FileSystem, password string, chunkSize int) *EncryptFS {
+		t.Helper()
+		fs, err := New(base, &Config{
+			Cipher: CipherAES256GCM,
+			KeyProvider: NewPasswordKeyProvider([]byte(password), Argon2idParams{
+				Memory:      64 * 1024,
+				Iterations:  1,
+				Parallelism: 2,
+			}),
+			ChunkSize: chunkSize,
+		})
+		if err != nil {
+			t.Fatalf("Failed to create EncryptFS: %v", err)
+		}
+		return fs
+	}
+
+	writeFile := func(t *testing.T, fs *EncryptFS, name string, data []byte) {
+		t.Helper()
+		file, err := fs.Create(name)
+		if err != nil {
+			t.Fatalf("Create failed: %v", err)
+		}
+		file.Write(data)
+		if err := file.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+	}
+
+	wantAuthFailure := func(t *testing.T, err error) {
+		t.Helper()
+		if err == nil {
+			t.Fatal("Expected an error")
+		}
+		if !errors.Is(err, ErrAuthFailed) {
+			t.Errorf("errors.Is(err, ErrAuthFailed) = false for %v", err)
+		}
+		if !IsAuthenticationError(err) {
+			t.Errorf("errors.As(err, *AuthenticationError) = false for %v", err)
+		}
+	}
+
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+
+	t.Run("traditional wrong password", func(t *testing.T) {
+		base, _ := memfs.NewFS()
+		writeFile(t, newFS(t, base, "right", 0), "/file.bin", data)
+
+		_, err := newFS(t, base, "wrong", 0).Open("/file.bin")
+		wantAuthFailure(t, err)
+	})
+
+	t.Run("chunked wrong password", func(t *testing.T) {
+		base, _ := memfs.NewFS()
+		writeFile(t, newFS(t, base, "right", 4096), "/file.bin", data)
+
+		file, err := newFS(t, base, "wrong", 4096).Open("/file.bin")
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		defer file.Close()
+
+		_, err = io.ReadAll(file)
+		wantAuthFailure(t, err)
+		if !IsCorruptionError(err) {
+			t.Errorf("errors.As(err, *CorruptionError) = false for %v", err)
+		}
+	})
+
+	t.Run("streaming wrong password", func(t *testing.T) {
+		base, _ := memfs.NewFS()
+		writeFile(t, newFS(t, base, "right", 0), "/file.bin", data)
+
+		baseFile, err := base.OpenFile("/file.bin", os.O_RDONLY, 0)
+		if err != nil {
+			t.Fatalf("OpenFile failed: %v", err)
+		}
+		sf, err := newStreamingFile(baseFile, newFS(t, base, "wrong", 0), DefaultStreamingConfig(), os.O_RDONLY)
+		if err != nil {
+			t.Fatalf("newStreamingFile failed: %v", err)
+		}
+		defer sf.Close()
+
+		_, err = sf.Read(make([]byte, 16))
+		wantAuthFailure(t, err)
+	})
+
+	t.Run("SIV filename with wrong key", func(t *testing.T) {
+		enc, err := NewDeterministicFilenameEncryptor(bytes.Repeat([]byte{1}, 64), false, "/")
+		if err != nil {
+			t.Fatalf("NewDeterministicFilenameEncryptor failed: %v", err)
+		}
+		dec, err := NewDeterministicFilenameEncryptor(bytes.Repeat([]byte{2}, 64), false, "/")
+		if err != nil {
+			t.Fatalf("NewDeterministicFilenameEncryptor failed: %v", err)
+		}
+
+		name, err := enc.EncryptFilename("secret.txt")
+		if err != nil {
+			t.Fatalf("EncryptFilename failed: %v", err)
+		}
+		_, err = dec.DecryptFilename(name)
+		wantAuthFailure(t, err)
+	})
+
+	t.Run("truncated chunk", func(t *testing.T) {
+		base, _ := memfs.NewFS()
+		fs := newFS(t, base, "right", 4096)
+		writeFile(t, fs, "/file.bin", data)
+
+		info, err := base.Stat("/file.bin")
+		if err != nil {
+			t.Fatalf("Stat failed: %v", err)
+		}
+		if err := base.Truncate("/file.bin", info.Size()-10); err != nil {
+			t.Fatalf("Truncate failed: %v", err)
+		}
+
+		file, err := fs.Open("/file.bin")
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		defer file.Close()
+
+		_, err = io.ReadAll(file)
+		if !IsCorruptionError(err) {
+			t.Errorf("errors.As(err, *CorruptionError) = false for %v", err)
+		}
+		if errors.Is(err, ErrAuthFailed) || IsAuthenticationError(err) {
+			t.Errorf("Truncation reported as an authentication failure: %v", err)
+		}
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		base, _ := memfs.NewFS()
+
+		_, err := newFS(t, base, "right", 0).Open("/missing.bin")
+		if !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("errors.Is(err, os.ErrNotExist) = false for %v", err)
+		}
+		if errors.Is(err, ErrAuthFailed) || IsAuthenticationError(err) {
+			t.Errorf("Missing file reported as an authentication failure: %v", err)
+		}
+	})
+}
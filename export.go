@@ -0,0 +1,136 @@
+package encryptfs
+
+import (
+	"io"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/absfs/absfs"
+)
+
+// ExportAll decrypts the whole filesystem into the directory dstRoot on
+// dst, for disaster recovery or to move data out of encryptfs. Directories
+// and files are recreated under their plaintext names with their modes, and
+// each file is streamed to dst rather than read into memory first. Symbolic
+// links are recreated if both filesystems support them; other special files
+// are skipped.
+//
+// ExportAll stops at the first error and returns the number of regular
+// files written until then.
+func (e *EncryptFS) ExportAll(dst absfs.FileSystem, dstRoot string) (files int, err error) {
+	if err := e.checkOpen("exportall", "/"); err != nil {
+		return 0, err
+	}
+	err = copyTree(e, dst, "/", dstRoot, &files)
+	return files, err
+}
+
+// ImportAll encrypts the tree beneath srcRoot on the plaintext filesystem
+// src into the root of the filesystem, the reverse of ExportAll. Existing
+// files of the same name are replaced.
+//
+// ImportAll stops at the first error and returns the number of regular
+// files written until then.
+func (e *EncryptFS) ImportAll(src absfs.FileSystem, srcRoot string) (files int, err error) {
+	if err := e.checkOpen("importall", "/"); err != nil {
+		return 0, err
+	}
+	err = copyTree(src, e, srcRoot, "/", &files)
+	return files, err
+}
+
+// copyTree copies the directory srcDir on src to dstDir on dst, creating
+// dstDir if needed and counting the regular files copied
+func copyTree(src, dst absfs.FileSystem, srcDir, dstDir string, files *int) error {
+	info, err := src.Stat(srcDir)
+	if err != nil {
+		return err
+	}
+	if err := dst.MkdirAll(dstDir, info.Mode().Perm()); err != nil {
+		return err
+	}
+
+	dir, err := src.Open(srcDir)
+	if err != nil {
+		return err
+	}
+	infos, err := dir.Readdir(-1)
+	dir.Close()
+	if err != nil {
+		return err
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name() < infos[j].Name()
+	})
+
+	for _, child := range infos {
+		if child.Name() == "." || child.Name() == ".." {
+			continue
+		}
+		srcPath := path.Join(srcDir, child.Name())
+		dstPath := path.Join(dstDir, child.Name())
+
+		switch mode := child.Mode(); {
+		case mode.IsDir():
+			// The mode is set last, as MkdirAll is subject to the umask
+			// and a read-only directory could not have been filled. It
+			// keeps ModeDir for filesystems whose Chmod replaces the whole
+			// mode.
+			if err = copyTree(src, dst, srcPath, dstPath, files); err == nil {
+				err = dst.Chmod(dstPath, os.ModeDir|mode.Perm())
+			}
+		case mode&os.ModeSymlink != 0:
+			err = copySymlink(src, dst, srcPath, dstPath)
+		case mode.IsRegular():
+			if err = copyFile(src, dst, srcPath, dstPath, mode.Perm()); err == nil {
+				*files++
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyFile streams the regular file srcPath on src to dstPath on dst,
+// giving it the mode perm
+func copyFile(src, dst absfs.FileSystem, srcPath, dstPath string, perm os.FileMode) error {
+	in, err := src.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := dst.OpenFile(dstPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return dst.Chmod(dstPath, perm)
+}
+
+// copySymlink recreates the symbolic link srcPath on src at dstPath on dst
+func copySymlink(src, dst absfs.FileSystem, srcPath, dstPath string) error {
+	srcLinker, ok := src.(absfs.SymLinker)
+	if !ok {
+		return &os.PathError{Op: "readlink", Path: srcPath, Err: ErrNotSupported}
+	}
+	dstLinker, ok := dst.(absfs.SymLinker)
+	if !ok {
+		return &os.LinkError{Op: "symlink", Old: srcPath, New: dstPath, Err: ErrNotSupported}
+	}
+
+	target, err := srcLinker.Readlink(srcPath)
+	if err != nil {
+		return err
+	}
+	return dstLinker.Symlink(target, dstPath)
+}
@@ -0,0 +1,138 @@
+package encryptfs
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/memfs"
+)
+
+func TestExportImportAll(t *testing.T) {
+	tree := map[string][]byte{
+		"/readme.txt":           []byte("top level"),
+		"/docs/guide.md":        bytes.Repeat([]byte("guide "), 1000),
+		"/docs/empty.txt":       {},
+		"/docs/nested/deep.bin": {0, 1, 2, 3},
+		"/private/secrets.txt":  []byte("mode 0600"),
+	}
+	modes := map[string]os.FileMode{
+		"/private/secrets.txt": 0600,
+		"/private":             0700,
+	}
+
+	for _, tc := range []struct {
+		name   string
+		config Config
+	}{
+		{"Deterministic", Config{FilenameEncryption: FilenameEncryptionDeterministic}},
+		{"Flat", Config{FilenameEncryption: FilenameEncryptionRandom, FlattenDirectories: true, MetadataPath: "/.metadata.json"}},
+		{"Chunked", Config{ChunkSize: 4 * 1024}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			base, cleanup := setupTestFS(t)
+			defer cleanup()
+
+			config := tc.config
+			config.Cipher = CipherAES256GCM
+			config.KeyProvider = NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+				Memory:      64 * 1024,
+				Iterations:  1,
+				Parallelism: 2,
+			})
+			fs, err := New(base, &config)
+			if err != nil {
+				t.Fatalf("failed to create EncryptFS: %v", err)
+			}
+			defer fs.Close()
+
+			for name, data := range tree {
+				if err := fs.MkdirAll(path.Dir(name), 0755); err != nil {
+					t.Fatalf("failed to create %s: %v", path.Dir(name), err)
+				}
+				file, err := fs.Create(name)
+				if err != nil {
+					t.Fatalf("failed to create %s: %v", name, err)
+				}
+				file.Write(data)
+				file.Close()
+			}
+			for name, mode := range modes {
+				if err := fs.Chmod(name, mode); err != nil {
+					t.Fatalf("failed to chmod %s: %v", name, err)
+				}
+			}
+
+			plain, err := memfs.NewFS()
+			if err != nil {
+				t.Fatalf("failed to create memfs: %v", err)
+			}
+			files, err := fs.ExportAll(plain, "/restore")
+			if err != nil {
+				t.Fatalf("ExportAll failed: %v", err)
+			}
+			if files != len(tree) {
+				t.Errorf("ExportAll wrote %d files, want %d", files, len(tree))
+			}
+			compareTree(t, plain, "/restore", tree)
+			if info, err := plain.Stat("/restore/private/secrets.txt"); err != nil {
+				t.Errorf("failed to stat exported file: %v", err)
+			} else if info.Mode().Perm() != 0600 {
+				t.Errorf("exported mode = %v, want 0600", info.Mode().Perm())
+			}
+
+			// Importing the export into a new store gives back the same tree
+			importBase, importCleanup := setupTestFS(t)
+			defer importCleanup()
+			imported, err := New(importBase, &config)
+			if err != nil {
+				t.Fatalf("failed to create EncryptFS: %v", err)
+			}
+			defer imported.Close()
+
+			files, err = imported.ImportAll(plain, "/restore")
+			if err != nil {
+				t.Fatalf("ImportAll failed: %v", err)
+			}
+			if files != len(tree) {
+				t.Errorf("ImportAll wrote %d files, want %d", files, len(tree))
+			}
+			compareTree(t, imported, "/", tree)
+			if info, err := imported.Stat("/private"); err != nil {
+				t.Errorf("failed to stat imported directory: %v", err)
+			} else if info.Mode().Perm() != 0700 {
+				t.Errorf("imported directory mode = %v, want 0700", info.Mode().Perm())
+			}
+			if info, err := imported.Stat("/private/secrets.txt"); err != nil {
+				t.Errorf("failed to stat imported file: %v", err)
+			} else if info.Mode().Perm() != 0600 {
+				t.Errorf("imported mode = %v, want 0600", info.Mode().Perm())
+			}
+		})
+	}
+}
+
+// compareTree checks that the files beneath root on fs hold the contents
+// given by tree, keyed by path relative to root
+func compareTree(t *testing.T, fs absfs.FileSystem, root string, tree map[string][]byte) {
+	t.Helper()
+	for name, want := range tree {
+		file, err := fs.Open(path.Join(root, name))
+		if err != nil {
+			t.Errorf("failed to open %s: %v", name, err)
+			continue
+		}
+		got, err := io.ReadAll(file)
+		file.Close()
+		if err != nil {
+			t.Errorf("failed to read %s: %v", name, err)
+			continue
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: got %d bytes, want %d", name, len(got), len(want))
+		}
+	}
+}
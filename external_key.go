@@ -0,0 +1,128 @@
+package encryptfs
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// ExternalKeyProvider gives every new file a random content key instead of
+// deriving one, and hands it to the caller, who wraps and stores it, or
+// passes it to a recipient, out of band: envelope encryption with the
+// envelope kept outside the filesystem. Files are read with the key the
+// caller supplies back.
+//
+// Each file is named by its file ID, a random value stored in place of the
+// salt in its header, which EncryptFS.FileID reads. Only a file whose key is
+// supplied can be read. With filename encryption or SharedSalt, the
+// filesystem's master key is created the same way, and Config.StoreConfig
+// or the keyfile records its ID so the next session can look it up.
+type ExternalKeyProvider struct {
+	onKey     func(fileID, key []byte) error
+	lookupKey func(fileID []byte) ([]byte, error)
+
+	mu      sync.Mutex
+	pending map[string]*SecretKey // Keys of new files, until they are first used
+}
+
+// NewExternalKeyProvider creates a provider that calls onKey with the ID
+// and the key of each new file, and lookupKey for the key of an existing
+// file. A file is not created if onKey fails. Either function may be nil:
+// without onKey no file can be written, and without lookupKey only files
+// written through this provider can be read.
+func NewExternalKeyProvider(onKey func(fileID, key []byte) error, lookupKey func(fileID []byte) ([]byte, error)) *ExternalKeyProvider {
+	return &ExternalKeyProvider{
+		onKey:     onKey,
+		lookupKey: lookupKey,
+		pending:   make(map[string]*SecretKey),
+	}
+}
+
+// GenerateSalt generates the ID and the key of a new file
+func (p *ExternalKeyProvider) GenerateSalt() ([]byte, error) {
+	return p.generateSaltFrom(rand.Reader)
+}
+
+func (p *ExternalKeyProvider) generateSaltFrom(random io.Reader) ([]byte, error) {
+	if p.onKey == nil {
+		return nil, ErrNoFileKey
+	}
+
+	id, err := readSalt(random, fileIDSize)
+	if err != nil {
+		return nil, err
+	}
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(random, key); err != nil {
+		return nil, fmt.Errorf("failed to generate file key: %w", err)
+	}
+
+	p.mu.Lock()
+	p.pending[string(id)] = NewSecretKey(key)
+	p.mu.Unlock()
+	return id, nil
+}
+
+// discardSalt drops the pending key of a new file that was not created
+func (p *ExternalKeyProvider) discardSalt(fileID []byte) {
+	p.mu.Lock()
+	key, ok := p.pending[string(fileID)]
+	delete(p.pending, string(fileID))
+	p.mu.Unlock()
+
+	if ok {
+		key.Destroy()
+	}
+}
+
+// DeriveKey returns the key of the file with the given ID. The key of a new
+// file is first handed to onKey; any other is asked of lookupKey.
+func (p *ExternalKeyProvider) DeriveKey(fileID []byte) (*SecretKey, error) {
+	p.mu.Lock()
+	key, ok := p.pending[string(fileID)]
+	delete(p.pending, string(fileID))
+	p.mu.Unlock()
+
+	if ok {
+		if err := p.onKey(append([]byte(nil), fileID...), append([]byte(nil), key.Bytes()...)); err != nil {
+			key.Destroy()
+			return nil, fmt.Errorf("failed to hand out file key: %w", err)
+		}
+		return key, nil
+	}
+
+	if p.lookupKey == nil {
+		return nil, ErrNoFileKey
+	}
+	supplied, err := p.lookupKey(append([]byte(nil), fileID...))
+	if err != nil {
+		return nil, err
+	}
+	if supplied == nil {
+		return nil, ErrNoFileKey
+	}
+	if len(supplied) != 32 {
+		return nil, &ValidationError{
+			Field:   "key",
+			Value:   len(supplied),
+			Message: fmt.Sprintf("file key must be 32 bytes, got %d", len(supplied)),
+		}
+	}
+	return NewSecretKey(append([]byte(nil), supplied...)), nil
+}
+
+// FileID returns the ID recorded in the header of the named file: for files
+// written with an ExternalKeyProvider, the ID its callbacks receive. It is
+// read without decrypting anything.
+func (e *EncryptFS) FileID(name string) ([]byte, error) {
+	if err := e.checkOp("fileid", name); err != nil {
+		return nil, err
+	}
+
+	_, header, _, err := e.readFileHeader(name)
+	if header == nil {
+		return nil, err
+	}
+	return append([]byte(nil), header.Salt...), nil
+}
@@ -0,0 +1,150 @@
+package encryptfs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+)
+
+func TestExternalKeyProvider(t *testing.T) {
+	base, cleanup := setupTestFS(t)
+	defer cleanup()
+
+	// Capture the ephemeral key of every file written
+	var mu sync.Mutex
+	keys := make(map[string][]byte)
+	provider := NewExternalKeyProvider(func(fileID, key []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+		keys[string(fileID)] = key
+		return nil
+	}, nil)
+
+	tree := map[string][]byte{
+		"/small.txt": []byte("ephemeral"),
+		"/big.bin":   bytes.Repeat([]byte("envelope "), 3000),
+	}
+	for _, chunkSize := range []int{0, 4 * 1024} {
+		fs, err := New(base, &Config{Cipher: CipherAES256GCM, KeyProvider: provider, ChunkSize: chunkSize})
+		if err != nil {
+			t.Fatalf("failed to create EncryptFS: %v", err)
+		}
+		name := "/small.txt"
+		if chunkSize > 0 {
+			name = "/big.bin"
+		}
+		if err := fs.WriteFiles(map[string][]byte{name: tree[name]}); err != nil {
+			t.Fatalf("WriteFiles failed: %v", err)
+		}
+		fs.Close()
+	}
+	if len(keys) != 2 {
+		t.Fatalf("captured %d keys, want 2", len(keys))
+	}
+
+	// A fresh filesystem reads each file with only its own key
+	for name, data := range tree {
+		var fileKey []byte
+		lookups := 0
+		reader := NewExternalKeyProvider(nil, func(fileID []byte) ([]byte, error) {
+			lookups++
+			return fileKey, nil
+		})
+		fs, err := New(base, &Config{Cipher: CipherAES256GCM, KeyProvider: reader})
+		if err != nil {
+			t.Fatalf("failed to create EncryptFS: %v", err)
+		}
+		id, err := fs.FileID(name)
+		if err != nil {
+			t.Fatalf("FileID(%s) failed: %v", name, err)
+		}
+		fileKey = keys[string(id)]
+		if fileKey == nil {
+			t.Fatalf("no key captured for %s", name)
+		}
+
+		file, err := fs.Open(name)
+		if err != nil {
+			t.Fatalf("failed to open %s: %v", name, err)
+		}
+		got, err := io.ReadAll(file)
+		file.Close()
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("read %s = %d bytes, %v; want the written content", name, len(got), err)
+		}
+		if lookups != 1 {
+			t.Errorf("key looked up %d times, want 1", lookups)
+		}
+
+		// Without a way to hand out keys, no file can be written
+		if _, err := fs.Create("/new.txt"); !errors.Is(err, ErrNoFileKey) {
+			t.Errorf("Create without onKey: got %v, want ErrNoFileKey", err)
+		}
+		fs.Close()
+	}
+
+	// The wrong key, or none, does not open a file
+	wrong := NewExternalKeyProvider(nil, func(fileID []byte) ([]byte, error) {
+		return bytes.Repeat([]byte{1}, 32), nil
+	})
+	fs, err := New(base, &Config{Cipher: CipherAES256GCM, KeyProvider: wrong})
+	if err != nil {
+		t.Fatalf("failed to create EncryptFS: %v", err)
+	}
+	defer fs.Close()
+	if file, err := fs.Open("/small.txt"); err == nil {
+		file.Close()
+		t.Error("opened a file with the wrong key")
+	} else if !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("wrong key: got %v, want ErrAuthFailed", err)
+	}
+
+	none, err := New(base, &Config{Cipher: CipherAES256GCM, KeyProvider: NewExternalKeyProvider(nil, nil)})
+	if err != nil {
+		t.Fatalf("failed to create EncryptFS: %v", err)
+	}
+	defer none.Close()
+	if _, err := none.Open("/small.txt"); !errors.Is(err, ErrNoFileKey) {
+		t.Errorf("no key: got %v, want ErrNoFileKey", err)
+	}
+
+	// A failing callback stops the file from being created
+	refuse := NewExternalKeyProvider(func(fileID, key []byte) error {
+		return errors.New("key escrow unavailable")
+	}, nil)
+	fs, err = New(base, &Config{Cipher: CipherAES256GCM, KeyProvider: refuse})
+	if err != nil {
+		t.Fatalf("failed to create EncryptFS: %v", err)
+	}
+	defer fs.Close()
+	if _, err := fs.Create("/refused.txt"); err == nil {
+		t.Error("Create succeeded although the key could not be handed out")
+	}
+	if len(refuse.pending) != 0 {
+		t.Errorf("%d keys left pending after the callback failed", len(refuse.pending))
+	}
+
+	// A file that fails to be created after its key was generated leaves no
+	// key behind: the random source runs dry at the header nonce
+	for _, chunkSize := range []int{0, 4 * 1024} {
+		failing := NewExternalKeyProvider(func(fileID, key []byte) error { return nil }, nil)
+		fs, err := New(base, &Config{
+			Cipher:      CipherAES256GCM,
+			KeyProvider: failing,
+			ChunkSize:   chunkSize,
+			RandSource:  io.LimitReader(bytes.NewReader(make([]byte, 1024)), fileIDSize+32),
+		})
+		if err != nil {
+			t.Fatalf("failed to create EncryptFS: %v", err)
+		}
+		if _, err := fs.Create("/dry.txt"); err == nil {
+			t.Errorf("chunk size %d: Create succeeded without randomness for its nonce", chunkSize)
+		}
+		if len(failing.pending) != 0 {
+			t.Errorf("chunk size %d: %d keys left pending after Create failed", chunkSize, len(failing.pending))
+		}
+		fs.Close()
+	}
+}
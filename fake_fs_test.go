@@ -0,0 +1,718 @@
+package encryptfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/absfs/absfs"
+)
+
+// fakeFS is an in-memory absfs.FileSystem for tests that need control over
+// the base filesystem: failures injected into chosen operations, slow reads,
+// case-insensitive names and any separator. Unlike memfs, a write is visible
+// to every open handle at once, as on a real disk.
+type fakeFS struct {
+	separator       uint8
+	caseInsensitive bool
+	readDelay       time.Duration // Added to every Read and ReadAt
+
+	mu     sync.Mutex
+	nodes  map[string]*fakeNode // Keyed by fakeFS.key
+	cwd    string
+	faults []*fakeFault
+}
+
+// fakeNode is a file or directory in a fakeFS
+type fakeNode struct {
+	name    string // Path as created, in its original case
+	dir     bool
+	mode    os.FileMode
+	modTime time.Time
+	data    []byte
+}
+
+// fakeFault fails count calls of any of ops once skip calls have succeeded
+type fakeFault struct {
+	ops   []string
+	skip  int
+	count int
+	err   error
+}
+
+// newFakeFS returns an empty case-sensitive fakeFS using "/" as separator.
+// Set separator and caseInsensitive before the filesystem is used.
+func newFakeFS() *fakeFS {
+	return &fakeFS{
+		separator: '/',
+		nodes:     map[string]*fakeNode{"/": {name: "/", dir: true, mode: os.ModeDir | 0755}},
+		cwd:       "/",
+	}
+}
+
+// fail makes count calls of any of ops fail with err, after skip calls have
+// succeeded. The ops are "open", "read", "write", "seek", "sync", "stat",
+// "truncate", "mkdir", "remove" and "rename"; reads and writes at an offset
+// count as "read" and "write".
+func (f *fakeFS) fail(err error, skip, count int, ops ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults = append(f.faults, &fakeFault{ops: ops, skip: skip, count: count, err: err})
+}
+
+// pendingFailures returns the number of injected failures not yet triggered
+func (f *fakeFS) pendingFailures() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, fault := range f.faults {
+		n += fault.count
+	}
+	return n
+}
+
+// fault returns the injected error for a call of op, if any. f.mu is held.
+func (f *fakeFS) fault(op string) error {
+	for _, fault := range f.faults {
+		if fault.count == 0 || !containsString(fault.ops, op) {
+			continue
+		}
+		if fault.skip > 0 {
+			fault.skip--
+			continue
+		}
+		fault.count--
+		return fault.err
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// clean converts name to a cleaned, absolute, slash-separated path
+func (f *fakeFS) clean(name string) string {
+	name = strings.ReplaceAll(name, string(f.separator), "/")
+	if !strings.HasPrefix(name, "/") {
+		name = f.cwd + "/" + name
+	}
+	return path.Clean(name)
+}
+
+// key returns the map key of a cleaned path
+func (f *fakeFS) key(p string) string {
+	if f.caseInsensitive {
+		return strings.ToLower(p)
+	}
+	return p
+}
+
+// lookup returns the node at a cleaned path. f.mu is held.
+func (f *fakeFS) lookup(p string) (*fakeNode, bool) {
+	n, ok := f.nodes[f.key(p)]
+	return n, ok
+}
+
+// checkParent returns an error unless the parent of a cleaned path is an
+// existing directory. f.mu is held.
+func (f *fakeFS) checkParent(op, name, p string) error {
+	parent, ok := f.lookup(path.Dir(p))
+	if !ok {
+		return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	}
+	if !parent.dir {
+		return &os.PathError{Op: op, Path: name, Err: syscall.ENOTDIR}
+	}
+	return nil
+}
+
+// children returns the keys of every node beneath a cleaned path. f.mu is
+// held.
+func (f *fakeFS) children(p string) []string {
+	prefix := f.key(p) + "/"
+	if p == "/" {
+		prefix = "/"
+	}
+	var keys []string
+	for k := range f.nodes {
+		if k != "/" && strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+func (f *fakeFS) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.fault("open"); err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	p := f.clean(name)
+	n, ok := f.lookup(p)
+	switch {
+	case ok && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	case ok && n.dir && flag&(os.O_WRONLY|os.O_RDWR) != 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+	case ok:
+		if flag&os.O_TRUNC != 0 {
+			n.data = nil
+			n.modTime = time.Now()
+		}
+	case flag&os.O_CREATE == 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	default:
+		if err := f.checkParent("open", name, p); err != nil {
+			return nil, err
+		}
+		n = &fakeNode{name: p, mode: perm & os.ModePerm, modTime: time.Now()}
+		f.nodes[f.key(p)] = n
+	}
+	return &fakeFile{fs: f, node: n, name: name, flag: flag}, nil
+}
+
+func (f *fakeFS) Open(name string) (absfs.File, error) {
+	return f.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (f *fakeFS) Create(name string) (absfs.File, error) {
+	return f.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (f *fakeFS) Mkdir(name string, perm os.FileMode) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.fault("mkdir"); err != nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+	p := f.clean(name)
+	if _, ok := f.lookup(p); ok {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+	if err := f.checkParent("mkdir", name, p); err != nil {
+		return err
+	}
+	f.nodes[f.key(p)] = &fakeNode{name: p, dir: true, mode: os.ModeDir | perm&os.ModePerm, modTime: time.Now()}
+	return nil
+}
+
+func (f *fakeFS) MkdirAll(name string, perm os.FileMode) error {
+	p := f.clean(name)
+	if p == "/" {
+		return nil
+	}
+	if err := f.MkdirAll(path.Dir(p), perm); err != nil {
+		return err
+	}
+	err := f.Mkdir(p, perm)
+	if errors.Is(err, os.ErrExist) {
+		if info, serr := f.Stat(p); serr == nil && info.IsDir() {
+			return nil
+		}
+	}
+	return err
+}
+
+func (f *fakeFS) Remove(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.fault("remove"); err != nil {
+		return &os.PathError{Op: "remove", Path: name, Err: err}
+	}
+	p := f.clean(name)
+	if _, ok := f.lookup(p); !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	if len(f.children(p)) > 0 {
+		return &os.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+	}
+	delete(f.nodes, f.key(p))
+	return nil
+}
+
+func (f *fakeFS) RemoveAll(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.fault("remove"); err != nil {
+		return &os.PathError{Op: "removeall", Path: name, Err: err}
+	}
+	p := f.clean(name)
+	for _, k := range f.children(p) {
+		delete(f.nodes, k)
+	}
+	if p != "/" {
+		delete(f.nodes, f.key(p))
+	}
+	return nil
+}
+
+func (f *fakeFS) Rename(oldpath, newpath string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	linkErr := func(err error) error {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: err}
+	}
+	if err := f.fault("rename"); err != nil {
+		return linkErr(err)
+	}
+
+	o, n := f.clean(oldpath), f.clean(newpath)
+	node, ok := f.lookup(o)
+	if !ok {
+		return linkErr(os.ErrNotExist)
+	}
+	if f.key(o) == f.key(n) {
+		node.name = n
+		return nil
+	}
+	if err := f.checkParent("rename", newpath, n); err != nil {
+		return linkErr(os.ErrNotExist)
+	}
+	if node.dir && strings.HasPrefix(f.key(n), f.key(o)+"/") {
+		return linkErr(syscall.EINVAL)
+	}
+	if existing, ok := f.lookup(n); ok {
+		switch {
+		case existing.dir && !node.dir:
+			return linkErr(syscall.EISDIR)
+		case !existing.dir && node.dir:
+			return linkErr(syscall.ENOTDIR)
+		case existing.dir && len(f.children(n)) > 0:
+			return linkErr(syscall.ENOTEMPTY)
+		}
+	}
+
+	if node.dir {
+		for _, k := range f.children(o) {
+			child := f.nodes[k]
+			delete(f.nodes, k)
+			child.name = n + child.name[len(o):]
+			f.nodes[f.key(child.name)] = child
+		}
+	}
+	delete(f.nodes, f.key(o))
+	node.name = n
+	f.nodes[f.key(n)] = node
+	return nil
+}
+
+func (f *fakeFS) Stat(name string) (os.FileInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.fault("stat"); err != nil {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: err}
+	}
+	n, ok := f.lookup(f.clean(name))
+	if !ok {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return n.info(), nil
+}
+
+func (f *fakeFS) Chmod(name string, mode os.FileMode) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n, ok := f.lookup(f.clean(name))
+	if !ok {
+		return &os.PathError{Op: "chmod", Path: name, Err: os.ErrNotExist}
+	}
+	n.mode = n.mode&os.ModeType | mode&os.ModePerm
+	return nil
+}
+
+func (f *fakeFS) Chtimes(name string, atime, mtime time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n, ok := f.lookup(f.clean(name))
+	if !ok {
+		return &os.PathError{Op: "chtimes", Path: name, Err: os.ErrNotExist}
+	}
+	n.modTime = mtime
+	return nil
+}
+
+func (f *fakeFS) Chown(name string, uid, gid int) error {
+	if _, err := f.Stat(name); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (f *fakeFS) Truncate(name string, size int64) error {
+	file, err := f.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Truncate(size)
+}
+
+func (f *fakeFS) Separator() uint8 {
+	return f.separator
+}
+
+func (f *fakeFS) ListSeparator() uint8 {
+	return ':'
+}
+
+func (f *fakeFS) Chdir(dir string) error {
+	info, err := f.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return &os.PathError{Op: "chdir", Path: dir, Err: syscall.ENOTDIR}
+	}
+	f.mu.Lock()
+	f.cwd = f.clean(dir)
+	f.mu.Unlock()
+	return nil
+}
+
+func (f *fakeFS) Getwd() (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return strings.ReplaceAll(f.cwd, "/", string(f.separator)), nil
+}
+
+func (f *fakeFS) TempDir() string {
+	return string(f.separator) + "tmp"
+}
+
+// info returns file info for the node. The caller holds the fakeFS lock.
+func (n *fakeNode) info() os.FileInfo {
+	return &fakeFileInfo{
+		name:    path.Base(n.name),
+		size:    int64(len(n.data)),
+		mode:    n.mode,
+		modTime: n.modTime,
+	}
+}
+
+type fakeFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (i *fakeFileInfo) Name() string       { return i.name }
+func (i *fakeFileInfo) Size() int64        { return i.size }
+func (i *fakeFileInfo) Mode() os.FileMode  { return i.mode }
+func (i *fakeFileInfo) ModTime() time.Time { return i.modTime }
+func (i *fakeFileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i *fakeFileInfo) Sys() interface{}   { return nil }
+
+// fakeFile is an open handle on a fakeNode
+type fakeFile struct {
+	fs     *fakeFS
+	node   *fakeNode
+	name   string
+	flag   int
+	offset int64
+	closed bool
+	dirPos int // Entries already returned by Readdir
+}
+
+// check returns an error if the handle is closed or, when write is set,
+// was not opened for writing. The fakeFS lock is held.
+func (f *fakeFile) check(op string, write bool) error {
+	if f.closed {
+		return &os.PathError{Op: op, Path: f.name, Err: os.ErrClosed}
+	}
+	if write && f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return &os.PathError{Op: op, Path: f.name, Err: syscall.EBADF}
+	}
+	if !write && f.flag&os.O_WRONLY != 0 {
+		return &os.PathError{Op: op, Path: f.name, Err: syscall.EBADF}
+	}
+	return f.fs.fault(op)
+}
+
+func (f *fakeFile) Name() string {
+	return f.name
+}
+
+func (f *fakeFile) Read(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	off := f.offset
+	f.fs.mu.Unlock()
+
+	n, err := f.ReadAt(p, off)
+	f.fs.mu.Lock()
+	f.offset = off + int64(n)
+	f.fs.mu.Unlock()
+	return n, err
+}
+
+func (f *fakeFile) ReadAt(p []byte, off int64) (int, error) {
+	time.Sleep(f.fs.readDelay)
+
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	if f.node.dir {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: syscall.EISDIR}
+	}
+	if off < 0 {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: syscall.EINVAL}
+	}
+	if off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *fakeFile) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	if f.flag&os.O_APPEND != 0 {
+		f.offset = int64(len(f.node.data))
+	}
+	off := f.offset
+	f.fs.mu.Unlock()
+
+	n, err := f.WriteAt(p, off)
+	f.fs.mu.Lock()
+	f.offset = off + int64(n)
+	f.fs.mu.Unlock()
+	return n, err
+}
+
+func (f *fakeFile) WriteAt(p []byte, off int64) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: syscall.EINVAL}
+	}
+	if end := off + int64(len(p)); end > int64(len(f.node.data)) {
+		grown := make([]byte, end)
+		copy(grown, f.node.data)
+		f.node.data = grown
+	}
+	copy(f.node.data[off:], p)
+	f.node.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *fakeFile) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+func (f *fakeFile) Seek(offset int64, whence int) (int64, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.closed {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: os.ErrClosed}
+	}
+	if err := f.fs.fault("seek"); err != nil {
+		return 0, err
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(len(f.node.data))
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: syscall.EINVAL}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *fakeFile) Truncate(size int64) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.check("truncate", true); err != nil {
+		return err
+	}
+	if size < 0 {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: syscall.EINVAL}
+	}
+	if size <= int64(len(f.node.data)) {
+		f.node.data = f.node.data[:size:size]
+	} else {
+		grown := make([]byte, size)
+		copy(grown, f.node.data)
+		f.node.data = grown
+	}
+	f.node.modTime = time.Now()
+	return nil
+}
+
+func (f *fakeFile) Sync() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.closed {
+		return &os.PathError{Op: "sync", Path: f.name, Err: os.ErrClosed}
+	}
+	return f.fs.fault("sync")
+}
+
+func (f *fakeFile) Stat() (os.FileInfo, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.closed {
+		return nil, &os.PathError{Op: "stat", Path: f.name, Err: os.ErrClosed}
+	}
+	return f.node.info(), nil
+}
+
+func (f *fakeFile) Readdir(count int) ([]os.FileInfo, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if !f.node.dir {
+		return nil, &os.PathError{Op: "readdir", Path: f.name, Err: syscall.ENOTDIR}
+	}
+
+	var infos []os.FileInfo
+	depth := strings.Count(f.node.name, "/") + 1
+	if f.node.name == "/" {
+		depth = 1
+	}
+	for _, k := range f.fs.children(f.node.name) {
+		child := f.fs.nodes[k]
+		if strings.Count(child.name, "/") == depth {
+			infos = append(infos, child.info())
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+
+	if f.dirPos > len(infos) {
+		f.dirPos = len(infos)
+	}
+	infos = infos[f.dirPos:]
+	if count > 0 {
+		if len(infos) == 0 {
+			return nil, io.EOF
+		}
+		if len(infos) > count {
+			infos = infos[:count]
+		}
+	}
+	f.dirPos += len(infos)
+	return infos, nil
+}
+
+func (f *fakeFile) Readdirnames(count int) ([]string, error) {
+	infos, err := f.Readdir(count)
+	names := make([]string, len(infos))
+	for i, info := range infos {
+		names[i] = info.Name()
+	}
+	return names, err
+}
+
+func (f *fakeFile) Close() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.closed {
+		return &os.PathError{Op: "close", Path: f.name, Err: os.ErrClosed}
+	}
+	f.closed = true
+	return nil
+}
+
+func TestFakeFS(t *testing.T) {
+	fs := newFakeFS()
+	fs.separator = '\\'
+	fs.caseInsensitive = true
+
+	if err := fs.MkdirAll(`\Docs\Reports`, 0755); err != nil {
+		t.Fatalf("MkdirAll failed: %v", err)
+	}
+	w, err := fs.Create(`\Docs\Reports\Q1.txt`)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	r, err := fs.Open(`\docs\reports\q1.TXT`)
+	if err != nil {
+		t.Fatalf("case-insensitive Open failed: %v", err)
+	}
+
+	// Writes are visible to other handles without a Sync
+	w.Write([]byte("quarterly"))
+	got, err := io.ReadAll(r)
+	if err != nil || string(got) != "quarterly" {
+		t.Errorf("ReadAll = %q, %v, want %q", got, err, "quarterly")
+	}
+	r.Close()
+	w.Close()
+
+	dir, err := fs.Open(`\DOCS`)
+	if err != nil {
+		t.Fatalf("Open of a directory failed: %v", err)
+	}
+	names, _ := dir.Readdirnames(-1)
+	dir.Close()
+	if strings.Join(names, ",") != "Reports" {
+		t.Errorf("Readdirnames = %v, want [Reports]", names)
+	}
+
+	if err := fs.Rename(`\docs`, `\Archive`); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	if _, err := fs.Stat(`\archive\reports\q1.txt`); err != nil {
+		t.Errorf("Stat after directory rename failed: %v", err)
+	}
+	if err := fs.Rename(`\Archive`, `\Archive\Reports\Inner`); err == nil {
+		t.Error("Rename of a directory into itself should fail")
+	}
+
+	// The second write from now fails, once
+	errInjected := errors.New("injected")
+	fs.fail(errInjected, 1, 1, "write")
+	f, err := fs.Create(`\faults.bin`)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	defer f.Close()
+	for i, want := range []error{nil, errInjected, nil} {
+		if _, err := f.Write([]byte{byte(i)}); !errors.Is(err, want) {
+			t.Errorf("write %d: got %v, want %v", i, err, want)
+		}
+	}
+	if n := fs.pendingFailures(); n != 0 {
+		t.Errorf("pendingFailures = %d, want 0", n)
+	}
+}
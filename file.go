@@ -1,13 +1,37 @@
 package encryptfs
 
 import (
+	"crypto/sha256"
 	"fmt"
 	"io"
+	"math"
 	"os"
+	"syscall"
 
 	"github.com/absfs/absfs"
 )
 
+var _ absfs.File = (*encryptedFile)(nil)
+
+// maxInMemorySize is the largest file held in memory in traditional mode: a
+// byte slice holds at most math.MaxInt bytes, which on 32-bit platforms is
+// just under 2 GiB. Chunked files are read a chunk at a time and have no
+// such limit.
+var maxInMemorySize int64 = math.MaxInt
+
+// checkInMemorySize rejects a traditional file of size bytes that a byte
+// slice on this platform cannot hold
+func checkInMemorySize(size int64) error {
+	if size > maxInMemorySize || size < 0 {
+		return &ValidationError{
+			Field:   "size",
+			Value:   size,
+			Message: fmt.Sprintf("file too large for traditional mode on this platform: %d bytes exceeds %d; use chunked mode for large files", size, maxInMemorySize),
+		}
+	}
+	return nil
+}
+
 // encryptedFile wraps a base file and provides transparent encryption/decryption
 type encryptedFile struct {
 	base      absfs.File
@@ -18,14 +42,26 @@ type encryptedFile struct {
 	plaintext []byte // Cached decrypted content for read operations
 	dirty     bool   // True if plaintext has been modified
 	offset    int64  // Current read/write offset in plaintext
+	unlock    func() // Releases the Config.FileLocking lock, if set
+	streamKey []byte // File key of a FlagStream file, which seals each body under a fresh payload key
+	aad       []byte // Additional data the body is bound to, or nil
 }
 
 // newEncryptedFile creates a new encrypted file wrapper
 func newEncryptedFile(base absfs.File, fs *EncryptFS, flags int) (*encryptedFile, error) {
+	return newBoundFile(base, fs, flags, nil)
+}
+
+// newBoundFile creates an encrypted file wrapper whose body is bound to
+// additional data kept outside the file, such as the path of the file an
+// attribute sidecar belongs to. Bound files are never STREAM-framed, as
+// STREAM records carry no additional data.
+func newBoundFile(base absfs.File, fs *EncryptFS, flags int, aad []byte) (*encryptedFile, error) {
 	ef := &encryptedFile{
 		base:  base,
 		fs:    fs,
 		flags: flags,
+		aad:   aad,
 	}
 
 	// Check if file is being opened for reading or if it already exists
@@ -33,9 +69,22 @@ func newEncryptedFile(base absfs.File, fs *EncryptFS, flags int) (*encryptedFile
 	if err != nil {
 		return nil, err
 	}
+	size := baseFileSize(info, flags)
+
+	// Refuse to load files that would exceed the in-memory limit
+	if limit := fs.config.MaxInMemoryFileSize; limit > 0 && size > limit {
+		return nil, &ValidationError{
+			Field:   "MaxInMemoryFileSize",
+			Value:   size,
+			Message: fmt.Sprintf("file size %d exceeds in-memory limit of %d bytes; use chunked mode for large files", size, limit),
+		}
+	}
+	if err := checkInMemorySize(size); err != nil {
+		return nil, err
+	}
 
 	// If file exists and has content, try to read the header and decrypt
-	if info.Size() > 0 {
+	if size > 0 {
 		if err := ef.loadFile(); err != nil {
 			return nil, fmt.Errorf("failed to load encrypted file: %w", err)
 		}
@@ -52,28 +101,48 @@ func newEncryptedFile(base absfs.File, fs *EncryptFS, flags int) (*encryptedFile
 // initNewFile initializes a new encrypted file
 func (f *encryptedFile) initNewFile() error {
 	// Generate salt
-	salt, err := f.fs.keyProvider.GenerateSalt()
+	salt, err := f.fs.generateSalt()
 	if err != nil {
 		return fmt.Errorf("failed to generate salt: %w", err)
 	}
 
 	// Generate nonce
-	nonce, err := GenerateNonce(f.fs.cipher)
+	nonce, err := f.fs.generateNonce(f.fs.cipher)
 	if err != nil {
+		f.fs.discardSalt(salt)
 		return fmt.Errorf("failed to generate nonce: %w", err)
 	}
 
 	// Create header
 	f.header = NewFileHeader(f.fs.cipher, salt, nonce)
+	f.header.KDF = kdfParamsFor(f.fs.keyProvider)
+	f.header.Flags = f.fs.newFileFlags()
+	f.header.setKeyID(keyIDFor(f.fs.keyProvider))
+	if f.fs.config.StreamFormat == StreamFormatSTREAM && f.aad == nil {
+		f.header.Flags |= FlagStream
+	}
 
 	// Derive key
-	key, err := f.fs.keyProvider.DeriveKey(salt)
+	key, err := f.fs.deriveKey(salt)
 	if err != nil {
 		return fmt.Errorf("failed to derive key: %w", err)
 	}
+	f.fs.keys.put(f.fs.keyProvider, salt, f.header.KDF, key)
+	if err := f.fs.wrapRecoveryKey(f.header, key); err != nil {
+		return err
+	}
+	if err := f.fs.describeFormat(f.header, key); err != nil {
+		return err
+	}
+	if err := f.header.setDigestKey(key); err != nil {
+		return err
+	}
+	if f.header.Flags&FlagStream != 0 {
+		f.streamKey = key
+	}
 
 	// Create cipher engine
-	f.engine, err = NewCipherEngine(f.fs.cipher, key)
+	f.engine, err = f.fs.newCipherEngine(f.fs.cipher, key)
 	if err != nil {
 		return fmt.Errorf("failed to create cipher engine: %w", err)
 	}
@@ -87,15 +156,27 @@ func (f *encryptedFile) initNewFile() error {
 
 // loadFile loads and decrypts an existing file
 func (f *encryptedFile) loadFile() error {
-	// Seek to beginning
-	if _, err := f.base.Seek(0, io.SeekStart); err != nil {
-		return fmt.Errorf("failed to seek to start: %w", err)
-	}
+	// Read header and ciphertext (before key derivation to avoid multiple reads)
+	var ciphertext []byte
+	err := f.fs.retry(func() error {
+		if _, err := f.base.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to seek to start: %w", err)
+		}
 
-	// Read header
-	f.header = &FileHeader{}
-	if _, err := f.header.ReadFrom(f.base); err != nil {
-		return fmt.Errorf("failed to read header: %w", err)
+		f.header = &FileHeader{}
+		if _, err := f.header.ReadFrom(f.base); err != nil {
+			return fmt.Errorf("failed to read header: %w", err)
+		}
+
+		var err error
+		ciphertext, err = io.ReadAll(f.base)
+		if err != nil {
+			return fmt.Errorf("failed to read ciphertext: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
 	// Validate header
@@ -103,26 +184,29 @@ func (f *encryptedFile) loadFile() error {
 		return err
 	}
 
-	// Read ciphertext (do this before key derivation to avoid multiple reads)
-	ciphertext, err := io.ReadAll(f.base)
+	keyProvider, err := f.fs.fileKeyProvider(f.header)
 	if err != nil {
-		return fmt.Errorf("failed to read ciphertext: %w", err)
+		return err
 	}
 
 	// Try to decrypt with the key provider(s)
 	// Check if we have a MultiKeyProvider for fallback support
-	if multiProvider, ok := f.fs.keyProvider.(*MultiKeyProvider); ok {
-		// Try each provider in order
+	if multiProvider, ok := keyProvider.(*MultiKeyProvider); ok {
+		// Try each provider that may have written the file in order
 		var lastErr error
-		for _, provider := range multiProvider.providers {
-			key, err := provider.DeriveKey(f.header.Salt)
+		for _, provider := range multiProvider.providersFor(f.header.KeyID) {
+			key, err := f.fs.keys.derive(provider, f.header)
 			if err != nil {
 				lastErr = err
 				continue
 			}
+			if err := f.header.openFormat(key); err != nil {
+				lastErr = err
+				continue
+			}
 
 			// Create cipher engine
-			engine, err := NewCipherEngine(f.header.Cipher, key)
+			engine, err := f.fs.newCipherEngine(f.header.Cipher, key)
 			if err != nil {
 				lastErr = err
 				continue
@@ -130,18 +214,29 @@ func (f *encryptedFile) loadFile() error {
 
 			// Try to decrypt
 			if len(ciphertext) > 0 {
-				plaintext, err := engine.Decrypt(f.header.Nonce, ciphertext)
+				plaintext, err := f.decryptBody(key, engine, ciphertext)
 				if err != nil {
 					lastErr = err
 					continue
 				}
+				if plaintext, err = f.header.unpadBody(f.base.Name(), plaintext); err != nil {
+					return err
+				}
+				if err := f.header.openDigest(key); err != nil {
+					return NewCorruptionError(f.base.Name(), err.Error())
+				}
 				// Success!
+				f.keepStreamKey(key)
 				f.engine = engine
 				f.plaintext = plaintext
 				f.dirty = false
 				f.offset = 0
 				return nil
 			} else {
+				if err := f.header.openDigest(key); err != nil {
+					return NewCorruptionError(f.base.Name(), err.Error())
+				}
+				f.keepStreamKey(key)
 				f.engine = engine
 				f.plaintext = []byte{}
 				f.dirty = false
@@ -152,74 +247,148 @@ func (f *encryptedFile) loadFile() error {
 
 		// All providers failed
 		if lastErr != nil {
-			return fmt.Errorf("all key providers failed to decrypt: %w", lastErr)
+			return decryptError(f.base.Name(), "all key providers failed to decrypt", lastErr)
 		}
 		return fmt.Errorf("no key providers could decrypt the file")
 	}
 
 	// Single key provider - standard path
-	key, err := f.fs.keyProvider.DeriveKey(f.header.Salt)
+	key, err := f.fs.keys.derive(keyProvider, f.header)
 	if err != nil {
 		return fmt.Errorf("failed to derive key: %w", err)
 	}
+	if err := f.header.openFormat(key); err != nil {
+		return decryptError(f.base.Name(), "failed to authenticate header", err)
+	}
 
 	// Create cipher engine
-	f.engine, err = NewCipherEngine(f.header.Cipher, key)
+	f.engine, err = f.fs.newCipherEngine(f.header.Cipher, key)
 	if err != nil {
 		return fmt.Errorf("failed to create cipher engine: %w", err)
 	}
 
 	// Decrypt if there's any ciphertext
 	if len(ciphertext) > 0 {
-		f.plaintext, err = f.engine.Decrypt(f.header.Nonce, ciphertext)
+		plaintext, err := f.decryptBody(key, f.engine, ciphertext)
 		if err != nil {
-			return fmt.Errorf("failed to decrypt: %w", err)
+			return decryptError(f.base.Name(), "failed to decrypt", err)
+		}
+		if f.plaintext, err = f.header.unpadBody(f.base.Name(), plaintext); err != nil {
+			return err
 		}
 	} else {
 		f.plaintext = []byte{}
 	}
+	// The body decrypted under the key, so a digest that does not is corrupt
+	if err := f.header.openDigest(key); err != nil {
+		return NewCorruptionError(f.base.Name(), err.Error())
+	}
 
+	f.keepStreamKey(key)
 	f.dirty = false
 	f.offset = 0
 
 	return nil
 }
 
+// decryptBody decrypts the body of the file under key, or the engine made
+// from it: STREAM records for FlagStream files, and a single ciphertext
+// otherwise
+func (f *encryptedFile) decryptBody(key []byte, engine CipherEngine, ciphertext []byte) ([]byte, error) {
+	if f.header.Flags&FlagStream != 0 {
+		// A STREAM body could not have been bound to the additional data
+		if f.aad != nil {
+			return nil, ErrAuthFailed
+		}
+		return f.fs.openStream(f.header.Cipher, key, f.base.Name(), ciphertext)
+	}
+	return decryptWithAAD(engine, f.header.Nonce, ciphertext, f.aad)
+}
+
+// keepStreamKey keeps the file key of a FlagStream file, which seals the
+// next body under a payload key of its own
+func (f *encryptedFile) keepStreamKey(key []byte) {
+	if f.header.Flags&FlagStream != 0 {
+		f.streamKey = append([]byte(nil), key...)
+	}
+}
+
 // flush writes any pending changes to the underlying file
 func (f *encryptedFile) flush() error {
 	if !f.dirty {
 		return nil
 	}
 
-	// Encrypt plaintext
-	ciphertext, err := f.engine.Encrypt(f.header.Nonce, f.plaintext)
+	// Every write of the ciphertext needs a fresh nonce: the previous one
+	// may also be in use by a cloned copy of this file
+	nonce, err := f.fs.generateNonce(f.header.Cipher)
 	if err != nil {
-		return fmt.Errorf("failed to encrypt: %w", err)
+		return fmt.Errorf("failed to generate nonce: %w", err)
 	}
+	f.header.Nonce = nonce
 
-	// Seek to beginning of base file
-	if _, err := f.base.Seek(0, io.SeekStart); err != nil {
-		return fmt.Errorf("failed to seek: %w", err)
+	var ciphertext []byte
+	if f.header.Flags&FlagStream != 0 {
+		// STREAM records frame themselves and are never padded
+		ciphertext, err = f.fs.sealStream(f.header.Cipher, f.streamKey, f.plaintext)
+	} else {
+		var body []byte
+		if body, err = f.header.padBody(f.plaintext, f.fs.config.PadSize, f.fs.random); err != nil {
+			return err
+		}
+		ciphertext, err = encryptWithAAD(f.engine, f.header.Nonce, body, f.aad)
 	}
-
-	// Write header
-	if _, err := f.header.WriteTo(f.base); err != nil {
-		return fmt.Errorf("failed to write header: %w", err)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt: %w", err)
 	}
 
-	// Write ciphertext
-	if _, err := f.base.Write(ciphertext); err != nil {
-		return fmt.Errorf("failed to write ciphertext: %w", err)
+	// Record the plaintext digest. Files that already carry one keep it up
+	// to date even when the configuration no longer asks for it.
+	if f.header.Version >= headerFlagsVersion &&
+		(f.fs.config.ComputeDigest || f.header.Flags&FlagDigest != 0) {
+		sum := sha256.Sum256(f.plaintext)
+		if err := f.header.sealDigest(sum[:], f.fs.random); err != nil {
+			return err
+		}
 	}
 
-	// Truncate any extra data
-	currentPos, err := f.base.Seek(0, io.SeekCurrent)
+	err = f.fs.retry(func() error {
+		// Seek to beginning of base file
+		if _, err := f.base.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to seek: %w", err)
+		}
+
+		// Write header
+		if _, err := f.header.WriteTo(f.base); err != nil {
+			return fmt.Errorf("failed to write header: %w", err)
+		}
+
+		// Write ciphertext
+		if _, err := f.base.Write(ciphertext); err != nil {
+			return fmt.Errorf("failed to write ciphertext: %w", err)
+		}
+
+		// Truncate any extra data
+		currentPos, err := f.base.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return fmt.Errorf("failed to get position: %w", err)
+		}
+
+		if err := f.base.Truncate(currentPos); err != nil {
+			return fmt.Errorf("failed to truncate: %w", err)
+		}
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("failed to get position: %w", err)
+		return err
 	}
 
-	if err := f.base.Truncate(currentPos); err != nil {
-		return fmt.Errorf("failed to truncate: %w", err)
+	// The file stays dirty if verification fails, so a later Sync or Close
+	// writes it again
+	if f.fs.config.VerifyAfterWrite {
+		if err := f.verifyWrite(); err != nil {
+			return err
+		}
 	}
 
 	f.dirty = false
@@ -248,14 +417,34 @@ func (f *encryptedFile) Read(p []byte) (n int, err error) {
 	return n, err
 }
 
+// checkWritable returns the error os.File reports for op on a handle
+// opened without write access, or nil if flags grant it
+func checkWritable(op, name string, flags int) error {
+	if flags&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return &os.PathError{Op: op, Path: name, Err: syscall.EBADF}
+	}
+	return nil
+}
+
 // Write writes to the plaintext buffer (will be encrypted on Close/Sync)
 func (f *encryptedFile) Write(p []byte) (n int, err error) {
-	// Extend plaintext if needed
-	newSize := f.offset + int64(len(p))
-	if newSize > int64(len(f.plaintext)) {
-		newPlaintext := make([]byte, newSize)
-		copy(newPlaintext, f.plaintext)
-		f.plaintext = newPlaintext
+	if err := checkWritable("write", f.Name(), f.flags); err != nil {
+		return 0, err
+	}
+
+	// An empty write never extends the file, even past EOF
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	// Appends always land at the end of the plaintext
+	if f.flags&os.O_APPEND != 0 {
+		f.offset = int64(len(f.plaintext))
+	}
+
+	// A write past EOF leaves a hole of zeros before it
+	if err := f.extend(f.offset + int64(len(p))); err != nil {
+		return 0, err
 	}
 
 	n = copy(f.plaintext[f.offset:], p)
@@ -265,6 +454,29 @@ func (f *encryptedFile) Write(p []byte) (n int, err error) {
 	return n, nil
 }
 
+// extend grows the plaintext to size if it is shorter, filling the bytes
+// between the old end and size with zeros. A truncated plaintext keeps its
+// old contents beyond its length, so the gap is cleared explicitly rather
+// than relying on a fresh allocation being zeroed.
+func (f *encryptedFile) extend(size int64) error {
+	end := int64(len(f.plaintext))
+	if size <= end {
+		return nil
+	}
+	if err := checkInMemorySize(size); err != nil {
+		return err
+	}
+
+	if size > int64(cap(f.plaintext)) {
+		grown := make([]byte, end, size)
+		copy(grown, f.plaintext)
+		f.plaintext = grown
+	}
+	f.plaintext = f.plaintext[:size]
+	clear(f.plaintext[end:])
+	return nil
+}
+
 // WriteString writes a string to the file
 func (f *encryptedFile) WriteString(s string) (n int, err error) {
 	return f.Write([]byte(s))
@@ -295,6 +507,12 @@ func (f *encryptedFile) Seek(offset int64, whence int) (int64, error) {
 
 // Close flushes any pending writes and closes the file
 func (f *encryptedFile) Close() error {
+	if f.unlock != nil {
+		defer f.unlock()
+	}
+	defer clear(f.streamKey)
+	defer f.header.clearKeys()
+
 	if err := f.flush(); err != nil {
 		f.base.Close()
 		return err
@@ -312,24 +530,36 @@ func (f *encryptedFile) Sync() error {
 	return f.base.Sync()
 }
 
-// Stat returns file information
+// Stat returns file information reporting the plaintext size
 func (f *encryptedFile) Stat() (os.FileInfo, error) {
 	info, err := f.base.Stat()
 	if err != nil {
 		return nil, err
 	}
 
-	return newEncryptedFileInfo(info, f.fs.cipher), nil
+	encInfo := newEncryptedFileInfo(info, f.header.Cipher)
+	encInfo.size = int64(len(f.plaintext))
+	return encInfo, nil
+}
+
+// Digest returns the SHA-256 digest of the plaintext recorded in the file
+// header, or nil if the file has none. It reflects the contents as of the
+// last Sync or Close.
+func (f *encryptedFile) Digest() []byte {
+	if f.header.Flags&FlagDigest == 0 {
+		return nil
+	}
+	return append([]byte(nil), f.header.plaintextDigest...)
 }
 
-// Readdir reads directory entries
+// Readdir fails, as a regular file is not a directory
 func (f *encryptedFile) Readdir(n int) ([]os.FileInfo, error) {
-	return f.base.Readdir(n)
+	return nil, &os.PathError{Op: "readdir", Path: f.Name(), Err: errNotDir}
 }
 
-// Readdirnames reads directory entry names
+// Readdirnames fails, as a regular file is not a directory
 func (f *encryptedFile) Readdirnames(n int) ([]string, error) {
-	return f.base.Readdirnames(n)
+	return nil, &os.PathError{Op: "readdirnames", Path: f.Name(), Err: errNotDir}
 }
 
 // ReadAt reads from a specific offset in the decrypted content
@@ -352,16 +582,20 @@ func (f *encryptedFile) ReadAt(b []byte, off int64) (n int, err error) {
 
 // WriteAt writes to a specific offset in the plaintext
 func (f *encryptedFile) WriteAt(b []byte, off int64) (n int, err error) {
+	if err := checkWritable("write", f.Name(), f.flags); err != nil {
+		return 0, err
+	}
 	if off < 0 {
 		return 0, fmt.Errorf("negative offset")
 	}
 
-	// Extend plaintext if needed
-	newSize := off + int64(len(b))
-	if newSize > int64(len(f.plaintext)) {
-		newPlaintext := make([]byte, newSize)
-		copy(newPlaintext, f.plaintext)
-		f.plaintext = newPlaintext
+	// An empty write never extends the file, even past EOF
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	if err := f.extend(off + int64(len(b))); err != nil {
+		return 0, err
 	}
 
 	n = copy(f.plaintext[off:], b)
@@ -372,15 +606,17 @@ func (f *encryptedFile) WriteAt(b []byte, off int64) (n int, err error) {
 
 // Truncate changes the size of the file
 func (f *encryptedFile) Truncate(size int64) error {
+	if err := checkWritable("truncate", f.Name(), f.flags); err != nil {
+		return err
+	}
 	if size < 0 {
 		return fmt.Errorf("negative size")
 	}
 
 	if size > int64(len(f.plaintext)) {
-		// Extend with zeros
-		newPlaintext := make([]byte, size)
-		copy(newPlaintext, f.plaintext)
-		f.plaintext = newPlaintext
+		if err := f.extend(size); err != nil {
+			return err
+		}
 	} else {
 		// Truncate
 		f.plaintext = f.plaintext[:size]
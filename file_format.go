@@ -2,7 +2,9 @@ package encryptfs
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 )
@@ -12,13 +14,116 @@ const (
 	MagicBytes = uint32(0x454E4352)
 
 	// CurrentVersion is the current file format version
-	CurrentVersion = uint8(1)
+	// Version 2 adds the KDF parameters block after the nonce
+	// Version 3 stores chunk index entries as interleaved (offset, size) pairs
+	// Version 4 adds a flags byte after the KDF parameters
+	CurrentVersion = uint8(4)
+
+	// kdfParamsVersion is the first version that records KDF parameters
+	kdfParamsVersion = uint8(2)
+
+	// interleavedIndexVersion is the first version whose chunk index can be
+	// updated one entry at a time
+	interleavedIndexVersion = uint8(3)
+
+	// headerFlagsVersion is the first version that records header flags
+	headerFlagsVersion = uint8(4)
+
+	// kdfParamsSize is the encoded size of the KDF parameters block:
+	// 1 byte (id) + 4 bytes (iterations) + 4 bytes (memory) +
+	// 1 byte (parallelism) + 1 byte (hash) + 2 bytes (key size)
+	kdfParamsSize = 13
+
+	// DigestSize is the size of the plaintext digest recorded when
+	// FlagDigest is set (SHA-256), before it is sealed
+	DigestSize = sha256.Size
+
+	// MaxKeyIDSize is the largest key identifier a header can record
+	MaxKeyIDSize = 255
+
+	// MaxWrappedKeySize is the largest wrapped recovery key a header can
+	// record
+	MaxWrappedKeySize = 255
+
+	// MaxSaltSize is the largest salt a header is read with. Salts are
+	// length-prefixed, so larger sizes are rejected before anything is
+	// allocated for them.
+	MaxSaltSize = 1024
+
+	// maxNonceSize bounds the nonce size read from a header; no supported
+	// cipher uses more than 24 bytes
+	maxNonceSize = 64
+
+	// paddedSizeSize is the encoded size of the plaintext size that starts
+	// the body of a FlagPadded file
+	paddedSizeSize = 8
+
+	// formatTagSize is the size of the tag authenticating a header with a
+	// format descriptor (truncated HMAC-SHA256)
+	formatTagSize = 16
+
+	// formatDescriptorSize is the encoded size of the format descriptor
+	// recorded when FlagFormat is set: 4 bytes (features) + the tag
+	formatDescriptorSize = 4 + formatTagSize
 
 	// HeaderSize is the fixed size of the file header (without salt and nonce)
 	// 4 bytes (magic) + 1 byte (version) + 1 byte (cipher) + 2 bytes (salt size) = 8 bytes
 	MinHeaderSize = 8
 )
 
+// HeaderFlags records optional features of an encrypted file (version 4+)
+type HeaderFlags uint8
+
+const (
+	// FlagChunked marks files whose body is a chunk index followed by
+	// encrypted chunks rather than a single ciphertext
+	FlagChunked HeaderFlags = 1 << iota
+
+	// FlagDigest marks files whose header records the SHA-256 digest of
+	// the plaintext after the flags byte, sealed under a key derived from
+	// the file key
+	FlagDigest
+
+	// FlagSharedSalt marks files whose key is expanded from the filesystem
+	// master key with HKDF; the salt field holds a file ID instead of a salt
+	FlagSharedSalt
+
+	// FlagKeyID marks files whose header records the identifier of the key
+	// provider that wrote them, as a length byte and the identifier, after
+	// the digest
+	FlagKeyID
+
+	// FlagPadded marks traditional files whose body is padded: the
+	// ciphertext holds the plaintext size as 8 bytes, the plaintext and
+	// zeros up to a multiple of Config.PadSize. The header records the
+	// size too, after the wrapped key, sealed under a key expanded from the
+	// file key, so it can be read without decrypting the body but does not
+	// reveal the size the padding hides.
+	FlagPadded
+
+	// FlagRecoveryKey marks files whose header records a copy of the file
+	// key wrapped under Config.RecoveryKey, as a length byte and the wrapped
+	// key, after the key identifier
+	FlagRecoveryKey
+
+	// FlagStream marks files framed with the STREAM construction of
+	// StreamFormatSTREAM. The body of a traditional file is a STREAM
+	// payload rather than a single ciphertext, and its header nonce is
+	// unused; each chunk of a chunked file is a STREAM record bound to its
+	// index and to the end of the file.
+	FlagStream
+
+	// FlagFormat marks files whose header records a format descriptor after
+	// the wrapped key: the FormatFeatures the file uses, and a tag that
+	// authenticates them along with the rest of the header under the file
+	// key. It takes the last bit of the flags byte, so features added later
+	// are recorded in the descriptor alone.
+	FlagFormat
+
+	// knownHeaderFlags is the set of flags this version understands
+	knownHeaderFlags = FlagChunked | FlagDigest | FlagSharedSalt | FlagKeyID | FlagPadded | FlagRecoveryKey | FlagStream | FlagFormat
+)
+
 // FileHeader represents the header of an encrypted file
 type FileHeader struct {
 	Magic      uint32      // Magic bytes to identify encrypted files
@@ -28,6 +133,22 @@ type FileHeader struct {
 	Salt       []byte      // Salt for key derivation
 	NonceSize  uint16      // Size of the nonce in bytes
 	Nonce      []byte      // Nonce/IV for encryption
+	KDF        KDFParams   // Key derivation parameters (version 2+)
+	Flags      HeaderFlags // Optional features (version 4+)
+	Digest     []byte      // Sealed SHA-256 of the plaintext (FlagDigest only)
+	KeyID      []byte      // Identifier of the key provider (FlagKeyID only)
+
+	WrappedKey    []byte         // File key wrapped under the recovery key (FlagRecoveryKey only)
+	SealedSize    []byte         // Sealed plaintext size (FlagPadded only)
+	Features      FormatFeatures // Format features of the file (FlagFormat only)
+	FormatTag     []byte         // Authenticates the header (FlagFormat only)
+
+	formatKey []byte // Key of FormatTag, known once the file key is
+	tagged    []byte // Header bytes covered by FormatTag, as read
+
+	digestKey       []byte // Key sealing Digest, known once the file key is
+	sizeKey         []byte // Key sealing SealedSize, known once the file key is
+	plaintextDigest []byte // Digest as opened or last sealed
 }
 
 // NewFileHeader creates a new file header with the given parameters
@@ -43,9 +164,97 @@ func NewFileHeader(cipher CipherSuite, salt, nonce []byte) *FileHeader {
 	}
 }
 
+// newChunkIndex returns an empty chunk index in the layout used by this
+// header's format version
+func (h *FileHeader) newChunkIndex(chunkSize uint32) *ChunkIndexHeader {
+	index := NewChunkIndexHeader(chunkSize)
+	index.Interleaved = h.Version >= interleavedIndexVersion
+	return index
+}
+
+// setKeyID records the identifier of the key provider that writes the file.
+// Nothing is recorded for an empty identifier.
+func (h *FileHeader) setKeyID(id []byte) {
+	if len(id) == 0 {
+		return
+	}
+	h.Flags |= FlagKeyID
+	h.KeyID = id
+}
+
+// setWrappedKey records the file key wrapped under the recovery key
+func (h *FileHeader) setWrappedKey(wrapped []byte) {
+	h.Flags |= FlagRecoveryKey
+	h.WrappedKey = wrapped
+}
+
+// padBody returns the body to encrypt for the plaintext of a traditional
+// file. With padSize set, it is the plaintext size, the plaintext and zeros
+// up to a multiple of padSize bytes, and the header is flagged FlagPadded
+// and records the size sealed with a nonce read from random; otherwise it
+// is the plaintext itself.
+func (h *FileHeader) padBody(plaintext []byte, padSize int, random io.Reader) ([]byte, error) {
+	if padSize <= 0 || h.Version < headerFlagsVersion {
+		h.Flags &^= FlagPadded
+		h.SealedSize = nil
+		return plaintext, nil
+	}
+	if err := h.sealSize(len(plaintext), random); err != nil {
+		return nil, err
+	}
+	h.Flags |= FlagPadded
+
+	size := paddedSizeSize + len(plaintext)
+	if size%padSize != 0 {
+		size += padSize - size%padSize
+	}
+	body := make([]byte, size)
+	binary.LittleEndian.PutUint64(body, uint64(len(plaintext)))
+	copy(body[paddedSizeSize:], plaintext)
+	return body, nil
+}
+
+// unpadBody returns the plaintext of the decrypted body of a traditional
+// file, stripping the size and padding of a FlagPadded body
+func (h *FileHeader) unpadBody(path string, body []byte) ([]byte, error) {
+	if h.Flags&FlagPadded == 0 {
+		return body, nil
+	}
+	if len(body) < paddedSizeSize {
+		return nil, NewCorruptionError(path, fmt.Sprintf("padded body of %d bytes has no plaintext size", len(body)))
+	}
+	size := binary.LittleEndian.Uint64(body)
+	if size > uint64(len(body)-paddedSizeSize) {
+		return nil, NewCorruptionError(path, fmt.Sprintf("plaintext size %d exceeds padded size %d", size, len(body)-paddedSizeSize))
+	}
+	return body[paddedSizeSize : paddedSizeSize+int(size)], nil
+}
+
 // Size returns the total size of the header in bytes
 func (h *FileHeader) Size() int {
-	return MinHeaderSize + len(h.Salt) + 2 + len(h.Nonce)
+	size := MinHeaderSize + len(h.Salt) + 2 + len(h.Nonce)
+	if h.Version >= kdfParamsVersion {
+		size += kdfParamsSize
+	}
+	if h.Version >= headerFlagsVersion {
+		size++
+		if h.Flags&FlagDigest != 0 {
+			size += sealedDigestSize
+		}
+		if h.Flags&FlagKeyID != 0 {
+			size += 1 + len(h.KeyID)
+		}
+		if h.Flags&FlagRecoveryKey != 0 {
+			size += 1 + len(h.WrappedKey)
+		}
+		if h.Flags&FlagPadded != 0 {
+			size += sealedSizeSize
+		}
+		if h.Flags&FlagFormat != 0 {
+			size += formatDescriptorSize
+		}
+	}
+	return size
 }
 
 // WriteTo writes the header to the given writer
@@ -81,23 +290,89 @@ func (h *FileHeader) WriteTo(w io.Writer) (int64, error) {
 		return 0, fmt.Errorf("failed to write nonce: %w", err)
 	}
 
+	// Write KDF parameters
+	if h.Version >= kdfParamsVersion {
+		if err := binary.Write(buf, binary.LittleEndian, h.KDF); err != nil {
+			return 0, fmt.Errorf("failed to write kdf parameters: %w", err)
+		}
+	}
+
+	// Write flags
+	if h.Version >= headerFlagsVersion {
+		buf.WriteByte(byte(h.Flags))
+
+		// Write digest
+		if h.Flags&FlagDigest != 0 {
+			if len(h.Digest) != sealedDigestSize {
+				return 0, fmt.Errorf("invalid digest size: %d", len(h.Digest))
+			}
+			buf.Write(h.Digest)
+		}
+
+		// Write key identifier
+		if h.Flags&FlagKeyID != 0 {
+			if len(h.KeyID) == 0 || len(h.KeyID) > MaxKeyIDSize {
+				return 0, fmt.Errorf("invalid key id size: %d", len(h.KeyID))
+			}
+			buf.WriteByte(byte(len(h.KeyID)))
+			buf.Write(h.KeyID)
+		}
+
+		// Write wrapped recovery key
+		if h.Flags&FlagRecoveryKey != 0 {
+			if len(h.WrappedKey) == 0 || len(h.WrappedKey) > MaxWrappedKeySize {
+				return 0, fmt.Errorf("invalid wrapped key size: %d", len(h.WrappedKey))
+			}
+			buf.WriteByte(byte(len(h.WrappedKey)))
+			buf.Write(h.WrappedKey)
+		}
+
+		// Write sealed plaintext size
+		if h.Flags&FlagPadded != 0 {
+			if len(h.SealedSize) != sealedSizeSize {
+				return 0, fmt.Errorf("invalid sealed size: %d bytes", len(h.SealedSize))
+			}
+			buf.Write(h.SealedSize)
+		}
+
+		// Write format descriptor, sealing everything written before it
+		if h.Flags&FlagFormat != 0 {
+			if h.formatKey == nil {
+				return 0, errors.New("format descriptor cannot be sealed without the file key")
+			}
+			h.Features = h.flagFeatures()
+			buf.Write(binary.LittleEndian.AppendUint32(nil, uint32(h.Features)))
+			h.FormatTag = formatTag(h.formatKey, buf.Bytes())
+			buf.Write(h.FormatTag)
+		}
+	}
+
 	// Write to actual writer
 	n, err := w.Write(buf.Bytes())
 	return int64(n), err
 }
 
-// ReadFrom reads the header from the given reader
+// ReadFrom reads the header from the given reader. Data that does not start
+// with the magic bytes yields ErrNotEncrypted.
 func (h *FileHeader) ReadFrom(r io.Reader) (int64, error) {
 	var totalRead int64
 
+	// Keep the bytes read, which a format descriptor's tag covers
+	raw := new(bytes.Buffer)
+	r = io.TeeReader(r, raw)
+
 	// Read magic bytes
 	if err := binary.Read(r, binary.LittleEndian, &h.Magic); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			// Too short to hold the magic bytes of any encrypted file
+			return totalRead, ErrNotEncrypted
+		}
 		return totalRead, fmt.Errorf("failed to read magic bytes: %w", err)
 	}
 	totalRead += 4
 
 	if h.Magic != MagicBytes {
-		return totalRead, ErrInvalidHeader
+		return totalRead, ErrNotEncrypted
 	}
 
 	// Read version
@@ -123,6 +398,9 @@ func (h *FileHeader) ReadFrom(r io.Reader) (int64, error) {
 	totalRead += 2
 
 	// Read salt
+	if h.SaltSize > MaxSaltSize {
+		return totalRead, fmt.Errorf("%w: salt size %d exceeds %d", ErrInvalidHeader, h.SaltSize, MaxSaltSize)
+	}
 	h.Salt = make([]byte, h.SaltSize)
 	n, err := io.ReadFull(r, h.Salt)
 	totalRead += int64(n)
@@ -137,6 +415,9 @@ func (h *FileHeader) ReadFrom(r io.Reader) (int64, error) {
 	totalRead += 2
 
 	// Read nonce
+	if h.NonceSize > maxNonceSize {
+		return totalRead, fmt.Errorf("%w: nonce size %d exceeds %d", ErrInvalidHeader, h.NonceSize, maxNonceSize)
+	}
 	h.Nonce = make([]byte, h.NonceSize)
 	n, err = io.ReadFull(r, h.Nonce)
 	totalRead += int64(n)
@@ -144,17 +425,105 @@ func (h *FileHeader) ReadFrom(r io.Reader) (int64, error) {
 		return totalRead, fmt.Errorf("failed to read nonce: %w", err)
 	}
 
+	// Read KDF parameters
+	if h.Version >= kdfParamsVersion {
+		if err := binary.Read(r, binary.LittleEndian, &h.KDF); err != nil {
+			return totalRead, fmt.Errorf("failed to read kdf parameters: %w", err)
+		}
+		totalRead += kdfParamsSize
+	}
+
+	// Read flags
+	if h.Version >= headerFlagsVersion {
+		if err := binary.Read(r, binary.LittleEndian, &h.Flags); err != nil {
+			return totalRead, fmt.Errorf("failed to read flags: %w", err)
+		}
+		totalRead += 1
+
+		// Read digest
+		if h.Flags&FlagDigest != 0 {
+			h.Digest = make([]byte, sealedDigestSize)
+			n, err := io.ReadFull(r, h.Digest)
+			totalRead += int64(n)
+			if err != nil {
+				return totalRead, fmt.Errorf("failed to read digest: %w", err)
+			}
+		}
+
+		// Read key identifier
+		if h.Flags&FlagKeyID != 0 {
+			var size uint8
+			if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+				return totalRead, fmt.Errorf("failed to read key id size: %w", err)
+			}
+			totalRead += 1
+
+			h.KeyID = make([]byte, size)
+			n, err := io.ReadFull(r, h.KeyID)
+			totalRead += int64(n)
+			if err != nil {
+				return totalRead, fmt.Errorf("failed to read key id: %w", err)
+			}
+		}
+
+		// Read wrapped recovery key
+		if h.Flags&FlagRecoveryKey != 0 {
+			var size uint8
+			if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+				return totalRead, fmt.Errorf("failed to read wrapped key size: %w", err)
+			}
+			totalRead += 1
+
+			h.WrappedKey = make([]byte, size)
+			n, err := io.ReadFull(r, h.WrappedKey)
+			totalRead += int64(n)
+			if err != nil {
+				return totalRead, fmt.Errorf("failed to read wrapped key: %w", err)
+			}
+		}
+
+		// Read sealed plaintext size
+		if h.Flags&FlagPadded != 0 {
+			h.SealedSize = make([]byte, sealedSizeSize)
+			n, err := io.ReadFull(r, h.SealedSize)
+			totalRead += int64(n)
+			if err != nil {
+				return totalRead, fmt.Errorf("failed to read sealed size: %w", err)
+			}
+		}
+
+		// Read format descriptor
+		if h.Flags&FlagFormat != 0 {
+			if err := binary.Read(r, binary.LittleEndian, &h.Features); err != nil {
+				return totalRead, fmt.Errorf("failed to read format features: %w", err)
+			}
+			totalRead += 4
+			h.tagged = bytes.Clone(raw.Bytes())
+
+			h.FormatTag = make([]byte, formatTagSize)
+			n, err := io.ReadFull(r, h.FormatTag)
+			totalRead += int64(n)
+			if err != nil {
+				return totalRead, fmt.Errorf("failed to read format tag: %w", err)
+			}
+		}
+	}
+
 	return totalRead, nil
 }
 
 // Validate checks if the header is valid
 func (h *FileHeader) Validate() error {
 	if h.Magic != MagicBytes {
-		return ErrInvalidHeader
+		return ErrNotEncrypted
 	}
 	if h.Version > CurrentVersion {
 		return ErrUnsupportedVersion
 	}
+	if h.Cipher == CipherAuto {
+		// Auto is resolved by New; a header must name the cipher it used
+		return fmt.Errorf("%w: %s is not a concrete cipher", ErrUnsupportedCipher, h.Cipher)
+	}
 	if h.Cipher != CipherAES256GCM && h.Cipher != CipherChaCha20Poly1305 {
 		return ErrUnsupportedCipher
 	}
@@ -164,5 +533,67 @@ func (h *FileHeader) Validate() error {
 	if len(h.Nonce) == 0 {
 		return fmt.Errorf("nonce cannot be empty")
 	}
+	if nonceSize, _ := nonceSizeFor(h.Cipher); len(h.Nonce) != nonceSize {
+		return fmt.Errorf("nonce size %d does not match %s nonce size %d", len(h.Nonce), h.Cipher, nonceSize)
+	}
+	if h.KDF.ID > KDFPBKDF2 {
+		return fmt.Errorf("unsupported kdf: %d", h.KDF.ID)
+	}
+	if h.Flags&^knownHeaderFlags != 0 {
+		return fmt.Errorf("unsupported header flags: %#x", uint8(h.Flags))
+	}
+	if h.Flags&FlagKeyID != 0 && len(h.KeyID) == 0 {
+		return fmt.Errorf("key id cannot be empty")
+	}
+	if h.Flags&FlagRecoveryKey != 0 && len(h.WrappedKey) == 0 {
+		return fmt.Errorf("wrapped key cannot be empty")
+	}
+	if h.Flags&FlagFormat != 0 {
+		if unsupported := h.Features &^ supportedFeatures; unsupported != 0 {
+			return fmt.Errorf("%w: %v", ErrUnsupportedFeatures, unsupported)
+		}
+		if h.Features != h.flagFeatures() {
+			return fmt.Errorf("%w: format features %v do not match the header flags", ErrInvalidHeader, h.Features)
+		}
+	}
 	return nil
 }
+
+// detectChunkedFormat reports whether an encrypted file uses the chunked
+// layout. Version 4+ headers record this in their flags. Older headers do
+// not, so the chunk index that would follow the header is checked instead:
+// the first chunk of a chunked file starts right after the reserved index,
+// which a traditional file's ciphertext matches only by chance.
+func detectChunkedFormat(r io.ReaderAt, size int64) (bool, error) {
+	header := &FileHeader{}
+	headerSize, err := header.ReadFrom(io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return false, fmt.Errorf("failed to read header: %w", err)
+	}
+
+	if header.Version >= headerFlagsVersion {
+		return header.Flags&FlagChunked != 0, nil
+	}
+
+	bodyStart := headerSize + ChunkIndexReservedSize
+	if size < bodyStart {
+		return false, nil
+	}
+
+	// Chunk size, chunk count and the first chunk offset, which is stored
+	// at the same position in both index layouts
+	preamble := make([]byte, chunkIndexPreambleSize+8)
+	if _, err := r.ReadAt(preamble, headerSize); err != nil {
+		return false, fmt.Errorf("failed to read chunk index: %w", err)
+	}
+	chunkSize := binary.LittleEndian.Uint32(preamble[0:4])
+	count := binary.LittleEndian.Uint32(preamble[4:8])
+
+	if ValidateChunkSize(chunkSize) != nil || count > MaxIndexedChunks {
+		return false, nil
+	}
+	if count == 0 {
+		return size == bodyStart, nil
+	}
+	return binary.LittleEndian.Uint64(preamble[8:16]) == uint64(bodyStart), nil
+}
@@ -0,0 +1,418 @@
+package encryptfs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestFileHeader_KDFParamsRoundTrip(t *testing.T) {
+	header := NewFileHeader(CipherAES256GCM, bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 12))
+	header.KDF = KDFParams{
+		ID:          KDFArgon2id,
+		Iterations:  3,
+		Memory:      64 * 1024,
+		Parallelism: 4,
+		KeySize:     32,
+	}
+
+	buf := new(bytes.Buffer)
+	written, err := header.WriteTo(buf)
+	if err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+	if int(written) != header.Size() {
+		t.Errorf("Written size mismatch: got %d, want %d", written, header.Size())
+	}
+
+	read := &FileHeader{}
+	n, err := read.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("ReadFrom failed: %v", err)
+	}
+	if n != written {
+		t.Errorf("Read size mismatch: got %d, want %d", n, written)
+	}
+	if read.KDF != header.KDF {
+		t.Errorf("KDF mismatch: got %+v, want %+v", read.KDF, header.KDF)
+	}
+	if err := read.Validate(); err != nil {
+		t.Errorf("Validate failed: %v", err)
+	}
+}
+
+func TestFileHeader_Version1HasNoKDFParams(t *testing.T) {
+	header := NewFileHeader(CipherAES256GCM, bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 12))
+	header.Version = 1
+	header.KDF = KDFParams{ID: KDFArgon2id}
+
+	buf := new(bytes.Buffer)
+	written, err := header.WriteTo(buf)
+	if err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+	if written != int64(MinHeaderSize+32+2+12) {
+		t.Errorf("Version 1 header size: got %d, want %d", written, MinHeaderSize+32+2+12)
+	}
+
+	read := &FileHeader{}
+	if _, err := read.ReadFrom(buf); err != nil {
+		t.Fatalf("ReadFrom failed: %v", err)
+	}
+	if read.KDF.ID != KDFNone {
+		t.Errorf("Version 1 header should have no KDF, got %v", read.KDF.ID)
+	}
+}
+
+func TestFileHeader_Flags(t *testing.T) {
+	header := NewFileHeader(CipherAES256GCM, bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 12))
+	header.Flags = FlagChunked
+
+	buf := new(bytes.Buffer)
+	if _, err := header.WriteTo(buf); err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+
+	read := &FileHeader{}
+	if _, err := read.ReadFrom(buf); err != nil {
+		t.Fatalf("ReadFrom failed: %v", err)
+	}
+	if read.Flags != FlagChunked {
+		t.Errorf("Flags mismatch: got %#x, want %#x", read.Flags, FlagChunked)
+	}
+
+	read.Flags |= 0x80
+	if err := read.Validate(); err == nil {
+		t.Error("Validate should reject unknown flags")
+	}
+
+	// A digest follows the flags byte when FlagDigest is set
+	header.Flags = FlagChunked | FlagDigest
+	header.Digest = bytes.Repeat([]byte{3}, sealedDigestSize)
+
+	buf.Reset()
+	n, err := header.WriteTo(buf)
+	if err != nil {
+		t.Fatalf("WriteTo with digest failed: %v", err)
+	}
+	if int(n) != header.Size() {
+		t.Errorf("WriteTo wrote %d bytes, Size reports %d", n, header.Size())
+	}
+
+	read = &FileHeader{}
+	if _, err := read.ReadFrom(buf); err != nil {
+		t.Fatalf("ReadFrom with digest failed: %v", err)
+	}
+	if err := read.Validate(); err != nil {
+		t.Errorf("Validate failed: %v", err)
+	}
+	if !bytes.Equal(read.Digest, header.Digest) {
+		t.Errorf("Digest mismatch: got %x, want %x", read.Digest, header.Digest)
+	}
+}
+
+func TestFileHeader_SealDigest(t *testing.T) {
+	header := NewFileHeader(CipherAES256GCM, bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 12))
+	key := bytes.Repeat([]byte{4}, 32)
+	sum := sha256.Sum256([]byte("plaintext"))
+	if err := header.setDigestKey(key); err != nil {
+		t.Fatalf("setDigestKey failed: %v", err)
+	}
+	if err := header.sealDigest(sum[:], rand.Reader); err != nil {
+		t.Fatalf("sealDigest failed: %v", err)
+	}
+
+	// The header holds neither the digest nor the same bytes twice
+	if bytes.Contains(header.Digest, sum[:]) {
+		t.Error("sealed digest contains the plaintext digest")
+	}
+	first := header.Digest
+	if err := header.sealDigest(sum[:], rand.Reader); err != nil {
+		t.Fatalf("sealDigest failed: %v", err)
+	}
+	if bytes.Equal(first, header.Digest) {
+		t.Error("sealing the same digest twice gave the same bytes")
+	}
+
+	buf := new(bytes.Buffer)
+	if _, err := header.WriteTo(buf); err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+	read := &FileHeader{}
+	if _, err := read.ReadFrom(buf); err != nil {
+		t.Fatalf("ReadFrom failed: %v", err)
+	}
+	if err := read.openDigest(key); err != nil {
+		t.Fatalf("openDigest failed: %v", err)
+	}
+	if !bytes.Equal(read.plaintextDigest, sum[:]) {
+		t.Errorf("opened digest %x, want %x", read.plaintextDigest, sum)
+	}
+
+	// A tampered digest does not open
+	read.Digest[len(read.Digest)-1] ^= 1
+	if err := read.openDigest(key); !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("openDigest of a tampered digest = %v, want ErrAuthFailed", err)
+	}
+}
+
+func TestFileHeader_PadBody(t *testing.T) {
+	header := NewFileHeader(CipherAES256GCM, bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 12))
+	header.setKeyID([]byte("key"))
+	key := bytes.Repeat([]byte{3}, 32)
+	if err := header.setDigestKey(key); err != nil {
+		t.Fatalf("setDigestKey failed: %v", err)
+	}
+	size := header.Size()
+
+	for _, plaintext := range [][]byte{{}, []byte("short"), bytes.Repeat([]byte{'x'}, 500)} {
+		body, err := header.padBody(plaintext, 256, rand.Reader)
+		if err != nil {
+			t.Fatalf("padBody failed: %v", err)
+		}
+		if header.Flags&FlagPadded == 0 {
+			t.Errorf("flags %#x after padBody, want FlagPadded", header.Flags)
+		}
+		if len(body)%256 != 0 || len(body) < len(plaintext)+paddedSizeSize {
+			t.Errorf("padded body of %d bytes for %d bytes of plaintext", len(body), len(plaintext))
+		}
+		got, err := header.unpadBody("/file", body)
+		if err != nil || !bytes.Equal(got, plaintext) {
+			t.Errorf("unpadBody = %q, %v, want %q", got, err, plaintext)
+		}
+
+		// The header seals the size, which opens only with the file key
+		var buf bytes.Buffer
+		if _, err := header.WriteTo(&buf); err != nil {
+			t.Fatalf("WriteTo failed: %v", err)
+		}
+		read := &FileHeader{}
+		if _, err := read.ReadFrom(&buf); err != nil {
+			t.Fatalf("ReadFrom failed: %v", err)
+		}
+		if n, err := read.openSize(key); err != nil || n != int64(len(plaintext)) {
+			t.Errorf("openSize = %d, %v, want %d", n, err, len(plaintext))
+		}
+		if _, err := read.openSize(bytes.Repeat([]byte{4}, 32)); !errors.Is(err, ErrAuthFailed) {
+			t.Errorf("openSize with the wrong key = %v, want ErrAuthFailed", err)
+		}
+	}
+
+	// Only the sealed size, of a fixed length, is added to the header
+	if header.Size() != size+sealedSizeSize {
+		t.Errorf("padded header is %d bytes, want %d", header.Size(), size+sealedSizeSize)
+	}
+
+	// Without a pad size the body is the plaintext itself
+	if body, err := header.padBody([]byte("plain"), 0, rand.Reader); err != nil || string(body) != "plain" || header.Flags&FlagPadded != 0 {
+		t.Errorf("padBody without a pad size = %q, %v with flags %#x", body, err, header.Flags)
+	}
+	if header.Size() != size {
+		t.Errorf("unpadded header is %d bytes, want %d", header.Size(), size)
+	}
+
+	// The size cannot exceed the decrypted body it describes
+	header.Flags |= FlagPadded
+	for _, body := range [][]byte{make([]byte, 4), binary.LittleEndian.AppendUint64(nil, 100)} {
+		if _, err := header.unpadBody("/file", body); !IsCorruptionError(err) {
+			t.Errorf("unpadBody of %d bytes: got %v, want a CorruptionError", len(body), err)
+		}
+	}
+}
+
+func TestFileHeader_NonceSizeMatchesCipher(t *testing.T) {
+	for _, cipher := range []CipherSuite{CipherAES256GCM, CipherChaCha20Poly1305} {
+		nonce, err := GenerateNonce(cipher)
+		if err != nil {
+			t.Fatalf("GenerateNonce(%s) failed: %v", cipher, err)
+		}
+		header := NewFileHeader(cipher, bytes.Repeat([]byte{1}, 32), nonce)
+		if err := header.Validate(); err != nil {
+			t.Errorf("Validate(%s) failed: %v", cipher, err)
+		}
+
+		header.Nonce = append(header.Nonce, 0)
+		header.NonceSize++
+		if err := header.Validate(); err == nil {
+			t.Errorf("Validate(%s) accepted a %d-byte nonce", cipher, len(header.Nonce))
+		}
+	}
+}
+
+func TestFileHeader_RejectsCipherAuto(t *testing.T) {
+	nonce, err := GenerateNonce(CipherAES256GCM)
+	if err != nil {
+		t.Fatalf("GenerateNonce failed: %v", err)
+	}
+	header := NewFileHeader(CipherAuto, bytes.Repeat([]byte{1}, 32), nonce)
+
+	var buf bytes.Buffer
+	if _, err := header.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+	read := &FileHeader{}
+	if _, err := read.ReadFrom(&buf); err != nil {
+		t.Fatalf("ReadFrom failed: %v", err)
+	}
+
+	err = read.Validate()
+	if !errors.Is(err, ErrUnsupportedCipher) {
+		t.Fatalf("Validate error = %v, want ErrUnsupportedCipher", err)
+	}
+	if !strings.Contains(err.Error(), "auto") {
+		t.Errorf("Validate error %q does not name the auto cipher", err)
+	}
+
+	// New resolves CipherAuto before any header is written
+	base, cleanup := setupTestFS(t)
+	defer cleanup()
+	fs, err := New(base, &Config{
+		Cipher: CipherAuto,
+		KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+			Memory:      64 * 1024,
+			Iterations:  1,
+			Parallelism: 2,
+		}),
+	})
+	if err != nil {
+		t.Fatalf("failed to create EncryptFS: %v", err)
+	}
+	file, err := fs.Create("/auto.txt")
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	file.Write([]byte("data"))
+	file.Close()
+
+	raw, err := readBaseFile(base, "/auto.txt")
+	if err != nil {
+		t.Fatalf("failed to read base file: %v", err)
+	}
+	stored := &FileHeader{}
+	if _, err := stored.ReadFrom(bytes.NewReader(raw)); err != nil {
+		t.Fatalf("ReadFrom failed: %v", err)
+	}
+	if stored.Cipher != CipherAES256GCM {
+		t.Errorf("header cipher = %s, want %s", stored.Cipher, CipherAES256GCM)
+	}
+}
+
+func TestFileHeader_NotEncrypted(t *testing.T) {
+	for _, data := range []string{"plain", "ab"} {
+		_, err := (&FileHeader{}).ReadFrom(strings.NewReader(data))
+		if !errors.Is(err, ErrNotEncrypted) {
+			t.Errorf("ReadFrom(%q) error = %v, want ErrNotEncrypted", data, err)
+		}
+		if !errors.Is(err, ErrInvalidHeader) {
+			t.Errorf("ReadFrom(%q) error = %v, want it to wrap ErrInvalidHeader", data, err)
+		}
+	}
+	if err := (&FileHeader{}).Validate(); !errors.Is(err, ErrNotEncrypted) {
+		t.Errorf("Validate error = %v, want ErrNotEncrypted", err)
+	}
+
+	// Plaintext files left in the store are reported as such, whatever the
+	// file format the filesystem writes
+	for _, config := range []*Config{
+		{},
+		{ChunkSize: 4 * 1024},
+		{ChunkSize: 4 * 1024, ReadOnce: true},
+	} {
+		base, cleanup := setupTestFS(t)
+		defer cleanup()
+
+		config.Cipher = CipherAES256GCM
+		config.KeyProvider = NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+			Memory:      64 * 1024,
+			Iterations:  1,
+			Parallelism: 2,
+		})
+		fs, err := New(base, config)
+		if err != nil {
+			t.Fatalf("failed to create EncryptFS: %v", err)
+		}
+		defer fs.Close()
+
+		file, err := base.Create("/notes.txt")
+		if err != nil {
+			t.Fatalf("failed to create plaintext file: %v", err)
+		}
+		file.Write([]byte("these notes were never encrypted"))
+		file.Close()
+
+		file, err = fs.Open("/notes.txt")
+		if err == nil {
+			_, err = file.Read(make([]byte, 16))
+			file.Close()
+		}
+		if !errors.Is(err, ErrNotEncrypted) {
+			t.Errorf("chunk size %d: open error = %v, want ErrNotEncrypted", config.ChunkSize, err)
+		}
+	}
+}
+
+// FuzzParseHeader feeds arbitrary bytes to the header parser, which reads
+// lengths from untrusted input. A header that parses and validates must
+// write back to the bytes it was read from.
+func FuzzParseHeader(f *testing.F) {
+	header := NewFileHeader(CipherAES256GCM, bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 12))
+	header.KDF = KDFParams{ID: KDFArgon2id, Iterations: 3, Memory: 64 * 1024, Parallelism: 4, KeySize: 32}
+	header.Flags = FlagChunked | FlagDigest | FlagPadded
+	header.Digest = make([]byte, sealedDigestSize)
+	header.setKeyID([]byte("key-1"))
+	header.setWrappedKey(make([]byte, 60))
+	header.SealedSize = make([]byte, sealedSizeSize)
+	seed := new(bytes.Buffer)
+	header.WriteTo(seed)
+	f.Add(seed.Bytes())
+	f.Add(seed.Bytes()[:20])
+	f.Add([]byte("ENCR\x01\x01\xff\xff"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		header := &FileHeader{}
+		n, err := header.ReadFrom(bytes.NewReader(data))
+		if err != nil || header.Validate() != nil {
+			return
+		}
+		if n != int64(header.Size()) {
+			t.Fatalf("read %d bytes, Size reports %d", n, header.Size())
+		}
+		out := new(bytes.Buffer)
+		if _, err := header.WriteTo(out); err != nil {
+			t.Fatalf("WriteTo failed: %v", err)
+		}
+		if !bytes.Equal(out.Bytes(), data[:n]) {
+			t.Fatalf("header did not round trip:\n got %x\nwant %x", out.Bytes(), data[:n])
+		}
+	})
+}
+
+// TestFileHeader_OversizedFields checks that length prefixes beyond any
+// real header are rejected before a buffer is allocated for them
+func TestFileHeader_OversizedFields(t *testing.T) {
+	header := NewFileHeader(CipherAES256GCM, bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 12))
+	buf := new(bytes.Buffer)
+	header.WriteTo(buf)
+	valid := buf.Bytes()
+
+	// The salt size follows magic, version and cipher; the nonce size
+	// follows the salt
+	for _, tc := range []struct {
+		name   string
+		offset int
+	}{
+		{"salt", 6},
+		{"nonce", 8 + 32},
+	} {
+		data := append([]byte(nil), valid...)
+		data[tc.offset], data[tc.offset+1] = 0xff, 0xff
+		_, err := (&FileHeader{}).ReadFrom(bytes.NewReader(data))
+		if !errors.Is(err, ErrInvalidHeader) || !strings.Contains(err.Error(), tc.name) {
+			t.Errorf("%s size 0xffff: got %v, want ErrInvalidHeader", tc.name, err)
+		}
+	}
+}
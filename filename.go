@@ -2,7 +2,9 @@ package encryptfs
 
 import (
 	"crypto/rand"
+	"encoding/base32"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -30,6 +32,44 @@ type FilenameEncryptor interface {
 	DecryptPath(ciphertext string) (string, error)
 }
 
+// normalizeSeparators rewrites a path to use only the given separator. On
+// filesystems that use a backslash, forward slashes are accepted as well, as
+// Windows does. On filesystems that use a forward slash, a backslash is an
+// ordinary filename character and is left alone.
+func normalizeSeparators(p, separator string) string {
+	if separator == "\\" {
+		return strings.ReplaceAll(p, "/", separator)
+	}
+	return p
+}
+
+// validateFilename checks a single plaintext path component before it is
+// encrypted. A NUL byte or a separator inside a component would be
+// encrypted along with the rest of the name and split the path differently
+// once decrypted, and control characters are rejected by many filesystems
+// that back the metadata database or are used to display names. The
+// components "." and ".." are reserved for navigation and are never
+// encrypted, so they are accepted here.
+func validateFilename(name, separator string) error {
+	var message string
+	switch {
+	case strings.IndexByte(name, 0) >= 0:
+		message = "filename contains a NUL byte"
+	case strings.Contains(name, separator) || strings.Contains(name, "/"):
+		message = "filename contains a path separator"
+	case strings.IndexFunc(name, isControl) >= 0:
+		message = "filename contains a control character"
+	default:
+		return nil
+	}
+	return &ValidationError{Field: "filename", Value: name, Message: message}
+}
+
+// isControl reports whether r is an ASCII control character
+func isControl(r rune) bool {
+	return r < 0x20 || r == 0x7f
+}
+
 // noOpFilenameEncryptor passes through filenames without encryption
 type noOpFilenameEncryptor struct{}
 
@@ -49,11 +89,52 @@ func (n *noOpFilenameEncryptor) DecryptPath(ciphertext string) (string, error) {
 	return ciphertext, nil
 }
 
+// DefaultMaxFilenameLength is the default limit on the length of plaintext
+// names encrypted deterministically
+const DefaultMaxFilenameLength = 255
+
 // deterministicFilenameEncryptor uses SIV mode for deterministic filename encryption
 type deterministicFilenameEncryptor struct {
 	siv               *SIVEngine
 	preserveExtensions bool
 	separator         string
+	encoding          FilenameEncoding
+	maxLength         int // Longest name in bytes; no limit if not positive
+}
+
+// destroyKeys zeroes the encryptor's keys
+func (d *deterministicFilenameEncryptor) destroyKeys() {
+	d.siv.destroyKeys()
+}
+
+// base32Filename encodes filenames as lowercase base32 so that they survive
+// case-insensitive filesystems
+var base32Filename = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// encode converts a filename ciphertext to text in the configured encoding
+func (d *deterministicFilenameEncryptor) encode(ciphertext []byte) string {
+	switch d.encoding {
+	case FilenameEncodingBase32:
+		return base32Filename.EncodeToString(ciphertext)
+	case FilenameEncodingHex:
+		return hex.EncodeToString(ciphertext)
+	default:
+		return base64.URLEncoding.WithPadding(base64.NoPadding).EncodeToString(ciphertext)
+	}
+}
+
+// decode converts an encoded filename back to ciphertext. Base32 and hex
+// names are accepted in either case, since a case-insensitive filesystem
+// may report them differently than they were written.
+func (d *deterministicFilenameEncryptor) decode(encoded string) ([]byte, error) {
+	switch d.encoding {
+	case FilenameEncodingBase32:
+		return base32Filename.DecodeString(strings.ToLower(encoded))
+	case FilenameEncodingHex:
+		return hex.DecodeString(encoded)
+	default:
+		return base64.URLEncoding.WithPadding(base64.NoPadding).DecodeString(encoded)
+	}
 }
 
 // NewDeterministicFilenameEncryptor creates a new deterministic filename encryptor
@@ -81,6 +162,7 @@ func NewDeterministicFilenameEncryptor(key []byte, preserveExtensions bool, sepa
 		siv:               siv,
 		preserveExtensions: preserveExtensions,
 		separator:         separator,
+		maxLength:         DefaultMaxFilenameLength,
 	}, nil
 }
 
@@ -88,6 +170,17 @@ func (d *deterministicFilenameEncryptor) EncryptFilename(plaintext string) (stri
 	if plaintext == "" || plaintext == "." || plaintext == ".." {
 		return plaintext, nil
 	}
+	if err := validateFilename(plaintext, d.separator); err != nil {
+		return "", err
+	}
+	// Checked before SIV, which buffers the whole name
+	if d.maxLength > 0 && len(plaintext) > d.maxLength {
+		return "", &ValidationError{
+			Field:   "filename",
+			Value:   len(plaintext),
+			Message: fmt.Sprintf("filename is %d bytes, longer than the limit of %d", len(plaintext), d.maxLength),
+		}
+	}
 
 	var base, ext string
 	if d.preserveExtensions {
@@ -103,8 +196,8 @@ func (d *deterministicFilenameEncryptor) EncryptFilename(plaintext string) (stri
 		return "", fmt.Errorf("failed to encrypt filename: %w", err)
 	}
 
-	// Encode as URL-safe base64
-	encoded := base64.URLEncoding.WithPadding(base64.NoPadding).EncodeToString(ciphertext)
+	// Encode as text
+	encoded := d.encode(ciphertext)
 
 	// Reattach extension if preserved
 	if d.preserveExtensions && ext != "" {
@@ -127,8 +220,8 @@ func (d *deterministicFilenameEncryptor) DecryptFilename(ciphertext string) (str
 		encoded = ciphertext
 	}
 
-	// Decode from base64
-	data, err := base64.URLEncoding.WithPadding(base64.NoPadding).DecodeString(encoded)
+	// Decode from text
+	data, err := d.decode(encoded)
 	if err != nil {
 		return "", fmt.Errorf("failed to decode filename: %w", err)
 	}
@@ -136,7 +229,7 @@ func (d *deterministicFilenameEncryptor) DecryptFilename(ciphertext string) (str
 	// Decrypt using SIV
 	plaintext, err := d.siv.Decrypt(data)
 	if err != nil {
-		return "", fmt.Errorf("failed to decrypt filename: %w", err)
+		return "", decryptError(ciphertext, "failed to decrypt filename", err)
 	}
 
 	// Reattach extension if it was preserved
@@ -153,7 +246,7 @@ func (d *deterministicFilenameEncryptor) EncryptPath(plaintext string) (string,
 	}
 
 	// Split path into components
-	parts := strings.Split(plaintext, d.separator)
+	parts := strings.Split(normalizeSeparators(plaintext, d.separator), d.separator)
 
 	// Encrypt each component
 	for i, part := range parts {
@@ -175,7 +268,7 @@ func (d *deterministicFilenameEncryptor) DecryptPath(ciphertext string) (string,
 	}
 
 	// Split path into components
-	parts := strings.Split(ciphertext, d.separator)
+	parts := strings.Split(normalizeSeparators(ciphertext, d.separator), d.separator)
 
 	// Decrypt each component
 	for i, part := range parts {
@@ -191,36 +284,43 @@ func (d *deterministicFilenameEncryptor) DecryptPath(ciphertext string) (string,
 	return strings.Join(parts, d.separator), nil
 }
 
-// randomFilenameEncryptor uses random UUIDs with a metadata database
+// randomFilenameEncryptor uses random IDs with a metadata database. It
+// keeps no state of its own, so the metadata's lock is the only one taken.
 type randomFilenameEncryptor struct {
 	siv          *SIVEngine
 	metadata     *FilenameMetadata
 	separator    string
-	mu           sync.RWMutex
+	generateID   func() string // Config.FilenameIDGenerator; nil for UUIDs
+	random       io.Reader     // Config.RandSource for UUIDs; nil for crypto/rand
 }
 
-// FilenameMetadata stores mappings between encrypted and plaintext filenames
+// FilenameMetadata stores mappings between encrypted and plaintext filenames.
+// Its methods are safe for concurrent use, including Load and Save while
+// names are being added; the exported maps must not be used directly while
+// other goroutines hold the metadata.
 type FilenameMetadata struct {
 	// Map from encrypted path to plaintext path
 	Mappings map[string]string `json:"mappings"`
 	// Map from plaintext path to encrypted path (reverse lookup)
 	Reverse  map[string]string `json:"reverse"`
+	// Logical directories and their permissions (flattened layout only)
+	Directories map[string]os.FileMode `json:"directories,omitempty"`
 	mu       sync.RWMutex
 }
 
 // NewFilenameMetadata creates a new metadata store
 func NewFilenameMetadata() *FilenameMetadata {
 	return &FilenameMetadata{
-		Mappings: make(map[string]string),
-		Reverse:  make(map[string]string),
+		Mappings:    make(map[string]string),
+		Reverse:     make(map[string]string),
+		Directories: make(map[string]os.FileMode),
 	}
 }
 
-// Load loads metadata from a file
+// Load loads metadata from a file, merging it into the current mappings.
+// The file is read and decoded before the lock is taken, so lookups are not
+// blocked on I/O and a file that fails to decode leaves m unchanged.
 func (m *FilenameMetadata) Load(fs absfs.FileSystem, path string) error {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-
 	file, err := fs.Open(path)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -231,13 +331,27 @@ func (m *FilenameMetadata) Load(fs absfs.FileSystem, path string) error {
 	}
 	defer file.Close()
 
+	var loaded struct {
+		Mappings    map[string]string      `json:"mappings"`
+		Directories map[string]os.FileMode `json:"directories"`
+	}
 	decoder := json.NewDecoder(file)
-	if err := decoder.Decode(m); err != nil {
+	if err := decoder.Decode(&loaded); err != nil {
 		return fmt.Errorf("failed to decode metadata: %w", err)
 	}
 
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for encrypted, plaintext := range loaded.Mappings {
+		m.Mappings[encrypted] = plaintext
+	}
+	for plaintext, perm := range loaded.Directories {
+		m.Directories[plaintext] = perm
+	}
+
 	// Rebuild reverse map
-	m.Reverse = make(map[string]string)
+	m.Reverse = make(map[string]string, len(m.Mappings))
 	for encrypted, plaintext := range m.Mappings {
 		m.Reverse[plaintext] = encrypted
 	}
@@ -245,21 +359,48 @@ func (m *FilenameMetadata) Load(fs absfs.FileSystem, path string) error {
 	return nil
 }
 
-// Save saves metadata to a file
+// metadataTempSuffix is appended to the path of the metadata file for the
+// copy that Save writes before renaming it into place
+const metadataTempSuffix = ".tmp"
+
+// metadataCorruptSuffix is appended to the path of a metadata file that
+// could not be loaded when it is set aside under MetadataStartFresh
+const metadataCorruptSuffix = ".corrupt"
+
+// Save saves metadata to a file. The mappings are encoded under the read
+// lock and written after it is released, so a slow base filesystem does not
+// hold up names being added. They are written to a temporary file that
+// then replaces path, so a crash while saving leaves the previous file.
 func (m *FilenameMetadata) Save(fs absfs.FileSystem, path string) error {
 	m.mu.RLock()
-	defer m.mu.RUnlock()
+	data, err := json.MarshalIndent(m, "", "  ")
+	m.mu.RUnlock()
+	if err != nil {
+		return fmt.Errorf("failed to encode metadata: %w", err)
+	}
 
-	file, err := fs.Create(path)
+	tmp := path + metadataTempSuffix
+	file, err := fs.Create(tmp)
 	if err != nil {
 		return fmt.Errorf("failed to create metadata file: %w", err)
 	}
-	defer file.Close()
-
-	encoder := json.NewEncoder(file)
-	encoder.SetIndent("", "  ")
-	if err := encoder.Encode(m); err != nil {
-		return fmt.Errorf("failed to encode metadata: %w", err)
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		file.Close()
+		fs.Remove(tmp)
+		return fmt.Errorf("failed to write metadata: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		fs.Remove(tmp)
+		return fmt.Errorf("failed to sync metadata: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		fs.Remove(tmp)
+		return fmt.Errorf("failed to write metadata: %w", err)
+	}
+	if err := fs.Rename(tmp, path); err != nil {
+		fs.Remove(tmp)
+		return fmt.Errorf("failed to replace metadata file: %w", err)
 	}
 
 	return nil
@@ -274,6 +415,60 @@ func (m *FilenameMetadata) Add(encrypted, plaintext string) {
 	m.Reverse[plaintext] = encrypted
 }
 
+// addIfAbsent adds a mapping from plaintext to encrypted unless plaintext
+// already has one, and returns the encrypted name in use. The check and the
+// update happen under one lock, so concurrent callers agree on the name. It
+// returns false, adding nothing, if encrypted names another plaintext.
+func (m *FilenameMetadata) addIfAbsent(encrypted, plaintext string) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if existing, ok := m.Reverse[plaintext]; ok {
+		return existing, true
+	}
+	if _, taken := m.Mappings[encrypted]; taken {
+		return "", false
+	}
+	m.Mappings[encrypted] = plaintext
+	m.Reverse[plaintext] = encrypted
+	return encrypted, true
+}
+
+// maxFilenameIDAttempts bounds the IDs generated for one name when each
+// turns out to be in use already
+const maxFilenameIDAttempts = 16
+
+// newFilenameID returns an ID for a new random name from generate, or a
+// UUID read from random if generate is nil. IDs from a generator must be
+// valid filenames and must not start with a dot, which would let them be
+// mistaken for the internal files kept next to encrypted ones.
+func newFilenameID(generate func() string, random io.Reader, separator string) (string, error) {
+	if generate == nil {
+		if random == nil {
+			random = rand.Reader
+		}
+		id, err := uuid.NewRandomFromReader(random)
+		if err != nil {
+			return "", fmt.Errorf("failed to generate filename ID: %w", err)
+		}
+		return id.String(), nil
+	}
+	id := generate()
+	if id == "" || strings.HasPrefix(id, ".") {
+		return "", &ValidationError{Field: "FilenameIDGenerator", Value: id, Message: "generated ID is empty or starts with a dot"}
+	}
+	if err := validateFilename(id, separator); err != nil {
+		return "", &ValidationError{Field: "FilenameIDGenerator", Value: id, Message: "generated ID is not a valid filename"}
+	}
+	return id, nil
+}
+
+// errFilenameIDsExhausted is returned when every generated ID for a name
+// was already in use
+func errFilenameIDsExhausted(plaintext string) error {
+	return fmt.Errorf("no unused filename ID for %q after %d attempts", plaintext, maxFilenameIDAttempts)
+}
+
 // Get retrieves a plaintext filename from an encrypted one
 func (m *FilenameMetadata) Get(encrypted string) (string, bool) {
 	m.mu.RLock()
@@ -292,6 +487,59 @@ func (m *FilenameMetadata) GetReverse(plaintext string) (string, bool) {
 	return encrypted, ok
 }
 
+// Remove deletes the mapping for an encrypted name
+func (m *FilenameMetadata) Remove(encrypted string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if plaintext, ok := m.Mappings[encrypted]; ok {
+		delete(m.Reverse, plaintext)
+	}
+	delete(m.Mappings, encrypted)
+}
+
+// AddDirectory records a logical directory
+func (m *FilenameMetadata) AddDirectory(plaintext string, perm os.FileMode) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.Directories[plaintext] = perm
+}
+
+// RemoveDirectory deletes a logical directory
+func (m *FilenameMetadata) RemoveDirectory(plaintext string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.Directories, plaintext)
+}
+
+// GetDirectory reports whether a logical directory exists and its permissions
+func (m *FilenameMetadata) GetDirectory(plaintext string) (os.FileMode, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	perm, ok := m.Directories[plaintext]
+	return perm, ok
+}
+
+// Snapshot returns copies of the plaintext-to-encrypted mappings and the
+// logical directories
+func (m *FilenameMetadata) Snapshot() (files map[string]string, dirs map[string]os.FileMode) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	files = make(map[string]string, len(m.Reverse))
+	for plaintext, encrypted := range m.Reverse {
+		files[plaintext] = encrypted
+	}
+	dirs = make(map[string]os.FileMode, len(m.Directories))
+	for plaintext, perm := range m.Directories {
+		dirs[plaintext] = perm
+	}
+	return files, dirs
+}
+
 // NewRandomFilenameEncryptor creates a new random filename encryptor
 func NewRandomFilenameEncryptor(key []byte, metadata *FilenameMetadata, separator string) (*randomFilenameEncryptor, error) {
 	// Derive a 64-byte key for SIV
@@ -318,23 +566,39 @@ func (r *randomFilenameEncryptor) EncryptFilename(plaintext string) (string, err
 	if plaintext == "" || plaintext == "." || plaintext == ".." {
 		return plaintext, nil
 	}
+	if err := validateFilename(plaintext, r.separator); err != nil {
+		return "", err
+	}
 
-	r.mu.Lock()
-	defer r.mu.Unlock()
+	return r.encryptName(plaintext, nil)
+}
 
+// encryptName returns the mapped name of a validated plaintext name, or
+// maps it to a new ID. A name keeps its ID in every directory, so a new ID
+// is checked against all the IDs in the metadata rather than the entries of
+// one directory, and also against the base filesystem with taken, if set.
+// IDs already in use by either are replaced.
+func (r *randomFilenameEncryptor) encryptName(plaintext string, taken func(id string) bool) (string, error) {
 	// Check if we already have a mapping
 	if encrypted, ok := r.metadata.GetReverse(plaintext); ok {
 		return encrypted, nil
 	}
 
-	// Generate a random UUID for the encrypted filename
-	id := uuid.New()
-	encrypted := id.String()
-
-	// Store the mapping
-	r.metadata.Add(encrypted, plaintext)
-
-	return encrypted, nil
+	// Store a new ID for the encrypted filename, unless another goroutine
+	// has stored one since the check
+	for attempt := 0; attempt < maxFilenameIDAttempts; attempt++ {
+		id, err := newFilenameID(r.generateID, r.random, r.separator)
+		if err != nil {
+			return "", err
+		}
+		if taken != nil && taken(id) {
+			continue
+		}
+		if encrypted, ok := r.metadata.addIfAbsent(id, plaintext); ok {
+			return encrypted, nil
+		}
+	}
+	return "", errFilenameIDsExhausted(plaintext)
 }
 
 func (r *randomFilenameEncryptor) DecryptFilename(ciphertext string) (string, error) {
@@ -342,9 +606,6 @@ func (r *randomFilenameEncryptor) DecryptFilename(ciphertext string) (string, er
 		return ciphertext, nil
 	}
 
-	r.mu.RLock()
-	defer r.mu.RUnlock()
-
 	// Look up the mapping
 	plaintext, ok := r.metadata.Get(ciphertext)
 	if !ok {
@@ -359,7 +620,7 @@ func (r *randomFilenameEncryptor) EncryptPath(plaintext string) (string, error)
 		return plaintext, nil
 	}
 
-	parts := strings.Split(plaintext, r.separator)
+	parts := strings.Split(normalizeSeparators(plaintext, r.separator), r.separator)
 
 	for i, part := range parts {
 		if part != "" && part != "." && part != ".." {
@@ -374,12 +635,41 @@ func (r *randomFilenameEncryptor) EncryptPath(plaintext string) (string, error)
 	return strings.Join(parts, r.separator), nil
 }
 
+// resolvePath encrypts a plaintext path like EncryptPath, but only maps a
+// name to a new ID for which exists reports no entry in the encrypted
+// directory holding it, so that a file left on the base filesystem without
+// a mapping is not taken over by the name that is being created
+func (r *randomFilenameEncryptor) resolvePath(plaintext string, exists func(encrypted string) bool) (string, error) {
+	if plaintext == "" || plaintext == "." {
+		return plaintext, nil
+	}
+
+	parts := strings.Split(normalizeSeparators(plaintext, r.separator), r.separator)
+	for i, part := range parts {
+		if part == "" || part == "." || part == ".." {
+			continue
+		}
+		if err := validateFilename(part, r.separator); err != nil {
+			return "", err
+		}
+		encrypted, err := r.encryptName(part, func(id string) bool {
+			return exists(strings.Join(append(parts[:i:i], id), r.separator))
+		})
+		if err != nil {
+			return "", err
+		}
+		parts[i] = encrypted
+	}
+
+	return strings.Join(parts, r.separator), nil
+}
+
 func (r *randomFilenameEncryptor) DecryptPath(ciphertext string) (string, error) {
 	if ciphertext == "" || ciphertext == "." {
 		return ciphertext, nil
 	}
 
-	parts := strings.Split(ciphertext, r.separator)
+	parts := strings.Split(normalizeSeparators(ciphertext, r.separator), r.separator)
 
 	for i, part := range parts {
 		if part != "" && part != "." && part != ".." {
@@ -394,57 +684,83 @@ func (r *randomFilenameEncryptor) DecryptPath(ciphertext string) (string, error)
 	return strings.Join(parts, r.separator), nil
 }
 
+// keyDestroyer is implemented by the filename encryptors that hold keys
+// derived from the master key
+type keyDestroyer interface {
+	destroyKeys()
+}
+
+// destroyKeys zeroes the encryptor's keys
+func (r *randomFilenameEncryptor) destroyKeys() {
+	r.siv.destroyKeys()
+}
+
 // NewFilenameEncryptor creates a filename encryptor based on the configuration
 func NewFilenameEncryptor(config *Config, key []byte, fs absfs.FileSystem) (FilenameEncryptor, error) {
 	separator := string([]byte{fs.Separator()})
+	if config.FilenameEncryptor != nil {
+		return config.FilenameEncryptor, nil
+	}
+	if config.dirnamesSeparate() {
+		return newSplitFilenameEncryptor(config, key, separator)
+	}
 
 	switch config.FilenameEncryption {
 	case FilenameEncryptionNone:
 		return &noOpFilenameEncryptor{}, nil
 
 	case FilenameEncryptionDeterministic:
-		return NewDeterministicFilenameEncryptor(key, config.PreserveExtensions, separator)
+		return newConfiguredDeterministicEncryptor(config, key, separator)
 
 	case FilenameEncryptionRandom:
 		metadata := NewFilenameMetadata()
 
-		// Load existing metadata if path is specified
+		// Load existing metadata if path is specified. A database that
+		// exists but cannot be read is only set aside if the config says
+		// so, and is kept so that the lost mappings can still be recovered.
 		if config.MetadataPath != "" {
 			if err := metadata.Load(fs, config.MetadataPath); err != nil {
-				// If load fails, we'll start fresh
-				// In production, might want to handle this differently
+				if config.MetadataLoadPolicy != MetadataStartFresh {
+					return nil, fmt.Errorf("failed to load filename metadata from %s: %w", config.MetadataPath, err)
+				}
+				corrupt := config.MetadataPath + metadataCorruptSuffix
+				if renameErr := fs.Rename(config.MetadataPath, corrupt); renameErr != nil {
+					return nil, fmt.Errorf("failed to set aside unreadable filename metadata %s: %w", config.MetadataPath, renameErr)
+				}
+				config.logger().Warnf("encryptfs: moved unreadable filename metadata %s to %s: %v", config.MetadataPath, corrupt, err)
 			}
 		}
 
-		return NewRandomFilenameEncryptor(key, metadata, separator)
+		if config.FlattenDirectories {
+			flat := newFlatNamespace(metadata, separator)
+			flat.generateID = config.FilenameIDGenerator
+			flat.random = config.RandSource
+			return flat, nil
+		}
+
+		enc, err := NewRandomFilenameEncryptor(key, metadata, separator)
+		if err != nil {
+			return nil, err
+		}
+		enc.generateID = config.FilenameIDGenerator
+		enc.random = config.RandSource
+		return enc, nil
 
 	default:
 		return &noOpFilenameEncryptor{}, nil
 	}
 }
 
-// deriveFilenameKey derives a separate key for filename encryption
-func deriveFilenameKey(masterKey []byte) ([]byte, error) {
-	// Use a simple derivation - in production use HKDF
-	key := make([]byte, 32)
-
-	// Read from crypto/rand using masterKey as context
-	// For now, we'll just XOR with a constant
-	copy(key, masterKey)
-	for i := 0; i < 32; i++ {
-		key[i] ^= byte(i)
-	}
-
-	// Better approach: use HKDF
-	// This is placeholder for proper key derivation
-	randBytes := make([]byte, 32)
-	if _, err := io.ReadFull(rand.Reader, randBytes); err != nil {
+// newConfiguredDeterministicEncryptor creates a deterministic filename
+// encryptor with the encoding and length limit set in config
+func newConfiguredDeterministicEncryptor(config *Config, key []byte, separator string) (*deterministicFilenameEncryptor, error) {
+	enc, err := NewDeterministicFilenameEncryptor(key, config.PreserveExtensions, separator)
+	if err != nil {
 		return nil, err
 	}
-
-	for i := 0; i < 32; i++ {
-		key[i] ^= randBytes[i]
+	enc.encoding = config.FilenameEncoding
+	if config.MaxFilenameLength != 0 {
+		enc.maxLength = config.MaxFilenameLength
 	}
-
-	return key, nil
+	return enc, nil
 }
@@ -0,0 +1,161 @@
+package encryptfs
+
+import (
+	"strings"
+)
+
+// splitFilenameEncryptor encrypts directory names with one encryptor and
+// file names with another, as selected by Config.DirnameEncryption. One of
+// the two leaves names in plaintext, so a name decrypts with the other if
+// it can and is taken as plaintext otherwise, whatever it names.
+//
+// EncryptPath treats the last component of a path as a file and the rest as
+// directories. EncryptFS resolves paths with resolvePath instead, which
+// finds directories under their own name, and creates directories with
+// encryptDirPath.
+type splitFilenameEncryptor struct {
+	files     FilenameEncryptor
+	dirs      FilenameEncryptor
+	separator string
+}
+
+// dirnamesSeparate reports whether directory names are encrypted
+// differently from file names
+func (c *Config) dirnamesSeparate() bool {
+	switch c.DirnameEncryption {
+	case DirnameEncryptionNone:
+		return c.FilenameEncryption != FilenameEncryptionNone
+	case DirnameEncryptionDeterministic:
+		return c.FilenameEncryption != FilenameEncryptionDeterministic
+	}
+	return false
+}
+
+// namesEncrypted reports whether any names are encrypted under a key
+// derived from the master key
+func (c *Config) namesEncrypted() bool {
+	return c.FilenameEncryption != FilenameEncryptionNone || c.DirnameEncryption == DirnameEncryptionDeterministic
+}
+
+// newSplitFilenameEncryptor creates the encryptor for a config whose
+// directory names are encrypted differently from its file names
+func newSplitFilenameEncryptor(config *Config, key []byte, separator string) (*splitFilenameEncryptor, error) {
+	split := &splitFilenameEncryptor{
+		files:     &noOpFilenameEncryptor{},
+		dirs:      &noOpFilenameEncryptor{},
+		separator: separator,
+	}
+
+	encrypted := &split.files
+	if config.DirnameEncryption == DirnameEncryptionDeterministic {
+		encrypted = &split.dirs
+	}
+	enc, err := newConfiguredDeterministicEncryptor(config, key, separator)
+	if err != nil {
+		return nil, err
+	}
+	*encrypted = enc
+
+	return split, nil
+}
+
+// destroyKeys zeroes the keys of the encrypting side
+func (s *splitFilenameEncryptor) destroyKeys() {
+	for _, enc := range []FilenameEncryptor{s.files, s.dirs} {
+		if d, ok := enc.(keyDestroyer); ok {
+			d.destroyKeys()
+		}
+	}
+}
+
+// EncryptFilename encrypts the name of a file
+func (s *splitFilenameEncryptor) EncryptFilename(plaintext string) (string, error) {
+	return s.files.EncryptFilename(plaintext)
+}
+
+// DecryptFilename decrypts the name of a file or a directory. Names that
+// the encrypting side cannot decrypt are plaintext names of the other.
+func (s *splitFilenameEncryptor) DecryptFilename(ciphertext string) (string, error) {
+	encrypting, plain := s.files, s.dirs
+	if _, ok := encrypting.(*noOpFilenameEncryptor); ok {
+		encrypting, plain = s.dirs, s.files
+	}
+	if plaintext, err := encrypting.DecryptFilename(ciphertext); err == nil {
+		return plaintext, nil
+	}
+	return plain.DecryptFilename(ciphertext)
+}
+
+// EncryptPath encrypts a path whose last component names a file
+func (s *splitFilenameEncryptor) EncryptPath(plaintext string) (string, error) {
+	return s.encryptPath(plaintext, false)
+}
+
+// encryptDirPath encrypts a path whose components all name directories
+func (s *splitFilenameEncryptor) encryptDirPath(plaintext string) (string, error) {
+	return s.encryptPath(plaintext, true)
+}
+
+func (s *splitFilenameEncryptor) encryptPath(plaintext string, dir bool) (string, error) {
+	if plaintext == "" || plaintext == "." {
+		return plaintext, nil
+	}
+
+	parts := strings.Split(normalizeSeparators(plaintext, s.separator), s.separator)
+	last := len(parts) - 1
+	for last >= 0 && parts[last] == "" {
+		last--
+	}
+	for i, part := range parts {
+		if part == "" || part == "." || part == ".." {
+			continue
+		}
+
+		encryptor := s.dirs
+		if i == last && !dir {
+			encryptor = s.files
+		}
+		encrypted, err := encryptor.EncryptFilename(part)
+		if err != nil {
+			return "", err
+		}
+		parts[i] = encrypted
+	}
+
+	return strings.Join(parts, s.separator), nil
+}
+
+// DecryptPath decrypts a full path one component at a time
+func (s *splitFilenameEncryptor) DecryptPath(ciphertext string) (string, error) {
+	if ciphertext == "" || ciphertext == "." {
+		return ciphertext, nil
+	}
+
+	parts := strings.Split(normalizeSeparators(ciphertext, s.separator), s.separator)
+	for i, part := range parts {
+		if part != "" && part != "." && part != ".." {
+			decrypted, err := s.DecryptFilename(part)
+			if err != nil {
+				return "", err
+			}
+			parts[i] = decrypted
+		}
+	}
+
+	return strings.Join(parts, s.separator), nil
+}
+
+// resolvePath encrypts a plaintext path, encrypting its last component as
+// a directory name if isDir reports a directory under that name, and as a
+// file name otherwise
+func (s *splitFilenameEncryptor) resolvePath(plaintext string, isDir func(encrypted string) bool) (string, error) {
+	asDir, err := s.encryptDirPath(plaintext)
+	if err != nil {
+		return "", err
+	}
+	asFile, err := s.EncryptPath(plaintext)
+	if err != nil || asFile == asDir || !isDir(asDir) {
+		return asFile, err
+	}
+	return asDir, nil
+}
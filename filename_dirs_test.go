@@ -0,0 +1,169 @@
+package encryptfs
+
+import (
+	"os"
+	"slices"
+	"testing"
+)
+
+func TestDirnameEncryption(t *testing.T) {
+	keyProvider := NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+		Memory:      64 * 1024,
+		Iterations:  1,
+		Parallelism: 2,
+	})
+
+	tests := []struct {
+		name       string
+		files      FilenameEncryption
+		dirs       DirnameEncryption
+		plainDirs  bool
+		plainFiles bool
+	}{
+		{"plaintext directories", FilenameEncryptionDeterministic, DirnameEncryptionNone, true, false},
+		{"plaintext files", FilenameEncryptionNone, DirnameEncryptionDeterministic, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base, cleanup := setupTestFS(t)
+			defer cleanup()
+			newFS := func(config *Config) *EncryptFS {
+				t.Helper()
+				fs, err := New(base, config)
+				if err != nil {
+					t.Fatalf("failed to create EncryptFS: %v", err)
+				}
+				return fs
+			}
+			fs := newFS(&Config{
+				Cipher:             CipherAES256GCM,
+				KeyProvider:        keyProvider,
+				FilenameEncryption: tt.files,
+				DirnameEncryption:  tt.dirs,
+				StoreConfig:        true,
+			})
+			defer fs.Close()
+
+			if err := fs.MkdirAll("/docs/reports", 0755); err != nil {
+				t.Fatalf("MkdirAll failed: %v", err)
+			}
+			if err := fs.Mkdir("/docs/empty", 0755); err != nil {
+				t.Fatalf("Mkdir failed: %v", err)
+			}
+			tree := map[string][]byte{
+				"/docs/reports/q1.txt": []byte("first quarter"),
+				"/docs/notes.txt":      []byte("notes"),
+				"/top.txt":             []byte("top"),
+			}
+			if err := fs.WriteFiles(tree); err != nil {
+				t.Fatalf("WriteFiles failed: %v", err)
+			}
+			compareTree(t, fs, "/", tree)
+
+			// Each kind of name is stored on the base filesystem as configured
+			for _, dir := range []string{"/docs", "/docs/reports", "/docs/empty"} {
+				info, err := base.Stat(dir)
+				if tt.plainDirs != (err == nil && info.IsDir()) {
+					t.Errorf("directory %s stored in plaintext = %v, want %v", dir, err == nil, tt.plainDirs)
+				}
+			}
+			if _, err := base.Stat("/top.txt"); tt.plainFiles != (err == nil) {
+				t.Errorf("file /top.txt stored in plaintext = %v, want %v", err == nil, tt.plainFiles)
+			}
+
+			// Directories are found by their own names wherever they appear
+			for _, dir := range []string{"/docs", "/docs/reports", "/docs/empty/"} {
+				if info, err := fs.Stat(dir); err != nil || !info.IsDir() {
+					t.Errorf("Stat(%s) = %v, %v; want a directory", dir, info, err)
+				}
+			}
+			entries, err := fs.ReadDir("/docs")
+			if err != nil {
+				t.Fatalf("ReadDir failed: %v", err)
+			}
+			var names []string
+			for _, entry := range entries {
+				names = append(names, entry.Name())
+			}
+			slices.Sort(names)
+			if want := []string{"empty", "notes.txt", "reports"}; !slices.Equal(names, want) {
+				t.Errorf("ReadDir(/docs) = %v, want %v", names, want)
+			}
+
+			// A directory renamed keeps a directory name
+			if err := fs.Rename("/docs/reports", "/docs/archive"); err != nil {
+				t.Fatalf("Rename of directory failed: %v", err)
+			}
+			if err := fs.Rename("/docs/notes.txt", "/docs/archive/notes.txt"); err != nil {
+				t.Fatalf("Rename of file failed: %v", err)
+			}
+			tree = map[string][]byte{
+				"/docs/archive/q1.txt":    []byte("first quarter"),
+				"/docs/archive/notes.txt": []byte("notes"),
+				"/top.txt":                []byte("top"),
+			}
+			compareTree(t, fs, "/", tree)
+			if err := fs.Mkdir("/docs/archive/sub", 0755); err != nil {
+				t.Errorf("Mkdir in renamed directory failed: %v", err)
+			}
+
+			// A directory cannot be created over a file
+			if err := fs.Mkdir("/top.txt", 0755); !os.IsExist(err) {
+				t.Errorf("Mkdir over a file = %v, want an exists error", err)
+			}
+
+			sub, err := fs.Sub("/docs")
+			if err != nil {
+				t.Fatalf("Sub failed: %v", err)
+			}
+			compareTree(t, sub, "/", map[string][]byte{"/archive/q1.txt": []byte("first quarter")})
+
+			// The stored config records the directory name mode
+			reopened := newFS(&Config{Cipher: CipherAES256GCM, KeyProvider: keyProvider})
+			defer reopened.Close()
+			if reopened.config.DirnameEncryption != tt.dirs {
+				t.Errorf("reopened with DirnameEncryption %v, want %v", reopened.config.DirnameEncryption, tt.dirs)
+			}
+			compareTree(t, reopened, "/", tree)
+		})
+	}
+}
+
+func TestDirnameEncryption_Validate(t *testing.T) {
+	keyProvider := NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+		Memory:      64 * 1024,
+		Iterations:  1,
+		Parallelism: 2,
+	})
+	names, err := NewDeterministicFilenameEncryptor(make([]byte, 32), false, "/")
+	if err != nil {
+		t.Fatalf("failed to create filename encryptor: %v", err)
+	}
+
+	invalid := map[string]*Config{
+		"unknown mode": {KeyProvider: keyProvider, DirnameEncryption: DirnameEncryptionDeterministic + 1},
+		"random": {
+			KeyProvider:        keyProvider,
+			FilenameEncryption: FilenameEncryptionRandom,
+			MetadataPath:       "/.metadata",
+			DirnameEncryption:  DirnameEncryptionNone,
+		},
+		"custom encryptor": {
+			KeyProvider:        keyProvider,
+			FilenameEncryption: FilenameEncryptionDeterministic,
+			FilenameEncryptor:  names,
+			DirnameEncryption:  DirnameEncryptionNone,
+		},
+	}
+	for name, config := range invalid {
+		if err := config.Validate(); err == nil {
+			t.Errorf("%s: expected a validation error", name)
+		}
+	}
+
+	// A mode matching FilenameEncryption is the same as leaving it unset
+	same := &Config{FilenameEncryption: FilenameEncryptionDeterministic, DirnameEncryption: DirnameEncryptionDeterministic}
+	if same.dirnamesSeparate() {
+		t.Error("matching modes reported as separate")
+	}
+}
@@ -0,0 +1,182 @@
+package encryptfs
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MultiKeyFilenameEncryptor encrypts filenames with a primary encryptor and
+// decrypts them with whichever of its encryptors can, so that names written
+// under an old filename key stay readable while new names are written under
+// the new one. It is the filename counterpart of MultiKeyProvider.
+//
+// Set as Config.FilenameEncryptor, it also resolves paths: each component
+// of a path is looked up on the base filesystem under the primary key, then
+// under the others in order, and the first name that exists is used, so
+// existing files and directories are found under whichever key wrote them.
+// Components that do not exist yet are encrypted with the primary key.
+type MultiKeyFilenameEncryptor struct {
+	encryptors []FilenameEncryptor
+	separator  string
+}
+
+// NewMultiKeyFilenameEncryptor creates a multi-key filename encryptor for
+// paths using separator. The first encryptor is used for new names, the
+// others only to decrypt and find existing ones.
+func NewMultiKeyFilenameEncryptor(separator string, encryptors ...FilenameEncryptor) (*MultiKeyFilenameEncryptor, error) {
+	if len(encryptors) == 0 {
+		return nil, fmt.Errorf("at least one filename encryptor required")
+	}
+	if separator == "" {
+		return nil, fmt.Errorf("separator cannot be empty")
+	}
+
+	return &MultiKeyFilenameEncryptor{
+		encryptors: encryptors,
+		separator:  separator,
+	}, nil
+}
+
+// EncryptFilename encrypts a filename with the primary encryptor
+func (m *MultiKeyFilenameEncryptor) EncryptFilename(plaintext string) (string, error) {
+	return m.encryptors[0].EncryptFilename(plaintext)
+}
+
+// DecryptFilename decrypts a filename with the first encryptor that can. If
+// none can, the primary encryptor's error is returned.
+func (m *MultiKeyFilenameEncryptor) DecryptFilename(ciphertext string) (string, error) {
+	var firstErr error
+	for _, encryptor := range m.encryptors {
+		plaintext, err := encryptor.DecryptFilename(ciphertext)
+		if err == nil {
+			return plaintext, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return "", firstErr
+}
+
+// EncryptPath encrypts a full path with the primary encryptor
+func (m *MultiKeyFilenameEncryptor) EncryptPath(plaintext string) (string, error) {
+	return m.encryptors[0].EncryptPath(plaintext)
+}
+
+// DecryptPath decrypts a full path one component at a time, so a path may
+// mix names written under different keys
+func (m *MultiKeyFilenameEncryptor) DecryptPath(ciphertext string) (string, error) {
+	if ciphertext == "" || ciphertext == "." {
+		return ciphertext, nil
+	}
+
+	parts := strings.Split(normalizeSeparators(ciphertext, m.separator), m.separator)
+	for i, part := range parts {
+		if part != "" && part != "." && part != ".." {
+			decrypted, err := m.DecryptFilename(part)
+			if err != nil {
+				return "", err
+			}
+			parts[i] = decrypted
+		}
+	}
+
+	return strings.Join(parts, m.separator), nil
+}
+
+// resolvePath encrypts a plaintext path, choosing for each component the
+// first of its encryptions whose path so far exists according to exists.
+// Once a component exists under no key, neither can anything below it, so
+// the rest of the path is encrypted with the primary encryptor. A path that
+// exists under the primary key, or a new name in a directory that does,
+// takes one or two lookups; only paths with components under older keys are
+// looked up component by component.
+func (m *MultiKeyFilenameEncryptor) resolvePath(plaintext string, exists func(encrypted string) bool) (string, error) {
+	if plaintext == "" || plaintext == "." {
+		return plaintext, nil
+	}
+
+	parts := strings.Split(normalizeSeparators(plaintext, m.separator), m.separator)
+	if resolved, ok, err := m.resolveUnderPrimary(parts, exists); err != nil || ok {
+		return resolved, err
+	}
+	found := true
+	for i, part := range parts {
+		if part == "" || part == "." || part == ".." {
+			continue
+		}
+
+		primary, err := m.encryptors[0].EncryptFilename(part)
+		if err != nil {
+			return "", err
+		}
+		parts[i] = primary
+		if !found {
+			continue
+		}
+
+		found = false
+		for j, encryptor := range m.encryptors {
+			name := primary
+			if j > 0 {
+				if name, err = encryptor.EncryptFilename(part); err != nil || name == primary {
+					continue
+				}
+			}
+			parts[i] = name
+			if exists(strings.Join(parts[:i+1], m.separator)) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			parts[i] = primary
+		}
+	}
+
+	return strings.Join(parts, m.separator), nil
+}
+
+// resolveUnderPrimary resolves the path split into parts when everything
+// but possibly its last component exists under the primary key, reporting
+// whether it did. The last component is then tried under each key in turn.
+func (m *MultiKeyFilenameEncryptor) resolveUnderPrimary(parts []string, exists func(encrypted string) bool) (string, bool, error) {
+	primary := make([]string, len(parts))
+	last := -1
+	for i, part := range parts {
+		primary[i] = part
+		if part == "" || part == "." || part == ".." {
+			continue
+		}
+		name, err := m.encryptors[0].EncryptFilename(part)
+		if err != nil {
+			return "", false, err
+		}
+		primary[i] = name
+		last = i
+	}
+	if last < 0 || exists(strings.Join(primary, m.separator)) {
+		return strings.Join(primary, m.separator), true, nil
+	}
+
+	// The root always exists; any other directory is looked up
+	for _, part := range primary[:last] {
+		if part != "" && part != "." && part != ".." {
+			if !exists(strings.Join(primary[:last], m.separator)) {
+				return "", false, nil
+			}
+			break
+		}
+	}
+	for _, encryptor := range m.encryptors[1:] {
+		name, err := encryptor.EncryptFilename(parts[last])
+		if err != nil || name == primary[last] {
+			continue
+		}
+		candidate := append(append(primary[:last:last], name), primary[last+1:]...)
+		if exists(strings.Join(candidate, m.separator)) {
+			return strings.Join(candidate, m.separator), true, nil
+		}
+	}
+	return strings.Join(primary, m.separator), true, nil
+}
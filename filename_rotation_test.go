@@ -0,0 +1,219 @@
+package encryptfs
+
+import (
+	"bytes"
+	"sort"
+	"testing"
+)
+
+func TestMultiKeyFilenameEncryptor(t *testing.T) {
+	base, cleanup := setupTestFS(t)
+	defer cleanup()
+
+	keyProvider := NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+		Memory:      64 * 1024,
+		Iterations:  1,
+		Parallelism: 2,
+	})
+	oldNames, err := NewDeterministicFilenameEncryptor(bytes.Repeat([]byte{0x01}, 32), false, "/")
+	if err != nil {
+		t.Fatalf("failed to create old filename encryptor: %v", err)
+	}
+	newNames, err := NewDeterministicFilenameEncryptor(bytes.Repeat([]byte{0x02}, 32), false, "/")
+	if err != nil {
+		t.Fatalf("failed to create new filename encryptor: %v", err)
+	}
+	newConfig := func(names FilenameEncryptor) *Config {
+		return &Config{
+			Cipher:             CipherAES256GCM,
+			KeyProvider:        keyProvider,
+			FilenameEncryption: FilenameEncryptionDeterministic,
+			FilenameEncryptor:  names,
+		}
+	}
+	write := func(fs *EncryptFS, name string, data []byte) {
+		t.Helper()
+		file, err := fs.Create(name)
+		if err != nil {
+			t.Fatalf("failed to create %s: %v", name, err)
+		}
+		if _, err := file.Write(data); err != nil {
+			t.Fatalf("failed to write %s: %v", name, err)
+		}
+		if err := file.Close(); err != nil {
+			t.Fatalf("failed to close %s: %v", name, err)
+		}
+	}
+
+	// Files written under the old filename key
+	oldFS, err := New(base, newConfig(oldNames))
+	if err != nil {
+		t.Fatalf("failed to create EncryptFS: %v", err)
+	}
+	if err := oldFS.MkdirAll("/docs/old", 0755); err != nil {
+		t.Fatalf("failed to create directories: %v", err)
+	}
+	write(oldFS, "/docs/old/a.txt", []byte("old a"))
+	write(oldFS, "/top.txt", []byte("old top"))
+	oldFS.Close()
+
+	// After rotation both keys resolve, and new names use the new key
+	multi, err := NewMultiKeyFilenameEncryptor("/", newNames, oldNames)
+	if err != nil {
+		t.Fatalf("failed to create multi-key filename encryptor: %v", err)
+	}
+	fs, err := New(base, newConfig(multi))
+	if err != nil {
+		t.Fatalf("failed to create EncryptFS: %v", err)
+	}
+	defer fs.Close()
+
+	compareTree(t, fs, "/", map[string][]byte{
+		"/docs/old/a.txt": []byte("old a"),
+		"/top.txt":        []byte("old top"),
+	})
+	write(fs, "/docs/new.txt", []byte("new in old dir"))
+	if err := fs.Mkdir("/fresh", 0755); err != nil {
+		t.Fatalf("failed to create directory: %v", err)
+	}
+	write(fs, "/fresh/b.txt", []byte("new b"))
+	compareTree(t, fs, "/", map[string][]byte{
+		"/docs/new.txt": []byte("new in old dir"),
+		"/fresh/b.txt":  []byte("new b"),
+	})
+
+	// The new file sits in the existing directory under its new-key name
+	oldDocs, _ := oldNames.EncryptPath("/docs")
+	newFile, _ := newNames.EncryptFilename("new.txt")
+	if _, err := base.Stat(oldDocs + "/" + newFile); err != nil {
+		t.Errorf("new file not stored under the new key in the old directory: %v", err)
+	}
+	newFresh, _ := newNames.EncryptPath("/fresh/b.txt")
+	if _, err := base.Stat(newFresh); err != nil {
+		t.Errorf("new directory not stored under the new key: %v", err)
+	}
+
+	// Listings decrypt names under either key
+	entries, err := fs.ReadDir("/docs")
+	if err != nil {
+		t.Fatalf("failed to list directory: %v", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+	if len(names) != 2 || names[0] != "new.txt" || names[1] != "old" {
+		t.Errorf("listed %v, want [new.txt old]", names)
+	}
+
+	// Paths that mix keys decrypt component by component
+	mixed := oldDocs + "/" + newFile
+	if got, err := multi.DecryptPath(mixed); err != nil || got != "/docs/new.txt" {
+		t.Errorf("DecryptPath(%q) = %q, %v; want /docs/new.txt", mixed, got, err)
+	}
+
+	// Renaming moves a file to its new-key name
+	if err := fs.Rename("/top.txt", "/renamed.txt"); err != nil {
+		t.Fatalf("failed to rename: %v", err)
+	}
+	renamed, _ := newNames.EncryptPath("/renamed.txt")
+	if _, err := base.Stat(renamed); err != nil {
+		t.Errorf("renamed file not stored under the new key: %v", err)
+	}
+
+	// A filesystem with only the new key sees only the new names
+	newFS, err := New(base, newConfig(newNames))
+	if err != nil {
+		t.Fatalf("failed to create EncryptFS: %v", err)
+	}
+	defer newFS.Close()
+	if _, err := newFS.Stat("/docs/old/a.txt"); err == nil {
+		t.Error("old-key file found without the old key")
+	}
+	compareTree(t, newFS, "/", map[string][]byte{
+		"/fresh/b.txt": []byte("new b"),
+		"/renamed.txt": []byte("old top"),
+	})
+}
+
+func TestMultiKeyFilenameEncryptor_Validate(t *testing.T) {
+	if _, err := NewMultiKeyFilenameEncryptor("/"); err == nil {
+		t.Error("expected error for no encryptors")
+	}
+
+	names, err := NewDeterministicFilenameEncryptor(bytes.Repeat([]byte{0x01}, 32), false, "/")
+	if err != nil {
+		t.Fatalf("failed to create filename encryptor: %v", err)
+	}
+	config := &Config{
+		KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+			Memory:      64 * 1024,
+			Iterations:  1,
+			Parallelism: 2,
+		}),
+		FilenameEncryption: FilenameEncryptionRandom,
+		MetadataPath:       "/.metadata",
+		FilenameEncryptor:  names,
+	}
+	if err := config.Validate(); err == nil {
+		t.Error("expected error combining a filename encryptor with random filename encryption")
+	}
+}
+
+func TestMultiKeyFilenameEncryptor_Lookups(t *testing.T) {
+	oldNames, err := NewDeterministicFilenameEncryptor(bytes.Repeat([]byte{0x01}, 32), false, "/")
+	if err != nil {
+		t.Fatalf("failed to create old filename encryptor: %v", err)
+	}
+	newNames, err := NewDeterministicFilenameEncryptor(bytes.Repeat([]byte{0x02}, 32), false, "/")
+	if err != nil {
+		t.Fatalf("failed to create new filename encryptor: %v", err)
+	}
+	multi, err := NewMultiKeyFilenameEncryptor("/", newNames, oldNames)
+	if err != nil {
+		t.Fatalf("NewMultiKeyFilenameEncryptor failed: %v", err)
+	}
+	encrypt := func(enc FilenameEncryptor, name string) string {
+		t.Helper()
+		encrypted, err := enc.EncryptPath(name)
+		if err != nil {
+			t.Fatalf("EncryptPath(%s) failed: %v", name, err)
+		}
+		return encrypted
+	}
+
+	// The base filesystem holds a tree under the new key, and an old
+	// directory with a file renamed into it under the new key
+	existing := map[string]bool{}
+	for _, name := range []string{"/a", "/a/b", "/a/b/c.txt"} {
+		existing[encrypt(newNames, name)] = true
+	}
+	oldDir := encrypt(oldNames, "/old")
+	existing[oldDir] = true
+	mixed := oldDir + "/" + encrypt(newNames, "/d.txt")[1:]
+	existing[mixed] = true
+
+	for _, tc := range []struct {
+		name    string
+		want    string
+		lookups int
+	}{
+		{"/a/b/c.txt", encrypt(newNames, "/a/b/c.txt"), 1},
+		{"/a/b/new.txt", encrypt(newNames, "/a/b/new.txt"), 3},
+		{"/old", oldDir, 2},
+		{"/old/d.txt", mixed, 5},
+	} {
+		lookups := 0
+		got, err := multi.resolvePath(tc.name, func(encrypted string) bool {
+			lookups++
+			return existing[encrypted]
+		})
+		if err != nil || got != tc.want {
+			t.Errorf("resolvePath(%s) = %q, %v; want %q", tc.name, got, err, tc.want)
+		}
+		if lookups != tc.lookups {
+			t.Errorf("resolvePath(%s) looked up %d paths, want %d", tc.name, lookups, tc.lookups)
+		}
+	}
+}
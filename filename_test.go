@@ -1,10 +1,18 @@
 package encryptfs
 
 import (
+	"bytes"
 	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"os"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/absfs/absfs"
 	"github.com/absfs/memfs"
 )
 
@@ -129,6 +137,61 @@ func TestDeterministicFilenameEncryptor_PreserveExtensions(t *testing.T) {
 	}
 }
 
+func TestDeterministicFilenameEncryptor_MaxLength(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	enc, err := NewDeterministicFilenameEncryptor(key, false, "/")
+	if err != nil {
+		t.Fatalf("Failed to create encryptor: %v", err)
+	}
+
+	if _, err := enc.EncryptFilename(strings.Repeat("a", DefaultMaxFilenameLength)); err != nil {
+		t.Errorf("EncryptFilename rejected a name at the limit: %v", err)
+	}
+
+	var validationErr *ValidationError
+	_, err = enc.EncryptFilename(strings.Repeat("a", 1<<20))
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("EncryptFilename error = %v, want ValidationError", err)
+	}
+	if _, err := enc.EncryptPath("/dir/" + strings.Repeat("b", DefaultMaxFilenameLength+1)); !errors.As(err, &validationErr) {
+		t.Errorf("EncryptPath error = %v, want ValidationError", err)
+	}
+
+	// The limit is configurable, and a negative limit removes it
+	base, cleanup := setupTestFS(t)
+	defer cleanup()
+	fs, err := New(base, &Config{
+		KeyProvider:        NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{Memory: 64 * 1024, Iterations: 1, Parallelism: 2}),
+		FilenameEncryption: FilenameEncryptionDeterministic,
+		MaxFilenameLength:  8,
+	})
+	if err != nil {
+		t.Fatalf("failed to create EncryptFS: %v", err)
+	}
+	defer fs.Close()
+	if _, err := fs.Create("/too-long.txt"); !errors.As(err, &validationErr) {
+		t.Errorf("Create error = %v, want ValidationError", err)
+	}
+	file, err := fs.Create("/short")
+	if err != nil {
+		t.Fatalf("failed to create file within the limit: %v", err)
+	}
+	file.Close()
+
+	unlimited, err := NewFilenameEncryptor(&Config{
+		FilenameEncryption: FilenameEncryptionDeterministic,
+		MaxFilenameLength:  -1,
+	}, key, base)
+	if err != nil {
+		t.Fatalf("NewFilenameEncryptor failed: %v", err)
+	}
+	if _, err := unlimited.EncryptFilename(strings.Repeat("a", 4096)); err != nil {
+		t.Errorf("EncryptFilename without a limit failed: %v", err)
+	}
+}
+
 func TestDeterministicFilenameEncryptor_Paths(t *testing.T) {
 	key := make([]byte, 32)
 	rand.Read(key)
@@ -187,6 +250,119 @@ func TestDeterministicFilenameEncryptor_Paths(t *testing.T) {
 	}
 }
 
+func TestDeterministicFilenameEncryptor_Encodings(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	fs, err := memfs.NewFS()
+	if err != nil {
+		t.Fatalf("Failed to create memfs: %v", err)
+	}
+
+	tests := []struct {
+		encoding FilenameEncoding
+		alphabet string
+		length   func(n int) int // Encoded length of an n-byte ciphertext
+	}{
+		{FilenameEncodingBase64URL, "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_", func(n int) int { return (n*8 + 5) / 6 }},
+		{FilenameEncodingBase32, "abcdefghijklmnopqrstuvwxyz234567", func(n int) int { return (n*8 + 4) / 5 }},
+		{FilenameEncodingHex, "0123456789abcdef", func(n int) int { return n * 2 }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.encoding.String(), func(t *testing.T) {
+			enc, err := NewFilenameEncryptor(&Config{
+				FilenameEncryption: FilenameEncryptionDeterministic,
+				FilenameEncoding:   tt.encoding,
+			}, key, fs)
+			if err != nil {
+				t.Fatalf("NewFilenameEncryptor failed: %v", err)
+			}
+
+			for _, plaintext := range []string{"a", "report.txt", "文件名.txt", strings.Repeat("x", 100)} {
+				encrypted, err := enc.EncryptFilename(plaintext)
+				if err != nil {
+					t.Fatalf("EncryptFilename(%q) failed: %v", plaintext, err)
+				}
+
+				// SIV adds a 16-byte tag to the name
+				if want := tt.length(len(plaintext) + 16); len(encrypted) != want {
+					t.Errorf("len(EncryptFilename(%q)) = %d, want %d", plaintext, len(encrypted), want)
+				}
+				if i := strings.IndexFunc(encrypted, func(r rune) bool {
+					return !strings.ContainsRune(tt.alphabet, r)
+				}); i >= 0 {
+					t.Errorf("EncryptFilename(%q) = %q contains %q outside the alphabet", plaintext, encrypted, encrypted[i])
+				}
+
+				decrypted, err := enc.DecryptFilename(encrypted)
+				if err != nil {
+					t.Fatalf("DecryptFilename(%q) failed: %v", encrypted, err)
+				}
+				if decrypted != plaintext {
+					t.Errorf("Round-trip failed: got %q, want %q", decrypted, plaintext)
+				}
+
+				// Case-insensitive encodings survive a filesystem that
+				// changes the case of names
+				if tt.encoding != FilenameEncodingBase64URL {
+					decrypted, err := enc.DecryptFilename(strings.ToUpper(encrypted))
+					if err != nil {
+						t.Fatalf("DecryptFilename(%q) failed: %v", strings.ToUpper(encrypted), err)
+					}
+					if decrypted != plaintext {
+						t.Errorf("Upper-case round-trip failed: got %q, want %q", decrypted, plaintext)
+					}
+				}
+			}
+		})
+	}
+}
+
+// TestEncryptFS_CaseInsensitiveBase tests that names differing only in
+// case stay distinct files on a case-insensitive base filesystem when a
+// case-insensitive filename encoding is used
+func TestEncryptFS_CaseInsensitiveBase(t *testing.T) {
+	base := newFakeFS()
+	base.caseInsensitive = true
+
+	fs, err := New(base, &Config{
+		Cipher: CipherAES256GCM,
+		KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+			Memory:      64 * 1024,
+			Iterations:  1,
+			Parallelism: 2,
+		}),
+		FilenameEncryption: FilenameEncryptionDeterministic,
+		FilenameEncoding:   FilenameEncodingBase32,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create EncryptFS: %v", err)
+	}
+
+	names := []string{"/Report.txt", "/report.txt", "/REPORT.TXT"}
+	for _, name := range names {
+		file, err := fs.Create(name)
+		if err != nil {
+			t.Fatalf("Create(%q) failed: %v", name, err)
+		}
+		file.Write([]byte("content of " + name))
+		file.Close()
+	}
+
+	for _, name := range names {
+		file, err := fs.Open(name)
+		if err != nil {
+			t.Fatalf("Open(%q) failed: %v", name, err)
+		}
+		data, _ := io.ReadAll(file)
+		file.Close()
+		if string(data) != "content of "+name {
+			t.Errorf("Content of %q = %q", name, data)
+		}
+	}
+}
+
 func TestRandomFilenameEncryptor(t *testing.T) {
 	key := make([]byte, 32)
 	rand.Read(key)
@@ -251,6 +427,222 @@ func TestRandomFilenameEncryptor_Consistency(t *testing.T) {
 	}
 }
 
+func TestRandomFilenameEncryptor_IDGenerator(t *testing.T) {
+	keyProvider := NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+		Memory:      64 * 1024,
+		Iterations:  1,
+		Parallelism: 2,
+	})
+
+	for _, flatten := range []bool{false, true} {
+		base, cleanup := setupTestFS(t)
+		defer cleanup()
+		next := 0
+		fs, err := New(base, &Config{
+			Cipher:             CipherAES256GCM,
+			KeyProvider:        keyProvider,
+			FilenameEncryption: FilenameEncryptionRandom,
+			MetadataPath:       "/.metadata",
+			FlattenDirectories: flatten,
+			FilenameIDGenerator: func() string {
+				next++
+				return fmt.Sprintf("id-%03d", next)
+			},
+		})
+		if err != nil {
+			t.Fatalf("failed to create EncryptFS: %v", err)
+		}
+
+		if err := fs.Mkdir("/docs", 0755); err != nil {
+			t.Fatalf("Mkdir failed: %v", err)
+		}
+		tree := map[string][]byte{"/docs/a.txt": []byte("a"), "/b.txt": []byte("b")}
+		if err := fs.WriteFiles(tree); err != nil {
+			t.Fatalf("WriteFiles failed: %v", err)
+		}
+		compareTree(t, fs, "/", tree)
+
+		// Every name in the mapping came from the generator
+		var metadata *FilenameMetadata
+		switch enc := fs.filenameEncryptor.(type) {
+		case *randomFilenameEncryptor:
+			metadata = enc.metadata
+		case *flatNamespace:
+			metadata = enc.metadata
+		}
+		files, _ := metadata.Snapshot()
+		if len(files) == 0 {
+			t.Fatalf("flatten=%v: no mappings recorded", flatten)
+		}
+		for plaintext, encrypted := range files {
+			if !strings.HasPrefix(strings.TrimPrefix(encrypted, "/"), "id-") {
+				t.Errorf("flatten=%v: %s stored as %q, want a generated ID", flatten, plaintext, encrypted)
+			}
+		}
+		if err := fs.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+	}
+}
+
+func TestRandomFilenameEncryptor_IDCollision(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	fs, _ := memfs.NewFS()
+
+	newEncryptor := func(ids ...string) (FilenameEncryptor, *int) {
+		t.Helper()
+		calls := 0
+		enc, err := NewFilenameEncryptor(&Config{
+			FilenameEncryption: FilenameEncryptionRandom,
+			FilenameIDGenerator: func() string {
+				id := ids[min(calls, len(ids)-1)]
+				calls++
+				return id
+			},
+		}, key, fs)
+		if err != nil {
+			t.Fatalf("NewFilenameEncryptor failed: %v", err)
+		}
+		return enc, &calls
+	}
+
+	// An ID already mapped to another name is replaced by the next one
+	enc, calls := newEncryptor("taken", "taken", "fresh")
+	if encrypted, err := enc.EncryptFilename("first.txt"); err != nil || encrypted != "taken" {
+		t.Fatalf("EncryptFilename(first.txt) = %q, %v; want taken", encrypted, err)
+	}
+	encrypted, err := enc.EncryptFilename("second.txt")
+	if err != nil || encrypted != "fresh" {
+		t.Fatalf("EncryptFilename(second.txt) = %q, %v; want fresh", encrypted, err)
+	}
+	if *calls != 3 {
+		t.Errorf("generator called %d times, want 3", *calls)
+	}
+	for ciphertext, want := range map[string]string{"taken": "first.txt", "fresh": "second.txt"} {
+		if got, err := enc.DecryptFilename(ciphertext); err != nil || got != want {
+			t.Errorf("DecryptFilename(%q) = %q, %v; want %q", ciphertext, got, err, want)
+		}
+	}
+
+	// A generator that only returns IDs in use gives up
+	enc, calls = newEncryptor("same")
+	enc.EncryptFilename("first.txt")
+	if _, err := enc.EncryptFilename("second.txt"); err == nil {
+		t.Error("expected an error once every generated ID is in use")
+	}
+	if *calls != 1+maxFilenameIDAttempts {
+		t.Errorf("generator called %d times, want %d", *calls, 1+maxFilenameIDAttempts)
+	}
+
+	// IDs that are not safe to store are rejected
+	for _, id := range []string{"", ".hidden", "..", "a/b", "nul\x00"} {
+		enc, _ = newEncryptor(id)
+		var verr *ValidationError
+		if _, err := enc.EncryptFilename("file.txt"); !errors.As(err, &verr) {
+			t.Errorf("generated ID %q: error = %v, want a ValidationError", id, err)
+		}
+	}
+}
+
+func TestRandomFilenameEncryptor_OnDiskCollision(t *testing.T) {
+	keyProvider := NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+		Memory:      64 * 1024,
+		Iterations:  1,
+		Parallelism: 2,
+	})
+
+	newFS := func(t *testing.T, base absfs.FileSystem, flatten bool, ids *[]string) (*EncryptFS, *int) {
+		t.Helper()
+		calls := 0
+		fs, err := New(base, &Config{
+			Cipher:             CipherAES256GCM,
+			KeyProvider:        keyProvider,
+			FilenameEncryption: FilenameEncryptionRandom,
+			MetadataPath:       "/.metadata",
+			FlattenDirectories: flatten,
+			FilenameIDGenerator: func() string {
+				id := (*ids)[min(calls, len(*ids)-1)]
+				calls++
+				return id
+			},
+		})
+		if err != nil {
+			t.Fatalf("failed to create EncryptFS: %v", err)
+		}
+		return fs, &calls
+	}
+
+	// A file on the base filesystem without a mapping, in the directory
+	// the new name is created in, is never taken over
+	for _, flatten := range []bool{false, true} {
+		base, cleanup := setupTestFS(t)
+		defer cleanup()
+		orphan := []byte("not in the metadata")
+		raw, err := base.Create("/orphan")
+		if err != nil {
+			t.Fatalf("failed to create orphan: %v", err)
+		}
+		raw.Write(orphan)
+		raw.Close()
+
+		ids := []string{"orphan", "orphan", "fresh"}
+		fs, calls := newFS(t, base, flatten, &ids)
+		defer fs.Close()
+		if err := fs.WriteFiles(map[string][]byte{"/file.txt": []byte("new")}); err != nil {
+			t.Fatalf("flatten=%v: WriteFiles failed: %v", flatten, err)
+		}
+		if *calls != 3 {
+			t.Errorf("flatten=%v: generator called %d times, want 3", flatten, *calls)
+		}
+		if _, err := base.Stat("/fresh"); err != nil {
+			t.Errorf("flatten=%v: file not stored under the regenerated ID: %v", flatten, err)
+		}
+		raw, err = base.Open("/orphan")
+		if err != nil {
+			t.Fatalf("flatten=%v: orphan removed: %v", flatten, err)
+		}
+		data, _ := io.ReadAll(raw)
+		raw.Close()
+		if !bytes.Equal(data, orphan) {
+			t.Errorf("flatten=%v: orphan = %q, want it untouched", flatten, data)
+		}
+		compareTree(t, fs, "/", map[string][]byte{"/file.txt": []byte("new")})
+
+		// A generator that only returns names on disk gives up
+		ids = []string{"orphan"}
+		if _, err := fs.Create("/other.txt"); err == nil {
+			t.Errorf("flatten=%v: expected an error once every generated ID exists on disk", flatten)
+		}
+	}
+
+	// A name keeps its ID in every directory, so an ID mapped in another
+	// directory is replaced even though the target has no entry
+	base2, cleanup2 := setupTestFS(t)
+	defer cleanup2()
+	ids := []string{"dir", "taken", "taken", "fresh"}
+	fs2, calls := newFS(t, base2, false, &ids)
+	defer fs2.Close()
+	if err := fs2.Mkdir("/dir", 0755); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+	tree := map[string][]byte{"/dir/a.txt": []byte("a")}
+	if err := fs2.WriteFiles(tree); err != nil {
+		t.Fatalf("WriteFiles failed: %v", err)
+	}
+	tree["/b.txt"] = []byte("b")
+	if err := fs2.WriteFiles(map[string][]byte{"/b.txt": tree["/b.txt"]}); err != nil {
+		t.Fatalf("WriteFiles failed: %v", err)
+	}
+	if *calls != 4 {
+		t.Errorf("generator called %d times, want 4", *calls)
+	}
+	if _, err := base2.Stat("/fresh"); err != nil {
+		t.Errorf("file not stored under the regenerated ID: %v", err)
+	}
+	compareTree(t, fs2, "/", tree)
+}
+
 func TestFilenameMetadata_SaveLoad(t *testing.T) {
 	fs, _ := memfs.NewFS()
 	metadataPath := "/.metadata.json"
@@ -286,6 +678,239 @@ func TestFilenameMetadata_SaveLoad(t *testing.T) {
 	}
 }
 
+// tornWriteFS writes only half of every write to its files before failing,
+// as a crash partway through a write would
+type tornWriteFS struct {
+	absfs.FileSystem
+}
+
+func (f *tornWriteFS) Create(name string) (absfs.File, error) {
+	return f.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (f *tornWriteFS) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	file, err := f.FileSystem.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &tornWriteFile{File: file}, nil
+}
+
+type tornWriteFile struct {
+	absfs.File
+}
+
+func (f *tornWriteFile) Write(p []byte) (int, error) {
+	n, _ := f.File.Write(p[:len(p)/2])
+	return n, errors.New("simulated crash")
+}
+
+func TestFilenameMetadata_SaveReplaces(t *testing.T) {
+	fs, _ := memfs.NewFS()
+	metadataPath := "/.metadata.json"
+
+	metadata := NewFilenameMetadata()
+	metadata.Add("encrypted1", "plain1.txt")
+	if err := metadata.Save(fs, metadataPath); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	// A save that fails partway leaves the previous file whole
+	metadata.Add("encrypted2", "plain2.txt")
+	if err := metadata.Save(&tornWriteFS{fs}, metadataPath); err == nil {
+		t.Fatal("Save succeeded although the write failed")
+	}
+	loaded := NewFilenameMetadata()
+	if err := loaded.Load(fs, metadataPath); err != nil {
+		t.Fatalf("Load after a failed save failed: %v", err)
+	}
+	if plain, ok := loaded.Get("encrypted1"); !ok || plain != "plain1.txt" {
+		t.Errorf("mapping lost by a failed save: got %q, %v", plain, ok)
+	}
+	if _, err := fs.Stat(metadataPath + metadataTempSuffix); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+}
+
+func TestFilenameMetadata_LoadPolicy(t *testing.T) {
+	base, _ := memfs.NewFS()
+	config := func(policy MetadataLoadPolicy) *Config {
+		return &Config{
+			Cipher:             CipherAES256GCM,
+			FilenameEncryption: FilenameEncryptionRandom,
+			MetadataPath:       "/.metadata.json",
+			MetadataLoadPolicy: policy,
+			KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+				Memory:      64 * 1024,
+				Iterations:  1,
+				Parallelism: 2,
+			}),
+		}
+	}
+
+	fs, err := New(base, config(MetadataFailClosed))
+	if err != nil {
+		t.Fatalf("failed to create EncryptFS: %v", err)
+	}
+	file, err := fs.Create("/file.txt")
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	file.Close()
+	if err := fs.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// Corrupt the metadata database
+	corrupt := []byte("{\"mappings\": {")
+	metadata, err := base.OpenFile("/.metadata.json", os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		t.Fatalf("failed to open metadata: %v", err)
+	}
+	metadata.Write(corrupt)
+	metadata.Close()
+
+	// The default policy refuses to start and leaves the database alone
+	if _, err := New(base, config(MetadataFailClosed)); err == nil {
+		t.Error("New succeeded with a corrupt metadata database")
+	}
+	data, err := readBaseFile(base, "/.metadata.json")
+	if err != nil || string(data) != string(corrupt) {
+		t.Errorf("metadata database changed after a failed load: %q, %v", data, err)
+	}
+
+	// Starting fresh loses the mappings, but keeps the unreadable
+	// database aside rather than saving over it
+	fs, err = New(base, config(MetadataStartFresh))
+	if err != nil {
+		t.Fatalf("New with MetadataStartFresh failed: %v", err)
+	}
+	if _, err := fs.Stat("/file.txt"); !os.IsNotExist(err) {
+		t.Errorf("Stat after starting fresh: got %v, want not exist", err)
+	}
+	if !fs.isInternalPath("/.metadata.json" + metadataCorruptSuffix) {
+		t.Error("the set-aside database is not treated as internal")
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	data, err = readBaseFile(base, "/.metadata.json"+metadataCorruptSuffix)
+	if err != nil || string(data) != string(corrupt) {
+		t.Errorf("set-aside database = %q, %v; want the original bytes %q", data, err, corrupt)
+	}
+}
+
+// TestFilenameMetadata_Concurrent creates files through random filename
+// encryption while the metadata is saved, loaded and listed. Run with -race.
+func TestFilenameMetadata_Concurrent(t *testing.T) {
+	base, cleanup := setupTestFS(t)
+	defer cleanup()
+
+	fs, err := New(base, &Config{
+		Cipher:             CipherAES256GCM,
+		FilenameEncryption: FilenameEncryptionRandom,
+		MetadataPath:       "/.metadata.json",
+		KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+			Memory:      64 * 1024,
+			Iterations:  1,
+			Parallelism: 2,
+		}),
+	})
+	if err != nil {
+		t.Fatalf("failed to create EncryptFS: %v", err)
+	}
+	defer fs.Close()
+	metadata := fs.metadata()
+
+	// A saved database to load from while names are being added
+	snapshotFS, _ := memfs.NewFS()
+	snapshot := NewFilenameMetadata()
+	snapshot.Add("loaded-id", "loaded.txt")
+	if err := snapshot.Save(snapshotFS, "/snapshot.json"); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	const writers, files = 8, 10
+	var wg sync.WaitGroup
+	errs := make(chan error, writers*(files+1)+3)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			// Every writer also creates the same name, which must get a
+			// single encrypted name
+			names := []string{"/shared.txt"}
+			for i := 0; i < files; i++ {
+				names = append(names, fmt.Sprintf("/w%d-%d.txt", w, i))
+			}
+			for _, name := range names {
+				file, err := fs.Create(name)
+				if err != nil {
+					errs <- err
+					continue
+				}
+				file.Write([]byte(name))
+				file.Close()
+			}
+		}(w)
+	}
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			if err := metadata.Save(base, "/.metadata.json"); err != nil {
+				errs <- err
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			if err := metadata.Load(snapshotFS, "/snapshot.json"); err != nil {
+				errs <- err
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			if _, err := fs.ReadDir("/"); err != nil {
+				errs <- err
+			}
+		}
+	}()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	entries, err := fs.ReadDir("/")
+	if err != nil {
+		t.Fatalf("ReadDir failed: %v", err)
+	}
+	if want := writers*files + 1; len(entries) != want {
+		t.Errorf("ReadDir returned %d entries, want %d", len(entries), want)
+	}
+	if plain, ok := metadata.Get("loaded-id"); !ok || plain != "loaded.txt" {
+		t.Errorf("loaded mapping = %q, %v, want %q", plain, ok, "loaded.txt")
+	}
+
+	// The last save holds every name
+	if err := metadata.Save(base, "/.metadata.json"); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	saved := NewFilenameMetadata()
+	if err := saved.Load(base, "/.metadata.json"); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	for _, entry := range entries {
+		if _, ok := saved.GetReverse(entry.Name()); !ok {
+			t.Errorf("saved metadata is missing %s", entry.Name())
+		}
+	}
+}
+
 func TestNoOpFilenameEncryptor(t *testing.T) {
 	enc := &noOpFilenameEncryptor{}
 
@@ -372,6 +997,58 @@ func TestNewFilenameEncryptor(t *testing.T) {
 	}
 }
 
+func TestFilenameEncryptor_RejectsInvalidNames(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	for _, separator := range []string{"/", "\\"} {
+		deterministic, err := NewDeterministicFilenameEncryptor(key, true, separator)
+		if err != nil {
+			t.Fatalf("Failed to create encryptor: %v", err)
+		}
+		random, err := NewRandomFilenameEncryptor(key, NewFilenameMetadata(), separator)
+		if err != nil {
+			t.Fatalf("Failed to create encryptor: %v", err)
+		}
+
+		for _, enc := range []FilenameEncryptor{deterministic, random} {
+			for _, name := range []string{
+				"nul\x00byte.txt",
+				"embedded/slash.txt",
+				"embedded" + separator + "separator.txt",
+				"new\nline.txt",
+				"del\x7f.txt",
+			} {
+				_, err := enc.EncryptFilename(name)
+				var verr *ValidationError
+				if !errors.As(err, &verr) {
+					t.Errorf("%T(%q).EncryptFilename(%q) error = %v, want a ValidationError", enc, separator, name, err)
+				}
+			}
+
+			// Reserved navigation names pass through unencrypted
+			for _, name := range []string{".", ".."} {
+				if got, err := enc.EncryptFilename(name); err != nil || got != name {
+					t.Errorf("%T.EncryptFilename(%q) = %q, %v, want it unchanged", enc, name, got, err)
+				}
+			}
+		}
+
+		// A path is split before its components are validated
+		if _, err := random.EncryptPath("dir" + separator + "file.txt"); err != nil {
+			t.Errorf("EncryptPath with separator %q failed: %v", separator, err)
+		}
+	}
+
+	// Random mode records no mapping for a rejected name
+	metadata := NewFilenameMetadata()
+	random, _ := NewRandomFilenameEncryptor(key, metadata, "/")
+	random.EncryptFilename("bad\x00name")
+	if files, _ := metadata.Snapshot(); len(files) != 0 {
+		t.Errorf("metadata has %d mappings after a rejected name, want 0", len(files))
+	}
+}
+
 func BenchmarkDeterministicFilenameEncryptor(b *testing.B) {
 	key := make([]byte, 32)
 	rand.Read(key)
@@ -380,6 +1057,7 @@ func BenchmarkDeterministicFilenameEncryptor(b *testing.B) {
 	plaintext := "benchmark-file.txt"
 
 	b.Run("Encrypt", func(b *testing.B) {
+		b.ReportAllocs()
 		for i := 0; i < b.N; i++ {
 			enc.EncryptFilename(plaintext)
 		}
@@ -388,10 +1066,21 @@ func BenchmarkDeterministicFilenameEncryptor(b *testing.B) {
 	encrypted, _ := enc.EncryptFilename(plaintext)
 
 	b.Run("Decrypt", func(b *testing.B) {
+		b.ReportAllocs()
 		for i := 0; i < b.N; i++ {
 			enc.DecryptFilename(encrypted)
 		}
 	})
+
+	// A path as a tree walk encrypts it, one component after another
+	path := "/home/user/projects/encryptfs/testdata/golden/benchmark-file.txt"
+
+	b.Run("EncryptPath", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			enc.EncryptPath(path)
+		}
+	})
 }
 
 func BenchmarkRandomFilenameEncryptor(b *testing.B) {
@@ -416,3 +1105,228 @@ func BenchmarkRandomFilenameEncryptor(b *testing.B) {
 		}
 	})
 }
+
+// backslashFS presents a filesystem with Windows-style separators. Paths it
+// receives must use only backslashes; they are translated for the wrapped
+// filesystem, which uses forward slashes.
+type backslashFS struct {
+	absfs.FileSystem
+}
+
+var errForwardSlash = errors.New("forward slash in path")
+
+func (fs *backslashFS) path(op, name string) (string, error) {
+	if strings.Contains(name, "/") {
+		return "", &os.PathError{Op: op, Path: name, Err: errForwardSlash}
+	}
+	return strings.ReplaceAll(name, "\\", "/"), nil
+}
+
+func (fs *backslashFS) Separator() uint8 {
+	return '\\'
+}
+
+func (fs *backslashFS) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	p, err := fs.path("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return fs.FileSystem.OpenFile(p, flag, perm)
+}
+
+func (fs *backslashFS) Open(name string) (absfs.File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (fs *backslashFS) Create(name string) (absfs.File, error) {
+	return fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (fs *backslashFS) Mkdir(name string, perm os.FileMode) error {
+	p, err := fs.path("mkdir", name)
+	if err != nil {
+		return err
+	}
+	return fs.FileSystem.Mkdir(p, perm)
+}
+
+func (fs *backslashFS) MkdirAll(name string, perm os.FileMode) error {
+	p, err := fs.path("mkdir", name)
+	if err != nil {
+		return err
+	}
+	return fs.FileSystem.MkdirAll(p, perm)
+}
+
+func (fs *backslashFS) Remove(name string) error {
+	p, err := fs.path("remove", name)
+	if err != nil {
+		return err
+	}
+	return fs.FileSystem.Remove(p)
+}
+
+func (fs *backslashFS) RemoveAll(name string) error {
+	p, err := fs.path("remove", name)
+	if err != nil {
+		return err
+	}
+	return fs.FileSystem.RemoveAll(p)
+}
+
+func (fs *backslashFS) Rename(oldpath, newpath string) error {
+	o, err := fs.path("rename", oldpath)
+	if err != nil {
+		return err
+	}
+	n, err := fs.path("rename", newpath)
+	if err != nil {
+		return err
+	}
+	return fs.FileSystem.Rename(o, n)
+}
+
+func (fs *backslashFS) Stat(name string) (os.FileInfo, error) {
+	p, err := fs.path("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return fs.FileSystem.Stat(p)
+}
+
+func (fs *backslashFS) Chmod(name string, mode os.FileMode) error {
+	p, err := fs.path("chmod", name)
+	if err != nil {
+		return err
+	}
+	return fs.FileSystem.Chmod(p, mode)
+}
+
+func (fs *backslashFS) Chtimes(name string, atime, mtime time.Time) error {
+	p, err := fs.path("chtimes", name)
+	if err != nil {
+		return err
+	}
+	return fs.FileSystem.Chtimes(p, atime, mtime)
+}
+
+func (fs *backslashFS) Chown(name string, uid, gid int) error {
+	p, err := fs.path("chown", name)
+	if err != nil {
+		return err
+	}
+	return fs.FileSystem.Chown(p, uid, gid)
+}
+
+func (fs *backslashFS) Truncate(name string, size int64) error {
+	p, err := fs.path("truncate", name)
+	if err != nil {
+		return err
+	}
+	return fs.FileSystem.Truncate(p, size)
+}
+
+func TestFilenameEncryptor_BackslashSeparator(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	deterministic, err := NewDeterministicFilenameEncryptor(key, true, "\\")
+	if err != nil {
+		t.Fatalf("NewDeterministicFilenameEncryptor failed: %v", err)
+	}
+	random, err := NewRandomFilenameEncryptor(key, NewFilenameMetadata(), "\\")
+	if err != nil {
+		t.Fatalf("NewRandomFilenameEncryptor failed: %v", err)
+	}
+
+	encryptors := map[string]FilenameEncryptor{
+		"deterministic": deterministic,
+		"random":        random,
+	}
+
+	for name, enc := range encryptors {
+		t.Run(name, func(t *testing.T) {
+			for _, input := range []string{
+				"\\docs\\reports\\q1.txt",
+				"/docs/reports/q1.txt",
+				"\\docs/reports\\q1.txt",
+			} {
+				encrypted, err := enc.EncryptPath(input)
+				if err != nil {
+					t.Fatalf("EncryptPath(%q) failed: %v", input, err)
+				}
+				if strings.Contains(encrypted, "/") {
+					t.Errorf("EncryptPath(%q) = %q contains a forward slash", input, encrypted)
+				}
+				if parts := strings.Split(encrypted, "\\"); len(parts) != 4 {
+					t.Errorf("EncryptPath(%q) = %q has %d components, want 4", input, encrypted, len(parts))
+				}
+
+				decrypted, err := enc.DecryptPath(encrypted)
+				if err != nil {
+					t.Fatalf("DecryptPath(%q) failed: %v", encrypted, err)
+				}
+				if decrypted != "\\docs\\reports\\q1.txt" {
+					t.Errorf("DecryptPath(EncryptPath(%q)) = %q, want %q", input, decrypted, "\\docs\\reports\\q1.txt")
+				}
+			}
+		})
+	}
+}
+
+func TestEncryptFS_BackslashSeparator(t *testing.T) {
+	mem, err := memfs.NewFS()
+	if err != nil {
+		t.Fatalf("Failed to create memfs: %v", err)
+	}
+
+	fs, err := New(&backslashFS{FileSystem: mem}, &Config{
+		Cipher: CipherAES256GCM,
+		KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+			Memory:      64 * 1024,
+			Iterations:  1,
+			Parallelism: 2,
+		}),
+		FilenameEncryption: FilenameEncryptionDeterministic,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create EncryptFS: %v", err)
+	}
+
+	if err := fs.MkdirAll("\\docs/reports", 0755); err != nil {
+		t.Fatalf("MkdirAll failed: %v", err)
+	}
+
+	file, err := fs.Create("/docs\\reports/q1.txt")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	file.Write([]byte("quarterly numbers"))
+	file.Close()
+
+	file, err = fs.Open("\\docs\\reports\\q1.txt")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	data, _ := io.ReadAll(file)
+	file.Close()
+	if string(data) != "quarterly numbers" {
+		t.Errorf("Content = %q, want %q", string(data), "quarterly numbers")
+	}
+
+	info, err := fs.Stat("/docs/reports/q1.txt")
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if info.Name() != "q1.txt" {
+		t.Errorf("Stat().Name() = %q, want %q", info.Name(), "q1.txt")
+	}
+
+	entries, err := fs.ReadDir("/docs")
+	if err != nil {
+		t.Fatalf("ReadDir failed: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "reports" {
+		t.Errorf("ReadDir(/docs) = %v, want [reports]", entries)
+	}
+}
@@ -0,0 +1,399 @@
+package encryptfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/absfs/absfs"
+)
+
+// errNotDir, errIsDir, errDirNotEmpty and errRenameIntoSelf mirror the
+// errors the os package reports for the equivalent conditions on a real
+// directory tree
+var (
+	errNotDir         = errors.New("not a directory")
+	errIsDir          = errors.New("is a directory")
+	errDirNotEmpty    = errors.New("directory not empty")
+	errRenameIntoSelf = errors.New("cannot move a directory into itself")
+)
+
+// flatNamespace stores every file as a UUID-named blob in the root of the
+// base filesystem while the metadata database records the logical plaintext
+// tree. Directories exist only in the metadata, so the on-disk layout reveals
+// nothing about depth or fan-out.
+//
+// flatNamespace implements FilenameEncryptor for path translation and
+// provides the directory operations EncryptFS delegates to when
+// Config.FlattenDirectories is set.
+type flatNamespace struct {
+	metadata   *FilenameMetadata
+	separator  string
+	generateID func() string // Config.FilenameIDGenerator; nil for UUIDs
+	random     io.Reader     // Config.RandSource for UUIDs; nil for crypto/rand
+	mu         sync.Mutex    // Serializes multi-step namespace changes
+}
+
+// newFlatNamespace creates a flat namespace backed by the given metadata
+func newFlatNamespace(metadata *FilenameMetadata, separator string) *flatNamespace {
+	return &flatNamespace{
+		metadata:  metadata,
+		separator: separator,
+	}
+}
+
+// clean normalizes a logical path to an absolute, separator-delimited form
+func (f *flatNamespace) clean(name string) string {
+	p := path.Clean("/" + strings.ReplaceAll(name, f.separator, "/"))
+	return strings.ReplaceAll(p, "/", f.separator)
+}
+
+// parent returns the parent of a cleaned logical path
+func (f *flatNamespace) parent(name string) string {
+	i := strings.LastIndex(name, f.separator)
+	if i <= 0 {
+		return f.separator
+	}
+	return name[:i]
+}
+
+// within reports whether name is root itself or lies beneath it
+func (f *flatNamespace) within(root, name string) bool {
+	if root == f.separator {
+		return true
+	}
+	return name == root || strings.HasPrefix(name, root+f.separator)
+}
+
+// isDir reports whether a cleaned logical path is a directory
+func (f *flatNamespace) isDir(name string) bool {
+	if name == f.separator {
+		return true
+	}
+	_, ok := f.metadata.GetDirectory(name)
+	return ok
+}
+
+// EncryptFilename looks up the blob name for a logical path
+func (f *flatNamespace) EncryptFilename(plaintext string) (string, error) {
+	return f.EncryptPath(plaintext)
+}
+
+// DecryptFilename looks up the logical path for a blob name
+func (f *flatNamespace) DecryptFilename(ciphertext string) (string, error) {
+	return f.DecryptPath(ciphertext)
+}
+
+// EncryptPath returns the blob path of an existing file. Unknown paths are
+// reported as not existing; new files are allocated through create.
+func (f *flatNamespace) EncryptPath(plaintext string) (string, error) {
+	p := f.clean(plaintext)
+	if p == f.separator {
+		return f.separator, nil
+	}
+
+	encrypted, ok := f.metadata.GetReverse(p)
+	if !ok {
+		return "", &os.PathError{Op: "lookup", Path: plaintext, Err: os.ErrNotExist}
+	}
+	return encrypted, nil
+}
+
+// DecryptPath returns the logical path of a blob
+func (f *flatNamespace) DecryptPath(ciphertext string) (string, error) {
+	if ciphertext == "" || ciphertext == f.separator {
+		return f.separator, nil
+	}
+
+	plaintext, ok := f.metadata.Get(ciphertext)
+	if !ok {
+		return "", fmt.Errorf("no mapping found for encrypted path: %s", ciphertext)
+	}
+	return plaintext, nil
+}
+
+// create returns the blob path for a file, allocating a new ID if the file
+// does not exist yet. created reports whether a new mapping was added. IDs
+// whose blob path is mapped already, or for which exists reports an entry
+// on the base filesystem, are replaced by new ones.
+func (f *flatNamespace) create(name string, exists func(encrypted string) bool) (encrypted string, created bool, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	p := f.clean(name)
+	if f.isDir(p) {
+		return "", false, &os.PathError{Op: "open", Path: name, Err: errIsDir}
+	}
+	if encrypted, ok := f.metadata.GetReverse(p); ok {
+		return encrypted, false, nil
+	}
+	if !f.isDir(f.parent(p)) {
+		return "", false, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+
+	for attempt := 0; attempt < maxFilenameIDAttempts; attempt++ {
+		id, err := newFilenameID(f.generateID, f.random, f.separator)
+		if err != nil {
+			return "", false, err
+		}
+		if exists(f.separator + id) {
+			continue
+		}
+		if encrypted, ok := f.metadata.addIfAbsent(f.separator+id, p); ok {
+			return encrypted, true, nil
+		}
+	}
+	return "", false, errFilenameIDsExhausted(p)
+}
+
+// mkdir records a single logical directory
+func (f *flatNamespace) mkdir(name string, perm os.FileMode) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	p := f.clean(name)
+	if _, isFile := f.metadata.GetReverse(p); isFile || f.isDir(p) {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+	if !f.isDir(f.parent(p)) {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrNotExist}
+	}
+
+	f.metadata.AddDirectory(p, perm.Perm())
+	return nil
+}
+
+// mkdirAll records a logical directory and any missing parents
+func (f *flatNamespace) mkdirAll(name string, perm os.FileMode) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	p := f.clean(name)
+	if p == f.separator {
+		return nil
+	}
+
+	current := ""
+	for _, part := range strings.Split(strings.TrimPrefix(p, f.separator), f.separator) {
+		current += f.separator + part
+		if _, isFile := f.metadata.GetReverse(current); isFile {
+			return &os.PathError{Op: "mkdir", Path: current, Err: errNotDir}
+		}
+		if !f.isDir(current) {
+			f.metadata.AddDirectory(current, perm.Perm())
+		}
+	}
+	return nil
+}
+
+// remove deletes a file blob or an empty logical directory
+func (f *flatNamespace) remove(base absfs.FileSystem, name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	p := f.clean(name)
+	if p == f.separator {
+		return &os.PathError{Op: "remove", Path: name, Err: errDirNotEmpty}
+	}
+
+	if f.isDir(p) {
+		files, dirs := f.metadata.Snapshot()
+		for child := range files {
+			if f.parent(child) == p {
+				return &os.PathError{Op: "remove", Path: name, Err: errDirNotEmpty}
+			}
+		}
+		for child := range dirs {
+			if child != p && f.parent(child) == p {
+				return &os.PathError{Op: "remove", Path: name, Err: errDirNotEmpty}
+			}
+		}
+		f.metadata.RemoveDirectory(p)
+		return nil
+	}
+
+	encrypted, ok := f.metadata.GetReverse(p)
+	if !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	if err := base.Remove(encrypted); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := removeXattrs(base, encrypted); err != nil {
+		return err
+	}
+	f.metadata.Remove(encrypted)
+	return nil
+}
+
+// removeAll deletes a logical path and everything beneath it
+func (f *flatNamespace) removeAll(base absfs.FileSystem, name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	p := f.clean(name)
+	files, dirs := f.metadata.Snapshot()
+
+	for plaintext, encrypted := range files {
+		if !f.within(p, plaintext) {
+			continue
+		}
+		if err := base.Remove(encrypted); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := removeXattrs(base, encrypted); err != nil {
+			return err
+		}
+		f.metadata.Remove(encrypted)
+	}
+	for dir := range dirs {
+		if f.within(p, dir) {
+			f.metadata.RemoveDirectory(dir)
+		}
+	}
+	return nil
+}
+
+// rename moves a file or directory within the logical tree. No blobs move on
+// the base filesystem; only the metadata changes.
+func (f *flatNamespace) rename(base absfs.FileSystem, oldpath, newpath string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	o, n := f.clean(oldpath), f.clean(newpath)
+	linkErr := func(err error) error {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: err}
+	}
+
+	if o == n {
+		return nil
+	}
+	if !f.isDir(f.parent(n)) {
+		return linkErr(os.ErrNotExist)
+	}
+
+	if f.isDir(o) {
+		if o == f.separator || f.within(o, n) {
+			return linkErr(errRenameIntoSelf)
+		}
+		if _, isFile := f.metadata.GetReverse(n); isFile || f.isDir(n) {
+			return linkErr(os.ErrExist)
+		}
+
+		files, dirs := f.metadata.Snapshot()
+		for dir, perm := range dirs {
+			if f.within(o, dir) {
+				f.metadata.RemoveDirectory(dir)
+				f.metadata.AddDirectory(n+dir[len(o):], perm)
+			}
+		}
+		for plaintext, encrypted := range files {
+			if f.within(o, plaintext) {
+				f.metadata.Remove(encrypted)
+				f.metadata.Add(encrypted, n+plaintext[len(o):])
+			}
+		}
+		return nil
+	}
+
+	encrypted, ok := f.metadata.GetReverse(o)
+	if !ok {
+		return linkErr(os.ErrNotExist)
+	}
+	if f.isDir(n) {
+		return linkErr(errIsDir)
+	}
+
+	// Replace an existing destination file, as os.Rename does
+	if existing, ok := f.metadata.GetReverse(n); ok {
+		if err := base.Remove(existing); err != nil && !os.IsNotExist(err) {
+			return linkErr(err)
+		}
+		if err := removeXattrs(base, existing); err != nil {
+			return linkErr(err)
+		}
+		f.metadata.Remove(existing)
+	}
+
+	f.metadata.Remove(encrypted)
+	f.metadata.Add(encrypted, n)
+	return nil
+}
+
+// chmodDir sets the permissions recorded for a logical directory, reporting
+// whether name is one. The root's permissions are fixed.
+func (f *flatNamespace) chmodDir(name string, mode os.FileMode) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	p := f.clean(name)
+	if !f.isDir(p) {
+		return false
+	}
+	if p != f.separator {
+		f.metadata.AddDirectory(p, mode.Perm())
+	}
+	return true
+}
+
+// dirInfo returns synthetic file info for a logical directory
+func (f *flatNamespace) dirInfo(name string) (os.FileInfo, bool) {
+	p := f.clean(name)
+	if p == f.separator {
+		return &flatDirInfo{name: f.separator, perm: 0755}, true
+	}
+
+	perm, ok := f.metadata.GetDirectory(p)
+	if !ok {
+		return nil, false
+	}
+	return &flatDirInfo{name: p[strings.LastIndex(p, f.separator)+1:], perm: perm}, true
+}
+
+// children lists the direct children of a logical directory, returning file
+// names mapped to blob paths and subdirectory names mapped to their info
+func (f *flatNamespace) children(name string) (map[string]string, map[string]os.FileInfo, error) {
+	p := f.clean(name)
+	if !f.isDir(p) {
+		if _, isFile := f.metadata.GetReverse(p); isFile {
+			return nil, nil, &os.PathError{Op: "readdir", Path: name, Err: errNotDir}
+		}
+		return nil, nil, &os.PathError{Op: "readdir", Path: name, Err: os.ErrNotExist}
+	}
+
+	files, dirs := f.metadata.Snapshot()
+	childFiles := make(map[string]string)
+	childDirs := make(map[string]os.FileInfo)
+
+	for plaintext, encrypted := range files {
+		if plaintext != p && f.parent(plaintext) == p {
+			childFiles[plaintext[strings.LastIndex(plaintext, f.separator)+1:]] = encrypted
+		}
+	}
+	for dir, perm := range dirs {
+		if dir != p && f.parent(dir) == p {
+			base := dir[strings.LastIndex(dir, f.separator)+1:]
+			childDirs[base] = &flatDirInfo{name: base, perm: perm}
+		}
+	}
+
+	return childFiles, childDirs, nil
+}
+
+// flatDirInfo describes a logical directory that has no physical counterpart
+type flatDirInfo struct {
+	name string
+	perm os.FileMode
+}
+
+func (d *flatDirInfo) Name() string       { return d.name }
+func (d *flatDirInfo) Size() int64        { return 0 }
+func (d *flatDirInfo) Mode() os.FileMode  { return os.ModeDir | d.perm }
+func (d *flatDirInfo) ModTime() time.Time { return time.Time{} }
+func (d *flatDirInfo) IsDir() bool        { return true }
+func (d *flatDirInfo) Sys() any           { return nil }
@@ -0,0 +1,181 @@
+package encryptfs
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// FormatFeatures is the set of format features an encrypted file uses, as
+// recorded in its format descriptor (FlagFormat). The low byte mirrors the
+// header flags other than FlagFormat, which the descriptor's tag thereby
+// authenticates. Features added by later versions take the bits above it,
+// and readers refuse files that use features they do not know.
+//
+// Some properties of the format are not features of their own:
+//   - Every file is encrypted under a key of its own, derived from the salt
+//     in its header; FeatureSharedSalt expands it from the filesystem master
+//     key instead of running the password KDF per file.
+//   - FeatureStream seals records under counter nonces, and binds them to
+//     their position and to the end of the file with the last-record flag.
+//     For chunked files the record counter is the chunk index, so it is the
+//     feature that binds chunks to their place in the file.
+//   - Files are never compressed, so there is no compression feature.
+type FormatFeatures uint32
+
+// Format features, each mirroring the header flag of the same name
+const (
+	FeatureChunked     = FormatFeatures(FlagChunked)
+	FeatureDigest      = FormatFeatures(FlagDigest)
+	FeatureSharedSalt  = FormatFeatures(FlagSharedSalt)
+	FeatureKeyID       = FormatFeatures(FlagKeyID)
+	FeaturePadded      = FormatFeatures(FlagPadded)
+	FeatureRecoveryKey = FormatFeatures(FlagRecoveryKey)
+	FeatureStream      = FormatFeatures(FlagStream)
+)
+
+// supportedFeatures is the set of features this version reads
+const supportedFeatures = FeatureChunked | FeatureDigest | FeatureSharedSalt | FeatureKeyID |
+	FeaturePadded | FeatureRecoveryKey | FeatureStream
+
+// featureNames names the features this version knows
+var featureNames = map[FormatFeatures]string{
+	FeatureChunked:     "chunked",
+	FeatureDigest:      "digest",
+	FeatureSharedSalt:  "shared-salt",
+	FeatureKeyID:       "key-id",
+	FeaturePadded:      "padded",
+	FeatureRecoveryKey: "recovery-key",
+	FeatureStream:      "stream",
+}
+
+// String lists the features in the set, naming unknown ones by their bit
+func (f FormatFeatures) String() string {
+	var names []string
+	for bit := 0; bit < 32; bit++ {
+		feature := FormatFeatures(1) << bit
+		if f&feature == 0 {
+			continue
+		}
+		if name, ok := featureNames[feature]; ok {
+			names = append(names, name)
+		} else {
+			names = append(names, fmt.Sprintf("feature %d", bit))
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ", ")
+}
+
+// formatKeyInfo is the HKDF info string that derives the key of a format
+// descriptor's tag from the file key
+var formatKeyInfo = []byte("encryptfs format descriptor")
+
+// flagFeatures returns the features implied by the header flags
+func (h *FileHeader) flagFeatures() FormatFeatures {
+	return FormatFeatures(h.Flags &^ FlagFormat)
+}
+
+// sealFormat gives the header a format descriptor, sealed under a key
+// derived from the file key whenever the header is written
+func (h *FileHeader) sealFormat(key []byte) error {
+	formatKey, err := deriveFormatKey(key, h.Salt)
+	if err != nil {
+		return err
+	}
+	h.Flags |= FlagFormat
+	h.formatKey = formatKey
+	return nil
+}
+
+// openFormat checks the tag of the header's format descriptor under the
+// file key, and keeps the derived key to seal the header again when it is
+// rewritten. Headers without a descriptor are accepted as they are.
+func (h *FileHeader) openFormat(key []byte) error {
+	if h.Flags&FlagFormat == 0 {
+		return nil
+	}
+	formatKey, err := deriveFormatKey(key, h.Salt)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(formatTag(formatKey, h.tagged), h.FormatTag) {
+		return fmt.Errorf("format descriptor: %w", ErrAuthFailed)
+	}
+	h.formatKey = formatKey
+	return nil
+}
+
+// deriveFormatKey expands the file key into the key of the format tag, so
+// the file key itself only ever keys the cipher
+func deriveFormatKey(key, salt []byte) ([]byte, error) {
+	formatKey := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, salt, formatKeyInfo), formatKey); err != nil {
+		return nil, fmt.Errorf("failed to derive format key: %w", err)
+	}
+	return formatKey, nil
+}
+
+// formatTag computes the tag over the encoded header up to and including
+// the format features
+func formatTag(formatKey, header []byte) []byte {
+	mac := hmac.New(sha256.New, formatKey)
+	mac.Write(header)
+	return mac.Sum(nil)[:formatTagSize]
+}
+
+// describeFormat gives a new file's header a format descriptor if
+// Config.FormatDescriptor is set
+func (e *EncryptFS) describeFormat(header *FileHeader, key []byte) error {
+	if !e.config.FormatDescriptor {
+		return nil
+	}
+	return header.sealFormat(key)
+}
+
+// UpgradeFormat rewrites the file name in the current file format with a
+// format descriptor, so that it gains the features of this version and
+// can be checked by later ones. The contents, mode and extended attributes
+// are kept, and the file is replaced atomically under the configured key
+// provider and its own cipher. Files that already have a descriptor in the
+// current version are left as they are.
+func (e *EncryptFS) UpgradeFormat(name string) error {
+	if err := e.checkOp("upgradeformat", name); err != nil {
+		return err
+	}
+
+	encryptedPath, err := e.translatePath(name)
+	if err != nil {
+		return err
+	}
+	file, err := e.base.Open(encryptedPath)
+	if err != nil {
+		return err
+	}
+	header := &FileHeader{}
+	_, err = header.ReadFrom(file)
+	file.Close()
+	if err != nil {
+		return NewCorruptionError(name, err.Error())
+	}
+	if err := header.Validate(); err != nil {
+		return &os.PathError{Op: "upgradeformat", Path: name, Err: err}
+	}
+	if header.Version == CurrentVersion && header.Flags&FlagFormat != 0 {
+		return nil
+	}
+
+	return e.ReEncrypt(name, KeyRotationOptions{
+		NewKeyProvider:   e.config.KeyProvider,
+		NewCipher:        header.Cipher,
+		Atomic:           true,
+		FormatDescriptor: true,
+	})
+}
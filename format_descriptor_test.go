@@ -0,0 +1,250 @@
+package encryptfs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/absfs/absfs"
+)
+
+func TestFormatDescriptor(t *testing.T) {
+	keyProvider := NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+		Memory:      64 * 1024,
+		Iterations:  1,
+		Parallelism: 2,
+	})
+
+	configs := map[string]Config{
+		"traditional": {ComputeDigest: true},
+		"padded":      {PadSize: 512},
+		"stream":      {StreamFormat: StreamFormatSTREAM},
+		"chunked":     {ChunkSize: 4096, ComputeDigest: true},
+		"shared salt": {SharedSalt: true},
+	}
+	for name, config := range configs {
+		t.Run(name, func(t *testing.T) {
+			base, cleanup := setupTestFS(t)
+			defer cleanup()
+			config.Cipher = CipherAES256GCM
+			config.KeyProvider = keyProvider
+			config.FormatDescriptor = true
+			fs, err := New(base, &config)
+			if err != nil {
+				t.Fatalf("failed to create EncryptFS: %v", err)
+			}
+			defer fs.Close()
+
+			content := make([]byte, 10000)
+			rand.Read(content)
+			if err := fs.WriteFiles(map[string][]byte{"/file.bin": content}); err != nil {
+				t.Fatalf("WriteFiles failed: %v", err)
+			}
+			compareTree(t, fs, "/", map[string][]byte{"/file.bin": content})
+
+			header := readTestHeader(t, base, "/file.bin")
+			if header.Flags&FlagFormat == 0 {
+				t.Fatal("header has no format descriptor")
+			}
+			if header.Features != header.flagFeatures() {
+				t.Errorf("features %v, want %v", header.Features, header.flagFeatures())
+			}
+			if info, err := base.Stat("/file.bin"); err != nil {
+				t.Fatalf("base Stat failed: %v", err)
+			} else if want := CiphertextSize(int64(len(content)), &config); info.Size() != want {
+				t.Errorf("ciphertext size %d, CiphertextSize predicts %d", info.Size(), want)
+			}
+
+			// Rewriting an existing file seals the descriptor again
+			file, err := fs.OpenFile("/file.bin", os.O_WRONLY|os.O_APPEND, 0)
+			if err != nil {
+				t.Fatalf("OpenFile failed: %v", err)
+			}
+			if _, err := file.Write([]byte("tail")); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			if err := file.Close(); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+			content = append(content, "tail"...)
+			compareTree(t, fs, "/", map[string][]byte{"/file.bin": content})
+
+			// The tag covers the header
+			tagEnd := int64(readTestHeader(t, base, "/file.bin").Size())
+			patchBaseFile(t, base, "/file.bin", tagEnd-1, func(b []byte) { b[0] ^= 1 })
+			var authErr *AuthenticationError
+			if err := readAllErr(fs, "/file.bin"); !errors.As(err, &authErr) {
+				t.Errorf("read with a tampered tag = %v, want an AuthenticationError", err)
+			}
+		})
+	}
+}
+
+func TestFormatDescriptor_UnknownFeature(t *testing.T) {
+	base, cleanup := setupTestFS(t)
+	defer cleanup()
+	fs, err := New(base, &Config{
+		Cipher: CipherAES256GCM,
+		KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+			Memory:      64 * 1024,
+			Iterations:  1,
+			Parallelism: 2,
+		}),
+		FormatDescriptor: true,
+	})
+	if err != nil {
+		t.Fatalf("failed to create EncryptFS: %v", err)
+	}
+	defer fs.Close()
+	if err := fs.WriteFiles(map[string][]byte{"/file.txt": []byte("from a later version")}); err != nil {
+		t.Fatalf("WriteFiles failed: %v", err)
+	}
+
+	// A later version records a feature this one does not know
+	featuresAt := int64(readTestHeader(t, base, "/file.txt").Size()) - formatDescriptorSize
+	patchBaseFile(t, base, "/file.txt", featuresAt, func(b []byte) {
+		features := binary.LittleEndian.Uint32(b) | 1<<20
+		binary.LittleEndian.PutUint32(b, features)
+	})
+
+	err = readAllErr(fs, "/file.txt")
+	if !errors.Is(err, ErrUnsupportedFeatures) {
+		t.Fatalf("read = %v, want ErrUnsupportedFeatures", err)
+	}
+	if !strings.Contains(err.Error(), "feature 20") {
+		t.Errorf("error %q does not name the unsupported feature", err)
+	}
+	if err := fs.UpgradeFormat("/file.txt"); !errors.Is(err, ErrUnsupportedFeatures) {
+		t.Errorf("UpgradeFormat = %v, want ErrUnsupportedFeatures", err)
+	}
+}
+
+func TestFormatFeatures_Names(t *testing.T) {
+	// Every header flag other than FlagFormat is a named feature
+	if want := FormatFeatures(knownHeaderFlags &^ FlagFormat); supportedFeatures != want {
+		t.Errorf("supportedFeatures = %#x, want %#x", supportedFeatures, want)
+	}
+	for bit := 0; bit < 8; bit++ {
+		feature := FormatFeatures(1) << bit
+		if _, named := featureNames[feature]; named != (supportedFeatures&feature != 0) {
+			t.Errorf("feature bit %d named %v, supported %v", bit, named, supportedFeatures&feature != 0)
+		}
+	}
+
+	if got, want := (FeatureChunked | FeatureStream).String(), "chunked, stream"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+	if got, want := (FeatureDigest | 1<<20).String(), "digest, feature 20"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
+
+func TestUpgradeFormat(t *testing.T) {
+	keyProvider := NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+		Memory:      64 * 1024,
+		Iterations:  1,
+		Parallelism: 2,
+	})
+
+	for _, chunkSize := range []int{0, 4096} {
+		base, cleanup := setupTestFS(t)
+		defer cleanup()
+		fs, err := New(base, &Config{Cipher: CipherChaCha20Poly1305, KeyProvider: keyProvider, ChunkSize: chunkSize})
+		if err != nil {
+			t.Fatalf("failed to create EncryptFS: %v", err)
+		}
+		defer fs.Close()
+
+		content := make([]byte, 10000)
+		rand.Read(content)
+		file, err := fs.OpenFile("/legacy.bin", os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			t.Fatalf("OpenFile failed: %v", err)
+		}
+		if chunkSize > 0 {
+			// Chunked files are written in the version 2 layout
+			useLegacyIndex(t, file)
+		}
+		if _, err := file.Write(content); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if err := file.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+		if header := readTestHeader(t, base, "/legacy.bin"); header.Flags&FlagFormat != 0 {
+			t.Fatal("legacy file has a format descriptor")
+		}
+
+		if err := fs.UpgradeFormat("/legacy.bin"); err != nil {
+			t.Fatalf("chunk size %d: UpgradeFormat failed: %v", chunkSize, err)
+		}
+		header := readTestHeader(t, base, "/legacy.bin")
+		if header.Version != CurrentVersion || header.Flags&FlagFormat == 0 {
+			t.Errorf("chunk size %d: upgraded to version %d with flags %#x, want version %d with a descriptor",
+				chunkSize, header.Version, header.Flags, CurrentVersion)
+		}
+		if header.Cipher != CipherChaCha20Poly1305 {
+			t.Errorf("chunk size %d: upgraded file uses %v, want the original cipher", chunkSize, header.Cipher)
+		}
+		compareTree(t, fs, "/", map[string][]byte{"/legacy.bin": content})
+		if info, err := fs.Stat("/legacy.bin"); err != nil || info.Mode().Perm() != 0600 {
+			t.Errorf("chunk size %d: Stat = %v, %v; want mode 0600", chunkSize, info, err)
+		}
+
+		// An upgraded file is left as it is
+		before := readBaseBytes(t, base, "/legacy.bin")
+		if err := fs.UpgradeFormat("/legacy.bin"); err != nil {
+			t.Fatalf("second UpgradeFormat failed: %v", err)
+		}
+		if !bytes.Equal(readBaseBytes(t, base, "/legacy.bin"), before) {
+			t.Errorf("chunk size %d: second UpgradeFormat rewrote the file", chunkSize)
+		}
+	}
+}
+
+// readAllErr reads name through fs and returns the first error
+func readAllErr(fs absfs.FileSystem, name string) error {
+	file, err := fs.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.ReadAll(file)
+	return err
+}
+
+// readBaseBytes returns the contents of name on the base filesystem
+func readBaseBytes(t *testing.T, base absfs.FileSystem, name string) []byte {
+	t.Helper()
+	file, err := base.Open(name)
+	if err != nil {
+		t.Fatalf("failed to open base file: %v", err)
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		t.Fatalf("failed to read base file: %v", err)
+	}
+	return data
+}
+
+// patchBaseFile applies patch to the bytes of name on the base filesystem
+// from offset on
+func patchBaseFile(t *testing.T, base absfs.FileSystem, name string, offset int64, patch func([]byte)) {
+	t.Helper()
+	data := readBaseBytes(t, base, name)
+	patch(data[offset:])
+	file, err := base.OpenFile(name, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		t.Fatalf("failed to open base file: %v", err)
+	}
+	defer file.Close()
+	if _, err := file.Write(data); err != nil {
+		t.Fatalf("failed to write base file: %v", err)
+	}
+}
@@ -0,0 +1,78 @@
+package encryptfs
+
+// FSInfo describes the active configuration of an EncryptFS, with defaults
+// and stored settings resolved. It holds no key material, so it can be
+// logged or shown to users for diagnostics.
+type FSInfo struct {
+	// Cipher encrypts new files. It is never CipherAuto.
+	Cipher CipherSuite
+
+	// FilenameEncryption and DirnameEncryption are the name encryption
+	// modes, and FilenameEncoding the encoding of deterministic names
+	FilenameEncryption FilenameEncryption
+	DirnameEncryption  DirnameEncryption
+	FilenameEncoding   FilenameEncoding
+	PreserveExtensions bool
+	HashLongComponents bool
+	FlattenDirectories bool
+
+	// Chunked is set when new files are written in the chunked format, in
+	// chunks of ChunkSize bytes of plaintext. ChunkSize is zero otherwise.
+	// Existing files are read in whichever format they were written.
+	Chunked   bool
+	ChunkSize int
+
+	// StreamFormat and PadSize describe the bodies of new traditional files
+	StreamFormat StreamFormat
+	PadSize      int
+
+	// Parallel is the parallel processing configuration, with MaxWorkers
+	// resolved if it was left at zero
+	Parallel ParallelConfig
+
+	// KDF describes the key derivation of the configured key provider. Its
+	// ID is KDFNone if the provider cannot describe it. With SharedSalt it
+	// derives the master key, from which the file keys are expanded.
+	KDF KDFParams
+
+	// SharedSalt is set when all files derive their keys from the
+	// filesystem salt instead of their own
+	SharedSalt bool
+
+	// ReadOnce, ComputeDigest, VerifyAfterWrite and FormatDescriptor
+	// mirror the config
+	ReadOnce         bool
+	ComputeDigest    bool
+	VerifyAfterWrite bool
+	FormatDescriptor bool
+}
+
+// Info returns the resolved, non-secret configuration of the filesystem
+func (e *EncryptFS) Info() FSInfo {
+	info := FSInfo{
+		Cipher:             e.cipher,
+		FilenameEncryption: e.config.FilenameEncryption,
+		DirnameEncryption:  e.config.DirnameEncryption,
+		FilenameEncoding:   e.config.FilenameEncoding,
+		PreserveExtensions: e.config.PreserveExtensions,
+		HashLongComponents: e.config.HashLongComponents,
+		FlattenDirectories: e.config.FlattenDirectories,
+		Chunked:            e.config.ChunkSize > 0 || e.config.ReadOnce,
+		StreamFormat:       e.config.StreamFormat,
+		PadSize:            e.config.PadSize,
+		Parallel:           e.parallel,
+		KDF:                kdfParamsFor(e.config.KeyProvider),
+		SharedSalt:         e.config.SharedSalt,
+		ReadOnce:           e.config.ReadOnce,
+		ComputeDigest:      e.config.ComputeDigest,
+		VerifyAfterWrite:   e.config.VerifyAfterWrite,
+		FormatDescriptor:   e.config.FormatDescriptor,
+	}
+	if info.Chunked {
+		info.ChunkSize = e.config.ChunkSize
+		if info.ChunkSize == 0 {
+			info.ChunkSize = DefaultChunkSize
+		}
+	}
+	return info
+}
@@ -0,0 +1,69 @@
+package encryptfs
+
+import (
+	"testing"
+)
+
+func TestEncryptFS_Info(t *testing.T) {
+	keyProvider := NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+		Memory:      64 * 1024,
+		Iterations:  1,
+		Parallelism: 2,
+	})
+
+	tests := []struct {
+		name      string
+		config    Config
+		cipher    CipherSuite
+		chunkSize int
+	}{
+		{"auto traditional", Config{Cipher: CipherAuto}, resolveCipher(CipherAuto), 0},
+		{"chunked", Config{Cipher: CipherChaCha20Poly1305, ChunkSize: 16 * 1024}, CipherChaCha20Poly1305, 16 * 1024},
+		{"read once", Config{Cipher: CipherAES256GCM, ReadOnce: true}, CipherAES256GCM, DefaultChunkSize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base, cleanup := setupTestFS(t)
+			defer cleanup()
+			config := tt.config
+			config.KeyProvider = keyProvider
+			config.FilenameEncryption = FilenameEncryptionDeterministic
+			if config.ChunkSize > 0 {
+				config.Parallel = ParallelConfig{Enabled: true, MinChunksForParallel: 2}
+			}
+			fs, err := New(base, &config)
+			if err != nil {
+				t.Fatalf("failed to create EncryptFS: %v", err)
+			}
+			defer fs.Close()
+
+			info := fs.Info()
+			if info.Cipher == CipherAuto || info.Cipher != tt.cipher {
+				t.Errorf("Cipher = %v, want %v", info.Cipher, tt.cipher)
+			}
+			if info.Chunked != (tt.chunkSize > 0) || info.ChunkSize != tt.chunkSize {
+				t.Errorf("Chunked, ChunkSize = %v, %d; want %v, %d", info.Chunked, info.ChunkSize, tt.chunkSize > 0, tt.chunkSize)
+			}
+			if info.FilenameEncryption != FilenameEncryptionDeterministic {
+				t.Errorf("FilenameEncryption = %v, want deterministic", info.FilenameEncryption)
+			}
+			if info.Parallel.Enabled != config.Parallel.Enabled || (info.Parallel.Enabled && info.Parallel.MaxWorkers == 0) {
+				t.Errorf("Parallel = %+v, want %+v with MaxWorkers resolved", info.Parallel, config.Parallel)
+			}
+			if info.KDF.ID != KDFArgon2id || info.KDF.Memory != 64*1024 {
+				t.Errorf("KDF = %+v, want Argon2id with 64 MiB", info.KDF)
+			}
+
+			// New files are written in the reported format
+			file, err := fs.Create("/file.txt")
+			if err != nil {
+				t.Fatalf("failed to create file: %v", err)
+			}
+			_, chunked := file.(*ChunkedFile)
+			file.Close()
+			if chunked != info.Chunked {
+				t.Errorf("new file chunked = %v, Info reports %v", chunked, info.Chunked)
+			}
+		})
+	}
+}
@@ -1,11 +1,17 @@
 package encryptfs
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/absfs/absfs"
 	"github.com/absfs/memfs"
 )
 
@@ -181,10 +187,455 @@ func TestIntegration_RandomFilenameEncryption(t *testing.T) {
 		}
 	}
 
-	// Note: Metadata is saved on-demand or during filesystem operations
-	// For random encryption, the metadata is stored in memory during the session
-	// In a real application, you would call a SaveMetadata() method or
-	// the filesystem would save it during Sync() or Close() operations
+	// The metadata is kept in memory during the session and saved by Close
+	if err := fs.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if _, err := base.Stat(config.MetadataPath); err != nil {
+		t.Errorf("metadata was not saved: %v", err)
+	}
+}
+
+// TestIntegration_FlattenDirectories tests that a nested logical tree is stored
+// as a single flat directory on the base filesystem
+func TestIntegration_FlattenDirectories(t *testing.T) {
+	base, err := memfs.NewFS()
+	if err != nil {
+		t.Fatalf("Failed to create base filesystem: %v", err)
+	}
+
+	config := &Config{
+		Cipher: CipherAES256GCM,
+		KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+			Memory:      64 * 1024,
+			Iterations:  1,
+			Parallelism: 2,
+		}),
+		FilenameEncryption: FilenameEncryptionRandom,
+		MetadataPath:       "/.metadata.json",
+		FlattenDirectories: true,
+	}
+
+	fs, err := New(base, config)
+	if err != nil {
+		t.Fatalf("Failed to create EncryptFS: %v", err)
+	}
+
+	if err := fs.MkdirAll("/projects/alpha/docs", 0755); err != nil {
+		t.Fatalf("MkdirAll failed: %v", err)
+	}
+	if err := fs.Mkdir("/projects/beta", 0700); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+
+	files := map[string]string{
+		"/readme.txt":                   "top level",
+		"/projects/alpha/plan.txt":      "alpha plan",
+		"/projects/alpha/docs/spec.txt": "alpha spec",
+		"/projects/beta/notes.txt":      "beta notes",
+	}
+	for path, content := range files {
+		file, err := fs.Create(path)
+		if err != nil {
+			t.Fatalf("Create(%q) failed: %v", path, err)
+		}
+		file.Write([]byte(content))
+		file.Close()
+	}
+
+	if _, err := fs.Create("/missing/file.txt"); err == nil {
+		t.Error("Create in a missing directory should fail")
+	}
+
+	// The base filesystem holds only file blobs, all in the root
+	root, err := base.Open("/")
+	if err != nil {
+		t.Fatalf("Failed to open base root: %v", err)
+	}
+	infos, err := root.Readdir(-1)
+	root.Close()
+	if err != nil {
+		t.Fatalf("Readdir failed: %v", err)
+	}
+
+	var blobs int
+	for _, info := range infos {
+		if info.Name() == "." || info.Name() == ".." || "/"+info.Name() == VerifyMarkerPath {
+			continue
+		}
+		if info.IsDir() {
+			t.Errorf("Base filesystem contains directory %q", info.Name())
+		}
+		blobs++
+	}
+	if blobs != len(files) {
+		t.Errorf("Base filesystem has %d entries, want %d", blobs, len(files))
+	}
+
+	// Logical paths still resolve
+	for path, content := range files {
+		file, err := fs.Open(path)
+		if err != nil {
+			t.Fatalf("Open(%q) failed: %v", path, err)
+		}
+		data, _ := io.ReadAll(file)
+		file.Close()
+
+		if string(data) != content {
+			t.Errorf("Content mismatch for %q: got %q, want %q", path, string(data), content)
+		}
+	}
+
+	info, err := fs.Stat("/projects/beta")
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if !info.IsDir() || info.Name() != "beta" || info.Mode().Perm() != 0700 {
+		t.Errorf("Stat(/projects/beta) = %q dir=%v mode=%v", info.Name(), info.IsDir(), info.Mode())
+	}
+
+	entries, err := fs.ReadDir("/projects/alpha")
+	if err != nil {
+		t.Fatalf("ReadDir failed: %v", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if strings.Join(names, ",") != "docs,plan.txt" {
+		t.Errorf("ReadDir(/projects/alpha) = %v, want [docs plan.txt]", names)
+	}
+
+	// Renaming a directory only touches metadata
+	if err := fs.Rename("/projects/alpha", "/archive"); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	file, err := fs.Open("/archive/docs/spec.txt")
+	if err != nil {
+		t.Fatalf("Open after rename failed: %v", err)
+	}
+	data, _ := io.ReadAll(file)
+	file.Close()
+	if string(data) != "alpha spec" {
+		t.Errorf("Content after rename = %q, want %q", string(data), "alpha spec")
+	}
+	if _, err := fs.Stat("/projects/alpha"); err == nil {
+		t.Error("Old directory should not exist after rename")
+	}
+
+	if err := fs.Remove("/archive"); err == nil {
+		t.Error("Remove of a non-empty directory should fail")
+	}
+	if err := fs.RemoveAll("/archive"); err != nil {
+		t.Fatalf("RemoveAll failed: %v", err)
+	}
+	if _, err := fs.Stat("/archive/plan.txt"); err == nil {
+		t.Error("File should not exist after RemoveAll")
+	}
+}
+
+// TestIntegration_Sub tests filesystems scoped to a subdirectory
+func TestIntegration_Sub(t *testing.T) {
+	modes := []struct {
+		name   string
+		config func(c *Config)
+	}{
+		{"deterministic", func(c *Config) {
+			c.FilenameEncryption = FilenameEncryptionDeterministic
+		}},
+		{"random", func(c *Config) {
+			c.FilenameEncryption = FilenameEncryptionRandom
+			c.MetadataPath = "/.metadata.json"
+		}},
+		{"flattened", func(c *Config) {
+			c.FilenameEncryption = FilenameEncryptionRandom
+			c.MetadataPath = "/.metadata.json"
+			c.FlattenDirectories = true
+		}},
+	}
+
+	for _, mode := range modes {
+		t.Run(mode.name, func(t *testing.T) {
+			base, err := memfs.NewFS()
+			if err != nil {
+				t.Fatalf("Failed to create base filesystem: %v", err)
+			}
+
+			config := &Config{
+				Cipher: CipherAES256GCM,
+				KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+					Memory:      64 * 1024,
+					Iterations:  1,
+					Parallelism: 2,
+				}),
+			}
+			mode.config(config)
+
+			fs, err := New(base, config)
+			if err != nil {
+				t.Fatalf("Failed to create EncryptFS: %v", err)
+			}
+
+			if err := fs.MkdirAll("/tenants/acme", 0755); err != nil {
+				t.Fatalf("MkdirAll failed: %v", err)
+			}
+			file, err := fs.Create("/secret.txt")
+			if err != nil {
+				t.Fatalf("Create failed: %v", err)
+			}
+			file.Write([]byte("parent only"))
+			file.Close()
+
+			if _, err := fs.Sub("/secret.txt"); err == nil {
+				t.Error("Sub of a file should fail")
+			}
+
+			tenant, err := fs.Sub("/tenants/acme")
+			if err != nil {
+				t.Fatalf("Sub failed: %v", err)
+			}
+
+			// Nested Sub composes with its parent's root
+			if err := tenant.Mkdir("/docs", 0755); err != nil {
+				t.Fatalf("Mkdir in sub failed: %v", err)
+			}
+			docs, err := tenant.Sub("/docs")
+			if err != nil {
+				t.Fatalf("Nested Sub failed: %v", err)
+			}
+
+			file, err = docs.Create("/readme.txt")
+			if err != nil {
+				t.Fatalf("Create in sub failed: %v", err)
+			}
+			file.Write([]byte("tenant data"))
+			file.Close()
+
+			// The parent sees the file at its full path
+			file, err = fs.Open("/tenants/acme/docs/readme.txt")
+			if err != nil {
+				t.Fatalf("Open via parent failed: %v", err)
+			}
+			data, _ := io.ReadAll(file)
+			file.Close()
+			if string(data) != "tenant data" {
+				t.Errorf("Content via parent = %q, want %q", string(data), "tenant data")
+			}
+
+			entries, err := tenant.ReadDir("/")
+			if err != nil {
+				t.Fatalf("ReadDir in sub failed: %v", err)
+			}
+			if len(entries) != 1 || entries[0].Name() != "docs" || !entries[0].IsDir() {
+				t.Errorf("ReadDir(/) in sub = %v, want [docs/]", entries)
+			}
+
+			info, err := docs.Stat("/")
+			if err != nil {
+				t.Fatalf("Stat of sub root failed: %v", err)
+			}
+			if info.Name() != "docs" || !info.IsDir() {
+				t.Errorf("Stat of sub root = %q dir=%v, want docs dir", info.Name(), info.IsDir())
+			}
+
+			// Paths cannot climb out of the root
+			if _, err := tenant.Open("/../../secret.txt"); err == nil {
+				t.Error("Open outside the sub root should fail")
+			}
+		})
+	}
+}
+
+// TestIntegration_DirectoryRename tests that every file in a renamed
+// directory stays readable under its new plaintext path, in each filename mode
+// and after the filesystem is reopened
+func TestIntegration_DirectoryRename(t *testing.T) {
+	modes := []struct {
+		name   string
+		config func(c *Config)
+	}{
+		{"deterministic", func(c *Config) {
+			c.FilenameEncryption = FilenameEncryptionDeterministic
+		}},
+		{"random", func(c *Config) {
+			c.FilenameEncryption = FilenameEncryptionRandom
+			c.MetadataPath = "/.metadata.json"
+		}},
+		{"flattened", func(c *Config) {
+			c.FilenameEncryption = FilenameEncryptionRandom
+			c.MetadataPath = "/.metadata.json"
+			c.FlattenDirectories = true
+		}},
+	}
+
+	files := map[string]string{
+		"/src/a.txt":          "alpha",
+		"/src/sub/b.txt":      "bravo",
+		"/src/sub/deep/c.txt": "charlie",
+		"/other/sub/b.txt":    "unrelated",
+		"/other/src/keep.txt": "kept",
+	}
+	moved := map[string]string{
+		"/dst/moved/a.txt":          "alpha",
+		"/dst/moved/sub/b.txt":      "bravo",
+		"/dst/moved/sub/deep/c.txt": "charlie",
+		"/other/sub/b.txt":          "unrelated",
+		"/other/src/keep.txt":       "kept",
+	}
+
+	for _, mode := range modes {
+		t.Run(mode.name, func(t *testing.T) {
+			base, err := memfs.NewFS()
+			if err != nil {
+				t.Fatalf("Failed to create base filesystem: %v", err)
+			}
+
+			config := &Config{
+				Cipher: CipherAES256GCM,
+				KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+					Memory:      64 * 1024,
+					Iterations:  1,
+					Parallelism: 2,
+				}),
+				SharedSalt: true,
+			}
+			mode.config(config)
+
+			fs, err := New(base, config)
+			if err != nil {
+				t.Fatalf("Failed to create EncryptFS: %v", err)
+			}
+
+			for path, content := range files {
+				if err := fs.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					t.Fatalf("MkdirAll(%q) failed: %v", filepath.Dir(path), err)
+				}
+				file, err := fs.Create(path)
+				if err != nil {
+					t.Fatalf("Create(%q) failed: %v", path, err)
+				}
+				file.Write([]byte(content))
+				file.Close()
+			}
+
+			// The destination's parent must exist, as with os.Rename
+			if err := fs.Rename("/src", "/dst/moved"); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("Rename into a missing directory: got %v, want ErrNotExist", err)
+			}
+			if err := fs.Mkdir("/dst", 0755); err != nil {
+				t.Fatalf("Mkdir failed: %v", err)
+			}
+			if err := fs.Rename("/src", "/src/sub/inner"); err == nil {
+				t.Error("Rename of a directory into itself should fail")
+			}
+
+			if err := fs.Rename("/src", "/dst/moved"); err != nil {
+				t.Fatalf("Rename failed: %v", err)
+			}
+			if _, err := fs.Stat("/src"); !os.IsNotExist(err) {
+				t.Errorf("Stat(/src) after rename: got %v, want not exist", err)
+			}
+			if _, err := fs.Stat("/src/a.txt"); !os.IsNotExist(err) {
+				t.Errorf("Stat(/src/a.txt) after rename: got %v, want not exist", err)
+			}
+
+			entries, err := fs.ReadDir("/dst/moved")
+			if err != nil {
+				t.Fatalf("ReadDir failed: %v", err)
+			}
+			var names []string
+			for _, entry := range entries {
+				names = append(names, entry.Name())
+			}
+			if strings.Join(names, ",") != "a.txt,sub" {
+				t.Errorf("ReadDir(/dst/moved) = %v, want [a.txt sub]", names)
+			}
+
+			checkFiles := func(fs *EncryptFS) {
+				t.Helper()
+				for path, want := range moved {
+					file, err := fs.Open(path)
+					if err != nil {
+						t.Errorf("Open(%q) failed: %v", path, err)
+						continue
+					}
+					data, _ := io.ReadAll(file)
+					file.Close()
+					if string(data) != want {
+						t.Errorf("Content of %q = %q, want %q", path, data, want)
+					}
+				}
+			}
+			checkFiles(fs)
+
+			if err := fs.Close(); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+			fs, err = New(base, config)
+			if err != nil {
+				t.Fatalf("Failed to reopen EncryptFS: %v", err)
+			}
+			defer fs.Close()
+			checkFiles(fs)
+		})
+	}
+}
+
+// TestIntegration_StatPlaintextNames verifies Stat reports decrypted names
+func TestIntegration_StatPlaintextNames(t *testing.T) {
+	base, err := memfs.NewFS()
+	if err != nil {
+		t.Fatalf("Failed to create base filesystem: %v", err)
+	}
+
+	config := &Config{
+		Cipher: CipherAES256GCM,
+		KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+			Memory:      64 * 1024,
+			Iterations:  1,
+			Parallelism: 2,
+		}),
+		FilenameEncryption: FilenameEncryptionDeterministic,
+	}
+
+	fs, err := New(base, config)
+	if err != nil {
+		t.Fatalf("Failed to create EncryptFS: %v", err)
+	}
+
+	if err := fs.MkdirAll("/reports/2025", 0755); err != nil {
+		t.Fatalf("MkdirAll failed: %v", err)
+	}
+
+	file, err := fs.Create("/reports/2025/summary.txt")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	file.Write([]byte("quarterly summary"))
+	file.Close()
+
+	tests := []struct {
+		path  string
+		name  string
+		isDir bool
+	}{
+		{"/reports", "reports", true},
+		{"/reports/2025/", "2025", true},
+		{"/reports/2025/summary.txt", "summary.txt", false},
+	}
+
+	for _, tt := range tests {
+		info, err := fs.Stat(tt.path)
+		if err != nil {
+			t.Fatalf("Stat(%q) failed: %v", tt.path, err)
+		}
+		if info.Name() != tt.name {
+			t.Errorf("Stat(%q).Name() = %q, want %q", tt.path, info.Name(), tt.name)
+		}
+		if info.IsDir() != tt.isDir {
+			t.Errorf("Stat(%q).IsDir() = %v, want %v", tt.path, info.IsDir(), tt.isDir)
+		}
+	}
 }
 
 // TestIntegration_NoFilenameEncryption tests content-only encryption
@@ -307,6 +758,102 @@ func TestIntegration_MultipleFilesystems(t *testing.T) {
 	}
 }
 
+// TestIntegration_MixedFileFormats tests that traditional and chunked files
+// are readable whichever mode the filesystem is configured with
+func TestIntegration_MixedFileFormats(t *testing.T) {
+	base, err := memfs.NewFS()
+	if err != nil {
+		t.Fatalf("Failed to create base filesystem: %v", err)
+	}
+
+	newFS := func(chunkSize int) *EncryptFS {
+		fs, err := New(base, &Config{
+			Cipher: CipherAES256GCM,
+			KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+				Memory:      64 * 1024,
+				Iterations:  1,
+				Parallelism: 2,
+			}),
+			ChunkSize: chunkSize,
+		})
+		if err != nil {
+			t.Fatalf("Failed to create EncryptFS: %v", err)
+		}
+		return fs
+	}
+	traditional := newFS(0)
+	chunked := newFS(4 * 1024)
+
+	chunkedData := make([]byte, 10000)
+	for i := range chunkedData {
+		chunkedData[i] = byte(i % 251)
+	}
+
+	files := []struct {
+		path    string
+		fs      *EncryptFS
+		content []byte
+		legacy  func(f absfs.File)
+	}{
+		{"/traditional.txt", traditional, []byte("single blob"), nil},
+		{"/legacy-traditional.txt", traditional, []byte("version 2 blob"), func(f absfs.File) {
+			f.(*encryptedFile).header.Version = 2
+		}},
+		{"/chunked.bin", chunked, chunkedData, nil},
+		{"/legacy-chunked.bin", chunked, chunkedData, func(f absfs.File) {
+			useLegacyIndex(t, f)
+		}},
+	}
+
+	for _, tt := range files {
+		file, err := tt.fs.Create(tt.path)
+		if err != nil {
+			t.Fatalf("Create(%q) failed: %v", tt.path, err)
+		}
+		if tt.legacy != nil {
+			tt.legacy(file)
+		}
+		file.Write(tt.content)
+		if err := file.Close(); err != nil {
+			t.Fatalf("Close(%q) failed: %v", tt.path, err)
+		}
+	}
+
+	for name, fs := range map[string]*EncryptFS{"traditional": traditional, "chunked": chunked} {
+		for _, tt := range files {
+			file, err := fs.Open(tt.path)
+			if err != nil {
+				t.Fatalf("%s: Open(%q) failed: %v", name, tt.path, err)
+			}
+			data, err := io.ReadAll(file)
+			file.Close()
+			if err != nil {
+				t.Fatalf("%s: ReadAll(%q) failed: %v", name, tt.path, err)
+			}
+			if !bytes.Equal(data, tt.content) {
+				t.Errorf("%s: content mismatch for %q", name, tt.path)
+			}
+		}
+
+		// Directory listings report the plaintext size of either format
+		entries, err := fs.ReadDir("/")
+		if err != nil {
+			t.Fatalf("%s: ReadDir failed: %v", name, err)
+		}
+		for _, entry := range entries {
+			info, err := entry.Info()
+			if err != nil {
+				t.Fatalf("%s: Info(%q) failed: %v", name, entry.Name(), err)
+			}
+			for _, tt := range files {
+				if "/"+entry.Name() == tt.path && info.Size() != int64(len(tt.content)) {
+					t.Errorf("%s: size of %q = %d, want %d", name, tt.path, info.Size(), len(tt.content))
+				}
+			}
+		}
+	}
+}
+
 // BenchmarkIntegration_FilenameEncryption benchmarks filesystem operations with filename encryption
 func BenchmarkIntegration_FilenameEncryption(b *testing.B) {
 	base, _ := memfs.NewFS()
@@ -354,3 +901,127 @@ func BenchmarkIntegration_FilenameEncryption(b *testing.B) {
 		})
 	}
 }
+
+func TestIntegration_ComputeDigest(t *testing.T) {
+	base, err := memfs.NewFS()
+	if err != nil {
+		t.Fatalf("Failed to create base filesystem: %v", err)
+	}
+
+	data := make([]byte, 10000)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	want := sha256.Sum256(data)
+
+	for _, chunkSize := range []int{0, 4 * 1024} {
+		fs, err := New(base, &Config{
+			Cipher: CipherAES256GCM,
+			KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+				Memory:      64 * 1024,
+				Iterations:  1,
+				Parallelism: 2,
+			}),
+			ChunkSize:     chunkSize,
+			ComputeDigest: true,
+		})
+		if err != nil {
+			t.Fatalf("Failed to create EncryptFS: %v", err)
+		}
+
+		name := fmt.Sprintf("/digest-%d.bin", chunkSize)
+		file, err := fs.Create(name)
+		if err != nil {
+			t.Fatalf("Create(%q) failed: %v", name, err)
+		}
+		for off := 0; off < len(data); off += 3000 {
+			end := off + 3000
+			if end > len(data) {
+				end = len(data)
+			}
+			file.Write(data[off:end])
+		}
+		if err := file.Close(); err != nil {
+			t.Fatalf("Close(%q) failed: %v", name, err)
+		}
+
+		digester := file.(interface{ Digest() []byte })
+		if got := digester.Digest(); !bytes.Equal(got, want[:]) {
+			t.Errorf("%s: Digest() = %x, want %x", name, got, want)
+		}
+
+		// The digest is read back from the header
+		file, err = fs.Open(name)
+		if err != nil {
+			t.Fatalf("Open(%q) failed: %v", name, err)
+		}
+		if got := file.(interface{ Digest() []byte }).Digest(); !bytes.Equal(got, want[:]) {
+			t.Errorf("%s: reopened Digest() = %x, want %x", name, got, want)
+		}
+		file.Close()
+
+		if err := fs.VerifyEncryption(name); err != nil {
+			t.Errorf("%s: VerifyEncryption failed: %v", name, err)
+		}
+
+		// The header reveals neither the digest nor that two files match
+		if err := fs.WriteFiles(map[string][]byte{name + ".copy": data}); err != nil {
+			t.Fatalf("WriteFiles failed: %v", err)
+		}
+		sealed := make(map[string][]byte)
+		for _, plain := range []string{name, name + ".copy"} {
+			encrypted, err := fs.translatePath(plain)
+			if err != nil {
+				t.Fatalf("translatePath(%q) failed: %v", plain, err)
+			}
+			sealed[plain] = readTestHeader(t, base, encrypted).Digest
+			if bytes.Contains(sealed[plain], want[:]) {
+				t.Errorf("%s: header holds the plaintext digest", plain)
+			}
+		}
+		if bytes.Equal(sealed[name], sealed[name+".copy"]) {
+			t.Errorf("%s: identical files record identical digests", name)
+		}
+
+		// Out-of-order writes are rehashed on Close
+		file, err = fs.OpenFile(name, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatalf("OpenFile(%q) failed: %v", name, err)
+		}
+		if _, err := file.WriteAt([]byte("patched"), 5000); err != nil {
+			t.Fatalf("WriteAt(%q) failed: %v", name, err)
+		}
+		file.Close()
+
+		patched := append([]byte(nil), data...)
+		copy(patched[5000:], "patched")
+		wantPatched := sha256.Sum256(patched)
+		if got := file.(interface{ Digest() []byte }).Digest(); !bytes.Equal(got, wantPatched[:]) {
+			t.Errorf("%s: Digest() after WriteAt = %x, want %x", name, got, wantPatched)
+		}
+
+		// A tampered digest fails verification
+		encrypted, err := fs.translatePath(name)
+		if err != nil {
+			t.Fatalf("translatePath(%q) failed: %v", name, err)
+		}
+		raw, err := base.OpenFile(encrypted, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatalf("Failed to open base file: %v", err)
+		}
+		header := &FileHeader{}
+		if _, err := header.ReadFrom(raw); err != nil {
+			t.Fatalf("Failed to read header: %v", err)
+		}
+		header.Digest[0] ^= 0xFF
+		raw.Seek(0, io.SeekStart)
+		header.WriteTo(raw)
+		raw.Close()
+
+		err = fs.VerifyEncryption(name)
+		var corruption *CorruptionError
+		if !errors.As(err, &corruption) {
+			t.Errorf("%s: VerifyEncryption with tampered digest = %v, want CorruptionError", name, err)
+		}
+	}
+}
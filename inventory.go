@@ -0,0 +1,72 @@
+package encryptfs
+
+import (
+	"io/fs"
+	"path"
+)
+
+// InventoryReport summarizes the formats of the files beneath a root, as
+// recorded in their headers
+type InventoryReport struct {
+	Files      int                 // Files whose header was read
+	TotalBytes int64               // Combined size of those files on the base filesystem
+	Chunked    int                 // Files in the chunked format
+	Ciphers    map[CipherSuite]int // Files per cipher
+	Versions   map[uint8]int       // Files per header format version
+	KDFs       map[KDFID]int       // Files per recorded key derivation function
+	Unreadable []string            // Paths of files and directories that could not be read
+}
+
+// Inventory reads the header of every file beneath root, a path in the
+// encrypted filesystem, and counts the files by cipher, format version and
+// key derivation function. Only headers are read, so no key is needed and
+// files encrypted under other keys are counted too. The returned error is
+// only set if root itself cannot be listed.
+func (e *EncryptFS) Inventory(root string) (*InventoryReport, error) {
+	report := &InventoryReport{
+		Ciphers:  make(map[CipherSuite]int),
+		Versions: make(map[uint8]int),
+		KDFs:     make(map[KDFID]int),
+	}
+
+	entries, err := e.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+	e.inventoryDir(report, root, entries)
+
+	return report, nil
+}
+
+// inventoryDir adds a directory's entries to the report, descending into
+// subdirectories
+func (e *EncryptFS) inventoryDir(report *InventoryReport, dir string, entries []fs.DirEntry) {
+	for _, entry := range entries {
+		name := path.Join(dir, entry.Name())
+
+		if entry.IsDir() {
+			children, err := e.ReadDir(name)
+			if err != nil {
+				report.Unreadable = append(report.Unreadable, name)
+				continue
+			}
+			e.inventoryDir(report, name, children)
+			continue
+		}
+
+		size, header, chunked, err := e.readFileHeader(name)
+		if err != nil {
+			report.Unreadable = append(report.Unreadable, name)
+			continue
+		}
+
+		report.Files++
+		report.TotalBytes += size
+		if chunked {
+			report.Chunked++
+		}
+		report.Ciphers[header.Cipher]++
+		report.Versions[header.Version]++
+		report.KDFs[header.KDF.ID]++
+	}
+}
@@ -0,0 +1,107 @@
+package encryptfs
+
+import (
+	"os"
+	"testing"
+)
+
+func TestInventory(t *testing.T) {
+	base, cleanup := setupTestFS(t)
+	defer cleanup()
+
+	argon2id := NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+		Memory:      64 * 1024,
+		Iterations:  1,
+		Parallelism: 2,
+	})
+	pbkdf2 := NewPasswordKeyProviderPBKDF2([]byte("other-password"), PBKDF2Params{
+		Iterations: 1000,
+		HashFunc:   SHA256,
+	})
+
+	newFS := func(cipher CipherSuite, provider KeyProvider, chunkSize int) *EncryptFS {
+		fs, err := New(base, &Config{Cipher: cipher, KeyProvider: provider, ChunkSize: chunkSize})
+		if err != nil {
+			t.Fatalf("failed to create EncryptFS: %v", err)
+		}
+		return fs
+	}
+	aes := newFS(CipherAES256GCM, argon2id, 0)
+	chacha := newFS(CipherChaCha20Poly1305, pbkdf2, 0)
+	chunked := newFS(CipherChaCha20Poly1305, argon2id, 4*1024)
+
+	if err := aes.MkdirAll("/docs/old", 0755); err != nil {
+		t.Fatalf("MkdirAll failed: %v", err)
+	}
+
+	var totalBytes int64
+	for _, f := range []struct {
+		fs   *EncryptFS
+		name string
+	}{
+		{aes, "/a.txt"},
+		{aes, "/docs/b.txt"},
+		{chacha, "/docs/c.txt"},
+		{chacha, "/docs/old/d.txt"},
+		{chunked, "/docs/old/e.bin"},
+	} {
+		file, err := f.fs.Create(f.name)
+		if err != nil {
+			t.Fatalf("failed to create %s: %v", f.name, err)
+		}
+		file.Write([]byte("contents of " + f.name))
+		file.Close()
+
+		info, err := base.Stat(f.name)
+		if err != nil {
+			t.Fatalf("failed to stat %s: %v", f.name, err)
+		}
+		totalBytes += info.Size()
+	}
+
+	// A file that is not encrypted at all is reported, not counted
+	file, err := base.OpenFile("/docs/plain.txt", os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatalf("failed to create plain file: %v", err)
+	}
+	file.Write([]byte("not encrypted"))
+	file.Close()
+
+	// Any key can take the inventory, as only headers are read
+	report, err := chacha.Inventory("/")
+	if err != nil {
+		t.Fatalf("Inventory failed: %v", err)
+	}
+
+	if report.Files != 5 {
+		t.Errorf("Files = %d, want 5", report.Files)
+	}
+	if report.TotalBytes != totalBytes {
+		t.Errorf("TotalBytes = %d, want %d", report.TotalBytes, totalBytes)
+	}
+	if report.Chunked != 1 {
+		t.Errorf("Chunked = %d, want 1", report.Chunked)
+	}
+	if got := report.Ciphers[CipherAES256GCM]; got != 2 {
+		t.Errorf("%s files = %d, want 2", CipherAES256GCM, got)
+	}
+	if got := report.Ciphers[CipherChaCha20Poly1305]; got != 3 {
+		t.Errorf("%s files = %d, want 3", CipherChaCha20Poly1305, got)
+	}
+	if got := report.KDFs[KDFArgon2id]; got != 3 {
+		t.Errorf("%s files = %d, want 3", KDFArgon2id, got)
+	}
+	if got := report.KDFs[KDFPBKDF2]; got != 2 {
+		t.Errorf("%s files = %d, want 2", KDFPBKDF2, got)
+	}
+	if got := report.Versions[CurrentVersion]; got != 5 {
+		t.Errorf("version %d files = %d, want 5", CurrentVersion, got)
+	}
+	if len(report.Unreadable) != 1 || report.Unreadable[0] != "/docs/plain.txt" {
+		t.Errorf("Unreadable = %v, want [/docs/plain.txt]", report.Unreadable)
+	}
+
+	if _, err := chacha.Inventory("/missing"); !os.IsNotExist(err) {
+		t.Errorf("Inventory of a missing root error = %v, want not exist", err)
+	}
+}
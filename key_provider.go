@@ -7,18 +7,32 @@ import (
 	"errors"
 	"fmt"
 	"hash"
+	"io"
 	"os"
 
 	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/hkdf"
 	"golang.org/x/crypto/pbkdf2"
 )
 
+// defaultSaltSize is the size of the salts generated when none is configured
+const defaultSaltSize = 32
+
+// defaultKDFLimits are the most expensive derivation parameters a
+// PasswordKeyProvider accepts from file headers, unless it is configured with
+// stronger parameters itself or given other limits with SetKDFLimit
+var defaultKDFLimits = map[KDFID]KDFParams{
+	KDFArgon2id: {ID: KDFArgon2id, Iterations: 10, Memory: 1024 * 1024, Parallelism: 16},
+	KDFPBKDF2:   {ID: KDFPBKDF2, Iterations: 2000000},
+}
+
 // PasswordKeyProvider implements KeyProvider using password-based key derivation
 type PasswordKeyProvider struct {
 	password     []byte
 	useArgon2id  bool
 	pbkdf2Params PBKDF2Params
 	argon2Params Argon2idParams
+	kdfLimits    map[KDFID]KDFParams
 }
 
 // NewPasswordKeyProviderPBKDF2 creates a new password-based key provider using PBKDF2
@@ -28,7 +42,7 @@ func NewPasswordKeyProviderPBKDF2(password []byte, params PBKDF2Params) *Passwor
 		params.Iterations = 100000
 	}
 	if params.SaltSize == 0 {
-		params.SaltSize = 32
+		params.SaltSize = defaultSaltSize
 	}
 	if params.KeySize == 0 {
 		params.KeySize = 32
@@ -54,7 +68,7 @@ func NewPasswordKeyProvider(password []byte, params Argon2idParams) *PasswordKey
 		params.Parallelism = 4
 	}
 	if params.SaltSize == 0 {
-		params.SaltSize = 32
+		params.SaltSize = defaultSaltSize
 	}
 	if params.KeySize == 0 {
 		params.KeySize = 32
@@ -68,7 +82,7 @@ func NewPasswordKeyProvider(password []byte, params Argon2idParams) *PasswordKey
 }
 
 // DeriveKey derives an encryption key from the password and salt
-func (p *PasswordKeyProvider) DeriveKey(salt []byte) ([]byte, error) {
+func (p *PasswordKeyProvider) DeriveKey(salt []byte) (*SecretKey, error) {
 	if len(p.password) == 0 {
 		return nil, errors.New("password cannot be empty")
 	}
@@ -86,7 +100,7 @@ func (p *PasswordKeyProvider) DeriveKey(salt []byte) ([]byte, error) {
 			p.argon2Params.Parallelism,
 			uint32(p.argon2Params.KeySize),
 		)
-		return key, nil
+		return NewSecretKey(key), nil
 	}
 
 	// Use PBKDF2
@@ -107,23 +121,118 @@ func (p *PasswordKeyProvider) DeriveKey(salt []byte) ([]byte, error) {
 		p.pbkdf2Params.KeySize,
 		hashFunc,
 	)
-	return key, nil
+	return NewSecretKey(key), nil
 }
 
-// GenerateSalt generates a new random salt
+// KDFParams returns the derivation parameters used for new keys
+func (p *PasswordKeyProvider) KDFParams() KDFParams {
+	if p.useArgon2id {
+		return KDFParams{
+			ID:          KDFArgon2id,
+			Iterations:  p.argon2Params.Iterations,
+			Memory:      p.argon2Params.Memory,
+			Parallelism: p.argon2Params.Parallelism,
+			KeySize:     uint16(p.argon2Params.KeySize),
+		}
+	}
+	return KDFParams{
+		ID:         KDFPBKDF2,
+		Iterations: uint32(p.pbkdf2Params.Iterations),
+		HashFunc:   p.pbkdf2Params.HashFunc,
+		KeySize:    uint16(p.pbkdf2Params.KeySize),
+	}
+}
+
+// SetKDFLimit sets the most expensive parameters DeriveKeyWithParams accepts
+// for limit.ID. Headers asking for more iterations, memory or parallelism
+// are rejected with ErrKDFLimit. Without a limit, the provider's own
+// parameters or a default of 1 GiB, 10 iterations and 16 threads for
+// Argon2id and 2,000,000 PBKDF2 iterations apply, whichever is stronger.
+func (p *PasswordKeyProvider) SetKDFLimit(limit KDFParams) {
+	if p.kdfLimits == nil {
+		p.kdfLimits = make(map[KDFID]KDFParams)
+	}
+	p.kdfLimits[limit.ID] = limit
+}
+
+// kdfLimit returns the most expensive parameters accepted for id
+func (p *PasswordKeyProvider) kdfLimit(id KDFID) KDFParams {
+	if limit, ok := p.kdfLimits[id]; ok {
+		return limit
+	}
+	limit := defaultKDFLimits[id]
+	if own := p.KDFParams(); own.ID == id {
+		limit.Iterations = max(limit.Iterations, own.Iterations)
+		limit.Memory = max(limit.Memory, own.Memory)
+		limit.Parallelism = max(limit.Parallelism, own.Parallelism)
+	}
+	return limit
+}
+
+// DeriveKeyWithParams derives a key from the password using explicit
+// parameters, typically those recorded in a file header. The parameters are
+// validated and checked against the provider's limit first so that a
+// crafted header cannot demand excessive resources.
+func (p *PasswordKeyProvider) DeriveKeyWithParams(salt []byte, params KDFParams) (*SecretKey, error) {
+	derived := &PasswordKeyProvider{password: p.password}
+
+	if params.ID == KDFArgon2id || params.ID == KDFPBKDF2 {
+		limit := p.kdfLimit(params.ID)
+		if params.Iterations > limit.Iterations || params.Memory > limit.Memory || params.Parallelism > limit.Parallelism {
+			return nil, fmt.Errorf("%w: %s with %d iterations, %d KiB and %d threads",
+				ErrKDFLimit, params.ID, params.Iterations, params.Memory, params.Parallelism)
+		}
+	}
+
+	switch params.ID {
+	case KDFArgon2id:
+		derived.useArgon2id = true
+		derived.argon2Params = Argon2idParams{
+			Memory:      params.Memory,
+			Iterations:  params.Iterations,
+			Parallelism: params.Parallelism,
+			SaltSize:    len(salt),
+			KeySize:     int(params.KeySize),
+		}
+		if err := derived.argon2Params.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid stored kdf parameters: %w", err)
+		}
+	case KDFPBKDF2:
+		derived.pbkdf2Params = PBKDF2Params{
+			Iterations: int(params.Iterations),
+			HashFunc:   params.HashFunc,
+			SaltSize:   len(salt),
+			KeySize:    int(params.KeySize),
+		}
+		if err := derived.pbkdf2Params.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid stored kdf parameters: %w", err)
+		}
+	default:
+		return p.DeriveKey(salt)
+	}
+
+	return derived.DeriveKey(salt)
+}
+
+// GenerateSalt generates a new random salt of the configured SaltSize, or
+// defaultSaltSize bytes if none is set. Keys for existing files are derived
+// from the salt stored in their header, whatever its size.
 func (p *PasswordKeyProvider) GenerateSalt() ([]byte, error) {
+	return p.generateSaltFrom(rand.Reader)
+}
+
+func (p *PasswordKeyProvider) generateSaltFrom(random io.Reader) ([]byte, error) {
 	var saltSize int
 	if p.useArgon2id {
 		saltSize = p.argon2Params.SaltSize
 	} else {
 		saltSize = p.pbkdf2Params.SaltSize
 	}
-
-	salt := make([]byte, saltSize)
-	if _, err := rand.Read(salt); err != nil {
-		return nil, fmt.Errorf("failed to generate salt: %w", err)
+	if saltSize <= 0 {
+		saltSize = defaultSaltSize
 	}
-	return salt, nil
+
+	return readSalt(random, saltSize)
 }
 
 // EnvKeyProvider implements KeyProvider using an environment variable
@@ -142,7 +251,7 @@ func NewEnvKeyProvider(envVar string) *EnvKeyProvider {
 
 // DeriveKey returns the key from the environment variable
 // For env-based keys, the salt is ignored as the key is pre-derived
-func (e *EnvKeyProvider) DeriveKey(salt []byte) ([]byte, error) {
+func (e *EnvKeyProvider) DeriveKey(salt []byte) (*SecretKey, error) {
 	keyHex := os.Getenv(e.envVar)
 	if keyHex == "" {
 		return nil, fmt.Errorf("environment variable %s not set", e.envVar)
@@ -156,14 +265,148 @@ func (e *EnvKeyProvider) DeriveKey(salt []byte) ([]byte, error) {
 		return nil, fmt.Errorf("key from environment variable must be 32 bytes, got %d", len(key))
 	}
 
-	return key, nil
+	return NewSecretKey(key), nil
 }
 
 // GenerateSalt generates a new random salt
 func (e *EnvKeyProvider) GenerateSalt() ([]byte, error) {
-	salt := make([]byte, e.saltSize)
-	if _, err := rand.Read(salt); err != nil {
+	return e.generateSaltFrom(rand.Reader)
+}
+
+func (e *EnvKeyProvider) generateSaltFrom(random io.Reader) ([]byte, error) {
+	return readSalt(random, e.saltSize)
+}
+
+const (
+	// MinRawKeySize is the minimum length of a key passed to NewRawKeyProvider
+	MinRawKeySize = 32
+
+	// keyIDSize is the size of the key identifiers of the built-in providers
+	keyIDSize = 8
+)
+
+// RawKeyProvider implements KeyProvider using an existing high-entropy key,
+// such as one issued by a KMS or HSM. No password KDF is run; per-file keys
+// are expanded from the raw key with HKDF so each salt yields a distinct key.
+type RawKeyProvider struct {
+	key      []byte
+	saltSize int
+}
+
+// NewRawKeyProvider creates a key provider from a raw key of at least
+// MinRawKeySize bytes. The key is copied.
+func NewRawKeyProvider(key []byte) (*RawKeyProvider, error) {
+	if len(key) < MinRawKeySize {
+		return nil, &ValidationError{
+			Field:   "key",
+			Value:   len(key),
+			Message: fmt.Sprintf("raw key must be at least %d bytes, got %d", MinRawKeySize, len(key)),
+		}
+	}
+
+	return &RawKeyProvider{
+		key:      append([]byte(nil), key...),
+		saltSize: 32,
+	}, nil
+}
+
+// DeriveKey expands the raw key with HKDF-SHA256, using the salt as the
+// info parameter
+func (r *RawKeyProvider) DeriveKey(salt []byte) (*SecretKey, error) {
+	if len(salt) == 0 {
+		return nil, errors.New("salt cannot be empty")
+	}
+
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, r.key, salt), key); err != nil {
+		return nil, fmt.Errorf("failed to expand key: %w", err)
+	}
+	return NewSecretKey(key), nil
+}
+
+// KeyID returns the first keyIDSize bytes of a SHA-256 hash of the raw key.
+// The key has full entropy, so the hash does not reveal it.
+func (r *RawKeyProvider) KeyID() []byte {
+	sum := sha256.Sum256(append([]byte("encryptfs key id\x00"), r.key...))
+	return sum[:keyIDSize]
+}
+
+// GenerateSalt generates a new random salt
+func (r *RawKeyProvider) GenerateSalt() ([]byte, error) {
+	return r.generateSaltFrom(rand.Reader)
+}
+
+func (r *RawKeyProvider) generateSaltFrom(random io.Reader) ([]byte, error) {
+	return readSalt(random, r.saltSize)
+}
+
+// readSalt reads a salt of the given size from random
+func readSalt(random io.Reader, size int) ([]byte, error) {
+	salt := make([]byte, size)
+	if _, err := io.ReadFull(random, salt); err != nil {
 		return nil, fmt.Errorf("failed to generate salt: %w", err)
 	}
 	return salt, nil
 }
+
+// saltSource is implemented by the built-in providers, whose salts are
+// plain random bytes, so that they can be drawn from Config.RandSource
+type saltSource interface {
+	generateSaltFrom(random io.Reader) ([]byte, error)
+}
+
+// generateSalt generates a salt with the provider, reading it from random
+// if the provider's salts are plain random bytes
+func generateSalt(provider KeyProvider, random io.Reader) ([]byte, error) {
+	if p, ok := provider.(saltSource); ok {
+		return p.generateSaltFrom(random)
+	}
+	return provider.GenerateSalt()
+}
+
+// saltDiscarder is implemented by providers that keep state for a salt they
+// generated until the key for it is derived
+type saltDiscarder interface {
+	discardSalt(salt []byte)
+}
+
+// discardSalt releases what the provider keeps for a generated salt whose
+// key will not be derived, as the file it was for was never created
+func discardSalt(provider KeyProvider, salt []byte) {
+	if p, ok := provider.(saltDiscarder); ok {
+		p.discardSalt(salt)
+	}
+}
+
+// kdfParamsFor returns the KDF parameters to record for keys derived by the
+// given provider, or zero parameters if the provider cannot describe them
+func kdfParamsFor(provider KeyProvider) KDFParams {
+	if p, ok := provider.(KDFParamsProvider); ok {
+		return p.KDFParams()
+	}
+	return KDFParams{}
+}
+
+// keyIDFor returns the key identifier to record for files written by the
+// given provider, or nil if it has none
+func keyIDFor(provider KeyProvider) []byte {
+	if p, ok := provider.(KeyIDProvider); ok {
+		return p.KeyID()
+	}
+	return nil
+}
+
+// deriveKeyForHeader derives the key for an existing file, preferring the
+// KDF parameters recorded in its header over the provider's configuration.
+// A RecoveryKeyProvider unwraps the copy of the key recorded in the header.
+func deriveKeyForHeader(provider KeyProvider, header *FileHeader) (*SecretKey, error) {
+	if p, ok := provider.(*RecoveryKeyProvider); ok {
+		return p.unwrap(header)
+	}
+	if header.KDF.ID != KDFNone {
+		if p, ok := provider.(KDFParamsProvider); ok {
+			return p.DeriveKeyWithParams(header.Salt, header.KDF)
+		}
+	}
+	return provider.DeriveKey(header.Salt)
+}
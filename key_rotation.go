@@ -1,10 +1,18 @@
 package encryptfs
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/absfs/absfs"
 )
 
 // MultiKeyProvider tries multiple key providers in order for decryption
@@ -28,7 +36,7 @@ func NewMultiKeyProvider(providers ...KeyProvider) (*MultiKeyProvider, error) {
 }
 
 // DeriveKey uses the primary provider
-func (m *MultiKeyProvider) DeriveKey(salt []byte) ([]byte, error) {
+func (m *MultiKeyProvider) DeriveKey(salt []byte) (*SecretKey, error) {
 	return m.primary.DeriveKey(salt)
 }
 
@@ -37,9 +45,69 @@ func (m *MultiKeyProvider) GenerateSalt() ([]byte, error) {
 	return m.primary.GenerateSalt()
 }
 
+func (m *MultiKeyProvider) generateSaltFrom(random io.Reader) ([]byte, error) {
+	return generateSalt(m.primary, random)
+}
+
+func (m *MultiKeyProvider) discardSalt(salt []byte) {
+	discardSalt(m.primary, salt)
+}
+
+// KDFParams returns the primary provider's derivation parameters
+func (m *MultiKeyProvider) KDFParams() KDFParams {
+	return kdfParamsFor(m.primary)
+}
+
+// KeyID returns the primary provider's key identifier
+func (m *MultiKeyProvider) KeyID() []byte {
+	return keyIDFor(m.primary)
+}
+
+// DeriveKeyWithParams derives a key with the primary provider using explicit parameters
+func (m *MultiKeyProvider) DeriveKeyWithParams(salt []byte, params KDFParams) (*SecretKey, error) {
+	return deriveKeyForHeader(m.primary, &FileHeader{Salt: salt, KDF: params})
+}
+
+// providersFor returns the providers that may have written a file with the
+// given key identifier, in the order they should be tried: those with a
+// matching identifier first, then those without one. Providers whose
+// identifier differs cannot have written the file and are left out. Without
+// an identifier every provider is returned in order.
+func (m *MultiKeyProvider) providersFor(keyID []byte) []KeyProvider {
+	if len(keyID) == 0 {
+		return m.providers
+	}
+
+	var matching, unknown []KeyProvider
+	for _, provider := range m.providers {
+		switch id := keyIDFor(provider); {
+		case len(id) == 0:
+			unknown = append(unknown, provider)
+		case bytes.Equal(id, keyID):
+			matching = append(matching, provider)
+		}
+	}
+	return append(matching, unknown...)
+}
+
+// keyProviderFor returns the provider of a MultiKeyProvider whose key
+// identifier matches the one recorded in header, so that the file is
+// decrypted without trying the others. Any other provider, or a
+// MultiKeyProvider without a match, is returned as it is.
+func keyProviderFor(provider KeyProvider, header *FileHeader) KeyProvider {
+	multi, ok := provider.(*MultiKeyProvider)
+	if !ok || len(header.KeyID) == 0 {
+		return provider
+	}
+	if candidates := multi.providersFor(header.KeyID); len(candidates) > 0 && bytes.Equal(keyIDFor(candidates[0]), header.KeyID) {
+		return candidates[0]
+	}
+	return provider
+}
+
 // TryDeriveKey attempts to derive a key using each provider in order
 // Returns the first successful key derivation
-func (m *MultiKeyProvider) TryDeriveKey(salt []byte) ([]byte, error) {
+func (m *MultiKeyProvider) TryDeriveKey(salt []byte) (*SecretKey, error) {
 	var lastErr error
 	for _, provider := range m.providers {
 		key, err := provider.DeriveKey(salt)
@@ -73,6 +141,25 @@ type KeyRotationOptions struct {
 
 	// DryRun simulates the operation without making changes
 	DryRun bool
+
+	// CheckpointPath is a path on the base filesystem where RotateAllKeys
+	// records its progress, so an interrupted rotation can be resumed by
+	// calling it again with the same path. The checkpoint lists the
+	// encrypted paths of the rotated files, so it reveals no more than the
+	// base filesystem does. It is removed once every file has been rotated,
+	// and must not lie inside the rotated tree.
+	CheckpointPath string
+
+	// Atomic writes each re-encrypted file to a temporary file beside it,
+	// checks that the temporary file decrypts to the original contents with
+	// the new key, and only then renames it over the original, so an
+	// interrupted rotation leaves the original readable with the old key.
+	// By default files are rewritten in place.
+	Atomic bool
+
+	// FormatDescriptor gives every re-encrypted file a format descriptor,
+	// as Config.FormatDescriptor does for new files
+	FormatDescriptor bool
 }
 
 // ReEncrypt re-encrypts a file with a new key provider
@@ -108,96 +195,347 @@ func (e *EncryptFS) ReEncrypt(name string, opts KeyRotationOptions) error {
 		return nil
 	}
 
-	// Create a new EncryptFS with the new key provider
-	cipher := opts.NewCipher
-	if cipher == 0 {
-		cipher = e.cipher // Use existing cipher if not specified
+	// Write with new encryption
+	if opts.Atomic {
+		if err := e.replaceAtomically(name, content, opts); err != nil {
+			return err
+		}
+	} else {
+		newFile, err := e.rotationFS(opts).Create(name)
+		if err != nil {
+			return fmt.Errorf("failed to create new file: %w", err)
+		}
+
+		_, err = newFile.Write(content)
+		if err != nil {
+			newFile.Close()
+			return fmt.Errorf("failed to write re-encrypted content: %w", err)
+		}
+
+		if err := newFile.Close(); err != nil {
+			return fmt.Errorf("failed to close new file: %w", err)
+		}
+	}
+
+	// Restore permissions if requested
+	if opts.PreserveTimestamps {
+		if err := e.Chmod(name, origModTime); err != nil {
+			return fmt.Errorf("failed to restore permissions: %w", err)
+		}
 	}
 
-	newConfig := &Config{
-		Cipher:      cipher,
-		KeyProvider: opts.NewKeyProvider,
+	if opts.Verbose {
+		fmt.Printf("Re-encrypted %s (%d bytes)\n", name, len(content))
 	}
 
-	newFS, err := New(e.base, newConfig)
+	return nil
+}
+
+// replaceAtomically re-encrypts content into a temporary file beside name,
+// checks that it reads back as content, and renames it over name. The
+// temporary file takes name's mode and extended attributes first. On failure
+// it is removed and name is left as it was.
+func (e *EncryptFS) replaceAtomically(name string, content []byte, opts KeyRotationOptions) (err error) {
+	info, err := e.Stat(name)
 	if err != nil {
-		return fmt.Errorf("failed to create new encrypted filesystem: %w", err)
+		return fmt.Errorf("failed to stat file: %w", err)
 	}
 
-	// Write with new encryption
-	newFile, err := newFS.Create(name)
+	suffix := make([]byte, 8)
+	if _, err := io.ReadFull(e.random, suffix); err != nil {
+		return fmt.Errorf("failed to generate temporary name: %w", err)
+	}
+	tmp := path.Join(path.Dir(name), "."+path.Base(name)+".rotate-"+hex.EncodeToString(suffix))
+
+	r := e.rotationFS(opts)
+	if err := r.writeFile(tmp, content); err != nil {
+		e.Remove(tmp)
+		return fmt.Errorf("failed to write re-encrypted content: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			e.Remove(tmp)
+		}
+	}()
+
+	file, err := r.Open(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to verify re-encrypted content: %w", err)
+	}
+	written, err := io.ReadAll(file)
+	file.Close()
 	if err != nil {
-		return fmt.Errorf("failed to create new file: %w", err)
+		return fmt.Errorf("failed to verify re-encrypted content: %w", err)
+	}
+	if !bytes.Equal(written, content) {
+		return NewCorruptionError(tmp, "re-encrypted content does not match the original")
 	}
 
-	_, err = newFile.Write(content)
+	if err := e.Chmod(tmp, info.Mode().Perm()); err != nil {
+		return fmt.Errorf("failed to copy permissions: %w", err)
+	}
+	encryptedName, err := e.translatePath(name)
 	if err != nil {
-		newFile.Close()
-		return fmt.Errorf("failed to write re-encrypted content: %w", err)
+		return err
+	}
+	encryptedTmp, err := e.translatePath(tmp)
+	if err != nil {
+		return err
+	}
+	if err := e.copyXattrs(encryptedName, encryptedTmp); err != nil {
+		return fmt.Errorf("failed to copy extended attributes: %w", err)
 	}
 
-	if err := newFile.Close(); err != nil {
-		return fmt.Errorf("failed to close new file: %w", err)
+	if err := e.Rename(tmp, name); err != nil {
+		return fmt.Errorf("failed to replace file: %w", err)
 	}
 
-	// Restore permissions if requested
-	if opts.PreserveTimestamps {
-		if err := e.Chmod(name, origModTime); err != nil {
-			return fmt.Errorf("failed to restore permissions: %w", err)
+	// A crash must not bring back the original once the rename returned
+	if err := e.syncParent(encryptedName); err != nil {
+		return fmt.Errorf("failed to sync directory: %w", err)
+	}
+	return nil
+}
+
+// rotationFS returns a view of the filesystem that encrypts file contents
+// with the rotation's key provider and cipher. Filename encryption, the
+// filename metadata database and the flattened namespace are shared with e,
+// so a re-encrypted file keeps its encrypted path and its plaintext name
+// mapping; only the key of its contents changes. Re-encrypted files carry
+// their own salt, as the shared salt keyfile belongs to the old key.
+func (e *EncryptFS) rotationFS(opts KeyRotationOptions) *EncryptFS {
+	cipher := opts.NewCipher
+	if cipher == 0 {
+		cipher = e.cipher // Use existing cipher if not specified
+	}
+
+	config := *e.config
+	config.Cipher = cipher
+	config.KeyProvider = opts.NewKeyProvider
+	config.SharedSalt = false
+	config.FormatDescriptor = config.FormatDescriptor || opts.FormatDescriptor
+
+	r := *e
+	r.config = &config
+	r.keyProvider = opts.NewKeyProvider
+	r.cipher = cipher
+
+	// The verification marker is rewrapped by RotateAllKeys once the whole
+	// tree is rotated, never created under the new key before then
+	r.marked = new(atomic.Bool)
+	r.marked.Store(true)
+
+	return &r
+}
+
+// RotateAllKeys re-encrypts all files in a directory tree with a new key.
+// The tree is walked by plaintext path, so root is a path in the encrypted
+// filesystem.
+//
+// If opts.CheckpointPath is set, every re-encrypted file is recorded there
+// and files already recorded by an earlier, interrupted call are skipped. A
+// file may be rotated again if the interruption fell between re-encrypting
+// it and recording it, so the filesystem should use a MultiKeyProvider that
+// can still read files under both the old and the new key.
+//
+// Once every file of the whole filesystem has been rotated without error,
+// the verification marker is rewrapped under the new key provider, so that
+// ValidatePassword accepts the new password and rejects the old one. With
+// Config.SharedSalt the keyfile is rewrapped too, and so is the config blob
+// written by Config.StoreConfig, so New accepts the new password. A rotation
+// of a subtree leaves them all under the old key.
+func (e *EncryptFS) RotateAllKeys(root string, opts KeyRotationOptions) error {
+	checkpointPath := opts.CheckpointPath
+	if opts.DryRun {
+		checkpointPath = ""
+	}
+	checkpoint, err := openRotationCheckpoint(e.base, checkpointPath)
+	if err != nil {
+		return err
+	}
+
+	rotation := &keyRotation{fs: e, opts: opts, checkpoint: checkpoint}
+	rotation.rotateDir(root)
+
+	if err := checkpoint.close(len(rotation.errors) == 0); err != nil {
+		rotation.errors = append(rotation.errors, err)
+	}
+	if len(rotation.errors) == 0 && !opts.DryRun && e.isWholeTree(root) {
+		if err := e.rewrapMarkers(opts); err != nil {
+			rotation.errors = append(rotation.errors, err)
 		}
 	}
 
+	if len(rotation.errors) > 0 {
+		return fmt.Errorf("key rotation completed with %d errors (rotated %d files, skipped %d)",
+			len(rotation.errors), rotation.rotated, rotation.skipped)
+	}
+
 	if opts.Verbose {
-		fmt.Printf("Re-encrypted %s (%d bytes)\n", name, len(content))
+		fmt.Printf("Successfully rotated keys for %d files\n", rotation.rotated)
 	}
 
 	return nil
 }
 
-// RotateAllKeys re-encrypts all files in a directory tree with a new key
-func (e *EncryptFS) RotateAllKeys(root string, opts KeyRotationOptions) error {
-	var filesRotated int
-	var errors []error
+// isWholeTree reports whether root is the root of the whole filesystem
+func (e *EncryptFS) isWholeTree(root string) bool {
+	sep := string([]byte{e.base.Separator()})
+	return e.root == "" && e.logicalPath(sep+root) == sep
+}
 
-	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			errors = append(errors, fmt.Errorf("walk error for %s: %w", path, err))
-			return nil // Continue walking
+// rewrapMarkers rewrites the marker files of the filesystem under the
+// rotation's key provider, keeping the master key they yield
+func (e *EncryptFS) rewrapMarkers(opts KeyRotationOptions) error {
+	cipher := opts.NewCipher
+	if cipher == 0 {
+		cipher = e.cipher
+	}
+	paths := []string{e.verifyMarkerPath(), configBlobPath(e.base)}
+	if e.config.SharedSalt {
+		paths = append(paths, KeyfilePath)
+	}
+	for _, path := range paths {
+		if err := rewrapMarker(e.base, path, e.config.KeyProvider, opts.NewKeyProvider, cipher, e.random); err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
-		// Skip directories
-		if info.IsDir() {
-			return nil
+// keyRotation holds the state of a RotateAllKeys walk
+type keyRotation struct {
+	fs         *EncryptFS
+	opts       KeyRotationOptions
+	checkpoint *rotationCheckpoint
+	rotated    int
+	skipped    int
+	errors     []error
+}
+
+// rotateDir re-encrypts the files beneath a directory, continuing past
+// failures so that as much of the tree as possible is rotated
+func (r *keyRotation) rotateDir(dir string) {
+	entries, err := r.fs.ReadDir(dir)
+	if err != nil {
+		r.errors = append(r.errors, fmt.Errorf("walk error for %s: %w", dir, err))
+		return
+	}
+
+	for _, entry := range entries {
+		name := path.Join(dir, entry.Name())
+
+		if entry.IsDir() {
+			r.rotateDir(name)
+			continue
 		}
 
-		// Try to re-encrypt the file
-		relPath, err := filepath.Rel(root, path)
+		// The checkpoint lies on the base filesystem, so it records encrypted
+		// paths. An atomic rotation may give the file a new one, so it is
+		// translated again once the file is rotated.
+		encrypted, err := r.fs.translatePath(name)
 		if err != nil {
-			errors = append(errors, fmt.Errorf("failed to get relative path for %s: %w", path, err))
-			return nil
+			r.errors = append(r.errors, fmt.Errorf("failed to translate %s: %w", name, err))
+			continue
+		}
+		if r.checkpoint.completed(encrypted) {
+			r.skipped++
+			continue
 		}
 
-		if err := e.ReEncrypt("/"+relPath, opts); err != nil {
-			errors = append(errors, fmt.Errorf("failed to re-encrypt %s: %w", relPath, err))
-			return nil
+		if err := r.fs.ReEncrypt(name, r.opts); err != nil {
+			r.errors = append(r.errors, fmt.Errorf("failed to re-encrypt %s: %w", name, err))
+			continue
 		}
 
-		filesRotated++
-		return nil
-	})
+		if !r.opts.DryRun {
+			if encrypted, err = r.fs.translatePath(name); err == nil {
+				err = r.checkpoint.record(encrypted)
+			}
+			if err != nil {
+				r.errors = append(r.errors, err)
+				continue
+			}
+		}
+		r.rotated++
+	}
+}
 
+// rotationCheckpoint records the files a key rotation has completed, one
+// encrypted path per line. A line cut short by a crash matches no file, so
+// that file is simply rotated again on resume.
+type rotationCheckpoint struct {
+	fs   absfs.FileSystem
+	path string
+	done map[string]bool
+	file absfs.File
+}
+
+// openRotationCheckpoint loads the checkpoint at path, if any, and opens it
+// for appending. An empty path disables checkpointing.
+func openRotationCheckpoint(fs absfs.FileSystem, path string) (*rotationCheckpoint, error) {
+	c := &rotationCheckpoint{fs: fs, path: path, done: make(map[string]bool)}
+	if path == "" {
+		return c, nil
+	}
+
+	file, err := fs.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
 	if err != nil {
-		return fmt.Errorf("walk failed: %w", err)
+		return nil, fmt.Errorf("failed to open checkpoint: %w", err)
 	}
 
-	if len(errors) > 0 {
-		return fmt.Errorf("key rotation completed with %d errors (rotated %d files)", len(errors), filesRotated)
+	data, err := io.ReadAll(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to read checkpoint: %w", err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" {
+			c.done[line] = true
+		}
 	}
 
-	if opts.Verbose {
-		fmt.Printf("Successfully rotated keys for %d files\n", filesRotated)
+	c.file = file
+	return c, nil
+}
+
+// completed reports whether the checkpoint records the file at the encrypted
+// path name as rotated
+func (c *rotationCheckpoint) completed(name string) bool {
+	return c.done[name]
+}
+
+// record appends the encrypted path name to the checkpoint and syncs it to
+// storage
+func (c *rotationCheckpoint) record(name string) error {
+	c.done[name] = true
+	if c.file == nil {
+		return nil
 	}
 
+	if _, err := c.file.Write([]byte(name + "\n")); err != nil {
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	if err := c.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync checkpoint: %w", err)
+	}
+	return nil
+}
+
+// close closes the checkpoint file, removing it if the rotation finished
+func (c *rotationCheckpoint) close(finished bool) error {
+	if c.file == nil {
+		return nil
+	}
+
+	if err := c.file.Close(); err != nil {
+		return fmt.Errorf("failed to close checkpoint: %w", err)
+	}
+	if finished {
+		if err := c.fs.Remove(c.path); err != nil {
+			return fmt.Errorf("failed to remove checkpoint: %w", err)
+		}
+	}
 	return nil
 }
 
@@ -217,7 +555,8 @@ func (e *EncryptFS) WalkEncrypted(root string, walkFn EncryptedFileWalker) error
 	})
 }
 
-// VerifyEncryption verifies that a file can be decrypted successfully
+// VerifyEncryption verifies that a file can be decrypted successfully. Files
+// that record a plaintext digest must also match it.
 func (e *EncryptFS) VerifyEncryption(name string) error {
 	file, err := e.Open(name)
 	if err != nil {
@@ -226,11 +565,21 @@ func (e *EncryptFS) VerifyEncryption(name string) error {
 	defer file.Close()
 
 	// Try to read the entire file
-	_, err = io.ReadAll(file)
-	if err != nil {
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
 		return fmt.Errorf("failed to decrypt: %w", err)
 	}
 
+	if d, ok := file.(interface{ Digest() []byte }); ok {
+		if want := d.Digest(); want != nil && !bytes.Equal(want, h.Sum(nil)) {
+			return &CorruptionError{
+				Path:    name,
+				Message: ErrDigestMismatch.Error(),
+				Err:     ErrDigestMismatch,
+			}
+		}
+	}
+
 	return nil
 }
 
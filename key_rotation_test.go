@@ -2,8 +2,15 @@ package encryptfs
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"io"
+	"os"
+	"path"
+	"strings"
 	"testing"
+
+	"github.com/absfs/absfs"
 )
 
 func TestMultiKeyProvider(t *testing.T) {
@@ -76,6 +83,112 @@ func TestMultiKeyProvider(t *testing.T) {
 	}
 }
 
+// keyIDProvider reports a fixed key identifier for a counting provider
+type keyIDProvider struct {
+	*countingKeyProvider
+	id []byte
+}
+
+func (p keyIDProvider) KeyID() []byte {
+	return p.id
+}
+
+func TestMultiKeyProvider_KeyID(t *testing.T) {
+	newRaw := func(fill byte) *RawKeyProvider {
+		provider, err := NewRawKeyProvider(bytes.Repeat([]byte{fill}, 32))
+		if err != nil {
+			t.Fatalf("failed to create raw key provider: %v", err)
+		}
+		return provider
+	}
+	oldRaw, newRawKey := newRaw(1), newRaw(2)
+	if bytes.Equal(oldRaw.KeyID(), newRawKey.KeyID()) || len(oldRaw.KeyID()) == 0 {
+		t.Fatalf("raw key ids %x and %x should differ", oldRaw.KeyID(), newRawKey.KeyID())
+	}
+
+	for _, tc := range []struct {
+		name     string
+		chunk    int
+		withID   bool
+		newCalls int // Derivations by the new provider when opening the file
+	}{
+		{"ByID", 0, true, 0},
+		{"ByIDChunked", 4 * 1024, true, 0},
+		{"Trial", 0, false, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			base, cleanup := setupTestFS(t)
+			defer cleanup()
+
+			wrap := func(raw *RawKeyProvider) keyIDProvider {
+				provider := keyIDProvider{countingKeyProvider: &countingKeyProvider{KeyProvider: raw}}
+				if tc.withID {
+					provider.id = raw.KeyID()
+				}
+				return provider
+			}
+			oldKey, newKey := wrap(oldRaw), wrap(newRawKey)
+
+			fs1, err := New(base, &Config{Cipher: CipherAES256GCM, KeyProvider: oldKey, ChunkSize: tc.chunk})
+			if err != nil {
+				t.Fatalf("failed to create EncryptFS: %v", err)
+			}
+			testData := []byte("written under the old key")
+			file, err := fs1.Create("/test.txt")
+			if err != nil {
+				t.Fatalf("failed to create file: %v", err)
+			}
+			file.Write(testData)
+			file.Close()
+			fs1.Close()
+
+			// The header names the key only if the provider has an identifier
+			raw, err := base.Open("/test.txt")
+			if err != nil {
+				t.Fatalf("failed to open base file: %v", err)
+			}
+			header := &FileHeader{}
+			_, err = header.ReadFrom(raw)
+			raw.Close()
+			if err != nil {
+				t.Fatalf("failed to read header: %v", err)
+			}
+			if !bytes.Equal(header.KeyID, oldKey.id) || (header.Flags&FlagKeyID != 0) != tc.withID {
+				t.Fatalf("header key id = %x (flags %#x), want %x", header.KeyID, header.Flags, oldKey.id)
+			}
+
+			multiKey, err := NewMultiKeyProvider(newKey, oldKey)
+			if err != nil {
+				t.Fatalf("failed to create multi-key provider: %v", err)
+			}
+			fs2, err := New(base, &Config{Cipher: CipherAES256GCM, KeyProvider: multiKey, ChunkSize: tc.chunk})
+			if err != nil {
+				t.Fatalf("failed to create EncryptFS with multi-key: %v", err)
+			}
+			defer fs2.Close()
+			newKey.derivations, oldKey.derivations = 0, 0
+
+			file, err = fs2.Open("/test.txt")
+			if err != nil {
+				t.Fatalf("failed to open file with multi-key: %v", err)
+			}
+			readData, err := io.ReadAll(file)
+			file.Close()
+			if err != nil {
+				t.Fatalf("failed to read: %v", err)
+			}
+			if !bytes.Equal(readData, testData) {
+				t.Fatalf("data mismatch when reading with multi-key provider")
+			}
+
+			if newKey.derivations != tc.newCalls || oldKey.derivations != 1 {
+				t.Errorf("derivations: new key %d, old key %d; want %d and 1",
+					newKey.derivations, oldKey.derivations, tc.newCalls)
+			}
+		})
+	}
+}
+
 func TestReEncrypt(t *testing.T) {
 	base, cleanup := setupTestFS(t)
 	defer cleanup()
@@ -157,6 +270,102 @@ func TestReEncrypt(t *testing.T) {
 	}
 }
 
+func TestReEncrypt_Atomic(t *testing.T) {
+	base := newFakeFS()
+
+	params := Argon2idParams{Memory: 64 * 1024, Iterations: 1, Parallelism: 2}
+	oldKey := NewPasswordKeyProvider([]byte("old-password"), params)
+	newKey := NewPasswordKeyProvider([]byte("new-password"), params)
+
+	fs, err := New(base, &Config{Cipher: CipherAES256GCM, KeyProvider: oldKey})
+	if err != nil {
+		t.Fatalf("failed to create EncryptFS: %v", err)
+	}
+	defer fs.Close()
+
+	original := []byte("content that must survive an interrupted rotation")
+	file, err := fs.OpenFile("/data.txt", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	file.Write(original)
+	file.Close()
+	if err := fs.SetXattr("/data.txt", "user.tag", []byte("kept")); err != nil {
+		t.Fatalf("SetXattr failed: %v", err)
+	}
+
+	readWith := func(provider KeyProvider) ([]byte, error) {
+		reader, err := New(base, &Config{Cipher: CipherAES256GCM, KeyProvider: provider})
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		file, err := reader.Open("/data.txt")
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		return io.ReadAll(file)
+	}
+	listing := func() []string {
+		entries, err := fs.ReadDir("/")
+		if err != nil {
+			t.Fatalf("ReadDir failed: %v", err)
+		}
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		return names
+	}
+
+	opts := KeyRotationOptions{NewKeyProvider: newKey, Atomic: true}
+	errInjected := errors.New("injected failure")
+
+	// A failure after the new file is written, or while writing it, leaves
+	// the original readable with the old key and no temporary file behind
+	for _, op := range []string{"rename", "write"} {
+		base.fail(errInjected, 0, 1, op)
+		if err := fs.ReEncrypt("/data.txt", opts); !errors.Is(err, errInjected) {
+			t.Fatalf("%s failure: ReEncrypt error = %v, want the injected error", op, err)
+		}
+		got, err := readWith(oldKey)
+		if err != nil {
+			t.Fatalf("%s failure: original unreadable with the old key: %v", op, err)
+		}
+		if !bytes.Equal(got, original) {
+			t.Fatalf("%s failure: original = %q, want %q", op, got, original)
+		}
+		if names := listing(); len(names) != 1 || names[0] != "data.txt" {
+			t.Errorf("%s failure: directory holds %v, want only data.txt", op, names)
+		}
+	}
+
+	// Without failures the file is replaced and keeps its mode and attributes
+	if err := fs.ReEncrypt("/data.txt", opts); err != nil {
+		t.Fatalf("ReEncrypt failed: %v", err)
+	}
+	got, err := readWith(newKey)
+	if err != nil {
+		t.Fatalf("rotated file unreadable with the new key: %v", err)
+	}
+	if !bytes.Equal(got, original) {
+		t.Errorf("rotated content = %q, want %q", got, original)
+	}
+	if _, err := readWith(oldKey); err == nil {
+		t.Error("rotated file still readable with the old key")
+	}
+	if names := listing(); len(names) != 1 || names[0] != "data.txt" {
+		t.Errorf("directory holds %v, want only data.txt", names)
+	}
+	if info, err := fs.Stat("/data.txt"); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("rotated file mode = %v (%v), want 0600", info, err)
+	}
+	if value, err := fs.GetXattr("/data.txt", "user.tag"); err != nil || string(value) != "kept" {
+		t.Errorf("GetXattr after rotation = %q, %v; want \"kept\"", value, err)
+	}
+}
+
 func TestMigrateCipher(t *testing.T) {
 	base, cleanup := setupTestFS(t)
 	defer cleanup()
@@ -344,3 +553,314 @@ func TestDryRun(t *testing.T) {
 		t.Fatal("dry run should not have changed the encryption")
 	}
 }
+
+// crashingFS counts the files re-encrypted on the base filesystem and fails
+// every write once its budget is spent, simulating a crash
+type crashingFS struct {
+	absfs.FileSystem
+	budget    int // Remaining successful re-encryptions, or -1 for unlimited
+	rewritten map[string]int
+	prefix    string // Base path of the rotated tree, "/data" if empty
+}
+
+func (c *crashingFS) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	prefix := c.prefix
+	if prefix == "" {
+		prefix = "/data"
+	}
+	if flag&os.O_TRUNC != 0 && strings.HasPrefix(name, prefix) {
+		if c.budget == 0 {
+			return nil, errors.New("simulated crash")
+		}
+		if c.budget > 0 {
+			c.budget--
+		}
+		c.rewritten[name]++
+	}
+	return c.FileSystem.OpenFile(name, flag, perm)
+}
+
+func TestRotateAllKeys_Resume(t *testing.T) {
+	for _, chunkSize := range []int{0, 4 * 1024} {
+		t.Run(fmt.Sprintf("chunk=%d", chunkSize), func(t *testing.T) {
+			osBase, cleanup := setupTestFS(t)
+			defer cleanup()
+
+			oldKey := NewPasswordKeyProvider([]byte("old-password"), Argon2idParams{
+				Memory:      64 * 1024,
+				Iterations:  1,
+				Parallelism: 2,
+			})
+			newKey := NewPasswordKeyProvider([]byte("new-password"), Argon2idParams{
+				Memory:      64 * 1024,
+				Iterations:  1,
+				Parallelism: 2,
+			})
+
+			oldFS, err := New(osBase, &Config{Cipher: CipherAES256GCM, KeyProvider: oldKey, ChunkSize: chunkSize})
+			if err != nil {
+				t.Fatalf("failed to create EncryptFS: %v", err)
+			}
+
+			files := []string{"/data/a.txt", "/data/b.txt", "/data/c.txt", "/data/sub/d.txt", "/data/sub/e.txt", "/data/sub/f.txt"}
+			for _, name := range files {
+				file, err := oldFS.Create(name)
+				if err != nil {
+					t.Fatalf("Create(%q) failed: %v", name, err)
+				}
+				file.Write([]byte("content of " + name))
+				file.Close()
+			}
+
+			multiKey, err := NewMultiKeyProvider(newKey, oldKey)
+			if err != nil {
+				t.Fatalf("failed to create multi-key provider: %v", err)
+			}
+
+			base := &crashingFS{FileSystem: osBase, budget: len(files) / 2, rewritten: make(map[string]int)}
+			fs, err := New(base, &Config{Cipher: CipherAES256GCM, KeyProvider: multiKey, ChunkSize: chunkSize})
+			if err != nil {
+				t.Fatalf("failed to create EncryptFS: %v", err)
+			}
+
+			opts := KeyRotationOptions{
+				NewKeyProvider: newKey,
+				CheckpointPath: "/.rotation-checkpoint",
+			}
+
+			// The first run rotates half the tree before crashing
+			if err := fs.RotateAllKeys("/data", opts); err == nil {
+				t.Fatal("expected the interrupted rotation to fail")
+			}
+			if _, err := osBase.Stat(opts.CheckpointPath); err != nil {
+				t.Fatalf("checkpoint missing after interrupted rotation: %v", err)
+			}
+
+			// Resuming skips the files already rotated
+			base.budget = -1
+			if err := fs.RotateAllKeys("/data", opts); err != nil {
+				t.Fatalf("resumed rotation failed: %v", err)
+			}
+			if _, err := osBase.Stat(opts.CheckpointPath); !os.IsNotExist(err) {
+				t.Errorf("checkpoint not removed after rotation: %v", err)
+			}
+
+			newFS, err := New(osBase, &Config{Cipher: CipherAES256GCM, KeyProvider: newKey, ChunkSize: chunkSize})
+			if err != nil {
+				t.Fatalf("failed to create EncryptFS: %v", err)
+			}
+			for _, name := range files {
+				if n := base.rewritten[name]; n != 1 {
+					t.Errorf("%s was re-encrypted %d times, want 1", name, n)
+				}
+
+				file, err := newFS.Open(name)
+				if err != nil {
+					t.Errorf("Open(%q) with new key failed: %v", name, err)
+					continue
+				}
+				data, _ := io.ReadAll(file)
+				file.Close()
+				if want := "content of " + name; string(data) != want {
+					t.Errorf("content of %q = %q, want %q", name, data, want)
+				}
+			}
+		})
+	}
+}
+
+// TestRotateAllKeys_CheckpointNames checks that the checkpoint records
+// encrypted paths, which still match once atomic rotation has given the
+// rotated files new random names
+func TestRotateAllKeys_CheckpointNames(t *testing.T) {
+	for _, chunkSize := range []int{0, 4 * 1024} {
+		t.Run(fmt.Sprintf("chunk=%d", chunkSize), func(t *testing.T) {
+			osBase, cleanup := setupTestFS(t)
+			defer cleanup()
+
+			oldKey := NewPasswordKeyProvider([]byte("old-password"), Argon2idParams{
+				Memory:      64 * 1024,
+				Iterations:  1,
+				Parallelism: 2,
+			})
+			newKey := NewPasswordKeyProvider([]byte("new-password"), Argon2idParams{
+				Memory:      64 * 1024,
+				Iterations:  1,
+				Parallelism: 2,
+			})
+			newFS := func(base absfs.FileSystem, provider KeyProvider) *EncryptFS {
+				fs, err := New(base, &Config{
+					Cipher:             CipherAES256GCM,
+					KeyProvider:        provider,
+					ChunkSize:          chunkSize,
+					FilenameEncryption: FilenameEncryptionRandom,
+					MetadataPath:       "/.metadata.json",
+				})
+				if err != nil {
+					t.Fatalf("failed to create EncryptFS: %v", err)
+				}
+				return fs
+			}
+
+			oldFS := newFS(osBase, oldKey)
+			files := []string{"/data/a.txt", "/data/b.txt", "/data/c.txt", "/data/d.txt"}
+			if err := oldFS.MkdirAll("/data", 0755); err != nil {
+				t.Fatalf("MkdirAll failed: %v", err)
+			}
+			for _, name := range files {
+				file, err := oldFS.Create(name)
+				if err != nil {
+					t.Fatalf("Create(%q) failed: %v", name, err)
+				}
+				file.Write([]byte("content of " + name))
+				file.Close()
+			}
+			dataDir, err := oldFS.translatePath("/data")
+			if err != nil {
+				t.Fatalf("failed to translate /data: %v", err)
+			}
+			if err := oldFS.Close(); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+
+			multiKey, err := NewMultiKeyProvider(newKey, oldKey)
+			if err != nil {
+				t.Fatalf("failed to create multi-key provider: %v", err)
+			}
+			base := &crashingFS{FileSystem: osBase, budget: len(files) / 2, rewritten: make(map[string]int), prefix: dataDir}
+			fs := newFS(base, multiKey)
+			defer fs.Close()
+
+			opts := KeyRotationOptions{
+				NewKeyProvider: newKey,
+				CheckpointPath: "/.rotation-checkpoint",
+				Atomic:         true,
+			}
+			if err := fs.RotateAllKeys("/data", opts); err == nil {
+				t.Fatal("expected the interrupted rotation to fail")
+			}
+			checkpoint, err := readBaseFile(osBase, opts.CheckpointPath)
+			if err != nil {
+				t.Fatalf("failed to read checkpoint: %v", err)
+			}
+			if bytes.Contains(checkpoint, []byte("data")) || bytes.Contains(checkpoint, []byte(".txt")) {
+				t.Errorf("checkpoint lists plaintext names: %q", checkpoint)
+			}
+			if lines := strings.Count(string(checkpoint), "\n"); lines != len(files)/2 {
+				t.Errorf("checkpoint records %d files, want %d", lines, len(files)/2)
+			}
+
+			// Resuming rotates only the remaining files
+			base.budget = -1
+			if err := fs.RotateAllKeys("/data", opts); err != nil {
+				t.Fatalf("resumed rotation failed: %v", err)
+			}
+			rewritten := 0
+			for _, n := range base.rewritten {
+				rewritten += n
+			}
+			if rewritten != len(files) {
+				t.Errorf("%d files re-encrypted, want %d", rewritten, len(files))
+			}
+			if err := fs.Close(); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+
+			rotated := newFS(osBase, newKey)
+			defer rotated.Close()
+			for _, name := range files {
+				file, err := rotated.Open(name)
+				if err != nil {
+					t.Errorf("Open(%q) with new key failed: %v", name, err)
+					continue
+				}
+				content, _ := io.ReadAll(file)
+				file.Close()
+				if string(content) != "content of "+name {
+					t.Errorf("%s content = %q, want %q", name, content, "content of "+name)
+				}
+			}
+		})
+	}
+}
+
+func TestRotateAllKeys_RandomFilenames(t *testing.T) {
+	base, cleanup := setupTestFS(t)
+	defer cleanup()
+
+	oldKey := NewPasswordKeyProvider([]byte("old-password"), Argon2idParams{
+		Memory:      64 * 1024,
+		Iterations:  1,
+		Parallelism: 2,
+	})
+	newKey := NewPasswordKeyProvider([]byte("new-password"), Argon2idParams{
+		Memory:      64 * 1024,
+		Iterations:  1,
+		Parallelism: 2,
+	})
+
+	newFS := func(provider KeyProvider) *EncryptFS {
+		fs, err := New(base, &Config{
+			Cipher:             CipherAES256GCM,
+			KeyProvider:        provider,
+			FilenameEncryption: FilenameEncryptionRandom,
+			MetadataPath:       "/.metadata.json",
+		})
+		if err != nil {
+			t.Fatalf("failed to create EncryptFS: %v", err)
+		}
+		return fs
+	}
+
+	fs := newFS(oldKey)
+	files := []string{"/a.txt", "/docs/b.txt", "/docs/sub/c.txt"}
+	for _, name := range files {
+		if err := fs.MkdirAll(path.Dir(name), 0755); err != nil {
+			t.Fatalf("MkdirAll(%q) failed: %v", path.Dir(name), err)
+		}
+		file, err := fs.Create(name)
+		if err != nil {
+			t.Fatalf("Create(%q) failed: %v", name, err)
+		}
+		file.Write([]byte("content of " + name))
+		file.Close()
+	}
+
+	if err := fs.RotateAllKeys("/", KeyRotationOptions{NewKeyProvider: newKey}); err != nil {
+		t.Fatalf("RotateAllKeys failed: %v", err)
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// Rotation must not leave files under their plaintext names
+	if _, err := base.Stat("/a.txt"); !os.IsNotExist(err) {
+		t.Errorf("plaintext name /a.txt exists on the base filesystem: %v", err)
+	}
+
+	rotated := newFS(newKey)
+	defer rotated.Close()
+	for _, name := range files {
+		file, err := rotated.Open(name)
+		if err != nil {
+			t.Errorf("Open(%q) with new key failed: %v", name, err)
+			continue
+		}
+		content, err := io.ReadAll(file)
+		file.Close()
+		if err != nil {
+			t.Errorf("reading %s with new key failed: %v", name, err)
+			continue
+		}
+		if string(content) != "content of "+name {
+			t.Errorf("%s content = %q, want %q", name, content, "content of "+name)
+		}
+	}
+
+	stale := newFS(oldKey)
+	defer stale.Close()
+	if file, err := stale.Open("/a.txt"); err == nil {
+		file.Close()
+		t.Error("expected the old key to fail after rotation")
+	}
+}
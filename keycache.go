@@ -0,0 +1,153 @@
+package encryptfs
+
+import (
+	"container/list"
+	"reflect"
+	"sync"
+)
+
+// DefaultKeyCacheSize is the number of file keys cached when
+// Config.KeyCacheSize is zero
+const DefaultKeyCacheSize = 1024
+
+// keyCache remembers the file keys derived during a session. Every file has
+// its own salt, so a password provider runs its key derivation function on
+// each open; caching the result by salt lets a file that is reopened, or
+// read back after being written, skip the derivation. The cache holds a
+// bounded number of keys as SecretKeys, so they are locked in memory when
+// the encryptfs_mlock tag is set, and destroys the least recently used on
+// eviction.
+// Filesystems returned by Sub share the cache with their parent.
+type keyCache struct {
+	mu      sync.Mutex
+	size    int                           // Maximum number of keys, 0 disables caching
+	entries map[keyCacheKey]*list.Element // Values are *keyCacheEntry
+	order   *list.List                    // Most recently used first
+	metrics Metrics                       // Told about derivations on a miss, if set
+}
+
+// keyCacheKey identifies a derived key. The provider is part of the key so
+// that the providers of a MultiKeyProvider do not share entries.
+type keyCacheKey struct {
+	provider KeyProvider
+	salt     string
+	kdf      KDFParams
+}
+
+// keyCacheEntry is an element of the cache's recency list
+type keyCacheEntry struct {
+	id  keyCacheKey
+	key *SecretKey
+}
+
+// newKeyCache creates an empty key cache holding up to size keys. Zero
+// selects DefaultKeyCacheSize and a negative size disables caching.
+func newKeyCache(size int) *keyCache {
+	if size == 0 {
+		size = DefaultKeyCacheSize
+	}
+	if size < 0 {
+		size = 0
+	}
+
+	return &keyCache{
+		size:    size,
+		entries: make(map[keyCacheKey]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// derive returns the key for an existing file's header, deriving it with
+// the provider on a cache miss
+func (c *keyCache) derive(provider KeyProvider, header *FileHeader) ([]byte, error) {
+	derive := func() (*SecretKey, error) {
+		return deriveKeyForHeader(provider, header)
+	}
+	if c.size == 0 || !cacheable(provider) {
+		return unwrapKey(timeKeyDerive(c.metrics, derive))
+	}
+
+	if key, ok := c.get(keyCacheKey{provider: provider, salt: string(header.Salt), kdf: header.KDF}); ok {
+		return key, nil
+	}
+
+	secret, err := timeKeyDerive(c.metrics, derive)
+	if err != nil {
+		return nil, err
+	}
+	key := append([]byte(nil), secret.Bytes()...)
+	c.store(keyCacheKey{provider: provider, salt: string(header.Salt), kdf: header.KDF}, secret)
+	return key, nil
+}
+
+// get returns a copy of a cached key and marks it as recently used. The
+// copy stays valid if the entry is evicted and zeroed while it is in use.
+func (c *keyCache) get(id keyCacheKey) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[id]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return append([]byte(nil), elem.Value.(*keyCacheEntry).key.Bytes()...), true
+}
+
+// put records a key derived for a new file. The cache keeps its own copy,
+// which is destroyed on eviction without touching the caller's slice.
+func (c *keyCache) put(provider KeyProvider, salt []byte, kdf KDFParams, key []byte) {
+	if c.size == 0 || !cacheable(provider) {
+		return
+	}
+	c.store(keyCacheKey{provider: provider, salt: string(salt), kdf: kdf}, NewSecretKey(append([]byte(nil), key...)))
+}
+
+// store takes ownership of secret and caches it under id, destroying it
+// instead if id is cached already
+func (c *keyCache) store(id keyCacheKey, secret *SecretKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[id]; ok {
+		c.order.MoveToFront(elem)
+		secret.Destroy()
+		return
+	}
+
+	c.entries[id] = c.order.PushFront(&keyCacheEntry{id: id, key: secret})
+	for c.order.Len() > c.size {
+		c.evict(c.order.Back())
+	}
+}
+
+// len returns the number of cached keys
+func (c *keyCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// clear destroys and forgets every cached key
+func (c *keyCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for c.order.Len() > 0 {
+		c.evict(c.order.Back())
+	}
+}
+
+// evict removes an entry from the cache and destroys its key. The caller
+// must hold c.mu.
+func (c *keyCache) evict(elem *list.Element) {
+	entry := c.order.Remove(elem).(*keyCacheEntry)
+	delete(c.entries, entry.id)
+	entry.key.Destroy()
+}
+
+// cacheable reports whether a provider can be used as a map key. Providers
+// are normally pointers, but a value type holding a slice is not comparable.
+func cacheable(provider KeyProvider) bool {
+	return reflect.TypeOf(provider).Comparable()
+}
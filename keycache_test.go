@@ -0,0 +1,125 @@
+package encryptfs
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// countingKeyProvider counts the keys derived by the wrapped provider
+type countingKeyProvider struct {
+	KeyProvider
+	derivations int
+}
+
+func (p *countingKeyProvider) DeriveKey(salt []byte) (*SecretKey, error) {
+	p.derivations++
+	return p.KeyProvider.DeriveKey(salt)
+}
+
+func TestKeyCache_Reopen(t *testing.T) {
+	base, cleanup := setupTestFS(t)
+	defer cleanup()
+
+	provider := &countingKeyProvider{KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+		Memory:      64 * 1024,
+		Iterations:  1,
+		Parallelism: 2,
+	})}
+
+	for _, chunked := range []bool{false, true} {
+		config := &Config{Cipher: CipherAES256GCM, KeyProvider: provider}
+		if chunked {
+			config.ChunkSize = 4 * 1024
+		}
+		fs, err := New(base, config)
+		if err != nil {
+			t.Fatalf("failed to create EncryptFS: %v", err)
+		}
+		// The verification marker costs a derivation on the first write
+		if err := fs.ensureVerifyMarker(); err != nil {
+			t.Fatalf("failed to create verification marker: %v", err)
+		}
+		provider.derivations = 0
+
+		data := []byte("small file contents")
+		file, err := fs.Create("/small.txt")
+		if err != nil {
+			t.Fatalf("failed to create file: %v", err)
+		}
+		file.Write(data)
+		file.Close()
+
+		for i := 0; i < 3; i++ {
+			file, err := fs.Open("/small.txt")
+			if err != nil {
+				t.Fatalf("failed to open file: %v", err)
+			}
+			got, _ := io.ReadAll(file)
+			file.Close()
+			if !bytes.Equal(got, data) {
+				t.Fatalf("content = %q, want %q", got, data)
+			}
+		}
+
+		// Only the key for the new file was derived; reopening hit the cache
+		if provider.derivations != 1 {
+			t.Errorf("chunked=%v: %d derivations, want 1", chunked, provider.derivations)
+		}
+
+		if n := fs.keys.len(); n != 1 {
+			t.Fatalf("chunked=%v: %d cached keys, want 1", chunked, n)
+		}
+		cached := fs.keys.order.Front().Value.(*keyCacheEntry).key.Bytes()
+
+		// Close zeroes the cached keys
+		fs.Close()
+		if fs.keys.len() != 0 {
+			t.Errorf("chunked=%v: cache not emptied by Close", chunked)
+		}
+		if !bytes.Equal(cached, make([]byte, len(cached))) {
+			t.Errorf("chunked=%v: cached key not zeroed by Close", chunked)
+		}
+	}
+}
+
+func TestKeyCache_Eviction(t *testing.T) {
+	provider, err := NewRawKeyProvider(make([]byte, 32))
+	if err != nil {
+		t.Fatalf("failed to create key provider: %v", err)
+	}
+	header := func(salt string) *FileHeader {
+		return &FileHeader{Salt: []byte(salt)}
+	}
+
+	cache := newKeyCache(2)
+	a, _ := cache.derive(provider, header("salt-a"))
+	cache.derive(provider, header("salt-b"))
+
+	// Using a makes b the least recently used key
+	if key, _ := cache.derive(provider, header("salt-a")); !bytes.Equal(key, a) {
+		t.Fatal("cached key differs from derived key")
+	}
+	evicted := cache.order.Back().Value.(*keyCacheEntry).key.Bytes()
+	cache.derive(provider, header("salt-c"))
+
+	if n := cache.len(); n != 2 {
+		t.Fatalf("cache holds %d keys, want 2", n)
+	}
+	if _, ok := cache.get(keyCacheKey{provider: provider, salt: "salt-b"}); ok {
+		t.Error("least recently used key was not evicted")
+	}
+	if _, ok := cache.get(keyCacheKey{provider: provider, salt: "salt-a"}); !ok {
+		t.Error("recently used key was evicted")
+	}
+	if !bytes.Equal(evicted, make([]byte, len(evicted))) {
+		t.Error("evicted key was not zeroed")
+	}
+
+	// A negative size disables the cache
+	disabled := newKeyCache(-1)
+	disabled.derive(provider, header("salt-a"))
+	if n := disabled.len(); n != 0 {
+		t.Errorf("disabled cache holds %d keys", n)
+	}
+}
@@ -0,0 +1,72 @@
+package encryptfs
+
+import (
+	"os"
+	"syscall"
+)
+
+// Linker is implemented by base filesystems that support hard links. Link
+// creates newname as another name for the file oldname and fails if newname
+// exists, as os.Link does.
+type Linker interface {
+	Link(oldname, newname string) error
+}
+
+// Link creates newname as a hard link to the regular file oldname. Both
+// names refer to the same file on the base filesystem, and since encrypted
+// files are not bound to their path, its contents decrypt the same under
+// either. With random filename encryption newname gets its own encrypted
+// name, linked to the same file. Extended attributes are kept per name and
+// copied to newname. Rewriting a file under a new key, as RotateKey does,
+// replaces it under that one name only. Link returns an error wrapping
+// ErrNotSupported if the base filesystem does not implement Linker.
+func (e *EncryptFS) Link(oldname, newname string) error {
+	for _, name := range []string{oldname, newname} {
+		if err := e.checkTarget("link", name); err != nil {
+			return err
+		}
+	}
+
+	linker, ok := e.base.(Linker)
+	if !ok {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: ErrNotSupported}
+	}
+
+	info, err := e.Stat(oldname)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: syscall.EPERM}
+	}
+
+	encryptedOld, err := e.translatePath(oldname)
+	if err != nil {
+		return err
+	}
+
+	var encryptedNew string
+	var created bool
+	if e.flat != nil {
+		encryptedNew, created, err = e.flat.create(e.logicalPath(newname), e.baseExists)
+		if err == nil && !created {
+			return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: os.ErrExist}
+		}
+	} else {
+		encryptedNew, err = e.translatePath(newname)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := linker.Link(encryptedOld, encryptedNew); err != nil {
+		if created {
+			e.flat.metadata.Remove(encryptedNew)
+		}
+		return err
+	}
+	if err := e.recordLongNames(newname); err != nil {
+		return err
+	}
+	return e.copyXattrs(encryptedOld, encryptedNew)
+}
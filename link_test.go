@@ -0,0 +1,158 @@
+package encryptfs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// linkTestFS adds hard links to osTestFS
+type linkTestFS struct {
+	*osTestFS
+}
+
+func (fs linkTestFS) Link(oldname, newname string) error {
+	return os.Link(filepath.Join(fs.root, oldname), filepath.Join(fs.root, newname))
+}
+
+func TestLink(t *testing.T) {
+	keyProvider := NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+		Memory:      64 * 1024,
+		Iterations:  1,
+		Parallelism: 2,
+	})
+
+	modes := []struct {
+		name   string
+		config func(c *Config)
+	}{
+		{"none", func(c *Config) {}},
+		{"deterministic", func(c *Config) {
+			c.FilenameEncryption = FilenameEncryptionDeterministic
+		}},
+		{"random", func(c *Config) {
+			c.FilenameEncryption = FilenameEncryptionRandom
+			c.MetadataPath = "/.metadata.json"
+		}},
+		{"flattened", func(c *Config) {
+			c.FilenameEncryption = FilenameEncryptionRandom
+			c.MetadataPath = "/.metadata.json"
+			c.FlattenDirectories = true
+		}},
+		{"chunked", func(c *Config) {
+			c.FilenameEncryption = FilenameEncryptionDeterministic
+			c.ChunkSize = 4096
+		}},
+	}
+
+	for _, mode := range modes {
+		t.Run(mode.name, func(t *testing.T) {
+			osBase, cleanup := setupTestFS(t)
+			defer cleanup()
+			base := linkTestFS{osBase.(*osTestFS)}
+			config := &Config{Cipher: CipherAES256GCM, KeyProvider: keyProvider}
+			mode.config(config)
+			fs, err := New(base, config)
+			if err != nil {
+				t.Fatalf("failed to create EncryptFS: %v", err)
+			}
+			defer fs.Close()
+			if !fs.Capabilities().HardLinks {
+				t.Errorf("Capabilities() = %+v, want hard links", fs.Capabilities())
+			}
+
+			if err := fs.MkdirAll("/a/b", 0755); err != nil {
+				t.Fatalf("MkdirAll failed: %v", err)
+			}
+			if err := fs.WriteFiles(map[string][]byte{"/a/orig.txt": []byte("shared content")}); err != nil {
+				t.Fatalf("WriteFiles failed: %v", err)
+			}
+			if err := fs.Link("/a/orig.txt", "/a/b/link.txt"); err != nil {
+				t.Fatalf("Link failed: %v", err)
+			}
+			compareTree(t, fs, "/", map[string][]byte{
+				"/a/orig.txt":   []byte("shared content"),
+				"/a/b/link.txt": []byte("shared content"),
+			})
+
+			// Both names refer to the same file on the base filesystem
+			encryptedOld, _ := fs.translatePath("/a/orig.txt")
+			encryptedNew, _ := fs.translatePath("/a/b/link.txt")
+			oldInfo, err := base.Stat(encryptedOld)
+			if err != nil {
+				t.Fatalf("base Stat failed: %v", err)
+			}
+			newInfo, err := base.Stat(encryptedNew)
+			if err != nil {
+				t.Fatalf("base Stat failed: %v", err)
+			}
+			if encryptedOld == encryptedNew || !os.SameFile(oldInfo, newInfo) {
+				t.Errorf("%s and %s are not links to one file", encryptedOld, encryptedNew)
+			}
+			if name, err := fs.untranslatePath(encryptedNew); err != nil || name != "/a/b/link.txt" {
+				t.Errorf("link stored as %s decrypts to %q, %v", encryptedNew, name, err)
+			}
+
+			// A change through one name shows through the other
+			file, err := fs.OpenFile("/a/b/link.txt", os.O_WRONLY|os.O_TRUNC, 0)
+			if err != nil {
+				t.Fatalf("OpenFile failed: %v", err)
+			}
+			if _, err := file.Write([]byte("updated")); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			if err := file.Close(); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+			compareTree(t, fs, "/", map[string][]byte{"/a/orig.txt": []byte("updated")})
+
+			// Removing one name leaves the other
+			if err := fs.Remove("/a/orig.txt"); err != nil {
+				t.Fatalf("Remove failed: %v", err)
+			}
+			compareTree(t, fs, "/", map[string][]byte{"/a/b/link.txt": []byte("updated")})
+
+			// Existing names and directories cannot be linked to or from
+			if err := fs.WriteFiles(map[string][]byte{"/a/other.txt": []byte("other")}); err != nil {
+				t.Fatalf("WriteFiles failed: %v", err)
+			}
+			if err := fs.Link("/a/b/link.txt", "/a/other.txt"); !errors.Is(err, os.ErrExist) {
+				t.Errorf("Link over an existing file = %v, want an exists error", err)
+			}
+			compareTree(t, fs, "/", map[string][]byte{"/a/other.txt": []byte("other")})
+			if err := fs.Link("/a/b", "/a/c"); err == nil {
+				t.Error("Link of a directory succeeded")
+			}
+			if err := fs.Link("/a/missing.txt", "/a/d.txt"); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("Link of a missing file = %v, want a not-exist error", err)
+			}
+		})
+	}
+}
+
+func TestLink_NotSupported(t *testing.T) {
+	keyProvider := NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+		Memory:      64 * 1024,
+		Iterations:  1,
+		Parallelism: 2,
+	})
+
+	osBase, cleanup := setupTestFS(t)
+	defer cleanup()
+	fs, err := New(plainFS{osBase}, &Config{Cipher: CipherAES256GCM, KeyProvider: keyProvider})
+	if err != nil {
+		t.Fatalf("failed to create EncryptFS: %v", err)
+	}
+	defer fs.Close()
+
+	if fs.Capabilities().HardLinks {
+		t.Errorf("Capabilities() = %+v, want no hard links", fs.Capabilities())
+	}
+	if err := fs.WriteFiles(map[string][]byte{"/file.txt": []byte("data")}); err != nil {
+		t.Fatalf("WriteFiles failed: %v", err)
+	}
+	if err := fs.Link("/file.txt", "/link.txt"); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("Link = %v, want ErrNotSupported", err)
+	}
+}
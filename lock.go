@@ -0,0 +1,106 @@
+package encryptfs
+
+import (
+	"os"
+	"reflect"
+	"sync"
+)
+
+// fileLocks is the registry of the files opened under Config.FileLocking.
+// It is shared by every EncryptFS in the process, so handles of different
+// filesystems over the same base filesystem coordinate too.
+var fileLocks = newLockRegistry()
+
+// lockKey identifies a file on a base filesystem
+type lockKey struct {
+	scope any    // The base filesystem, or the EncryptFS if it is not comparable
+	path  string // Path on the base filesystem
+}
+
+// lockState counts the handles holding a file's lock
+type lockState struct {
+	readers int
+	writer  bool
+}
+
+// lockRegistry is an in-process readers-writer lock per file. Waiters are
+// woken on every release and recheck their own file.
+type lockRegistry struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	locks map[lockKey]*lockState
+}
+
+// newLockRegistry creates an empty lock registry
+func newLockRegistry() *lockRegistry {
+	r := &lockRegistry{locks: make(map[lockKey]*lockState)}
+	r.cond = sync.NewCond(&r.mu)
+	return r
+}
+
+// acquire takes the lock of a file, shared for a reader or exclusive for a
+// writer, waiting for conflicting handles to close if wait is set and
+// failing with ErrLocked otherwise. The returned function releases it.
+func (r *lockRegistry) acquire(key lockKey, exclusive, wait bool) (func(), error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for {
+		state := r.locks[key]
+		if state == nil {
+			state = &lockState{}
+			r.locks[key] = state
+		}
+		if !state.writer && (!exclusive || state.readers == 0) {
+			if exclusive {
+				state.writer = true
+			} else {
+				state.readers++
+			}
+			var once sync.Once
+			return func() { once.Do(func() { r.release(key, exclusive) }) }, nil
+		}
+		if !wait {
+			return nil, ErrLocked
+		}
+		r.cond.Wait()
+	}
+}
+
+// release gives up a lock taken by acquire
+func (r *lockRegistry) release(key lockKey, exclusive bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	state := r.locks[key]
+	if exclusive {
+		state.writer = false
+	} else {
+		state.readers--
+	}
+	if !state.writer && state.readers == 0 {
+		delete(r.locks, key)
+	}
+	r.cond.Broadcast()
+}
+
+// lockFile takes the lock of the file at encryptedPath for an open with
+// the given flags, as Config.FileLocking directs. Opens that may write take
+// it exclusively. It returns a function that releases the lock, which does
+// nothing without locking.
+func (e *EncryptFS) lockFile(name, encryptedPath string, flag int) (func(), error) {
+	if e.config.FileLocking == LockNone {
+		return func() {}, nil
+	}
+
+	var scope any = e.base
+	if !reflect.TypeOf(e.base).Comparable() {
+		scope = e.keys
+	}
+	exclusive := flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0
+	release, err := fileLocks.acquire(lockKey{scope: scope, path: encryptedPath}, exclusive, e.config.FileLocking == LockWait)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	return release, nil
+}
@@ -0,0 +1,124 @@
+package encryptfs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestFileLocking(t *testing.T) {
+	base, cleanup := setupTestFS(t)
+	defer cleanup()
+
+	newFS := func(policy LockPolicy) *EncryptFS {
+		fs, err := New(base, &Config{
+			Cipher: CipherAES256GCM,
+			KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+				Memory:      64 * 1024,
+				Iterations:  1,
+				Parallelism: 2,
+			}),
+			ChunkSize:   4 * 1024,
+			SharedSalt:  true,
+			FileLocking: policy,
+		})
+		if err != nil {
+			t.Fatalf("failed to create EncryptFS: %v", err)
+		}
+		return fs
+	}
+	fs := newFS(LockWait)
+	defer fs.Close()
+
+	versions := [][]byte{
+		bytes.Repeat([]byte("a"), 20*1024),
+		bytes.Repeat([]byte("b"), 20*1024),
+	}
+	writeFile := func(data []byte) error {
+		file, err := fs.OpenFile("/shared.bin", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return err
+		}
+		// Write in pieces, so an unlocked reader would see partial content
+		for i := 0; i < len(data); i += 1000 {
+			if _, err := file.Write(data[i:min(i+1000, len(data))]); err != nil {
+				file.Close()
+				return err
+			}
+		}
+		return file.Close()
+	}
+	if err := writeFile(versions[0]); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	// Overlapping writers and readers only see whole versions
+	var wg sync.WaitGroup
+	errs := make(chan error, 64)
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			errs <- writeFile(versions[i%2])
+		}(i)
+		go func() {
+			defer wg.Done()
+			file, err := fs.Open("/shared.bin")
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer file.Close()
+			data, err := io.ReadAll(file)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if !bytes.Equal(data, versions[0]) && !bytes.Equal(data, versions[1]) {
+				errs <- errors.New("reader saw a partly written file")
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	// Under LockFailFast, conflicting opens fail, including from another
+	// filesystem over the same base
+	other := newFS(LockFailFast)
+	defer other.Close()
+	reader, err := fs.Open("/shared.bin")
+	if err != nil {
+		t.Fatalf("failed to open file: %v", err)
+	}
+	if _, err := other.OpenFile("/shared.bin", os.O_RDWR, 0); !errors.Is(err, ErrLocked) {
+		t.Errorf("writer over a reader: got %v, want ErrLocked", err)
+	}
+	second, err := other.Open("/shared.bin")
+	if err != nil {
+		t.Fatalf("second reader failed: %v", err)
+	}
+	second.Close()
+	reader.Close()
+
+	writer, err := other.OpenFile("/shared.bin", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("writer failed after readers closed: %v", err)
+	}
+	if _, err := other.Open("/shared.bin"); !errors.Is(err, ErrLocked) {
+		t.Errorf("reader over a writer: got %v, want ErrLocked", err)
+	}
+	writer.Close()
+	if file, err := other.Open("/shared.bin"); err != nil {
+		t.Errorf("reader failed after the writer closed: %v", err)
+	} else {
+		file.Close()
+	}
+}
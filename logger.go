@@ -0,0 +1,26 @@
+package encryptfs
+
+// Logger receives reports of conditions that do not stop an operation but
+// may deserve attention, such as a suboptimal setting or a retried read.
+// Implementations must be safe for concurrent use.
+type Logger interface {
+	// Warnf reports a condition the user may want to fix
+	Warnf(format string, args ...any)
+
+	// Debugf reports routine detail, such as a retry after a transient error
+	Debugf(format string, args ...any)
+}
+
+// nopLogger is the Logger used when Config.Logger is nil
+type nopLogger struct{}
+
+func (nopLogger) Warnf(format string, args ...any)  {}
+func (nopLogger) Debugf(format string, args ...any) {}
+
+// logger returns the configured Logger, or one that discards everything
+func (c *Config) logger() Logger {
+	if c.Logger == nil {
+		return nopLogger{}
+	}
+	return c.Logger
+}
@@ -0,0 +1,96 @@
+package encryptfs
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordingLogger keeps every message it is given
+type recordingLogger struct {
+	mu       sync.Mutex
+	warnings []string
+	debug    []string
+}
+
+func (l *recordingLogger) Warnf(format string, args ...any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.warnings = append(l.warnings, fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) Debugf(format string, args ...any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.debug = append(l.debug, fmt.Sprintf(format, args...))
+}
+
+func TestLogger(t *testing.T) {
+	base, cleanup := setupTestFS(t)
+	defer cleanup()
+
+	config := func(logger Logger, chunkSize int) *Config {
+		return &Config{
+			Cipher: CipherAES256GCM,
+			KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+				Memory:      64 * 1024,
+				Iterations:  1,
+				Parallelism: 2,
+			}),
+			ChunkSize: chunkSize,
+			Logger:    logger,
+		}
+	}
+
+	// A chunk size that is not a power of two is accepted with a warning
+	logger := &recordingLogger{}
+	fs, err := New(base, config(logger, 5000))
+	if err != nil {
+		t.Fatalf("failed to create EncryptFS: %v", err)
+	}
+	fs.Close()
+	if len(logger.warnings) != 1 || !strings.Contains(logger.warnings[0], "5000") {
+		t.Errorf("warnings = %q, want one about chunk size 5000", logger.warnings)
+	}
+
+	logger = &recordingLogger{}
+	fs, err = New(base, config(logger, 8*1024))
+	if err != nil {
+		t.Fatalf("failed to create EncryptFS: %v", err)
+	}
+	fs.Close()
+	if len(logger.warnings) != 0 {
+		t.Errorf("warnings for a power of two chunk size: %q", logger.warnings)
+	}
+
+	// Discarded filename metadata is reported
+	blob, err := base.OpenFile("/.metadata.json", os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		t.Fatalf("failed to create metadata: %v", err)
+	}
+	blob.Write([]byte("{not json"))
+	blob.Close()
+
+	logger = &recordingLogger{}
+	fresh := config(logger, 0)
+	fresh.FilenameEncryption = FilenameEncryptionRandom
+	fresh.MetadataPath = "/.metadata.json"
+	fresh.MetadataLoadPolicy = MetadataStartFresh
+	fs, err = New(base, fresh)
+	if err != nil {
+		t.Fatalf("failed to create EncryptFS: %v", err)
+	}
+	fs.Close()
+	if len(logger.warnings) != 1 || !strings.Contains(logger.warnings[0], "/.metadata.json") {
+		t.Errorf("warnings = %q, want one about the discarded metadata", logger.warnings)
+	}
+
+	// No logger is fine
+	fs, err = New(base, config(nil, 5000))
+	if err != nil {
+		t.Fatalf("failed to create EncryptFS without a logger: %v", err)
+	}
+	fs.Close()
+}
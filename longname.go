@@ -0,0 +1,228 @@
+package encryptfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/absfs/absfs"
+)
+
+// LongComponentThreshold is the longest encrypted path component that
+// Config.HashLongComponents stores under its own name
+const LongComponentThreshold = 64
+
+// longNamePrefix starts the base name of an entry whose encrypted name was
+// hashed. Encrypted names never start with a dot, so the two cannot meet.
+const longNamePrefix = ".long-"
+
+// longNameIndexFile names the index in each base directory that maps the
+// hashed names of its entries back to their full encrypted names. The index
+// holds only encrypted names, so it is stored as plain JSON.
+const longNameIndexFile = ".encryptfs-longnames"
+
+// longNameIndex shortens long encrypted path components and keeps the
+// per-directory indexes needed to recover them
+type longNameIndex struct {
+	base absfs.FileSystem
+	sep  string
+	mu   sync.Mutex // Serializes index updates
+}
+
+// newLongNameIndex returns the long name index for a base filesystem
+func newLongNameIndex(base absfs.FileSystem) *longNameIndex {
+	return &longNameIndex{base: base, sep: string([]byte{base.Separator()})}
+}
+
+// hashedName returns the name stored on the base filesystem for a long
+// encrypted component
+func hashedName(component string) string {
+	sum := sha256.Sum256([]byte(component))
+	return longNamePrefix + hex.EncodeToString(sum[:16])
+}
+
+// isHashedName reports whether a base name was produced by hashedName
+func isHashedName(name string) bool {
+	return strings.HasPrefix(name, longNamePrefix)
+}
+
+// shorten replaces every component of an encrypted path that is longer than
+// LongComponentThreshold with its hashed name
+func (l *longNameIndex) shorten(p string) string {
+	parts := strings.Split(p, l.sep)
+	for i, part := range parts {
+		if len(part) > LongComponentThreshold {
+			parts[i] = hashedName(part)
+		}
+	}
+	return strings.Join(parts, l.sep)
+}
+
+// record adds every long component of the full encrypted path p to the
+// index of the directory holding it, once the entries exist on the base
+func (l *longNameIndex) record(p string) error {
+	parts := strings.Split(p, l.sep)
+	for i, part := range parts {
+		if len(part) <= LongComponentThreshold {
+			continue
+		}
+		dir := l.shorten(strings.Join(parts[:i], l.sep))
+		if i == 1 && parts[0] == "" {
+			dir = l.sep
+		}
+		if err := l.add(dir, hashedName(part), part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// add records that the entry name of the base directory dir stands for the
+// encrypted name full, rewriting the index only if it changes
+func (l *longNameIndex) add(dir, name, full string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	index, err := l.read(dir)
+	if err != nil {
+		return err
+	}
+	if index[name] == full {
+		return nil
+	}
+	index[name] = full
+
+	data, err := json.Marshal(index)
+	if err != nil {
+		return fmt.Errorf("failed to encode long name index: %w", err)
+	}
+	file, err := l.base.OpenFile(l.indexPath(dir), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// read loads the index of the base directory dir, which is empty if the
+// directory has no long entries
+func (l *longNameIndex) read(dir string) (map[string]string, error) {
+	index := make(map[string]string)
+	data, err := readBaseFile(l.base, l.indexPath(dir))
+	if os.IsNotExist(err) {
+		return index, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, NewCorruptionError(l.indexPath(dir), fmt.Sprintf("invalid long name index: %v", err))
+	}
+	return index, nil
+}
+
+// indexPath returns the path of the index of the base directory dir
+func (l *longNameIndex) indexPath(dir string) string {
+	if dir == "" {
+		return longNameIndexFile
+	}
+	return strings.TrimSuffix(dir, l.sep) + l.sep + longNameIndexFile
+}
+
+// lookup returns the full encrypted name of the entry name of the base
+// directory dir. Names that were not hashed are returned unchanged.
+func (l *longNameIndex) lookup(dir, name string) (string, error) {
+	if !isHashedName(name) {
+		return name, nil
+	}
+	index, err := l.read(dir)
+	if err != nil {
+		return "", err
+	}
+	full, ok := index[name]
+	if !ok {
+		return "", NewCorruptionError(dir, fmt.Sprintf("%s is missing from the long name index", name))
+	}
+	return full, nil
+}
+
+// expand replaces the hashed components of the base path p with their full
+// encrypted names. The path is resolved against the base directory dir to
+// find the indexes that hold them, or against the root if dir is empty.
+func (l *longNameIndex) expand(dir, p string) (string, error) {
+	parts := strings.Split(p, l.sep)
+	if dir == "" {
+		dir = l.sep
+	}
+	for i, part := range parts {
+		switch {
+		case part == "" || part == ".":
+			continue
+		case part == "..":
+			if j := strings.LastIndex(dir, l.sep); j > 0 {
+				dir = dir[:j]
+			} else if j == 0 {
+				dir = l.sep
+			}
+			continue
+		}
+		full, err := l.lookup(dir, part)
+		if err != nil {
+			return "", err
+		}
+		parts[i] = full
+		dir = strings.TrimSuffix(dir, l.sep) + l.sep + part
+	}
+	return strings.Join(parts, l.sep), nil
+}
+
+// prepareRemove deletes the index of the base directory p if it is the
+// only entry left, so that the directory can be removed
+func (l *longNameIndex) prepareRemove(p string) error {
+	dir, err := l.base.Open(p)
+	if err != nil {
+		// Not a directory, or missing; Remove reports the error
+		return nil
+	}
+	names, err := dir.Readdirnames(-1)
+	dir.Close()
+	if err != nil {
+		return nil
+	}
+
+	var entries int
+	var indexed bool
+	for _, name := range names {
+		switch name {
+		case ".", "..":
+		case longNameIndexFile:
+			indexed = true
+		default:
+			entries++
+		}
+	}
+	if !indexed || entries > 0 {
+		return nil
+	}
+	return l.base.Remove(l.indexPath(p))
+}
+
+// recordLongNames adds the long components of the encrypted form of name to
+// their directory indexes after name has been created on the base
+func (e *EncryptFS) recordLongNames(name string) error {
+	if e.longNames == nil {
+		return nil
+	}
+	encrypted, err := e.encryptPath(name)
+	if err != nil {
+		return err
+	}
+	return e.longNames.record(encrypted)
+}
@@ -0,0 +1,181 @@
+package encryptfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/absfs/absfs"
+)
+
+func TestHashLongComponents(t *testing.T) {
+	base, cleanup := setupTestFS(t)
+	defer cleanup()
+
+	fs, err := New(symlinkTestFS{base.(*osTestFS)}, &Config{
+		Cipher:             CipherAES256GCM,
+		FilenameEncryption: FilenameEncryptionDeterministic,
+		HashLongComponents: true,
+		KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+			Memory:      64 * 1024,
+			Iterations:  1,
+			Parallelism: 2,
+		}),
+	})
+	if err != nil {
+		t.Fatalf("failed to create EncryptFS: %v", err)
+	}
+	defer fs.Close()
+
+	// A deep tree of long names, with short names mixed in
+	tree := make(map[string][]byte)
+	dir := ""
+	for depth := 0; depth < 8; depth++ {
+		dir += "/" + strings.Repeat(string(rune('a'+depth)), 100)
+		tree[dir+"/"+strings.Repeat("long file name ", 10)+".txt"] = []byte(fmt.Sprintf("long %d", depth))
+		tree[dir+"/short.txt"] = []byte(fmt.Sprintf("short %d", depth))
+	}
+	if err := fs.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("MkdirAll failed: %v", err)
+	}
+	for name, data := range tree {
+		file, err := fs.Create(name)
+		if err != nil {
+			t.Fatalf("failed to create %s: %v", name, err)
+		}
+		file.Write(data)
+		if err := file.Close(); err != nil {
+			t.Fatalf("failed to close %s: %v", name, err)
+		}
+	}
+
+	// No component on the base is longer than the threshold
+	var longest int
+	walkBase(t, base, "/", func(name string) {
+		longest = max(longest, len(path.Base(name)))
+	})
+	if longest > LongComponentThreshold {
+		t.Errorf("longest base component is %d bytes, want at most %d", longest, LongComponentThreshold)
+	}
+
+	compareTree(t, fs, "/", tree)
+
+	// Listings decrypt the full names and hide the indexes
+	var listed []string
+	var list func(dir string)
+	list = func(dir string) {
+		entries, err := fs.ReadDir(dir)
+		if err != nil {
+			t.Fatalf("ReadDir(%s) failed: %v", dir, err)
+		}
+		for _, entry := range entries {
+			name := path.Join(dir, entry.Name())
+			if entry.IsDir() {
+				list(name)
+			} else {
+				listed = append(listed, name)
+			}
+		}
+	}
+	list("/")
+	var want []string
+	for name := range tree {
+		want = append(want, name)
+	}
+	sort.Strings(want)
+	sort.Strings(listed)
+	if fmt.Sprint(listed) != fmt.Sprint(want) {
+		t.Errorf("listed files:\n%v\nwant:\n%v", listed, want)
+	}
+
+	// A long file renamed into another directory keeps its name
+	top := "/" + strings.Repeat("a", 100)
+	oldName := top + "/" + strings.Repeat("long file name ", 10) + ".txt"
+	newName := dir + "/" + strings.Repeat("renamed file ", 10)
+	if err := fs.Rename(oldName, newName); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	entries, err := fs.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir failed: %v", err)
+	}
+	var found bool
+	for _, entry := range entries {
+		found = found || entry.Name() == path.Base(newName)
+	}
+	if !found {
+		t.Errorf("renamed file missing from listing of %s", dir)
+	}
+
+	// Relative symbolic links through long names resolve and read back
+	target := "../" + path.Base(dir) + "/short.txt"
+	link := path.Dir(dir) + "/" + strings.Repeat("link ", 20)
+	if err := fs.Symlink(target, link); err != nil {
+		t.Fatalf("Symlink failed: %v", err)
+	}
+	if got, err := fs.Readlink(link); err != nil || got != target {
+		t.Errorf("Readlink = %q, %v, want %q", got, err, target)
+	}
+
+	// A directory whose only remaining entry is its index can be removed
+	empty := top + "/" + strings.Repeat("empty directory ", 8)
+	if err := fs.Mkdir(empty, 0755); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+	name := empty + "/" + strings.Repeat("x", 80)
+	file, err := fs.Create(name)
+	if err != nil {
+		t.Fatalf("failed to create %s: %v", name, err)
+	}
+	file.Close()
+	if err := fs.Remove(name); err != nil {
+		t.Fatalf("failed to remove file: %v", err)
+	}
+	if err := fs.Remove(empty); err != nil {
+		t.Fatalf("failed to remove directory: %v", err)
+	}
+	if _, err := fs.Stat(empty); !os.IsNotExist(err) {
+		t.Errorf("Stat after Remove: got %v, want not exist", err)
+	}
+
+	// The index file is reserved
+	if _, err := fs.Create("/" + longNameIndexFile); !errors.Is(err, ErrReservedPath) {
+		t.Errorf("creating the index file: got %v, want ErrReservedPath", err)
+	}
+}
+
+func TestHashLongComponents_RequiresDeterministic(t *testing.T) {
+	config := &Config{
+		Cipher:             CipherAES256GCM,
+		KeyProvider:        NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{}),
+		HashLongComponents: true,
+	}
+	if err := config.Validate(); err == nil {
+		t.Error("Validate accepted HashLongComponents without filename encryption")
+	}
+}
+
+// walkBase calls fn for every entry beneath dir on the base filesystem
+func walkBase(t *testing.T, base absfs.FileSystem, dir string, fn func(name string)) {
+	t.Helper()
+	file, err := base.Open(dir)
+	if err != nil {
+		t.Fatalf("failed to open %s: %v", dir, err)
+	}
+	infos, err := file.Readdir(-1)
+	file.Close()
+	if err != nil {
+		t.Fatalf("failed to list %s: %v", dir, err)
+	}
+	for _, info := range infos {
+		name := path.Join(dir, info.Name())
+		fn(name)
+		if info.IsDir() {
+			walkBase(t, base, name, fn)
+		}
+	}
+}
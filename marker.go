@@ -0,0 +1,315 @@
+package encryptfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+
+	"github.com/absfs/absfs"
+)
+
+// VerifyMarkerPath is the path on the base filesystem of the marker that
+// ValidatePassword checks the key provider against. The marker is created
+// when a file is first opened for writing.
+const VerifyMarkerPath = "/.encryptfs-verify"
+
+// verifyMarkerCheck is the constant encrypted in the verification marker
+var verifyMarkerCheck = []byte("encryptfs password verification marker")
+
+// ValidatePassword reports whether the configured key provider derives the
+// same keys as the one that first wrote to the filesystem. It decrypts only
+// the small marker at VerifyMarkerPath, never user data, so interactive
+// tools can reject a mistyped password before anything is written with it.
+// A filesystem that has never been written to has no marker, and any
+// password is reported as valid. With SharedSalt the keyfile was already
+// checked by New.
+func (e *EncryptFS) ValidatePassword() (bool, error) {
+	if err := e.checkOpen("validatepassword", VerifyMarkerPath); err != nil {
+		return false, err
+	}
+	if e.config.SharedSalt {
+		return true, nil
+	}
+
+	providers := []KeyProvider{e.keyProvider}
+	if multi, ok := e.keyProvider.(*MultiKeyProvider); ok {
+		providers = multi.providers
+	}
+
+	for _, provider := range providers {
+		key, err := openMarker(e.base, e.verifyMarkerPath(), provider, verifyMarkerCheck)
+		if os.IsNotExist(err) {
+			return true, nil
+		}
+		if errors.Is(err, ErrAuthFailed) {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		key.Destroy()
+		return true, nil
+	}
+	return false, nil
+}
+
+// ensureVerifyMarker creates the verification marker if the filesystem does
+// not have one yet. It is called before a file is opened for writing.
+func (e *EncryptFS) ensureVerifyMarker() error {
+	if e.config.SharedSalt || e.marked.Load() {
+		return nil
+	}
+	if _, ok := e.keyProvider.(*ExternalKeyProvider); ok {
+		// Each file has its own key; there is no password to verify
+		return nil
+	}
+
+	_, err := e.base.Stat(e.verifyMarkerPath())
+	if os.IsNotExist(err) {
+		var key *SecretKey
+		key, err = createMarker(e.base, e.verifyMarkerPath(), e.keyProvider, e.cipher, verifyMarkerCheck, e.random)
+		key.Destroy()
+		if errors.Is(err, fs.ErrExist) {
+			err = nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	e.marked.Store(true)
+	return nil
+}
+
+// verifyMarkerPath returns VerifyMarkerPath with the base filesystem's separator
+func (e *EncryptFS) verifyMarkerPath() string {
+	return string(e.base.Separator()) + strings.TrimPrefix(VerifyMarkerPath, "/")
+}
+
+// markerKeyPrefix starts the plaintext of a marker rewrapped by key
+// rotation. It is followed by the length of the key the marker was first
+// created with and that key, so the filesystem keeps its master key when
+// the password changes, and then by the marker's own contents. The leading
+// NUL tells it apart from the plaintext of a marker as first created.
+var markerKeyPrefix = []byte("\x00encryptfs wrapped master key")
+
+// markerRewrapSuffix is appended to the path of a marker for the copy that
+// rewrapMarker renames over it
+const markerRewrapSuffix = ".rewrap"
+
+// createMarker derives a key from a new salt and writes a marker file at
+// path: a file header recording the salt and the provider's KDF parameters,
+// followed by check encrypted under the key. It returns the key.
+func createMarker(base absfs.FileSystem, path string, provider KeyProvider, cipher CipherSuite, check []byte, random io.Reader) (*SecretKey, error) {
+	key, data, err := sealMarker(provider, cipher, check, random)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt %s: %w", path, err)
+	}
+
+	// O_EXCL keeps a concurrently created marker from being replaced
+	file, err := base.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		key.Destroy()
+		return nil, fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		key.Destroy()
+		return nil, fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := file.Close(); err != nil {
+		key.Destroy()
+		return nil, fmt.Errorf("failed to write %s: %w", path, err)
+	}
+
+	return key, nil
+}
+
+// sealMarker derives a key from a new salt and returns it with the encoded
+// marker holding plaintext encrypted under it
+func sealMarker(provider KeyProvider, cipher CipherSuite, plaintext []byte, random io.Reader) (*SecretKey, []byte, error) {
+	salt, err := generateSalt(provider, random)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate salt: %w", err)
+	}
+	nonce, err := generateNonceFrom(random, cipher)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	header := NewFileHeader(cipher, salt, nonce)
+	header.KDF = kdfParamsFor(provider)
+
+	key, err := provider.DeriveKey(salt)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to derive key: %w", err)
+	}
+
+	engine, err := NewCipherEngine(cipher, key.Bytes())
+	if err != nil {
+		key.Destroy()
+		return nil, nil, fmt.Errorf("failed to create cipher engine: %w", err)
+	}
+	ciphertext, err := engine.Encrypt(nonce, plaintext)
+	if err != nil {
+		key.Destroy()
+		return nil, nil, err
+	}
+
+	var buf bytes.Buffer
+	if _, err := header.WriteTo(&buf); err != nil {
+		key.Destroy()
+		return nil, nil, err
+	}
+	buf.Write(ciphertext)
+	return key, buf.Bytes(), nil
+}
+
+// rewrapMarker rewrites the marker at path, if there is one, so that the
+// new provider opens it instead of the old. The marker keeps its contents
+// and the master key it yields, which stays the same across password
+// changes. It is replaced by renaming a complete copy over it.
+func rewrapMarker(base absfs.FileSystem, path string, oldProvider, newProvider KeyProvider, cipher CipherSuite, random io.Reader) error {
+	key, contents, err := readMarkerAny(base, path, oldProvider)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer key.Destroy()
+
+	plaintext := append([]byte(nil), markerKeyPrefix...)
+	plaintext = append(plaintext, byte(key.Len()))
+	plaintext = append(plaintext, key.Bytes()...)
+	plaintext = append(plaintext, contents...)
+	defer clear(plaintext)
+
+	wrapKey, data, err := sealMarker(newProvider, cipher, plaintext, random)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt %s: %w", path, err)
+	}
+	wrapKey.Destroy()
+
+	tmp := path + markerRewrapSuffix
+	file, err := base.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", tmp, err)
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		base.Remove(tmp)
+		return fmt.Errorf("failed to write %s: %w", tmp, err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		base.Remove(tmp)
+		return fmt.Errorf("failed to sync %s: %w", tmp, err)
+	}
+	if err := file.Close(); err != nil {
+		base.Remove(tmp)
+		return fmt.Errorf("failed to write %s: %w", tmp, err)
+	}
+	if err := base.Rename(tmp, path); err != nil {
+		base.Remove(tmp)
+		return fmt.Errorf("failed to replace %s: %w", path, err)
+	}
+	return nil
+}
+
+// readMarkerAny reads a marker with the provider, or with the first of the
+// providers of a MultiKeyProvider that decrypts it
+func readMarkerAny(base absfs.FileSystem, path string, provider KeyProvider) (*SecretKey, []byte, error) {
+	multi, ok := provider.(*MultiKeyProvider)
+	if !ok {
+		return readMarker(base, path, provider)
+	}
+	var err error
+	for _, p := range multi.providers {
+		var key *SecretKey
+		var contents []byte
+		if key, contents, err = readMarker(base, path, p); !errors.Is(err, ErrAuthFailed) {
+			return key, contents, err
+		}
+	}
+	return nil, nil, err
+}
+
+// openMarker reads a marker file written by createMarker and returns the key
+// that decrypts it. A key that fails to decrypt the marker yields an error
+// wrapping ErrAuthFailed; a missing marker yields the base filesystem's
+// not-exist error.
+func openMarker(base absfs.FileSystem, path string, provider KeyProvider, check []byte) (*SecretKey, error) {
+	key, plaintext, err := readMarker(base, path, provider)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(plaintext, check) {
+		key.Destroy()
+		return nil, NewCorruptionError(path, "check value mismatch")
+	}
+	return key, nil
+}
+
+// readMarker decrypts a marker file written by createMarker or
+// rewrapMarker, returning the master key and the value encrypted in it, with
+// the errors of openMarker. The master key of a marker as first created is
+// the key that decrypts it; a rewrapped marker carries it.
+func readMarker(base absfs.FileSystem, path string, provider KeyProvider) (*SecretKey, []byte, error) {
+	data, err := readBaseFile(base, path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r := bytes.NewReader(data)
+	header := &FileHeader{}
+	if _, err := header.ReadFrom(r); err != nil {
+		return nil, nil, NewCorruptionError(path, fmt.Sprintf("invalid header: %v", err))
+	}
+	if err := header.Validate(); err != nil {
+		return nil, nil, NewCorruptionError(path, fmt.Sprintf("invalid header: %v", err))
+	}
+
+	key, err := deriveKeyForHeader(provider, header)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to derive key: %w", err)
+	}
+
+	engine, err := NewCipherEngine(header.Cipher, key.Bytes())
+	if err != nil {
+		key.Destroy()
+		return nil, nil, fmt.Errorf("failed to create cipher engine: %w", err)
+	}
+	plaintext, err := engine.Decrypt(header.Nonce, data[len(data)-r.Len():])
+	if err != nil {
+		key.Destroy()
+		return nil, nil, decryptError(path, "failed to verify key", err)
+	}
+
+	if rest, ok := bytes.CutPrefix(plaintext, markerKeyPrefix); ok {
+		key.Destroy()
+		if len(rest) == 0 || len(rest) < 1+int(rest[0]) {
+			return nil, nil, NewCorruptionError(path, "truncated master key")
+		}
+		size := int(rest[0])
+		key = NewSecretKey(append([]byte(nil), rest[1:1+size]...))
+		clear(rest[1 : 1+size])
+		plaintext = rest[1+size:]
+	}
+
+	return key, plaintext, nil
+}
+
+// readBaseFile reads a whole file from the base filesystem
+func readBaseFile(base absfs.FileSystem, name string) ([]byte, error) {
+	file, err := base.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
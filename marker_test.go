@@ -0,0 +1,155 @@
+package encryptfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/absfs/absfs"
+)
+
+func newMarkerTestFS(t *testing.T, base absfs.FileSystem, password string) *EncryptFS {
+	t.Helper()
+
+	fs, err := New(base, &Config{
+		Cipher: CipherAES256GCM,
+		KeyProvider: NewPasswordKeyProvider([]byte(password), Argon2idParams{
+			Memory:      64 * 1024,
+			Iterations:  1,
+			Parallelism: 2,
+		}),
+	})
+	if err != nil {
+		t.Fatalf("failed to create EncryptFS: %v", err)
+	}
+	return fs
+}
+
+func TestValidatePassword(t *testing.T) {
+	base, cleanup := setupTestFS(t)
+	defer cleanup()
+
+	fs := newMarkerTestFS(t, base, "right")
+
+	// Nothing has been written, so there is nothing to check against
+	if ok, err := fs.ValidatePassword(); !ok || err != nil {
+		t.Errorf("ValidatePassword before the first write = %v, %v, want true", ok, err)
+	}
+	if _, err := base.Stat(VerifyMarkerPath); !os.IsNotExist(err) {
+		t.Fatalf("marker exists before the first write: %v", err)
+	}
+
+	file, err := fs.Create("/file.txt")
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	file.Write([]byte("secret"))
+	file.Close()
+
+	if _, err := base.Stat(VerifyMarkerPath); err != nil {
+		t.Fatalf("marker not created by the first write: %v", err)
+	}
+
+	// The marker is hidden and reserved
+	entries, err := fs.ReadDir("/")
+	if err != nil {
+		t.Fatalf("ReadDir failed: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("ReadDir returned %d entries, want 1", len(entries))
+	}
+	if _, err := fs.Create(VerifyMarkerPath); !errors.Is(err, ErrReservedPath) {
+		t.Errorf("Create(VerifyMarkerPath) error = %v, want ErrReservedPath", err)
+	}
+
+	tests := []struct {
+		password string
+		want     bool
+	}{
+		{"right", true},
+		{"wrong", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.password, func(t *testing.T) {
+			other := newMarkerTestFS(t, base, tt.password)
+			defer other.Close()
+
+			ok, err := other.ValidatePassword()
+			if err != nil {
+				t.Fatalf("ValidatePassword failed: %v", err)
+			}
+			if ok != tt.want {
+				t.Errorf("ValidatePassword = %v, want %v", ok, tt.want)
+			}
+		})
+	}
+
+	fs.Close()
+	if _, err := fs.ValidatePassword(); !errors.Is(err, ErrClosed) {
+		t.Errorf("ValidatePassword after Close error = %v, want ErrClosed", err)
+	}
+}
+
+func TestValidatePassword_AfterRotation(t *testing.T) {
+	base, cleanup := setupTestFS(t)
+	defer cleanup()
+
+	fs := newMarkerTestFS(t, base, "old")
+	for _, name := range []string{"/a.txt", "/b.txt"} {
+		file, err := fs.Create(name)
+		if err != nil {
+			t.Fatalf("Create(%q) failed: %v", name, err)
+		}
+		file.Write([]byte("content of " + name))
+		file.Close()
+	}
+
+	newKey := NewPasswordKeyProvider([]byte("new"), Argon2idParams{
+		Memory:      64 * 1024,
+		Iterations:  1,
+		Parallelism: 2,
+	})
+	if err := fs.RotateAllKeys("/", KeyRotationOptions{NewKeyProvider: newKey}); err != nil {
+		t.Fatalf("RotateAllKeys failed: %v", err)
+	}
+	fs.Close()
+
+	tests := []struct {
+		password string
+		want     bool
+	}{
+		{"new", true},
+		{"old", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.password, func(t *testing.T) {
+			other := newMarkerTestFS(t, base, tt.password)
+			defer other.Close()
+
+			ok, err := other.ValidatePassword()
+			if err != nil {
+				t.Fatalf("ValidatePassword failed: %v", err)
+			}
+			if ok != tt.want {
+				t.Errorf("ValidatePassword = %v, want %v", ok, tt.want)
+			}
+		})
+	}
+
+	// Names are still encrypted under the master key the marker yields
+	rotated := newMarkerTestFS(t, base, "new")
+	defer rotated.Close()
+	file, err := rotated.Open("/a.txt")
+	if err != nil {
+		t.Fatalf("Open with the new password failed: %v", err)
+	}
+	content, err := io.ReadAll(file)
+	file.Close()
+	if err != nil || string(content) != "content of /a.txt" {
+		t.Errorf("content = %q, %v, want %q", content, err, "content of /a.txt")
+	}
+	if _, err := base.Stat(VerifyMarkerPath + markerRewrapSuffix); !os.IsNotExist(err) {
+		t.Errorf("rewrap temp file left behind: %v", err)
+	}
+}
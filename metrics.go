@@ -0,0 +1,103 @@
+package encryptfs
+
+import "time"
+
+// Metrics receives measurements of the work done by an EncryptFS, for
+// monitoring encryption throughput, key derivation cost and chunk cache
+// effectiveness. Callbacks run synchronously on the read and write paths,
+// possibly from several goroutines at once, so implementations must be
+// cheap and safe for concurrent use.
+type Metrics interface {
+	// OnEncrypt reports that bytes of plaintext were encrypted
+	OnEncrypt(bytes int, dur time.Duration)
+
+	// OnDecrypt reports that ciphertext was decrypted to bytes of plaintext
+	OnDecrypt(bytes int, dur time.Duration)
+
+	// OnKeyDerive reports a run of the key provider's derivation. Keys
+	// served from the key cache are not reported.
+	OnKeyDerive(dur time.Duration)
+
+	// OnChunkCacheHit reports a chunk served from a file's chunk cache
+	OnChunkCacheHit()
+
+	// OnChunkCacheMiss reports a chunk that had to be read and decrypted
+	OnChunkCacheMiss()
+}
+
+// meteredEngine reports the work of a cipher engine to Metrics
+type meteredEngine struct {
+	CipherEngine
+	metrics Metrics
+}
+
+func (m *meteredEngine) Encrypt(nonce, plaintext []byte) ([]byte, error) {
+	start := time.Now()
+	ciphertext, err := m.CipherEngine.Encrypt(nonce, plaintext)
+	if err == nil {
+		m.metrics.OnEncrypt(len(plaintext), time.Since(start))
+	}
+	return ciphertext, err
+}
+
+func (m *meteredEngine) Decrypt(nonce, ciphertext []byte) ([]byte, error) {
+	start := time.Now()
+	plaintext, err := m.CipherEngine.Decrypt(nonce, ciphertext)
+	if err == nil {
+		m.metrics.OnDecrypt(len(plaintext), time.Since(start))
+	}
+	return plaintext, err
+}
+
+func (m *meteredEngine) EncryptWithAAD(nonce, plaintext, additionalData []byte) ([]byte, error) {
+	start := time.Now()
+	ciphertext, err := encryptWithAAD(m.CipherEngine, nonce, plaintext, additionalData)
+	if err == nil {
+		m.metrics.OnEncrypt(len(plaintext), time.Since(start))
+	}
+	return ciphertext, err
+}
+
+func (m *meteredEngine) DecryptWithAAD(nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	start := time.Now()
+	plaintext, err := decryptWithAAD(m.CipherEngine, nonce, ciphertext, additionalData)
+	if err == nil {
+		m.metrics.OnDecrypt(len(plaintext), time.Since(start))
+	}
+	return plaintext, err
+}
+
+// newCipherEngine creates the cipher engine for a file, reporting its work
+// if metrics are configured
+func (e *EncryptFS) newCipherEngine(cipher CipherSuite, key []byte) (CipherEngine, error) {
+	engine, err := NewCipherEngine(cipher, key)
+	if err != nil || e.config.Metrics == nil {
+		return engine, err
+	}
+	return &meteredEngine{CipherEngine: engine, metrics: e.config.Metrics}, nil
+}
+
+// deriveKey derives the key for a new file's salt with the configured
+// provider, reusing the key of a WriteFiles batch for the batch's salt
+func (e *EncryptFS) deriveKey(salt []byte) ([]byte, error) {
+	if e.batch != nil && e.batch.sharesSalt(salt) {
+		return append([]byte(nil), e.batch.key...), nil
+	}
+	return unwrapKey(timeKeyDerive(e.config.Metrics, func() (*SecretKey, error) {
+		return e.keyProvider.DeriveKey(salt)
+	}))
+}
+
+// timeKeyDerive runs a key derivation, reporting its duration to metrics
+// if they are set and it succeeds
+func timeKeyDerive(metrics Metrics, derive func() (*SecretKey, error)) (*SecretKey, error) {
+	if metrics == nil {
+		return derive()
+	}
+	start := time.Now()
+	key, err := derive()
+	if err == nil {
+		metrics.OnKeyDerive(time.Since(start))
+	}
+	return key, err
+}
@@ -0,0 +1,136 @@
+package encryptfs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// metricCounts tallies the callbacks received by recordingMetrics
+type metricCounts struct {
+	encrypts       int
+	encryptedBytes int
+	decrypts       int
+	decryptedBytes int
+	derives        int
+	hits, misses   int
+}
+
+// recordingMetrics counts the callbacks it receives
+type recordingMetrics struct {
+	mu sync.Mutex
+	metricCounts
+}
+
+func (m *recordingMetrics) OnEncrypt(bytes int, dur time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.encrypts++
+	m.encryptedBytes += bytes
+}
+
+func (m *recordingMetrics) OnDecrypt(bytes int, dur time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.decrypts++
+	m.decryptedBytes += bytes
+}
+
+func (m *recordingMetrics) OnKeyDerive(dur time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.derives++
+}
+
+func (m *recordingMetrics) OnChunkCacheHit() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.hits++
+}
+
+func (m *recordingMetrics) OnChunkCacheMiss() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.misses++
+}
+
+func TestMetrics(t *testing.T) {
+	const chunkSize = 4 * 1024
+
+	tests := []struct {
+		name      string
+		chunkSize int
+		want      metricCounts
+	}{
+		// One key derivation for the new file, then the cached key is used
+		{"traditional", 0, metricCounts{
+			encrypts: 1, encryptedBytes: 3 * chunkSize,
+			decrypts: 1, decryptedBytes: 3 * chunkSize,
+			derives: 1,
+		}},
+		// The second pass over the chunks is served from the chunk cache
+		{"chunked", chunkSize, metricCounts{
+			encrypts: 3, encryptedBytes: 3 * chunkSize,
+			decrypts: 3, decryptedBytes: 3 * chunkSize,
+			derives: 1, hits: 3, misses: 3,
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base, cleanup := setupTestFS(t)
+			defer cleanup()
+
+			metrics := &recordingMetrics{}
+			fs, err := New(base, &Config{
+				Cipher: CipherAES256GCM,
+				KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+					Memory:      64 * 1024,
+					Iterations:  1,
+					Parallelism: 2,
+				}),
+				ChunkSize: tt.chunkSize,
+				Metrics:   metrics,
+			})
+			if err != nil {
+				t.Fatalf("failed to create EncryptFS: %v", err)
+			}
+
+			data := make([]byte, 3*chunkSize)
+			rand.Read(data)
+			file, err := fs.Create("/measured.bin")
+			if err != nil {
+				t.Fatalf("failed to create file: %v", err)
+			}
+			file.Write(data)
+			if err := file.Close(); err != nil {
+				t.Fatalf("failed to close: %v", err)
+			}
+
+			file, err = fs.Open("/measured.bin")
+			if err != nil {
+				t.Fatalf("failed to open: %v", err)
+			}
+			defer file.Close()
+			for pass := 0; pass < 2; pass++ {
+				file.Seek(0, io.SeekStart)
+				got, err := io.ReadAll(file)
+				if err != nil {
+					t.Fatalf("failed to read: %v", err)
+				}
+				if !bytes.Equal(got, data) {
+					t.Fatal("content mismatch")
+				}
+			}
+
+			metrics.mu.Lock()
+			defer metrics.mu.Unlock()
+			if metrics.metricCounts != tt.want {
+				t.Errorf("metrics = %+v, want %+v", metrics.metricCounts, tt.want)
+			}
+		})
+	}
+}
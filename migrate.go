@@ -0,0 +1,199 @@
+package encryptfs
+
+import (
+	"encoding/hex"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+
+	"github.com/absfs/absfs"
+)
+
+// MigrationReport summarizes a run of EncryptExisting
+type MigrationReport struct {
+	Encrypted        int      // Files encrypted by this run
+	Unchanged        int      // Files whose encrypted copy was up to date
+	AlreadyEncrypted []string // Source files skipped because they are encrypted files themselves
+	StaleRemoved     int      // Temporary files of interrupted runs that were removed
+}
+
+// importTempName matches the temporary names files are encrypted under
+// before they are renamed into place
+var importTempName = regexp.MustCompile(`^\..+\.import-[0-9a-f]{16}$`)
+
+// EncryptExisting encrypts the plaintext tree beneath plainRoot on plainFS
+// into the root of the filesystem, for the one-time migration of an existing
+// directory to encryptfs. Files are streamed one at a time under their
+// encrypted names and keep their modes and modification times.
+//
+// Unlike ImportAll, EncryptExisting can be run again after it was
+// interrupted, or over the tree it encrypted. It skips files already
+// encrypted: those whose encrypted copy has the size and modification time
+// of the plaintext file, and source files that are encrypted files
+// themselves. The latter are listed in the report, as a source file that
+// merely looks encrypted is not copied; in place, the encrypted files of an
+// earlier run count as unchanged instead. Each file is written under a
+// temporary name and renamed into place, and temporary files left by an
+// interrupted run are removed. So if filenames are not encrypted, plainFS may be the base
+// filesystem of e itself and the encrypted files replace the plaintext ones
+// in place. Otherwise plainFS must hold only the plaintext tree, which is
+// left for the caller to remove. Paths reserved for the filesystem's own
+// files are skipped.
+//
+// EncryptExisting stops at the first error and returns the report of the
+// work done until then, which is never nil.
+func (e *EncryptFS) EncryptExisting(plainFS absfs.FileSystem, plainRoot string) (*MigrationReport, error) {
+	report := &MigrationReport{}
+	if err := e.checkOpen("encryptexisting", "/"); err != nil {
+		return report, err
+	}
+	err := e.encryptTree(plainFS, plainRoot, "/", report)
+	return report, err
+}
+
+// encryptTree encrypts the directory srcDir on src to dstDir, creating
+// dstDir if needed and recording the outcome of each file in report
+func (e *EncryptFS) encryptTree(src absfs.FileSystem, srcDir, dstDir string, report *MigrationReport) error {
+	info, err := src.Stat(srcDir)
+	if err != nil {
+		return err
+	}
+	if err := e.MkdirAll(dstDir, info.Mode().Perm()); err != nil {
+		return err
+	}
+	// Before the source is listed, as in place it holds them too
+	if err := e.removeStaleImports(dstDir, report); err != nil {
+		return err
+	}
+
+	dir, err := src.Open(srcDir)
+	if err != nil {
+		return err
+	}
+	infos, err := dir.Readdir(-1)
+	dir.Close()
+	if err != nil {
+		return err
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name() < infos[j].Name()
+	})
+
+	for _, child := range infos {
+		if child.Name() == "." || child.Name() == ".." {
+			continue
+		}
+		srcPath := path.Join(srcDir, child.Name())
+		dstPath := path.Join(dstDir, child.Name())
+		if e.checkReserved("encryptexisting", dstPath) != nil {
+			continue
+		}
+
+		switch mode := child.Mode(); {
+		case mode.IsDir():
+			// The mode is set last, as in copyTree
+			if err = e.encryptTree(src, srcPath, dstPath, report); err == nil {
+				err = e.Chmod(dstPath, os.ModeDir|mode.Perm())
+			}
+		case mode&os.ModeSymlink != 0:
+			if _, statErr := e.Lstat(dstPath); statErr != nil {
+				err = copySymlink(src, e, srcPath, dstPath)
+			}
+		case mode.IsRegular():
+			err = e.encryptExistingFile(src, srcPath, dstPath, child, report)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeStaleImports removes the temporary files an interrupted run left in
+// dir, which were never renamed into place
+func (e *EncryptFS) removeStaleImports(dir string, report *MigrationReport) error {
+	entries, err := e.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !importTempName.MatchString(entry.Name()) {
+			continue
+		}
+		if err := e.Remove(path.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+		report.StaleRemoved++
+	}
+	return nil
+}
+
+// encryptExistingFile encrypts the regular file srcPath on src to dstPath
+// unless it was encrypted already, and records the outcome in report
+func (e *EncryptFS) encryptExistingFile(src absfs.FileSystem, srcPath, dstPath string, info os.FileInfo, report *MigrationReport) error {
+	// The encrypted path is only looked up for an existing copy, so that
+	// none is assigned to a file not encrypted yet
+	existing, statErr := e.Stat(dstPath)
+	var encryptedDst string
+	if statErr == nil && existing.Mode().IsRegular() {
+		if encryptedDst, statErr = e.translatePath(dstPath); statErr != nil {
+			return statErr
+		}
+	}
+	// A plaintext file in place of dstPath is not an encrypted copy, even
+	// though it has the size and time of the source
+	if encryptedDst != "" && existing.Size() == info.Size() &&
+		existing.ModTime().Equal(info.ModTime()) && isEncryptedFile(e.base, encryptedDst) {
+		report.Unchanged++
+		return nil
+	}
+	if isEncryptedFile(src, srcPath) {
+		// In place, the source is the encrypted copy itself
+		if baseInfo, err := e.base.Stat(encryptedDst); encryptedDst != "" && err == nil &&
+			baseInfo.Size() == info.Size() && baseInfo.ModTime().Equal(info.ModTime()) {
+			report.Unchanged++
+		} else {
+			report.AlreadyEncrypted = append(report.AlreadyEncrypted, srcPath)
+		}
+		return nil
+	}
+
+	suffix := make([]byte, 8)
+	if _, err := io.ReadFull(e.random, suffix); err != nil {
+		return err
+	}
+	tmp := path.Join(path.Dir(dstPath), "."+path.Base(dstPath)+".import-"+hex.EncodeToString(suffix))
+
+	if err := copyFile(src, e, srcPath, tmp, info.Mode().Perm()); err != nil {
+		e.Remove(tmp)
+		return err
+	}
+	if err := e.Chtimes(tmp, info.ModTime(), info.ModTime()); err != nil {
+		e.Remove(tmp)
+		return err
+	}
+	if err := e.Rename(tmp, dstPath); err != nil {
+		e.Remove(tmp)
+		return err
+	}
+	report.Encrypted++
+	return nil
+}
+
+// isEncryptedFile reports whether the file name on fs starts with a valid
+// encrypted file header
+func isEncryptedFile(fs absfs.FileSystem, name string) bool {
+	file, err := fs.Open(name)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	var header FileHeader
+	if _, err := header.ReadFrom(file); err != nil {
+		return false
+	}
+	return header.Validate() == nil
+}
@@ -0,0 +1,203 @@
+package encryptfs
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/memfs"
+)
+
+func TestEncryptExisting(t *testing.T) {
+	keyProvider := NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+		Memory:      64 * 1024,
+		Iterations:  1,
+		Parallelism: 2,
+	})
+	tree := map[string][]byte{
+		"/readme.txt":           []byte("top level"),
+		"/docs/guide.md":        bytes.Repeat([]byte("guide "), 1000),
+		"/docs/nested/deep.bin": {0, 1, 2, 3},
+	}
+
+	plain, err := memfs.NewFS()
+	if err != nil {
+		t.Fatalf("failed to create memfs: %v", err)
+	}
+	if err := plain.MkdirAll("/data/docs/nested", 0755); err != nil {
+		t.Fatalf("MkdirAll failed: %v", err)
+	}
+	for name, content := range tree {
+		writePlainFile(t, plain, "/data"+name, content)
+	}
+
+	base, cleanup := setupTestFS(t)
+	defer cleanup()
+	fs, err := New(base, &Config{
+		Cipher:             CipherAES256GCM,
+		KeyProvider:        keyProvider,
+		FilenameEncryption: FilenameEncryptionDeterministic,
+		ChunkSize:          4096,
+	})
+	if err != nil {
+		t.Fatalf("failed to create EncryptFS: %v", err)
+	}
+	defer fs.Close()
+
+	report, err := fs.EncryptExisting(plain, "/data")
+	if err != nil {
+		t.Fatalf("EncryptExisting failed: %v", err)
+	}
+	if report.Encrypted != len(tree) {
+		t.Errorf("EncryptExisting encrypted %d files, want %d", report.Encrypted, len(tree))
+	}
+	compareTree(t, fs, "/", tree)
+	if _, err := base.Stat("/readme.txt"); err == nil {
+		t.Error("file stored under its plaintext name")
+	}
+
+	// A second run finds everything encrypted already
+	if report, err = fs.EncryptExisting(plain, "/data"); err != nil || report.Encrypted != 0 || report.Unchanged != len(tree) {
+		t.Errorf("second EncryptExisting = %+v, %v; want %d files unchanged", report, err, len(tree))
+	}
+
+	// A changed plaintext file is encrypted again
+	writePlainFile(t, plain, "/data/readme.txt", []byte("changed"))
+	if err := plain.Chtimes("/data/readme.txt", time.Now(), time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Chtimes failed: %v", err)
+	}
+	if report, err = fs.EncryptExisting(plain, "/data"); err != nil || report.Encrypted != 1 {
+		t.Errorf("EncryptExisting after a change = %+v, %v; want 1 file", report, err)
+	}
+	tree["/readme.txt"] = []byte("changed")
+	compareTree(t, fs, "/", tree)
+}
+
+func TestEncryptExisting_InPlace(t *testing.T) {
+	keyProvider := NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+		Memory:      64 * 1024,
+		Iterations:  1,
+		Parallelism: 2,
+	})
+	tree := map[string][]byte{
+		"/a.txt":     []byte("alpha"),
+		"/dir/b.txt": bytes.Repeat([]byte("beta "), 500),
+	}
+
+	base, cleanup := setupTestFS(t)
+	defer cleanup()
+	if err := base.MkdirAll("/dir", 0755); err != nil {
+		t.Fatalf("MkdirAll failed: %v", err)
+	}
+	for name, content := range tree {
+		writePlainFile(t, base, name, content)
+	}
+
+	fs, err := New(base, &Config{Cipher: CipherAES256GCM, KeyProvider: keyProvider, StoreConfig: true})
+	if err != nil {
+		t.Fatalf("failed to create EncryptFS: %v", err)
+	}
+	defer fs.Close()
+
+	report, err := fs.EncryptExisting(base, "/")
+	if err != nil {
+		t.Fatalf("EncryptExisting failed: %v", err)
+	}
+	if report.Encrypted != len(tree) {
+		t.Errorf("EncryptExisting encrypted %d files, want %d", report.Encrypted, len(tree))
+	}
+	compareTree(t, fs, "/", tree)
+	for name := range tree {
+		if !isEncryptedFile(base, name) {
+			t.Errorf("%s was not encrypted in place", name)
+		}
+	}
+	entries, err := base.Open("/dir")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	names, _ := entries.Readdirnames(-1)
+	entries.Close()
+	if len(names) != 1 {
+		t.Errorf("base directory holds %v, want only the encrypted file", names)
+	}
+
+	// The encrypted files are the source now, and count as unchanged
+	if report, err = fs.EncryptExisting(base, "/"); err != nil || report.Encrypted != 0 ||
+		report.Unchanged != len(tree) || len(report.AlreadyEncrypted) != 0 {
+		t.Errorf("second EncryptExisting = %+v, %v; want %d files unchanged", report, err, len(tree))
+	}
+	compareTree(t, fs, "/", tree)
+}
+
+func TestEncryptExisting_Leftovers(t *testing.T) {
+	keyProvider := NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+		Memory:      64 * 1024,
+		Iterations:  1,
+		Parallelism: 2,
+	})
+	base, cleanup := setupTestFS(t)
+	defer cleanup()
+	fs, err := New(base, &Config{Cipher: CipherAES256GCM, KeyProvider: keyProvider})
+	if err != nil {
+		t.Fatalf("failed to create EncryptFS: %v", err)
+	}
+	defer fs.Close()
+
+	plain, err := memfs.NewFS()
+	if err != nil {
+		t.Fatalf("failed to create memfs: %v", err)
+	}
+	if err := plain.MkdirAll("/data", 0755); err != nil {
+		t.Fatalf("MkdirAll failed: %v", err)
+	}
+	writePlainFile(t, plain, "/data/a.txt", []byte("alpha"))
+
+	// A source file that is an encrypted file is not copied, but reported
+	writePlainFile(t, fs, "/sealed.bin", []byte("sealed"))
+	sealed, err := readBaseFile(base, "/sealed.bin")
+	if err != nil {
+		t.Fatalf("failed to read encrypted file: %v", err)
+	}
+	writePlainFile(t, plain, "/data/sealed.bin", sealed)
+	if err := fs.Remove("/sealed.bin"); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+
+	// The temporary file of an interrupted run is removed
+	stale := "/.a.txt.import-0123456789abcdef"
+	writePlainFile(t, fs, stale, []byte("partial"))
+
+	report, err := fs.EncryptExisting(plain, "/data")
+	if err != nil {
+		t.Fatalf("EncryptExisting failed: %v", err)
+	}
+	if report.Encrypted != 1 || report.StaleRemoved != 1 ||
+		len(report.AlreadyEncrypted) != 1 || report.AlreadyEncrypted[0] != "/data/sealed.bin" {
+		t.Errorf("EncryptExisting = %+v; want 1 file encrypted, 1 temporary file removed and /data/sealed.bin reported", report)
+	}
+	if _, err := fs.Stat(stale); err == nil {
+		t.Error("stale temporary file was not removed")
+	}
+	if _, err := fs.Stat("/sealed.bin"); err == nil {
+		t.Error("encrypted source file was copied")
+	}
+	compareTree(t, fs, "/", map[string][]byte{"/a.txt": []byte("alpha")})
+}
+
+// writePlainFile writes content to name on fs, replacing it if it exists
+func writePlainFile(t *testing.T, fs absfs.FileSystem, name string, content []byte) {
+	t.Helper()
+	file, err := fs.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatalf("failed to create %s: %v", name, err)
+	}
+	if _, err := file.Write(content); err != nil {
+		t.Fatalf("failed to write %s: %v", name, err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatalf("failed to close %s: %v", name, err)
+	}
+}
@@ -18,10 +18,21 @@ type ParallelConfig struct {
 
 	// MinChunksForParallel is the minimum number of chunks to use parallel processing
 	// Below this threshold, sequential processing is used
-	// Defaults to 4
+	// Must be at least 1 when enabled; DefaultParallelConfig uses 4
 	MinChunksForParallel int
+
+	// MinBytesForParallel is the minimum number of bytes a bulk read or
+	// write must cover to use parallel processing, so that small chunk
+	// sizes do not send a few kilobytes through the workers. If 0, only
+	// MinChunksForParallel applies; DefaultParallelConfig uses
+	// DefaultMinBytesForParallel.
+	MinBytesForParallel int
 }
 
+// DefaultMinBytesForParallel is the MinBytesForParallel of
+// DefaultParallelConfig: its MinChunksForParallel chunks of DefaultChunkSize
+const DefaultMinBytesForParallel = 4 * DefaultChunkSize
+
 // Validate checks if the parallel configuration is valid
 func (p *ParallelConfig) Validate() error {
 	if !p.Enabled {
@@ -40,190 +51,202 @@ func (p *ParallelConfig) Validate() error {
 	if p.MinChunksForParallel > 1000 {
 		return errors.New("parallel min chunks threshold must not exceed 1000")
 	}
+	if p.MinBytesForParallel < 0 {
+		return errors.New("parallel min bytes threshold cannot be negative")
+	}
+	if p.MinBytesForParallel > 1<<30 {
+		return errors.New("parallel min bytes threshold must not exceed 1 GiB")
+	}
 
 	return nil
 }
 
+// withDefaults returns the configuration with unset fields resolved:
+// enabled configurations with no MaxWorkers use one worker per CPU
+func (p ParallelConfig) withDefaults() ParallelConfig {
+	if p.Enabled && p.MaxWorkers == 0 {
+		p.MaxWorkers = runtime.NumCPU()
+	}
+	return p
+}
+
 // DefaultParallelConfig returns the default parallel processing configuration
 func DefaultParallelConfig() ParallelConfig {
 	return ParallelConfig{
 		Enabled:              true,
 		MaxWorkers:           runtime.NumCPU(),
 		MinChunksForParallel: 4,
+		MinBytesForParallel:  DefaultMinBytesForParallel,
 	}
 }
 
 // chunkJob represents a chunk encryption/decryption job
 type chunkJob struct {
 	index      uint32
+	last       bool // Whether the chunk is the last of the file
 	plaintext  []byte
 	ciphertext []byte
 	nonce      []byte
 	err        error
 }
 
-// parallelEncryptChunks encrypts multiple chunks in parallel
-func (cf *ChunkedFile) parallelEncryptChunks(chunks []chunkJob) error {
-	if len(chunks) == 0 {
-		return nil
-	}
+// workerPool runs chunk jobs on a fixed set of goroutines shared by every
+// file of an EncryptFS, so bulk operations do not pay for starting and
+// stopping workers on each call. The goroutines are started on first use
+// and stopped by close.
+type workerPool struct {
+	size  int
+	tasks chan func()
+	start sync.Once
+	wg    sync.WaitGroup
+
+	mu     sync.RWMutex // Held for reading while jobs are submitted
+	closed bool
+}
 
-	// Determine number of workers
-	numWorkers := cf.fs.config.Parallel.MaxWorkers
-	if numWorkers <= 0 {
-		numWorkers = runtime.NumCPU()
+// newWorkerPool creates a pool of size workers, or runtime.NumCPU() workers
+// if size is not positive
+func newWorkerPool(size int) *workerPool {
+	if size <= 0 {
+		size = runtime.NumCPU()
 	}
+	return &workerPool{size: size}
+}
 
-	// Limit workers to number of chunks
-	if numWorkers > len(chunks) {
-		numWorkers = len(chunks)
+// spawn starts the worker goroutines
+func (p *workerPool) spawn() {
+	p.tasks = make(chan func(), p.size)
+	for w := 0; w < p.size; w++ {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for task := range p.tasks {
+				task()
+			}
+		}()
 	}
+}
 
-	// Check if parallel processing is worth it
-	if len(chunks) < cf.fs.config.Parallel.MinChunksForParallel {
-		// Sequential processing
-		for i := range chunks {
-			ciphertext, err := cf.engine.Encrypt(chunks[i].nonce, chunks[i].plaintext)
-			if err != nil {
-				return err
-			}
-			chunks[i].ciphertext = ciphertext
-		}
-		return nil
+// run calls fn for every index in [0, n) on the pool's workers and waits for
+// them to finish, returning the first error. A panic in fn is recovered and
+// reported as an error naming the kind of worker.
+func (p *workerPool) run(n int, kind string, fn func(i int) error) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.closed {
+		return ErrClosed
 	}
+	p.start.Do(p.spawn)
 
-	// Parallel processing
 	var wg sync.WaitGroup
-	jobChan := make(chan int, len(chunks))
-	errChan := make(chan error, numWorkers)
+	var errOnce sync.Once
+	var firstErr error
+	fail := func(err error) {
+		errOnce.Do(func() { firstErr = err })
+	}
 
-	// Start workers
-	for w := 0; w < numWorkers; w++ {
-		wg.Add(1)
-		go func() {
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		p.tasks <- func() {
 			defer wg.Done()
 			defer func() {
 				if r := recover(); r != nil {
 					// Convert panic to error
-					err := fmt.Errorf("panic in encryption worker: %v", r)
-					select {
-					case errChan <- err:
-					default:
-					}
+					fail(fmt.Errorf("panic in %s worker: %v", kind, r))
 				}
 			}()
-			for idx := range jobChan {
-				ciphertext, err := cf.engine.Encrypt(chunks[idx].nonce, chunks[idx].plaintext)
-				if err != nil {
-					select {
-					case errChan <- err:
-					default:
-					}
-					return
-				}
-				chunks[idx].ciphertext = ciphertext
+			if err := fn(i); err != nil {
+				fail(err)
 			}
-		}()
-	}
-
-	// Send jobs
-	for i := range chunks {
-		jobChan <- i
+		}
 	}
-	close(jobChan)
-
-	// Wait for completion
 	wg.Wait()
-	close(errChan)
 
-	// Check for errors
-	select {
-	case err := <-errChan:
-		return err
-	default:
-		return nil
-	}
+	return firstErr
 }
 
-// parallelDecryptChunks decrypts multiple chunks in parallel
-func (cf *ChunkedFile) parallelDecryptChunks(chunks []chunkJob) error {
-	if len(chunks) == 0 {
-		return nil
+// close waits for submitted jobs to finish and stops the workers. Later
+// calls to run return ErrClosed.
+func (p *workerPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return
 	}
+	p.closed = true
 
-	// Determine number of workers
-	numWorkers := cf.fs.config.Parallel.MaxWorkers
-	if numWorkers <= 0 {
-		numWorkers = runtime.NumCPU()
+	if p.tasks != nil {
+		close(p.tasks)
+		p.wg.Wait()
 	}
+}
 
-	// Limit workers to number of chunks
-	if numWorkers > len(chunks) {
-		numWorkers = len(chunks)
+// useParallel reports whether a bulk read or write of n bytes is large
+// enough, in both chunks and bytes, to be worth the worker pool
+func (cf *ChunkedFile) useParallel(n int) bool {
+	parallel := cf.fs.parallel
+	return parallel.Enabled && n >= int(cf.chunkSize)*parallel.MinChunksForParallel &&
+		n >= parallel.MinBytesForParallel
+}
+
+// parallelEncryptChunks encrypts multiple chunks in parallel
+func (cf *ChunkedFile) parallelEncryptChunks(chunks []chunkJob) error {
+	if len(chunks) == 0 {
+		return nil
 	}
 
 	// Check if parallel processing is worth it
-	if len(chunks) < cf.fs.config.Parallel.MinChunksForParallel {
+	if len(chunks) < cf.fs.parallel.MinChunksForParallel {
 		// Sequential processing
 		for i := range chunks {
-			plaintext, err := cf.engine.Decrypt(chunks[i].nonce, chunks[i].ciphertext)
+			ciphertext, err := cf.sealer.seal(cf.engine, chunks[i].nonce, chunks[i].index, chunks[i].last, chunks[i].plaintext)
 			if err != nil {
 				return err
 			}
-			chunks[i].plaintext = plaintext
+			chunks[i].ciphertext = ciphertext
 		}
 		return nil
 	}
 
 	// Parallel processing
-	var wg sync.WaitGroup
-	jobChan := make(chan int, len(chunks))
-	errChan := make(chan error, numWorkers)
+	return cf.fs.workers.run(len(chunks), "encryption", func(idx int) error {
+		ciphertext, err := cf.sealer.seal(cf.engine, chunks[idx].nonce, chunks[idx].index, chunks[idx].last, chunks[idx].plaintext)
+		if err != nil {
+			return err
+		}
+		chunks[idx].ciphertext = ciphertext
+		return nil
+	})
+}
 
-	// Start workers
-	for w := 0; w < numWorkers; w++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			defer func() {
-				if r := recover(); r != nil {
-					// Convert panic to error
-					err := fmt.Errorf("panic in decryption worker: %v", r)
-					select {
-					case errChan <- err:
-					default:
-					}
-				}
-			}()
-			for idx := range jobChan {
-				plaintext, err := cf.engine.Decrypt(chunks[idx].nonce, chunks[idx].ciphertext)
-				if err != nil {
-					select {
-					case errChan <- err:
-					default:
-					}
-					return
-				}
-				chunks[idx].plaintext = plaintext
-			}
-		}()
+// parallelDecryptChunks decrypts multiple chunks in parallel
+func (cf *ChunkedFile) parallelDecryptChunks(chunks []chunkJob) error {
+	if len(chunks) == 0 {
+		return nil
 	}
 
-	// Send jobs
-	for i := range chunks {
-		jobChan <- i
+	// Check if parallel processing is worth it
+	if len(chunks) < cf.fs.parallel.MinChunksForParallel {
+		// Sequential processing
+		for i := range chunks {
+			plaintext, err := cf.sealer.open(cf.engine, chunks[i].nonce, chunks[i].index, chunks[i].last, chunks[i].ciphertext)
+			if err != nil {
+				return cf.chunkCorruption(chunks[i].index, "failed to decrypt chunk", err)
+			}
+			chunks[i].plaintext = plaintext
+		}
+		return nil
 	}
-	close(jobChan)
 
-	// Wait for completion
-	wg.Wait()
-	close(errChan)
-
-	// Check for errors
-	select {
-	case err := <-errChan:
-		return err
-	default:
+	// Parallel processing
+	return cf.fs.workers.run(len(chunks), "decryption", func(idx int) error {
+		plaintext, err := cf.sealer.open(cf.engine, chunks[idx].nonce, chunks[idx].index, chunks[idx].last, chunks[idx].ciphertext)
+		if err != nil {
+			return cf.chunkCorruption(chunks[idx].index, "failed to decrypt chunk", err)
+		}
+		chunks[idx].plaintext = plaintext
 		return nil
-	}
+	})
 }
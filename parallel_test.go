@@ -0,0 +1,239 @@
+package encryptfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/absfs/memfs"
+)
+
+func newParallelTestFS(t *testing.T) *EncryptFS {
+	t.Helper()
+
+	base, err := memfs.NewFS()
+	if err != nil {
+		t.Fatalf("Failed to create memfs: %v", err)
+	}
+
+	fs, err := New(base, &Config{
+		Cipher: CipherAES256GCM,
+		KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+			Memory:      64 * 1024,
+			Iterations:  1,
+			Parallelism: 2,
+		}),
+		ChunkSize: 4 * 1024,
+		Parallel: ParallelConfig{
+			Enabled:              true,
+			MaxWorkers:           4,
+			MinChunksForParallel: 2,
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create EncryptFS: %v", err)
+	}
+	return fs
+}
+
+// TestWorkerPool_ConcurrentBulk runs bulk writes and reads on several files
+// at once, all sharing the filesystem's worker pool. Run with -race.
+func TestWorkerPool_ConcurrentBulk(t *testing.T) {
+	fs := newParallelTestFS(t)
+	defer fs.Close()
+
+	// memfs does not support concurrent directory changes, so the files
+	// are created up front and only the bulk operations run concurrently
+	const files = 8
+	chunked := make([]*ChunkedFile, files)
+	for n := range chunked {
+		file, err := fs.Create(fmt.Sprintf("/bulk-%d.bin", n))
+		if err != nil {
+			t.Fatalf("Create failed: %v", err)
+		}
+		chunked[n] = file.(*ChunkedFile)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, files)
+
+	for n, cf := range chunked {
+		wg.Add(1)
+		go func(n int, cf *ChunkedFile) {
+			defer wg.Done()
+
+			data := bytes.Repeat([]byte{byte(n)}, 10*4*1024+n)
+			if _, err := cf.WriteBulk(data); err != nil {
+				errs <- fmt.Errorf("WriteBulk(%s): %w", cf.Name(), err)
+				return
+			}
+			cf.Seek(0, io.SeekStart)
+
+			got := make([]byte, len(data))
+			if _, err := cf.ReadBulk(got); err != nil {
+				errs <- fmt.Errorf("ReadBulk(%s): %w", cf.Name(), err)
+				return
+			}
+			if !bytes.Equal(got, data) {
+				errs <- fmt.Errorf("%s: content mismatch", cf.Name())
+				return
+			}
+			if err := cf.Close(); err != nil {
+				errs <- err
+			}
+		}(n, cf)
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestWorkerPool_Close(t *testing.T) {
+	fs := newParallelTestFS(t)
+
+	file, err := fs.Create("/closed.bin")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	cf := file.(*ChunkedFile)
+
+	if err := fs.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatalf("second Close failed: %v", err)
+	}
+
+	if _, err := cf.WriteBulk(make([]byte, 10*4*1024)); !errors.Is(err, ErrClosed) {
+		t.Errorf("WriteBulk after Close: got %v, want ErrClosed", err)
+	}
+}
+
+// TestParallelConfig_ZeroWorkers checks that an enabled configuration with
+// no MaxWorkers gets one worker per CPU and still processes bulk operations
+func TestParallelConfig_ZeroWorkers(t *testing.T) {
+	base, err := memfs.NewFS()
+	if err != nil {
+		t.Fatalf("Failed to create memfs: %v", err)
+	}
+
+	fs, err := New(base, &Config{
+		Cipher: CipherAES256GCM,
+		KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+			Memory:      64 * 1024,
+			Iterations:  1,
+			Parallelism: 2,
+		}),
+		ChunkSize: 4 * 1024,
+		Parallel: ParallelConfig{
+			Enabled:              true,
+			MinChunksForParallel: 2,
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create EncryptFS: %v", err)
+	}
+	defer fs.Close()
+
+	if fs.parallel.MaxWorkers != runtime.NumCPU() {
+		t.Errorf("MaxWorkers = %d, want %d", fs.parallel.MaxWorkers, runtime.NumCPU())
+	}
+	if fs.workers.size != runtime.NumCPU() {
+		t.Errorf("pool size = %d, want %d", fs.workers.size, runtime.NumCPU())
+	}
+
+	data := bytes.Repeat([]byte("zero workers "), 4*1024)
+	file, err := fs.Create("/bulk.bin")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	cf := file.(*ChunkedFile)
+	if _, err := cf.WriteBulk(data); err != nil {
+		t.Fatalf("WriteBulk failed: %v", err)
+	}
+	cf.Seek(0, io.SeekStart)
+	got := make([]byte, len(data))
+	if _, err := cf.ReadBulk(got); err != nil {
+		t.Fatalf("ReadBulk failed: %v", err)
+	}
+	cf.Close()
+	if !bytes.Equal(got, data) {
+		t.Error("bulk round trip mismatch")
+	}
+
+	// The resolved default does not leak into the caller's configuration
+	if fs.config.Parallel.MaxWorkers != 0 {
+		t.Errorf("Config.Parallel.MaxWorkers changed to %d", fs.config.Parallel.MaxWorkers)
+	}
+}
+
+// TestParallelConfig_MinBytes checks that bulk operations smaller than
+// MinBytesForParallel stay sequential however many chunks they span
+func TestParallelConfig_MinBytes(t *testing.T) {
+	base, err := memfs.NewFS()
+	if err != nil {
+		t.Fatalf("Failed to create memfs: %v", err)
+	}
+
+	fs, err := New(base, &Config{
+		Cipher: CipherAES256GCM,
+		KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+			Memory:      64 * 1024,
+			Iterations:  1,
+			Parallelism: 2,
+		}),
+		ChunkSize: 4 * 1024,
+		Parallel: ParallelConfig{
+			Enabled:              true,
+			MaxWorkers:           4,
+			MinChunksForParallel: 2,
+			MinBytesForParallel:  64 * 1024,
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create EncryptFS: %v", err)
+	}
+	defer fs.Close()
+
+	file, err := fs.Create("/bulk.bin")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	defer file.Close()
+	cf := file.(*ChunkedFile)
+
+	// Eight chunks, but below the byte threshold: the pool is never started
+	small := bytes.Repeat([]byte("s"), 32*1024)
+	if _, err := cf.WriteBulk(small); err != nil {
+		t.Fatalf("WriteBulk failed: %v", err)
+	}
+	cf.Seek(0, io.SeekStart)
+	if _, err := cf.ReadBulk(make([]byte, len(small))); err != nil {
+		t.Fatalf("ReadBulk failed: %v", err)
+	}
+	if fs.workers.tasks != nil {
+		t.Error("worker pool started for a bulk operation below MinBytesForParallel")
+	}
+
+	large := bytes.Repeat([]byte("l"), 64*1024)
+	if _, err := cf.WriteBulk(large); err != nil {
+		t.Fatalf("WriteBulk failed: %v", err)
+	}
+	if fs.workers.tasks == nil {
+		t.Error("worker pool not started for a bulk operation at MinBytesForParallel")
+	}
+
+	for _, minBytes := range []int{-1, 1<<30 + 1} {
+		config := ParallelConfig{Enabled: true, MinChunksForParallel: 1, MinBytesForParallel: minBytes}
+		if err := config.Validate(); err == nil {
+			t.Errorf("MinBytesForParallel %d: expected a validation error", minBytes)
+		}
+	}
+}
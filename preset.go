@@ -0,0 +1,74 @@
+package encryptfs
+
+// PresetSecure returns a configuration that favours security over speed:
+// ChaCha20-Poly1305, Argon2id with 256 MiB of memory and 5 iterations,
+// deterministic filename encryption and content digests. Key derivation
+// takes around a second, and the memory is needed each time a file is
+// opened, so it suits stores that hold a few valuable files.
+//
+// Like the other presets it has no key provider: attach one, for example
+// with SetPassword, before passing it to New.
+func PresetSecure() *Config {
+	return &Config{
+		Cipher:             CipherChaCha20Poly1305,
+		FilenameEncryption: FilenameEncryptionDeterministic,
+		ChunkSize:          DefaultChunkSize,
+		ComputeDigest:      true,
+		PasswordParams: Argon2idParams{
+			Memory:      256 * 1024,
+			Iterations:  5,
+			Parallelism: 4,
+			SaltSize:    defaultSaltSize,
+			KeySize:     32,
+		},
+	}
+}
+
+// PresetBalanced returns a configuration for general use: AES-256-GCM,
+// Argon2id with 64 MiB of memory and 3 iterations (the defaults of
+// NewPasswordKeyProvider) and deterministic filename encryption.
+func PresetBalanced() *Config {
+	return &Config{
+		Cipher:             CipherAES256GCM,
+		FilenameEncryption: FilenameEncryptionDeterministic,
+		ChunkSize:          DefaultChunkSize,
+		PasswordParams: Argon2idParams{
+			Memory:      64 * 1024,
+			Iterations:  3,
+			Parallelism: 4,
+			SaltSize:    defaultSaltSize,
+			KeySize:     32,
+		},
+	}
+}
+
+// PresetFast returns a configuration that favours throughput: AES-256-GCM,
+// which is hardware accelerated on most CPUs, Argon2id with 19 MiB of memory
+// and 2 iterations, the OWASP minimum, and large chunks processed in
+// parallel. Filenames are left in plaintext. This package offers no weaker
+// cipher than AES-256-GCM, so the speed comes from key derivation and chunk
+// processing rather than the cipher.
+func PresetFast() *Config {
+	return &Config{
+		Cipher:    CipherAES256GCM,
+		ChunkSize: 1024 * 1024,
+		Parallel:  DefaultParallelConfig(),
+		PasswordParams: Argon2idParams{
+			Memory:      19 * 1024,
+			Iterations:  2,
+			Parallelism: 1,
+			SaltSize:    defaultSaltSize,
+			KeySize:     32,
+		},
+	}
+}
+
+// SetPassword sets the key provider to derive keys from password with
+// Argon2id, using PasswordParams. It returns c so that it can be chained
+// after a preset:
+//
+//	fs, err := encryptfs.New(base, encryptfs.PresetBalanced().SetPassword(password))
+func (c *Config) SetPassword(password []byte) *Config {
+	c.KeyProvider = NewPasswordKeyProvider(password, c.PasswordParams)
+	return c
+}
@@ -0,0 +1,94 @@
+package encryptfs
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestPresets(t *testing.T) {
+	presets := map[string]*Config{
+		"Secure":   PresetSecure(),
+		"Balanced": PresetBalanced(),
+		"Fast":     PresetFast(),
+	}
+	for name, config := range presets {
+		if config.KeyProvider != nil {
+			t.Errorf("%s: preset has a key provider", name)
+		}
+		if err := config.SetPassword([]byte("test-password")).Validate(); err != nil {
+			t.Errorf("%s: Validate failed: %v", name, err)
+		}
+	}
+
+	secure, balanced, fast := presets["Secure"], presets["Balanced"], presets["Fast"]
+	if secure.Cipher != CipherChaCha20Poly1305 {
+		t.Errorf("Secure cipher = %v, want %v", secure.Cipher, CipherChaCha20Poly1305)
+	}
+	if secure.PasswordParams.Memory != 256*1024 || secure.PasswordParams.Iterations != 5 {
+		t.Errorf("Secure Argon2id = %d KiB, %d iterations, want 262144 KiB, 5 iterations",
+			secure.PasswordParams.Memory, secure.PasswordParams.Iterations)
+	}
+	if balanced.Cipher != CipherAES256GCM || fast.Cipher != CipherAES256GCM {
+		t.Errorf("Balanced and Fast ciphers = %v and %v, want %v", balanced.Cipher, fast.Cipher, CipherAES256GCM)
+	}
+
+	// Key derivation gets cheaper from Secure to Fast
+	cost := func(c *Config) uint64 {
+		return uint64(c.PasswordParams.Memory) * uint64(c.PasswordParams.Iterations)
+	}
+	if !(cost(secure) > cost(balanced) && cost(balanced) > cost(fast)) {
+		t.Errorf("Argon2id costs not decreasing: Secure %d, Balanced %d, Fast %d",
+			cost(secure), cost(balanced), cost(fast))
+	}
+	if !fast.Parallel.Enabled || fast.ChunkSize <= balanced.ChunkSize {
+		t.Errorf("Fast should process larger chunks in parallel: %+v, chunk size %d", fast.Parallel, fast.ChunkSize)
+	}
+
+	// Presets are fresh copies
+	PresetSecure().Cipher = CipherAES256GCM
+	if PresetSecure().Cipher != CipherChaCha20Poly1305 {
+		t.Error("changing one preset changed another")
+	}
+
+	// Invalid password parameters are rejected
+	config := PresetBalanced()
+	config.PasswordParams.Memory = 1024
+	if err := config.SetPassword([]byte("test-password")).Validate(); err == nil {
+		t.Error("Validate accepted 1 MiB of Argon2id memory")
+	}
+}
+
+func TestPresetFast_RoundTrip(t *testing.T) {
+	base, cleanup := setupTestFS(t)
+	defer cleanup()
+
+	fs, err := New(base, PresetFast().SetPassword([]byte("test-password")))
+	if err != nil {
+		t.Fatalf("failed to create EncryptFS: %v", err)
+	}
+	defer fs.Close()
+
+	data := bytes.Repeat([]byte("preset "), 1000)
+	file, err := fs.Create("/file.txt")
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	file.Write(data)
+	if err := file.Close(); err != nil {
+		t.Fatalf("failed to close file: %v", err)
+	}
+
+	file, err = fs.Open("/file.txt")
+	if err != nil {
+		t.Fatalf("failed to open file: %v", err)
+	}
+	got, err := io.ReadAll(file)
+	file.Close()
+	if err != nil {
+		t.Fatalf("failed to read file: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("read %d bytes, want %d", len(got), len(data))
+	}
+}
@@ -0,0 +1,458 @@
+package encryptfs
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/absfs/absfs"
+)
+
+// ReadDir reads the named directory and returns its entries sorted by
+// plaintext filename, in the style of os.ReadDir. Entry names are decrypted
+// and internal files such as the filename metadata database are omitted.
+func (e *EncryptFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if err := e.checkOp("readdir", name); err != nil {
+		return nil, err
+	}
+
+	if e.flat != nil {
+		return e.readFlatDir(name)
+	}
+
+	encryptedPath, err := e.translatePath(name)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := e.base.Open(encryptedPath)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+
+	infos, err := dir.Readdir(-1)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]fs.DirEntry, 0, len(infos))
+	for _, info := range infos {
+		entry, err := e.dirEntry(encryptedPath, info)
+		if err != nil {
+			return nil, err
+		}
+		if entry != nil {
+			entries = append(entries, entry)
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+
+	return entries, nil
+}
+
+// dirEntry returns the entry for a child of the base directory
+// encryptedPath with its name decrypted, or nil for the directory itself,
+// its parent and internal files
+func (e *EncryptFS) dirEntry(encryptedPath string, info os.FileInfo) (*encryptedDirEntry, error) {
+	if info.Name() == "." || info.Name() == ".." {
+		return nil, nil
+	}
+
+	encryptedChild := e.joinPath(encryptedPath, info.Name())
+	if e.isInternalPath(encryptedChild) {
+		return nil, nil
+	}
+
+	encryptedName := info.Name()
+	if e.longNames != nil {
+		var err error
+		if encryptedName, err = e.longNames.lookup(encryptedPath, encryptedName); err != nil {
+			return nil, err
+		}
+	}
+	plainName, err := e.filenameEncryptor.DecryptFilename(encryptedName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt entry %q: %w", info.Name(), err)
+	}
+
+	return &encryptedDirEntry{
+		fs:            e,
+		name:          plainName,
+		encryptedPath: encryptedChild,
+		baseInfo:      info,
+	}, nil
+}
+
+// readDirStreamBatch is the number of base entries ReadDirStream lists at a
+// time
+const readDirStreamBatch = 256
+
+// ReadDirStream lists the named directory without holding all of its
+// entries in memory. Each call to next returns one entry, decrypting its
+// name as it goes, and io.EOF once the directory is exhausted. Entries come
+// in the order of the base filesystem, not sorted, and internal files are
+// omitted as with ReadDir. The base directory is read readDirStreamBatch
+// entries at a time and stays open until next returns an error or cancel is
+// called; after cancel, next fails with os.ErrClosed. The iterator is not
+// safe for concurrent use.
+//
+// A flattened filesystem lists directories from its metadata database,
+// which is already in memory, so its entries are sorted.
+func (e *EncryptFS) ReadDirStream(name string) (next func() (fs.DirEntry, error), cancel func()) {
+	fail := func(err error) (func() (fs.DirEntry, error), func()) {
+		return func() (fs.DirEntry, error) { return nil, err }, func() {}
+	}
+	if err := e.checkOp("readdir", name); err != nil {
+		return fail(err)
+	}
+
+	if e.flat != nil {
+		entries, err := e.readFlatDir(name)
+		if err != nil {
+			return fail(err)
+		}
+		closed := false
+		next = func() (fs.DirEntry, error) {
+			switch {
+			case closed:
+				return nil, &os.PathError{Op: "readdir", Path: name, Err: os.ErrClosed}
+			case len(entries) == 0:
+				return nil, io.EOF
+			}
+			entry := entries[0]
+			entries = entries[1:]
+			return entry, nil
+		}
+		return next, func() { closed, entries = true, nil }
+	}
+
+	encryptedPath, err := e.translatePath(name)
+	if err != nil {
+		return fail(err)
+	}
+	dir, err := e.base.Open(encryptedPath)
+	if err != nil {
+		return fail(err)
+	}
+
+	var (
+		batch []os.FileInfo
+		done  error // Returned by every call once set
+	)
+	finish := func(err error) {
+		if done == nil {
+			dir.Close()
+			done = err
+		}
+	}
+	next = func() (fs.DirEntry, error) {
+		for done == nil {
+			if len(batch) == 0 {
+				infos, err := dir.Readdir(readDirStreamBatch)
+				if len(infos) == 0 {
+					if err == nil {
+						err = io.EOF
+					}
+					finish(err)
+					break
+				}
+				batch = infos
+			}
+
+			info := batch[0]
+			batch = batch[1:]
+			entry, err := e.dirEntry(encryptedPath, info)
+			if err != nil {
+				finish(err)
+				break
+			}
+			if entry != nil {
+				return entry, nil
+			}
+		}
+		return nil, done
+	}
+	cancel = func() {
+		batch = nil
+		finish(&os.PathError{Op: "readdir", Path: name, Err: os.ErrClosed})
+	}
+	return next, cancel
+}
+
+// readFlatDir lists a logical directory of a flattened filesystem from the
+// metadata database, stating each file blob on the base filesystem
+func (e *EncryptFS) readFlatDir(name string) ([]fs.DirEntry, error) {
+	files, dirs, err := e.flat.children(e.logicalPath(name))
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]fs.DirEntry, 0, len(files)+len(dirs))
+	for plainName, info := range dirs {
+		entries = append(entries, &encryptedDirEntry{
+			fs:       e,
+			name:     plainName,
+			baseInfo: info,
+		})
+	}
+	for plainName, blob := range files {
+		info, err := e.base.Stat(blob)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, &encryptedDirEntry{
+			fs:            e,
+			name:          plainName,
+			encryptedPath: blob,
+			baseInfo:      info,
+		})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+
+	return entries, nil
+}
+
+// joinPath joins a directory and a child name using the base separator
+func (e *EncryptFS) joinPath(dir, child string) string {
+	sep := string([]byte{e.base.Separator()})
+	return strings.TrimSuffix(dir, sep) + sep + child
+}
+
+// isInternalPath reports whether an encrypted path refers to a file managed
+// by encryptfs itself rather than by the user
+func (e *EncryptFS) isInternalPath(encryptedPath string) bool {
+	if strings.HasSuffix(encryptedPath, xattrSuffix) {
+		return true
+	}
+	sep := string([]byte{e.base.Separator()})
+	if e.longNames != nil && (encryptedPath == longNameIndexFile || strings.HasSuffix(encryptedPath, sep+longNameIndexFile)) {
+		return true
+	}
+	encryptedPath = strings.TrimPrefix(encryptedPath, sep)
+	if marker, ok := strings.CutSuffix(encryptedPath, markerRewrapSuffix); ok && e.isInternalPath(marker) {
+		return true
+	}
+	if e.config.SharedSalt && encryptedPath == strings.TrimPrefix(KeyfilePath, "/") {
+		return true
+	}
+	if encryptedPath == strings.TrimPrefix(VerifyMarkerPath, "/") {
+		return true
+	}
+	if encryptedPath == strings.TrimPrefix(ConfigBlobPath, "/") {
+		return true
+	}
+	if e.config.MetadataPath == "" {
+		return false
+	}
+	metadataPath := strings.TrimPrefix(e.config.MetadataPath, sep)
+	return encryptedPath == metadataPath || encryptedPath == metadataPath+metadataTempSuffix ||
+		encryptedPath == metadataPath+metadataCorruptSuffix
+}
+
+// encryptedDirEntry implements fs.DirEntry for an entry of an encrypted directory
+type encryptedDirEntry struct {
+	fs            *EncryptFS
+	name          string      // Decrypted entry name
+	encryptedPath string      // Full path on the base filesystem
+	baseInfo      os.FileInfo // Info as reported by the base directory listing
+}
+
+// Name returns the decrypted entry name
+func (d *encryptedDirEntry) Name() string {
+	return d.name
+}
+
+// IsDir reports whether the entry describes a directory
+func (d *encryptedDirEntry) IsDir() bool {
+	return d.baseInfo.IsDir()
+}
+
+// Type returns the type bits for the entry
+func (d *encryptedDirEntry) Type() fs.FileMode {
+	return d.baseInfo.Mode().Type()
+}
+
+// Info returns the FileInfo for the entry with the plaintext name and, for
+// regular files, the decrypted size. The size is only computed when Info is
+// called, since it requires reading the file headers.
+func (d *encryptedDirEntry) Info() (fs.FileInfo, error) {
+	info := newEncryptedFileInfo(d.baseInfo, d.fs.cipher)
+	info.name = d.name
+
+	if !d.baseInfo.IsDir() {
+		size, err := d.fs.plaintextSize(d.encryptedPath, d.baseInfo)
+		if err != nil {
+			return nil, err
+		}
+		info.size = size
+	}
+
+	return info, nil
+}
+
+// String returns a human-readable description of the entry
+func (d *encryptedDirEntry) String() string {
+	return fs.FormatDirEntry(d)
+}
+
+var _ absfs.File = (*encryptedDir)(nil)
+
+// encryptedDir is the handle returned by OpenFile for a directory. Like an
+// os.File opened on a directory it lists its entries, here with decrypted
+// names, and fails to read or write data.
+type encryptedDir struct {
+	fs      *EncryptFS
+	name    string        // Plaintext path passed to OpenFile
+	entries []fs.DirEntry // Listed on the first Readdir or Readdirnames
+	offset  int           // Number of entries already returned
+	listed  bool
+	closed  bool
+}
+
+// openDir returns a handle for the directory at a plaintext path. Only
+// read-only opens are allowed, as with os.OpenFile.
+func (e *EncryptFS) openDir(name string, flag int) (*encryptedDir, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		return nil, &os.PathError{Op: "open", Path: name, Err: errIsDir}
+	}
+	return &encryptedDir{fs: e, name: name}, nil
+}
+
+// next returns up to n of the remaining entries, or all of them if n <= 0,
+// following the conventions of os.File.ReadDir
+func (d *encryptedDir) next(op string, n int) ([]fs.DirEntry, error) {
+	if d.closed {
+		return nil, &os.PathError{Op: op, Path: d.name, Err: os.ErrClosed}
+	}
+
+	if !d.listed {
+		entries, err := d.fs.ReadDir(d.name)
+		if err != nil {
+			return nil, err
+		}
+		d.entries = entries
+		d.listed = true
+	}
+
+	remaining := d.entries[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return remaining, nil
+	}
+	if len(remaining) == 0 {
+		return nil, io.EOF
+	}
+
+	n = min(n, len(remaining))
+	d.offset += n
+	return remaining[:n], nil
+}
+
+// Readdir returns file information for the directory's entries
+func (d *encryptedDir) Readdir(n int) ([]os.FileInfo, error) {
+	entries, err := d.next("readdir", n)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return infos, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// Readdirnames returns the decrypted names of the directory's entries
+func (d *encryptedDir) Readdirnames(n int) ([]string, error) {
+	entries, err := d.next("readdirnames", n)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, len(entries))
+	for i, entry := range entries {
+		names[i] = entry.Name()
+	}
+	return names, nil
+}
+
+// Name returns the plaintext path the directory was opened with
+func (d *encryptedDir) Name() string {
+	return d.name
+}
+
+// Stat returns file information for the directory
+func (d *encryptedDir) Stat() (os.FileInfo, error) {
+	return d.fs.Stat(d.name)
+}
+
+// Seek rewinds the listing when called with offset 0 and io.SeekStart, the
+// only seek a directory supports
+func (d *encryptedDir) Seek(offset int64, whence int) (int64, error) {
+	if offset != 0 || whence != io.SeekStart {
+		return 0, &os.PathError{Op: "seek", Path: d.name, Err: errIsDir}
+	}
+	d.entries = nil
+	d.offset = 0
+	d.listed = false
+	return 0, nil
+}
+
+// Read fails, as a directory holds no data
+func (d *encryptedDir) Read(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "read", Path: d.name, Err: errIsDir}
+}
+
+// ReadAt fails, as a directory holds no data
+func (d *encryptedDir) ReadAt(b []byte, off int64) (int, error) {
+	return 0, &os.PathError{Op: "read", Path: d.name, Err: errIsDir}
+}
+
+// Write fails, as a directory holds no data
+func (d *encryptedDir) Write(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: d.name, Err: errIsDir}
+}
+
+// WriteAt fails, as a directory holds no data
+func (d *encryptedDir) WriteAt(b []byte, off int64) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: d.name, Err: errIsDir}
+}
+
+// WriteString fails, as a directory holds no data
+func (d *encryptedDir) WriteString(s string) (int, error) {
+	return d.Write([]byte(s))
+}
+
+// Truncate fails, as a directory holds no data
+func (d *encryptedDir) Truncate(size int64) error {
+	return &os.PathError{Op: "truncate", Path: d.name, Err: errIsDir}
+}
+
+// Sync does nothing, as a directory handle buffers no data
+func (d *encryptedDir) Sync() error {
+	return nil
+}
+
+// Close releases the listing. Later calls fail with os.ErrClosed.
+func (d *encryptedDir) Close() error {
+	if d.closed {
+		return &os.PathError{Op: "close", Path: d.name, Err: os.ErrClosed}
+	}
+	d.closed = true
+	d.entries = nil
+	return nil
+}
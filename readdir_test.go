@@ -0,0 +1,335 @@
+package encryptfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/memfs"
+)
+
+func TestReadDir(t *testing.T) {
+	modes := []struct {
+		name   string
+		config func(*Config)
+	}{
+		{"deterministic", func(c *Config) {
+			c.FilenameEncryption = FilenameEncryptionDeterministic
+		}},
+		{"random", func(c *Config) {
+			c.FilenameEncryption = FilenameEncryptionRandom
+			c.MetadataPath = "/.metadata.json"
+		}},
+	}
+
+	for _, mode := range modes {
+		t.Run(mode.name, func(t *testing.T) {
+			base, err := memfs.NewFS()
+			if err != nil {
+				t.Fatalf("Failed to create memfs: %v", err)
+			}
+
+			config := &Config{
+				Cipher: CipherAES256GCM,
+				KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+					Memory:      64 * 1024,
+					Iterations:  1,
+					Parallelism: 2,
+				}),
+			}
+			mode.config(config)
+
+			fs, err := New(base, config)
+			if err != nil {
+				t.Fatalf("Failed to create EncryptFS: %v", err)
+			}
+
+			if err := fs.MkdirAll("/docs/archive", 0755); err != nil {
+				t.Fatalf("MkdirAll failed: %v", err)
+			}
+
+			files := map[string]string{
+				"/docs/readme.md": "Read me first",
+				"/docs/notes.txt": "Some notes",
+				"/docs/empty.txt": "",
+			}
+			for path, content := range files {
+				file, err := fs.Create(path)
+				if err != nil {
+					t.Fatalf("Create(%q) failed: %v", path, err)
+				}
+				file.Write([]byte(content))
+				file.Close()
+			}
+
+			// Persist random-mode metadata so it appears in the base listing
+			if r, ok := fs.filenameEncryptor.(*randomFilenameEncryptor); ok {
+				if err := r.metadata.Save(base, config.MetadataPath); err != nil {
+					t.Fatalf("Save metadata failed: %v", err)
+				}
+			}
+
+			entries, err := fs.ReadDir("/docs")
+			if err != nil {
+				t.Fatalf("ReadDir failed: %v", err)
+			}
+
+			want := []string{"archive", "empty.txt", "notes.txt", "readme.md"}
+			var got []string
+			for _, entry := range entries {
+				got = append(got, entry.Name())
+			}
+			if !sort.StringsAreSorted(got) || len(got) != len(want) {
+				t.Fatalf("ReadDir names: got %v, want %v", got, want)
+			}
+			for i := range want {
+				if got[i] != want[i] {
+					t.Fatalf("ReadDir names: got %v, want %v", got, want)
+				}
+			}
+
+			for _, entry := range entries {
+				info, err := entry.Info()
+				if err != nil {
+					t.Fatalf("Info(%q) failed: %v", entry.Name(), err)
+				}
+				if info.Name() != entry.Name() {
+					t.Errorf("Info name mismatch: got %q, want %q", info.Name(), entry.Name())
+				}
+				if entry.Name() == "archive" {
+					if !entry.IsDir() || !info.IsDir() {
+						t.Errorf("archive should be a directory")
+					}
+					continue
+				}
+				want := int64(len(files["/docs/"+entry.Name()]))
+				if info.Size() != want {
+					t.Errorf("Size of %q: got %d, want %d", entry.Name(), info.Size(), want)
+				}
+			}
+
+			// The metadata database must not show up in the root listing
+			root, err := fs.ReadDir("/")
+			if err != nil {
+				t.Fatalf("ReadDir(/) failed: %v", err)
+			}
+			if len(root) != 1 || root[0].Name() != "docs" {
+				var names []string
+				for _, entry := range root {
+					names = append(names, entry.Name())
+				}
+				t.Errorf("ReadDir(/): got %v, want [docs]", names)
+			}
+		})
+	}
+}
+
+func TestOpenFile_Directory(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    FilenameEncryption
+		flatten bool
+	}{
+		{"none", FilenameEncryptionNone, false},
+		{"deterministic", FilenameEncryptionDeterministic, false},
+		{"random", FilenameEncryptionRandom, false},
+		{"flat", FilenameEncryptionRandom, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs, _ := newXattrTestFS(t, tt.mode, tt.flatten)
+
+			if err := fs.MkdirAll("/docs/archive", 0755); err != nil {
+				t.Fatalf("MkdirAll failed: %v", err)
+			}
+			for _, name := range []string{"/docs/b.txt", "/docs/a.txt"} {
+				file, err := fs.Create(name)
+				if err != nil {
+					t.Fatalf("Create(%q) failed: %v", name, err)
+				}
+				file.Write([]byte("content"))
+				file.Close()
+			}
+
+			dir, err := fs.Open("/docs")
+			if err != nil {
+				t.Fatalf("Open(/docs) failed: %v", err)
+			}
+			defer dir.Close()
+
+			info, err := dir.Stat()
+			if err != nil || !info.IsDir() {
+				t.Errorf("Stat = %v, %v, want a directory", info, err)
+			}
+
+			if _, err := dir.Read(make([]byte, 16)); !errors.Is(err, errIsDir) {
+				t.Errorf("Read error = %v, want errIsDir", err)
+			}
+			if _, err := dir.Write([]byte("x")); !errors.Is(err, errIsDir) {
+				t.Errorf("Write error = %v, want errIsDir", err)
+			}
+
+			names, err := dir.Readdirnames(-1)
+			if err != nil {
+				t.Fatalf("Readdirnames failed: %v", err)
+			}
+			want := []string{"a.txt", "archive", "b.txt"}
+			if !reflect.DeepEqual(names, want) {
+				t.Errorf("Readdirnames = %v, want %v", names, want)
+			}
+
+			// Rewinding lists the entries again, in batches this time
+			if _, err := dir.Seek(0, io.SeekStart); err != nil {
+				t.Fatalf("Seek failed: %v", err)
+			}
+			var infos []os.FileInfo
+			for {
+				batch, err := dir.Readdir(2)
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("Readdir failed: %v", err)
+				}
+				infos = append(infos, batch...)
+			}
+			if len(infos) != len(want) {
+				t.Fatalf("Readdir returned %d entries, want %d", len(infos), len(want))
+			}
+			for i, info := range infos {
+				if info.Name() != want[i] {
+					t.Errorf("Readdir[%d] name = %q, want %q", i, info.Name(), want[i])
+				}
+				if info.Name() == "a.txt" && info.Size() != int64(len("content")) {
+					t.Errorf("Readdir size of a.txt = %d, want %d", info.Size(), len("content"))
+				}
+			}
+
+			if _, err := fs.OpenFile("/docs", os.O_RDWR, 0); err == nil {
+				t.Errorf("OpenFile(/docs, O_RDWR) succeeded, want an error")
+			}
+		})
+	}
+}
+
+// readdirRecordingFS records the counts passed to Readdir on the files it
+// opens, so tests can check that a listing was read in bounded batches
+type readdirRecordingFS struct {
+	absfs.FileSystem
+	largest   int
+	unbounded bool
+}
+
+func (f *readdirRecordingFS) Open(name string) (absfs.File, error) {
+	file, err := f.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &readdirRecordingFile{File: file, fs: f}, nil
+}
+
+type readdirRecordingFile struct {
+	absfs.File
+	fs *readdirRecordingFS
+}
+
+func (f *readdirRecordingFile) Readdir(n int) ([]os.FileInfo, error) {
+	f.fs.unbounded = f.fs.unbounded || n <= 0
+	f.fs.largest = max(f.fs.largest, n)
+	return f.File.Readdir(n)
+}
+
+func TestReadDirStream(t *testing.T) {
+	mem, err := memfs.NewFS()
+	if err != nil {
+		t.Fatalf("Failed to create memfs: %v", err)
+	}
+	base := &readdirRecordingFS{FileSystem: mem}
+
+	fs, err := New(base, &Config{
+		Cipher:             CipherAES256GCM,
+		FilenameEncryption: FilenameEncryptionDeterministic,
+		KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+			Memory:      64 * 1024,
+			Iterations:  1,
+			Parallelism: 2,
+		}),
+	})
+	if err != nil {
+		t.Fatalf("Failed to create EncryptFS: %v", err)
+	}
+	defer fs.Close()
+
+	// Many entries, created directly on the base since only names matter
+	const count = 5 * readDirStreamBatch
+	if err := fs.Mkdir("/big", 0755); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+	want := make(map[string]bool, count)
+	for i := 0; i < count; i++ {
+		name := fmt.Sprintf("/big/file-%04d.txt", i)
+		encrypted, err := fs.translatePath(name)
+		if err != nil {
+			t.Fatalf("translatePath failed: %v", err)
+		}
+		file, err := mem.Create(encrypted)
+		if err != nil {
+			t.Fatalf("Create on base failed: %v", err)
+		}
+		file.Close()
+		want[name[len("/big/"):]] = true
+	}
+
+	next, cancel := fs.ReadDirStream("/big")
+	defer cancel()
+	var listed int
+	for {
+		entry, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("next failed after %d entries: %v", listed, err)
+		}
+		if !want[entry.Name()] {
+			t.Errorf("unexpected or repeated entry %q", entry.Name())
+		}
+		delete(want, entry.Name())
+		listed++
+	}
+	if len(want) != 0 {
+		t.Errorf("%d entries were not listed", len(want))
+	}
+	if base.unbounded || base.largest > readDirStreamBatch {
+		t.Errorf("base directory read with unbounded=%v, largest batch %d; want batches of at most %d",
+			base.unbounded, base.largest, readDirStreamBatch)
+	}
+	if _, err := next(); err != io.EOF {
+		t.Errorf("next after the end: got %v, want io.EOF", err)
+	}
+
+	// Cancelling stops the listing early
+	next, cancel = fs.ReadDirStream("/big")
+	for i := 0; i < 10; i++ {
+		if _, err := next(); err != nil {
+			t.Fatalf("next failed: %v", err)
+		}
+	}
+	cancel()
+	if _, err := next(); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("next after cancel: got %v, want os.ErrClosed", err)
+	}
+
+	// A missing directory is reported by next
+	next, cancel = fs.ReadDirStream("/missing")
+	defer cancel()
+	if _, err := next(); !os.IsNotExist(err) {
+		t.Errorf("next on a missing directory: got %v, want not exist", err)
+	}
+}
@@ -0,0 +1,192 @@
+package encryptfs
+
+import (
+	"fmt"
+	"io"
+)
+
+// decryptReadSeeker is the io.ReadSeeker returned by NewDecryptReadSeeker.
+// It keeps the most recently decrypted chunk, so sequential reads decrypt
+// each chunk once.
+type decryptReadSeeker struct {
+	rs        io.ReadSeeker
+	index     *ChunkIndexHeader
+	engine    CipherEngine
+	sealer    *chunkSealer
+	nonceSize int
+	size      int64 // Plaintext size
+	position  int64
+
+	chunkIdx uint32 // Index of the chunk in chunk, if it is set
+	chunk    []byte
+}
+
+// NewDecryptReadSeeker returns an io.ReadSeeker over the plaintext of an
+// encrypted file in the chunked format, read from rs, such as a file opened
+// on the base filesystem or an object in remote storage. A seek to any
+// plaintext offset decrypts only the chunk holding it, which suits serving
+// byte ranges of large files. The key is derived from config.KeyProvider and
+// the file header; files written with Config.SharedSalt are not supported,
+// since their keys derive from the filesystem keyfile.
+//
+// A file in the traditional format yields an error wrapping ErrNotChunked.
+// Chunks that fail to decrypt are reported by Read as a CorruptionError.
+func NewDecryptReadSeeker(rs io.ReadSeeker, config *Config) (io.ReadSeeker, error) {
+	if config == nil {
+		return nil, ErrNilConfig
+	}
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+
+	if _, err := rs.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to seek to start: %w", err)
+	}
+	header := &FileHeader{}
+	if _, err := header.ReadFrom(rs); err != nil {
+		return nil, fmt.Errorf("failed to read header: %w", err)
+	}
+	if err := header.Validate(); err != nil {
+		return nil, err
+	}
+	if header.Version >= headerFlagsVersion && header.Flags&FlagChunked == 0 {
+		return nil, ErrNotChunked
+	}
+	if header.Flags&FlagSharedSalt != 0 {
+		return nil, fmt.Errorf("file key derives from a shared salt, which requires the filesystem keyfile")
+	}
+
+	index := header.newChunkIndex(0)
+	if _, err := index.ReadFrom(rs); err != nil {
+		return nil, fmt.Errorf("failed to read chunk index: %w", err)
+	}
+	if err := ValidateChunkSize(index.ChunkSize); err != nil {
+		return nil, NewCorruptionError("", fmt.Sprintf("invalid chunk index: %v", err))
+	}
+
+	// Every chunk but the last is full, so a plaintext offset locates its
+	// chunk directly
+	var size int64
+	for i, chunkSize := range index.PlaintextSizes {
+		last := i == len(index.PlaintextSizes)-1
+		if chunkSize > index.ChunkSize || (!last && chunkSize != index.ChunkSize) {
+			return nil, &CorruptionError{
+				ChunkIdx: uint32(i),
+				Message:  fmt.Sprintf("chunk size %d does not fit chunk size %d", chunkSize, index.ChunkSize),
+			}
+		}
+		size += int64(chunkSize)
+	}
+
+	key, err := unwrapKey(deriveKeyForHeader(keyProviderFor(config.KeyProvider, header), header))
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive key: %w", err)
+	}
+	defer clear(key)
+	if err := header.openFormat(key); err != nil {
+		return nil, decryptError("", "failed to authenticate header", err)
+	}
+	engine, err := NewCipherEngine(header.Cipher, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher engine: %w", err)
+	}
+	nonceSize, err := chunkNonceSize(header, engine)
+	if err != nil {
+		return nil, err
+	}
+
+	return &decryptReadSeeker{
+		rs:        rs,
+		index:     index,
+		engine:    engine,
+		sealer:    newChunkSealer(header, key, NewCipherEngine),
+		nonceSize: nonceSize,
+		size:      size,
+	}, nil
+}
+
+// Read reads plaintext from the current position, decrypting chunks as
+// they are reached
+func (d *decryptReadSeeker) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if d.position >= d.size {
+		return 0, io.EOF
+	}
+
+	var n int
+	for n < len(p) && d.position < d.size {
+		chunkIdx := uint32(d.position / int64(d.index.ChunkSize))
+		if err := d.load(chunkIdx); err != nil {
+			return n, err
+		}
+		copied := copy(p[n:], d.chunk[d.position%int64(d.index.ChunkSize):])
+		n += copied
+		d.position += int64(copied)
+	}
+	return n, nil
+}
+
+// load decrypts a chunk into d.chunk, unless it is already there
+func (d *decryptReadSeeker) load(chunkIdx uint32) error {
+	if d.chunk != nil && d.chunkIdx == chunkIdx {
+		return nil
+	}
+
+	offset, plaintextSize, err := d.index.GetChunkInfo(chunkIdx)
+	if err != nil {
+		return err
+	}
+	if _, err := d.rs.Seek(int64(offset), io.SeekStart); err != nil {
+		return NewIOError("seek", "", err)
+	}
+
+	chunkHeader := &EncryptedChunkHeader{}
+	if _, err := chunkHeader.readWithNonceSize(d.rs, d.nonceSize); err != nil {
+		return readChunkError("", chunkIdx, err)
+	}
+	if chunkHeader.PlaintextSize != plaintextSize {
+		return &CorruptionError{
+			ChunkIdx: chunkIdx,
+			Message:  fmt.Sprintf("chunk header size %d does not match index size %d", chunkHeader.PlaintextSize, plaintextSize),
+		}
+	}
+	ciphertext := make([]byte, int(plaintextSize)+d.engine.Overhead())
+	if _, err := io.ReadFull(d.rs, ciphertext); err != nil {
+		return readChunkError("", chunkIdx, err)
+	}
+
+	plaintext, err := d.sealer.open(d.engine, chunkHeader.Nonce, chunkIdx, chunkIdx+1 >= d.index.ChunkCount, ciphertext)
+	if err != nil {
+		return &CorruptionError{
+			ChunkIdx: chunkIdx,
+			Message:  fmt.Sprintf("failed to decrypt chunk: %v", err),
+			Err:      decryptError("", "failed to decrypt chunk", err),
+		}
+	}
+	d.chunk = plaintext
+	d.chunkIdx = chunkIdx
+	return nil
+}
+
+// Seek sets the plaintext offset of the next Read. Seeking past the end is
+// allowed; reads there return io.EOF.
+func (d *decryptReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	var position int64
+	switch whence {
+	case io.SeekStart:
+		position = offset
+	case io.SeekCurrent:
+		position = d.position + offset
+	case io.SeekEnd:
+		position = d.size + offset
+	default:
+		return 0, fmt.Errorf("invalid whence: %d", whence)
+	}
+	if position < 0 {
+		return 0, fmt.Errorf("negative position: %d", position)
+	}
+	d.position = position
+	return position, nil
+}
@@ -0,0 +1,122 @@
+package encryptfs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	mathrand "math/rand"
+	"testing"
+
+	"github.com/absfs/memfs"
+)
+
+func TestDecryptReadSeeker(t *testing.T) {
+	base, err := memfs.NewFS()
+	if err != nil {
+		t.Fatalf("Failed to create memfs: %v", err)
+	}
+	password := func(p string) KeyProvider {
+		return NewPasswordKeyProvider([]byte(p), Argon2idParams{
+			Memory:      64 * 1024,
+			Iterations:  1,
+			Parallelism: 2,
+		})
+	}
+
+	const chunkSize = 4 * 1024
+	fs, err := New(base, &Config{
+		Cipher:      CipherChaCha20Poly1305,
+		KeyProvider: password("test-password"),
+		ChunkSize:   chunkSize,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create EncryptFS: %v", err)
+	}
+	defer fs.Close()
+
+	plaintext := make([]byte, 10*chunkSize+123)
+	rng := mathrand.New(mathrand.NewSource(1))
+	rng.Read(plaintext)
+	file, err := fs.Create("/video.bin")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	file.Write(plaintext)
+	if err := file.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	raw, err := base.Open("/video.bin")
+	if err != nil {
+		t.Fatalf("Open on base failed: %v", err)
+	}
+	defer raw.Close()
+	rs, err := NewDecryptReadSeeker(raw, &Config{KeyProvider: password("test-password")})
+	if err != nil {
+		t.Fatalf("NewDecryptReadSeeker failed: %v", err)
+	}
+
+	// Random ranges, including ones spanning chunks and reaching the end
+	for i := 0; i < 200; i++ {
+		off := rng.Intn(len(plaintext))
+		n := rng.Intn(3 * chunkSize)
+		if off+n > len(plaintext) {
+			n = len(plaintext) - off
+		}
+		if pos, err := rs.Seek(int64(off), io.SeekStart); err != nil || pos != int64(off) {
+			t.Fatalf("Seek(%d) = %d, %v", off, pos, err)
+		}
+		got := make([]byte, n)
+		if _, err := io.ReadFull(rs, got); err != nil {
+			t.Fatalf("reading %d bytes at %d failed: %v", n, off, err)
+		}
+		if !bytes.Equal(got, plaintext[off:off+n]) {
+			t.Fatalf("bytes %d to %d do not match the plaintext", off, off+n)
+		}
+	}
+
+	// Seeking relative to the end, and reading past it
+	if pos, err := rs.Seek(-10, io.SeekEnd); err != nil || pos != int64(len(plaintext)-10) {
+		t.Fatalf("Seek(-10, end) = %d, %v", pos, err)
+	}
+	rest, err := io.ReadAll(rs)
+	if err != nil || !bytes.Equal(rest, plaintext[len(plaintext)-10:]) {
+		t.Errorf("ReadAll at the end = %d bytes, %v", len(rest), err)
+	}
+	if n, err := rs.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Errorf("Read past the end = %d, %v, want 0, io.EOF", n, err)
+	}
+	if _, err := rs.Seek(-1, io.SeekStart); err == nil {
+		t.Error("Seek to a negative position succeeded")
+	}
+
+	// A wrong password fails to decrypt
+	wrong, err := NewDecryptReadSeeker(raw, &Config{KeyProvider: password("wrong-password")})
+	if err != nil {
+		t.Fatalf("NewDecryptReadSeeker failed: %v", err)
+	}
+	if _, err := wrong.Read(make([]byte, 10)); !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("Read with the wrong password: got %v, want ErrAuthFailed", err)
+	}
+
+	// Traditional files are rejected
+	traditional, err := New(base, &Config{KeyProvider: password("test-password")})
+	if err != nil {
+		t.Fatalf("Failed to create EncryptFS: %v", err)
+	}
+	defer traditional.Close()
+	file, err = traditional.Create("/small.txt")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	file.Write([]byte("small"))
+	file.Close()
+	small, err := base.Open("/small.txt")
+	if err != nil {
+		t.Fatalf("Open on base failed: %v", err)
+	}
+	defer small.Close()
+	if _, err := NewDecryptReadSeeker(small, &Config{KeyProvider: password("test-password")}); !errors.Is(err, ErrNotChunked) {
+		t.Errorf("NewDecryptReadSeeker on a traditional file: got %v, want ErrNotChunked", err)
+	}
+}
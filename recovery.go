@@ -0,0 +1,109 @@
+package encryptfs
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// recoveryWrapInfo is the HKDF info string that derives the key wrapping
+// file keys from Config.RecoveryKey
+var recoveryWrapInfo = []byte("encryptfs recovery key wrap")
+
+// RecoveryKeyProvider reads files through the copy of their key wrapped
+// under Config.RecoveryKey, for break-glass access when the password that
+// wrote them is lost. It cannot create keys, so files can be read but not
+// written, and it must be used without filename encryption or SharedSalt,
+// whose keys derive from the password. It can also be combined with the
+// password provider in a MultiKeyProvider.
+type RecoveryKeyProvider struct {
+	key []byte
+}
+
+// NewRecoveryKeyProvider creates a key provider from the recovery key given
+// as Config.RecoveryKey when the files were written. The key is copied.
+func NewRecoveryKeyProvider(recoveryKey []byte) (*RecoveryKeyProvider, error) {
+	if len(recoveryKey) < MinRawKeySize {
+		return nil, &ValidationError{
+			Field:   "recoveryKey",
+			Value:   len(recoveryKey),
+			Message: fmt.Sprintf("recovery key must be at least %d bytes, got %d", MinRawKeySize, len(recoveryKey)),
+		}
+	}
+
+	return &RecoveryKeyProvider{key: append([]byte(nil), recoveryKey...)}, nil
+}
+
+// DeriveKey fails with ErrNoRecoveryKey: a file key can only be unwrapped
+// from the header of the file
+func (r *RecoveryKeyProvider) DeriveKey(salt []byte) (*SecretKey, error) {
+	return nil, ErrNoRecoveryKey
+}
+
+// GenerateSalt fails with ErrNoRecoveryKey, since new files need a key the
+// provider cannot create
+func (r *RecoveryKeyProvider) GenerateSalt() ([]byte, error) {
+	return nil, ErrNoRecoveryKey
+}
+
+// unwrap recovers the key of the file with the given header from its
+// wrapped copy. A wrong recovery key or a tampered copy fails with
+// ErrAuthFailed.
+func (r *RecoveryKeyProvider) unwrap(header *FileHeader) (*SecretKey, error) {
+	if header.Flags&FlagRecoveryKey == 0 {
+		return nil, ErrNoRecoveryKey
+	}
+
+	engine, err := newRecoveryEngine(r.key)
+	if err != nil {
+		return nil, err
+	}
+	nonceSize := engine.NonceSize()
+	if len(header.WrappedKey) < nonceSize {
+		return nil, fmt.Errorf("wrapped key too short: %d bytes", len(header.WrappedKey))
+	}
+	key, err := engine.DecryptWithAAD(header.WrappedKey[:nonceSize], header.WrappedKey[nonceSize:], header.Salt)
+	if err != nil {
+		return nil, err
+	}
+	return NewSecretKey(key), nil
+}
+
+// wrapRecoveryKey records a copy of a new file's key, wrapped under
+// Config.RecoveryKey, in its header. Nothing is recorded without a recovery
+// key. The wrapped key is bound to the header's salt, so it cannot be
+// moved to another file.
+func (e *EncryptFS) wrapRecoveryKey(header *FileHeader, key []byte) error {
+	if len(e.config.RecoveryKey) == 0 {
+		return nil
+	}
+
+	engine, err := newRecoveryEngine(e.config.RecoveryKey)
+	if err != nil {
+		return err
+	}
+	nonce, err := generateNonceFrom(e.random, CipherAES256GCM)
+	if err != nil {
+		return err
+	}
+	wrapped, err := engine.EncryptWithAAD(nonce, key, header.Salt)
+	if err != nil {
+		return fmt.Errorf("failed to wrap recovery key: %w", err)
+	}
+	header.setWrappedKey(append(nonce, wrapped...))
+	return nil
+}
+
+// newRecoveryEngine returns the AES-256-GCM engine that wraps file keys
+// under a recovery key, keyed by HKDF-SHA256 so that the recovery key
+// itself is never used directly
+func newRecoveryEngine(recoveryKey []byte) (*AESGCMEngine, error) {
+	key := make([]byte, 32)
+	defer clear(key)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, recoveryKey, nil, recoveryWrapInfo), key); err != nil {
+		return nil, fmt.Errorf("failed to expand recovery key: %w", err)
+	}
+	return NewAESGCMEngine(key)
+}
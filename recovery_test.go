@@ -0,0 +1,132 @@
+package encryptfs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestRecoveryKey(t *testing.T) {
+	base, cleanup := setupTestFS(t)
+	defer cleanup()
+
+	recoveryKey := bytes.Repeat([]byte{0x5a}, 32)
+	password := NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+		Memory:      64 * 1024,
+		Iterations:  1,
+		Parallelism: 2,
+	})
+
+	// Traditional and chunked files written with a recovery key
+	tree := map[string][]byte{
+		"/small.txt":       []byte("small file"),
+		"/empty.txt":       {},
+		"/chunked/big.bin": bytes.Repeat([]byte("recover me "), 5000),
+	}
+	for _, chunkSize := range []int{0, 4 * 1024} {
+		fs, err := New(base, &Config{
+			Cipher:      CipherAES256GCM,
+			KeyProvider: password,
+			RecoveryKey: recoveryKey,
+			ChunkSize:   chunkSize,
+		})
+		if err != nil {
+			t.Fatalf("failed to create EncryptFS: %v", err)
+		}
+		for name, data := range tree {
+			if (chunkSize > 0) != (name == "/chunked/big.bin") {
+				continue
+			}
+			file, err := fs.Create(name)
+			if err != nil {
+				t.Fatalf("failed to create %s: %v", name, err)
+			}
+			file.Write(data)
+			if err := file.Close(); err != nil {
+				t.Fatalf("failed to close %s: %v", name, err)
+			}
+		}
+		fs.Close()
+	}
+	if header := readTestHeader(t, base, "/chunked/big.bin"); header.Flags&FlagRecoveryKey == 0 || header.Flags&FlagChunked == 0 {
+		t.Errorf("chunked file flags = %#x, want chunked with a recovery key", uint8(header.Flags))
+	}
+
+	// A file written without a recovery key
+	fs, err := New(base, &Config{Cipher: CipherAES256GCM, KeyProvider: password})
+	if err != nil {
+		t.Fatalf("failed to create EncryptFS: %v", err)
+	}
+	file, err := fs.Create("/unrecoverable.txt")
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	file.Write([]byte("password only"))
+	file.Close()
+	fs.Close()
+
+	// The recovery key alone reads the files back
+	recovery, err := NewRecoveryKeyProvider(recoveryKey)
+	if err != nil {
+		t.Fatalf("NewRecoveryKeyProvider failed: %v", err)
+	}
+	fs, err = New(base, &Config{Cipher: CipherAES256GCM, KeyProvider: recovery})
+	if err != nil {
+		t.Fatalf("failed to create EncryptFS: %v", err)
+	}
+	defer fs.Close()
+	compareTree(t, fs, "/", tree)
+	info, err := fs.Stat("/small.txt")
+	if err != nil || info.Size() != int64(len(tree["/small.txt"])) {
+		t.Errorf("Stat = %v, %v, want size %d", info, err, len(tree["/small.txt"]))
+	}
+
+	if _, err := fs.Open("/unrecoverable.txt"); !errors.Is(err, ErrNoRecoveryKey) {
+		t.Errorf("opening a file without a recovery copy: got %v, want ErrNoRecoveryKey", err)
+	}
+	if _, err := fs.Create("/new.txt"); !errors.Is(err, ErrNoRecoveryKey) {
+		t.Errorf("creating a file with the recovery key: got %v, want ErrNoRecoveryKey", err)
+	}
+
+	// A wrong recovery key is rejected
+	wrong, err := NewRecoveryKeyProvider(bytes.Repeat([]byte{0xa5}, 32))
+	if err != nil {
+		t.Fatalf("NewRecoveryKeyProvider failed: %v", err)
+	}
+	wrongFS, err := New(base, &Config{Cipher: CipherAES256GCM, KeyProvider: wrong})
+	if err != nil {
+		t.Fatalf("failed to create EncryptFS: %v", err)
+	}
+	defer wrongFS.Close()
+	if file, err := wrongFS.Open("/small.txt"); err == nil {
+		_, err = io.ReadAll(file)
+		file.Close()
+		if !errors.Is(err, ErrAuthFailed) {
+			t.Errorf("reading with the wrong recovery key: got %v, want ErrAuthFailed", err)
+		}
+	} else if !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("opening with the wrong recovery key: got %v, want ErrAuthFailed", err)
+	}
+
+	// The password still works alongside the recovery key
+	fs, err = New(base, &Config{Cipher: CipherAES256GCM, KeyProvider: password})
+	if err != nil {
+		t.Fatalf("failed to create EncryptFS: %v", err)
+	}
+	defer fs.Close()
+	compareTree(t, fs, "/", tree)
+}
+
+func TestRecoveryKey_Validation(t *testing.T) {
+	if _, err := NewRecoveryKeyProvider(make([]byte, 16)); !IsValidationError(err) {
+		t.Errorf("NewRecoveryKeyProvider with a 16-byte key: got %v, want a validation error", err)
+	}
+	config := &Config{
+		KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{}),
+		RecoveryKey: make([]byte, 16),
+	}
+	if err := config.Validate(); err == nil {
+		t.Error("Validate accepted a 16-byte recovery key")
+	}
+}
@@ -0,0 +1,83 @@
+package encryptfs
+
+import (
+	"errors"
+	"time"
+)
+
+// RetryPolicy controls how base filesystem I/O that fails with a transient
+// error is retried, for base filesystems backed by a network such as S3 or
+// SFTP adapters. Retries cover the steps that load and flush file contents,
+// each of which seeks to an absolute offset first, so a repeated attempt
+// reads or rewrites the same bytes.
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts per step, including the first.
+	// Zero or one disables retries.
+	MaxAttempts int
+
+	// Backoff is the delay before the first retry. It doubles before each
+	// further retry, up to MaxBackoff.
+	Backoff time.Duration
+
+	// MaxBackoff is the longest delay between two attempts. Zero uses
+	// DefaultMaxBackoff.
+	MaxBackoff time.Duration
+
+	// IsTransient reports whether an error is worth retrying. Errors are
+	// wrapped with context by the time they reach it, so it should use
+	// errors.Is or errors.As. If nil, no error is retried.
+	IsTransient func(error) bool
+}
+
+// DefaultMaxBackoff is the longest delay between two attempts when
+// RetryPolicy.MaxBackoff is zero
+const DefaultMaxBackoff = 10 * time.Second
+
+// Validate checks if the retry policy is valid
+func (p RetryPolicy) Validate() error {
+	if p.MaxAttempts < 0 {
+		return errors.New("retry max attempts cannot be negative")
+	}
+	if p.Backoff < 0 {
+		return errors.New("retry backoff cannot be negative")
+	}
+	if p.MaxBackoff < 0 {
+		return errors.New("retry max backoff cannot be negative")
+	}
+	return nil
+}
+
+// delay returns the delay before the given retry, counting from one
+func (p RetryPolicy) delay(retry int) time.Duration {
+	maxBackoff := p.MaxBackoff
+	if maxBackoff == 0 {
+		maxBackoff = DefaultMaxBackoff
+	}
+	backoff := p.Backoff
+	for i := 1; i < retry && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxBackoff {
+		return maxBackoff
+	}
+	return backoff
+}
+
+// retry runs fn, running it again while it fails with an error the retry
+// policy classifies as transient and attempts remain
+func (e *EncryptFS) retry(fn func() error) error {
+	policy := e.config.RetryPolicy
+
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= policy.MaxAttempts ||
+			policy.IsTransient == nil || !policy.IsTransient(err) {
+			return err
+		}
+
+		e.config.logger().Debugf("encryptfs: retrying after transient error (attempt %d of %d): %v", attempt+1, policy.MaxAttempts, err)
+		if delay := policy.delay(attempt); delay > 0 {
+			time.Sleep(delay)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package encryptfs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+var errTransient = errors.New("transient failure")
+
+func TestRetryPolicy(t *testing.T) {
+	retryTransient := RetryPolicy{
+		MaxAttempts: 3,
+		Backoff:     time.Millisecond,
+		IsTransient: func(err error) bool { return errors.Is(err, errTransient) },
+	}
+
+	tests := []struct {
+		name    string
+		policy  RetryPolicy
+		succeed bool
+	}{
+		{"retried", retryTransient, true},
+		{"no retries", RetryPolicy{}, false},
+		{"not transient", RetryPolicy{MaxAttempts: 3, IsTransient: func(error) bool { return false }}, false},
+	}
+
+	for _, chunkSize := range []int{0, 4 * 1024} {
+		for _, tt := range tests {
+			name := tt.name + "/traditional"
+			if chunkSize > 0 {
+				name = tt.name + "/chunked"
+			}
+			t.Run(name, func(t *testing.T) {
+				flaky := newFakeFS()
+				logger := &recordingLogger{}
+				fs, err := New(flaky, &Config{
+					Cipher: CipherAES256GCM,
+					KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+						Memory:      64 * 1024,
+						Iterations:  1,
+						Parallelism: 2,
+					}),
+					ChunkSize:   chunkSize,
+					RetryPolicy: tt.policy,
+					Logger:      logger,
+				})
+				if err != nil {
+					t.Fatalf("failed to create EncryptFS: %v", err)
+				}
+
+				data := bytes.Repeat([]byte("flaky network "), 1000)
+				file, err := fs.Create("/remote.txt")
+				if err != nil {
+					t.Fatalf("failed to create file: %v", err)
+				}
+				file.Write(data)
+
+				// The flush fails twice before it succeeds
+				flaky.fail(errTransient, 0, 2, "read", "write", "seek")
+				err = file.Close()
+				if !tt.succeed {
+					if !errors.Is(err, errTransient) {
+						t.Errorf("Close error = %v, want the transient error", err)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("Close failed: %v", err)
+				}
+
+				// So does the load
+				flaky.fail(errTransient, 0, 2, "read", "write", "seek")
+				file, err = fs.Open("/remote.txt")
+				if err != nil {
+					t.Fatalf("failed to open file: %v", err)
+				}
+				got, err := io.ReadAll(file)
+				file.Close()
+				if err != nil {
+					t.Fatalf("failed to read file: %v", err)
+				}
+				if !bytes.Equal(got, data) {
+					t.Error("content mismatch after retried I/O")
+				}
+				if n := flaky.pendingFailures(); n != 0 {
+					t.Errorf("%d injected failures never reached, want 0", n)
+				}
+				if len(logger.debug) == 0 {
+					t.Error("retries were not logged")
+				}
+			})
+		}
+	}
+}
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	tests := []struct {
+		policy RetryPolicy
+		want   []time.Duration
+	}{
+		{RetryPolicy{Backoff: time.Second, MaxBackoff: 5 * time.Second},
+			[]time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}},
+		{RetryPolicy{Backoff: 4 * time.Second},
+			[]time.Duration{4 * time.Second, 8 * time.Second, DefaultMaxBackoff, DefaultMaxBackoff}},
+		{RetryPolicy{Backoff: time.Minute, MaxBackoff: time.Second},
+			[]time.Duration{time.Second, time.Second}},
+		{RetryPolicy{}, []time.Duration{0, 0}},
+	}
+	for _, tt := range tests {
+		for i, want := range tt.want {
+			if got := tt.policy.delay(i + 1); got != want {
+				t.Errorf("%+v: delay before retry %d = %v, want %v", tt.policy, i+1, got, want)
+			}
+		}
+	}
+
+	// Many retries never overflow the delay
+	if got := (RetryPolicy{Backoff: time.Hour, MaxBackoff: 24 * time.Hour}).delay(100); got != 24*time.Hour {
+		t.Errorf("delay before retry 100 = %v, want the maximum", got)
+	}
+	if err := (RetryPolicy{MaxBackoff: -1}).Validate(); err == nil {
+		t.Error("expected error for a negative max backoff")
+	}
+}
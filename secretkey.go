@@ -0,0 +1,72 @@
+package encryptfs
+
+import "fmt"
+
+// SecretKey holds key material. It keeps the bytes out of logs and error
+// messages: every fmt verb prints "<redacted>". Destroy zeroes the bytes
+// once the key is no longer needed.
+//
+// When built with the encryptfs_mlock tag on Unix systems, the key's memory
+// is also locked so that it is not swapped to disk.
+type SecretKey struct {
+	key []byte
+}
+
+// NewSecretKey wraps key in a SecretKey. The SecretKey takes ownership of
+// the slice, which the caller must not use afterwards.
+func NewSecretKey(key []byte) *SecretKey {
+	lockMemory(key)
+	return &SecretKey{key: key}
+}
+
+// Bytes returns the key material. The slice is shared with the SecretKey
+// and is zeroed by Destroy. It returns nil for a nil or destroyed key.
+func (k *SecretKey) Bytes() []byte {
+	if k == nil {
+		return nil
+	}
+	return k.key
+}
+
+// Len returns the size of the key in bytes
+func (k *SecretKey) Len() int {
+	return len(k.Bytes())
+}
+
+// Destroy zeroes the key material. It is safe to call more than once.
+func (k *SecretKey) Destroy() {
+	if k == nil || k.key == nil {
+		return
+	}
+	clear(k.key)
+	unlockMemory(k.key)
+	k.key = nil
+}
+
+// String never reveals the key. It and the other formatting methods have
+// value receivers, so a dereferenced SecretKey is redacted too.
+func (k SecretKey) String() string {
+	return "<redacted>"
+}
+
+// GoString never reveals the key
+func (k SecretKey) GoString() string {
+	return "<redacted>"
+}
+
+// Format prints "<redacted>" for every verb, including those such as %d
+// and %x that would otherwise print the underlying bytes
+func (k SecretKey) Format(f fmt.State, verb rune) {
+	f.Write([]byte("<redacted>"))
+}
+
+// unwrapKey copies a derived key into a plain slice and destroys the
+// SecretKey, for internal code that zeroes its own key buffers. It passes
+// through errors, so it can wrap a derivation call directly.
+func unwrapKey(secret *SecretKey, err error) ([]byte, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer secret.Destroy()
+	return append([]byte(nil), secret.Bytes()...), nil
+}
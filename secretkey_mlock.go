@@ -0,0 +1,21 @@
+//go:build encryptfs_mlock && (linux || darwin || freebsd || netbsd || openbsd)
+
+package encryptfs
+
+import "syscall"
+
+// lockMemory locks the pages holding key into memory so that they are never
+// swapped to disk. Locking is best effort: it fails if the process exceeds
+// its locked memory limit, and the key is then used unlocked.
+func lockMemory(key []byte) {
+	if len(key) > 0 {
+		_ = syscall.Mlock(key)
+	}
+}
+
+// unlockMemory unlocks pages locked by lockMemory
+func unlockMemory(key []byte) {
+	if len(key) > 0 {
+		_ = syscall.Munlock(key)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !encryptfs_mlock || !(linux || darwin || freebsd || netbsd || openbsd)
+
+package encryptfs
+
+// lockMemory is a no-op without the encryptfs_mlock build tag
+func lockMemory(key []byte) {}
+
+// unlockMemory is a no-op without the encryptfs_mlock build tag
+func unlockMemory(key []byte) {}
@@ -0,0 +1,71 @@
+package encryptfs
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestSecretKey_Redacted(t *testing.T) {
+	provider, err := NewRawKeyProvider(bytes.Repeat([]byte{0x5a}, 32))
+	if err != nil {
+		t.Fatalf("NewRawKeyProvider failed: %v", err)
+	}
+	salt, err := provider.GenerateSalt()
+	if err != nil {
+		t.Fatalf("GenerateSalt failed: %v", err)
+	}
+	key, err := provider.DeriveKey(salt)
+	if err != nil {
+		t.Fatalf("DeriveKey failed: %v", err)
+	}
+	defer key.Destroy()
+
+	raw := key.Bytes()
+	secrets := []string{string(raw), hex.EncodeToString(raw), fmt.Sprint(raw), fmt.Sprintf("%#v", raw)}
+
+	for _, format := range []string{"%v", "%+v", "%#v", "%s", "%q", "%x", "%X", "%d"} {
+		for name, value := range map[string]any{
+			"pointer": key,
+			"value":   *key,
+			"struct":  struct{ Key *SecretKey }{key},
+			"error":   fmt.Errorf("derived %v", key),
+		} {
+			out := fmt.Sprintf(format, value)
+			for _, secret := range secrets {
+				if strings.Contains(out, secret) {
+					t.Errorf("Sprintf(%q, %s) reveals the key: %s", format, name, out)
+				}
+			}
+		}
+	}
+
+	if got := fmt.Sprintf("%v", key); got != "<redacted>" {
+		t.Errorf("Sprintf(%%v): got %q, want <redacted>", got)
+	}
+}
+
+func TestSecretKey_Destroy(t *testing.T) {
+	raw := bytes.Repeat([]byte{0x42}, 32)
+	key := NewSecretKey(raw)
+	if !bytes.Equal(key.Bytes(), bytes.Repeat([]byte{0x42}, 32)) {
+		t.Fatal("Bytes does not return the key")
+	}
+
+	key.Destroy()
+	if !bytes.Equal(raw, make([]byte, 32)) {
+		t.Error("Destroy did not zero the key")
+	}
+	if key.Bytes() != nil || key.Len() != 0 {
+		t.Error("destroyed key still has bytes")
+	}
+	key.Destroy()
+
+	var nilKey *SecretKey
+	nilKey.Destroy()
+	if nilKey.Bytes() != nil {
+		t.Error("nil key has bytes")
+	}
+}
@@ -0,0 +1,97 @@
+package encryptfs
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/absfs/absfs"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// KeyfilePath is the path on the base filesystem of the keyfile that
+	// holds the filesystem salt when Config.SharedSalt is set
+	KeyfilePath = "/.encryptfs-keyfile"
+
+	// fileIDSize is the size of the file ID stored in place of a salt in
+	// the header of files written with a shared salt
+	fileIDSize = 16
+)
+
+// keyfileCheck is encrypted under the master key and stored in the keyfile,
+// so that a wrong password is reported when the filesystem is created
+// rather than when the first file is read
+var keyfileCheck = []byte("encryptfs shared salt keyfile")
+
+// sharedKeyProvider derives file keys from the filesystem master key. Its
+// salts are random file IDs, and a file's key is expanded from the master
+// key and the file ID with HKDF-SHA256, so opening a file costs no password
+// key derivation.
+type sharedKeyProvider struct {
+	masterKey *SecretKey
+}
+
+// GenerateSalt generates a new random file ID
+func (p *sharedKeyProvider) GenerateSalt() ([]byte, error) {
+	return p.generateSaltFrom(rand.Reader)
+}
+
+func (p *sharedKeyProvider) generateSaltFrom(random io.Reader) ([]byte, error) {
+	id := make([]byte, fileIDSize)
+	if _, err := io.ReadFull(random, id); err != nil {
+		return nil, fmt.Errorf("failed to generate file id: %w", err)
+	}
+	return id, nil
+}
+
+// DeriveKey expands the master key into the key of the file with the given ID
+func (p *sharedKeyProvider) DeriveKey(fileID []byte) (*SecretKey, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, p.masterKey.Bytes(), fileID, []byte("encryptfs file key")), key); err != nil {
+		return nil, fmt.Errorf("failed to expand file key: %w", err)
+	}
+	return NewSecretKey(key), nil
+}
+
+// loadSharedMasterKey derives the master key from the salt in the keyfile,
+// creating the keyfile with a new salt if the base filesystem has none. The
+// key is checked against the keyfile, so a wrong password fails with an
+// authentication error.
+func loadSharedMasterKey(base absfs.FileSystem, provider KeyProvider, cipher CipherSuite, random io.Reader) (*SecretKey, error) {
+	masterKey, err := openMarker(base, KeyfilePath, provider, keyfileCheck)
+	if os.IsNotExist(err) {
+		return createMarker(base, KeyfilePath, provider, cipher, keyfileCheck, random)
+	}
+	return masterKey, err
+}
+
+// newFileFlags returns the header flags recorded by every new file
+func (e *EncryptFS) newFileFlags() HeaderFlags {
+	if e.config.SharedSalt {
+		return FlagSharedSalt
+	}
+	return 0
+}
+
+// fileKeyProvider returns the provider that derives the key of an existing
+// file. Files written before SharedSalt was enabled, or re-encrypted by key
+// rotation, carry their own salt and are read with the configured provider.
+// A MultiKeyProvider is narrowed to the provider named by the header's key
+// identifier, if one matches.
+func (e *EncryptFS) fileKeyProvider(header *FileHeader) (KeyProvider, error) {
+	if _, ok := e.config.KeyProvider.(*RecoveryKeyProvider); ok {
+		// Recovery does not depend on how the key was derived
+		return e.config.KeyProvider, nil
+	}
+	shared := header.Flags&FlagSharedSalt != 0
+	if shared == e.config.SharedSalt {
+		return keyProviderFor(e.keyProvider, header), nil
+	}
+	if !shared {
+		return keyProviderFor(e.config.KeyProvider, header), nil
+	}
+	return nil, fmt.Errorf("file key derives from a shared salt, which requires Config.SharedSalt")
+}
@@ -0,0 +1,222 @@
+package encryptfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/absfs/absfs"
+)
+
+func newSharedSaltTestFS(t *testing.T, base absfs.FileSystem, provider KeyProvider, chunkSize int) *EncryptFS {
+	t.Helper()
+
+	fs, err := New(base, &Config{
+		Cipher:       CipherAES256GCM,
+		KeyProvider:  provider,
+		ChunkSize:    chunkSize,
+		SharedSalt:   true,
+		KeyCacheSize: -1,
+	})
+	if err != nil {
+		t.Fatalf("failed to create EncryptFS: %v", err)
+	}
+	return fs
+}
+
+func TestSharedSalt_RoundTrip(t *testing.T) {
+	for _, chunkSize := range []int{0, 4 * 1024} {
+		t.Run(fmt.Sprintf("chunk=%d", chunkSize), func(t *testing.T) {
+			base, cleanup := setupTestFS(t)
+			defer cleanup()
+
+			provider := &countingKeyProvider{KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+				Memory:      64 * 1024,
+				Iterations:  1,
+				Parallelism: 2,
+			})}
+
+			fs := newSharedSaltTestFS(t, base, provider, chunkSize)
+			for i := 0; i < 5; i++ {
+				file, err := fs.Create(fmt.Sprintf("/file-%d.txt", i))
+				if err != nil {
+					t.Fatalf("failed to create file: %v", err)
+				}
+				fmt.Fprintf(file, "contents of file %d", i)
+				file.Close()
+			}
+			fs.Close()
+
+			// A new session derives the master key once, however many
+			// files it opens, even with the key cache disabled
+			fs = newSharedSaltTestFS(t, base, provider, chunkSize)
+			defer fs.Close()
+			for i := 0; i < 5; i++ {
+				file, err := fs.Open(fmt.Sprintf("/file-%d.txt", i))
+				if err != nil {
+					t.Fatalf("failed to open file: %v", err)
+				}
+				got, err := io.ReadAll(file)
+				file.Close()
+				if err != nil {
+					t.Fatalf("failed to read file: %v", err)
+				}
+				if want := fmt.Sprintf("contents of file %d", i); string(got) != want {
+					t.Errorf("content = %q, want %q", got, want)
+				}
+			}
+			if provider.derivations != 2 {
+				t.Errorf("%d password derivations over two sessions, want 2", provider.derivations)
+			}
+
+			// Headers carry a file ID rather than a salt
+			raw, err := readBaseFile(base, "/file-0.txt")
+			if err != nil {
+				t.Fatalf("failed to read base file: %v", err)
+			}
+			header := &FileHeader{}
+			if _, err := header.ReadFrom(bytes.NewReader(raw)); err != nil {
+				t.Fatalf("failed to read header: %v", err)
+			}
+			if header.Flags&FlagSharedSalt == 0 || len(header.Salt) != fileIDSize {
+				t.Errorf("header flags %#x, salt size %d; want FlagSharedSalt and %d", header.Flags, len(header.Salt), fileIDSize)
+			}
+
+			// The keyfile is hidden and reserved
+			entries, err := fs.ReadDir("/")
+			if err != nil {
+				t.Fatalf("ReadDir failed: %v", err)
+			}
+			if len(entries) != 5 {
+				t.Errorf("ReadDir returned %d entries, want 5", len(entries))
+			}
+			if _, err := fs.Create(KeyfilePath); !errors.Is(err, ErrReservedPath) {
+				t.Errorf("Create(KeyfilePath) error = %v, want ErrReservedPath", err)
+			}
+		})
+	}
+}
+
+func TestSharedSalt_WrongPassword(t *testing.T) {
+	base, cleanup := setupTestFS(t)
+	defer cleanup()
+
+	params := Argon2idParams{Memory: 64 * 1024, Iterations: 1, Parallelism: 2}
+	newSharedSaltTestFS(t, base, NewPasswordKeyProvider([]byte("right"), params), 0).Close()
+
+	_, err := New(base, &Config{
+		Cipher:      CipherAES256GCM,
+		KeyProvider: NewPasswordKeyProvider([]byte("wrong"), params),
+		SharedSalt:  true,
+	})
+	if !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("New with wrong password error = %v, want ErrAuthFailed", err)
+	}
+}
+
+func TestSharedSalt_MixedFiles(t *testing.T) {
+	base, cleanup := setupTestFS(t)
+	defer cleanup()
+
+	provider := NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+		Memory:      64 * 1024,
+		Iterations:  1,
+		Parallelism: 2,
+	})
+
+	perFile, err := New(base, &Config{Cipher: CipherAES256GCM, KeyProvider: provider})
+	if err != nil {
+		t.Fatalf("failed to create EncryptFS: %v", err)
+	}
+	shared := newSharedSaltTestFS(t, base, provider, 0)
+
+	write := func(fs *EncryptFS, name string) {
+		t.Helper()
+		file, err := fs.Create(name)
+		if err != nil {
+			t.Fatalf("failed to create %s: %v", name, err)
+		}
+		file.Write([]byte(name))
+		file.Close()
+	}
+	write(perFile, "/old.txt")
+	write(shared, "/new.txt")
+
+	// Files with their own salt stay readable once SharedSalt is enabled
+	for _, name := range []string{"/old.txt", "/new.txt"} {
+		file, err := shared.Open(name)
+		if err != nil {
+			t.Fatalf("failed to open %s: %v", name, err)
+		}
+		got, _ := io.ReadAll(file)
+		file.Close()
+		if string(got) != name {
+			t.Errorf("%s content = %q, want %q", name, got, name)
+		}
+	}
+
+	// Files written with a shared salt need SharedSalt to be read
+	if _, err := perFile.OpenFile("/new.txt", os.O_RDONLY, 0); err == nil {
+		t.Error("opening a shared salt file without SharedSalt succeeded")
+	}
+}
+
+func TestSharedSalt_RotateAllKeys(t *testing.T) {
+	base, cleanup := setupTestFS(t)
+	defer cleanup()
+
+	params := Argon2idParams{Memory: 64 * 1024, Iterations: 1, Parallelism: 2}
+	fs := newSharedSaltTestFS(t, base, NewPasswordKeyProvider([]byte("old"), params), 0)
+	for i := 0; i < 3; i++ {
+		file, err := fs.Create(fmt.Sprintf("/file-%d.txt", i))
+		if err != nil {
+			t.Fatalf("failed to create file: %v", err)
+		}
+		fmt.Fprintf(file, "contents of file %d", i)
+		file.Close()
+	}
+
+	newKey := NewPasswordKeyProvider([]byte("new"), params)
+	if err := fs.RotateAllKeys("/", KeyRotationOptions{NewKeyProvider: newKey}); err != nil {
+		t.Fatalf("RotateAllKeys failed: %v", err)
+	}
+	fs.Close()
+
+	// The keyfile now opens under the new password only
+	_, err := New(base, &Config{
+		Cipher:      CipherAES256GCM,
+		KeyProvider: NewPasswordKeyProvider([]byte("old"), params),
+		SharedSalt:  true,
+	})
+	if !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("New with the old password error = %v, want ErrAuthFailed", err)
+	}
+
+	fs = newSharedSaltTestFS(t, base, newKey, 0)
+	defer fs.Close()
+
+	file, err := fs.Create("/file-3.txt")
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	fmt.Fprintf(file, "contents of file %d", 3)
+	file.Close()
+
+	for i := 0; i < 4; i++ {
+		file, err := fs.Open(fmt.Sprintf("/file-%d.txt", i))
+		if err != nil {
+			t.Fatalf("failed to open file: %v", err)
+		}
+		got, err := io.ReadAll(file)
+		file.Close()
+		if err != nil {
+			t.Fatalf("failed to read file: %v", err)
+		}
+		if want := fmt.Sprintf("contents of file %d", i); string(got) != want {
+			t.Errorf("content = %q, want %q", got, want)
+		}
+	}
+}
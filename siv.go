@@ -22,6 +22,13 @@ type SIVEngine struct {
 	k1    []byte // First half of key for S2V
 	k2    []byte // Second half of key for CTR
 	block cipher.Block
+
+	// CMAC state for S2V, which depends only on k1 and is computed once
+	// rather than for every name encrypted
+	mac     cipher.Block // AES with k1
+	macK1   []byte       // CMAC subkey for complete last blocks
+	macK2   []byte       // CMAC subkey for incomplete last blocks
+	zeroMAC []byte       // CMAC of the zero block, where S2V starts
 }
 
 // NewSIVEngine creates a new AES-SIV cipher engine
@@ -32,20 +39,45 @@ func NewSIVEngine(key []byte) (*SIVEngine, error) {
 	}
 
 	// Split key into two halves
-	k1 := key[:32]
-	k2 := key[32:]
+	return newSIVEngine(key[:32], key[32:])
+}
 
+// newSIVEngine creates an AES-SIV engine from the S2V key k1 and the CTR
+// key k2, which may be of any AES key size. RFC 5297's test vectors use
+// AES-128 halves.
+func newSIVEngine(k1, k2 []byte) (*SIVEngine, error) {
 	// Create AES block cipher with k2 for CTR mode
 	block, err := aes.NewCipher(k2)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create AES cipher: %w", err)
 	}
 
-	return &SIVEngine{
+	// Create AES block cipher with k1 for CMAC
+	mac, err := aes.NewCipher(k1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AES cipher: %w", err)
+	}
+
+	e := &SIVEngine{
 		k1:    k1,
 		k2:    k2,
 		block: block,
-	}, nil
+		mac:   mac,
+	}
+	e.macK1, e.macK2 = generateSubkeys(mac)
+	e.zeroMAC = e.cmac(make([]byte, 16))
+	return e, nil
+}
+
+// destroyKeys zeroes the key halves and CMAC subkeys held by the engine.
+// The AES key schedules belong to crypto/aes and are left to the garbage
+// collector; names encrypted afterwards no longer authenticate.
+func (e *SIVEngine) destroyKeys() {
+	clear(e.k1)
+	clear(e.k2)
+	clear(e.macK1)
+	clear(e.macK2)
+	clear(e.zeroMAC)
 }
 
 // Encrypt encrypts plaintext using AES-SIV
@@ -92,15 +124,12 @@ func (e *SIVEngine) Decrypt(ciphertext []byte, ad ...[]byte) ([]byte, error) {
 
 // s2v implements the S2V (Synthetic IV) algorithm from RFC 5297
 func (e *SIVEngine) s2v(plaintext []byte, ad ...[]byte) []byte {
-	// Create CMAC with k1
-	block, _ := aes.NewCipher(e.k1)
-
 	// D = CMAC(zero_block)
-	d := e.cmac(block, make([]byte, 16))
+	d := e.zeroMAC
 
 	// For each AD[i]: D = dbl(D) xor CMAC(AD[i])
 	for _, a := range ad {
-		d = xor(dbl(d), e.cmac(block, a))
+		d = xor(dbl(d), e.cmac(a))
 	}
 
 	// Handle plaintext
@@ -115,13 +144,12 @@ func (e *SIVEngine) s2v(plaintext []byte, ad ...[]byte) []byte {
 		t = xor(dbl(d), pad(plaintext))
 	}
 
-	return e.cmac(block, t)
+	return e.cmac(t)
 }
 
-// cmac implements CMAC (Cipher-based Message Authentication Code)
-func (e *SIVEngine) cmac(block cipher.Block, data []byte) []byte {
-	// Generate subkeys
-	k1, k2 := generateSubkeys(block)
+// cmac implements CMAC (Cipher-based Message Authentication Code) under k1
+func (e *SIVEngine) cmac(data []byte) []byte {
+	block, k1, k2 := e.mac, e.macK1, e.macK2
 
 	// Process data in 16-byte blocks
 	n := (len(data) + 15) / 16
@@ -3,6 +3,8 @@ package encryptfs
 import (
 	"bytes"
 	"crypto/rand"
+	"encoding/hex"
+	"fmt"
 	"testing"
 )
 
@@ -222,6 +224,180 @@ func TestSIVEngine_ShortCiphertext(t *testing.T) {
 	}
 }
 
+// TestSIVEngine_CMACSubkeys checks the CMAC subkeys NewSIVEngine
+// precomputes, and a CMAC made with them, against RFC 4493, section 4
+func TestSIVEngine_CMACSubkeys(t *testing.T) {
+	key, _ := hex.DecodeString("2b7e151628aed2a6abf7158809cf4f3c")
+	siv, err := newSIVEngine(key, key)
+	if err != nil {
+		t.Fatalf("Failed to create SIV engine: %v", err)
+	}
+	if got := hex.EncodeToString(siv.macK1); got != "fbeed618357133667c85e08f7236a8de" {
+		t.Errorf("CMAC subkey K1 = %s", got)
+	}
+	if got := hex.EncodeToString(siv.macK2); got != "f7ddac306ae266ccf90bc11ee46d513b" {
+		t.Errorf("CMAC subkey K2 = %s", got)
+	}
+	if got := hex.EncodeToString(siv.cmac(nil)); got != "bb1d6929e95937287fa37d129b756746" {
+		t.Errorf("CMAC of the empty message = %s", got)
+	}
+}
+
+func TestSIVEngine_RFC5297(t *testing.T) {
+	decode := func(s string) []byte {
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			t.Fatalf("bad test vector %q: %v", s, err)
+		}
+		return b
+	}
+	tests := []struct {
+		name       string
+		key        string
+		ad         []string // Additional data, with the nonce last
+		plaintext  string
+		ciphertext string
+	}{
+		{
+			name:       "A.1 deterministic",
+			key:        "fffefdfcfbfaf9f8f7f6f5f4f3f2f1f0f0f1f2f3f4f5f6f7f8f9fafbfcfdfeff",
+			ad:         []string{"101112131415161718191a1b1c1d1e1f2021222324252627"},
+			plaintext:  "112233445566778899aabbccddee",
+			ciphertext: "85632d07c6e8f37f950acd320a2ecc9340c02b9690c4dc04daef7f6afe5c",
+		},
+		{
+			name: "A.2 nonce-based",
+			key:  "7f7e7d7c7b7a79787776757473727170404142434445464748494a4b4c4d4e4f",
+			ad: []string{
+				"00112233445566778899aabbccddeeffdeaddadadeaddadaffeeddccbbaa99887766554433221100",
+				"102030405060708090a0",
+				"09f911029d74e35bd84156c5635688c0",
+			},
+			plaintext:  "7468697320697320736f6d6520706c61696e7465787420746f20656e6372797074207573696e67205349562d414553",
+			ciphertext: "7bdb6e3b432667eb06f4d14bff2fbd0fcb900f2fddbe404326601965c889bf17dba77ceb094fa663b7a3f748ba8af829ea64ad544a272e9c485b62a3fd5c0d",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := decode(tt.key)
+			siv, err := newSIVEngine(key[:16], key[16:])
+			if err != nil {
+				t.Fatalf("Failed to create SIV engine: %v", err)
+			}
+			var ad [][]byte
+			for _, a := range tt.ad {
+				ad = append(ad, decode(a))
+			}
+
+			ciphertext, err := siv.Encrypt(decode(tt.plaintext), ad...)
+			if err != nil {
+				t.Fatalf("Encrypt failed: %v", err)
+			}
+			if got := hex.EncodeToString(ciphertext); got != tt.ciphertext {
+				t.Errorf("Encrypt = %s, want %s", got, tt.ciphertext)
+			}
+			plaintext, err := siv.Decrypt(decode(tt.ciphertext), ad...)
+			if err != nil {
+				t.Fatalf("Decrypt failed: %v", err)
+			}
+			if got := hex.EncodeToString(plaintext); got != tt.plaintext {
+				t.Errorf("Decrypt = %s, want %s", got, tt.plaintext)
+			}
+		})
+	}
+}
+
+// TestSIVEngine_RFC5297_S2V checks each step of S2V for the deterministic
+// example of RFC 5297, appendix A.1, so that a fault in dbl, cmac or the
+// handling of additional data shows where it lies
+func TestSIVEngine_RFC5297_S2V(t *testing.T) {
+	decode := func(s string) []byte {
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			t.Fatalf("bad test vector %q: %v", s, err)
+		}
+		return b
+	}
+	key := decode("fffefdfcfbfaf9f8f7f6f5f4f3f2f1f0f0f1f2f3f4f5f6f7f8f9fafbfcfdfeff")
+	siv, err := newSIVEngine(key[:16], key[16:])
+	if err != nil {
+		t.Fatalf("Failed to create SIV engine: %v", err)
+	}
+	ad := decode("101112131415161718191a1b1c1d1e1f2021222324252627")
+	plaintext := decode("112233445566778899aabbccddee")
+
+	steps := []struct {
+		name string
+		got  []byte
+		want string
+	}{
+		{"CMAC(zero)", siv.zeroMAC, "0e04dfafc1efbf040140582859bf073a"},
+		{"dbl(CMAC(zero))", dbl(siv.zeroMAC), "1c09bf5f83df7e080280b050b37e0e74"},
+		{"CMAC(AD)", siv.cmac(ad), "f1f922b7f5193ce64ff80cb47d93f23b"},
+		{"S2V", siv.s2v(plaintext, ad), "85632d07c6e8f37f950acd320a2ecc93"},
+	}
+	for _, step := range steps {
+		if got := hex.EncodeToString(step.got); got != step.want {
+			t.Errorf("%s = %s, want %s", step.name, got, step.want)
+		}
+	}
+
+	// Any change to the SIV, ciphertext or additional data is rejected
+	ciphertext := decode("85632d07c6e8f37f950acd320a2ecc9340c02b9690c4dc04daef7f6afe5c")
+	for _, i := range []int{0, 15, 16, len(ciphertext) - 1} {
+		tampered := bytes.Clone(ciphertext)
+		tampered[i] ^= 0x01
+		if _, err := siv.Decrypt(tampered, ad); err != ErrAuthFailed {
+			t.Errorf("Decrypt with byte %d flipped: got %v, want ErrAuthFailed", i, err)
+		}
+	}
+	if _, err := siv.Decrypt(ciphertext); err != ErrAuthFailed {
+		t.Errorf("Decrypt without the additional data: got %v, want ErrAuthFailed", err)
+	}
+}
+
+// TestSIVEngine_KnownAnswers pins the output of the engine, so that
+// encrypted filenames stay the same from one version to the next
+func TestSIVEngine_KnownAnswers(t *testing.T) {
+	key := make([]byte, 64)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	siv, err := NewSIVEngine(key)
+	if err != nil {
+		t.Fatalf("Failed to create SIV engine: %v", err)
+	}
+
+	tests := []struct {
+		plaintext string
+		withAD    string // Ciphertext with additional data "ad"
+		withoutAD string
+	}{
+		{"", "3db5bcde33d1d9b72935c72e1a4d9fcc", "d4fc53b9c44c2aeea87bfb8c983b136c"},
+		{"a", "5f9987ad5e04aeb296b560dac6764c47b0", "ba092609c39c78a53203bb6c759c7396d9"},
+		{
+			"sixteen-bytes-xx",
+			"826f8a740072235a90830ccc3ad8d5758a3a143208602318e2ed01bc1151ecdf",
+			"9675bed7eeb1944b0fc52a9e91ca9e23b69d2674d4b1e3edd3a69022c6008fdd",
+		},
+		{
+			"benchmark-file.txt",
+			"ff8a053d38640fb18625c22ca8d9f65bb5f0fc7bd6a15e9e4c93ce70f3fa05e95f7d",
+			"53a3c356fc776308e9e96db2aacb509c7dc5aa0df594e776035895f7855433e62d05",
+		},
+	}
+	for _, tt := range tests {
+		withAD, _ := siv.Encrypt([]byte(tt.plaintext), []byte("ad"))
+		if got := hex.EncodeToString(withAD); got != tt.withAD {
+			t.Errorf("Encrypt(%q, \"ad\") = %s, want %s", tt.plaintext, got, tt.withAD)
+		}
+		withoutAD, _ := siv.Encrypt([]byte(tt.plaintext))
+		if got := hex.EncodeToString(withoutAD); got != tt.withoutAD {
+			t.Errorf("Encrypt(%q) = %s, want %s", tt.plaintext, got, tt.withoutAD)
+		}
+	}
+}
+
 func BenchmarkSIVEngine_Encrypt(b *testing.B) {
 	key := make([]byte, 64)
 	rand.Read(key)
@@ -269,3 +445,57 @@ func BenchmarkSIVEngine_Decrypt(b *testing.B) {
 		})
 	}
 }
+
+// FuzzSIVDecrypt decrypts arbitrary ciphertexts, as the filename decryptor
+// does with names read from the base filesystem. Anything but a ciphertext
+// the engine produced must fail authentication without panicking.
+func FuzzSIVDecrypt(f *testing.F) {
+	siv, err := NewSIVEngine(bytes.Repeat([]byte{7}, 64))
+	if err != nil {
+		f.Fatalf("Failed to create SIV engine: %v", err)
+	}
+	for _, plaintext := range []string{"", "a", "report.txt", "exactly-16-bytes", "a rather longer file name.tar.gz"} {
+		ciphertext, _ := siv.Encrypt([]byte(plaintext))
+		f.Add(ciphertext)
+	}
+	f.Add(make([]byte, 15))
+
+	f.Fuzz(func(t *testing.T, ciphertext []byte) {
+		plaintext, err := siv.Decrypt(ciphertext)
+		if err != nil {
+			return
+		}
+		again, err := siv.Encrypt(plaintext)
+		if err != nil || !bytes.Equal(again, ciphertext) {
+			t.Fatalf("accepted ciphertext %x does not re-encrypt to itself", ciphertext)
+		}
+	})
+}
+
+// BenchmarkSIVEngine_CMAC compares CMAC with the subkeys precomputed by
+// NewSIVEngine to deriving them for every message, as each filename once did
+func BenchmarkSIVEngine_CMAC(b *testing.B) {
+	key := make([]byte, 64)
+	rand.Read(key)
+	siv, _ := NewSIVEngine(key)
+	names := make([][]byte, 1000)
+	for i := range names {
+		names[i] = []byte(fmt.Sprintf("document-%04d.txt", i))
+	}
+
+	b.Run("Precomputed", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			siv.cmac(names[i%len(names)])
+		}
+	})
+
+	b.Run("PerCall", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			perCall := *siv
+			perCall.macK1, perCall.macK2 = generateSubkeys(perCall.mac)
+			perCall.cmac(names[i%len(names)])
+		}
+	})
+}
@@ -0,0 +1,103 @@
+package encryptfs
+
+import (
+	"crypto/rand"
+)
+
+// wrappedKeySize is the size of a file key wrapped under a recovery key:
+// the AES-GCM nonce, the 32-byte key and the authentication tag
+const wrappedKeySize = 12 + 32 + 16
+
+// CiphertextSize returns the size on the base filesystem of a file with
+// plaintextSize bytes of content, written in one go by an EncryptFS created
+// with config: the file header, and either the chunk index region and each
+// chunk with its header and tag, or the single, padded ciphertext or STREAM
+// records of a traditional file. Nothing is written.
+//
+// It returns -1 if config is invalid, its key provider cannot write files,
+// or no file of that size can be written, such as a chunked file with more
+// chunks than the index holds.
+func CiphertextSize(plaintextSize int64, config *Config) int64 {
+	if plaintextSize < 0 || config == nil || config.Validate() != nil {
+		return -1
+	}
+
+	cipher := resolveCipher(config.Cipher)
+	nonceSize, err := nonceSizeFor(cipher)
+	if err != nil {
+		return -1
+	}
+	engine, err := NewCipherEngine(cipher, make([]byte, 32))
+	if err != nil {
+		return -1
+	}
+
+	// Build the header a new file gets; only the sizes of its fields matter
+	header := NewFileHeader(cipher, nil, make([]byte, nonceSize))
+	if config.SharedSalt {
+		header.Salt = make([]byte, fileIDSize)
+		header.Flags |= FlagSharedSalt
+	} else if _, ok := config.KeyProvider.(*ExternalKeyProvider); ok {
+		// Generating an ID would also generate a file key
+		header.Salt = make([]byte, fileIDSize)
+	} else {
+		random := config.RandSource
+		if random == nil {
+			random = rand.Reader
+		}
+		if header.Salt, err = generateSalt(config.KeyProvider, random); err != nil {
+			return -1
+		}
+		header.setKeyID(keyIDFor(config.KeyProvider))
+	}
+	header.SaltSize = uint16(len(header.Salt))
+	if len(config.RecoveryKey) > 0 {
+		header.setWrappedKey(make([]byte, wrappedKeySize))
+	}
+	if config.ComputeDigest {
+		header.Flags |= FlagDigest
+	}
+	if config.FormatDescriptor {
+		header.Flags |= FlagFormat
+	}
+
+	if config.StreamFormat == StreamFormatSTREAM {
+		header.Flags |= FlagStream
+		nonceSize = streamNonceSize
+	}
+	if config.StreamFormat == StreamFormatSTREAM && config.ChunkSize == 0 && !config.ReadOnce {
+		records := max((plaintextSize+streamRecordSize-1)/streamRecordSize, 1)
+		return int64(header.Size()) + streamNonceSize + plaintextSize + records*streamTagSize
+	}
+
+	if config.ChunkSize == 0 && !config.ReadOnce {
+		body := plaintextSize
+		if config.PadSize > 0 {
+			header.Flags |= FlagPadded
+			body += paddedSizeSize
+			if body%int64(config.PadSize) != 0 {
+				body += int64(config.PadSize) - body%int64(config.PadSize)
+			}
+		}
+		return int64(header.Size()) + body + int64(engine.Overhead())
+	}
+
+	chunkSize := uint32(config.ChunkSize)
+	if chunkSize == 0 {
+		chunkSize = DefaultChunkSize
+	}
+	chunkCount := CalculateChunkCount(plaintextSize, chunkSize)
+	if chunkCount > MaxIndexedChunks {
+		return -1
+	}
+	header.Flags |= FlagChunked
+
+	size := int64(header.Size()) + ChunkIndexReservedSize
+	if chunkCount > 0 {
+		full := int64(CalculateCiphertextSize(chunkSize, nonceSize, engine.Overhead()))
+		size += int64(chunkCount-1) * full
+		last := plaintextSize - int64(chunkCount-1)*int64(chunkSize)
+		size += int64(CalculateCiphertextSize(uint32(last), nonceSize, engine.Overhead()))
+	}
+	return size
+}
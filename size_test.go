@@ -0,0 +1,74 @@
+package encryptfs
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestCiphertextSize(t *testing.T) {
+	password := NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+		Memory:      64 * 1024,
+		Iterations:  1,
+		Parallelism: 2,
+	})
+	configs := map[string]*Config{
+		"traditional": {Cipher: CipherAES256GCM, KeyProvider: password},
+		"padded":      {Cipher: CipherChaCha20Poly1305, KeyProvider: password, PadSize: 4096, ComputeDigest: true},
+		"chunked":     {Cipher: CipherAES256GCM, KeyProvider: password, ChunkSize: 4 * 1024},
+		"chunked-chacha": {
+			Cipher:      CipherChaCha20Poly1305,
+			KeyProvider: password,
+			ChunkSize:   8 * 1024,
+			SharedSalt:  true,
+			RecoveryKey: bytes.Repeat([]byte{0x5a}, 32),
+		},
+		"read-once": {Cipher: CipherAES256GCM, KeyProvider: password, ReadOnce: true, ComputeDigest: true},
+		"stream":    {Cipher: CipherChaCha20Poly1305, KeyProvider: password, StreamFormat: StreamFormatSTREAM},
+	}
+	sizes := []int64{0, 1, 1023, 1024, 4096, 10000, 70000}
+
+	for name, config := range configs {
+		t.Run(name, func(t *testing.T) {
+			base, cleanup := setupTestFS(t)
+			defer cleanup()
+			fs, err := New(base, config)
+			if err != nil {
+				t.Fatalf("failed to create EncryptFS: %v", err)
+			}
+			defer fs.Close()
+
+			for _, size := range sizes {
+				path := fmt.Sprintf("/file-%d", size)
+				file, err := fs.Create(path)
+				if err != nil {
+					t.Fatalf("failed to create %s: %v", path, err)
+				}
+				if _, err := file.Write(bytes.Repeat([]byte{'x'}, int(size))); err != nil {
+					t.Fatalf("failed to write %s: %v", path, err)
+				}
+				if err := file.Close(); err != nil {
+					t.Fatalf("failed to close %s: %v", path, err)
+				}
+
+				info, err := base.Stat(path)
+				if err != nil {
+					t.Fatalf("failed to stat %s: %v", path, err)
+				}
+				if got := CiphertextSize(size, config); got != info.Size() {
+					t.Errorf("CiphertextSize(%d) = %d, want %d", size, got, info.Size())
+				}
+			}
+		})
+	}
+
+	if got := CiphertextSize(-1, configs["traditional"]); got != -1 {
+		t.Errorf("CiphertextSize of a negative size = %d, want -1", got)
+	}
+	if got := CiphertextSize(int64(MaxIndexedChunks+1)*8*1024, configs["chunked-chacha"]); got != -1 {
+		t.Errorf("CiphertextSize beyond the chunk index = %d, want -1", got)
+	}
+	if got := CiphertextSize(10, &Config{}); got != -1 {
+		t.Errorf("CiphertextSize with an invalid config = %d, want -1", got)
+	}
+}
@@ -0,0 +1,127 @@
+package encryptfs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/absfs/absfs"
+)
+
+// ConfigBlobPath is the path on the base filesystem of the blob written when
+// Config.StoreConfig is set. It is a marker file like the keyfile: a header
+// recording the filesystem salt and KDF parameters, followed by the stored
+// settings encrypted and authenticated under the key derived from them.
+const ConfigBlobPath = "/.encryptfs-config"
+
+// storedConfig holds the settings recorded in the config blob. Each one is
+// needed to read the files of the store back.
+type storedConfig struct {
+	Cipher             CipherSuite        `json:"cipher"`
+	FilenameEncryption FilenameEncryption `json:"filename_encryption"`
+	DirnameEncryption  DirnameEncryption  `json:"dirname_encryption,omitempty"`
+	FilenameEncoding   FilenameEncoding   `json:"filename_encoding"`
+	PreserveExtensions bool               `json:"preserve_extensions"`
+	HashLongComponents bool               `json:"hash_long_components"`
+	FlattenDirectories bool               `json:"flatten_directories"`
+	MetadataPath       string             `json:"metadata_path"`
+	ChunkSize          int                `json:"chunk_size"`
+	SharedSalt         bool               `json:"shared_salt"`
+}
+
+// newStoredConfig returns the settings of config to record in a new blob
+func newStoredConfig(config *Config) storedConfig {
+	return storedConfig{
+		Cipher:             resolveCipher(config.Cipher),
+		FilenameEncryption: config.FilenameEncryption,
+		DirnameEncryption:  config.DirnameEncryption,
+		FilenameEncoding:   config.FilenameEncoding,
+		PreserveExtensions: config.PreserveExtensions,
+		HashLongComponents: config.HashLongComponents,
+		FlattenDirectories: config.FlattenDirectories,
+		MetadataPath:       config.MetadataPath,
+		ChunkSize:          config.ChunkSize,
+		SharedSalt:         config.SharedSalt,
+	}
+}
+
+// apply fills in the settings config leaves unset from the stored ones. A
+// setting given a different value is reported with ErrConfigMismatch.
+func (s storedConfig) apply(config *Config) error {
+	return errors.Join(
+		mergeStored("Cipher", &config.Cipher, s.Cipher),
+		mergeStored("FilenameEncryption", &config.FilenameEncryption, s.FilenameEncryption),
+		mergeStored("DirnameEncryption", &config.DirnameEncryption, s.DirnameEncryption),
+		mergeStored("FilenameEncoding", &config.FilenameEncoding, s.FilenameEncoding),
+		mergeStored("PreserveExtensions", &config.PreserveExtensions, s.PreserveExtensions),
+		mergeStored("HashLongComponents", &config.HashLongComponents, s.HashLongComponents),
+		mergeStored("FlattenDirectories", &config.FlattenDirectories, s.FlattenDirectories),
+		mergeStored("MetadataPath", &config.MetadataPath, s.MetadataPath),
+		mergeStored("ChunkSize", &config.ChunkSize, s.ChunkSize),
+		mergeStored("SharedSalt", &config.SharedSalt, s.SharedSalt),
+	)
+}
+
+// mergeStored sets a setting left at its zero value to the stored value, and
+// reports a mismatch if it was set to anything else
+func mergeStored[T comparable](field string, setting *T, stored T) error {
+	var zero T
+	if *setting == zero {
+		*setting = stored
+		return nil
+	}
+	if *setting != stored {
+		return fmt.Errorf("%w: %s is %v, but the filesystem was created with %v", ErrConfigMismatch, field, *setting, stored)
+	}
+	return nil
+}
+
+// loadStoredConfig reads the config blob, if the base filesystem has one,
+// or writes it if config asks for one. It returns the config to use, with
+// the stored settings applied to a copy, and the master key derived from
+// the blob's salt, or nil if there is no blob.
+func loadStoredConfig(base absfs.FileSystem, config *Config, random io.Reader) (*Config, *SecretKey, error) {
+	path := configBlobPath(base)
+	key, data, err := readMarker(base, path, config.KeyProvider)
+	if os.IsNotExist(err) {
+		if !config.StoreConfig {
+			return config, nil, nil
+		}
+		data, err = json.Marshal(newStoredConfig(config))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to encode stored config: %w", err)
+		}
+		key, err = createMarker(base, path, config.KeyProvider, resolveCipher(config.Cipher), data, random)
+		if err != nil {
+			return nil, nil, err
+		}
+		return config, key, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var stored storedConfig
+	if err := json.Unmarshal(data, &stored); err != nil {
+		key.Destroy()
+		return nil, nil, NewCorruptionError(path, fmt.Sprintf("invalid stored config: %v", err))
+	}
+	merged := *config
+	if err := stored.apply(&merged); err != nil {
+		key.Destroy()
+		return nil, nil, err
+	}
+	if err := merged.Validate(); err != nil {
+		key.Destroy()
+		return nil, nil, fmt.Errorf("invalid stored config: %w", err)
+	}
+	return &merged, key, nil
+}
+
+// configBlobPath returns ConfigBlobPath with the base filesystem's separator
+func configBlobPath(base absfs.FileSystem) string {
+	return string(base.Separator()) + strings.TrimPrefix(ConfigBlobPath, "/")
+}
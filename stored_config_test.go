@@ -0,0 +1,178 @@
+package encryptfs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestStoreConfig(t *testing.T) {
+	base, cleanup := setupTestFS(t)
+	defer cleanup()
+
+	password := func(p string) KeyProvider {
+		return NewPasswordKeyProvider([]byte(p), Argon2idParams{
+			Memory:      64 * 1024,
+			Iterations:  1,
+			Parallelism: 2,
+		})
+	}
+
+	// Initialize the store with a full configuration
+	fs, err := New(base, &Config{
+		Cipher:             CipherChaCha20Poly1305,
+		KeyProvider:        password("test-password"),
+		FilenameEncryption: FilenameEncryptionDeterministic,
+		FilenameEncoding:   FilenameEncodingBase32,
+		ChunkSize:          4 * 1024,
+		StoreConfig:        true,
+	})
+	if err != nil {
+		t.Fatalf("failed to create EncryptFS: %v", err)
+	}
+	tree := map[string][]byte{
+		"/notes.txt":       []byte("notes"),
+		"/docs/report.txt": bytes.Repeat([]byte("report "), 2000),
+		"/docs/empty.txt":  {},
+	}
+	if err := fs.Mkdir("/docs", 0755); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+	if err := fs.WriteFiles(tree); err != nil {
+		t.Fatalf("WriteFiles failed: %v", err)
+	}
+	fs.Close()
+
+	// A minimal config and the password are enough to reopen it
+	fs, err = New(base, &Config{KeyProvider: password("test-password")})
+	if err != nil {
+		t.Fatalf("failed to reopen EncryptFS: %v", err)
+	}
+	defer fs.Close()
+
+	if fs.config.Cipher != CipherChaCha20Poly1305 || fs.config.FilenameEncryption != FilenameEncryptionDeterministic ||
+		fs.config.FilenameEncoding != FilenameEncodingBase32 || fs.config.ChunkSize != 4*1024 {
+		t.Errorf("stored settings not applied: %+v", fs.config)
+	}
+	compareTree(t, fs, "/", tree)
+
+	// Deterministic names match those written in the first session
+	entries, err := fs.ReadDir("/docs")
+	if err != nil {
+		t.Fatalf("ReadDir failed: %v", err)
+	}
+	if len(entries) != 2 || entries[0].Name() != "empty.txt" || entries[1].Name() != "report.txt" {
+		t.Errorf("ReadDir(/docs) = %v, want empty.txt and report.txt", entries)
+	}
+	root, err := fs.ReadDir("/")
+	if err != nil {
+		t.Fatalf("ReadDir failed: %v", err)
+	}
+	for _, entry := range root {
+		if entry.Name() == ConfigBlobPath[1:] {
+			t.Error("ReadDir lists the config blob")
+		}
+	}
+
+	// New files use the stored settings
+	file, err := fs.Create("/new.txt")
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	file.Write([]byte("new"))
+	file.Close()
+	if _, ok := file.(*ChunkedFile); !ok {
+		t.Errorf("new file is %T, want *ChunkedFile", file)
+	}
+
+	// The blob is reserved
+	if _, err := fs.Create(ConfigBlobPath); !errors.Is(err, ErrReservedPath) {
+		t.Errorf("creating the config blob: got %v, want ErrReservedPath", err)
+	}
+
+	// A setting that contradicts the blob is rejected
+	_, err = New(base, &Config{KeyProvider: password("test-password"), Cipher: CipherAES256GCM})
+	if !errors.Is(err, ErrConfigMismatch) {
+		t.Errorf("contradicting cipher: got %v, want ErrConfigMismatch", err)
+	}
+	_, err = New(base, &Config{KeyProvider: password("test-password"), FilenameEncoding: FilenameEncodingBase32})
+	if err != nil {
+		t.Errorf("matching setting rejected: %v", err)
+	}
+
+	// The blob is authenticated with the password
+	_, err = New(base, &Config{KeyProvider: password("wrong-password")})
+	if !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("wrong password: got %v, want ErrAuthFailed", err)
+	}
+
+	data, err := readBaseFile(base, ConfigBlobPath)
+	if err != nil {
+		t.Fatalf("failed to read config blob: %v", err)
+	}
+	data[len(data)-1] ^= 1
+	blob, err := base.OpenFile(ConfigBlobPath, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		t.Fatalf("failed to open config blob: %v", err)
+	}
+	io.Copy(blob, bytes.NewReader(data))
+	blob.Close()
+	if _, err := New(base, &Config{KeyProvider: password("test-password")}); !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("tampered blob: got %v, want ErrAuthFailed", err)
+	}
+}
+
+func TestStoreConfig_RotateAllKeys(t *testing.T) {
+	base, cleanup := setupTestFS(t)
+	defer cleanup()
+
+	password := func(p string) KeyProvider {
+		return NewPasswordKeyProvider([]byte(p), Argon2idParams{
+			Memory:      64 * 1024,
+			Iterations:  1,
+			Parallelism: 2,
+		})
+	}
+
+	fs, err := New(base, &Config{
+		Cipher:             CipherChaCha20Poly1305,
+		KeyProvider:        password("old-password"),
+		FilenameEncryption: FilenameEncryptionDeterministic,
+		ChunkSize:          4 * 1024,
+		StoreConfig:        true,
+	})
+	if err != nil {
+		t.Fatalf("failed to create EncryptFS: %v", err)
+	}
+	tree := map[string][]byte{
+		"/notes.txt":       []byte("notes"),
+		"/docs/report.txt": bytes.Repeat([]byte("report "), 2000),
+	}
+	if err := fs.Mkdir("/docs", 0755); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+	if err := fs.WriteFiles(tree); err != nil {
+		t.Fatalf("WriteFiles failed: %v", err)
+	}
+	if err := fs.RotateAllKeys("/", KeyRotationOptions{NewKeyProvider: password("new-password")}); err != nil {
+		t.Fatalf("RotateAllKeys failed: %v", err)
+	}
+	fs.Close()
+
+	// The blob now opens under the new password only
+	if _, err := New(base, &Config{KeyProvider: password("old-password")}); !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("old password: got %v, want ErrAuthFailed", err)
+	}
+	fs, err = New(base, &Config{KeyProvider: password("new-password")})
+	if err != nil {
+		t.Fatalf("failed to reopen EncryptFS with the new password: %v", err)
+	}
+	defer fs.Close()
+
+	if fs.config.Cipher != CipherChaCha20Poly1305 || fs.config.ChunkSize != 4*1024 {
+		t.Errorf("stored settings not applied: %+v", fs.config)
+	}
+	compareTree(t, fs, "/", tree)
+}
@@ -0,0 +1,228 @@
+package encryptfs
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// StreamFormat selects how the body of new files is framed
+type StreamFormat uint8
+
+const (
+	// StreamFormatNative encrypts the body of a traditional file as a
+	// single ciphertext, and each chunk of a chunked file under its own
+	// random nonce (default)
+	StreamFormatNative StreamFormat = iota
+
+	// StreamFormatSTREAM frames the body of a traditional file with the
+	// STREAM construction of age's payload: a 16-byte nonce, then the
+	// plaintext in 64 KiB records, each sealed under a key expanded from the
+	// file key and the nonce with HKDF-SHA256 (info "payload"), using an
+	// 11-byte big-endian record counter and a final-record flag byte as the
+	// AEAD nonce. With ChaCha20-Poly1305 the body is a valid age payload for
+	// the file key, so other tools implementing STREAM can decrypt it.
+	//
+	// Chunked files keep their index, and each chunk is sealed as a STREAM
+	// record of its own: the chunk header holds a 16-byte nonce in place of
+	// the AEAD nonce, the record key is expanded from it as above, and the
+	// record counter is the chunk index, with the final-record flag set on
+	// the last chunk. A chunk moved to another index, or a file cut short
+	// at a chunk boundary, fails to decrypt. Appending a chunk, or dropping
+	// chunks, seals the previous last chunk again.
+	StreamFormatSTREAM
+)
+
+const (
+	// streamRecordSize is the plaintext size of every STREAM record but
+	// the last
+	streamRecordSize = 64 * 1024
+
+	// streamNonceSize is the size of the nonce that starts a STREAM body
+	streamNonceSize = 16
+
+	// streamTagSize is the authentication tag appended to each record
+	streamTagSize = 16
+)
+
+// streamPayloadInfo is the HKDF info string of the STREAM payload key
+var streamPayloadInfo = []byte("payload")
+
+// streamPayloadKey expands a file key and the nonce of one STREAM body into
+// the key its records are sealed with. A body is sealed under a fresh nonce
+// on every write, so its record nonces, which restart at zero, never repeat
+// under a key.
+func streamPayloadKey(fileKey, nonce []byte) ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, fileKey, nonce, streamPayloadInfo), key); err != nil {
+		return nil, fmt.Errorf("failed to expand payload key: %w", err)
+	}
+	return key, nil
+}
+
+// streamRecordNonce returns the AEAD nonce of a STREAM record: the record
+// counter as 11 big-endian bytes, then 1 for the final record and 0 for any
+// other
+func streamRecordNonce(counter uint64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// sealStream encrypts plaintext as a STREAM body under fileKey. An empty
+// plaintext is a single empty final record.
+func (e *EncryptFS) sealStream(cipher CipherSuite, fileKey, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, streamNonceSize)
+	if _, err := io.ReadFull(e.random, nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate stream nonce: %w", err)
+	}
+	key, err := streamPayloadKey(fileKey, nonce)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(key)
+	engine, err := e.newCipherEngine(cipher, key)
+	if err != nil {
+		return nil, err
+	}
+
+	records := max((len(plaintext)+streamRecordSize-1)/streamRecordSize, 1)
+	body := make([]byte, 0, streamNonceSize+len(plaintext)+records*streamTagSize)
+	body = append(body, nonce...)
+	for i := 0; i < records; i++ {
+		record := plaintext[i*streamRecordSize : min((i+1)*streamRecordSize, len(plaintext))]
+		sealed, err := engine.Encrypt(streamRecordNonce(uint64(i), i == records-1), record)
+		if err != nil {
+			return nil, err
+		}
+		body = append(body, sealed...)
+	}
+	return body, nil
+}
+
+// openStream decrypts a STREAM body sealed under fileKey. A body cut short
+// at a record boundary fails, as its last record was not sealed as final.
+func (e *EncryptFS) openStream(cipher CipherSuite, fileKey []byte, path string, body []byte) ([]byte, error) {
+	plaintextSize, err := streamPlaintextSize(int64(len(body)))
+	if err != nil {
+		return nil, NewCorruptionError(path, err.Error())
+	}
+
+	key, err := streamPayloadKey(fileKey, body[:streamNonceSize])
+	if err != nil {
+		return nil, err
+	}
+	defer clear(key)
+	engine, err := e.newCipherEngine(cipher, key)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext := make([]byte, 0, plaintextSize)
+	records := body[streamNonceSize:]
+	for counter := uint64(0); ; counter++ {
+		n := min(len(records), streamRecordSize+streamTagSize)
+		last := n == len(records)
+		record, err := engine.Decrypt(streamRecordNonce(counter, last), records[:n])
+		if err != nil {
+			return nil, &CorruptionError{
+				Path:     path,
+				ChunkIdx: uint32(counter),
+				Message:  fmt.Sprintf("failed to decrypt record: %v", err),
+				Err:      err,
+			}
+		}
+		plaintext = append(plaintext, record...)
+		if last {
+			return plaintext, nil
+		}
+		records = records[n:]
+	}
+}
+
+// chunkSealer seals and opens the chunks of a chunked file. The chunks of a
+// FlagStream file are sealed as STREAM records under a key expanded from the
+// file key and the chunk's nonce, which is chosen afresh whenever the chunk
+// is written, so their counter nonces never repeat under a key.
+type chunkSealer struct {
+	newEngine func(CipherSuite, []byte) (CipherEngine, error) // Creates the engines of STREAM records
+	cipher    CipherSuite
+	streamKey []byte // File key of a FlagStream file, or nil
+}
+
+// newChunkSealer returns the sealer of the chunks of the file with header,
+// whose key is key
+func newChunkSealer(header *FileHeader, key []byte, newEngine func(CipherSuite, []byte) (CipherEngine, error)) *chunkSealer {
+	s := &chunkSealer{newEngine: newEngine, cipher: header.Cipher}
+	if header.Flags&FlagStream != 0 {
+		s.streamKey = append([]byte(nil), key...)
+	}
+	return s
+}
+
+// recordEngine returns the engine that seals the STREAM record of a chunk
+// under the chunk's nonce
+func (s *chunkSealer) recordEngine(nonce []byte) (CipherEngine, error) {
+	key, err := streamPayloadKey(s.streamKey, nonce)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(key)
+	return s.newEngine(s.cipher, key)
+}
+
+// seal encrypts the plaintext of chunk chunkIdx under nonce, with engine
+// unless the file is a FlagStream file. last is set for the last chunk of
+// the file.
+func (s *chunkSealer) seal(engine CipherEngine, nonce []byte, chunkIdx uint32, last bool, plaintext []byte) ([]byte, error) {
+	if s.streamKey == nil {
+		return engine.Encrypt(nonce, plaintext)
+	}
+	record, err := s.recordEngine(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return record.Encrypt(streamRecordNonce(uint64(chunkIdx), last), plaintext)
+}
+
+// open decrypts the ciphertext of chunk chunkIdx, sealed under nonce, with
+// engine unless the file is a FlagStream file. last is set for the last
+// chunk of the file.
+func (s *chunkSealer) open(engine CipherEngine, nonce []byte, chunkIdx uint32, last bool, ciphertext []byte) ([]byte, error) {
+	if s.streamKey == nil {
+		return engine.Decrypt(nonce, ciphertext)
+	}
+	record, err := s.recordEngine(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return record.Decrypt(streamRecordNonce(uint64(chunkIdx), last), ciphertext)
+}
+
+// destroy zeroes the file key the sealer keeps
+func (s *chunkSealer) destroy() {
+	clear(s.streamKey)
+	s.streamKey = nil
+}
+
+// streamPlaintextSize returns the plaintext size of a STREAM body of the
+// given size, which it determines without decrypting anything. Only an
+// empty plaintext has an empty final record.
+func streamPlaintextSize(bodySize int64) (int64, error) {
+	payload := bodySize - streamNonceSize
+	if payload < streamTagSize {
+		return 0, fmt.Errorf("stream body of %d bytes is too short", bodySize)
+	}
+	records := (payload + streamRecordSize + streamTagSize - 1) / (streamRecordSize + streamTagSize)
+	lastRecord := payload - (records-1)*(streamRecordSize+streamTagSize)
+	if lastRecord == streamTagSize && records > 1 {
+		return 0, fmt.Errorf("stream body ends with an empty record")
+	}
+	return payload - records*streamTagSize, nil
+}
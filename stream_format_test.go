@@ -0,0 +1,485 @@
+package encryptfs
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/absfs/absfs"
+)
+
+func TestStreamFormat_RoundTrip(t *testing.T) {
+	for _, cipher := range []CipherSuite{CipherAES256GCM, CipherChaCha20Poly1305} {
+		t.Run(cipher.String(), func(t *testing.T) {
+			base, cleanup := setupTestFS(t)
+			defer cleanup()
+			config := &Config{
+				Cipher: cipher,
+				KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+					Memory:      64 * 1024,
+					Iterations:  1,
+					Parallelism: 2,
+				}),
+				StreamFormat: StreamFormatSTREAM,
+			}
+			fs, err := New(base, config)
+			if err != nil {
+				t.Fatalf("failed to create EncryptFS: %v", err)
+			}
+			defer fs.Close()
+
+			for _, size := range []int{0, 1, streamRecordSize, streamRecordSize + 1, 200000} {
+				path := fmt.Sprintf("/file-%d", size)
+				data := make([]byte, size)
+				for i := range data {
+					data[i] = byte(i % 251)
+				}
+				file, err := fs.Create(path)
+				if err != nil {
+					t.Fatalf("failed to create %s: %v", path, err)
+				}
+				if _, err := file.Write(data); err != nil {
+					t.Fatalf("failed to write %s: %v", path, err)
+				}
+				if err := file.Close(); err != nil {
+					t.Fatalf("failed to close %s: %v", path, err)
+				}
+
+				if header := readTestHeader(t, base, path); header.Flags&FlagStream == 0 {
+					t.Errorf("%s: header flags %#x lack FlagStream", path, header.Flags)
+				}
+				baseInfo, err := base.Stat(path)
+				if err != nil {
+					t.Fatalf("failed to stat base %s: %v", path, err)
+				}
+				if got := CiphertextSize(int64(size), config); got != baseInfo.Size() {
+					t.Errorf("CiphertextSize(%d) = %d, want %d", size, got, baseInfo.Size())
+				}
+				info, err := fs.Stat(path)
+				if err != nil {
+					t.Fatalf("failed to stat %s: %v", path, err)
+				}
+				if info.Size() != int64(size) {
+					t.Errorf("%s: Stat size = %d, want %d", path, info.Size(), size)
+				}
+
+				file, err = fs.Open(path)
+				if err != nil {
+					t.Fatalf("failed to open %s: %v", path, err)
+				}
+				got, err := io.ReadAll(file)
+				file.Close()
+				if err != nil {
+					t.Fatalf("failed to read %s: %v", path, err)
+				}
+				if !bytes.Equal(got, data) {
+					t.Errorf("%s: read back %d bytes that differ from the %d written", path, len(got), size)
+				}
+			}
+
+			// Rewriting part of a file reseals the whole body
+			path := "/file-200000"
+			file, err := fs.OpenFile(path, os.O_RDWR, 0644)
+			if err != nil {
+				t.Fatalf("failed to open %s: %v", path, err)
+			}
+			if _, err := file.Seek(streamRecordSize-2, io.SeekStart); err != nil {
+				t.Fatalf("failed to seek: %v", err)
+			}
+			if _, err := file.Write([]byte("boundary")); err != nil {
+				t.Fatalf("failed to write: %v", err)
+			}
+			if err := file.Close(); err != nil {
+				t.Fatalf("failed to close: %v", err)
+			}
+			file, err = fs.Open(path)
+			if err != nil {
+				t.Fatalf("failed to reopen %s: %v", path, err)
+			}
+			got := make([]byte, len("boundary"))
+			if _, err := file.ReadAt(got, streamRecordSize-2); err != nil {
+				t.Fatalf("failed to read: %v", err)
+			}
+			file.Close()
+			if string(got) != "boundary" {
+				t.Errorf("read %q across the record boundary, want %q", got, "boundary")
+			}
+		})
+	}
+}
+
+func TestStreamFormat_Corruption(t *testing.T) {
+	base, cleanup := setupTestFS(t)
+	defer cleanup()
+	fs, err := New(base, &Config{
+		Cipher: CipherChaCha20Poly1305,
+		KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+			Memory:      64 * 1024,
+			Iterations:  1,
+			Parallelism: 2,
+		}),
+		StreamFormat: StreamFormatSTREAM,
+	})
+	if err != nil {
+		t.Fatalf("failed to create EncryptFS: %v", err)
+	}
+	defer fs.Close()
+
+	data := bytes.Repeat([]byte("stream"), 30000)
+	write := func(path string) int64 {
+		t.Helper()
+		file, err := fs.Create(path)
+		if err != nil {
+			t.Fatalf("failed to create %s: %v", path, err)
+		}
+		if _, err := file.Write(data); err != nil {
+			t.Fatalf("failed to write %s: %v", path, err)
+		}
+		if err := file.Close(); err != nil {
+			t.Fatalf("failed to close %s: %v", path, err)
+		}
+		header := readTestHeader(t, base, path)
+		return int64(header.Size())
+	}
+	open := func(path string) error {
+		file, err := fs.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.ReadAll(file)
+		return err
+	}
+
+	// A flipped byte in the second record
+	headerSize := write("/tampered")
+	file, err := base.OpenFile("/tampered", os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatalf("failed to open base file: %v", err)
+	}
+	offset := headerSize + streamNonceSize + streamRecordSize + streamTagSize + 10
+	b := make([]byte, 1)
+	if _, err := file.ReadAt(b, offset); err != nil {
+		t.Fatalf("failed to read base file: %v", err)
+	}
+	b[0] ^= 0xff
+	if _, err := file.WriteAt(b, offset); err != nil {
+		t.Fatalf("failed to write base file: %v", err)
+	}
+	file.Close()
+	var corruption *CorruptionError
+	if err := open("/tampered"); !errors.As(err, &corruption) || corruption.ChunkIdx != 1 {
+		t.Errorf("tampered file: got %v, want a CorruptionError in record 1", err)
+	}
+
+	// A body cut short at a record boundary, whose last record was not
+	// sealed as final
+	headerSize = write("/truncated")
+	if err := base.Truncate("/truncated", headerSize+streamNonceSize+2*(streamRecordSize+streamTagSize)); err != nil {
+		t.Fatalf("failed to truncate: %v", err)
+	}
+	if err := open("/truncated"); err == nil {
+		t.Error("truncated file read without error")
+	}
+}
+
+func TestStreamFormat_Chunked(t *testing.T) {
+	const chunkSize = 4 * 1024
+
+	base, cleanup := setupTestFS(t)
+	defer cleanup()
+	config := &Config{
+		Cipher: CipherChaCha20Poly1305,
+		KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+			Memory:      64 * 1024,
+			Iterations:  1,
+			Parallelism: 2,
+		}),
+		ChunkSize:    chunkSize,
+		StreamFormat: StreamFormatSTREAM,
+	}
+	fs, err := New(base, config)
+	if err != nil {
+		t.Fatalf("failed to create EncryptFS: %v", err)
+	}
+	defer fs.Close()
+
+	data := make([]byte, 3*chunkSize+100)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	check := func(step string, want []byte) {
+		t.Helper()
+		file, err := fs.Open("/chunked.bin")
+		if err != nil {
+			t.Fatalf("%s: failed to open: %v", step, err)
+		}
+		got, err := io.ReadAll(file)
+		file.Close()
+		if err != nil {
+			t.Fatalf("%s: failed to read: %v", step, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("%s: content mismatch (%d bytes, want %d)", step, len(got), len(want))
+		}
+		layout, err := fs.ChunkLayout("/chunked.bin")
+		if err != nil {
+			t.Fatalf("%s: ChunkLayout failed: %v", step, err)
+		}
+		for _, chunk := range layout {
+			if len(chunk.Nonce) != streamNonceSize {
+				t.Errorf("%s: chunk %d nonce is %d bytes, want %d", step, chunk.Index, len(chunk.Nonce), streamNonceSize)
+			}
+		}
+	}
+
+	file, err := fs.Create("/chunked.bin")
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	if _, err := file.Write(data); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+	if header := readTestHeader(t, base, "/chunked.bin"); header.Flags&(FlagStream|FlagChunked) != FlagStream|FlagChunked {
+		t.Errorf("header flags %#x lack FlagStream|FlagChunked", header.Flags)
+	}
+	baseInfo, err := base.Stat("/chunked.bin")
+	if err != nil {
+		t.Fatalf("failed to stat base file: %v", err)
+	}
+	if got := CiphertextSize(int64(len(data)), config); got != baseInfo.Size() {
+		t.Errorf("CiphertextSize(%d) = %d, want %d", len(data), got, baseInfo.Size())
+	}
+	check("create", data)
+
+	// Appending reseals the previous last chunk
+	file, err = fs.OpenFile("/chunked.bin", os.O_RDWR|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("failed to reopen: %v", err)
+	}
+	tail := bytes.Repeat([]byte("appended "), 1000)
+	if _, err := file.Write(tail); err != nil {
+		t.Fatalf("failed to append: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+	data = append(data, tail...)
+	check("append", data)
+
+	// Shrinking seals the new last chunk as final
+	if err := fs.Truncate("/chunked.bin", 2*chunkSize+10); err != nil {
+		t.Fatalf("failed to truncate: %v", err)
+	}
+	data = data[:2*chunkSize+10]
+	check("truncate", data)
+
+	// Bulk writes past the end seal their chunks in parallel
+	file, err = fs.OpenFile("/chunked.bin", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("failed to reopen: %v", err)
+	}
+	if _, err := file.Seek(3*chunkSize, io.SeekStart); err != nil {
+		t.Fatalf("failed to seek: %v", err)
+	}
+	bulk := bytes.Repeat([]byte{0xA5}, 2*chunkSize+1)
+	if _, err := file.(*ChunkedFile).WriteBulk(bulk); err != nil {
+		t.Fatalf("WriteBulk failed: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+	data = append(append(data, make([]byte, 3*chunkSize-len(data))...), bulk...)
+	check("bulk", data)
+
+	if err := fs.RebuildChunkIndex("/chunked.bin"); err != nil {
+		t.Fatalf("RebuildChunkIndex failed: %v", err)
+	}
+	check("rebuild", data)
+}
+
+// TestStreamFormat_ChunkedTampering checks that the chunks of a STREAM file
+// are bound to their position: reordered chunks and a file cut short at a
+// chunk boundary fail to decrypt
+func TestStreamFormat_ChunkedTampering(t *testing.T) {
+	const chunkSize = 4 * 1024
+
+	base, cleanup := setupTestFS(t)
+	defer cleanup()
+	fs, err := New(base, &Config{
+		Cipher: CipherAES256GCM,
+		KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+			Memory:      64 * 1024,
+			Iterations:  1,
+			Parallelism: 2,
+		}),
+		ChunkSize:    chunkSize,
+		StreamFormat: StreamFormatSTREAM,
+	})
+	if err != nil {
+		t.Fatalf("failed to create EncryptFS: %v", err)
+	}
+	defer fs.Close()
+
+	tamper := func(name string, patch func(raw absfs.File, indexOffset int64, index *ChunkIndexHeader)) {
+		t.Run(name, func(t *testing.T) {
+			path := "/" + name
+			file, err := fs.Create(path)
+			if err != nil {
+				t.Fatalf("failed to create file: %v", err)
+			}
+			file.Write(bytes.Repeat([]byte{1}, 3*chunkSize))
+			if err := file.Close(); err != nil {
+				t.Fatalf("failed to close: %v", err)
+			}
+
+			raw, err := base.OpenFile(path, os.O_RDWR, 0)
+			if err != nil {
+				t.Fatalf("failed to open base file: %v", err)
+			}
+			header := &FileHeader{}
+			headerSize, err := header.ReadFrom(raw)
+			if err != nil {
+				t.Fatalf("failed to read header: %v", err)
+			}
+			index := &ChunkIndexHeader{}
+			if _, err := index.ReadFrom(raw); err != nil {
+				t.Fatalf("failed to read index: %v", err)
+			}
+			patch(raw, headerSize, index)
+			raw.Close()
+
+			file, err = fs.Open(path)
+			if err != nil {
+				return
+			}
+			_, err = io.ReadAll(file)
+			file.Close()
+			if err == nil {
+				t.Error("tampered file read without error")
+			}
+		})
+	}
+
+	tamper("swapped", func(raw absfs.File, indexOffset int64, index *ChunkIndexHeader) {
+		index.ChunkOffsets[0], index.ChunkOffsets[1] = index.ChunkOffsets[1], index.ChunkOffsets[0]
+		for idx := uint32(0); idx < 2; idx++ {
+			raw.WriteAt(index.encodeEntry(idx), indexOffset+index.EntryOffset(idx))
+		}
+	})
+	tamper("cut", func(raw absfs.File, indexOffset int64, index *ChunkIndexHeader) {
+		index.ChunkCount--
+		count := make([]byte, 4)
+		binary.LittleEndian.PutUint32(count, index.ChunkCount)
+		raw.WriteAt(count, indexOffset+index.CountOffset())
+	})
+}
+
+func TestStreamFormat_Validate(t *testing.T) {
+	provider := NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+		Memory:      64 * 1024,
+		Iterations:  1,
+		Parallelism: 2,
+	})
+	tests := []struct {
+		name   string
+		config Config
+		valid  bool
+	}{
+		{"stream", Config{StreamFormat: StreamFormatSTREAM}, true},
+		{"unknown format", Config{StreamFormat: StreamFormatSTREAM + 1}, false},
+		{"chunked", Config{StreamFormat: StreamFormatSTREAM, ChunkSize: 64 * 1024}, true},
+		{"read once", Config{StreamFormat: StreamFormatSTREAM, ReadOnce: true}, true},
+		{"padded", Config{StreamFormat: StreamFormatSTREAM, PadSize: 4096}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config.KeyProvider = provider
+			if err := tt.config.Validate(); (err == nil) != tt.valid {
+				t.Errorf("Validate() = %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
+
+// TestStreamFormat_Golden checks STREAM bodies against vectors of age's
+// payload encryption in testdata/stream_vectors.txt
+func TestStreamFormat_Golden(t *testing.T) {
+	fileKey := make([]byte, 32)
+	for i := range fileKey {
+		fileKey[i] = byte(i)
+	}
+	nonce := make([]byte, streamNonceSize)
+	for i := range nonce {
+		nonce[i] = byte(0x40 + i)
+	}
+
+	vectors, err := os.Open("testdata/stream_vectors.txt")
+	if err != nil {
+		t.Fatalf("failed to open vectors: %v", err)
+	}
+	defer vectors.Close()
+
+	scanner := bufio.NewScanner(vectors)
+	count := 0
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			t.Fatalf("malformed vector %q", line)
+		}
+		size, err1 := strconv.Atoi(fields[0])
+		bodySize, err2 := strconv.Atoi(fields[1])
+		if err1 != nil || err2 != nil {
+			t.Fatalf("malformed vector %q", line)
+		}
+		count++
+
+		plaintext := make([]byte, size)
+		for i := range plaintext {
+			plaintext[i] = byte(i % 251)
+		}
+		e := &EncryptFS{config: &Config{}, random: bytes.NewReader(nonce)}
+		body, err := e.sealStream(CipherChaCha20Poly1305, fileKey, plaintext)
+		if err != nil {
+			t.Fatalf("size %d: failed to seal: %v", size, err)
+		}
+		sum := sha256.Sum256(body)
+		if len(body) != bodySize || hex.EncodeToString(sum[:]) != fields[2] {
+			t.Errorf("size %d: body of %d bytes with SHA-256 %x, want %d bytes with %s",
+				size, len(body), sum, bodySize, fields[2])
+		}
+
+		got, err := e.openStream(CipherChaCha20Poly1305, fileKey, "/golden", body)
+		if err != nil {
+			t.Fatalf("size %d: failed to open: %v", size, err)
+		}
+		if !bytes.Equal(got, plaintext) {
+			t.Errorf("size %d: opened plaintext differs", size)
+		}
+		if n, err := streamPlaintextSize(int64(len(body))); err != nil || n != int64(size) {
+			t.Errorf("size %d: streamPlaintextSize = %d, %v", size, n, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("failed to read vectors: %v", err)
+	}
+	if count == 0 {
+		t.Fatal("no vectors found")
+	}
+}
@@ -2,8 +2,10 @@ package encryptfs
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"os"
 
 	"github.com/absfs/absfs"
@@ -11,15 +13,19 @@ import (
 
 // StreamingConfig controls streaming encryption behavior
 type StreamingConfig struct {
-	ChunkSize  int  // Size of each encrypted chunk (default: 64KB)
-	EnableSeek bool // Allow seeking within encrypted files
+	ChunkSize int // Size of each encrypted chunk (default: 64KB)
+
+	// EnableSeek has no effect: streaming files always support Seek, as
+	// every other file does.
+	//
+	// Deprecated: Seek is always available; leave EnableSeek unset.
+	EnableSeek bool
 }
 
 // DefaultStreamingConfig returns sensible defaults for streaming
 func DefaultStreamingConfig() StreamingConfig {
 	return StreamingConfig{
-		ChunkSize:  64 * 1024, // 64 KB chunks
-		EnableSeek: true,
+		ChunkSize: 64 * 1024, // 64 KB chunks
 	}
 }
 
@@ -30,6 +36,8 @@ type ChunkHeader struct {
 	Nonce         []byte // Nonce for this chunk
 }
 
+var _ absfs.File = (*streamingFile)(nil)
+
 // streamingFile wraps a file for chunked streaming encryption/decryption
 type streamingFile struct {
 	base          absfs.File
@@ -43,7 +51,7 @@ type streamingFile struct {
 	chunkOffset   int64  // Offset within current chunk
 	globalOffset  int64  // Global offset in the virtual plaintext
 	fileSize      int64  // Total plaintext size
-	dirty         bool   // True if current chunk has been modified
+	dirty         bool   // True if chunkData holds modified contents of the whole file
 	flags         int
 	headerSize    int64 // Size of the main file header
 	chunksStartPos int64 // Position where chunks start
@@ -80,26 +88,40 @@ func newStreamingFile(base absfs.File, fs *EncryptFS, config StreamingConfig, fl
 // initStreamingFile initializes a new streaming encrypted file
 func (sf *streamingFile) initStreamingFile() error {
 	// Generate salt and nonce for file header
-	salt, err := sf.fs.keyProvider.GenerateSalt()
+	salt, err := sf.fs.generateSalt()
 	if err != nil {
 		return fmt.Errorf("failed to generate salt: %w", err)
 	}
 
-	nonce, err := GenerateNonce(sf.fs.cipher)
+	nonce, err := sf.fs.generateNonce(sf.fs.cipher)
 	if err != nil {
+		sf.fs.discardSalt(salt)
 		return fmt.Errorf("failed to generate nonce: %w", err)
 	}
 
 	sf.fileHeader = NewFileHeader(sf.fs.cipher, salt, nonce)
+	sf.fileHeader.KDF = kdfParamsFor(sf.fs.keyProvider)
+	sf.fileHeader.Flags = sf.fs.newFileFlags()
+	sf.fileHeader.setKeyID(keyIDFor(sf.fs.keyProvider))
 
 	// Derive key
-	key, err := sf.fs.keyProvider.DeriveKey(salt)
+	key, err := sf.fs.deriveKey(salt)
 	if err != nil {
 		return fmt.Errorf("failed to derive key: %w", err)
 	}
+	sf.fs.keys.put(sf.fs.keyProvider, salt, sf.fileHeader.KDF, key)
+	if err := sf.fs.wrapRecoveryKey(sf.fileHeader, key); err != nil {
+		return err
+	}
+	if err := sf.fs.describeFormat(sf.fileHeader, key); err != nil {
+		return err
+	}
+	if err := sf.fileHeader.setDigestKey(key); err != nil {
+		return err
+	}
 
 	// Create cipher engine
-	sf.engine, err = NewCipherEngine(sf.fs.cipher, key)
+	sf.engine, err = sf.fs.newCipherEngine(sf.fs.cipher, key)
 	if err != nil {
 		return fmt.Errorf("failed to create cipher engine: %w", err)
 	}
@@ -130,15 +152,29 @@ func (sf *streamingFile) loadStreamingFile() error {
 	if err := sf.fileHeader.Validate(); err != nil {
 		return err
 	}
+	if sf.fileHeader.Flags&FlagStream != 0 {
+		// STREAM records are not single-chunk ciphertexts
+		return errors.New("STREAM format files are not supported by the streaming reader")
+	}
 
 	// Derive key
-	key, err := sf.fs.keyProvider.DeriveKey(sf.fileHeader.Salt)
+	keyProvider, err := sf.fs.fileKeyProvider(sf.fileHeader)
+	if err != nil {
+		return err
+	}
+	key, err := sf.fs.keys.derive(keyProvider, sf.fileHeader)
 	if err != nil {
 		return fmt.Errorf("failed to derive key: %w", err)
 	}
+	if err := sf.fileHeader.openFormat(key); err != nil {
+		return decryptError(sf.base.Name(), "failed to authenticate header", err)
+	}
+	if err := sf.fileHeader.setDigestKey(key); err != nil {
+		return err
+	}
 
 	// Create cipher engine
-	sf.engine, err = NewCipherEngine(sf.fileHeader.Cipher, key)
+	sf.engine, err = sf.fs.newCipherEngine(sf.fileHeader.Cipher, key)
 	if err != nil {
 		return fmt.Errorf("failed to create cipher engine: %w", err)
 	}
@@ -154,57 +190,142 @@ func (sf *streamingFile) loadStreamingFile() error {
 	}
 	ciphertextSize -= sf.headerSize
 
+	// The sizes come from the file, so they are checked before a buffer is
+	// sized from them
 	if ciphertextSize > 0 {
+		if ciphertextSize < int64(sf.engine.Overhead()) || ciphertextSize > math.MaxUint32 {
+			return NewCorruptionError(sf.base.Name(), fmt.Sprintf("invalid ciphertext size %d", ciphertextSize))
+		}
+		if err := checkInMemorySize(ciphertextSize); err != nil {
+			return err
+		}
 		sf.chunks = []ChunkHeader{{
 			ChunkSize:      uint32(ciphertextSize) - uint32(sf.engine.Overhead()),
 			CiphertextSize: uint32(ciphertextSize),
 			Nonce:          sf.fileHeader.Nonce,
 		}}
 		sf.fileSize = int64(sf.chunks[0].ChunkSize)
+
+		// A padded body records its plaintext size inside the ciphertext
+		if sf.fileHeader.Flags&FlagPadded != 0 {
+			if err := sf.loadChunk(0); err != nil {
+				return err
+			}
+			sf.fileSize = int64(len(sf.chunkData))
+		}
 	}
 
 	return nil
 }
 
-// Read reads from the current position
+// Read reads from the current position. As with ChunkedFile.Read, io.EOF is
+// returned only when the position is already at the end of the file; a read
+// that reaches the end returns the bytes it read and a nil error.
 func (sf *streamingFile) Read(p []byte) (n int, err error) {
-	if sf.globalOffset >= sf.fileSize {
-		return 0, io.EOF
+	if len(p) == 0 {
+		return 0, nil
 	}
 
-	// Load current chunk if needed
-	if sf.chunkData == nil || len(sf.chunkData) == 0 {
-		if err := sf.loadChunk(sf.currentChunk); err != nil {
-			return 0, err
+	n, err = sf.readAt(p, sf.globalOffset)
+	sf.globalOffset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// readAt reads into p from off, decrypting one chunk at a time. As
+// io.ReaderAt requires, a read cut short by the end of the file returns
+// io.EOF along with the bytes read.
+func (sf *streamingFile) readAt(p []byte, off int64) (n int, err error) {
+	for n < len(p) {
+		if off >= sf.fileSize {
+			return n, io.EOF
+		}
+		if err := sf.seekChunk(off); err != nil {
+			return n, err
 		}
+		copied := copy(p[n:], sf.chunkData[sf.chunkOffset:])
+		if copied == 0 {
+			// The chunks hold less plaintext than the file size says
+			return n, io.ErrUnexpectedEOF
+		}
+		n += copied
+		off += int64(copied)
 	}
+	return n, nil
+}
 
-	// Read from current chunk
-	n = copy(p, sf.chunkData[sf.chunkOffset:])
-	sf.chunkOffset += int64(n)
-	sf.globalOffset += int64(n)
+// chunkStart returns the plaintext offset of the first byte of a chunk
+func (sf *streamingFile) chunkStart(chunkIdx int) int64 {
+	var start int64
+	for i := 0; i < chunkIdx; i++ {
+		start += int64(sf.chunks[i].ChunkSize)
+	}
+	return start
+}
 
-	// Check if we need to load next chunk
-	if sf.chunkOffset >= int64(len(sf.chunkData)) && sf.currentChunk+1 < len(sf.chunks) {
-		sf.currentChunk++
-		sf.chunkOffset = 0
-		sf.chunkData = nil
+// locateChunk returns the chunk holding the plaintext offset off and the
+// offset relative to the start of that chunk. Offsets at or past the end of
+// the file land in the last chunk.
+func (sf *streamingFile) locateChunk(off int64) (int, int64) {
+	var start int64
+	for i, chunk := range sf.chunks {
+		end := start + int64(chunk.ChunkSize)
+		if off < end || i == len(sf.chunks)-1 {
+			return i, off - start
+		}
+		start = end
+	}
+	return 0, off
+}
+
+// seekChunk makes the chunk holding off the current chunk, decrypting it
+// unless it is already loaded, and sets chunkOffset relative to it
+func (sf *streamingFile) seekChunk(off int64) error {
+	// Modified contents are buffered whole, as a single chunk
+	if sf.dirty {
+		sf.chunkOffset = off
+		return nil
 	}
 
-	if n < len(p) && sf.globalOffset < sf.fileSize {
-		// Recursively read more
-		n2, err2 := sf.Read(p[n:])
-		n += n2
-		if err2 != nil && err2 != io.EOF {
-			return n, err2
+	chunkIdx, rel := sf.locateChunk(off)
+	if chunkIdx != sf.currentChunk || sf.chunkData == nil {
+		sf.chunkData = nil
+		if len(sf.chunks) == 0 {
+			sf.chunkData = []byte{}
+		} else if err := sf.loadChunk(chunkIdx); err != nil {
+			return err
 		}
+		sf.currentChunk = chunkIdx
 	}
+	sf.chunkOffset = rel
+	return nil
+}
 
-	if sf.globalOffset >= sf.fileSize && n > 0 {
-		err = io.EOF
+// load decrypts the whole file into a single buffered chunk on first
+// modification. Writes and truncation operate on the buffered contents in
+// chunkData, which Flush encrypts as one chunk.
+func (sf *streamingFile) load() error {
+	if sf.dirty {
+		return nil
 	}
 
-	return n, err
+	data := make([]byte, 0, sf.fileSize)
+	for i := range sf.chunks {
+		if i != sf.currentChunk || sf.chunkData == nil {
+			if err := sf.loadChunk(i); err != nil {
+				return err
+			}
+			sf.currentChunk = i
+		}
+		data = append(data, sf.chunkData...)
+	}
+
+	sf.chunkData = data
+	sf.currentChunk = 0
+	sf.chunkOffset = sf.globalOffset
+	return nil
 }
 
 // loadChunk loads and decrypts a specific chunk
@@ -221,21 +342,35 @@ func (sf *streamingFile) loadChunk(chunkIdx int) error {
 		chunkPos += int64(sf.chunks[i].CiphertextSize)
 	}
 
-	// Seek to chunk position
-	if _, err := sf.base.Seek(chunkPos, io.SeekStart); err != nil {
-		return err
-	}
-
-	// Read ciphertext
 	ciphertext := make([]byte, chunk.CiphertextSize)
-	if _, err := io.ReadFull(sf.base, ciphertext); err != nil {
-		return fmt.Errorf("failed to read chunk ciphertext: %w", err)
+	err := sf.fs.retry(func() error {
+		// Seek to chunk position
+		if _, err := sf.base.Seek(chunkPos, io.SeekStart); err != nil {
+			return err
+		}
+
+		// Read ciphertext
+		if _, err := io.ReadFull(sf.base, ciphertext); err != nil {
+			return readChunkError(sf.base.Name(), uint32(chunkIdx), err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
 	// Decrypt
 	plaintext, err := sf.engine.Decrypt(chunk.Nonce, ciphertext)
 	if err != nil {
-		return fmt.Errorf("failed to decrypt chunk: %w", err)
+		return &CorruptionError{
+			Path:     sf.base.Name(),
+			ChunkIdx: uint32(chunkIdx),
+			Message:  fmt.Sprintf("failed to decrypt chunk: %v", err),
+			Err:      decryptError(sf.base.Name(), "failed to decrypt chunk", err),
+		}
+	}
+	if plaintext, err = sf.fileHeader.unpadBody(sf.base.Name(), plaintext); err != nil {
+		return err
 	}
 
 	sf.chunkData = plaintext
@@ -244,52 +379,97 @@ func (sf *streamingFile) loadChunk(chunkIdx int) error {
 	return nil
 }
 
-// Write writes data (will be chunked and encrypted on flush/close)
+// Write writes data at the current position (encrypted on flush/close)
 func (sf *streamingFile) Write(p []byte) (n int, err error) {
-	// For simplicity, buffer writes until close
-	// In a full implementation, we'd write complete chunks immediately
-	sf.chunkData = append(sf.chunkData, p...)
-	sf.globalOffset += int64(len(p))
-	sf.dirty = true
-	return len(p), nil
+	n, err = sf.writeAt(p, sf.globalOffset)
+	sf.globalOffset += int64(n)
+	return n, err
 }
 
-// Flush writes any pending chunks
-func (sf *streamingFile) Flush() error {
-	if !sf.dirty || len(sf.chunkData) == 0 {
-		return nil
+// writeAt copies p into the buffered plaintext at off, zero-filling any gap
+// past the end of the file
+func (sf *streamingFile) writeAt(p []byte, off int64) (int, error) {
+	if err := checkWritable("write", sf.Name(), sf.flags); err != nil {
+		return 0, err
 	}
 
-	// Seek to beginning
-	if _, err := sf.base.Seek(0, io.SeekStart); err != nil {
-		return err
+	// An empty write never extends the file, even past EOF
+	if len(p) == 0 {
+		return 0, nil
 	}
 
-	// Write file header
-	if _, err := sf.fileHeader.WriteTo(sf.base); err != nil {
-		return err
+	if err := sf.load(); err != nil {
+		return 0, err
 	}
 
-	// Encrypt and write data
-	ciphertext, err := sf.engine.Encrypt(sf.fileHeader.Nonce, sf.chunkData)
-	if err != nil {
-		return fmt.Errorf("failed to encrypt: %w", err)
+	if end := off + int64(len(p)); end > int64(len(sf.chunkData)) {
+		grown := make([]byte, end)
+		copy(grown, sf.chunkData)
+		sf.chunkData = grown
 	}
 
-	if _, err := sf.base.Write(ciphertext); err != nil {
+	n := copy(sf.chunkData[off:], p)
+	sf.fileSize = int64(len(sf.chunkData))
+	sf.dirty = true
+	return n, nil
+}
+
+// Flush encrypts the buffered plaintext and rewrites the file
+func (sf *streamingFile) Flush() error {
+	if !sf.dirty {
+		return nil
+	}
+	if err := sf.load(); err != nil {
 		return err
 	}
 
-	// Truncate
-	pos, err := sf.base.Seek(0, io.SeekCurrent)
+	// Every write of the ciphertext needs a fresh nonce
+	nonce, err := sf.fs.generateNonce(sf.fileHeader.Cipher)
+	if err != nil {
+		return fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	sf.fileHeader.Nonce = nonce
+
+	// Encrypt data, padded as traditional files are
+	body, err := sf.fileHeader.padBody(sf.chunkData, sf.fs.config.PadSize, sf.fs.random)
 	if err != nil {
 		return err
 	}
+	ciphertext, err := sf.engine.Encrypt(nonce, body)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt: %w", err)
+	}
+
+	err = sf.fs.retry(func() error {
+		// Seek to beginning
+		if _, err := sf.base.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
 
-	if err := sf.base.Truncate(pos); err != nil {
+		// Write file header and data
+		if _, err := sf.fileHeader.WriteTo(sf.base); err != nil {
+			return err
+		}
+		if _, err := sf.base.Write(ciphertext); err != nil {
+			return err
+		}
+
+		// Truncate
+		pos, err := sf.base.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		return sf.base.Truncate(pos)
+	})
+	if err != nil {
 		return err
 	}
 
+	sf.chunks = []ChunkHeader{{
+		ChunkSize:      uint32(len(sf.chunkData)),
+		CiphertextSize: uint32(len(ciphertext)),
+		Nonce:          nonce,
+	}}
 	sf.fileSize = int64(len(sf.chunkData))
 	sf.dirty = false
 
@@ -298,6 +478,7 @@ func (sf *streamingFile) Flush() error {
 
 // Close flushes and closes the file
 func (sf *streamingFile) Close() error {
+	defer sf.fileHeader.clearKeys()
 	if err := sf.Flush(); err != nil {
 		sf.base.Close()
 		return err
@@ -307,10 +488,6 @@ func (sf *streamingFile) Close() error {
 
 // Seek sets the offset for the next read/write
 func (sf *streamingFile) Seek(offset int64, whence int) (int64, error) {
-	if !sf.streamConfig.EnableSeek {
-		return 0, fmt.Errorf("seeking disabled")
-	}
-
 	var newOffset int64
 	switch whence {
 	case io.SeekStart:
@@ -327,51 +504,83 @@ func (sf *streamingFile) Seek(offset int64, whence int) (int64, error) {
 		return 0, fmt.Errorf("negative position")
 	}
 
-	// Find which chunk contains this offset
-	// For now with single chunk, just update offset
+	if err := sf.seekChunk(newOffset); err != nil {
+		return 0, err
+	}
 	sf.globalOffset = newOffset
-	sf.chunkOffset = newOffset
 
 	return newOffset, nil
 }
 
-// Stub methods to satisfy absfs.File interface
-func (sf *streamingFile) Name() string                               { return sf.base.Name() }
-func (sf *streamingFile) WriteString(s string) (int, error)          { return sf.Write([]byte(s)) }
-func (sf *streamingFile) Sync() error                                { return sf.Flush() }
-func (sf *streamingFile) Stat() (os.FileInfo, error)                 { return sf.base.Stat() }
-func (sf *streamingFile) Readdir(n int) ([]os.FileInfo, error)       { return sf.base.Readdir(n) }
-func (sf *streamingFile) Readdirnames(n int) ([]string, error)       { return sf.base.Readdirnames(n) }
+// Name returns the name of the underlying file
+func (sf *streamingFile) Name() string { return sf.base.Name() }
+
+// WriteString writes a string at the current position
+func (sf *streamingFile) WriteString(s string) (int, error) { return sf.Write([]byte(s)) }
+
+// Sync flushes the buffered plaintext to the base file
+func (sf *streamingFile) Sync() error { return sf.Flush() }
+
+// Stat returns file info reporting the plaintext size
+func (sf *streamingFile) Stat() (os.FileInfo, error) {
+	info, err := sf.base.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	encInfo := newEncryptedFileInfo(info, sf.fileHeader.Cipher)
+	encInfo.size = sf.fileSize
+	return encInfo, nil
+}
+
+// Readdir fails, as a regular file is not a directory
+func (sf *streamingFile) Readdir(n int) ([]os.FileInfo, error) {
+	return nil, &os.PathError{Op: "readdir", Path: sf.Name(), Err: errNotDir}
+}
+
+// Readdirnames fails, as a regular file is not a directory
+func (sf *streamingFile) Readdirnames(n int) ([]string, error) {
+	return nil, &os.PathError{Op: "readdirnames", Path: sf.Name(), Err: errNotDir}
+}
+
+// Truncate changes the plaintext size, zero-filling when it grows
 func (sf *streamingFile) Truncate(size int64) error {
-	// Simplified truncate
+	if err := checkWritable("truncate", sf.Name(), sf.flags); err != nil {
+		return err
+	}
 	if size < 0 {
 		return fmt.Errorf("negative size")
 	}
-	sf.chunkData = sf.chunkData[:min(len(sf.chunkData), int(size))]
+	if err := sf.load(); err != nil {
+		return err
+	}
+
+	if size > int64(len(sf.chunkData)) {
+		grown := make([]byte, size)
+		copy(grown, sf.chunkData)
+		sf.chunkData = grown
+	} else {
+		sf.chunkData = sf.chunkData[:size]
+	}
+	sf.fileSize = size
 	sf.dirty = true
 	return nil
 }
 
+// ReadAt reads from off without moving the current position
 func (sf *streamingFile) ReadAt(b []byte, off int64) (n int, err error) {
-	// Simplified ReadAt
-	oldOffset := sf.globalOffset
-	if _, err := sf.Seek(off, io.SeekStart); err != nil {
-		return 0, err
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset")
 	}
-	n, err = sf.Read(b)
-	sf.globalOffset = oldOffset
-	return n, err
+	return sf.readAt(b, off)
 }
 
+// WriteAt writes at off without moving the current position
 func (sf *streamingFile) WriteAt(b []byte, off int64) (n int, err error) {
-	// Simplified WriteAt
-	oldOffset := sf.globalOffset
-	if _, err := sf.Seek(off, io.SeekStart); err != nil {
-		return 0, err
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset")
 	}
-	n, err = sf.Write(b)
-	sf.globalOffset = oldOffset
-	return n, err
+	return sf.writeAt(b, off)
 }
 
 func min(a, b int) int {
@@ -412,6 +621,9 @@ func readChunkHeader(r io.Reader) (*ChunkHeader, error) {
 	if err := binary.Read(r, binary.LittleEndian, &nonceSize); err != nil {
 		return nil, err
 	}
+	if nonceSize > maxNonceSize {
+		return nil, fmt.Errorf("nonce size %d exceeds %d", nonceSize, maxNonceSize)
+	}
 	ch.Nonce = make([]byte, nonceSize)
 	if _, err := io.ReadFull(r, ch.Nonce); err != nil {
 		return nil, err
@@ -0,0 +1,255 @@
+package encryptfs
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+)
+
+// openMultiChunkStream writes chunks as separately encrypted chunks of a
+// streaming file and opens it with the matching chunk table
+func openMultiChunkStream(t *testing.T, fs *EncryptFS, base *osTestFS, name string, chunks [][]byte) *streamingFile {
+	t.Helper()
+
+	salt, err := fs.keyProvider.GenerateSalt()
+	if err != nil {
+		t.Fatalf("failed to generate salt: %v", err)
+	}
+	nonce, err := GenerateNonce(fs.cipher)
+	if err != nil {
+		t.Fatalf("failed to generate nonce: %v", err)
+	}
+	header := NewFileHeader(fs.cipher, salt, nonce)
+	header.KDF = kdfParamsFor(fs.keyProvider)
+	key, err := fs.keyProvider.DeriveKey(salt)
+	if err != nil {
+		t.Fatalf("failed to derive key: %v", err)
+	}
+	engine, err := NewCipherEngine(fs.cipher, key.Bytes())
+	if err != nil {
+		t.Fatalf("failed to create cipher engine: %v", err)
+	}
+
+	var buf bytes.Buffer
+	header.WriteTo(&buf)
+	var table []ChunkHeader
+	var size int64
+	for _, chunk := range chunks {
+		nonce, err := GenerateNonce(fs.cipher)
+		if err != nil {
+			t.Fatalf("failed to generate nonce: %v", err)
+		}
+		ciphertext, err := engine.Encrypt(nonce, chunk)
+		if err != nil {
+			t.Fatalf("failed to encrypt chunk: %v", err)
+		}
+		buf.Write(ciphertext)
+		table = append(table, ChunkHeader{
+			ChunkSize:      uint32(len(chunk)),
+			CiphertextSize: uint32(len(ciphertext)),
+			Nonce:          nonce,
+		})
+		size += int64(len(chunk))
+	}
+
+	file, err := base.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatalf("failed to create base file: %v", err)
+	}
+	file.Write(buf.Bytes())
+
+	sf, err := newStreamingFile(file, fs, DefaultStreamingConfig(), os.O_RDWR)
+	if err != nil {
+		t.Fatalf("newStreamingFile failed: %v", err)
+	}
+	sf.chunks = table
+	sf.fileSize = size
+	return sf
+}
+
+func TestStreamingFile_SeekAcrossChunks(t *testing.T) {
+	fs, base := newXattrTestFS(t, FilenameEncryptionNone, false)
+
+	chunks := [][]byte{
+		bytes.Repeat([]byte("a"), 16),
+		[]byte("0123456789abcdef"),
+		bytes.Repeat([]byte("c"), 10),
+	}
+	want := bytes.Join(chunks, nil)
+	sf := openMultiChunkStream(t, fs, base, "/stream.bin", chunks)
+	defer sf.Close()
+
+	tests := []struct {
+		offset int64
+		whence int
+		size   int
+		pos    int64
+		chunk  int
+	}{
+		{20, io.SeekStart, 8, 20, 1},
+		{-14, io.SeekCurrent, 10, 14, 0}, // spans chunks 0 and 1
+		{-3, io.SeekEnd, 3, 39, 2},
+		{16, io.SeekStart, 4, 16, 1},
+		{0, io.SeekStart, len(want), 0, 0},
+	}
+	for _, tt := range tests {
+		pos, err := sf.Seek(tt.offset, tt.whence)
+		if err != nil {
+			t.Fatalf("Seek(%d, %d) failed: %v", tt.offset, tt.whence, err)
+		}
+		if pos != tt.pos {
+			t.Fatalf("Seek(%d, %d) = %d, want %d", tt.offset, tt.whence, pos, tt.pos)
+		}
+		if sf.currentChunk != tt.chunk || sf.chunkOffset != pos-sf.chunkStart(tt.chunk) {
+			t.Errorf("Seek(%d, %d) left chunk %d offset %d, want chunk %d offset %d",
+				tt.offset, tt.whence, sf.currentChunk, sf.chunkOffset, tt.chunk, pos-sf.chunkStart(tt.chunk))
+		}
+
+		got := make([]byte, tt.size)
+		if _, err := io.ReadFull(sf, got); err != nil {
+			t.Fatalf("read at %d failed: %v", pos, err)
+		}
+		if !bytes.Equal(got, want[pos:pos+int64(tt.size)]) {
+			t.Errorf("read at %d = %q, want %q", pos, got, want[pos:pos+int64(tt.size)])
+		}
+	}
+
+	// Seeking within the loaded chunk reuses its plaintext
+	sf.Seek(20, io.SeekStart)
+	loaded := &sf.chunkData[0]
+	sf.Seek(-2, io.SeekCurrent)
+	if &sf.chunkData[0] != loaded {
+		t.Error("seeking within the current chunk decrypted it again")
+	}
+
+	// Writing after a seek keeps the other chunks
+	sf.Seek(30, io.SeekStart)
+	sf.Write([]byte("XY"))
+	copy(want[30:], "XY")
+	if err := sf.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	got := make([]byte, len(want))
+	if _, err := sf.ReadAt(got, 0); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("content after write = %q, want %q", got, want)
+	}
+}
+
+func TestStreamingFile_ReadEOF(t *testing.T) {
+	fs, base := newXattrTestFS(t, FilenameEncryptionNone, false)
+
+	chunks := [][]byte{
+		bytes.Repeat([]byte("a"), 16),
+		[]byte("0123456789abcdef"),
+		bytes.Repeat([]byte("c"), 10),
+	}
+	want := bytes.Join(chunks, nil)
+	sf := openMultiChunkStream(t, fs, base, "/stream.bin", chunks)
+	defer sf.Close()
+
+	// Small buffers cross chunk boundaries, and io.EOF comes only once the
+	// whole file has been read
+	for _, size := range []int{1, 3, 7, 16, 17, 100} {
+		sf.Seek(0, io.SeekStart)
+		var got []byte
+		buf := make([]byte, size)
+		for {
+			n, err := sf.Read(buf)
+			got = append(got, buf[:n]...)
+			if err == io.EOF {
+				if n != 0 {
+					t.Errorf("buffer %d: io.EOF returned with %d bytes", size, n)
+				}
+				break
+			}
+			if err != nil {
+				t.Fatalf("buffer %d: Read failed: %v", size, err)
+			}
+			if n == 0 {
+				t.Fatalf("buffer %d: Read returned no bytes and no error", size)
+			}
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("buffer %d: read %q, want %q", size, got, want)
+		}
+	}
+
+	// Reading exactly to the end succeeds, and the next read is at EOF
+	sf.Seek(0, io.SeekStart)
+	buf := make([]byte, len(want))
+	if n, err := sf.Read(buf); n != len(want) || err != nil {
+		t.Fatalf("Read to the end = %d, %v; want %d, nil", n, err, len(want))
+	}
+	if n, err := sf.Read(buf); n != 0 || err != io.EOF {
+		t.Errorf("Read at the end = %d, %v; want 0, io.EOF", n, err)
+	}
+	if n, err := sf.Read(nil); n != 0 || err != nil {
+		t.Errorf("empty Read at the end = %d, %v; want 0, nil", n, err)
+	}
+
+	// ReadAt reports a read cut short by the end of the file
+	if n, err := sf.ReadAt(buf, 30); n != len(want)-30 || err != io.EOF {
+		t.Errorf("ReadAt past the end = %d, %v; want %d, io.EOF", n, err, len(want)-30)
+	}
+	if n, err := sf.ReadAt(buf[:12], 30); n != 12 || err != nil {
+		t.Errorf("ReadAt to the end = %d, %v; want 12, nil", n, err)
+	}
+	if n, err := sf.ReadAt(buf, int64(len(want))); n != 0 || err != io.EOF {
+		t.Errorf("ReadAt at the end = %d, %v; want 0, io.EOF", n, err)
+	}
+}
+
+// TestStreamingFile_CorruptSizes opens streaming files whose sizes cannot
+// be right: a body shorter than an authentication tag once made the chunk
+// size wrap around, and a recorded plaintext size larger than the body was
+// used to size the buffer of the whole file
+func TestStreamingFile_CorruptSizes(t *testing.T) {
+	fs, base := newXattrTestFS(t, FilenameEncryptionNone, false)
+
+	salt, err := fs.keyProvider.GenerateSalt()
+	if err != nil {
+		t.Fatalf("failed to generate salt: %v", err)
+	}
+	nonce, err := GenerateNonce(fs.cipher)
+	if err != nil {
+		t.Fatalf("failed to generate nonce: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		padded bool
+		body   int
+	}{
+		{"body shorter than tag", false, 5},
+		{"padded body that does not decrypt", true, 40},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := NewFileHeader(fs.cipher, salt, nonce)
+			header.KDF = kdfParamsFor(fs.keyProvider)
+			if tt.padded {
+				header.Flags |= FlagPadded
+				header.SealedSize = make([]byte, sealedSizeSize)
+			}
+			var buf bytes.Buffer
+			header.WriteTo(&buf)
+			buf.Write(make([]byte, tt.body))
+
+			file, err := base.OpenFile("/corrupt.bin", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+			if err != nil {
+				t.Fatalf("failed to create base file: %v", err)
+			}
+			defer file.Close()
+			file.Write(buf.Bytes())
+
+			_, err = newStreamingFile(file, fs, DefaultStreamingConfig(), os.O_RDWR)
+			if !IsCorruptionError(err) {
+				t.Errorf("newStreamingFile = %v, want a CorruptionError", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package encryptfs
+
+import (
+	"os"
+	"strings"
+
+	"github.com/absfs/absfs"
+)
+
+// Capabilities reports which optional features an EncryptFS supports. Most
+// depend on the interfaces its base filesystem implements.
+type Capabilities struct {
+	// Symlinks is set when the base filesystem implements absfs.SymLinker,
+	// enabling Symlink, Readlink, Lstat and Lchown
+	Symlinks bool
+
+	// Clone is set when the base filesystem implements Cloner, so that Copy
+	// can clone ciphertext instead of re-encrypting it
+	Clone bool
+
+	// HardLinks is set when the base filesystem implements Linker,
+	// enabling Link
+	HardLinks bool
+
+	// Xattrs is always set: extended attributes are kept in encrypted
+	// sidecar files and need no support from the base filesystem
+	Xattrs bool
+
+	// DirSync is set when directories on the base filesystem can be synced,
+	// either through DirSyncer or by syncing a handle opened on them. Files
+	// created by a handle then have their directory entry synced by the
+	// handle's first Sync and by Close; otherwise the directory sync is
+	// skipped.
+	DirSync bool
+}
+
+// Capabilities reports the optional features available on the filesystem.
+// Methods for a missing feature return an error wrapping ErrNotSupported.
+func (e *EncryptFS) Capabilities() Capabilities {
+	_, clone := e.base.(Cloner)
+	_, hardLinks := e.base.(Linker)
+	_, symlinks := e.symLinker()
+	return Capabilities{
+		Symlinks:  symlinks,
+		Clone:     clone,
+		HardLinks: hardLinks,
+		Xattrs:    true,
+		DirSync:   e.canSyncDirs(),
+	}
+}
+
+// symLinker returns the base filesystem as an absfs.SymLinker. Symbolic
+// links need a real directory tree, so they are unavailable when directories
+// are flattened.
+func (e *EncryptFS) symLinker() (absfs.SymLinker, bool) {
+	if e.flat != nil {
+		return nil, false
+	}
+	linker, ok := e.base.(absfs.SymLinker)
+	return linker, ok
+}
+
+// Symlink creates newname as a symbolic link to oldname. The link target is
+// encrypted like a path: an absolute target is translated as any other path
+// on the filesystem, and each component of a relative target is encrypted
+// on its own, so the link resolves on the base filesystem and Readlink
+// returns the plaintext target. The target need not exist.
+func (e *EncryptFS) Symlink(oldname, newname string) error {
+	if err := e.checkTarget("symlink", newname); err != nil {
+		return err
+	}
+
+	linker, ok := e.symLinker()
+	if !ok {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: ErrNotSupported}
+	}
+
+	target, err := e.encryptLinkTarget(oldname)
+	if err != nil {
+		return err
+	}
+	encryptedPath, err := e.translatePath(newname)
+	if err != nil {
+		return err
+	}
+	if err := linker.Symlink(target, encryptedPath); err != nil {
+		return err
+	}
+	return e.recordLongNames(newname)
+}
+
+// Readlink returns the plaintext target of the symbolic link name
+func (e *EncryptFS) Readlink(name string) (string, error) {
+	if err := e.checkOp("readlink", name); err != nil {
+		return "", err
+	}
+
+	linker, ok := e.symLinker()
+	if !ok {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: ErrNotSupported}
+	}
+
+	encryptedPath, err := e.translatePath(name)
+	if err != nil {
+		return "", err
+	}
+	target, err := linker.Readlink(encryptedPath)
+	if err != nil {
+		return "", err
+	}
+
+	sep := string([]byte{e.base.Separator()})
+	if strings.HasPrefix(target, sep) {
+		return e.untranslatePath(target)
+	}
+	// Relative targets are resolved from the directory holding the link
+	dir := encryptedPath[:strings.LastIndex(encryptedPath, sep)+1]
+	return e.decryptPath(dir, target)
+}
+
+// Lstat returns file information like Stat, but describes a symbolic link
+// itself rather than the file it refers to
+func (e *EncryptFS) Lstat(name string) (os.FileInfo, error) {
+	if err := e.checkOp("lstat", name); err != nil {
+		return nil, err
+	}
+
+	linker, ok := e.symLinker()
+	if !ok {
+		return nil, &os.PathError{Op: "lstat", Path: name, Err: ErrNotSupported}
+	}
+
+	encryptedPath, err := e.translatePath(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := linker.Lstat(encryptedPath)
+	if err != nil {
+		return nil, err
+	}
+
+	encInfo := newEncryptedFileInfo(info, e.cipher)
+	encInfo.name = e.plaintextBase(e.logicalPath(name))
+	return encInfo, nil
+}
+
+// Lchown changes the owner and group of a file without following a
+// symbolic link
+func (e *EncryptFS) Lchown(name string, uid, gid int) error {
+	if err := e.checkOp("lchown", name); err != nil {
+		return err
+	}
+
+	linker, ok := e.symLinker()
+	if !ok {
+		return &os.PathError{Op: "lchown", Path: name, Err: ErrNotSupported}
+	}
+
+	encryptedPath, err := e.translatePath(name)
+	if err != nil {
+		return err
+	}
+	return linker.Lchown(encryptedPath, uid, gid)
+}
+
+// encryptLinkTarget encrypts the target of a symbolic link
+func (e *EncryptFS) encryptLinkTarget(target string) (string, error) {
+	sep := string([]byte{e.base.Separator()})
+	if strings.HasPrefix(normalizeSeparators(target, sep), sep) {
+		return e.translatePath(target)
+	}
+	encrypted, err := e.filenameEncryptor.EncryptPath(target)
+	if err != nil || e.longNames == nil {
+		return encrypted, err
+	}
+	return e.longNames.shorten(encrypted), nil
+}
@@ -0,0 +1,217 @@
+package encryptfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/memfs"
+)
+
+// plainFS hides every optional interface of the filesystem it wraps
+type plainFS struct {
+	absfs.FileSystem
+}
+
+// symlinkTestFS adds symbolic links to osTestFS. Targets are stored as given,
+// so only relative targets resolve inside the test directory.
+type symlinkTestFS struct {
+	*osTestFS
+}
+
+func (fs symlinkTestFS) Symlink(oldname, newname string) error {
+	return os.Symlink(oldname, filepath.Join(fs.root, newname))
+}
+
+func (fs symlinkTestFS) Readlink(name string) (string, error) {
+	return os.Readlink(filepath.Join(fs.root, name))
+}
+
+func (fs symlinkTestFS) Lstat(name string) (os.FileInfo, error) {
+	return os.Lstat(filepath.Join(fs.root, name))
+}
+
+func (fs symlinkTestFS) Lchown(name string, uid, gid int) error {
+	return os.Lchown(filepath.Join(fs.root, name), uid, gid)
+}
+
+func TestSymlink(t *testing.T) {
+	modes := []struct {
+		name   string
+		config func(c *Config)
+	}{
+		{"none", func(c *Config) {}},
+		{"deterministic", func(c *Config) {
+			c.FilenameEncryption = FilenameEncryptionDeterministic
+		}},
+		{"random", func(c *Config) {
+			c.FilenameEncryption = FilenameEncryptionRandom
+			c.MetadataPath = "/.metadata.json"
+		}},
+	}
+
+	for _, mode := range modes {
+		t.Run(mode.name, func(t *testing.T) {
+			osBase, cleanup := setupTestFS(t)
+			defer cleanup()
+			base := symlinkTestFS{osBase.(*osTestFS)}
+
+			config := &Config{
+				Cipher: CipherAES256GCM,
+				KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+					Memory:      64 * 1024,
+					Iterations:  1,
+					Parallelism: 2,
+				}),
+			}
+			mode.config(config)
+			fs, err := New(base, config)
+			if err != nil {
+				t.Fatalf("Failed to create EncryptFS: %v", err)
+			}
+
+			if caps := fs.Capabilities(); !caps.Symlinks || caps.Clone || !caps.Xattrs {
+				t.Errorf("Capabilities() = %+v, want symlinks and xattrs", caps)
+			}
+
+			if err := fs.MkdirAll("/data", 0755); err != nil {
+				t.Fatalf("MkdirAll failed: %v", err)
+			}
+			file, err := fs.Create("/data/secret.txt")
+			if err != nil {
+				t.Fatalf("Create failed: %v", err)
+			}
+			file.Write([]byte("linked content"))
+			file.Close()
+
+			for _, target := range []string{"/data/secret.txt", "data/secret.txt"} {
+				if err := fs.Symlink(target, "/link"); err != nil {
+					t.Fatalf("Symlink(%q) failed: %v", target, err)
+				}
+
+				got, err := fs.Readlink("/link")
+				if err != nil {
+					t.Fatalf("Readlink failed: %v", err)
+				}
+				if got != target {
+					t.Errorf("Readlink = %q, want %q", got, target)
+				}
+
+				encryptedLink, err := fs.translatePath("/link")
+				if err != nil {
+					t.Fatalf("translatePath failed: %v", err)
+				}
+				raw, err := base.Readlink(encryptedLink)
+				if err != nil {
+					t.Fatalf("base Readlink failed: %v", err)
+				}
+				if mode.name != "none" && strings.Contains(raw, "secret") {
+					t.Errorf("base link target %q reveals the plaintext name", raw)
+				}
+
+				info, err := fs.Lstat("/link")
+				if err != nil {
+					t.Fatalf("Lstat failed: %v", err)
+				}
+				if info.Mode()&os.ModeSymlink == 0 || info.Name() != "link" {
+					t.Errorf("Lstat = %q mode %v, want a symlink named link", info.Name(), info.Mode())
+				}
+
+				if err := fs.Lchown("/link", os.Getuid(), os.Getgid()); err != nil {
+					t.Errorf("Lchown failed: %v", err)
+				}
+
+				// Opening the link reads the file it refers to. Absolute
+				// targets point outside the test directory on the base.
+				if strings.HasPrefix(target, "/") {
+					if err := fs.Remove("/link"); err != nil {
+						t.Fatalf("Remove of the link failed: %v", err)
+					}
+					continue
+				}
+				file, err := fs.Open("/link")
+				if err != nil {
+					t.Fatalf("Open through the link failed: %v", err)
+				}
+				data, _ := io.ReadAll(file)
+				file.Close()
+				if string(data) != "linked content" {
+					t.Errorf("Content through the link = %q", data)
+				}
+
+				if err := fs.Remove("/link"); err != nil {
+					t.Fatalf("Remove of the link failed: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestCapabilities_Unsupported(t *testing.T) {
+	mem, err := memfs.NewFS()
+	if err != nil {
+		t.Fatalf("Failed to create memfs: %v", err)
+	}
+	keyProvider := NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+		Memory:      64 * 1024,
+		Iterations:  1,
+		Parallelism: 2,
+	})
+
+	fs, err := New(plainFS{mem}, &Config{Cipher: CipherAES256GCM, KeyProvider: keyProvider})
+	if err != nil {
+		t.Fatalf("Failed to create EncryptFS: %v", err)
+	}
+	if caps := fs.Capabilities(); caps.Symlinks || caps.Clone || !caps.Xattrs {
+		t.Errorf("Capabilities() = %+v, want only xattrs", caps)
+	}
+
+	file, err := fs.Create("/file.txt")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	file.Close()
+
+	_, lstatErr := fs.Lstat("/file.txt")
+	_, readlinkErr := fs.Readlink("/file.txt")
+	for name, err := range map[string]error{
+		"Symlink":  fs.Symlink("/file.txt", "/link"),
+		"Readlink": readlinkErr,
+		"Lstat":    lstatErr,
+		"Lchown":   fs.Lchown("/file.txt", os.Getuid(), os.Getgid()),
+	} {
+		if !errors.Is(err, ErrNotSupported) || !errors.Is(err, errors.ErrUnsupported) {
+			t.Errorf("%s: got %v, want ErrNotSupported", name, err)
+		}
+	}
+
+	// Flattened directories have no tree for links to live in
+	flat, err := New(mem, &Config{
+		Cipher:             CipherAES256GCM,
+		KeyProvider:        keyProvider,
+		FilenameEncryption: FilenameEncryptionRandom,
+		MetadataPath:       "/.metadata.json",
+		FlattenDirectories: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create EncryptFS: %v", err)
+	}
+	if flat.Capabilities().Symlinks {
+		t.Error("flattened filesystem reports symlink support")
+	}
+	if err := flat.Symlink("/file.txt", "/link"); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("Symlink on a flattened filesystem: got %v, want ErrNotSupported", err)
+	}
+
+	cloning, err := New(&cloningFS{FileSystem: plainFS{mem}}, &Config{Cipher: CipherAES256GCM, KeyProvider: keyProvider})
+	if err != nil {
+		t.Fatalf("Failed to create EncryptFS: %v", err)
+	}
+	if caps := cloning.Capabilities(); !caps.Clone || caps.Symlinks {
+		t.Errorf("Capabilities() = %+v, want clone support only", caps)
+	}
+}
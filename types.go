@@ -3,6 +3,7 @@ package encryptfs
 import (
 	"errors"
 	"hash"
+	"io"
 )
 
 // CipherSuite represents the encryption algorithm to use
@@ -43,6 +44,80 @@ const (
 	FilenameEncryptionRandom
 )
 
+// DirnameEncryption selects how directory names are encrypted when they
+// should be treated differently from file names
+type DirnameEncryption uint8
+
+const (
+	// DirnameEncryptionSame encrypts directory names like file names
+	DirnameEncryptionSame DirnameEncryption = iota
+	// DirnameEncryptionNone leaves directory names in plaintext
+	DirnameEncryptionNone
+	// DirnameEncryptionDeterministic encrypts directory names with SIV mode
+	DirnameEncryptionDeterministic
+)
+
+// LockPolicy selects what OpenFile does when Config.FileLocking is set and
+// the file is open by a handle the new one would conflict with
+type LockPolicy uint8
+
+const (
+	// LockNone does no locking; handles of the same file are independent
+	LockNone LockPolicy = iota
+	// LockWait blocks the open until the conflicting handles are closed
+	LockWait
+	// LockFailFast fails the open with ErrLocked
+	LockFailFast
+)
+
+// MetadataLoadPolicy selects what New does when the metadata database of
+// random filename encryption exists but cannot be loaded
+type MetadataLoadPolicy uint8
+
+const (
+	// MetadataFailClosed makes New return the load error, leaving the
+	// database untouched so that it can be repaired or the read retried
+	MetadataFailClosed MetadataLoadPolicy = iota
+	// MetadataStartFresh starts with an empty database, as if there were
+	// none. Files named by the lost mappings can no longer be found. The
+	// unreadable database is renamed to MetadataPath plus ".corrupt",
+	// replacing any earlier one, so that it can still be repaired.
+	MetadataStartFresh
+)
+
+// FilenameEncoding selects how deterministic filename ciphertexts are
+// encoded. SIV adds 16 bytes to each name before encoding, so a 255-byte
+// name limit allows plaintext names of up to 175 bytes with base64url, 143
+// with base32 and 111 with hex.
+type FilenameEncoding uint8
+
+const (
+	// FilenameEncodingBase64URL uses unpadded URL-safe base64, the shortest
+	// encoding. Names differ only in case, so it is unsafe on
+	// case-insensitive filesystems.
+	FilenameEncodingBase64URL FilenameEncoding = iota
+	// FilenameEncodingBase32 uses unpadded lowercase base32, which is safe on
+	// case-insensitive filesystems at 1.6 times the ciphertext length
+	FilenameEncodingBase32
+	// FilenameEncodingHex uses lowercase hexadecimal, which is safe on
+	// case-insensitive filesystems at twice the ciphertext length
+	FilenameEncodingHex
+)
+
+// String returns the string representation of the filename encoding
+func (f FilenameEncoding) String() string {
+	switch f {
+	case FilenameEncodingBase64URL:
+		return "base64url"
+	case FilenameEncodingBase32:
+		return "base32"
+	case FilenameEncodingHex:
+		return "hex"
+	default:
+		return "unknown"
+	}
+}
+
 // HashFunc represents hash function types for PBKDF2
 type HashFunc uint8
 
@@ -61,6 +136,44 @@ type PBKDF2Params struct {
 	KeySize    int      // Derived key size in bytes (default 32 for AES-256)
 }
 
+// KDFID identifies the key derivation function recorded in a file header
+type KDFID uint8
+
+const (
+	// KDFNone means no derivation parameters are recorded; the configured
+	// key provider is used as-is
+	KDFNone KDFID = iota
+	// KDFArgon2id identifies Argon2id key derivation
+	KDFArgon2id
+	// KDFPBKDF2 identifies PBKDF2 key derivation
+	KDFPBKDF2
+)
+
+// String returns the string representation of the KDF identifier
+func (k KDFID) String() string {
+	switch k {
+	case KDFNone:
+		return "none"
+	case KDFArgon2id:
+		return "argon2id"
+	case KDFPBKDF2:
+		return "pbkdf2"
+	default:
+		return "unknown"
+	}
+}
+
+// KDFParams describes how a file key was derived so that it can be
+// re-derived without knowing the original configuration
+type KDFParams struct {
+	ID          KDFID    // Key derivation function
+	Iterations  uint32   // Iterations (Argon2id time parameter or PBKDF2 rounds)
+	Memory      uint32   // Argon2id memory in KiB (unused for PBKDF2)
+	Parallelism uint8    // Argon2id parallelism (unused for PBKDF2)
+	HashFunc    HashFunc // PBKDF2 hash function (unused for Argon2id)
+	KeySize     uint16   // Derived key size in bytes
+}
+
 // Argon2idParams contains parameters for Argon2id key derivation
 type Argon2idParams struct {
 	Memory      uint32 // Memory in KiB (e.g., 64*1024 for 64MB)
@@ -139,23 +252,209 @@ type Config struct {
 	// KeyProvider supplies encryption keys
 	KeyProvider KeyProvider
 
+	// PasswordParams are the Argon2id parameters SetPassword gives the
+	// password key provider it creates. The presets choose them; New does
+	// not read them. Zero values take the NewPasswordKeyProvider defaults.
+	PasswordParams Argon2idParams
+
+	// RecoveryKey is a key of at least MinRawKeySize bytes under which a
+	// second copy of every new file's key is wrapped and stored in its
+	// header. A filesystem opened with NewRecoveryKeyProvider and this key
+	// can read those files without the password. It does not recover
+	// encrypted filenames, whose keys still derive from the password.
+	RecoveryKey []byte
+
 	// FilenameEncryption mode (Phase 3 feature)
 	FilenameEncryption FilenameEncryption
 
+	// DirnameEncryption encrypts directory names independently of file
+	// names, for example to keep directories navigable in plaintext while
+	// file names are encrypted. Since a path alone does not say what it
+	// names, its last component is taken to be a file unless a directory
+	// of that name exists or Mkdir or MkdirAll is creating one. Cannot be
+	// combined with FilenameEncryptionRandom or a FilenameEncryptor.
+	DirnameEncryption DirnameEncryption
+
 	// PreserveExtensions keeps file extensions visible when using filename encryption
 	PreserveExtensions bool
 
+	// FilenameEncoding selects the text encoding of deterministic filename
+	// ciphertexts. Use base32 or hex on case-insensitive base filesystems.
+	FilenameEncoding FilenameEncoding
+
+	// MaxFilenameLength is the longest plaintext path component, in bytes,
+	// that deterministic filename encryption accepts. Zero uses
+	// DefaultMaxFilenameLength and a negative value removes the limit.
+	MaxFilenameLength int
+
+	// FilenameEncryptor replaces the encryptor that FilenameEncryption,
+	// PreserveExtensions, FilenameEncoding and MaxFilenameLength would
+	// otherwise build from the master key. Set it to a
+	// MultiKeyFilenameEncryptor while rotating the filename key. It cannot
+	// be combined with FilenameEncryptionRandom.
+	FilenameEncryptor FilenameEncryptor
+
+	// HashLongComponents bounds the length of encrypted paths on the base
+	// filesystem, which grow with every component since each is encrypted
+	// separately. Encrypted components longer than LongComponentThreshold
+	// are stored under a hash of their name, and the full name is kept in
+	// an index file in the directory holding them. Requires deterministic
+	// filename encryption; stores written with it must be opened with it.
+	HashLongComponents bool
+
 	// MetadataPath is the path to store metadata for random filename encryption
 	MetadataPath string
 
+	// MetadataLoadPolicy selects what happens when the database at
+	// MetadataPath cannot be loaded. The zero value, MetadataFailClosed,
+	// makes New fail rather than silently discard every filename mapping.
+	MetadataLoadPolicy MetadataLoadPolicy
+
+	// FlattenDirectories stores every file as a UUID in the root of the base
+	// filesystem, keeping the logical directory tree only in the metadata
+	// database. Requires FilenameEncryptionRandom.
+	FlattenDirectories bool
+
+	// FilenameIDGenerator returns the names under which random filename
+	// encryption stores files and directories on the base filesystem. Nil
+	// uses random (version 4) UUIDs. An ID must be a valid filename that
+	// does not start with a dot; an ID already in use is discarded and
+	// another generated. Requires FilenameEncryptionRandom.
+	FilenameIDGenerator func() string
+
 	// ChunkSize for streaming encryption (Phase 4 feature)
 	ChunkSize int
 
-	// EnableSeek allows seeking within encrypted files (Phase 4 feature)
+	// WriteThrough makes each completed chunk of a chunked file durable as
+	// soon as it is written: the chunk and its index entry are written to
+	// the base file, which is then synced. By default chunks are buffered
+	// until the next chunk switch, Sync or Close, so a crash can lose them.
+	// Write-through trades throughput for durability.
+	WriteThrough bool
+
+	// FileLocking coordinates the handles that open the same file,
+	// including those of other EncryptFS instances over the same base
+	// filesystem in this process: any number of read-only handles, or a
+	// single handle that may write, can be open at once, so a reader never
+	// sees a file that a writer has only partly flushed. The lock is held
+	// until Close. With LockWait, a goroutine that opens a file it already
+	// holds in a conflicting mode deadlocks. Locks are not shared with
+	// other processes.
+	FileLocking LockPolicy
+
+	// EnableSeek has no effect: every file supports Seek, in the
+	// traditional and the chunked format alike. Honoring a false value
+	// would disable seeking for every config that leaves it unset.
+	//
+	// Deprecated: Seek is always available; leave EnableSeek unset.
 	EnableSeek bool
 
 	// Parallel controls parallel chunk processing (Phase 5 feature)
 	Parallel ParallelConfig
+
+	// ReadOnce suits files that are written once and read once, such as
+	// downloads being served. New files use the chunked format even when
+	// ChunkSize is zero, with DefaultChunkSize chunks, and chunked files keep
+	// no cache of decrypted chunks, so a reader holds one chunk of plaintext
+	// at a time rather than the whole file. Existing traditional files are
+	// still decrypted whole.
+	ReadOnce bool
+
+	// MaxInMemoryFileSize limits the on-disk size of files opened in
+	// traditional (non-chunked) mode, which are fully decrypted into memory.
+	// Zero means no limit other than the platform's: on 32-bit platforms a
+	// traditional file cannot exceed 2 GiB, and larger files need chunked
+	// mode.
+	MaxInMemoryFileSize int64
+
+	// VerifyAfterWrite reads back everything a file writes to the base
+	// filesystem, decrypts it and compares it to the plaintext written, to
+	// catch silent corruption by the storage. Traditional files are checked
+	// whole on Sync and Close. Chunked files are checked chunk by chunk as
+	// each is written, including by WriteBulk, and their header and chunk
+	// index whenever either is rewritten. A mismatch fails the write with a
+	// CorruptionError wrapping ErrWriteVerification. Reading everything
+	// back roughly doubles the cost of writing.
+	VerifyAfterWrite bool
+
+	// ComputeDigest records the SHA-256 digest of each file's plaintext in
+	// its header when the file is closed, sealed under a key derived from
+	// the file key so the header neither confirms guessed contents nor
+	// links identical files. The digest is available from the file's
+	// Digest method and is checked by VerifyEncryption.
+	ComputeDigest bool
+
+	// FormatDescriptor records a format descriptor in the header of each new
+	// file: the set of format features the file uses, authenticated with the
+	// rest of the header under the file key. Readers refuse files that use
+	// features they do not support, with an error naming them. Files written
+	// without one can be given one with UpgradeFormat.
+	FormatDescriptor bool
+
+	// PadSize pads the plaintext of traditional (non-chunked) files with
+	// zeros to a multiple of PadSize bytes before encryption, so that the
+	// base filesystem does not reveal exact file sizes. The true size is
+	// encrypted along with the plaintext, ahead of the padding, and sealed
+	// in the header, where Stat opens it. Zero disables padding.
+	PadSize int
+
+	// StreamFormat frames the body of new files. StreamFormatSTREAM writes
+	// the record framing of age's payload, which other STREAM
+	// implementations can decrypt given the file key, and seals each chunk
+	// of a chunked file as a STREAM record bound to its index and to the end
+	// of the file; it cannot be combined with PadSize. Existing files are
+	// read in the format they were written in.
+	StreamFormat StreamFormat
+
+	// KeyCacheSize is the number of derived file keys kept in memory so that
+	// reopening a file skips key derivation. Zero uses DefaultKeyCacheSize
+	// and a negative value disables the cache. Evicted keys are zeroed.
+	KeyCacheSize int
+
+	// SharedSalt derives one master key per filesystem from a salt stored
+	// in the keyfile at KeyfilePath, and expands each file's key from it
+	// with HKDF and a file ID recorded in the file header. Opening a file
+	// then costs no password key derivation. Intended for stores with a
+	// single password; files written without SharedSalt remain readable.
+	SharedSalt bool
+
+	// StoreConfig writes the cipher, filename settings and chunk size to an
+	// authenticated blob at ConfigBlobPath when New finds none, along with a
+	// filesystem salt. New reads an existing blob whether or not StoreConfig
+	// is set: settings left unset are taken from it, a setting that differs
+	// fails with ErrConfigMismatch, and the filename master key is derived
+	// from its salt, so filenames encrypt the same way in every session.
+	StoreConfig bool
+
+	// MaxPathDepth is the maximum number of components in a path passed to
+	// the filesystem. Zero uses DefaultMaxPathDepth.
+	MaxPathDepth int
+
+	// RetryPolicy retries base filesystem I/O that fails with a transient
+	// error while files are loaded and flushed. The zero value never retries.
+	RetryPolicy RetryPolicy
+
+	// Metrics, if set, is told about every encryption, decryption, key
+	// derivation and chunk cache lookup. Nil disables measurement.
+	Metrics Metrics
+
+	// Logger, if set, receives warnings about conditions that are allowed
+	// but likely unintended, such as a chunk size that is not a power of
+	// two or discarded filename metadata, and debug reports of retries.
+	// Nil discards them.
+	Logger Logger
+
+	// CheckNonces makes opening a chunked file fail with a CorruptionError
+	// if two of its chunks share a nonce, as EncryptFS.CheckNonces does.
+	// Every chunk header is read on open, so the check is off by default.
+	CheckNonces bool
+
+	// RandSource supplies the random bytes of every salt and nonce the
+	// filesystem generates, and must be safe for concurrent use. Nil uses
+	// crypto/rand.Reader. Any other source is for tests and known-answer
+	// vectors only: a predictable source makes keys guessable and a
+	// repeating one reuses nonces, which breaks the encryption.
+	RandSource io.Reader
 }
 
 // Validate checks if the configuration is valid
@@ -174,6 +473,19 @@ func (c *Config) Validate() error {
 		return errors.New("unsupported cipher suite")
 	}
 
+	// Validate PasswordParams, with the defaults SetPassword would apply
+	if c.PasswordParams != (Argon2idParams{}) {
+		params := NewPasswordKeyProvider(nil, c.PasswordParams).argon2Params
+		if err := params.Validate(); err != nil {
+			return err
+		}
+	}
+
+	// Validate RecoveryKey
+	if len(c.RecoveryKey) > 0 && len(c.RecoveryKey) < MinRawKeySize {
+		return errors.New("recovery key must be at least 32 bytes")
+	}
+
 	// Validate FilenameEncryption
 	if c.FilenameEncryption != FilenameEncryptionNone &&
 		c.FilenameEncryption != FilenameEncryptionDeterministic &&
@@ -181,11 +493,57 @@ func (c *Config) Validate() error {
 		return errors.New("unsupported filename encryption mode")
 	}
 
+	// Validate FilenameEncoding
+	if c.FilenameEncoding > FilenameEncodingHex {
+		return errors.New("unsupported filename encoding")
+	}
+
 	// Validate MetadataPath for random filename encryption
 	if c.FilenameEncryption == FilenameEncryptionRandom && c.MetadataPath == "" {
 		return errors.New("metadata path must be set when using random filename encryption")
 	}
 
+	// Validate FileLocking
+	if c.FileLocking > LockFailFast {
+		return errors.New("unsupported file locking policy")
+	}
+
+	// Validate MetadataLoadPolicy
+	if c.MetadataLoadPolicy > MetadataStartFresh {
+		return errors.New("unsupported metadata load policy")
+	}
+
+	// Random names come from the metadata database, not from a key
+	if c.FilenameEncryptor != nil && c.FilenameEncryption == FilenameEncryptionRandom {
+		return errors.New("a custom filename encryptor cannot be combined with random filename encryption")
+	}
+
+	// Validate DirnameEncryption
+	if c.DirnameEncryption > DirnameEncryptionDeterministic {
+		return errors.New("unsupported directory name encryption mode")
+	}
+	if c.DirnameEncryption != DirnameEncryptionSame {
+		if c.FilenameEncryption == FilenameEncryptionRandom {
+			return errors.New("directory name encryption cannot be combined with random filename encryption")
+		}
+		if c.FilenameEncryptor != nil {
+			return errors.New("directory name encryption cannot be combined with a custom filename encryptor")
+		}
+	}
+
+	// Hashed components are only looked up for deterministic names
+	if c.HashLongComponents && c.FilenameEncryption != FilenameEncryptionDeterministic {
+		return errors.New("hashing long components requires deterministic filename encryption")
+	}
+
+	// Flattened layout depends on the metadata database
+	if c.FlattenDirectories && c.FilenameEncryption != FilenameEncryptionRandom {
+		return errors.New("flattened directories require random filename encryption")
+	}
+	if c.FilenameIDGenerator != nil && c.FilenameEncryption != FilenameEncryptionRandom {
+		return errors.New("a filename ID generator requires random filename encryption")
+	}
+
 	// Validate ChunkSize
 	if c.ChunkSize < 0 {
 		return errors.New("chunk size cannot be negative")
@@ -202,27 +560,43 @@ func (c *Config) Validate() error {
 			return errors.New("chunk size must not exceed 16 MiB")
 		}
 
-		// Warn if not a power of 2 (not an error, but suboptimal)
-		// Check if power of 2: n & (n-1) == 0
-		if c.ChunkSize&(c.ChunkSize-1) != 0 {
-			// Not a power of 2 - this is allowed but not recommended
-			// Could log a warning here if we had a logger
-		}
+		// A size that is not a power of 2 is allowed but suboptimal; New
+		// warns about it through the Logger
+	}
+
+	// Validate MaxPathDepth
+	if c.MaxPathDepth < 0 {
+		return errors.New("max path depth cannot be negative")
+	}
+
+	// Validate RetryPolicy
+	if err := c.RetryPolicy.Validate(); err != nil {
+		return err
+	}
+
+	// Validate PadSize
+	if c.PadSize < 0 {
+		return errors.New("pad size cannot be negative")
+	}
+
+	// Validate StreamFormat
+	if c.StreamFormat > StreamFormatSTREAM {
+		return errors.New("unsupported stream format")
+	}
+	if c.StreamFormat == StreamFormatSTREAM && c.PadSize > 0 {
+		// STREAM records are not padded
+		return errors.New("STREAM format does not support padding")
+	}
+
+	// Validate MaxInMemoryFileSize
+	if c.MaxInMemoryFileSize < 0 {
+		return errors.New("max in-memory file size cannot be negative")
 	}
 
 	// Validate ParallelConfig
 	if c.Parallel.Enabled {
-		if c.Parallel.MaxWorkers < 0 {
-			return errors.New("parallel max workers cannot be negative")
-		}
-		if c.Parallel.MaxWorkers > 1024 {
-			return errors.New("parallel max workers must not exceed 1024")
-		}
-		if c.Parallel.MinChunksForParallel < 1 {
-			return errors.New("parallel min chunks threshold must be at least 1")
-		}
-		if c.Parallel.MinChunksForParallel > 1000 {
-			return errors.New("parallel min chunks threshold must not exceed 1000")
+		if err := c.Parallel.Validate(); err != nil {
+			return err
 		}
 
 		// Parallel processing requires chunked mode
@@ -237,12 +611,36 @@ func (c *Config) Validate() error {
 // KeyProvider is an interface for providing encryption keys
 type KeyProvider interface {
 	// DeriveKey derives an encryption key from the given salt
-	DeriveKey(salt []byte) ([]byte, error)
+	DeriveKey(salt []byte) (*SecretKey, error)
 
 	// GenerateSalt generates a new random salt
 	GenerateSalt() ([]byte, error)
 }
 
+// KDFParamsProvider is implemented by key providers whose derivation
+// parameters can be recorded in file headers. Files written through such a
+// provider can later be decrypted even if the configured parameters change.
+type KDFParamsProvider interface {
+	// KDFParams returns the parameters used for new keys
+	KDFParams() KDFParams
+
+	// DeriveKeyWithParams derives a key using explicit parameters
+	DeriveKeyWithParams(salt []byte, params KDFParams) (*SecretKey, error)
+}
+
+// KeyIDProvider is implemented by key providers that can name their key
+// with a non-secret identifier of at most MaxKeyIDSize bytes. New files
+// record the identifier in their header, so that a MultiKeyProvider can go
+// straight to the provider that wrote a file instead of trying each in turn.
+// The identifier must not help an attacker guess the key: a hash of a
+// password, for instance, would allow guesses to be checked offline without
+// running the KDF.
+type KeyIDProvider interface {
+	// KeyID returns the identifier of the provider's key, or nil if it has
+	// none
+	KeyID() []byte
+}
+
 // HashFuncToHash converts HashFunc to hash.Hash
 func HashFuncToHash(hf HashFunc) func() hash.Hash {
 	switch hf {
@@ -53,6 +53,36 @@ func TestConfig_Validate(t *testing.T) {
 			wantErr: true,
 			errMsg:  "chunk size cannot be negative",
 		},
+		{
+			name: "negative max in-memory file size",
+			config: &Config{
+				Cipher:              CipherAES256GCM,
+				KeyProvider:         NewPasswordKeyProvider([]byte("test"), Argon2idParams{Memory: 64 * 1024, Iterations: 1, Parallelism: 2}),
+				MaxInMemoryFileSize: -1,
+			},
+			wantErr: true,
+			errMsg:  "max in-memory file size cannot be negative",
+		},
+		{
+			name: "negative max path depth",
+			config: &Config{
+				Cipher:       CipherAES256GCM,
+				KeyProvider:  NewPasswordKeyProvider([]byte("test"), Argon2idParams{Memory: 64 * 1024, Iterations: 1, Parallelism: 2}),
+				MaxPathDepth: -1,
+			},
+			wantErr: true,
+			errMsg:  "max path depth cannot be negative",
+		},
+		{
+			name: "negative retry attempts",
+			config: &Config{
+				Cipher:      CipherAES256GCM,
+				KeyProvider: NewPasswordKeyProvider([]byte("test"), Argon2idParams{Memory: 64 * 1024, Iterations: 1, Parallelism: 2}),
+				RetryPolicy: RetryPolicy{MaxAttempts: -1},
+			},
+			wantErr: true,
+			errMsg:  "retry max attempts cannot be negative",
+		},
 		{
 			name: "chunk size too small",
 			config: &Config{
@@ -113,6 +143,28 @@ func TestConfig_Validate(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name: "flattened directories without random filename encryption",
+			config: &Config{
+				Cipher:             CipherAES256GCM,
+				KeyProvider:        NewPasswordKeyProvider([]byte("test"), Argon2idParams{Memory: 64 * 1024, Iterations: 1, Parallelism: 2}),
+				FilenameEncryption: FilenameEncryptionDeterministic,
+				FlattenDirectories: true,
+			},
+			wantErr: true,
+			errMsg:  "flattened directories require random filename encryption",
+		},
+		{
+			name: "unsupported filename encoding",
+			config: &Config{
+				Cipher:             CipherAES256GCM,
+				KeyProvider:        NewPasswordKeyProvider([]byte("test"), Argon2idParams{Memory: 64 * 1024, Iterations: 1, Parallelism: 2}),
+				FilenameEncryption: FilenameEncryptionDeterministic,
+				FilenameEncoding:   FilenameEncoding(99),
+			},
+			wantErr: true,
+			errMsg:  "unsupported filename encoding",
+		},
 		{
 			name: "parallel without chunked mode",
 			config: &Config{
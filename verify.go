@@ -0,0 +1,199 @@
+package encryptfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+)
+
+// VerifyStatus classifies the outcome of verifying a single file
+type VerifyStatus uint8
+
+const (
+	// VerifyOK means the file decrypted and matched its digest, if any
+	VerifyOK VerifyStatus = iota
+	// VerifyAuthFailed means no part of the file could be authenticated,
+	// which usually means it was encrypted with a different key
+	VerifyAuthFailed
+	// VerifyCorrupt means the file is structurally damaged, or part of it
+	// authenticated before the rest failed
+	VerifyCorrupt
+	// VerifyIOError means the file could not be read from the base filesystem
+	VerifyIOError
+)
+
+// String returns the string representation of the verify status
+func (s VerifyStatus) String() string {
+	switch s {
+	case VerifyOK:
+		return "ok"
+	case VerifyAuthFailed:
+		return "auth-failed"
+	case VerifyCorrupt:
+		return "corrupt"
+	case VerifyIOError:
+		return "io-error"
+	default:
+		return "unknown"
+	}
+}
+
+// VerifyResult describes the verification of a single file
+type VerifyResult struct {
+	Path     string       // Plaintext path of the file
+	Status   VerifyStatus // Outcome of the verification
+	Size     int64        // Size of the encrypted file on the base filesystem
+	Cipher   CipherSuite  // Cipher recorded in the header, if readable
+	Chunked  bool         // Whether the file uses the chunked format
+	ChunkIdx int          // Chunk that failed to verify, or -1
+	Err      error        // Cause of the failure, nil if Status is VerifyOK
+}
+
+// VerifyReport collects the results of VerifyAllEncryptionReport
+type VerifyReport struct {
+	Results []VerifyResult // One entry per file, in walk order
+}
+
+// Failed returns the results whose status is not VerifyOK
+func (r *VerifyReport) Failed() []VerifyResult {
+	var failed []VerifyResult
+	for _, result := range r.Results {
+		if result.Status != VerifyOK {
+			failed = append(failed, result)
+		}
+	}
+	return failed
+}
+
+// VerifyAllEncryptionReport verifies every file beneath root, a path in the
+// encrypted filesystem, and reports the outcome for each file. Unlike
+// VerifyAllEncryption it walks the plaintext tree, so it works with any base
+// filesystem and filename encryption mode. The returned error is only set if
+// root itself cannot be listed; failures of individual files are recorded in
+// the report.
+func (e *EncryptFS) VerifyAllEncryptionReport(root string) (*VerifyReport, error) {
+	report := &VerifyReport{}
+
+	entries, err := e.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+	e.verifyDir(report, root, entries)
+
+	return report, nil
+}
+
+// verifyDir appends the results for a directory's entries to the report,
+// descending into subdirectories
+func (e *EncryptFS) verifyDir(report *VerifyReport, dir string, entries []fs.DirEntry) {
+	for _, entry := range entries {
+		name := path.Join(dir, entry.Name())
+
+		if !entry.IsDir() {
+			report.Results = append(report.Results, e.verifyFile(name))
+			continue
+		}
+
+		children, err := e.ReadDir(name)
+		if err != nil {
+			report.Results = append(report.Results, VerifyResult{
+				Path:     name,
+				Status:   VerifyIOError,
+				ChunkIdx: -1,
+				Err:      err,
+			})
+			continue
+		}
+		e.verifyDir(report, name, children)
+	}
+}
+
+// verifyFile verifies a single file and classifies any failure
+func (e *EncryptFS) verifyFile(name string) VerifyResult {
+	result := VerifyResult{Path: name, ChunkIdx: -1}
+
+	size, header, chunked, err := e.readFileHeader(name)
+	result.Size = size
+	if err != nil {
+		result.Status, _ = classifyVerifyError(err, false)
+		result.Err = err
+		return result
+	}
+	result.Cipher = header.Cipher
+	result.Chunked = chunked
+
+	if err := e.VerifyEncryption(name); err != nil {
+		result.Status, result.ChunkIdx = classifyVerifyError(err, chunked)
+		result.Err = err
+	}
+	return result
+}
+
+// readFileHeader reads the header of an encrypted file directly from the
+// base filesystem, returning the on-disk size and whether the file is chunked
+func (e *EncryptFS) readFileHeader(name string) (int64, *FileHeader, bool, error) {
+	encryptedPath, err := e.translatePath(name)
+	if err != nil {
+		return 0, nil, false, err
+	}
+
+	file, err := e.base.Open(encryptedPath)
+	if err != nil {
+		return 0, nil, false, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, nil, false, err
+	}
+
+	header := &FileHeader{}
+	if _, err := header.ReadFrom(io.NewSectionReader(file, 0, info.Size())); err != nil {
+		return info.Size(), nil, false, NewCorruptionError(name, err.Error())
+	}
+
+	chunked, err := detectChunkedFormat(file, info.Size())
+	if err != nil {
+		return info.Size(), header, false, NewCorruptionError(name, err.Error())
+	}
+	return info.Size(), header, chunked, nil
+}
+
+// classifyVerifyError maps a verification failure to a status and, for
+// chunked files, the chunk that failed.
+//
+// An authentication tag mismatch cannot tell a wrong key from modified
+// ciphertext. Chunks are verified in order, so once an earlier chunk has
+// authenticated the key is known to be right and the failure is reported
+// as corruption.
+func classifyVerifyError(err error, chunked bool) (VerifyStatus, int) {
+	chunkIdx := -1
+
+	var corruption *CorruptionError
+	isCorruption := errors.As(err, &corruption)
+	if isCorruption && chunked && !errors.Is(err, ErrDigestMismatch) {
+		chunkIdx = int(corruption.ChunkIdx)
+	}
+
+	var ioErr *IOError
+	var pathErr *fs.PathError
+	switch {
+	case errors.Is(err, ErrAuthFailed):
+		if chunkIdx > 0 {
+			return VerifyCorrupt, chunkIdx
+		}
+		return VerifyAuthFailed, chunkIdx
+	case isCorruption,
+		errors.Is(err, ErrInvalidHeader),
+		errors.Is(err, ErrUnsupportedVersion),
+		errors.Is(err, ErrUnsupportedCipher),
+		errors.Is(err, io.EOF),
+		errors.Is(err, io.ErrUnexpectedEOF):
+		return VerifyCorrupt, chunkIdx
+	case errors.As(err, &ioErr), errors.As(err, &pathErr):
+		return VerifyIOError, chunkIdx
+	}
+	return VerifyCorrupt, chunkIdx
+}
@@ -0,0 +1,123 @@
+package encryptfs
+
+import (
+	"os"
+	"testing"
+
+	"github.com/absfs/memfs"
+)
+
+func TestVerifyAllEncryptionReport(t *testing.T) {
+	base, err := memfs.NewFS()
+	if err != nil {
+		t.Fatalf("Failed to create base filesystem: %v", err)
+	}
+
+	newFS := func(password string) *EncryptFS {
+		fs, err := New(base, &Config{
+			Cipher: CipherAES256GCM,
+			KeyProvider: NewPasswordKeyProvider([]byte(password), Argon2idParams{
+				Memory:      64 * 1024,
+				Iterations:  1,
+				Parallelism: 2,
+			}),
+			ChunkSize: 4 * 1024,
+		})
+		if err != nil {
+			t.Fatalf("Failed to create EncryptFS: %v", err)
+		}
+		return fs
+	}
+	fs := newFS("test-password")
+	other := newFS("other-password")
+
+	data := make([]byte, 10000)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+
+	if err := fs.MkdirAll("/dir", 0755); err != nil {
+		t.Fatalf("MkdirAll failed: %v", err)
+	}
+	for _, f := range []struct {
+		fs   *EncryptFS
+		path string
+	}{
+		{fs, "/good.bin"},
+		{other, "/dir/wrong-key.bin"},
+		{fs, "/dir/corrupt.bin"},
+	} {
+		file, err := f.fs.Create(f.path)
+		if err != nil {
+			t.Fatalf("Create(%q) failed: %v", f.path, err)
+		}
+		file.Write(data)
+		if err := file.Close(); err != nil {
+			t.Fatalf("Close(%q) failed: %v", f.path, err)
+		}
+	}
+
+	// Flip a ciphertext byte in the second chunk
+	raw, err := base.OpenFile("/dir/corrupt.bin", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("Failed to open base file: %v", err)
+	}
+	header := &FileHeader{}
+	if _, err := header.ReadFrom(raw); err != nil {
+		t.Fatalf("Failed to read header: %v", err)
+	}
+	index := header.newChunkIndex(0)
+	if _, err := index.ReadFrom(raw); err != nil {
+		t.Fatalf("Failed to read chunk index: %v", err)
+	}
+	pos := int64(index.ChunkOffsets[1]) + int64(4+len(header.Nonce)) + 10
+	b := make([]byte, 1)
+	raw.ReadAt(b, pos)
+	b[0] ^= 0xFF
+	raw.WriteAt(b, pos)
+	raw.Close()
+
+	report, err := fs.VerifyAllEncryptionReport("/")
+	if err != nil {
+		t.Fatalf("VerifyAllEncryptionReport failed: %v", err)
+	}
+
+	want := map[string]struct {
+		status   VerifyStatus
+		chunkIdx int
+	}{
+		"/good.bin":          {VerifyOK, -1},
+		"/dir/wrong-key.bin": {VerifyAuthFailed, 0},
+		"/dir/corrupt.bin":   {VerifyCorrupt, 1},
+	}
+	if len(report.Results) != len(want) {
+		t.Fatalf("Got %d results, want %d: %+v", len(report.Results), len(want), report.Results)
+	}
+	for _, result := range report.Results {
+		w, ok := want[result.Path]
+		if !ok {
+			t.Errorf("Unexpected result for %q", result.Path)
+			continue
+		}
+		if result.Status != w.status {
+			t.Errorf("%s: status = %v, want %v (err: %v)", result.Path, result.Status, w.status, result.Err)
+		}
+		if result.ChunkIdx != w.chunkIdx {
+			t.Errorf("%s: chunk = %d, want %d", result.Path, result.ChunkIdx, w.chunkIdx)
+		}
+		if result.Cipher != CipherAES256GCM || !result.Chunked || result.Size == 0 {
+			t.Errorf("%s: cipher=%v chunked=%v size=%d", result.Path, result.Cipher, result.Chunked, result.Size)
+		}
+		if (result.Err == nil) != (result.Status == VerifyOK) {
+			t.Errorf("%s: status %v with err %v", result.Path, result.Status, result.Err)
+		}
+	}
+
+	if failed := report.Failed(); len(failed) != 2 {
+		t.Errorf("Failed() returned %d results, want 2", len(failed))
+	}
+
+	if _, err := fs.VerifyAllEncryptionReport("/missing"); err == nil {
+		t.Error("VerifyAllEncryptionReport should fail for a missing root")
+	}
+}
@@ -0,0 +1,151 @@
+package encryptfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// verifyWrite reads back the file just written by flush, decrypts it and
+// compares the result to the buffered plaintext (Config.VerifyAfterWrite)
+func (f *encryptedFile) verifyWrite() error {
+	var plaintext []byte
+	err := f.fs.retry(func() error {
+		if _, err := f.base.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to seek to start: %w", err)
+		}
+		header := &FileHeader{}
+		if _, err := header.ReadFrom(f.base); err != nil {
+			return f.verifyError(fmt.Errorf("failed to read header: %w", err))
+		}
+		ciphertext, err := io.ReadAll(f.base)
+		if err != nil {
+			return fmt.Errorf("failed to read ciphertext: %w", err)
+		}
+
+		if header.Flags&FlagStream != 0 {
+			plaintext, err = f.fs.openStream(header.Cipher, f.streamKey, f.base.Name(), ciphertext)
+		} else {
+			plaintext, err = decryptWithAAD(f.engine, header.Nonce, ciphertext, f.aad)
+		}
+		if err == nil {
+			plaintext, err = header.unpadBody(f.base.Name(), plaintext)
+		}
+		if err != nil {
+			return f.verifyError(err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(plaintext, f.plaintext) {
+		return f.verifyError(errors.New("plaintext differs from what was written"))
+	}
+	return nil
+}
+
+// verifyError reports a failed read-back of the file's whole body
+func (f *encryptedFile) verifyError(err error) error {
+	return &CorruptionError{
+		Path:    f.base.Name(),
+		Message: fmt.Sprintf("read-back verification failed: %v", err),
+		Err:     ErrWriteVerification,
+	}
+}
+
+// verifyChunk reads back the chunk just written at offset by writeChunk,
+// decrypts it and compares the result to plaintext (Config.VerifyAfterWrite)
+func (cf *ChunkedFile) verifyChunk(chunkIdx uint32, last bool, offset int64, plaintext []byte) error {
+	chunkHeader := &EncryptedChunkHeader{}
+	ciphertext := make([]byte, len(plaintext)+cf.engine.Overhead())
+	err := cf.fs.retry(func() error {
+		if _, err := cf.base.Seek(offset, io.SeekStart); err != nil {
+			return NewIOError("seek", cf.base.Name(), err)
+		}
+		if _, err := chunkHeader.readWithNonceSize(cf.base, cf.nonceSize); err != nil {
+			return cf.verifyError(chunkIdx, fmt.Errorf("failed to read chunk header: %w", err))
+		}
+		if _, err := io.ReadFull(cf.base, ciphertext); err != nil {
+			return cf.verifyError(chunkIdx, fmt.Errorf("failed to read ciphertext: %w", err))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if int(chunkHeader.PlaintextSize) != len(plaintext) {
+		return cf.verifyError(chunkIdx, fmt.Errorf("chunk header size %d, want %d", chunkHeader.PlaintextSize, len(plaintext)))
+	}
+	got, err := cf.sealer.open(cf.engine, chunkHeader.Nonce, chunkIdx, last, ciphertext)
+	if err != nil {
+		return cf.verifyError(chunkIdx, err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		return cf.verifyError(chunkIdx, errors.New("plaintext differs from what was written"))
+	}
+	return nil
+}
+
+// verifyHeaders reads back the file header and chunk index just written and
+// compares them to the ones in memory (Config.VerifyAfterWrite)
+func (cf *ChunkedFile) verifyHeaders() error {
+	var want bytes.Buffer
+	if _, err := cf.fileHeader.WriteTo(&want); err != nil {
+		return fmt.Errorf("failed to encode file header: %w", err)
+	}
+	header := make([]byte, want.Len())
+	index := cf.fileHeader.newChunkIndex(0)
+	err := cf.fs.retry(func() error {
+		if _, err := cf.base.Seek(0, io.SeekStart); err != nil {
+			return NewIOError("seek", cf.base.Name(), err)
+		}
+		if _, err := io.ReadFull(cf.base, header); err != nil {
+			return cf.headersVerifyError(fmt.Errorf("failed to read file header: %w", err))
+		}
+		if _, err := index.ReadFrom(cf.base); err != nil {
+			return cf.headersVerifyError(fmt.Errorf("failed to read chunk index: %w", err))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(header, want.Bytes()) {
+		return cf.headersVerifyError(errors.New("file header differs from what was written"))
+	}
+	if index.ChunkSize != cf.chunkIndex.ChunkSize || index.ChunkCount != cf.chunkIndex.ChunkCount {
+		return cf.headersVerifyError(fmt.Errorf("chunk index records %d chunks of %d bytes, want %d of %d",
+			index.ChunkCount, index.ChunkSize, cf.chunkIndex.ChunkCount, cf.chunkIndex.ChunkSize))
+	}
+	for idx := range index.ChunkCount {
+		if index.ChunkOffsets[idx] != cf.chunkIndex.ChunkOffsets[idx] || index.PlaintextSizes[idx] != cf.chunkIndex.PlaintextSizes[idx] {
+			return cf.headersVerifyError(fmt.Errorf("chunk index entry %d differs from what was written", idx))
+		}
+	}
+	return nil
+}
+
+// headersVerifyError reports a failed read-back of the file header or chunk
+// index
+func (cf *ChunkedFile) headersVerifyError(err error) error {
+	return &CorruptionError{
+		Path:    cf.base.Name(),
+		Message: fmt.Sprintf("read-back verification failed: %v", err),
+		Err:     ErrWriteVerification,
+	}
+}
+
+// verifyError reports a failed read-back of a chunk
+func (cf *ChunkedFile) verifyError(chunkIdx uint32, err error) error {
+	return &CorruptionError{
+		Path:     cf.base.Name(),
+		ChunkIdx: chunkIdx,
+		Message:  fmt.Sprintf("read-back verification failed: %v", err),
+		Err:      ErrWriteVerification,
+	}
+}
@@ -0,0 +1,244 @@
+package encryptfs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/absfs/absfs"
+)
+
+// corruptingFS wraps a filesystem so that reads return the byte at offset
+// at of any file inverted, as if the disk had silently corrupted it. A
+// negative at disables corruption.
+type corruptingFS struct {
+	absfs.FileSystem
+	at int64
+}
+
+func (c *corruptingFS) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	file, err := c.FileSystem.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &corruptingFile{File: file, fs: c}, nil
+}
+
+type corruptingFile struct {
+	absfs.File
+	fs  *corruptingFS
+	pos int64
+}
+
+func (f *corruptingFile) corrupt(p []byte, off int64) {
+	if at := f.fs.at; at >= off && at < off+int64(len(p)) {
+		p[at-off] ^= 0xff
+	}
+}
+
+func (f *corruptingFile) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	f.corrupt(p[:n], f.pos)
+	f.pos += int64(n)
+	return n, err
+}
+
+func (f *corruptingFile) ReadAt(p []byte, off int64) (int, error) {
+	n, err := f.File.ReadAt(p, off)
+	f.corrupt(p[:n], off)
+	return n, err
+}
+
+func (f *corruptingFile) Write(p []byte) (int, error) {
+	n, err := f.File.Write(p)
+	f.pos += int64(n)
+	return n, err
+}
+
+func (f *corruptingFile) Seek(offset int64, whence int) (int64, error) {
+	pos, err := f.File.Seek(offset, whence)
+	if err == nil {
+		f.pos = pos
+	}
+	return pos, err
+}
+
+func TestVerifyAfterWrite(t *testing.T) {
+	keyProvider := NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+		Memory:      64 * 1024,
+		Iterations:  1,
+		Parallelism: 2,
+	})
+	data := bytes.Repeat([]byte("verify after write "), 1000)
+
+	tests := []struct {
+		name   string
+		config Config
+	}{
+		{"traditional", Config{Cipher: CipherAES256GCM}},
+		{"stream", Config{Cipher: CipherChaCha20Poly1305, StreamFormat: StreamFormatSTREAM}},
+		{"chunked", Config{Cipher: CipherAES256GCM, ChunkSize: 4096}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			osBase, cleanup := setupTestFS(t)
+			defer cleanup()
+			base := &corruptingFS{FileSystem: osBase, at: -1}
+			config := tt.config
+			config.KeyProvider = keyProvider
+			config.VerifyAfterWrite = true
+			fs, err := New(base, &config)
+			if err != nil {
+				t.Fatalf("failed to create EncryptFS: %v", err)
+			}
+			defer fs.Close()
+
+			write := func(path string) error {
+				file, err := fs.Create(path)
+				if err != nil {
+					t.Fatalf("failed to create %s: %v", path, err)
+				}
+				if _, err := file.Write(data); err != nil {
+					file.Close()
+					return err
+				}
+				return file.Close()
+			}
+
+			// Intact writes verify and read back
+			if err := write("/intact.txt"); err != nil {
+				t.Fatalf("failed to write intact file: %v", err)
+			}
+			compareTree(t, fs, "/", map[string][]byte{"/intact.txt": data})
+
+			// Flip a byte near the end of what is written, inside the last
+			// chunk or record
+			info, err := osBase.Stat("/intact.txt")
+			if err != nil {
+				t.Fatalf("failed to stat base file: %v", err)
+			}
+			base.at = info.Size() - 20
+
+			err = write("/corrupt.txt")
+			if !errors.Is(err, ErrWriteVerification) {
+				t.Fatalf("expected ErrWriteVerification, got %v", err)
+			}
+			var corruption *CorruptionError
+			if !errors.As(err, &corruption) {
+				t.Errorf("expected a CorruptionError, got %T", err)
+			}
+		})
+	}
+}
+
+func TestVerifyAfterWrite_Disabled(t *testing.T) {
+	osBase, cleanup := setupTestFS(t)
+	defer cleanup()
+	base := &corruptingFS{FileSystem: osBase, at: 100}
+	fs, err := New(base, &Config{
+		Cipher: CipherAES256GCM,
+		KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+			Memory:      64 * 1024,
+			Iterations:  1,
+			Parallelism: 2,
+		}),
+	})
+	if err != nil {
+		t.Fatalf("failed to create EncryptFS: %v", err)
+	}
+	defer fs.Close()
+
+	// Without verification the corruption goes unnoticed until the next read
+	file, err := fs.Create("/file.txt")
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	if _, err := file.Write(bytes.Repeat([]byte("x"), 500)); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatalf("close without verification failed: %v", err)
+	}
+
+	file, err = fs.Open("/file.txt")
+	if err == nil {
+		_, err = io.ReadAll(file)
+		file.Close()
+	}
+	if err == nil {
+		t.Error("expected the corrupted file to fail to read")
+	}
+}
+
+// TestVerifyAfterWrite_Chunked checks that the header and chunk index of
+// chunked files, and the chunks written by WriteBulk, are read back too
+func TestVerifyAfterWrite_Chunked(t *testing.T) {
+	const chunkSize = 4096
+
+	data := bytes.Repeat([]byte("verify after write "), 2000)
+	parallel := DefaultParallelConfig()
+	parallel.MinBytesForParallel = chunkSize
+
+	osBase, cleanup := setupTestFS(t)
+	defer cleanup()
+	base := &corruptingFS{FileSystem: osBase, at: -1}
+	fs, err := New(base, &Config{
+		Cipher: CipherAES256GCM,
+		KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+			Memory:      64 * 1024,
+			Iterations:  1,
+			Parallelism: 2,
+		}),
+		ChunkSize:        chunkSize,
+		Parallel:         parallel,
+		VerifyAfterWrite: true,
+	})
+	if err != nil {
+		t.Fatalf("failed to create EncryptFS: %v", err)
+	}
+	defer fs.Close()
+
+	write := func(path string) error {
+		file, err := fs.Create(path)
+		if err != nil {
+			return err
+		}
+		if _, err := file.(*ChunkedFile).WriteBulk(data); err != nil {
+			file.Close()
+			return err
+		}
+		return file.Close()
+	}
+
+	if err := write("/intact.bin"); err != nil {
+		t.Fatalf("failed to write intact file: %v", err)
+	}
+	compareTree(t, fs, "/", map[string][]byte{"/intact.bin": data})
+	headerSize := int64(readTestHeader(t, base, "/intact.bin").Size())
+	info, err := osBase.Stat("/intact.bin")
+	if err != nil {
+		t.Fatalf("failed to stat base file: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		at   int64
+	}{
+		{"header", headerSize - 1},
+		{"index entry", headerSize + chunkIndexPreambleSize},
+		{"bulk chunk", info.Size() - 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base.at = tt.at
+			defer func() { base.at = -1 }()
+
+			err := write("/" + tt.name)
+			if !errors.Is(err, ErrWriteVerification) {
+				t.Fatalf("expected ErrWriteVerification, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,222 @@
+package encryptfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/absfs/absfs"
+)
+
+// xattrSuffix is appended to a file's encrypted path to name the sidecar
+// that holds its extended attributes. Sidecars are encrypted like regular
+// files, so their contents are authenticated and bound to the key provider
+// rather than to a single EncryptFS instance. Their bodies are also bound to
+// the encrypted path of their file, so a sidecar moved or copied beside
+// another file fails to authenticate.
+const xattrSuffix = ".encryptfs-xattr"
+
+// xattrAAD returns the additional data that binds the attribute sidecar of
+// the file at encryptedPath to that path
+func xattrAAD(encryptedPath string) []byte {
+	return []byte("encryptfs xattr\x00" + encryptedPath)
+}
+
+// SetXattr sets an extended attribute on a file, replacing any previous
+// value. Attributes are encrypted and stored in a sidecar next to the file
+// on the base filesystem, which follows the file through Rename and is
+// deleted with it by Remove.
+func (e *EncryptFS) SetXattr(name, attr string, value []byte) error {
+	encryptedPath, err := e.xattrPath("setxattr", name)
+	if err != nil {
+		return err
+	}
+
+	attrs, err := e.readXattrs(encryptedPath)
+	if err != nil {
+		return err
+	}
+	attrs[attr] = value
+	return e.writeXattrs(encryptedPath, attrs)
+}
+
+// GetXattr returns the value of an extended attribute set by SetXattr. It
+// returns an error wrapping ErrNoXattr if the attribute is not set, and an
+// authentication error if the attribute sidecar has been tampered with.
+func (e *EncryptFS) GetXattr(name, attr string) ([]byte, error) {
+	encryptedPath, err := e.xattrPath("getxattr", name)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs, err := e.readXattrs(encryptedPath)
+	if err != nil {
+		return nil, err
+	}
+
+	value, ok := attrs[attr]
+	if !ok {
+		return nil, &os.PathError{Op: "getxattr", Path: name, Err: ErrNoXattr}
+	}
+	return value, nil
+}
+
+// xattrPath returns the encrypted path of a regular file, beside which its
+// attribute sidecar lies
+func (e *EncryptFS) xattrPath(op, name string) (string, error) {
+	if err := e.checkTarget(op, name); err != nil {
+		return "", err
+	}
+
+	info, err := e.Stat(name)
+	if err != nil {
+		return "", err
+	}
+	if info.IsDir() {
+		return "", &os.PathError{Op: op, Path: name, Err: errIsDir}
+	}
+
+	return e.translatePath(name)
+}
+
+// readXattrs decrypts the attributes stored in the sidecar of the file at
+// encryptedPath. A missing sidecar holds no attributes.
+func (e *EncryptFS) readXattrs(encryptedPath string) (map[string][]byte, error) {
+	return e.readSidecar(encryptedPath+xattrSuffix, encryptedPath)
+}
+
+// readSidecar decrypts the attributes stored in sidecar, which is bound to
+// the encrypted path bound. A missing sidecar holds no attributes.
+func (e *EncryptFS) readSidecar(sidecar, bound string) (map[string][]byte, error) {
+	attrs := make(map[string][]byte)
+
+	baseFile, err := e.base.OpenFile(sidecar, os.O_RDONLY, 0)
+	if os.IsNotExist(err) {
+		return attrs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	file, err := newBoundFile(baseFile, e, os.O_RDONLY, xattrAAD(bound))
+	if err != nil {
+		baseFile.Close()
+		return nil, err
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &attrs); err != nil {
+		return nil, NewCorruptionError(sidecar, fmt.Sprintf("invalid extended attributes: %v", err))
+	}
+	return attrs, nil
+}
+
+// writeXattrs encrypts attrs into the sidecar of the file at encryptedPath,
+// bound to that path
+func (e *EncryptFS) writeXattrs(encryptedPath string, attrs map[string][]byte) error {
+	data, err := json.Marshal(attrs)
+	if err != nil {
+		return fmt.Errorf("failed to encode extended attributes: %w", err)
+	}
+
+	flag := os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	baseFile, err := e.base.OpenFile(encryptedPath+xattrSuffix, flag, 0600)
+	if err != nil {
+		return err
+	}
+	file, err := newBoundFile(baseFile, e, flag, xattrAAD(encryptedPath))
+	if err != nil {
+		baseFile.Close()
+		return err
+	}
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// removeXattrs deletes the attribute sidecar of an encrypted path, if any
+func removeXattrs(base absfs.FileSystem, encryptedPath string) error {
+	if err := base.Remove(encryptedPath + xattrSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// copyXattrs copies the attributes of the file at one encrypted path, if
+// any, to the file at another, replacing the destination's. Sidecars are
+// bound to their path, so the copy is encrypted again for dst.
+func (e *EncryptFS) copyXattrs(src, dst string) error {
+	if _, err := e.base.Stat(src + xattrSuffix); err != nil {
+		return removeXattrs(e.base, dst)
+	}
+	attrs, err := e.readXattrs(src)
+	if err != nil {
+		return err
+	}
+	return e.writeXattrs(dst, attrs)
+}
+
+// renameXattrs moves the attributes along with a renamed file, encrypting
+// them again for its new path. The destination's previous attributes are
+// dropped, as its contents were. The sidecars beneath a renamed directory
+// moved with it, and are encrypted again for the new paths of their files.
+func (e *EncryptFS) renameXattrs(oldpath, newpath string) error {
+	if oldpath == newpath {
+		return nil
+	}
+	if info, err := e.base.Stat(newpath); err == nil && info.IsDir() {
+		return e.resealXattrs(oldpath, newpath)
+	}
+	if err := e.copyXattrs(oldpath, newpath); err != nil {
+		return err
+	}
+	return removeXattrs(e.base, oldpath)
+}
+
+// resealXattrs encrypts the sidecars beneath newdir, which was renamed from
+// olddir, again for the new paths of their files
+func (e *EncryptFS) resealXattrs(olddir, newdir string) error {
+	dir, err := e.base.Open(newdir)
+	if err != nil {
+		return err
+	}
+	infos, err := dir.Readdir(-1)
+	dir.Close()
+	if err != nil {
+		return err
+	}
+
+	sep := string([]byte{e.base.Separator()})
+	for _, child := range infos {
+		name := child.Name()
+		if name == "." || name == ".." {
+			continue
+		}
+		if child.IsDir() {
+			if err := e.resealXattrs(olddir+sep+name, newdir+sep+name); err != nil {
+				return err
+			}
+			continue
+		}
+		file, ok := strings.CutSuffix(name, xattrSuffix)
+		if !ok {
+			continue
+		}
+		attrs, err := e.readSidecar(newdir+sep+name, olddir+sep+file)
+		if err != nil {
+			return err
+		}
+		if err := e.writeXattrs(newdir+sep+file, attrs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package encryptfs
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+)
+
+func newXattrTestFS(t *testing.T, mode FilenameEncryption, flatten bool) (*EncryptFS, *osTestFS) {
+	t.Helper()
+
+	base, cleanup := setupTestFS(t)
+	t.Cleanup(cleanup)
+
+	config := &Config{
+		Cipher: CipherAES256GCM,
+		KeyProvider: NewPasswordKeyProvider([]byte("test-password"), Argon2idParams{
+			Memory:      64 * 1024,
+			Iterations:  1,
+			Parallelism: 2,
+		}),
+		FilenameEncryption: mode,
+		FlattenDirectories: flatten,
+	}
+	if mode == FilenameEncryptionRandom {
+		config.MetadataPath = "/.metadata.json"
+	}
+
+	fs, err := New(base, config)
+	if err != nil {
+		t.Fatalf("failed to create EncryptFS: %v", err)
+	}
+	return fs, base.(*osTestFS)
+}
+
+func TestXattr_RoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    FilenameEncryption
+		flatten bool
+	}{
+		{"none", FilenameEncryptionNone, false},
+		{"deterministic", FilenameEncryptionDeterministic, false},
+		{"random", FilenameEncryptionRandom, false},
+		{"flat", FilenameEncryptionRandom, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs, _ := newXattrTestFS(t, tt.mode, tt.flatten)
+
+			if err := fs.MkdirAll("/docs", 0755); err != nil {
+				t.Fatalf("MkdirAll failed: %v", err)
+			}
+			file, err := fs.Create("/docs/report.pdf")
+			if err != nil {
+				t.Fatalf("failed to create file: %v", err)
+			}
+			file.Write([]byte("%PDF"))
+			file.Close()
+
+			if _, err := fs.GetXattr("/docs/report.pdf", "content-type"); !errors.Is(err, ErrNoXattr) {
+				t.Errorf("GetXattr before SetXattr: got %v, want ErrNoXattr", err)
+			}
+
+			if err := fs.SetXattr("/docs/report.pdf", "content-type", []byte("application/pdf")); err != nil {
+				t.Fatalf("SetXattr failed: %v", err)
+			}
+			if err := fs.SetXattr("/docs/report.pdf", "tags", []byte("q3,finance")); err != nil {
+				t.Fatalf("SetXattr failed: %v", err)
+			}
+			if err := fs.SetXattr("/docs/report.pdf", "tags", []byte("q4")); err != nil {
+				t.Fatalf("SetXattr failed: %v", err)
+			}
+
+			// Attributes follow the file when it is renamed
+			if err := fs.Rename("/docs/report.pdf", "/docs/final.pdf"); err != nil {
+				t.Fatalf("Rename failed: %v", err)
+			}
+
+			want := map[string]string{"content-type": "application/pdf", "tags": "q4"}
+			checkAttrs := func(name string) {
+				t.Helper()
+				for attr, value := range want {
+					got, err := fs.GetXattr(name, attr)
+					if err != nil {
+						t.Fatalf("GetXattr(%q, %q) failed: %v", name, attr, err)
+					}
+					if !bytes.Equal(got, []byte(value)) {
+						t.Errorf("GetXattr(%q, %q) = %q, want %q", name, attr, got, value)
+					}
+				}
+			}
+			checkAttrs("/docs/final.pdf")
+
+			// And when their directory is renamed
+			if err := fs.Rename("/docs", "/papers"); err != nil {
+				t.Fatalf("Rename of directory failed: %v", err)
+			}
+			checkAttrs("/papers/final.pdf")
+			if err := fs.Rename("/papers", "/docs"); err != nil {
+				t.Fatalf("Rename of directory failed: %v", err)
+			}
+			checkAttrs("/docs/final.pdf")
+
+			// Sidecars are hidden from listings
+			entries, err := fs.ReadDir("/docs")
+			if err != nil {
+				t.Fatalf("ReadDir failed: %v", err)
+			}
+			if len(entries) != 1 || entries[0].Name() != "final.pdf" {
+				t.Errorf("ReadDir returned %d entries, want only final.pdf", len(entries))
+			}
+
+			// A file created in place of a removed one has no attributes
+			if err := fs.Remove("/docs/final.pdf"); err != nil {
+				t.Fatalf("Remove failed: %v", err)
+			}
+			file, err = fs.Create("/docs/final.pdf")
+			if err != nil {
+				t.Fatalf("failed to recreate file: %v", err)
+			}
+			file.Close()
+			if _, err := fs.GetXattr("/docs/final.pdf", "tags"); !errors.Is(err, ErrNoXattr) {
+				t.Errorf("GetXattr after Remove: got %v, want ErrNoXattr", err)
+			}
+		})
+	}
+}
+
+func TestXattr_Errors(t *testing.T) {
+	fs, _ := newXattrTestFS(t, FilenameEncryptionNone, false)
+
+	if err := fs.SetXattr("/missing.txt", "tag", []byte("x")); !os.IsNotExist(err) {
+		t.Errorf("SetXattr on missing file: got %v, want not-exist", err)
+	}
+
+	if err := fs.Mkdir("/dir", 0755); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+	if err := fs.SetXattr("/dir", "tag", []byte("x")); err == nil {
+		t.Error("SetXattr on a directory should fail")
+	}
+
+	if _, err := fs.Create("/note" + xattrSuffix); !errors.Is(err, ErrReservedPath) {
+		t.Errorf("Create with sidecar suffix: got %v, want ErrReservedPath", err)
+	}
+}
+
+func TestXattr_Tampered(t *testing.T) {
+	fs, base := newXattrTestFS(t, FilenameEncryptionNone, false)
+
+	file, err := fs.Create("/secret.txt")
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	file.Close()
+
+	if err := fs.SetXattr("/secret.txt", "owner", []byte("alice")); err != nil {
+		t.Fatalf("SetXattr failed: %v", err)
+	}
+
+	// Flip the last byte of the sidecar's authentication tag
+	sidecar := base.root + "/secret.txt" + xattrSuffix
+	data, err := os.ReadFile(sidecar)
+	if err != nil {
+		t.Fatalf("failed to read sidecar: %v", err)
+	}
+	data[len(data)-1] ^= 0xFF
+	if err := os.WriteFile(sidecar, data, 0600); err != nil {
+		t.Fatalf("failed to write sidecar: %v", err)
+	}
+
+	if _, err := fs.GetXattr("/secret.txt", "owner"); !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("GetXattr on tampered sidecar: got %v, want ErrAuthFailed", err)
+	}
+}
+
+func TestXattr_Swapped(t *testing.T) {
+	fs, base := newXattrTestFS(t, FilenameEncryptionNone, false)
+
+	for _, name := range []string{"/public.txt", "/secret.txt"} {
+		file, err := fs.Create(name)
+		if err != nil {
+			t.Fatalf("failed to create %s: %v", name, err)
+		}
+		file.Close()
+	}
+	if err := fs.SetXattr("/public.txt", "owner", []byte("mallory")); err != nil {
+		t.Fatalf("SetXattr failed: %v", err)
+	}
+	if err := fs.SetXattr("/secret.txt", "owner", []byte("alice")); err != nil {
+		t.Fatalf("SetXattr failed: %v", err)
+	}
+
+	// Sidecars are bound to their file, so one copied beside another file
+	// does not authenticate
+	data, err := os.ReadFile(base.root + "/public.txt" + xattrSuffix)
+	if err != nil {
+		t.Fatalf("failed to read sidecar: %v", err)
+	}
+	if err := os.WriteFile(base.root+"/secret.txt"+xattrSuffix, data, 0600); err != nil {
+		t.Fatalf("failed to write sidecar: %v", err)
+	}
+	if _, err := fs.GetXattr("/secret.txt", "owner"); !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("GetXattr on swapped sidecar: got %v, want ErrAuthFailed", err)
+	}
+}